@@ -0,0 +1,73 @@
+// Package acks with acknowledgement of commands
+package acks
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// MakeAckAddress returns the address acknowledgements are published on for the publisher of the
+// given address
+//  address of the publisher or one of its nodes, eg domain/publisherID/$identity
+// Returns "" if the address doesn't contain a domain and publisher ID
+func MakeAckAddress(address string) string {
+	segments := strings.Split(address, "/")
+	if len(segments) < 2 || segments[0] == "" || segments[1] == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s/%s", segments[0], segments[1], types.MessageTypeAck)
+}
+
+// NewCorrelationID returns a new random ID to correlate a command with its acknowledgement
+func NewCorrelationID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// PublishAck publishes the acknowledgement of a command to the publisher that sent it.
+// The acknowledgement is signed and encrypted with the public key of the command sender. Commands
+// without a correlation ID are not acknowledged.
+//  domain and publisherID of the publisher that received the command
+//  commandSender is the address of the sender of the command, eg domain/publisherID/$identity
+//  correlationID of the command
+//  status of the command
+//  errorText with the reason the command is rejected
+// Returns an error if the public key of the command sender is unknown
+func PublishAck(domain string, publisherID string, commandSender string, correlationID string,
+	status types.AckStatus, errorText string, messageSigner *messaging.MessageSigner) error {
+
+	if correlationID == "" {
+		return nil
+	}
+	ackAddr := MakeAckAddress(commandSender)
+	if ackAddr == "" {
+		return lib.MakeErrorf("PublishAck: Invalid sender '%s' of command %s", commandSender, correlationID)
+	}
+	var encryptionKey crypto.PublicKey
+	if messageSigner.GetPublicKey != nil {
+		encryptionKey = messageSigner.GetPublicKey(commandSender)
+	}
+	if encryptionKey == nil {
+		return lib.MakeErrorf("PublishAck: No public key of sender '%s' to encrypt the acknowledgement with", commandSender)
+	}
+	logrus.Infof("PublishAck: Command %s from %s is %s", correlationID, commandSender, status)
+	ackMessage := types.CommandAckMessage{
+		Address:       ackAddr,
+		CorrelationID: correlationID,
+		Error:         errorText,
+		Sender:        fmt.Sprintf("%s/%s/%s", domain, publisherID, types.MessageTypeIdentity),
+		Status:        status,
+		Timestamp:     time.Now().Format(types.TimeFormat),
+	}
+	return messageSigner.PublishObject(ackAddr, false, &ackMessage, encryptionKey)
+}
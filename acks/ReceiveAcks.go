@@ -0,0 +1,137 @@
+// Package acks with receiving of command acknowledgements
+package acks
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// pendingAck is a command that waits for its acknowledgement
+type pendingAck struct {
+	destination string                        // address the command is published to
+	received    chan *types.CommandAckMessage // receives the acknowledgement
+}
+
+// ReceiveAcks receives the acknowledgements of commands sent by this publisher.
+// Acknowledgements must be encrypted and signed by the publisher the command was sent to.
+type ReceiveAcks struct {
+	domain        string                       // the domain of this publisher
+	publisherID   string                       // this publisher
+	messageSigner *messaging.MessageSigner     // subscription and decryption of acknowledgements
+	pending       map[string]*pendingAck       // commands waiting for acknowledgement [correlationID]
+	subscription  messaging.SubscriptionHandle // handle of the subscription
+	updateMutex   *sync.Mutex                  // mutex for async handling of acknowledgements
+}
+
+// Start listening for acknowledgements
+func (receiveAcks *ReceiveAcks) Start() {
+	receiveAcks.updateMutex.Lock()
+	defer receiveAcks.updateMutex.Unlock()
+	addr := MakeAckAddress(receiveAcks.domain + "/" + receiveAcks.publisherID)
+	receiveAcks.subscription = receiveAcks.messageSigner.Subscribe(addr, receiveAcks.receiveAck)
+}
+
+// Stop listening for acknowledgements
+func (receiveAcks *ReceiveAcks) Stop() {
+	receiveAcks.updateMutex.Lock()
+	defer receiveAcks.updateMutex.Unlock()
+	receiveAcks.messageSigner.Unsubscribe(receiveAcks.subscription)
+}
+
+// WaitForAck publishes a command and waits for its acknowledgement
+//  ctx to limit the time to wait for the acknowledgement
+//  destination address of the command, used to verify the sender of the acknowledgement
+//  publish is invoked to publish the command with the given correlation ID
+// Returns the acknowledgement, or an error if publishing failed or ctx is done first
+func (receiveAcks *ReceiveAcks) WaitForAck(ctx context.Context, destination string,
+	publish func(correlationID string) error) (*types.CommandAckMessage, error) {
+
+	correlationID := NewCorrelationID()
+	pending := &pendingAck{destination: destination, received: make(chan *types.CommandAckMessage, 1)}
+	receiveAcks.updateMutex.Lock()
+	receiveAcks.pending[correlationID] = pending
+	receiveAcks.updateMutex.Unlock()
+	defer func() {
+		receiveAcks.updateMutex.Lock()
+		delete(receiveAcks.pending, correlationID)
+		receiveAcks.updateMutex.Unlock()
+	}()
+
+	err := publish(correlationID)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case ackMessage := <-pending.received:
+		return ackMessage, nil
+	case <-ctx.Done():
+		return nil, lib.MakeErrorf("WaitForAck: No acknowledgement of command to %s: %s", destination, ctx.Err())
+	}
+}
+
+// receiveAck handles an incoming acknowledgement. This:
+// - check if the message is encrypted and signed
+// - check if a command is waiting for the acknowledgement
+// - check if the acknowledgement is sent by the publisher of the command destination
+func (receiveAcks *ReceiveAcks) receiveAck(address string, message string) error {
+	var ackMessage types.CommandAckMessage
+
+	isEncrypted, isSigned, err := receiveAcks.messageSigner.DecodeMessage(message, &ackMessage)
+	if !isEncrypted {
+		return lib.MakeErrorf("receiveAck: Acknowledgement on '%s' is not encrypted. Message discarded.", address)
+	} else if !isSigned {
+		return lib.MakeErrorf("receiveAck: Acknowledgement on '%s' is not signed. Message discarded.", address)
+	} else if err != nil {
+		return lib.MakeErrorf("receiveAck: Acknowledgement on %s. Error %s'. Message discarded.", address, err)
+	}
+
+	receiveAcks.updateMutex.Lock()
+	pending := receiveAcks.pending[ackMessage.CorrelationID]
+	receiveAcks.updateMutex.Unlock()
+	if pending == nil {
+		logrus.Infof("receiveAck: No command waits for acknowledgement %s", ackMessage.CorrelationID)
+		return nil
+	}
+	if !samePublisher(ackMessage.Sender, pending.destination) {
+		return lib.MakeErrorf("receiveAck: Acknowledgement of command to %s is sent by %s. Message discarded.",
+			pending.destination, ackMessage.Sender)
+	}
+	select {
+	case pending.received <- &ackMessage:
+	default:
+		// already acknowledged, eg a duplicate
+	}
+	return nil
+}
+
+// samePublisher returns true if both addresses belong to the same publisher
+func samePublisher(address1 string, address2 string) bool {
+	segments1 := strings.Split(address1, "/")
+	segments2 := strings.Split(address2, "/")
+	if len(segments1) < 2 || len(segments2) < 2 {
+		return false
+	}
+	return segments1[0] == segments2[0] && segments1[1] == segments2[1]
+}
+
+// NewReceiveAcks returns a new instance of receiving command acknowledgements
+func NewReceiveAcks(
+	domain string,
+	publisherID string,
+	messageSigner *messaging.MessageSigner) *ReceiveAcks {
+
+	receiveAcks := &ReceiveAcks{
+		domain:        domain,
+		messageSigner: messageSigner,
+		pending:       make(map[string]*pendingAck),
+		publisherID:   publisherID,
+		updateMutex:   &sync.Mutex{},
+	}
+	return receiveAcks
+}
@@ -0,0 +1,105 @@
+package acks_test
+
+import (
+	"context"
+	"crypto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/acks"
+	"github.com/iotdomain/iotdomain-go/acl"
+	"github.com/iotdomain/iotdomain-go/inputs"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const domain = "test"
+const publisher1ID = "publisher1"
+const publisher2ID = "publisher2"
+const node1ID = "node1"
+
+const publisher1Addr = domain + "/" + publisher1ID + "/$identity"
+const publisher2Addr = domain + "/" + publisher2ID + "/$identity"
+
+func TestMakeAckAddress(t *testing.T) {
+	assert.Equal(t, "test/publisher1/$ack", acks.MakeAckAddress(publisher1Addr))
+	assert.Equal(t, "test/publisher1/$ack", acks.MakeAckAddress("test/publisher1/node1/$node"))
+	assert.Equal(t, "", acks.MakeAckAddress("test"))
+	assert.NotEqual(t, acks.NewCorrelationID(), acks.NewCorrelationID())
+}
+
+func TestSetInputAck(t *testing.T) {
+	key1 := messaging.CreateAsymKeys()
+	key2 := messaging.CreateAsymKeys()
+	getPublisherKey := func(address string) crypto.PublicKey {
+		if strings.HasPrefix(address, domain+"/"+publisher1ID+"/") {
+			return &key1.PublicKey
+		} else if strings.HasPrefix(address, domain+"/"+publisher2ID+"/") {
+			return &key2.PublicKey
+		}
+		return nil
+	}
+	msgr := messaging.NewDummyMessenger(nil)
+	signer1 := messaging.NewMessageSigner(msgr, key1, getPublisherKey)
+	signer2 := messaging.NewMessageSigner(msgr, key2, getPublisherKey)
+
+	// publisher1 has an input that publisher2 sets
+	registeredInputs := inputs.NewRegisteredInputs(domain, publisher1ID)
+	receiver := inputs.NewReceiveFromSetCommands(domain, publisher1ID, signer1, registeredInputs)
+	input := receiver.CreateInput(node1ID, types.InputTypeSwitch, types.DefaultInputInstance,
+		func(input *types.InputDiscoveryMessage, sender string, value string) {})
+	setAddr := inputs.MakeSetInputAddress(domain, publisher1ID, node1ID, types.InputTypeSwitch, types.DefaultInputInstance)
+	receiveAcks := acks.NewReceiveAcks(domain, publisher2ID, signer2)
+	receiveAcks.Start()
+	defer receiveAcks.Stop()
+	setInput := func(ctx context.Context, value string, signer *messaging.MessageSigner) (*types.CommandAckMessage, error) {
+		return receiveAcks.WaitForAck(ctx, input.Address, func(correlationID string) error {
+			return inputs.PublishSetInputWithCorrelationID(
+				setAddr, value, publisher2Addr, correlationID, signer, &key1.PublicKey)
+		})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	ack, err := setInput(ctx, "on", signer2)
+	require.NoError(t, err)
+	assert.Equal(t, types.AckStatusAccepted, ack.Status)
+	assert.Equal(t, publisher1Addr, ack.Sender)
+
+	// unsigned commands are not acknowledged, unauthorized commands are rejected
+	signer2.SetSignMessages(false)
+	unsignedCtx, unsignedCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer unsignedCancel()
+	_, err = setInput(unsignedCtx, "off", signer2)
+	signer2.SetSignMessages(true)
+	assert.Error(t, err)
+
+	accessControlList := acl.NewAccessControlList("", "", publisher1ID)
+	accessControlList.AddRule(acl.ACLRule{Sender: "admin", Address: "#"})
+	receiver.SetAuthorizer(accessControlList, nil)
+	ack, err = setInput(ctx, "off", signer2)
+	require.NoError(t, err)
+	assert.Equal(t, types.AckStatusRejected, ack.Status)
+	assert.Contains(t, ack.Error, "not authorized")
+	receiver.SetAuthorizer(nil, nil)
+
+	// an acknowledgement that isn't sent by the destination publisher is ignored
+	forger := messaging.NewMessageSigner(msgr, key2, getPublisherKey)
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shortCancel()
+	_, err = receiveAcks.WaitForAck(shortCtx, input.Address, func(correlationID string) error {
+		return acks.PublishAck(domain, publisher2ID, publisher2Addr, correlationID,
+			types.AckStatusAccepted, "", forger)
+	})
+	assert.Error(t, err)
+
+	// without receiver the command times out
+	receiver.DeleteInput(input.InputID)
+	shortCtx2, shortCancel2 := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shortCancel2()
+	_, err = setInput(shortCtx2, "on", signer2)
+	assert.Error(t, err)
+}
@@ -0,0 +1,151 @@
+// Package acl with a file based access control list
+package acl
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/sirupsen/logrus"
+)
+
+// ACLFile is the default filename of the access control list in the config folder
+const ACLFile = "acl.yaml"
+
+// ACLRule grants or denies senders the use of actions on nodes and inputs.
+// Sender and address support the message bus wildcards '+' for a single segment and '#' for the
+// remaining segments.
+type ACLRule struct {
+	Sender  string   `yaml:"sender"`         // identity address of the sender, eg domain/+/$identity
+	Address string   `yaml:"address"`        // node or input discovery address, eg domain/publisher1/#
+	Actions []string `yaml:"actions"`        // allowed actions, eg $configure. Empty for all actions
+	Deny    bool     `yaml:"deny,omitempty"` // deny instead of allow the actions
+}
+
+// aclFile is the yaml content of the access control list file
+type aclFile struct {
+	Rules []*ACLRule `yaml:"rules"`
+}
+
+// AccessControlList is an Authorizer with a list of rules. The first rule that matches the sender,
+// address and action determines whether the action is allowed. Without a matching rule the action
+// is denied. The list is persisted as a yaml file in the configuration folder:
+//  rules:
+//    - sender: domain1/admin/$identity
+//      address: domain1/{publisher}/#
+//    - sender: domain1/+/$identity
+//      address: domain1/{publisher}/+/switch/+/$input
+//      actions: [$setInput]
+type AccessControlList struct {
+	configFolder string     // folder of the acl file
+	filename     string     // acl filename
+	publisherID  string     // publisher whose nodes are protected, for {publisher} substitution
+	rules        []*ACLRule // rules in order of evaluation
+	updateMutex  *sync.Mutex
+}
+
+// AddRule appends a rule to the list
+func (acl *AccessControlList) AddRule(rule ACLRule) {
+	acl.updateMutex.Lock()
+	defer acl.updateMutex.Unlock()
+	acl.rules = append(acl.rules, &rule)
+}
+
+// GetRules returns a copy of the rules in order of evaluation
+func (acl *AccessControlList) GetRules() []ACLRule {
+	acl.updateMutex.Lock()
+	defer acl.updateMutex.Unlock()
+	ruleList := make([]ACLRule, 0, len(acl.rules))
+	for _, rule := range acl.rules {
+		ruleCopy := *rule
+		ruleCopy.Actions = append([]string{}, rule.Actions...)
+		ruleList = append(ruleList, ruleCopy)
+	}
+	return ruleList
+}
+
+// IsAuthorized returns true if the first rule that matches the sender, address and action allows
+// the action. Returns false if no rule matches.
+func (acl *AccessControlList) IsAuthorized(sender string, address string, action string) bool {
+	acl.updateMutex.Lock()
+	defer acl.updateMutex.Unlock()
+	for _, rule := range acl.rules {
+		if matchAddress(sender, rule.Sender) && matchAddress(address, rule.Address) &&
+			matchAction(action, rule.Actions) {
+			return !rule.Deny
+		}
+	}
+	return false
+}
+
+// Load the access control list from file. Existing rules are replaced.
+// If loading fails the existing rules are cleared so that all actions are denied.
+func (acl *AccessControlList) Load() error {
+	content := aclFile{}
+	err := lib.LoadYamlConfig(acl.configFolder, acl.filename, acl.publisherID, &content)
+	acl.updateMutex.Lock()
+	defer acl.updateMutex.Unlock()
+	acl.rules = make([]*ACLRule, 0)
+	if err != nil {
+		return lib.MakeErrorf("AccessControlList.Load: Unable to load '%s'. All actions are denied: %s", acl.filename, err)
+	}
+	for _, rule := range content.Rules {
+		if rule.Sender == "" || rule.Address == "" {
+			logrus.Warningf("AccessControlList.Load: Ignored rule without sender or address in %s", acl.filename)
+			continue
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+	return nil
+}
+
+// matchAction returns true if the action is in the list of actions or the list is empty
+func matchAction(action string, actions []string) bool {
+	if len(actions) == 0 {
+		return true
+	}
+	for _, allowed := range actions {
+		if allowed == action {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddress returns true if the address matches the pattern with wildcards '+' and '#'
+func matchAddress(address string, pattern string) bool {
+	patternSegments := strings.Split(pattern, "/")
+	addressSegments := strings.Split(address, "/")
+
+	for index, patternSegment := range patternSegments {
+		if patternSegment == "#" {
+			return true
+		} else if index >= len(addressSegments) {
+			return false
+		} else if patternSegment != "+" && patternSegment != addressSegments[index] {
+			return false
+		}
+	}
+	return len(patternSegments) == len(addressSegments)
+}
+
+// NewAccessControlList creates a new access control list persisted in the given file
+//  configFolder contains the acl file. Use "" for the default config folder.
+//  filename of the acl. Use "" for the default ACLFile.
+//  publisherID of the publisher whose nodes are protected, used to substitute {publisher} in the file.
+func NewAccessControlList(configFolder string, filename string, publisherID string) *AccessControlList {
+	if configFolder == "" {
+		configFolder = lib.DefaultConfigFolder
+	}
+	if filename == "" {
+		filename = ACLFile
+	}
+	acl := &AccessControlList{
+		configFolder: configFolder,
+		filename:     filename,
+		publisherID:  publisherID,
+		rules:        make([]*ACLRule, 0),
+		updateMutex:  &sync.Mutex{},
+	}
+	return acl
+}
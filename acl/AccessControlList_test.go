@@ -0,0 +1,62 @@
+package acl_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/iotdomain/iotdomain-go/acl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const aclText = `
+rules:
+  - sender: test/admin/$identity
+    address: test/{publisher}/#
+  - sender: test/+/$identity
+    address: test/{publisher}/node2/#
+    deny: true
+  - sender: test/+/$identity
+    address: test/{publisher}/+/switch/+/$input
+    actions: [$setInput]
+  - sender: test/noaddress/$identity
+`
+
+func TestAccessControlList(t *testing.T) {
+	const node1Addr = "test/publisher1/node1/$node"
+	const switchAddr = "test/publisher1/node1/switch/0/$input"
+	configFolder, _ := ioutil.TempDir("", "acl")
+	defer os.RemoveAll(configFolder)
+
+	// a missing acl denies everything
+	accessControlList := acl.NewAccessControlList(configFolder, "", "publisher1")
+	err := accessControlList.Load()
+	assert.Error(t, err, "Expected error loading a missing acl")
+	assert.False(t, accessControlList.IsAuthorized("test/admin/$identity", node1Addr, acl.ActionConfigure))
+
+	err = ioutil.WriteFile(path.Join(configFolder, acl.ACLFile), []byte(aclText), 0600)
+	require.NoError(t, err)
+	err = accessControlList.Load()
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(accessControlList.GetRules()), "Rule without address not ignored")
+
+	// admin can do everything
+	assert.True(t, accessControlList.IsAuthorized("test/admin/$identity", node1Addr, acl.ActionConfigure))
+	assert.True(t, accessControlList.IsAuthorized("test/admin/$identity", node1Addr, acl.ActionSetNodeID))
+	assert.False(t, accessControlList.IsAuthorized("test/admin/$identity", "test/publisher2/node1/$node", acl.ActionConfigure))
+	// others can only set switches
+	assert.True(t, accessControlList.IsAuthorized("test/user1/$identity", switchAddr, acl.ActionSetInput))
+	assert.False(t, accessControlList.IsAuthorized("test/user1/$identity", switchAddr, acl.ActionConfigure))
+	assert.False(t, accessControlList.IsAuthorized("test/user1/$identity", node1Addr, acl.ActionConfigure))
+	assert.False(t, accessControlList.IsAuthorized("test/user1/extra/$identity", switchAddr, acl.ActionSetInput))
+	// except on node2
+	assert.False(t, accessControlList.IsAuthorized("test/user1/$identity",
+		"test/publisher1/node2/switch/0/$input", acl.ActionSetInput))
+
+	// rules are evaluated in order
+	accessControlList.AddRule(acl.ACLRule{Sender: "test/user1/$identity", Address: "#"})
+	assert.False(t, accessControlList.IsAuthorized("test/user1/$identity", "test/publisher1/node2/$node", acl.ActionConfigure))
+	assert.True(t, accessControlList.IsAuthorized("test/user1/$identity", node1Addr, acl.ActionConfigure))
+}
@@ -0,0 +1,26 @@
+// Package acl with authorization of commands aimed at nodes and inputs of a publisher
+package acl
+
+import (
+	"github.com/iotdomain/iotdomain-go/types"
+)
+
+// Actions that require authorization. These are the message types of the commands.
+const (
+	ActionConfigure  = types.MessageTypeConfigure // configure a node
+	ActionCreateNode = types.MessageTypeCreate    // create a node
+	ActionDeleteNode = types.MessageTypeDelete    // delete a node
+	ActionSetInput   = types.MessageTypeSetInput  // set the value of an input
+	ActionSetNodeID  = types.MessageTypeSetNodeID // change the ID of a node
+	ActionUpgrade    = types.MessageTypeUpgrade   // upgrade the firmware of a node
+)
+
+// Authorizer determines if a sender is allowed to perform an action on a node or input.
+// Command receivers consult the authorizer after the message signature is verified.
+type Authorizer interface {
+	// IsAuthorized returns true if the sender is allowed to perform the action
+	//  sender is the identity address of the signer of the command: domain/publisher/$identity
+	//  address is the discovery address of the target node or input, eg domain/publisher/node/$node
+	//  action is the command message type, eg ActionConfigure
+	IsAuthorized(sender string, address string, action string) bool
+}
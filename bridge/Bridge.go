@@ -0,0 +1,398 @@
+// Package bridge with a bridge that forwards messages between two message busses.
+// The bridge connects zones that use different transports or servers, for example a local MQTT
+// broker and a remote NATS server. Rules select the domains, publishers and message types that
+// are forwarded in each direction and optionally rename the domain of unsigned messages on the
+// remote bus.
+package bridge
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/identities"
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Directions in which a rule forwards messages
+const (
+	DirectionBoth = "both" // forward in both directions (default)
+	DirectionIn   = "in"   // forward from the remote bus to the local bus
+	DirectionOut  = "out"  // forward from the local bus to the remote bus
+)
+
+// DefaultLoopWindow is the default nr of seconds a forwarded message is remembered to detect loops
+const DefaultLoopWindow = 10
+
+// DefaultRetainedTypes are the message types that are forwarded as retained messages when a rule
+// doesn't specify its retained types. Commands, acks, events and batches are not retained.
+var DefaultRetainedTypes = []string{
+	types.MessageTypeForecast,
+	types.MessageTypeHistory,
+	types.MessageTypeIdentity,
+	types.MessageTypeInputDiscovery,
+	types.MessageTypeLatest,
+	types.MessageTypeNodeDiscovery,
+	types.MessageTypeOutputDiscovery,
+	types.MessageTypeRaw,
+	types.MessageTypeRevocations,
+	types.MessageTypeStatus,
+}
+
+// BridgeConfig with the forwarding rules of a bridge
+type BridgeConfig struct {
+	LoopWindow       int          `yaml:"loopWindow,omitempty"`       // seconds to remember forwarded messages to detect loops. Default is DefaultLoopWindow
+	Rules            []BridgeRule `yaml:"rules"`                      // forwarding rules. The first matching rule of a direction is used
+	VerifySignatures bool         `yaml:"verifySignatures,omitempty"` // only forward messages from the remote bus with a valid signature
+}
+
+// BridgeRule selects the messages to forward
+type BridgeRule struct {
+	Direction     string   `yaml:"direction,omitempty"`     // in, out or both (default)
+	Domain        string   `yaml:"domain"`                  // domain on the local bus, required
+	MessageTypes  []string `yaml:"messageTypes,omitempty"`  // message types to forward, eg $node. Default is all types
+	Publisher     string   `yaml:"publisher,omitempty"`     // publisher to forward. Default is all publishers of the domain
+	RemoteDomain  string   `yaml:"remoteDomain,omitempty"`  // domain on the remote bus. Default is the same as the local domain. Signed messages are not renamed
+	RetainedTypes []string `yaml:"retainedTypes,omitempty"` // message types to forward as retained messages. Default is DefaultRetainedTypes
+}
+
+// BridgeMetrics with the counters of the messages handled by a bridge
+type BridgeMetrics struct {
+	Forwarded uint64 // messages forwarded
+	Loops     uint64 // messages not forwarded because the bridge itself forwarded them
+	Rejected  uint64 // messages not forwarded because their signature is invalid or their domain can't be renamed
+}
+
+// Bridge forwards messages between a local and a remote messenger
+// Messages that the bridge forwarded itself are not forwarded back, so rules in both directions
+// don't create a loop. When signatures are verified, messages from the remote bus must be signed
+// by a publisher whose identity is received on the remote bus. Encrypted messages are forwarded
+// as is as they can only be verified by their recipient.
+// Rules that rename the domain only forward unsigned messages. The address and sender in signed
+// and encrypted messages include the original domain and cannot be changed without invalidating
+// the signature, so consumers would reject them.
+type Bridge struct {
+	config           BridgeConfig
+	domainIdentities *identities.DomainPublisherIdentities                   // identities of the remote publishers
+	forwarded        map[bool]map[[sha256.Size]byte]time.Time                // hashes of forwarded messages with expiry, by destination (remote=true)
+	isRunning        bool                                                    // the bridge is forwarding messages
+	local            messaging.IMessenger                                    // messenger of the local bus
+	metrics          BridgeMetrics                                           // message counters
+	remote           messaging.IMessenger                                    // messenger of the remote bus
+	rxIdentities     *identities.ReceiveDomainPublisherIdentities            // receives the remote identities
+	subscriptions    map[messaging.IMessenger][]messaging.SubscriptionHandle // subscriptions by messenger
+	updateMutex      *sync.Mutex                                             // mutex for async forwarding of messages
+}
+
+// GetDomainIdentities returns the identities of the publishers received on the remote bus
+// These are used to verify the signatures of messages from the remote bus.
+func (bridge *Bridge) GetDomainIdentities() *identities.DomainPublisherIdentities {
+	return bridge.domainIdentities
+}
+
+// Metrics returns the counters of forwarded, looping and rejected messages
+func (bridge *Bridge) Metrics() BridgeMetrics {
+	bridge.updateMutex.Lock()
+	defer bridge.updateMutex.Unlock()
+	return bridge.metrics
+}
+
+// Start forwarding messages by subscribing to the addresses of the rules
+// The messengers must be connected separately.
+func (bridge *Bridge) Start() {
+	bridge.updateMutex.Lock()
+	if bridge.isRunning {
+		bridge.updateMutex.Unlock()
+		return
+	}
+	bridge.isRunning = true
+	bridge.updateMutex.Unlock()
+	logrus.Warningf("Bridge.Start: Starting bridge with %d rules", len(bridge.config.Rules))
+
+	if bridge.config.VerifySignatures {
+		bridge.rxIdentities.Start()
+	}
+	for index, rule := range bridge.config.Rules {
+		ruleIndex := index
+		if rule.Direction != DirectionOut {
+			bridge.subscribe(bridge.remote, ruleAddress(rule.RemoteDomain, rule.Publisher),
+				func(address string, message string) error {
+					return bridge.forward(ruleIndex, true, address, message)
+				})
+		}
+		if rule.Direction != DirectionIn {
+			bridge.subscribe(bridge.local, ruleAddress(rule.Domain, rule.Publisher),
+				func(address string, message string) error {
+					return bridge.forward(ruleIndex, false, address, message)
+				})
+		}
+	}
+}
+
+// Stop forwarding messages
+func (bridge *Bridge) Stop() {
+	bridge.updateMutex.Lock()
+	if !bridge.isRunning {
+		bridge.updateMutex.Unlock()
+		return
+	}
+	bridge.isRunning = false
+	subscriptions := bridge.subscriptions
+	bridge.subscriptions = make(map[messaging.IMessenger][]messaging.SubscriptionHandle)
+	bridge.updateMutex.Unlock()
+	logrus.Warningf("Bridge.Stop: Stopping bridge")
+
+	if bridge.config.VerifySignatures {
+		bridge.rxIdentities.Stop()
+	}
+	for messenger, handles := range subscriptions {
+		for _, handle := range handles {
+			messenger.Unsubscribe(handle)
+		}
+	}
+}
+
+// findRule returns the index of the first rule that forwards the address in the given direction
+// Returns -1 if no rule forwards the address
+func (bridge *Bridge) findRule(fromRemote bool, address string) int {
+	segments := strings.Split(address, "/")
+	if len(segments) < 3 {
+		return -1
+	}
+	messageType := segments[len(segments)-1]
+	for index, rule := range bridge.config.Rules {
+		domain := rule.Domain
+		if fromRemote {
+			domain = rule.RemoteDomain
+		}
+		if (fromRemote && rule.Direction == DirectionOut) || (!fromRemote && rule.Direction == DirectionIn) ||
+			segments[0] != domain || (rule.Publisher != "" && segments[1] != rule.Publisher) {
+			continue
+		}
+		if len(rule.MessageTypes) == 0 {
+			return index
+		}
+		for _, ruleType := range rule.MessageTypes {
+			if ruleType == messageType {
+				return index
+			}
+		}
+	}
+	return -1
+}
+
+// forward a message received by the subscription of a rule to the other bus
+// A message that matches several rules is forwarded by the first matching rule only.
+//  ruleIndex of the rule whose subscription received the message
+//  fromRemote is true for messages received on the remote bus
+//  address the message is received on
+//  message to forward
+//
+// Returns an error if the message signature is invalid or forwarding fails
+func (bridge *Bridge) forward(ruleIndex int, fromRemote bool, address string, message string) error {
+	if bridge.findRule(fromRemote, address) != ruleIndex {
+		return nil
+	}
+	rule := bridge.config.Rules[ruleIndex]
+	hash := sha256.Sum256([]byte(message))
+
+	bridge.updateMutex.Lock()
+	expiry, isForwarded := bridge.forwarded[fromRemote][hash]
+	if isForwarded && time.Now().Before(expiry) {
+		// the bridge forwarded this message to the bus it is received on
+		bridge.metrics.Loops++
+		bridge.updateMutex.Unlock()
+		return nil
+	}
+	bridge.updateMutex.Unlock()
+
+	if rule.RemoteDomain != rule.Domain && isSignedOrEncrypted(message) {
+		bridge.updateMutex.Lock()
+		bridge.metrics.Rejected++
+		bridge.updateMutex.Unlock()
+		logrus.Warningf("Bridge.forward: Signed message on %s is rejected as its domain cannot be renamed", address)
+		return lib.MakeErrorf("forward: Signed message on %s cannot be renamed to domain %s",
+			address, rule.RemoteDomain)
+	}
+	if fromRemote && bridge.config.VerifySignatures {
+		err := bridge.verifyMessage(address, message)
+		if err != nil {
+			bridge.updateMutex.Lock()
+			bridge.metrics.Rejected++
+			bridge.updateMutex.Unlock()
+			logrus.Warningf("Bridge.forward: Message on %s is rejected: %s", address, err)
+			return err
+		}
+	}
+
+	destination := bridge.remote
+	segments := strings.Split(address, "/")
+	segments[0] = rule.RemoteDomain
+	if fromRemote {
+		destination = bridge.local
+		segments[0] = rule.Domain
+	}
+	destAddress := strings.Join(segments, "/")
+	retained := false
+	for _, retainedType := range rule.RetainedTypes {
+		if retainedType == segments[len(segments)-1] {
+			retained = true
+			break
+		}
+	}
+
+	bridge.updateMutex.Lock()
+	bridge.removeExpired()
+	bridge.forwarded[!fromRemote][hash] = time.Now().Add(time.Duration(bridge.config.LoopWindow) * time.Second)
+	bridge.metrics.Forwarded++
+	bridge.updateMutex.Unlock()
+
+	logrus.Infof("Bridge.forward: %s -> %s", address, destAddress)
+	return destination.Publish(destAddress, retained, message)
+}
+
+// removeExpired removes the forwarded messages whose loop window has passed
+// Must be called within a locked section
+func (bridge *Bridge) removeExpired() {
+	now := time.Now()
+	for _, forwarded := range bridge.forwarded {
+		for hash, expiry := range forwarded {
+			if now.After(expiry) {
+				delete(forwarded, hash)
+			}
+		}
+	}
+}
+
+// subscribe to an address and track the subscription for Stop
+func (bridge *Bridge) subscribe(messenger messaging.IMessenger, address string,
+	handler func(address string, message string) error) {
+
+	handle := messenger.Subscribe(address, handler)
+	bridge.updateMutex.Lock()
+	bridge.subscriptions[messenger] = append(bridge.subscriptions[messenger], handle)
+	bridge.updateMutex.Unlock()
+}
+
+// verifyMessage verifies the signature of a message from the remote bus
+// Identities are verified by their issuer. Other messages must be signed by their sender,
+// which is the 'sender' or 'address' field of the message, or the publisher of the address.
+// The sender must be the publisher of the address the message is received on.
+// Returns an error if the message is not signed, the sender is not the publisher of the address,
+// or the signature is invalid
+func (bridge *Bridge) verifyMessage(address string, message string) error {
+	if strings.HasSuffix(address, "/"+types.MessageTypeIdentity) {
+		return bridge.rxIdentities.ReceiveDomainIdentity(address, message)
+	} else if _, err := jose.ParseEncrypted(message); err == nil {
+		// JWE encrypted message in compact or JSON serialization, the recipient verifies the
+		// signature after decryption
+		return nil
+	}
+	jwsSignature, err := jose.ParseSigned(message)
+	if err != nil {
+		return lib.MakeErrorf("verifyMessage: Message is not signed")
+	}
+	content := struct {
+		Address string `json:"address"`
+		Sender  string `json:"sender"`
+	}{}
+	_ = json.Unmarshal(jwsSignature.UnsafePayloadWithoutVerification(), &content)
+	sender := address
+	if content.Sender != "" {
+		sender = content.Sender
+	} else if content.Address != "" {
+		sender = content.Address
+	}
+	senderSegments := strings.Split(sender, "/")
+	addrSegments := strings.Split(address, "/")
+	if len(senderSegments) < 2 || len(addrSegments) < 2 ||
+		senderSegments[0] != addrSegments[0] || senderSegments[1] != addrSegments[1] {
+		return lib.MakeErrorf("verifyMessage: Sender %s is not the publisher of address %s", sender, address)
+	}
+	publicKey := bridge.domainIdentities.GetPublisherKey(sender)
+	if publicKey == nil {
+		return lib.MakeErrorf("verifyMessage: Sender %s is unknown", sender)
+	}
+	_, err = jwsSignature.Verify(publicKey)
+	if err != nil {
+		// the sender might have renewed its identity after signing the message
+		previousKey := bridge.domainIdentities.GetPreviousPublisherKey(sender)
+		if previousKey == nil {
+			return lib.MakeErrorf("verifyMessage: Invalid signature of sender %s", sender)
+		}
+		_, err = jwsSignature.Verify(previousKey)
+		if err != nil {
+			return lib.MakeErrorf("verifyMessage: Invalid signature of sender %s", sender)
+		}
+	}
+	return nil
+}
+
+// isSignedOrEncrypted returns true if the message is a JWS signed or JWE encrypted message
+func isSignedOrEncrypted(message string) bool {
+	if _, err := jose.ParseSigned(message); err == nil {
+		return true
+	}
+	_, err := jose.ParseEncrypted(message)
+	return err == nil
+}
+
+// ruleAddress returns the address to subscribe to for the messages of a domain and publisher
+func ruleAddress(domain string, publisherID string) string {
+	if publisherID == "" {
+		publisherID = "+"
+	}
+	return domain + "/" + publisherID + "/#"
+}
+
+// NewBridge creates a bridge that forwards messages between two messengers
+// Rules without remote domain use the local domain, rules without direction forward in both
+// directions and rules without retained types use DefaultRetainedTypes. Use Start to start forwarding.
+//
+//  config with the forwarding rules
+//  local messenger of the local bus
+//  remote messenger of the remote bus
+func NewBridge(config *BridgeConfig, local messaging.IMessenger, remote messaging.IMessenger) *Bridge {
+	bridgeConfig := *config
+	if bridgeConfig.LoopWindow <= 0 {
+		bridgeConfig.LoopWindow = DefaultLoopWindow
+	}
+	bridgeConfig.Rules = make([]BridgeRule, len(config.Rules))
+	for index, rule := range config.Rules {
+		if rule.Direction == "" {
+			rule.Direction = DirectionBoth
+		}
+		if rule.RemoteDomain == "" {
+			rule.RemoteDomain = rule.Domain
+		} else if rule.RemoteDomain != rule.Domain && bridgeConfig.VerifySignatures && rule.Direction != DirectionOut {
+			logrus.Warningf("NewBridge: Rule for domain %s renames the domain and only forwards unsigned messages. "+
+				"No messages from remote domain %s pass the signature verification.", rule.Domain, rule.RemoteDomain)
+		}
+		if rule.RetainedTypes == nil {
+			rule.RetainedTypes = DefaultRetainedTypes
+		}
+		bridgeConfig.Rules[index] = rule
+	}
+	domainIdentities := identities.NewDomainPublisherIdentities()
+	signer := messaging.NewMessageSigner(remote, nil, domainIdentities.GetPublisherKey)
+	bridge := &Bridge{
+		config:           bridgeConfig,
+		domainIdentities: domainIdentities,
+		forwarded: map[bool]map[[sha256.Size]byte]time.Time{
+			false: make(map[[sha256.Size]byte]time.Time),
+			true:  make(map[[sha256.Size]byte]time.Time),
+		},
+		local:         local,
+		remote:        remote,
+		rxIdentities:  identities.NewReceivePublisherIdentities("", domainIdentities, signer),
+		subscriptions: make(map[messaging.IMessenger][]messaging.SubscriptionHandle),
+		updateMutex:   &sync.Mutex{},
+	}
+	return bridge
+}
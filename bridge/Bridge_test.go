@@ -0,0 +1,133 @@
+package bridge_test
+
+import (
+	"crypto"
+	"testing"
+
+	"github.com/iotdomain/iotdomain-go/bridge"
+	"github.com/iotdomain/iotdomain-go/identities"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const node1Addr = "domain1/publisher1/node1/$node"
+const remoteNode1Addr = "remote1/publisher1/node1/$node"
+
+func TestForward(t *testing.T) {
+	local := messaging.NewDummyMessenger(nil)
+	remote := messaging.NewDummyMessenger(nil)
+	config := &bridge.BridgeConfig{Rules: []bridge.BridgeRule{
+		{Domain: "domain1", RemoteDomain: "remote1"},
+		{Domain: "domain2", Direction: bridge.DirectionOut, MessageTypes: []string{types.MessageTypeNodeDiscovery}},
+		{Domain: "domain2", Publisher: "publisher1", Direction: bridge.DirectionIn},
+	}}
+	testBridge := bridge.NewBridge(config, local, remote)
+	testBridge.Start()
+
+	// forward with the remote domain and don't forward back
+	err := local.Publish(node1Addr, true, "node1")
+	require.NoError(t, err)
+	assert.Equal(t, "node1", remote.FindLastPublication(remoteNode1Addr))
+	metrics := testBridge.Metrics()
+	assert.Equal(t, uint64(1), metrics.Forwarded)
+	assert.Equal(t, uint64(1), metrics.Loops)
+
+	err = remote.Publish("remote1/publisher2/$identity", true, "identity2")
+	require.NoError(t, err)
+	assert.Equal(t, "identity2", local.FindLastPublication("domain1/publisher2/$identity"))
+
+	// only the message types and directions of the rules are forwarded
+	local.Publish("domain2/publisher1/node1/$node", true, "node2")
+	local.Publish("domain2/publisher1/node1/temperature/0/$latest", true, "21.5")
+	remote.Publish("domain2/publisher1/node1/temperature/0/$latest", true, "22.5")
+	remote.Publish("domain2/publisher2/node1/temperature/0/$latest", true, "23.5")
+	local.Publish("domain3/publisher1/node1/$node", true, "node3")
+	assert.Equal(t, "node2", remote.FindLastPublication("domain2/publisher1/node1/$node"))
+	assert.Equal(t, "22.5", local.FindLastPublication("domain2/publisher1/node1/temperature/0/$latest"))
+	assert.Equal(t, "", local.FindLastPublication("domain2/publisher2/node1/temperature/0/$latest"))
+	assert.Equal(t, "", remote.FindLastPublication("domain3/publisher1/node1/$node"))
+	assert.Equal(t, uint64(4), testBridge.Metrics().Forwarded)
+
+	// a message that matches several rules is forwarded once
+	remote.Publish("domain2/publisher1/node2/$node", true, "node4")
+	assert.Equal(t, uint64(5), testBridge.Metrics().Forwarded)
+
+	// events are forwarded without retaining them
+	local.Publish("domain1/publisher1/node1/$event", true, "event1")
+	assert.Equal(t, "event1", remote.FindLastPublication("remote1/publisher1/node1/$event"))
+	retainedEvent := ""
+	remote.Subscribe("remote1/publisher1/node1/$event", func(address string, message string) error {
+		retainedEvent = message
+		return nil
+	})
+	assert.Equal(t, "", retainedEvent)
+
+	// signed messages can't be renamed as their content refers to the original domain
+	_, privKey := identities.CreateIdentity("domain1", "publisher1")
+	signer := messaging.NewMessageSigner(local, privKey, nil)
+	latestAddr := "domain1/publisher1/node1/temperature/0/$latest"
+	err = signer.PublishObject(latestAddr, true, &types.OutputLatestMessage{Address: latestAddr, Value: "20"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "", remote.FindLastPublication("remote1/publisher1/node1/temperature/0/$latest"))
+	assert.Equal(t, uint64(1), testBridge.Metrics().Rejected)
+
+	// no forwarding after stop
+	testBridge.Stop()
+	err = local.Publish(node1Addr, true, "stopped")
+	require.NoError(t, err)
+	assert.Equal(t, "node1", remote.FindLastPublication(remoteNode1Addr))
+}
+
+func TestVerifySignatures(t *testing.T) {
+	local := messaging.NewDummyMessenger(nil)
+	remote := messaging.NewDummyMessenger(nil)
+	config := &bridge.BridgeConfig{VerifySignatures: true, Rules: []bridge.BridgeRule{
+		{Domain: "domain1", Direction: bridge.DirectionIn},
+	}}
+	testBridge := bridge.NewBridge(config, local, remote)
+	testBridge.Start()
+	defer testBridge.Stop()
+
+	// the identity of the sender must be received before its messages are forwarded
+	fullIdentity, privKey := identities.CreateIdentity("domain1", "publisher1")
+	signer := messaging.NewMessageSigner(remote, privKey, nil)
+	node1 := &types.NodeDiscoveryMessage{Address: node1Addr, PublisherID: "publisher1", NodeID: "node1"}
+	err := signer.PublishObject(node1Addr, true, node1, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "", local.FindLastPublication("domain1/publisher1/node1/$node"))
+
+	identities.PublishIdentity(&fullIdentity.PublisherIdentityMessage, signer)
+	assert.NotEmpty(t, local.FindLastPublication("domain1/publisher1/$identity"))
+	require.NotNil(t, testBridge.GetDomainIdentities().GetPublisherKey(node1Addr))
+	err = signer.PublishObject(node1Addr, true, node1, nil)
+	require.NoError(t, err)
+	assert.NotEmpty(t, local.FindLastPublication("domain1/publisher1/node1/$node"))
+
+	// unsigned and forged messages are rejected
+	err = remote.Publish("domain1/publisher1/node2/$node", true, `{"address":"domain1/publisher1/node2/$node"}`)
+	require.NoError(t, err)
+	forger := messaging.NewMessageSigner(remote, messaging.CreateAsymKeys(), nil)
+	err = forger.PublishObject("domain1/publisher1/node3/$node", true,
+		&types.NodeDiscoveryMessage{Address: "domain1/publisher1/node3/$node"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "", local.FindLastPublication("domain1/publisher1/node2/$node"))
+	assert.Equal(t, "", local.FindLastPublication("domain1/publisher1/node3/$node"))
+
+	// a sender cannot publish on the address of another publisher
+	err = signer.PublishObject("domain1/publisher2/node1/$node", true, node1, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "", local.FindLastPublication("domain1/publisher2/node1/$node"))
+
+	// encrypted messages are verified by their recipients, including the JSON serialization
+	encrypted, err := messaging.EncryptMessageForRecipients("secret",
+		map[string]crypto.PublicKey{"domain1/publisher2/$identity": messaging.GetPublicKeyOf(privKey)})
+	require.NoError(t, err)
+	err = remote.Publish("domain1/publisher1/node1/temperature/0/$latest", true, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, encrypted, local.FindLastPublication("domain1/publisher1/node1/temperature/0/$latest"))
+	metrics := testBridge.Metrics()
+	assert.Equal(t, uint64(4), metrics.Rejected)
+	assert.Equal(t, uint64(3), metrics.Forwarded)
+}
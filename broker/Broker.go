@@ -0,0 +1,309 @@
+// Package broker with an embedded MQTT broker for standalone and test deployments
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/mqttpacket"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultAddress the broker listens on when no address is configured
+const DefaultAddress = "localhost:1883"
+
+// ConnectTimeout is the time a client has to send its connect request after opening a connection
+const ConnectTimeout = 10 * time.Second
+
+// BrokerConfig with the configuration of the embedded broker
+type BrokerConfig struct {
+	Address  string `yaml:"address,omitempty"`  // listen address, default is localhost:1883. Use port 0 for a free port
+	CAFile   string `yaml:"cafile,omitempty"`   // optional CA to require and verify client certificates with
+	CertFile string `yaml:"certfile,omitempty"` // optional server certificate, enables TLS
+	KeyFile  string `yaml:"keyfile,omitempty"`  // server private key, required with the server certificate
+}
+
+// retainedMessage with the time it expires
+type retainedMessage struct {
+	publish *mqttpacket.Publish
+	expires time.Time // zero if the message doesn't expire
+}
+
+// Broker is an embedded MQTT broker that accepts MQTT 3.1.1 and MQTT 5 clients. It supports
+// retained messages, wildcard subscriptions, last will and testament, and QoS 0 and 1.
+// Sessions are not persisted: every connection starts a clean session.
+type Broker struct {
+	config       *BrokerConfig
+	clients      map[string]*brokerClient    // connected clients by client ID
+	connections  map[*brokerClient]bool      // open connections, including those not yet connected
+	lastClientID int                         // counter for generating client IDs
+	listener     net.Listener                // listener for client connections, nil when stopped
+	retained     map[string]*retainedMessage // retained messages by topic
+	waitGroup    *sync.WaitGroup             // running connection goroutines
+	updateMutex  *sync.Mutex                 // mutex for async updating of clients and retained messages
+}
+
+// delivery of a message to a client with the combined options of its matching subscriptions
+type delivery struct {
+	client *brokerClient
+	qos    byte
+	retain bool
+	subIDs []uint32
+}
+
+// Address returns the address the broker listens on, including the port if a free port was
+// requested. Returns "" when the broker isn't running.
+func (broker *Broker) Address() string {
+	broker.updateMutex.Lock()
+	defer broker.updateMutex.Unlock()
+	if broker.listener == nil {
+		return ""
+	}
+	return broker.listener.Addr().String()
+}
+
+// Port returns the port the broker listens on, or 0 if the broker isn't running
+func (broker *Broker) Port() uint16 {
+	broker.updateMutex.Lock()
+	defer broker.updateMutex.Unlock()
+	if broker.listener == nil {
+		return 0
+	}
+	return uint16(broker.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Start listening for client connections
+// TLS is used when a server certificate is configured. Client certificates are required when a
+// CA is configured.
+// Returns an error if the certificates cannot be loaded or the address is not available
+func (broker *Broker) Start() error {
+	config := broker.config
+	address := config.Address
+	if address == "" {
+		address = DefaultAddress
+	}
+	var listener net.Listener
+	var err error
+	if config.CertFile != "" || config.KeyFile != "" {
+		tlsConfig, err2 := broker.makeTLSConfig()
+		if err2 != nil {
+			return err2
+		}
+		listener, err = tls.Listen("tcp", address, tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return lib.MakeErrorf("Broker.Start: Unable to listen on %s: %s", address, err)
+	}
+	broker.updateMutex.Lock()
+	broker.listener = listener
+	broker.updateMutex.Unlock()
+	logrus.Warningf("Broker.Start: Listening on %s. TLS=%v", listener.Addr(), config.CertFile != "")
+
+	broker.waitGroup.Add(1)
+	go func() {
+		defer broker.waitGroup.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			client := newBrokerClient(broker, conn)
+			broker.updateMutex.Lock()
+			if broker.listener == nil {
+				// stopped
+				broker.updateMutex.Unlock()
+				conn.Close()
+				return
+			}
+			broker.connections[client] = true
+			broker.updateMutex.Unlock()
+			broker.waitGroup.Add(1)
+			go func() {
+				defer broker.waitGroup.Done()
+				client.serve()
+				broker.updateMutex.Lock()
+				delete(broker.connections, client)
+				broker.updateMutex.Unlock()
+			}()
+		}
+	}()
+	return nil
+}
+
+// Stop the broker and close all client connections. Last wills are not published.
+// This waits until all connections are closed. Retained messages are kept for a restart.
+func (broker *Broker) Stop() {
+	broker.updateMutex.Lock()
+	listener := broker.listener
+	broker.listener = nil
+	connections := make([]*brokerClient, 0, len(broker.connections))
+	for client := range broker.connections {
+		connections = append(connections, client)
+	}
+	broker.updateMutex.Unlock()
+
+	if listener == nil {
+		return
+	}
+	logrus.Warningf("Broker.Stop: Closing %d client connections", len(connections))
+	listener.Close()
+	for _, client := range connections {
+		client.close(mqttpacket.ReasonServerShuttingDown, false)
+	}
+	broker.waitGroup.Wait()
+}
+
+// addClient registers a connected client. An existing client with the same ID is disconnected
+// and its last will is published.
+func (broker *Broker) addClient(client *brokerClient) {
+	broker.updateMutex.Lock()
+	if client.id == "" {
+		broker.lastClientID++
+		client.id = fmt.Sprintf("auto-%d-%d", time.Now().Unix(), broker.lastClientID)
+	}
+	existing := broker.clients[client.id]
+	broker.clients[client.id] = client
+	broker.updateMutex.Unlock()
+
+	if existing != nil {
+		logrus.Warningf("Broker.addClient: Client %s connected again. Closing the existing connection", client.id)
+		existing.close(mqttpacket.ReasonSessionTakenOver, true)
+	}
+}
+
+// makeTLSConfig loads the server certificate and the optional CA for verifying clients
+func (broker *Broker) makeTLSConfig() (*tls.Config, error) {
+	config := broker.config
+	serverCert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, lib.MakeErrorf("Broker.Start: Unable to load server certificate %s and key %s: %s",
+			config.CertFile, config.KeyFile, err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	if config.CAFile != "" {
+		caCert, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, lib.MakeErrorf("Broker.Start: Unable to read CA certificate %s: %s", config.CAFile, err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(caCert) {
+			return nil, lib.MakeErrorf("Broker.Start: No certificates found in CA certificate %s", config.CAFile)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// publish a message to the clients with a matching subscription and retain it if requested.
+// A retained message with an empty payload removes the retained message of the topic.
+//  sender is the client that published the message, nil for last will messages
+//  publish is the message to publish
+// Returns the number of clients the message is sent to
+func (broker *Broker) publish(sender *brokerClient, publish *mqttpacket.Publish) int {
+	broker.updateMutex.Lock()
+	if publish.Retain {
+		if len(publish.Payload) == 0 {
+			delete(broker.retained, publish.Topic)
+		} else {
+			retained := &retainedMessage{publish: publish}
+			if publish.Properties.MessageExpiry != 0 {
+				retained.expires = time.Now().Add(time.Duration(publish.Properties.MessageExpiry) * time.Second)
+			}
+			broker.retained[publish.Topic] = retained
+		}
+	}
+	deliveries := make([]*delivery, 0)
+	for _, client := range broker.clients {
+		var clientDelivery *delivery
+		for filter, subscription := range client.subscriptions {
+			if !mqttpacket.MatchTopic(publish.Topic, filter) || (subscription.NoLocal && client == sender) {
+				continue
+			}
+			if clientDelivery == nil {
+				clientDelivery = &delivery{client: client}
+				deliveries = append(deliveries, clientDelivery)
+			}
+			if subscription.QoS > clientDelivery.qos {
+				clientDelivery.qos = subscription.QoS
+			}
+			if subscription.RetainAsPublished && publish.Retain {
+				clientDelivery.retain = true
+			}
+			if subscription.id != 0 {
+				clientDelivery.subIDs = append(clientDelivery.subIDs, subscription.id)
+			}
+		}
+	}
+	broker.updateMutex.Unlock()
+
+	for _, clientDelivery := range deliveries {
+		qos := publish.QoS
+		if clientDelivery.qos < qos {
+			qos = clientDelivery.qos
+		}
+		clientDelivery.client.send(publish, qos, clientDelivery.retain, clientDelivery.subIDs, 0)
+	}
+	return len(deliveries)
+}
+
+// removeClient unregisters a client unless it was replaced by a new connection
+func (broker *Broker) removeClient(client *brokerClient) {
+	broker.updateMutex.Lock()
+	defer broker.updateMutex.Unlock()
+	if broker.clients[client.id] == client {
+		delete(broker.clients, client.id)
+	}
+}
+
+// sendRetained sends the retained messages that match a new subscription
+func (broker *Broker) sendRetained(client *brokerClient, filter string, subscription *brokerSubscription) {
+	now := time.Now()
+	broker.updateMutex.Lock()
+	messages := make([]*retainedMessage, 0)
+	for topic, retained := range broker.retained {
+		if !retained.expires.IsZero() && now.After(retained.expires) {
+			delete(broker.retained, topic)
+		} else if mqttpacket.MatchTopic(topic, filter) {
+			messages = append(messages, retained)
+		}
+	}
+	broker.updateMutex.Unlock()
+
+	subIDs := []uint32(nil)
+	if subscription.id != 0 {
+		subIDs = []uint32{subscription.id}
+	}
+	for _, retained := range messages {
+		qos := retained.publish.QoS
+		if subscription.QoS < qos {
+			qos = subscription.QoS
+		}
+		expiry := uint32(0)
+		if !retained.expires.IsZero() {
+			// remaining lifetime, at least 1 second
+			expiry = uint32(retained.expires.Sub(now)/time.Second) + 1
+		}
+		client.send(retained.publish, qos, true, subIDs, expiry)
+	}
+}
+
+// NewBroker creates a new embedded broker instance. Use Start to accept connections.
+func NewBroker(config *BrokerConfig) *Broker {
+	broker := &Broker{
+		config:      config,
+		clients:     make(map[string]*brokerClient),
+		connections: make(map[*brokerClient]bool),
+		retained:    make(map[string]*retainedMessage),
+		waitGroup:   &sync.WaitGroup{},
+		updateMutex: &sync.Mutex{},
+	}
+	return broker
+}
@@ -0,0 +1,279 @@
+// Package broker with the connection of a client to the broker
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/mqttpacket"
+	"github.com/sirupsen/logrus"
+)
+
+// brokerSubscription with the options of a client subscription
+type brokerSubscription struct {
+	mqttpacket.Subscription
+	id uint32 // subscription identifier of MQTT 5 clients. 0 if not provided
+}
+
+// brokerClient is the connection of a client to the broker
+type brokerClient struct {
+	broker        *Broker
+	conn          net.Conn
+	id            string                         // client ID
+	isClosed      bool                           // the connection is closed
+	isConnected   bool                           // the connect request is accepted
+	lastPacketID  uint16                         // packet ID of the last QoS 1 message sent
+	subscriptions map[string]*brokerSubscription // subscriptions by topic filter, guarded by the broker mutex
+	version       byte                           // protocol version of the client
+	will          *mqttpacket.Will               // last will, published when the connection is lost
+	writeMutex    *sync.Mutex                    // mutex for writing packets and closing the connection
+}
+
+// close the connection and optionally publish the last will
+// MQTT 5 clients are informed with a disconnect packet unless the reason is success.
+func (client *brokerClient) close(reasonCode byte, publishWill bool) {
+	client.writeMutex.Lock()
+	if client.isClosed {
+		client.writeMutex.Unlock()
+		return
+	}
+	if client.isConnected && client.version == mqttpacket.ProtocolVersion5 && reasonCode != mqttpacket.ReasonSuccess {
+		client.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = mqttpacket.WritePacket(client.conn, &mqttpacket.Disconnect{ReasonCode: reasonCode}, client.version)
+	}
+	client.isClosed = true
+	client.conn.Close()
+	will := client.will
+	client.will = nil
+	client.writeMutex.Unlock()
+
+	if publishWill && will != nil {
+		logrus.Infof("BrokerClient.close: Publishing last will of client %s on %s", client.id, will.Topic)
+		publish := &mqttpacket.Publish{
+			Topic:      will.Topic,
+			Payload:    will.Payload,
+			QoS:        will.QoS,
+			Retain:     will.Retain,
+			Properties: will.Properties,
+		}
+		publish.Properties.WillDelay = 0
+		client.broker.publish(nil, publish)
+	}
+}
+
+// handle a packet received from the client
+// Returns false if the connection is closed
+func (client *brokerClient) handle(packet mqttpacket.Packet) bool {
+	broker := client.broker
+
+	switch p := packet.(type) {
+	case *mqttpacket.Publish:
+		if !mqttpacket.ValidTopicName(p.Topic) {
+			client.close(mqttpacket.ReasonTopicNameInvalid, true)
+			return false
+		} else if p.QoS > 1 {
+			client.close(mqttpacket.ReasonQoSNotSupported, true)
+			return false
+		}
+		forward := *p
+		forward.Properties.SubscriptionIDs = nil
+		forward.Properties.TopicAlias = 0
+		count := broker.publish(client, &forward)
+		if p.QoS == 1 {
+			puback := &mqttpacket.Puback{PacketID: p.PacketID}
+			if count == 0 {
+				puback.ReasonCode = mqttpacket.ReasonNoMatchingSubscribers
+			}
+			client.write(puback)
+		}
+	case *mqttpacket.Puback:
+		// QoS 1 messages are not retransmitted so acknowledgements need no handling
+	case *mqttpacket.Subscribe:
+		suback := &mqttpacket.Suback{PacketID: p.PacketID}
+		subID := uint32(0)
+		if len(p.Properties.SubscriptionIDs) > 0 {
+			subID = p.Properties.SubscriptionIDs[0]
+		}
+		newSubscriptions := make([]*brokerSubscription, 0)
+		for _, subscription := range p.Subscriptions {
+			if !mqttpacket.ValidTopicFilter(subscription.Topic) {
+				suback.ReasonCodes = append(suback.ReasonCodes, mqttpacket.ReasonTopicFilterInvalid)
+				continue
+			} else if strings.HasPrefix(subscription.Topic, "$share/") {
+				suback.ReasonCodes = append(suback.ReasonCodes, mqttpacket.ReasonSharedSubNotSupported)
+				continue
+			}
+			if subscription.QoS > 1 {
+				subscription.QoS = 1
+			}
+			brokerSub := &brokerSubscription{Subscription: subscription, id: subID}
+			broker.updateMutex.Lock()
+			_, exists := client.subscriptions[subscription.Topic]
+			client.subscriptions[subscription.Topic] = brokerSub
+			broker.updateMutex.Unlock()
+			suback.ReasonCodes = append(suback.ReasonCodes, subscription.QoS)
+			if subscription.RetainHandling == 0 || (subscription.RetainHandling == 1 && !exists) {
+				newSubscriptions = append(newSubscriptions, brokerSub)
+			}
+		}
+		client.write(suback)
+		for _, subscription := range newSubscriptions {
+			broker.sendRetained(client, subscription.Topic, subscription)
+		}
+	case *mqttpacket.Unsubscribe:
+		unsuback := &mqttpacket.Unsuback{PacketID: p.PacketID}
+		broker.updateMutex.Lock()
+		for _, topic := range p.Topics {
+			if _, exists := client.subscriptions[topic]; exists {
+				delete(client.subscriptions, topic)
+				unsuback.ReasonCodes = append(unsuback.ReasonCodes, mqttpacket.ReasonSuccess)
+			} else {
+				unsuback.ReasonCodes = append(unsuback.ReasonCodes, mqttpacket.ReasonNoSubscriptionExisted)
+			}
+		}
+		broker.updateMutex.Unlock()
+		client.write(unsuback)
+	case *mqttpacket.Pingreq:
+		client.write(&mqttpacket.Pingresp{})
+	case *mqttpacket.Disconnect:
+		client.close(mqttpacket.ReasonSuccess, p.ReasonCode == mqttpacket.ReasonDisconnectWithWill)
+		return false
+	default:
+		logrus.Warningf("BrokerClient.handle: Unexpected packet type %d from client %s", packet.Type(), client.id)
+		client.close(mqttpacket.ReasonProtocolError, true)
+		return false
+	}
+	return true
+}
+
+// send a message to the client
+//  publish is the message to send
+//  qos to send the message with
+//  retain flag of the message
+//  subIDs are the identifiers of the subscriptions that match the message
+//  expiry is the remaining lifetime of the message in seconds. 0 to use the message expiry.
+func (client *brokerClient) send(publish *mqttpacket.Publish, qos byte, retain bool, subIDs []uint32, expiry uint32) {
+	forward := *publish
+	forward.QoS = qos
+	forward.Retain = retain
+	forward.Dup = false
+	forward.Properties.SubscriptionIDs = subIDs
+	if expiry != 0 {
+		forward.Properties.MessageExpiry = expiry
+	}
+	if qos > 0 {
+		client.writeMutex.Lock()
+		client.lastPacketID++
+		if client.lastPacketID == 0 {
+			client.lastPacketID = 1
+		}
+		forward.PacketID = client.lastPacketID
+		client.writeMutex.Unlock()
+	}
+	client.write(&forward)
+}
+
+// serve the client until the connection closes
+func (client *brokerClient) serve() {
+	conn := client.conn
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(ConnectTimeout))
+
+	packet, err := mqttpacket.ReadPacket(reader, 0)
+	if err == mqttpacket.ErrUnsupportedVersion {
+		connack := &mqttpacket.Connack{ReasonCode: mqttpacket.ReasonUnsupportedProtocolVersion}
+		_ = mqttpacket.WritePacket(conn, connack, mqttpacket.ProtocolVersion311)
+		conn.Close()
+		return
+	}
+	connect, isConnect := packet.(*mqttpacket.Connect)
+	if err != nil || !isConnect {
+		logrus.Warningf("BrokerClient.serve: Invalid connect request from %s", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	client.version = connect.ProtocolVersion
+	client.id = connect.ClientID
+	if connect.Will != nil {
+		will := *connect.Will
+		if will.QoS > 1 {
+			will.QoS = 1
+		}
+		client.will = &will
+	}
+	client.broker.addClient(client)
+	defer client.broker.removeClient(client)
+
+	maxQoS := byte(1)
+	sharedSubAvailable := byte(0)
+	connack := &mqttpacket.Connack{}
+	connack.Properties.MaximumQoS = &maxQoS
+	connack.Properties.SharedSubAvail = &sharedSubAvailable
+	if connect.ClientID == "" {
+		connack.Properties.AssignedClientID = client.id
+	}
+	client.writeMutex.Lock()
+	client.isConnected = true
+	client.writeMutex.Unlock()
+	if client.write(connack) != nil {
+		client.close(mqttpacket.ReasonSuccess, false)
+		return
+	}
+	logrus.Infof("BrokerClient.serve: Client %s connected from %s using protocol version %d",
+		client.id, conn.RemoteAddr(), client.version)
+
+	keepAlive := time.Duration(connect.KeepAlive) * time.Second
+	for {
+		if keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		packet, err = mqttpacket.ReadPacket(reader, client.version)
+		if err != nil {
+			reasonCode := mqttpacket.ReasonUnspecifiedError
+			if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() {
+				reasonCode = mqttpacket.ReasonKeepAliveTimeout
+			} else if err == mqttpacket.ErrMalformed {
+				reasonCode = mqttpacket.ReasonMalformedPacket
+			}
+			logrus.Infof("BrokerClient.serve: Connection with client %s ended: %s", client.id, err)
+			client.close(reasonCode, true)
+			return
+		}
+		if !client.handle(packet) {
+			return
+		}
+	}
+}
+
+// write a packet to the client
+// The connection is closed if writing fails.
+func (client *brokerClient) write(packet mqttpacket.Packet) error {
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+	if client.isClosed {
+		return errors.New("connection is closed")
+	}
+	client.conn.SetWriteDeadline(time.Now().Add(ConnectTimeout))
+	err := mqttpacket.WritePacket(client.conn, packet, client.version)
+	if err != nil {
+		client.conn.Close()
+	}
+	return err
+}
+
+// newBrokerClient creates a client for a new connection
+func newBrokerClient(broker *Broker, conn net.Conn) *brokerClient {
+	client := &brokerClient{
+		broker:        broker,
+		conn:          conn,
+		subscriptions: make(map[string]*brokerSubscription),
+		writeMutex:    &sync.Mutex{},
+	}
+	return client
+}
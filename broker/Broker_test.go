@@ -0,0 +1,255 @@
+package broker_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/broker"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/mqttpacket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const node1Addr = "domain1/publisher1/node1/$node"
+const valueAddr = "domain1/publisher1/node1/temperature/0/$latest"
+
+// start a broker on a free port
+func startBroker(t *testing.T, config *broker.BrokerConfig) *broker.Broker {
+	if config.Address == "" {
+		config.Address = "localhost:0"
+	}
+	testBroker := broker.NewBroker(config)
+	err := testBroker.Start()
+	require.NoError(t, err)
+	return testBroker
+}
+
+// receive a message from a channel with timeout. Returns "" on timeout.
+func receive(received chan string) string {
+	select {
+	case message := <-received:
+		return message
+	case <-time.After(3 * time.Second):
+		return ""
+	}
+}
+
+// write a self signed certificate and key for localhost
+func writeTestCert(t *testing.T, folder string) (certFile string, keyFile string) {
+	privKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	derCert, err := x509.CreateCertificate(rand.Reader, template, template, &privKey.PublicKey, privKey)
+	require.NoError(t, err)
+	derKey, _ := x509.MarshalECPrivateKey(privKey)
+	certFile = path.Join(folder, "localhost.crt")
+	keyFile = path.Join(folder, "localhost.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derCert}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: derKey}), 0600)
+	return certFile, keyFile
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	testBroker := startBroker(t, &broker.BrokerConfig{})
+	defer testBroker.Stop()
+
+	// MQTT 3.1.1 client
+	config3 := &messaging.MessengerConfig{Server: "localhost", Port: testBroker.Port(),
+		Transport: messaging.TransportTCP, PubQos: 1, SubQos: 1}
+	messenger3 := messaging.NewMqttMessenger(config3)
+	err := messenger3.Connect(context.Background(), "", "")
+	require.NoError(t, err)
+	defer messenger3.Disconnect()
+	// MQTT 5 client
+	config5 := &messaging.MessengerConfig{Server: "localhost", Port: testBroker.Port(),
+		Transport: messaging.TransportTCP, PubQos: 1, SubQos: 1}
+	messenger5 := messaging.NewMqtt5Messenger(config5)
+	err = messenger5.Connect(context.Background(), "", "")
+	require.NoError(t, err)
+	defer messenger5.Disconnect()
+
+	// retained messages are sent to new subscribers
+	err = messenger3.Publish(valueAddr, true, "21.5")
+	require.NoError(t, err)
+	received5 := make(chan string, 10)
+	handle5, err := messenger5.SubscribeWithProperties("domain1/+/+/+/+/$latest",
+		func(address string, message string, props *messaging.PublicationProperties) error {
+			received5 <- message
+			return nil
+		})
+	require.NoError(t, err)
+	assert.Equal(t, "21.5", receive(received5))
+
+	// messages are forwarded between protocol versions
+	received3 := make(chan string, 10)
+	messenger3.Subscribe("domain1/#", func(address string, message string) error {
+		received3 <- message
+		return nil
+	})
+	assert.Equal(t, "21.5", receive(received3))
+	err = messenger5.Publish(node1Addr, false, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", receive(received3))
+	err = messenger5.Publish(valueAddr, true, "22")
+	require.NoError(t, err)
+	assert.Equal(t, "22", receive(received5))
+	assert.Equal(t, "22", receive(received3))
+
+	// a retained message is removed with an empty message
+	err = messenger5.Publish(valueAddr, true, "")
+	require.NoError(t, err)
+	assert.Equal(t, "", receive(received3))
+	assert.Equal(t, "", receive(received5))
+	messenger5.Unsubscribe(handle5)
+	_, err = messenger5.SubscribeWithProperties(valueAddr,
+		func(address string, message string, props *messaging.PublicationProperties) error {
+			received5 <- message
+			return nil
+		})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, len(received5), "Removed retained message received")
+
+	// invalid subscriptions are rejected
+	_, err = messenger5.SubscribeWithProperties("domain1/#/$node",
+		func(address string, message string, props *messaging.PublicationProperties) error {
+			return nil
+		})
+	require.Error(t, err)
+	assert.Equal(t, mqttpacket.ReasonTopicFilterInvalid, err.(*messaging.ReasonCodeError).ReasonCode)
+}
+
+func TestExpiry(t *testing.T) {
+	testBroker := startBroker(t, &broker.BrokerConfig{})
+	defer testBroker.Stop()
+	config := &messaging.MessengerConfig{Server: "localhost", Port: testBroker.Port(),
+		Transport: messaging.TransportTCP, ValueExpiry: 1}
+	messenger := messaging.NewMqtt5Messenger(config)
+	err := messenger.Connect(context.Background(), "", "")
+	require.NoError(t, err)
+	defer messenger.Disconnect()
+
+	err = messenger.Publish(valueAddr, true, "21.5")
+	require.NoError(t, err)
+	err = messenger.Publish(node1Addr, true, "node1")
+	require.NoError(t, err)
+	time.Sleep(2100 * time.Millisecond)
+	received := make(chan string, 10)
+	_, err = messenger.SubscribeWithProperties("domain1/#",
+		func(address string, message string, props *messaging.PublicationProperties) error {
+			received <- message
+			return nil
+		})
+	require.NoError(t, err)
+	assert.Equal(t, "node1", receive(received))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, len(received), "Expired value received")
+}
+
+func TestLastWill(t *testing.T) {
+	const stateAddr = "domain1/publisher1/$state"
+	testBroker := startBroker(t, &broker.BrokerConfig{})
+	defer testBroker.Stop()
+
+	config := &messaging.MessengerConfig{Server: "localhost", Port: testBroker.Port(), Transport: messaging.TransportTCP}
+	messenger := messaging.NewMqtt5Messenger(config)
+	err := messenger.Connect(context.Background(), "", "")
+	require.NoError(t, err)
+	defer messenger.Disconnect()
+	received := make(chan string, 10)
+	_, err = messenger.SubscribeWithProperties(stateAddr,
+		func(address string, message string, props *messaging.PublicationProperties) error {
+			received <- message
+			return nil
+		})
+	require.NoError(t, err)
+
+	// connect using MQTT 3.1.1 and drop the connection
+	connect := &mqttpacket.Connect{
+		ProtocolVersion: mqttpacket.ProtocolVersion311,
+		ClientID:        "publisher1",
+		Will:            &mqttpacket.Will{Topic: stateAddr, Payload: []byte("lost"), QoS: 1},
+	}
+	conn, err := net.Dial("tcp", testBroker.Address())
+	require.NoError(t, err)
+	err = mqttpacket.WritePacket(conn, connect, 0)
+	require.NoError(t, err)
+	packet, err := mqttpacket.ReadPacket(bufio.NewReader(conn), mqttpacket.ProtocolVersion311)
+	require.NoError(t, err)
+	assert.Equal(t, mqttpacket.ReasonSuccess, packet.(*mqttpacket.Connack).ReasonCode)
+	conn.Close()
+	assert.Equal(t, "lost", receive(received))
+
+	// a graceful disconnect discards the will
+	conn, err = net.Dial("tcp", testBroker.Address())
+	require.NoError(t, err)
+	err = mqttpacket.WritePacket(conn, connect, 0)
+	require.NoError(t, err)
+	_, err = mqttpacket.ReadPacket(bufio.NewReader(conn), mqttpacket.ProtocolVersion311)
+	require.NoError(t, err)
+	err = mqttpacket.WritePacket(conn, &mqttpacket.Disconnect{}, mqttpacket.ProtocolVersion311)
+	require.NoError(t, err)
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, len(received), "Will published after graceful disconnect")
+
+	// MQTT 3.1 clients are not supported
+	conn, err = net.Dial("tcp", testBroker.Address())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte{0x10, 0x0C, 0x00, 0x06, 'M', 'Q', 'I', 's', 'd', 'p', 0x03, 0x02, 0x00, 0x00})
+	_, err = mqttpacket.ReadPacket(bufio.NewReader(conn), mqttpacket.ProtocolVersion311)
+	assert.Error(t, err, "Expected connection to close")
+}
+
+func TestTLS(t *testing.T) {
+	tempFolder, _ := ioutil.TempDir("", "broker")
+	defer os.RemoveAll(tempFolder)
+	certFile, keyFile := writeTestCert(t, tempFolder)
+
+	// mutual TLS, the self signed certificate is used by both the broker and the client
+	testBroker := startBroker(t, &broker.BrokerConfig{CertFile: certFile, KeyFile: keyFile, CAFile: certFile})
+	defer testBroker.Stop()
+	config := &messaging.MessengerConfig{Server: "localhost", Port: testBroker.Port(), Transport: messaging.TransportTLS,
+		CAFile: certFile, ClientCert: certFile, ClientKey: keyFile, PubQos: 1}
+	messenger := messaging.NewMqtt5Messenger(config)
+	err := messenger.Connect(context.Background(), "", "")
+	require.NoError(t, err)
+	err = messenger.Publish(node1Addr, false, "hello")
+	assert.NoError(t, err)
+	messenger.Disconnect()
+
+	// invalid certificates
+	invalidBroker := broker.NewBroker(&broker.BrokerConfig{Address: "localhost:0", CertFile: certFile, KeyFile: certFile})
+	err = invalidBroker.Start()
+	assert.Error(t, err)
+	invalidBroker = broker.NewBroker(&broker.BrokerConfig{Address: "localhost:0", CertFile: certFile, KeyFile: keyFile,
+		CAFile: keyFile})
+	err = invalidBroker.Start()
+	assert.Error(t, err)
+	assert.Equal(t, "", invalidBroker.Address())
+	assert.Equal(t, uint16(0), invalidBroker.Port())
+	invalidBroker.Stop()
+}
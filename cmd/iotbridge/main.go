@@ -0,0 +1,83 @@
+// Package main with the iotbridge command that forwards messages between a local and a remote
+// message bus. The configuration is loaded from iotbridge.yaml in the configuration folder.
+//
+// Example iotbridge.yaml:
+//  local:
+//    messenger: MQTTMessenger
+//    server: localhost
+//  remote:
+//    messenger: NATSMessenger
+//    server: nats.example.com
+//  bridge:
+//    verifySignatures: true
+//    rules:
+//      - domain: home
+//        messageTypes: [$identity, $node, $output, $latest]
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/bridge"
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/sirupsen/logrus"
+)
+
+// AppID of the bridge, used to load the configuration file <AppID>.yaml
+const AppID = "iotbridge"
+
+// BridgeAppConfig with the messengers and rules of the bridge
+type BridgeAppConfig struct {
+	Bridge   bridge.BridgeConfig       `yaml:"bridge"`             // forwarding rules
+	Local    messaging.MessengerConfig `yaml:"local"`              // messenger of the local bus
+	LogFile  string                    `yaml:"logFile,omitempty"`  // optional log file. Default logs to stderr
+	LogLevel string                    `yaml:"logLevel,omitempty"` // error, warning (default), info or debug
+	Remote   messaging.MessengerConfig `yaml:"remote"`             // messenger of the remote bus
+}
+
+func main() {
+	configFolder := flag.String("c", lib.DefaultConfigFolder, "folder with the "+AppID+lib.AppConfigSuffix+" configuration")
+	flag.Parse()
+
+	appConfig := BridgeAppConfig{LogLevel: "warning"}
+	err := lib.LoadAppConfig(*configFolder, AppID, &appConfig)
+	if err != nil {
+		logrus.Errorf("iotbridge: Unable to load the configuration: %s", err)
+		os.Exit(1)
+	}
+	lib.SetLogging(appConfig.LogLevel, appConfig.LogFile)
+
+	local := messaging.NewMessenger(&appConfig.Local)
+	remote := messaging.NewMessenger(&appConfig.Remote)
+	connect(local, "local")
+	connect(remote, "remote")
+	mainBridge := bridge.NewBridge(&appConfig.Bridge, local, remote)
+	mainBridge.Start()
+
+	// forward until terminated
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	mainBridge.Stop()
+	local.Disconnect()
+	remote.Disconnect()
+	metrics := mainBridge.Metrics()
+	logrus.Warningf("iotbridge: Stopped after forwarding %d messages. %d rejected.", metrics.Forwarded, metrics.Rejected)
+}
+
+// connect a messenger. If the bus isn't reachable then the messenger keeps trying in the background.
+func connect(messenger messaging.IMessenger, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), messaging.ConnectionTimeoutSec*time.Second)
+	defer cancel()
+	err := messenger.Connect(ctx, "", "")
+	if err != nil {
+		logrus.Warningf("iotbridge: The %s bus is not yet connected: %s", name, err)
+	}
+}
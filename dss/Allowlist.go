@@ -0,0 +1,188 @@
+// Package dss with the allowlist of publishers that are permitted in a secured domain
+package dss
+
+import (
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// AllowlistFile is the default filename of the DSS allowlist in the config folder
+const AllowlistFile = "dss-allowlist.yaml"
+
+// AllowlistEntry describes a publisher that is allowed to join the domain
+type AllowlistEntry struct {
+	PublisherID  string   `yaml:"publisherId"`            // ID of the publisher that is allowed
+	Organization string   `yaml:"organization,omitempty"` // organization included in the issued identity
+	Location     string   `yaml:"location,omitempty"`     // location included in the issued identity
+	PublicKey    string   `yaml:"publicKey,omitempty"`    // PEM key the publisher must join with. Required unless trustOnFirstUse
+	Revoked      string   `yaml:"revoked,omitempty"`      // timestamp the publisher was revoked, if revoked
+	RevokedKeys  []string `yaml:"revokedKeys,omitempty"`  // compromised PEM keys of the publisher
+}
+
+// allowlistFile is the yaml content of the allowlist file
+type allowlistFile struct {
+	Publishers []*AllowlistEntry `yaml:"publishers"`
+}
+
+// Allowlist with publishers that can receive an identity from the DSS.
+// The list is persisted as a yaml file in the configuration folder:
+//  publishers:
+//    - publisherId: publisher1
+//      organization: iotdomain.org
+type Allowlist struct {
+	configFolder string                     // folder of the allowlist file
+	filename     string                     // allowlist filename
+	entries      map[string]*AllowlistEntry // entries by publisherID
+	updateMutex  *sync.Mutex
+}
+
+// AddPublisher adds or replaces a publisher in the allowlist
+// Use Save to persist the change.
+func (allowlist *Allowlist) AddPublisher(entry AllowlistEntry) {
+	allowlist.updateMutex.Lock()
+	defer allowlist.updateMutex.Unlock()
+	allowlist.entries[entry.PublisherID] = &entry
+}
+
+// GetAllPublishers returns a copy of all entries in the allowlist ordered by publisherID
+func (allowlist *Allowlist) GetAllPublishers() []AllowlistEntry {
+	allowlist.updateMutex.Lock()
+	defer allowlist.updateMutex.Unlock()
+	entryList := make([]AllowlistEntry, 0, len(allowlist.entries))
+	for _, entry := range allowlist.entries {
+		entryCopy := *entry
+		entryCopy.RevokedKeys = append([]string{}, entry.RevokedKeys...)
+		entryList = append(entryList, entryCopy)
+	}
+	sort.Slice(entryList, func(i, j int) bool {
+		return entryList[i].PublisherID < entryList[j].PublisherID
+	})
+	return entryList
+}
+
+// GetPublisher returns a copy of the allowlist entry of a publisher
+// Returns nil if the publisher is not in the allowlist
+func (allowlist *Allowlist) GetPublisher(publisherID string) *AllowlistEntry {
+	allowlist.updateMutex.Lock()
+	defer allowlist.updateMutex.Unlock()
+	entry := allowlist.entries[publisherID]
+	if entry == nil {
+		return nil
+	}
+	entryCopy := *entry
+	entryCopy.RevokedKeys = append([]string{}, entry.RevokedKeys...)
+	return &entryCopy
+}
+
+// IsAllowed returns true if the publisher is in the allowlist and is not revoked
+func (allowlist *Allowlist) IsAllowed(publisherID string) bool {
+	entry := allowlist.GetPublisher(publisherID)
+	return entry != nil && entry.Revoked == ""
+}
+
+// Load the allowlist from file. Existing entries are replaced.
+func (allowlist *Allowlist) Load() error {
+	content := allowlistFile{}
+	err := lib.LoadYamlConfig(allowlist.configFolder, allowlist.filename, types.DSSPublisherID, &content)
+	if err != nil {
+		return err
+	}
+	allowlist.updateMutex.Lock()
+	defer allowlist.updateMutex.Unlock()
+	allowlist.entries = make(map[string]*AllowlistEntry)
+	for _, entry := range content.Publishers {
+		if entry.PublisherID == "" {
+			logrus.Warningf("Allowlist.Load: Ignored entry without publisherId in %s", allowlist.filename)
+			continue
+		}
+		allowlist.entries[entry.PublisherID] = entry
+	}
+	return nil
+}
+
+// RemovePublisher removes a publisher from the allowlist
+// Use Revoke to keep a record that the publisher was revoked.
+func (allowlist *Allowlist) RemovePublisher(publisherID string) {
+	allowlist.updateMutex.Lock()
+	defer allowlist.updateMutex.Unlock()
+	delete(allowlist.entries, publisherID)
+}
+
+// Revoke marks a publisher as revoked. A revoked publisher no longer receives identities.
+// Returns false if the publisher is not in the allowlist.
+func (allowlist *Allowlist) Revoke(publisherID string) bool {
+	allowlist.updateMutex.Lock()
+	defer allowlist.updateMutex.Unlock()
+	entry := allowlist.entries[publisherID]
+	if entry == nil {
+		return false
+	}
+	entry.Revoked = time.Now().Format(types.TimeFormat)
+	return true
+}
+
+// RevokeKey adds a compromised public key of a publisher to its revoked keys. The publisher itself
+// remains allowed and can rejoin with a new key.
+// Returns false if the publisher is not in the allowlist.
+func (allowlist *Allowlist) RevokeKey(publisherID string, publicKey string) bool {
+	allowlist.updateMutex.Lock()
+	defer allowlist.updateMutex.Unlock()
+	entry := allowlist.entries[publisherID]
+	if entry == nil {
+		return false
+	}
+	for _, revokedKey := range entry.RevokedKeys {
+		if strings.TrimSpace(revokedKey) == strings.TrimSpace(publicKey) {
+			return true
+		}
+	}
+	entry.RevokedKeys = append(entry.RevokedKeys, publicKey)
+	return true
+}
+
+// Save the allowlist to file
+func (allowlist *Allowlist) Save() error {
+	content := allowlistFile{Publishers: make([]*AllowlistEntry, 0)}
+	for _, entry := range allowlist.GetAllPublishers() {
+		entryCopy := entry
+		content.Publishers = append(content.Publishers, &entryCopy)
+	}
+	yamlText, err := yaml.Marshal(&content)
+	if err != nil {
+		return lib.MakeErrorf("Allowlist.Save: Error marshalling allowlist '%s': %v", allowlist.filename, err)
+	}
+	fullPath := path.Join(allowlist.configFolder, allowlist.filename)
+	err = ioutil.WriteFile(fullPath, yamlText, 0600)
+	if err != nil {
+		return lib.MakeErrorf("Allowlist.Save: Error saving allowlist to %s: %v", fullPath, err)
+	}
+	return nil
+}
+
+// NewAllowlist creates a new allowlist persisted in the given file
+//  configFolder contains the allowlist file. Use "" for the default config folder.
+//  filename of the allowlist. Use "" for the default AllowlistFile.
+func NewAllowlist(configFolder string, filename string) *Allowlist {
+	if configFolder == "" {
+		configFolder = lib.DefaultConfigFolder
+	}
+	if filename == "" {
+		filename = AllowlistFile
+	}
+	allowlist := &Allowlist{
+		configFolder: configFolder,
+		filename:     filename,
+		entries:      make(map[string]*AllowlistEntry),
+		updateMutex:  &sync.Mutex{},
+	}
+	return allowlist
+}
@@ -0,0 +1,46 @@
+package dss_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/iotdomain/iotdomain-go/dss"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowlist(t *testing.T) {
+	configFolder, _ := ioutil.TempDir("", "dss")
+	defer os.RemoveAll(configFolder)
+
+	allowlist := dss.NewAllowlist(configFolder, "")
+	err := allowlist.Load()
+	assert.Error(t, err, "Expected error loading a missing allowlist")
+
+	allowlist.AddPublisher(dss.AllowlistEntry{PublisherID: publisher1ID, Organization: "iotdomain.org"})
+	allowlist.AddPublisher(dss.AllowlistEntry{PublisherID: publisher2ID})
+	assert.True(t, allowlist.IsAllowed(publisher1ID))
+	assert.False(t, allowlist.IsAllowed("notallowed"))
+	assert.Nil(t, allowlist.GetPublisher("notallowed"))
+
+	revoked := allowlist.Revoke(publisher2ID)
+	assert.True(t, revoked)
+	assert.False(t, allowlist.IsAllowed(publisher2ID))
+	assert.False(t, allowlist.Revoke("notallowed"))
+	err = allowlist.Save()
+	require.NoError(t, err)
+
+	// reload the saved allowlist
+	allowlist2 := dss.NewAllowlist(configFolder, dss.AllowlistFile)
+	err = allowlist2.Load()
+	require.NoError(t, err)
+	entries := allowlist2.GetAllPublishers()
+	require.Equal(t, 2, len(entries))
+	assert.Equal(t, publisher1ID, entries[0].PublisherID)
+	assert.Equal(t, "iotdomain.org", entries[0].Organization)
+	assert.NotEmpty(t, entries[1].Revoked)
+
+	allowlist2.RemovePublisher(publisher1ID)
+	assert.Nil(t, allowlist2.GetPublisher(publisher1ID))
+}
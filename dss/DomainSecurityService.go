@@ -0,0 +1,374 @@
+// Package dss with the Domain Security Service reference implementation.
+// The DSS is a publisher that issues identities to the publishers of a secured domain. Publishers
+// that are on its allowlist receive a DSS signed identity which is renewed before it expires.
+package dss
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/identities"
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/publisher"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultCheckInterval in seconds to check for identities that need to be issued or renewed
+	DefaultCheckInterval = 60
+	// DefaultIdentityValidDays is the nr of days an issued identity is valid
+	DefaultIdentityValidDays = 30
+	// DefaultRenewDays is the nr of days before expiry that an identity is renewed
+	DefaultRenewDays = 10
+)
+
+// time to wait for a publisher to start using an issued identity before issuing another one
+const issueRetryInterval = 10 * time.Minute
+
+// DSSConfig with configuration of the domain security service
+type DSSConfig struct {
+	AllowlistFile     string `yaml:"allowlistFile"`     // allowlist filename in the config folder. Default is AllowlistFile
+	CheckInterval     int    `yaml:"checkInterval"`     // interval in seconds to check for identities to issue or renew
+	IdentityValidDays int    `yaml:"identityValidDays"` // nr of days an issued identity is valid
+	RenewDays         int    `yaml:"renewDays"`         // nr of days before expiry that an identity is renewed
+	TrustOnFirstUse   bool   `yaml:"trustOnFirstUse"`   // issue identities to allowlist entries without public key. Default is false
+}
+
+// issuedIdentity records the most recent identity issued to a publisher
+type issuedIdentity struct {
+	publicKey string    // public key of the issued identity
+	issued    time.Time // time the identity was issued
+}
+
+// DomainSecurityService issues and renews the identities of publishers in a secured domain.
+// It runs as the publisher with ID types.DSSPublisherID. Publishers join the domain by publishing
+// their self-signed identity. If the publisher is on the allowlist and joins with the public key of
+// its allowlist entry, the DSS issues a new DSS signed identity that is encrypted with the publisher's
+// current key and sent with the $setIdentity command. Entries without public key are only trusted on
+// first use when enabled in the configuration.
+type DomainSecurityService struct {
+	config      DSSConfig
+	allowlist   *Allowlist                 // publishers that are allowed in the domain
+	issued      map[string]*issuedIdentity // most recent issued identity by publisherID
+	publisher   *publisher.Publisher       // the DSS publisher
+	updateMutex *sync.Mutex                // mutex for async issuing of identities
+}
+
+// Address returns the DSS identity address
+func (dss *DomainSecurityService) Address() string {
+	return dss.publisher.Address()
+}
+
+// AllowPublisher adds a publisher to the allowlist and saves the allowlist
+// An identity is issued on the next check once the publisher's identity is discovered.
+func (dss *DomainSecurityService) AllowPublisher(entry AllowlistEntry) error {
+	dss.allowlist.AddPublisher(entry)
+	return dss.allowlist.Save()
+}
+
+// CheckIdentities issues identities to allowed publishers that have joined with a self-signed
+// identity, and renews DSS issued identities that are about to expire.
+// Publishers whose identity is not yet discovered are skipped. This is invoked periodically
+// with the configured check interval.
+// Returns the number of identities issued.
+func (dss *DomainSecurityService) CheckIdentities() int {
+	issueCount := 0
+	dss.updateMutex.Lock()
+	defer dss.updateMutex.Unlock()
+
+	for _, entry := range dss.allowlist.GetAllPublishers() {
+		if entry.Revoked != "" {
+			continue
+		}
+		addr := identities.MakePublisherIdentityAddress(dss.publisher.Domain(), entry.PublisherID)
+		current := dss.publisher.GetDomainPublisher(addr)
+		if current == nil || !dss.needsIdentity(&entry, current, false) {
+			continue
+		}
+		_, err := dss.issueIdentity(&entry, current)
+		if err != nil {
+			logrus.Errorf("CheckIdentities: %s", err)
+			continue
+		}
+		issueCount++
+	}
+	return issueCount
+}
+
+// GetAllowlist returns the allowlist of publishers
+func (dss *DomainSecurityService) GetAllowlist() *Allowlist {
+	return dss.allowlist
+}
+
+// IssueIdentity issues a new identity to an allowed publisher and sends it with the $setIdentity command
+// The identity is encrypted with the publisher's current key which must have been discovered.
+// Returns the issued identity or an error if the publisher is not allowed or unknown.
+func (dss *DomainSecurityService) IssueIdentity(publisherID string) (*types.PublisherFullIdentity, error) {
+	dss.updateMutex.Lock()
+	defer dss.updateMutex.Unlock()
+
+	entry := dss.allowlist.GetPublisher(publisherID)
+	if entry == nil || entry.Revoked != "" {
+		return nil, lib.MakeErrorf("IssueIdentity: Publisher %s is not allowed in the domain", publisherID)
+	}
+	addr := identities.MakePublisherIdentityAddress(dss.publisher.Domain(), publisherID)
+	current := dss.publisher.GetDomainPublisher(addr)
+	if current == nil {
+		return nil, lib.MakeErrorf("IssueIdentity: Identity of publisher %s is not yet discovered", publisherID)
+	}
+	return dss.issueIdentity(entry, current)
+}
+
+// RevokeKey revokes a compromised key of a publisher and publishes the updated revocation list.
+// The publisher remains allowed and receives a new identity once it rejoins with a new key.
+func (dss *DomainSecurityService) RevokeKey(publisherID string, publicKey string) error {
+	if !dss.allowlist.RevokeKey(publisherID, publicKey) {
+		return lib.MakeErrorf("RevokeKey: Publisher %s is not in the allowlist", publisherID)
+	}
+	dss.updateMutex.Lock()
+	delete(dss.issued, publisherID)
+	dss.updateMutex.Unlock()
+	logrus.Warningf("RevokeKey: A key of publisher %s is revoked", publisherID)
+	err := dss.allowlist.Save()
+	if err != nil {
+		return err
+	}
+	return dss.PublishRevocationList()
+}
+
+// RevokePublisher revokes a publisher. Its identity is no longer renewed and it can not rejoin the domain.
+// The publisher remains on the allowlist marked as revoked and the updated revocation list is published.
+func (dss *DomainSecurityService) RevokePublisher(publisherID string) error {
+	if !dss.allowlist.Revoke(publisherID) {
+		return lib.MakeErrorf("RevokePublisher: Publisher %s is not in the allowlist", publisherID)
+	}
+	dss.updateMutex.Lock()
+	delete(dss.issued, publisherID)
+	dss.updateMutex.Unlock()
+	logrus.Warningf("RevokePublisher: Publisher %s is revoked", publisherID)
+	err := dss.allowlist.Save()
+	if err != nil {
+		return err
+	}
+	return dss.PublishRevocationList()
+}
+
+// PublishRevocationList publishes the revoked publishers and keys from the allowlist
+func (dss *DomainSecurityService) PublishRevocationList() error {
+	domain := dss.publisher.Domain()
+	revoked := make([]types.RevokedPublisher, 0)
+	for _, entry := range dss.allowlist.GetAllPublishers() {
+		addr := identities.MakePublisherIdentityAddress(domain, entry.PublisherID)
+		if entry.Revoked != "" {
+			revoked = append(revoked, types.RevokedPublisher{Address: addr, Revoked: entry.Revoked})
+		}
+		for _, revokedKey := range entry.RevokedKeys {
+			revoked = append(revoked, types.RevokedPublisher{Address: addr, PublicKey: revokedKey})
+		}
+	}
+	return dss.publisher.PublishRevocationList(revoked)
+}
+
+// Start the DSS publisher and periodically check for identities to issue
+// This loads the allowlist from the config folder.
+func (dss *DomainSecurityService) Start() {
+	err := dss.allowlist.Load()
+	if err != nil {
+		logrus.Warningf("DomainSecurityService.Start: Allowlist not loaded. No identities are issued until publishers are allowed.")
+	}
+	dss.publisher.SetPollInterval(dss.config.CheckInterval, func(pub *publisher.Publisher) {
+		dss.CheckIdentities()
+	})
+	dss.publisher.Start()
+	err = dss.PublishRevocationList()
+	if err != nil {
+		logrus.Errorf("DomainSecurityService.Start: %s", err)
+	}
+}
+
+// Stop the DSS publisher
+func (dss *DomainSecurityService) Stop() {
+	dss.publisher.Stop()
+}
+
+// createIdentity creates a new identity for the publisher signed by the DSS
+//  algorithm of the keys of the new identity, eg messaging.KeyAlgorithmES256
+// Returns an error if the algorithm is not supported
+func (dss *DomainSecurityService) createIdentity(entry *AllowlistEntry, algorithm string) (
+	*types.PublisherFullIdentity, error) {
+
+	now := time.Now()
+	validUntil := now.Add(time.Duration(dss.config.IdentityValidDays) * 24 * time.Hour)
+	domain := dss.publisher.Domain()
+
+	privKey, err := messaging.CreateKeys(algorithm)
+	if err != nil {
+		return nil, lib.MakeErrorf("createIdentity: %s", err)
+	}
+	// ES256 identities don't record the algorithm so existing publishers can verify them
+	keyAlgorithm := messaging.GetKeyAlgorithm(privKey)
+	if keyAlgorithm == messaging.KeyAlgorithmES256 {
+		keyAlgorithm = ""
+	}
+	publicIdentity := types.PublisherIdentityMessage{
+		Address:      identities.MakePublisherIdentityAddress(domain, entry.PublisherID),
+		Algorithm:    keyAlgorithm,
+		Domain:       domain,
+		IssuerID:     types.DSSPublisherID,
+		Location:     entry.Location,
+		Organization: entry.Organization,
+		PublicKey:    messaging.PublicKeyToPem(messaging.GetPublicKeyOf(privKey)),
+		PublisherID:  entry.PublisherID,
+		Timestamp:    now.Format(types.TimeFormat),
+		ValidUntil:   validUntil.Format(types.TimeFormat),
+	}
+	messaging.SignIdentity(&publicIdentity, dss.publisher.GetIdentityKeys())
+
+	fullIdentity := &types.PublisherFullIdentity{
+		PublisherIdentityMessage: publicIdentity,
+		PrivateKey:               messaging.PrivateKeyToPem(privKey),
+		Sender:                   dss.publisher.Address(),
+	}
+	return fullIdentity, nil
+}
+
+// handleRenewRequest issues a new identity to an allowed publisher that requests renewal of its identity
+func (dss *DomainSecurityService) handleRenewRequest(publisherID string, message *types.RenewIdentityMessage) {
+	dss.updateMutex.Lock()
+	defer dss.updateMutex.Unlock()
+
+	entry := dss.allowlist.GetPublisher(publisherID)
+	if entry == nil || entry.Revoked != "" {
+		logrus.Warningf("handleRenewRequest: Publisher %s is not allowed in the domain. Request ignored.", publisherID)
+		return
+	}
+	current := dss.publisher.GetDomainPublisher(message.Sender)
+	if current == nil || !dss.needsIdentity(entry, current, true) {
+		return
+	}
+	_, err := dss.issueIdentity(entry, current)
+	if err != nil {
+		logrus.Errorf("handleRenewRequest: %s", err)
+	}
+}
+
+// issueIdentity creates and sends a new identity. Not thread-safe, use within a locked section.
+// The new keys use the same algorithm as the current identity of the publisher. Publishers with
+// EdDSA keys are refused as they cannot decrypt the identity.
+func (dss *DomainSecurityService) issueIdentity(
+	entry *AllowlistEntry, current *types.PublisherIdentityMessage) (*types.PublisherFullIdentity, error) {
+
+	algorithm := identities.GetIdentityAlgorithm(current)
+	if algorithm == messaging.KeyAlgorithmEdDSA {
+		return nil, lib.MakeErrorf("issueIdentity: Publisher %s uses %s keys which cannot receive an encrypted "+
+			"identity. Use %s or %s keys in a secured domain", entry.PublisherID, algorithm,
+			messaging.KeyAlgorithmES256, messaging.KeyAlgorithmES384)
+	}
+	fullIdentity, err := dss.createIdentity(entry, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	err = dss.publisher.PublishSetIdentity(fullIdentity)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("issueIdentity: Issued identity for publisher %s valid until %s",
+		entry.PublisherID, fullIdentity.ValidUntil)
+	dss.issued[entry.PublisherID] = &issuedIdentity{
+		publicKey: fullIdentity.PublicKey,
+		issued:    time.Now(),
+	}
+	return fullIdentity, nil
+}
+
+// needsIdentity determines if a publisher needs a new identity based on its current identity
+// renewRequested is set when the publisher has requested renewal of its DSS issued identity.
+// Not thread-safe, use within a locked section.
+func (dss *DomainSecurityService) needsIdentity(
+	entry *AllowlistEntry, current *types.PublisherIdentityMessage, renewRequested bool) bool {
+
+	for _, revokedKey := range entry.RevokedKeys {
+		if strings.TrimSpace(revokedKey) == strings.TrimSpace(current.PublicKey) {
+			return false
+		}
+	}
+	// give the publisher time to start using a recently issued identity
+	issued := dss.issued[entry.PublisherID]
+	if issued != nil && issued.publicKey != current.PublicKey &&
+		time.Since(issued.issued) < issueRetryInterval {
+		return false
+	}
+	if current.IssuerID != types.DSSPublisherID {
+		// joining with a self-signed identity. Its key must match the allowlist unless trust on first use is enabled
+		if entry.PublicKey == "" && !dss.config.TrustOnFirstUse {
+			logrus.Warningf("needsIdentity: Allowlist entry of publisher %s has no public key. Identity not issued. "+
+				"Add its public key to the allowlist or enable trustOnFirstUse.", entry.PublisherID)
+			return false
+		} else if entry.PublicKey == "" {
+			logrus.Warningf("needsIdentity: Allowlist entry of publisher %s has no public key. "+
+				"Trusting the key it joined with.", entry.PublisherID)
+		} else if strings.TrimSpace(entry.PublicKey) != strings.TrimSpace(current.PublicKey) {
+			logrus.Warningf("needsIdentity: Public key of publisher %s doesn't match the allowlist. Identity not issued.",
+				entry.PublisherID)
+			return false
+		}
+		return true
+	} else if renewRequested {
+		return true
+	}
+	validUntil, err := time.Parse(types.TimeFormat, current.ValidUntil)
+	if err != nil {
+		return true
+	}
+	renewTime := validUntil.Add(-time.Duration(dss.config.RenewDays) * 24 * time.Hour)
+	return time.Now().After(renewTime)
+}
+
+// NewDomainSecurityService creates a new instance of the domain security service.
+//  config with the DSS configuration. Use nil for defaults.
+//  pubConfig with the configuration of the DSS publisher. The publisher ID is always the DSS
+// publisher ID. The allowlist is stored in its config folder.
+//  messenger for publishing onto the message bus is required
+// Returns nil if no messenger is provided or the DSS publisher cannot be created.
+func NewDomainSecurityService(config *DSSConfig, pubConfig *publisher.PublisherConfig,
+	messenger messaging.IMessenger) *DomainSecurityService {
+
+	if messenger == nil {
+		return nil
+	}
+	dssConfig := DSSConfig{}
+	if config != nil {
+		dssConfig = *config
+	}
+	if dssConfig.CheckInterval <= 0 {
+		dssConfig.CheckInterval = DefaultCheckInterval
+	}
+	if dssConfig.IdentityValidDays <= 0 {
+		dssConfig.IdentityValidDays = DefaultIdentityValidDays
+	}
+	if dssConfig.RenewDays <= 0 {
+		dssConfig.RenewDays = DefaultRenewDays
+	}
+	dssPubConfig := publisher.PublisherConfig{}
+	if pubConfig != nil {
+		dssPubConfig = *pubConfig
+	}
+	dssPubConfig.PublisherID = types.DSSPublisherID
+	pub := publisher.NewPublisher(&dssPubConfig, messenger)
+	if pub == nil {
+		return nil
+	}
+
+	dss := &DomainSecurityService{
+		config:      dssConfig,
+		allowlist:   NewAllowlist(dssPubConfig.ConfigFolder, dssConfig.AllowlistFile),
+		issued:      make(map[string]*issuedIdentity),
+		publisher:   pub,
+		updateMutex: &sync.Mutex{},
+	}
+	pub.SetRenewIdentityHandler(dss.handleRenewRequest)
+	return dss
+}
@@ -0,0 +1,233 @@
+package dss_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/dss"
+	"github.com/iotdomain/iotdomain-go/identities"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/publisher"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const domain = "test"
+const publisher1ID = "publisher1"
+const publisher2ID = "publisher2"
+
+var msgConfig *messaging.MessengerConfig = &messaging.MessengerConfig{Domain: domain}
+
+func TestNewDSS(t *testing.T) {
+	service := dss.NewDomainSecurityService(nil, nil, nil)
+	assert.Nil(t, service)
+
+	testMessenger := messaging.NewDummyMessenger(msgConfig)
+	configFolder, _ := ioutil.TempDir("", "dss")
+	defer os.RemoveAll(configFolder)
+	service = dss.NewDomainSecurityService(nil,
+		&publisher.PublisherConfig{Domain: domain, ConfigFolder: configFolder}, testMessenger)
+	require.NotNil(t, service)
+	assert.Equal(t, identities.MakePublisherIdentityAddress(domain, types.DSSPublisherID), service.Address())
+	assert.NotNil(t, service.GetAllowlist())
+}
+
+func TestIssueIdentity(t *testing.T) {
+	configFolder, _ := ioutil.TempDir("", "dss")
+	defer os.RemoveAll(configFolder)
+	testMessenger := messaging.NewDummyMessenger(msgConfig)
+	dssIdentAddr := identities.MakePublisherIdentityAddress(domain, types.DSSPublisherID)
+
+	// renew identities immediately
+	dssConfig := &dss.DSSConfig{CheckInterval: 3600, IdentityValidDays: 3, RenewDays: 4}
+	service := dss.NewDomainSecurityService(dssConfig,
+		&publisher.PublisherConfig{Domain: domain, ConfigFolder: configFolder}, testMessenger)
+	service.Start()
+
+	// publisher1 doesn't request renewal itself
+	pub1 := publisher.NewPublisher(&publisher.PublisherConfig{
+		Domain: domain, PublisherID: publisher1ID, ConfigFolder: configFolder, SecuredDomain: true,
+		RenewIdentityDays: 1,
+	}, testMessenger)
+	pub1.Start()
+	// the dummy messenger doesn't retain publications, so resend the DSS identity to publisher1
+	testMessenger.OnReceive(dssIdentAddr, testMessenger.FindLastPublication(dssIdentAddr))
+	require.NotNil(t, pub1.GetPublisherKey(dssIdentAddr), "DSS identity not received")
+
+	// publisher1 isn't allowed yet
+	issueCount := service.CheckIdentities()
+	assert.Equal(t, 0, issueCount)
+	_, err := service.IssueIdentity(publisher1ID)
+	assert.Error(t, err)
+
+	// an allowlist entry without public key requires trust on first use
+	err = service.AllowPublisher(dss.AllowlistEntry{PublisherID: publisher1ID, Organization: "tester1"})
+	require.NoError(t, err)
+	issueCount = service.CheckIdentities()
+	assert.Equal(t, 0, issueCount)
+
+	// once allowed with its key, publisher1 joins the domain
+	err = service.AllowPublisher(dss.AllowlistEntry{
+		PublisherID: publisher1ID, Organization: "tester1", PublicKey: pub1.GetIdentity().PublicKey})
+	require.NoError(t, err)
+	issueCount = service.CheckIdentities()
+	assert.Equal(t, 1, issueCount)
+	// don't issue again while the publisher hasn't started using its identity
+	issueCount = service.CheckIdentities()
+	assert.Equal(t, 0, issueCount)
+
+	pub1.PublishUpdates()
+	ident1 := pub1.GetIdentity()
+	assert.Equal(t, types.DSSPublisherID, ident1.IssuerID, "Identity not issued by the DSS")
+	assert.Equal(t, "tester1", ident1.Organization)
+	// the issued identity must be saved
+	identityFile := path.Join(configFolder, publisher1ID+publisher.RegisteredIdentityFileSuffix)
+	identityJSON, err := ioutil.ReadFile(identityFile)
+	require.NoError(t, err)
+	savedIdentity := types.PublisherFullIdentity{}
+	json.Unmarshal(identityJSON, &savedIdentity)
+	assert.Equal(t, ident1.PublicKey, savedIdentity.PublicKey, "Issued identity not saved")
+
+	// the identity expires within the renewal period so it is renewed
+	issueCount = service.CheckIdentities()
+	assert.Equal(t, 1, issueCount)
+	pub1.PublishUpdates()
+	ident2 := pub1.GetIdentity()
+	assert.NotEqual(t, ident1.PublicKey, ident2.PublicKey, "Identity not renewed")
+
+	// a revoked publisher isn't renewed
+	err = service.RevokePublisher(publisher1ID)
+	assert.NoError(t, err)
+	issueCount = service.CheckIdentities()
+	assert.Equal(t, 0, issueCount)
+	_, err = service.IssueIdentity(publisher1ID)
+	assert.Error(t, err)
+	err = service.RevokePublisher(publisher2ID)
+	assert.Error(t, err)
+
+	// a publisher that isn't discovered can't receive an identity
+	service.AllowPublisher(dss.AllowlistEntry{PublisherID: publisher2ID})
+	_, err = service.IssueIdentity(publisher2ID)
+	assert.Error(t, err)
+
+	pub1.Stop()
+	service.Stop()
+}
+
+func TestRenewRequest(t *testing.T) {
+	configFolder, _ := ioutil.TempDir("", "dss")
+	defer os.RemoveAll(configFolder)
+	testMessenger := messaging.NewDummyMessenger(msgConfig)
+	dssIdentAddr := identities.MakePublisherIdentityAddress(domain, types.DSSPublisherID)
+
+	// the DSS doesn't renew by itself and trusts the key publishers join with
+	dssConfig := &dss.DSSConfig{CheckInterval: 3600, IdentityValidDays: 3, RenewDays: 1, TrustOnFirstUse: true}
+	service := dss.NewDomainSecurityService(dssConfig,
+		&publisher.PublisherConfig{Domain: domain, ConfigFolder: configFolder}, testMessenger)
+	service.Start()
+	// publisher1 requests renewal of an identity that expires within 5 days
+	pub1 := publisher.NewPublisher(&publisher.PublisherConfig{
+		Domain: domain, PublisherID: publisher1ID, ConfigFolder: configFolder, SecuredDomain: true,
+		RenewIdentityDays: 5,
+	}, testMessenger)
+	pub1.Start()
+	testMessenger.OnReceive(dssIdentAddr, testMessenger.FindLastPublication(dssIdentAddr))
+
+	service.AllowPublisher(dss.AllowlistEntry{PublisherID: publisher1ID})
+	issueCount := service.CheckIdentities()
+	require.Equal(t, 1, issueCount)
+	pub1.PublishUpdates()
+	ident1 := pub1.GetIdentity()
+	assert.Equal(t, types.DSSPublisherID, ident1.IssuerID)
+
+	// the next heartbeat requests renewal, after which the DSS issues a new identity
+	time.Sleep(time.Millisecond * 2100)
+	ident2 := pub1.GetIdentity()
+	assert.Equal(t, types.DSSPublisherID, ident2.IssuerID)
+	assert.NotEqual(t, ident1.PublicKey, ident2.PublicKey, "Identity not renewed on request")
+
+	// a request from a revoked publisher is ignored
+	service.RevokePublisher(publisher1ID)
+	signer := messaging.NewMessageSigner(testMessenger, pub1.GetIdentityKeys(), nil)
+	err := identities.PublishRenewIdentity(ident2, signer)
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond * 1100)
+	assert.Equal(t, ident2.PublicKey, pub1.GetIdentity().PublicKey)
+
+	pub1.Stop()
+	service.Stop()
+}
+
+func TestJoinWithPublicKey(t *testing.T) {
+	configFolder, _ := ioutil.TempDir("", "dss")
+	defer os.RemoveAll(configFolder)
+	testMessenger := messaging.NewDummyMessenger(msgConfig)
+	service := dss.NewDomainSecurityService(&dss.DSSConfig{CheckInterval: 3600},
+		&publisher.PublisherConfig{Domain: domain, ConfigFolder: configFolder}, testMessenger)
+	service.Start()
+	pub1 := publisher.NewPublisher(&publisher.PublisherConfig{
+		Domain: domain, PublisherID: publisher1ID, ConfigFolder: configFolder, SecuredDomain: true,
+	}, testMessenger)
+	pub1.Start()
+
+	// the publisher key must match the allowlist
+	otherKey := messaging.CreateAsymKeys()
+	service.AllowPublisher(dss.AllowlistEntry{
+		PublisherID: publisher1ID, PublicKey: messaging.PublicKeyToPem(&otherKey.PublicKey)})
+	issueCount := service.CheckIdentities()
+	assert.Equal(t, 0, issueCount)
+
+	service.AllowPublisher(dss.AllowlistEntry{PublisherID: publisher1ID, PublicKey: pub1.GetIdentity().PublicKey})
+	issueCount = service.CheckIdentities()
+	assert.Equal(t, 1, issueCount)
+
+	pub1.Stop()
+	service.Stop()
+}
+
+func TestIssueIdentityAlgorithm(t *testing.T) {
+	configFolder, _ := ioutil.TempDir("", "dss")
+	defer os.RemoveAll(configFolder)
+	testMessenger := messaging.NewDummyMessenger(msgConfig)
+	dssIdentAddr := identities.MakePublisherIdentityAddress(domain, types.DSSPublisherID)
+	service := dss.NewDomainSecurityService(&dss.DSSConfig{CheckInterval: 3600, TrustOnFirstUse: true},
+		&publisher.PublisherConfig{Domain: domain, ConfigFolder: configFolder}, testMessenger)
+	service.Start()
+
+	// the issued identity uses the algorithm of the publisher keys
+	pub1 := publisher.NewPublisher(&publisher.PublisherConfig{
+		Domain: domain, PublisherID: publisher1ID, ConfigFolder: configFolder, SecuredDomain: true,
+		KeyAlgorithm: messaging.KeyAlgorithmES384,
+	}, testMessenger)
+	pub1.Start()
+	testMessenger.OnReceive(dssIdentAddr, testMessenger.FindLastPublication(dssIdentAddr))
+	service.AllowPublisher(dss.AllowlistEntry{PublisherID: publisher1ID})
+	_, err := service.IssueIdentity(publisher1ID)
+	require.NoError(t, err)
+	pub1.PublishUpdates()
+	ident1 := pub1.GetIdentity()
+	assert.Equal(t, types.DSSPublisherID, ident1.IssuerID)
+	assert.Equal(t, messaging.KeyAlgorithmES384, ident1.Algorithm)
+	assert.Equal(t, messaging.KeyAlgorithmES384, messaging.GetKeyAlgorithm(pub1.GetIdentityKeys()))
+
+	// publishers with EdDSA keys can't decrypt the identity
+	pub2 := publisher.NewPublisher(&publisher.PublisherConfig{
+		Domain: domain, PublisherID: publisher2ID, ConfigFolder: configFolder, SecuredDomain: true,
+		KeyAlgorithm: messaging.KeyAlgorithmEdDSA,
+	}, testMessenger)
+	pub2.Start()
+	service.AllowPublisher(dss.AllowlistEntry{PublisherID: publisher2ID})
+	_, err = service.IssueIdentity(publisher2ID)
+	assert.Error(t, err)
+	issueCount := service.CheckIdentities()
+	assert.Equal(t, 0, issueCount)
+
+	pub2.Stop()
+	pub1.Stop()
+	service.Stop()
+}
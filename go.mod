@@ -11,8 +11,8 @@ require (
 	github.com/sirupsen/logrus v1.7.0
 	github.com/square/go-jose v2.5.1+incompatible
 	github.com/stretchr/testify v1.6.1
-	golang.org/x/crypto v0.0.0-20200930160638-afb6bcd081ae // indirect
-	golang.org/x/net v0.0.0-20200930145003-4acb6c075d10 // indirect
+	golang.org/x/crypto v0.0.0-20200930160638-afb6bcd081ae
+	golang.org/x/net v0.0.0-20200930145003-4acb6c075d10
 	golang.org/x/sys v0.0.0-20200929083018-4d22bbb62b3c // indirect
 	gopkg.in/square/go-jose.v2 v2.5.1
 	gopkg.in/yaml.v2 v2.3.0
@@ -2,11 +2,13 @@
 package identities
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"encoding/json"
 	"io/ioutil"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/iotdomain/iotdomain-go/lib"
 	"github.com/iotdomain/iotdomain-go/messaging"
@@ -18,18 +20,83 @@ import (
 
 // DomainPublisherIdentities with discovered and verified identities of publishers
 type DomainPublisherIdentities struct {
-	c              lib.DomainCollection //
-	publicKeyCache map[string]*ecdsa.PublicKey
+	c                 lib.DomainCollection //
+	publicKeyCache    map[string]crypto.PublicKey
+	previousKeys      map[string]*previousPublicKey // keys of renewed identities during their grace period
+	revokedKeys       map[string]bool               // revoked public keys in PEM format
+	revokedPublishers map[string]bool               // identity addresses of revoked publishers
+	updateMutex       *sync.Mutex                   // mutex for async updating of keys and revocations
+}
+
+// previousPublicKey holds the public key of a publisher before its identity was renewed
+type previousPublicKey struct {
+	publicKey crypto.PublicKey
+	pem       string    // the public key in PEM format
+	expiry    time.Time // time the key is no longer accepted
 }
 
 // AddIdentity adds a new public identity and generate its public key in the cache
-// If the identity already exists, it will be replaced
+// If the identity already exists, it will be replaced. When the replaced identity has a different
+// public key, that key remains available through GetPreviousPublisherKey for the PreviousKeyGracePeriod.
+// Revoked identities are ignored.
 func (pubIdentities *DomainPublisherIdentities) AddIdentity(identity *types.PublisherIdentityMessage) {
-	pubIdentities.c.Update(identity.Address, identity)
+	if pubIdentities.IsRevoked(identity) {
+		logrus.Warningf("AddIdentity: Identity %s is revoked. Ignored.", identity.Address)
+		return
+	}
+	existing := pubIdentities.GetPublisherByAddress(identity.Address)
 	pubKey := messaging.PublicKeyFromPem(identity.PublicKey)
+
+	pubIdentities.updateMutex.Lock()
+	defer pubIdentities.updateMutex.Unlock()
+	if existing != nil && existing.PublicKey != identity.PublicKey {
+		pubIdentities.previousKeys[identity.Address] = &previousPublicKey{
+			publicKey: pubIdentities.publicKeyCache[identity.Address],
+			pem:       existing.PublicKey,
+			expiry:    time.Now().Add(PreviousKeyGracePeriod),
+		}
+	}
+	pubIdentities.c.Update(identity.Address, identity)
 	pubIdentities.publicKeyCache[identity.Address] = pubKey
 }
 
+// ApplyRevocations replaces the revoked publishers and keys with the given revocation list.
+// The identities and keys of revoked publishers are removed so messages from them no longer verify.
+// Returns the identity addresses of the publishers that were removed.
+func (pubIdentities *DomainPublisherIdentities) ApplyRevocations(revoked []types.RevokedPublisher) []string {
+	removed := make([]string, 0)
+	revokedKeys := make(map[string]bool)
+	revokedPublishers := make(map[string]bool)
+	for _, entry := range revoked {
+		if entry.PublicKey != "" {
+			revokedKeys[strings.TrimSpace(entry.PublicKey)] = true
+		} else {
+			revokedPublishers[entry.Address] = true
+		}
+	}
+	pubIdentities.updateMutex.Lock()
+	pubIdentities.revokedKeys = revokedKeys
+	pubIdentities.revokedPublishers = revokedPublishers
+	for addr, prevKey := range pubIdentities.previousKeys {
+		if revokedPublishers[addr] || revokedKeys[strings.TrimSpace(prevKey.pem)] {
+			delete(pubIdentities.previousKeys, addr)
+		}
+	}
+	pubIdentities.updateMutex.Unlock()
+
+	for _, ident := range pubIdentities.GetAllPublishers() {
+		if pubIdentities.IsRevoked(ident) {
+			logrus.Warningf("ApplyRevocations: Publisher %s is revoked. Its identity is removed.", ident.Address)
+			pubIdentities.c.Remove(ident.Address)
+			pubIdentities.updateMutex.Lock()
+			delete(pubIdentities.publicKeyCache, ident.Address)
+			pubIdentities.updateMutex.Unlock()
+			removed = append(removed, ident.Address)
+		}
+	}
+	return removed
+}
+
 // GetAllPublishers returns a list of discovered publishers
 func (pubIdentities *DomainPublisherIdentities) GetAllPublishers() []*types.PublisherIdentityMessage {
 	var identList = make([]*types.PublisherIdentityMessage, 0)
@@ -62,7 +129,7 @@ func (pubIdentities *DomainPublisherIdentities) GetPublisherByAddress(address st
 // GetPublisherKey returns the public key of a publisher for signature verification or encryption
 // publisherAddress must start with domain/publisherId
 // returns public key or nil if publisher public key is not found
-func (pubIdentities *DomainPublisherIdentities) GetPublisherKey(publisherAddress string) *ecdsa.PublicKey {
+func (pubIdentities *DomainPublisherIdentities) GetPublisherKey(publisherAddress string) crypto.PublicKey {
 	// cleanup the address
 	segments := strings.Split(publisherAddress, "/")
 	if len(segments) < 2 {
@@ -71,6 +138,8 @@ func (pubIdentities *DomainPublisherIdentities) GetPublisherKey(publisherAddress
 	}
 	identityAddress := MakePublisherIdentityAddress(segments[0], segments[1])
 	// first try using the public key cache
+	pubIdentities.updateMutex.Lock()
+	defer pubIdentities.updateMutex.Unlock()
 	pubKey := pubIdentities.publicKeyCache[identityAddress]
 	// if pubKey == nil {
 	// 	// if the public key isn't cached yet, try generating it from identity PEM record
@@ -82,6 +151,36 @@ func (pubIdentities *DomainPublisherIdentities) GetPublisherKey(publisherAddress
 	return pubKey
 }
 
+// GetPreviousPublisherKey returns the public key a publisher used before its identity was renewed
+// Intended to verify messages that were signed before the renewal.
+// publisherAddress must start with domain/publisherId
+// returns the previous public key or nil if there is none or its grace period has passed
+func (pubIdentities *DomainPublisherIdentities) GetPreviousPublisherKey(publisherAddress string) crypto.PublicKey {
+	segments := strings.Split(publisherAddress, "/")
+	if len(segments) < 2 {
+		return nil
+	}
+	identityAddress := MakePublisherIdentityAddress(segments[0], segments[1])
+	pubIdentities.updateMutex.Lock()
+	defer pubIdentities.updateMutex.Unlock()
+	prevKey := pubIdentities.previousKeys[identityAddress]
+	if prevKey == nil {
+		return nil
+	} else if time.Now().After(prevKey.expiry) {
+		delete(pubIdentities.previousKeys, identityAddress)
+		return nil
+	}
+	return prevKey.publicKey
+}
+
+// IsRevoked returns true if the publisher of the identity, or the identity's public key, is revoked
+func (pubIdentities *DomainPublisherIdentities) IsRevoked(identity *types.PublisherIdentityMessage) bool {
+	pubIdentities.updateMutex.Lock()
+	defer pubIdentities.updateMutex.Unlock()
+	return pubIdentities.revokedPublishers[identity.Address] ||
+		pubIdentities.revokedKeys[strings.TrimSpace(identity.PublicKey)]
+}
+
 // LoadIdentities loads previously save identities from file
 // Existing identities are retained but replaced if contained in the file
 func (pubIdentities *DomainPublisherIdentities) LoadIdentities(filename string) error {
@@ -129,6 +228,7 @@ func (pubIdentities *DomainPublisherIdentities) UpdateCount() int {
 //  - the issuer ID or its public key is missing
 //  - the issuer is either the DSS or the publisher itself (self-signed)
 //  - identity is expired
+//  - the public key doesn't match the identity algorithm
 //  - a newer identity is already received
 //  - the identity signature doesn't verify against the signing key (if provided)
 //
@@ -138,9 +238,9 @@ func (pubIdentities *DomainPublisherIdentities) UpdateCount() int {
 //   based on message bus ACLs. Only publishers can self sign their own identity.
 //  When the issuer is a CA, the CA public key must be known
 func VerifyPublisherIdentity(rxAddress string, ident *types.PublisherIdentityMessage,
-	dssSigningKey *ecdsa.PublicKey) error {
+	dssSigningKey crypto.PublicKey) error {
 
-	var signingKey *ecdsa.PublicKey
+	var signingKey crypto.PublicKey
 
 	// identity must contain public key, issuer and signature
 	if ident.PublicKey == "" ||
@@ -176,14 +276,23 @@ func VerifyPublisherIdentity(rxAddress string, ident *types.PublisherIdentityMes
 		err := lib.MakeErrorf("VerifyIdentity: Identity '%s' is expired", rxAddress)
 		return err
 	}
+	// the public key must be of the algorithm recorded in the identity
+	publicKey, err := messaging.ParsePublicKeyPem(ident.PublicKey)
+	if err != nil {
+		return lib.MakeErrorf("VerifyIdentity: Public key of '%s' is invalid: %s", rxAddress, err)
+	} else if messaging.GetKeyAlgorithm(publicKey) != GetIdentityAlgorithm(ident) {
+		err := lib.MakeErrorf("VerifyIdentity: Public key of '%s' doesn't match algorithm '%s'",
+			rxAddress, GetIdentityAlgorithm(ident))
+		return err
+	}
 	if ident.IssuerID == types.DSSPublisherID {
 		signingKey = dssSigningKey
 	} else {
-		signingKey = messaging.PublicKeyFromPem(ident.PublicKey)
+		signingKey = publicKey
 	}
 
 	// Self signed or DSS signed identity
-	err := messaging.VerifyIdentitySignature(ident, signingKey)
+	err = messaging.VerifyIdentitySignature(ident, signingKey)
 	if err != nil {
 		return lib.MakeErrorf("VerifyIdentity: Verification of %s message failed. "+
 			"The identity signature doesn't match", rxAddress)
@@ -195,8 +304,12 @@ func VerifyPublisherIdentity(rxAddress string, ident *types.PublisherIdentityMes
 // NewDomainPublisherIdentities creates a new list of discovered publishers
 func NewDomainPublisherIdentities() *DomainPublisherIdentities {
 	domainIdentities := &DomainPublisherIdentities{
-		c:              lib.NewDomainCollection(reflect.TypeOf(&types.InputDiscoveryMessage{}), nil),
-		publicKeyCache: make(map[string]*ecdsa.PublicKey),
+		c:                 lib.NewDomainCollection(reflect.TypeOf(&types.InputDiscoveryMessage{}), nil),
+		publicKeyCache:    make(map[string]crypto.PublicKey),
+		previousKeys:      make(map[string]*previousPublicKey),
+		revokedKeys:       make(map[string]bool),
+		revokedPublishers: make(map[string]bool),
+		updateMutex:       &sync.Mutex{},
 	}
 	domainIdentities.c.GetPublicKey = domainIdentities.GetPublisherKey
 	return domainIdentities
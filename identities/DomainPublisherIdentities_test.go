@@ -1,10 +1,12 @@
 package identities_test
 
 import (
-	"crypto/ecdsa"
+	"crypto"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/iotdomain/iotdomain-go/identities"
 	"github.com/iotdomain/iotdomain-go/messaging"
@@ -23,7 +25,7 @@ func TestNewDomainIdentities(t *testing.T) {
 	// const TestConfigID = "test"
 	// const TestConfigDefault = "testDefault"
 	privKey := messaging.CreateAsymKeys()
-	getPubKey := func(address string) *ecdsa.PublicKey {
+	getPubKey := func(address string) crypto.PublicKey {
 		return &privKey.PublicKey
 	}
 	messenger := messaging.NewDummyMessenger(dummyConfig)
@@ -33,6 +35,110 @@ func TestNewDomainIdentities(t *testing.T) {
 	require.NotNil(t, collection, "Failed creating registered publisher collection")
 }
 
+func TestPreviousPublisherKey(t *testing.T) {
+	const domain = "test"
+	const publisher1ID = "pub1"
+	domainIdentities := identities.NewDomainPublisherIdentities()
+	ident1, privKey1 := identities.CreateIdentity(domain, publisher1ID)
+	addr := ident1.Address
+
+	domainIdentities.AddIdentity(&ident1.PublisherIdentityMessage)
+	assert.Nil(t, domainIdentities.GetPreviousPublisherKey(addr))
+
+	// the key of the renewed identity remains available
+	ident2, privKey2 := identities.CreateIdentity(domain, publisher1ID)
+	domainIdentities.AddIdentity(&ident2.PublisherIdentityMessage)
+	assert.Equal(t, messaging.GetPublicKeyOf(privKey2), domainIdentities.GetPublisherKey(addr))
+	assert.Equal(t, messaging.GetPublicKeyOf(privKey1), domainIdentities.GetPreviousPublisherKey(addr))
+	assert.Equal(t, messaging.GetPublicKeyOf(privKey1), domainIdentities.GetPreviousPublisherKey(domain+"/"+publisher1ID+"/node1"))
+
+	// republishing the same identity doesn't replace the previous key
+	domainIdentities.AddIdentity(&ident2.PublisherIdentityMessage)
+	assert.Equal(t, messaging.GetPublicKeyOf(privKey1), domainIdentities.GetPreviousPublisherKey(addr))
+	assert.Nil(t, domainIdentities.GetPreviousPublisherKey("invalid"))
+}
+
+func TestRevocationList(t *testing.T) {
+	const domain = "test"
+	var removed []string
+	collection := identities.NewDomainPublisherIdentities()
+	messenger := messaging.NewDummyMessenger(dummyConfig)
+	signer := messaging.NewMessageSigner(messenger, nil, collection.GetPublisherKey)
+	receiver := identities.NewReceiveRevocationList(domain, []string{"admin"}, collection, signer)
+	receiver.SetRevokedPublishersHandler(func(revokedAddresses []string) {
+		removed = revokedAddresses
+	})
+	receiver.Start()
+
+	dssIdent, dssKeys := identities.CreateIdentity(domain, types.DSSPublisherID)
+	pub2Ident, pub2Keys := identities.CreateIdentity(domain, "pub2")
+	pub3Ident, pub3Keys := identities.CreateIdentity(domain, "pub3")
+	collection.AddIdentity(&dssIdent.PublisherIdentityMessage)
+	collection.AddIdentity(&pub2Ident.PublisherIdentityMessage)
+	collection.AddIdentity(&pub3Ident.PublisherIdentityMessage)
+	makeList := func(sender string, keys crypto.PrivateKey, revoked ...types.RevokedPublisher) string {
+		list := types.RevocationListMessage{
+			Address:   identities.MakeRevocationListAddress(domain),
+			Revoked:   revoked,
+			Sender:    sender,
+			Timestamp: time.Now().Format(types.TimeFormat),
+		}
+		payload, _ := json.Marshal(list)
+		signed, _ := messaging.CreateJWSSignature(string(payload), keys)
+		return signed
+	}
+	listAddr := identities.MakeRevocationListAddress(domain)
+
+	// revoke publisher2 through the DSS
+	dssSigner := messaging.NewMessageSigner(messenger, dssKeys, nil)
+	err := identities.PublishRevocationList(domain,
+		[]types.RevokedPublisher{{Address: pub2Ident.Address}}, dssIdent.Address, dssSigner)
+	require.NoError(t, err)
+	assert.Equal(t, []string{pub2Ident.Address}, removed)
+	assert.Nil(t, collection.GetPublisherByAddress(pub2Ident.Address))
+	assert.Nil(t, collection.GetPublisherKey(pub2Ident.Address))
+	assert.True(t, collection.IsRevoked(&pub2Ident.PublisherIdentityMessage))
+
+	// messages from publisher2 no longer verify and its identity can't be added again
+	signed, _ := messaging.CreateJWSSignature(`{"address":"test/pub2/node1/$node"}`, pub2Keys)
+	_, err = signer.VerifySignedMessage(signed, &types.NodeDiscoveryMessage{})
+	assert.Error(t, err)
+	collection.AddIdentity(&pub2Ident.PublisherIdentityMessage)
+	assert.Nil(t, collection.GetPublisherKey(pub2Ident.Address))
+
+	// publisher3 isn't allowed to revoke the DSS
+	err = receiver.ReceiveRevocationList(listAddr,
+		makeList(pub3Ident.Address, pub3Keys, types.RevokedPublisher{Address: dssIdent.Address}))
+	assert.Error(t, err)
+	assert.NotNil(t, collection.GetPublisherKey(dssIdent.Address))
+	// unsigned lists are not accepted
+	err = receiver.ReceiveRevocationList(listAddr, `{"sender":"test/$dss/$identity"}`)
+	assert.Error(t, err)
+
+	// revoke the compromised key of publisher3. It can rejoin with a new key
+	err = receiver.ReceiveRevocationList(listAddr, makeList(dssIdent.Address, dssKeys,
+		types.RevokedPublisher{Address: pub3Ident.Address, PublicKey: pub3Ident.PublicKey}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{pub3Ident.Address}, removed)
+	assert.Nil(t, collection.GetPublisherKey(pub3Ident.Address))
+	// the list replaces the previous list so publisher2 is no longer revoked
+	assert.False(t, collection.IsRevoked(&pub2Ident.PublisherIdentityMessage))
+	pub3Ident2, _ := identities.CreateIdentity(domain, "pub3")
+	collection.AddIdentity(&pub3Ident2.PublisherIdentityMessage)
+	assert.NotNil(t, collection.GetPublisherKey(pub3Ident.Address))
+
+	// older lists are ignored
+	oldList := makeList(dssIdent.Address, dssKeys, types.RevokedPublisher{Address: pub3Ident.Address})
+	time.Sleep(time.Millisecond * 10)
+	err = receiver.ReceiveRevocationList(listAddr, makeList(dssIdent.Address, dssKeys))
+	assert.NoError(t, err)
+	err = receiver.ReceiveRevocationList(listAddr, oldList)
+	assert.Error(t, err)
+	assert.NotNil(t, collection.GetPublisherKey(pub3Ident.Address))
+
+	receiver.Stop()
+}
+
 func TestLoadDomainIdentities(t *testing.T) {
 	// const Source1ID = "source1"
 	const domain = "test"
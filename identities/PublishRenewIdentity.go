@@ -0,0 +1,34 @@
+// Package identities with publishing of the request to renew the publisher identity
+package identities
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// MakeRenewIdentityAddress returns the address of the DSS for requests to renew an identity
+//   domain/$dss/$renewIdentity
+func MakeRenewIdentityAddress(domain string) string {
+	address := fmt.Sprintf("%s/%s/%s", domain, types.DSSPublisherID, types.MessageTypeRenewIdentity)
+	return address
+}
+
+// PublishRenewIdentity publishes a request to the DSS to renew the given identity before it expires.
+// The request is signed with the identity's current keys. The DSS responds with the $setIdentity command.
+func PublishRenewIdentity(identity *types.PublisherIdentityMessage, messageSigner *messaging.MessageSigner) error {
+	addr := MakeRenewIdentityAddress(identity.Domain)
+	logrus.Infof("PublishRenewIdentity: request renewal of identity %s to: %s", identity.Address, addr)
+
+	message := &types.RenewIdentityMessage{
+		Address:    addr,
+		Sender:     identity.Address,
+		Timestamp:  time.Now().Format(types.TimeFormat),
+		ValidUntil: identity.ValidUntil,
+	}
+	err := messageSigner.PublishObject(addr, false, message, nil)
+	return err
+}
@@ -0,0 +1,37 @@
+// Package identities with publishing of the list of revoked publishers and keys
+package identities
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// MakeRevocationListAddress returns the address of the revocation list of a domain
+//   domain/$dss/$revocations
+func MakeRevocationListAddress(domain string) string {
+	address := fmt.Sprintf("%s/%s/%s", domain, types.DSSPublisherID, types.MessageTypeRevocations)
+	return address
+}
+
+// PublishRevocationList publishes the full list of revoked publishers and keys of the domain.
+// The list is retained so publishers that connect later also receive it.
+//  sender is the identity address of the DSS or revocation admin that signs the list
+func PublishRevocationList(domain string, revoked []types.RevokedPublisher, sender string,
+	messageSigner *messaging.MessageSigner) error {
+
+	addr := MakeRevocationListAddress(domain)
+	logrus.Infof("PublishRevocationList: %d revocations to: %s", len(revoked), addr)
+
+	message := &types.RevocationListMessage{
+		Address:   addr,
+		Revoked:   revoked,
+		Sender:    sender,
+		Timestamp: time.Now().Format(types.TimeFormat),
+	}
+	err := messageSigner.PublishObject(addr, true, message, nil)
+	return err
+}
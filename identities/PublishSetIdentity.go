@@ -0,0 +1,31 @@
+// Package identities with publishing of the command to update a publisher identity
+package identities
+
+import (
+	"crypto"
+	"fmt"
+
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// MakeSetIdentityAddress returns the address of the command to update a publisher's identity
+//   domain/publisherID/$setIdentity
+func MakeSetIdentityAddress(domain string, publisherID string) string {
+	address := fmt.Sprintf("%s/%s/%s", domain, publisherID, types.MessageTypeSetIdentity)
+	return address
+}
+
+// PublishSetIdentity publishes a new full identity to the publisher it is issued to.
+// Intended for use by the DSS to issue and renew identities. The message is signed by the
+// sender and encrypted with the publisher's current public key.
+func PublishSetIdentity(fullIdentity *types.PublisherFullIdentity,
+	messageSigner *messaging.MessageSigner, encryptionKey crypto.PublicKey) error {
+
+	addr := MakeSetIdentityAddress(fullIdentity.Domain, fullIdentity.PublisherID)
+	logrus.Infof("PublishSetIdentity: publish identity update to: %s", addr)
+
+	err := messageSigner.PublishObject(addr, false, fullIdentity, encryptionKey)
+	return err
+}
@@ -13,8 +13,9 @@ import (
 // In secured domains the domain identity must be signed by the DSS.
 type ReceiveDomainPublisherIdentities struct {
 	domainIdentities *DomainPublisherIdentities
-	messageSigner    *messaging.MessageSigner // subscription to command
-	dssAddress       string                   // the DSS address for this domain
+	messageSigner    *messaging.MessageSigner     // subscription to command
+	subscription     messaging.SubscriptionHandle // handle of the subscription
+	dssAddress       string                       // the DSS address for this domain
 }
 
 // Start listening for updates to the registered identity
@@ -22,13 +23,12 @@ type ReceiveDomainPublisherIdentities struct {
 func (rxIdentity *ReceiveDomainPublisherIdentities) Start() {
 	// subscription address for all identities domain/publisherID/$identity
 	addr := MakePublisherIdentityAddress("+", "+")
-	rxIdentity.messageSigner.Subscribe(addr, rxIdentity.ReceiveDomainIdentity)
+	rxIdentity.subscription = rxIdentity.messageSigner.Subscribe(addr, rxIdentity.ReceiveDomainIdentity)
 }
 
 // Stop listening
 func (rxIdentity *ReceiveDomainPublisherIdentities) Stop() {
-	addr := MakePublisherIdentityAddress("+", "+")
-	rxIdentity.messageSigner.Unsubscribe(addr, rxIdentity.ReceiveDomainIdentity)
+	rxIdentity.messageSigner.Unsubscribe(rxIdentity.subscription)
 
 }
 
@@ -72,6 +72,9 @@ func (rxIdentity *ReceiveDomainPublisherIdentities) ReceiveDomainIdentity(addres
 		return lib.MakeErrorf("ReceiveDomainIdentity: Publisher identity signature verification failed for %s", address)
 	}
 
+	if rxIdentity.domainIdentities.IsRevoked(&newIdentity) {
+		return lib.MakeErrorf("ReceiveDomainIdentity: Publisher identity %s is revoked", address)
+	}
 	rxIdentity.domainIdentities.AddIdentity(&newIdentity)
 	return nil
 }
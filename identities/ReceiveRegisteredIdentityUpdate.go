@@ -2,8 +2,6 @@
 package identities
 
 import (
-	"fmt"
-
 	"github.com/iotdomain/iotdomain-go/lib"
 	"github.com/iotdomain/iotdomain-go/messaging"
 	"github.com/iotdomain/iotdomain-go/types"
@@ -12,35 +10,36 @@ import (
 // ReceiveRegisteredIdentityUpdate listens for the identity update command from the DSS
 // This decrypts and verifies the signature of the command using the DSS public key when available
 type ReceiveRegisteredIdentityUpdate struct {
-	domain             string                   // the domain of this publisher
-	publisherID        string                   // the registered publisher for the inputs
-	messageSigner      *messaging.MessageSigner // subscription to command
-	registeredIdentity *RegisteredIdentity      // the identity to update
+	domain             string                       // the domain of this publisher
+	publisherID        string                       // the registered publisher for the inputs
+	messageSigner      *messaging.MessageSigner     // subscription to command
+	subscription       messaging.SubscriptionHandle // handle of the subscription
+	registeredIdentity *RegisteredIdentity          // the identity to update
 }
 
 // Start listening for updates to the registered identity
 // Intended to receive new keys from the DSS
 func (rxIdentity *ReceiveRegisteredIdentityUpdate) Start() {
-	addr := fmt.Sprintf("%s/%s/%s", rxIdentity.domain, "+", types.MessageTypeSetInput)
-	rxIdentity.messageSigner.Subscribe(addr, rxIdentity.ReceiveIdentityUpdate)
+	addr := MakeSetIdentityAddress(rxIdentity.domain, rxIdentity.publisherID)
+	rxIdentity.subscription = rxIdentity.messageSigner.Subscribe(addr, rxIdentity.ReceiveIdentityUpdate)
 }
 
 // Stop listening
 func (rxIdentity *ReceiveRegisteredIdentityUpdate) Stop() {
-	addr := fmt.Sprintf("%s/%s/%s", rxIdentity.domain, rxIdentity.publisherID, types.MessageTypeSetInput)
-	rxIdentity.messageSigner.Unsubscribe(addr, rxIdentity.ReceiveIdentityUpdate)
+	rxIdentity.messageSigner.Unsubscribe(rxIdentity.subscription)
 }
 
 // ReceiveIdentityUpdate handles an incoming a identity update command. This:
 // - checks if the rawMessage is encrypted
 // - checks the sender is the DSS
 // - verifies if the sender (dss) signature is valid
-// - passes the update to the adapter's callback set in Start()
+// - checks that the message is not a replay of an earlier update
+// - verifies the new identity is issued by the DSS and updates and saves the registered identity
 func (rxIdentity *ReceiveRegisteredIdentityUpdate) ReceiveIdentityUpdate(address string, rawMessage string) error {
 	var newIdentity types.PublisherFullIdentity
 
-	isEncrypted, isSigned, err := rxIdentity.messageSigner.DecodeMessage(
-		rawMessage, &newIdentity)
+	isEncrypted, isSigned, err := rxIdentity.messageSigner.DecodeCommand(
+		address, rawMessage, &newIdentity)
 
 	if err != nil {
 		return lib.MakeErrorf("HandleIdentityUpdate: Message to %s. Error %s'. Message discarded.", address, err)
@@ -56,7 +55,15 @@ func (rxIdentity *ReceiveRegisteredIdentityUpdate) ReceiveIdentityUpdate(address
 			newIdentity.Sender, dssAddress)
 	}
 	if rxIdentity.registeredIdentity != nil {
-		rxIdentity.registeredIdentity.UpdateIdentity(&newIdentity)
+		// the message signature is verified with the DSS key so it can be used to verify the identity
+		if rxIdentity.messageSigner.GetPublicKey != nil {
+			dssKey := rxIdentity.messageSigner.GetPublicKey(dssAddress)
+			rxIdentity.registeredIdentity.SetDssKey(dssKey)
+		}
+		err = rxIdentity.registeredIdentity.UpdateIdentity(&newIdentity)
+		if err != nil {
+			return lib.MakeErrorf("HandleIdentityUpdate: Identity update on %s is invalid: %s", address, err)
+		}
 		rxIdentity.registeredIdentity.SaveIdentity()
 	}
 	return err
@@ -0,0 +1,88 @@
+// Package identities with handling of requests to renew a publisher identity
+package identities
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// RenewIdentityHandler callback when a publisher requests renewal of its identity
+type RenewIdentityHandler func(publisherID string, message *types.RenewIdentityMessage)
+
+// ReceiveRenewIdentity listens for requests to renew a publisher identity
+// Intended for use by the DSS. The request must be signed by the publisher whose identity is renewed.
+type ReceiveRenewIdentity struct {
+	domain        string                       // the domain of the DSS
+	messageSigner *messaging.MessageSigner     // subscription to requests
+	subscription  messaging.SubscriptionHandle // handle of the subscription
+	handler       RenewIdentityHandler         // handler to pass the request to
+	updateMutex   *sync.Mutex                  // mutex for async handling of requests
+}
+
+// SetRenewIdentityHandler set the handler for renewing identities
+func (rxRenew *ReceiveRenewIdentity) SetRenewIdentityHandler(handler RenewIdentityHandler) {
+	rxRenew.updateMutex.Lock()
+	defer rxRenew.updateMutex.Unlock()
+	rxRenew.handler = handler
+}
+
+// Start listening for renewal requests
+func (rxRenew *ReceiveRenewIdentity) Start() {
+	addr := MakeRenewIdentityAddress(rxRenew.domain)
+	rxRenew.subscription = rxRenew.messageSigner.Subscribe(addr, rxRenew.ReceiveRenewRequest)
+}
+
+// Stop listening
+func (rxRenew *ReceiveRenewIdentity) Stop() {
+	rxRenew.messageSigner.Unsubscribe(rxRenew.subscription)
+}
+
+// ReceiveRenewRequest handles an incoming request to renew an identity. This:
+// - checks if the request is signed by the sender
+// - checks that the request is not a replay of an earlier request
+// - checks the sender is a publisher identity of this domain
+// - passes the request to the handler
+func (rxRenew *ReceiveRenewIdentity) ReceiveRenewRequest(address string, rawMessage string) error {
+	var message types.RenewIdentityMessage
+
+	_, isSigned, err := rxRenew.messageSigner.DecodeCommand(address, rawMessage, &message)
+	if !isSigned {
+		return lib.MakeErrorf("ReceiveRenewRequest: Request on '%s' is not signed. Message discarded.", address)
+	} else if err != nil {
+		return lib.MakeErrorf("ReceiveRenewRequest: Message to %s. Error %s'. Message discarded.", address, err)
+	}
+	segments := strings.Split(message.Sender, "/")
+	if len(segments) != 3 || segments[0] != rxRenew.domain || segments[2] != types.MessageTypeIdentity {
+		return lib.MakeErrorf("ReceiveRenewRequest: Sender '%s' is not a publisher of domain %s. Message discarded.",
+			message.Sender, rxRenew.domain)
+	}
+	rxRenew.updateMutex.Lock()
+	handler := rxRenew.handler
+	rxRenew.updateMutex.Unlock()
+
+	if handler != nil {
+		handler(segments[1], &message)
+	} else {
+		logrus.Errorf("ReceiveRenewRequest: request received on address %s, but no handler is configured.", address)
+	}
+	return nil
+}
+
+// NewReceiveRenewIdentity listens for requests to renew a publisher identity in the domain.
+// Run Start() to start listening.
+func NewReceiveRenewIdentity(domain string, handler RenewIdentityHandler,
+	messageSigner *messaging.MessageSigner) *ReceiveRenewIdentity {
+
+	rxRenew := &ReceiveRenewIdentity{
+		domain:        domain,
+		handler:       handler,
+		messageSigner: messageSigner,
+		updateMutex:   &sync.Mutex{},
+	}
+	return rxRenew
+}
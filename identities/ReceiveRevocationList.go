@@ -0,0 +1,120 @@
+// Package identities with handling of the list of revoked publishers and keys
+package identities
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// RevokedPublishersHandler callback with the identity addresses of publishers that were removed
+// because they were revoked
+type RevokedPublishersHandler func(revokedAddresses []string)
+
+// ReceiveRevocationList listens for the revocation list of the domain and applies it to the
+// discovered publisher identities. The list must be signed by the DSS or a revocation admin.
+type ReceiveRevocationList struct {
+	domain           string                       // the domain of this publisher
+	admins           []string                     // publisherIDs besides the DSS that can publish the list
+	domainIdentities *DomainPublisherIdentities   // the identities to apply the revocations to
+	handler          RevokedPublishersHandler     // handler to remove the entities of revoked publishers
+	lastTimestamp    time.Time                    // timestamp of the last applied list
+	messageSigner    *messaging.MessageSigner     // subscription to the revocation list
+	subscription     messaging.SubscriptionHandle // handle of the subscription
+	updateMutex      *sync.Mutex                  // mutex for async handling of revocation lists
+}
+
+// SetRevokedPublishersHandler set the handler that is invoked with the publishers that were revoked
+func (rxRevocations *ReceiveRevocationList) SetRevokedPublishersHandler(handler RevokedPublishersHandler) {
+	rxRevocations.updateMutex.Lock()
+	defer rxRevocations.updateMutex.Unlock()
+	rxRevocations.handler = handler
+}
+
+// Start listening for the revocation list
+func (rxRevocations *ReceiveRevocationList) Start() {
+	addr := MakeRevocationListAddress(rxRevocations.domain)
+	rxRevocations.subscription = rxRevocations.messageSigner.Subscribe(addr, rxRevocations.ReceiveRevocationList)
+}
+
+// Stop listening
+func (rxRevocations *ReceiveRevocationList) Stop() {
+	rxRevocations.messageSigner.Unsubscribe(rxRevocations.subscription)
+}
+
+// ReceiveRevocationList handles an incoming revocation list. This:
+// - checks if the list is signed by its sender
+// - checks the sender is the DSS or a revocation admin of this domain
+// - ignores lists that are older than the last applied list
+// - applies the revocations to the domain identities and passes the removed publishers to the handler
+func (rxRevocations *ReceiveRevocationList) ReceiveRevocationList(address string, rawMessage string) error {
+	var message types.RevocationListMessage
+
+	isSigned, err := rxRevocations.messageSigner.VerifySignedMessage(rawMessage, &message)
+	if !isSigned {
+		return lib.MakeErrorf("ReceiveRevocationList: List on '%s' is not signed. Message discarded.", address)
+	} else if err != nil {
+		return lib.MakeErrorf("ReceiveRevocationList: Message to %s. Error %s'. Message discarded.", address, err)
+	}
+	if !rxRevocations.isAuthority(message.Sender) {
+		return lib.MakeErrorf("ReceiveRevocationList: Sender '%s' is not allowed to revoke publishers. Message discarded.",
+			message.Sender)
+	}
+	timestamp, err := time.Parse(types.TimeFormat, message.Timestamp)
+	if err != nil {
+		return lib.MakeErrorf("ReceiveRevocationList: Invalid timestamp '%s'. Message discarded.", message.Timestamp)
+	}
+	rxRevocations.updateMutex.Lock()
+	if timestamp.Before(rxRevocations.lastTimestamp) {
+		rxRevocations.updateMutex.Unlock()
+		return lib.MakeErrorf("ReceiveRevocationList: List from %s is older than the current list. Message discarded.",
+			message.Sender)
+	}
+	rxRevocations.lastTimestamp = timestamp
+	handler := rxRevocations.handler
+	rxRevocations.updateMutex.Unlock()
+
+	logrus.Infof("ReceiveRevocationList: %d revocations from %s", len(message.Revoked), message.Sender)
+	removed := rxRevocations.domainIdentities.ApplyRevocations(message.Revoked)
+	if handler != nil && len(removed) > 0 {
+		handler(removed)
+	}
+	return nil
+}
+
+// isAuthority returns true if the sender is the DSS or an admin of this domain
+func (rxRevocations *ReceiveRevocationList) isAuthority(sender string) bool {
+	segments := strings.Split(sender, "/")
+	if len(segments) != 3 || segments[0] != rxRevocations.domain || segments[2] != types.MessageTypeIdentity {
+		return false
+	} else if segments[1] == types.DSSPublisherID {
+		return true
+	}
+	for _, admin := range rxRevocations.admins {
+		if segments[1] == admin {
+			return true
+		}
+	}
+	return false
+}
+
+// NewReceiveRevocationList listens for the revocation list of the domain
+//  admins contains the publisherIDs that besides the DSS are allowed to publish the list. Use nil for none.
+// Run Start() to start listening.
+func NewReceiveRevocationList(domain string, admins []string, domainIdentities *DomainPublisherIdentities,
+	messageSigner *messaging.MessageSigner) *ReceiveRevocationList {
+
+	rxRevocations := &ReceiveRevocationList{
+		domain:           domain,
+		admins:           admins,
+		domainIdentities: domainIdentities,
+		messageSigner:    messageSigner,
+		updateMutex:      &sync.Mutex{},
+	}
+	return rxRevocations
+}
@@ -1,14 +1,18 @@
 package identities_test
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/x509"
 	"encoding/json"
+	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 	"time"
 
 	"github.com/iotdomain/iotdomain-go/identities"
+	"github.com/iotdomain/iotdomain-go/keystore"
 	"github.com/iotdomain/iotdomain-go/messaging"
 	"github.com/iotdomain/iotdomain-go/types"
 	"github.com/stretchr/testify/assert"
@@ -41,8 +45,8 @@ func TestPersistIdentity(t *testing.T) {
 	require.NotNil(t, ident2, "Unable to read identity")
 	assert.Equal(t, domain, ident2.Domain, "Loaded identity doesn't match saved identity")
 	assert.Equal(t, publisherID, ident2.PublisherID, "Loaded identity doesn't match saved identity")
-	pe1, _ := x509.MarshalECPrivateKey(privKey)
-	pe2, _ := x509.MarshalECPrivateKey(privKey2)
+	pe1, _ := x509.MarshalECPrivateKey(privKey.(*ecdsa.PrivateKey))
+	pe2, _ := x509.MarshalECPrivateKey(privKey2.(*ecdsa.PrivateKey))
 	assert.Equal(t, pe1, pe2, "public key not identical")
 
 	// error case using default identity folder and a not yet existing identity
@@ -65,16 +69,16 @@ func TestUpdateIdentity(t *testing.T) {
 	const domain = "test"
 	const publisher1ID = "pub1"
 	const dssID = types.DSSPublisherID
-	var pubKeys = make(map[string]*ecdsa.PublicKey)
+	var pubKeys = make(map[string]crypto.PublicKey)
 	// identityFile := configFolder + "/testpersistidentity.json"
 
 	regIdentity := identities.NewRegisteredIdentity(domain, publisher1ID, "")
 	privKey := regIdentity.GetPrivateKey()
-	pubKeys[regIdentity.GetAddress()] = &privKey.PublicKey
+	pubKeys[regIdentity.GetAddress()] = messaging.GetPublicKeyOf(privKey)
 
 	// privKey := messaging.CreateAsymKeys()
 	// var pubKey *ecdsa.PublicKey = &privKey.PublicKey
-	getPubKey := func(address string) *ecdsa.PublicKey {
+	getPubKey := func(address string) crypto.PublicKey {
 		return pubKeys[address]
 	}
 	// setup the receiver for identity updates
@@ -87,12 +91,12 @@ func TestUpdateIdentity(t *testing.T) {
 	// The DSS is the only one that can update an identity
 	// Create the self-signed DSS identity who will publish the new identity
 	dssIdent, dssKeys := identities.CreateIdentity(domain, dssID)
-	pubKeys[dssIdent.Address] = &dssKeys.PublicKey
+	pubKeys[dssIdent.Address] = messaging.GetPublicKeyOf(dssKeys)
 	dssIdent.IssuerID = dssIdent.PublisherID
 	dssIdent.Organization = "iotdomain.org"
 	dssIdent.Sender = identities.MakePublisherIdentityAddress(domain, dssID)
 	messaging.SignIdentity(&dssIdent.PublisherIdentityMessage, dssKeys)
-	regIdentity.SetDssKey(&dssKeys.PublicKey)
+	regIdentity.SetDssKey(messaging.GetPublicKeyOf(dssKeys))
 
 	// next, create a new identity to publish by the DSS
 	newFullIdent, _ := identities.CreateIdentity(domain, publisher1ID)
@@ -112,15 +116,28 @@ func TestUpdateIdentity(t *testing.T) {
 	messaging.SignIdentity(&newFullIdent.PublisherIdentityMessage, dssKeys)
 	payload, _ = json.MarshalIndent(newFullIdent, " ", " ")
 	signedMessage, _ := messaging.CreateJWSSignature(string(payload), dssKeys)
-	encryptedMessage, _ := messaging.EncryptMessage(signedMessage, &privKey.PublicKey)
+	encryptedMessage, _ := messaging.EncryptMessage(signedMessage, messaging.GetPublicKeyOf(privKey))
 
 	// publish and receive the identity
 	rxIdent.ReceiveIdentityUpdate(newFullIdent.Address, encryptedMessage)
 	ident2, _ = regIdentity.GetFullIdentity()
 	assert.Equal(t, "tester2", ident2.Organization, "Identity not updated")
 
+	// test through the $setIdentity command
+	newFullIdent.Organization = "tester3"
+	messaging.SignIdentity(&newFullIdent.PublisherIdentityMessage, dssKeys)
+	dssSigner := messaging.NewMessageSigner(messenger, dssKeys, getPubKey)
+	err := identities.PublishSetIdentity(newFullIdent, dssSigner, messaging.GetPublicKeyOf(privKey))
+	assert.NoError(t, err)
+	updatedIdent, updatedKey := regIdentity.GetUpdatedIdentity(true)
+	require.NotNil(t, updatedIdent, "Identity not updated")
+	assert.Equal(t, "tester3", updatedIdent.Organization)
+	assert.NotNil(t, updatedKey)
+	updatedIdent, _ = regIdentity.GetUpdatedIdentity(true)
+	assert.Nil(t, updatedIdent)
+
 	// error case - unsigned but encrypted
-	encryptedMessage, _ = messaging.EncryptMessage(string(payload), &privKey.PublicKey)
+	encryptedMessage, _ = messaging.EncryptMessage(string(payload), messaging.GetPublicKeyOf(privKey))
 	rxIdent.ReceiveIdentityUpdate(newFullIdent.Address, encryptedMessage)
 
 	// error case - signed but not encrypted
@@ -128,10 +145,10 @@ func TestUpdateIdentity(t *testing.T) {
 
 	// error case - sender is not the dss
 	newFullIdent.Sender = "someoneelse"
-	pubKeys[newFullIdent.Sender] = &dssKeys.PublicKey
+	pubKeys[newFullIdent.Sender] = messaging.GetPublicKeyOf(dssKeys)
 	payload, _ = json.MarshalIndent(newFullIdent, " ", " ")
 	signedMessage, _ = messaging.CreateJWSSignature(string(payload), dssKeys)
-	encryptedMessage, _ = messaging.EncryptMessage(signedMessage, &privKey.PublicKey)
+	encryptedMessage, _ = messaging.EncryptMessage(signedMessage, messaging.GetPublicKeyOf(privKey))
 	rxIdent.ReceiveIdentityUpdate(newFullIdent.Address, encryptedMessage)
 	ident3, _ := regIdentity.GetFullIdentity()
 	assert.Equal(t, dssIdent.Sender, ident3.Sender, "Identity with invalid sender should not be accepted")
@@ -141,8 +158,9 @@ func TestUpdateIdentity(t *testing.T) {
 	newFullIdent.Domain = "wrong"
 	payload, _ = json.MarshalIndent(newFullIdent, " ", " ")
 	signedMessage, _ = messaging.CreateJWSSignature(string(payload), dssKeys)
-	encryptedMessage, _ = messaging.EncryptMessage(signedMessage, &privKey.PublicKey)
-	rxIdent.ReceiveIdentityUpdate(newFullIdent.Address, encryptedMessage)
+	encryptedMessage, _ = messaging.EncryptMessage(signedMessage, messaging.GetPublicKeyOf(privKey))
+	err = rxIdent.ReceiveIdentityUpdate(newFullIdent.Address, encryptedMessage)
+	assert.Error(t, err)
 	ident4, _ := regIdentity.GetFullIdentity()
 	assert.Equal(t, domain, ident4.Domain, "Identity with invalid domain should not be accepted")
 
@@ -154,6 +172,114 @@ func TestUpdateIdentity(t *testing.T) {
 
 }
 
+func TestRenewIdentity(t *testing.T) {
+	const domain = "test"
+	const publisher1ID = "pub1"
+	regIdentity := identities.NewRegisteredIdentity(domain, publisher1ID, "")
+	regIdentity.GetUpdatedIdentity(true)
+	ident1, privKey1 := regIdentity.GetFullIdentity()
+	ident1.Organization = "tester1"
+
+	// a new identity is valid for a year
+	assert.False(t, identities.IsIdentityExpiring(&ident1.PublisherIdentityMessage, 300*24*time.Hour))
+	assert.True(t, identities.IsIdentityExpiring(&ident1.PublisherIdentityMessage, 400*24*time.Hour))
+
+	ident2, privKey2 := regIdentity.RenewIdentity()
+	require.NotNil(t, ident2)
+	assert.NotEqual(t, ident1.PublicKey, ident2.PublicKey, "Renewed identity has the same key")
+	assert.NotEqual(t, privKey1, privKey2)
+	assert.Equal(t, "tester1", ident2.Organization)
+	err := identities.VerifyFullIdentity(ident2, domain, publisher1ID, nil)
+	assert.NoError(t, err)
+	updatedIdent, _ := regIdentity.GetUpdatedIdentity(true)
+	assert.Equal(t, ident2, updatedIdent, "Renewed identity not marked as updated")
+
+	// an invalid expiry time needs renewal
+	ident2.ValidUntil = "never"
+	assert.True(t, identities.IsIdentityExpiring(&ident2.PublisherIdentityMessage, 0))
+}
+
+func TestIdentityAlgorithm(t *testing.T) {
+	const domain = "test"
+	const publisher1ID = "pub1"
+	regIdentity, err := identities.NewRegisteredIdentityWithAlgorithm(
+		domain, publisher1ID, "", messaging.KeyAlgorithmEdDSA)
+	require.NoError(t, err)
+	ident1, privKey1 := regIdentity.GetFullIdentity()
+	assert.Equal(t, messaging.KeyAlgorithmEdDSA, ident1.Algorithm)
+	assert.Equal(t, messaging.KeyAlgorithmEdDSA, messaging.GetKeyAlgorithm(privKey1))
+	err = identities.VerifyFullIdentity(ident1, domain, publisher1ID, nil)
+	assert.NoError(t, err)
+
+	// renewal keeps the algorithm
+	ident2, privKey2 := regIdentity.RenewIdentity()
+	assert.Equal(t, messaging.KeyAlgorithmEdDSA, ident2.Algorithm)
+	assert.Equal(t, messaging.KeyAlgorithmEdDSA, messaging.GetKeyAlgorithm(privKey2))
+
+	// ES256 identities don't record the algorithm for compatibility with existing publishers
+	ident3, _ := identities.CreateIdentity(domain, publisher1ID)
+	assert.Empty(t, ident3.Algorithm)
+	assert.Equal(t, messaging.KeyAlgorithmES256, identities.GetIdentityAlgorithm(&ident3.PublisherIdentityMessage))
+	ident4, _, err := identities.CreateIdentityWithAlgorithm(domain, publisher1ID, messaging.KeyAlgorithmES384)
+	require.NoError(t, err)
+	err = identities.VerifyFullIdentity(ident4, domain, publisher1ID, nil)
+	assert.NoError(t, err)
+
+	// error case - the public key must match the algorithm of the identity
+	ident4.Algorithm = messaging.KeyAlgorithmEdDSA
+	err = identities.VerifyPublisherIdentity(ident4.Address, &ident4.PublisherIdentityMessage, nil)
+	assert.Error(t, err)
+
+	// error case - unsupported algorithm
+	_, err = identities.NewRegisteredIdentityWithAlgorithm(domain, publisher1ID, "", "RS256")
+	assert.Error(t, err)
+}
+
+func TestIdentityKeyStore(t *testing.T) {
+	const domain = "test"
+	const publisher1ID = "pub1"
+	folder, _ := ioutil.TempDir("", "identitykeystore")
+	defer os.RemoveAll(folder)
+	identityFile := path.Join(folder, publisher1ID+identities.IdentityFileSuffix)
+
+	// an identity file with the private key is moved to the key store when saved
+	regIdentity := identities.NewRegisteredIdentity(domain, publisher1ID, identityFile)
+	ident1, privKey1 := regIdentity.GetFullIdentity()
+	err := regIdentity.SaveIdentity()
+	require.NoError(t, err)
+	keyStore, err := keystore.NewEncryptedFileKeyStore(path.Join(folder, publisher1ID+"-key.pem"), "secret")
+	require.NoError(t, err)
+	regIdentity2 := identities.NewRegisteredIdentity(domain, publisher1ID, identityFile)
+	regIdentity2.SetKeyStore(keyStore)
+	_, privKey2, err := regIdentity2.LoadIdentity()
+	require.NoError(t, err)
+	assert.Equal(t, privKey1, privKey2)
+	err = regIdentity2.SaveIdentity()
+	require.NoError(t, err)
+	identityJSON, _ := ioutil.ReadFile(identityFile)
+	assert.NotContains(t, string(identityJSON), "PRIVATE KEY")
+
+	// the key is loaded from the store
+	regIdentity3 := identities.NewRegisteredIdentity(domain, publisher1ID, identityFile)
+	regIdentity3.SetKeyStore(keyStore)
+	ident3, privKey3, err := regIdentity3.LoadIdentity()
+	require.NoError(t, err)
+	assert.Equal(t, privKey1, privKey3)
+	assert.Equal(t, ident1.PrivateKey, ident3.PrivateKey)
+
+	// error cases - no key in the store or identity file
+	regIdentity4 := identities.NewRegisteredIdentity(domain, publisher1ID, identityFile)
+	regIdentity4.SetKeyStore(keystore.NewMemoryKeyStore())
+	_, _, err = regIdentity4.LoadIdentity()
+	assert.Error(t, err)
+	regIdentity4.SetKeyStore(nil)
+	_, _, err = regIdentity4.LoadIdentity()
+	assert.Error(t, err)
+	ident3.PrivateKey = "not a pem"
+	err = identities.VerifyFullIdentity(ident3, domain, publisher1ID, nil)
+	assert.Error(t, err)
+}
+
 func TestVerifyIdentity(t *testing.T) {
 	const domain = "test"
 
@@ -166,7 +292,7 @@ func TestVerifyIdentity(t *testing.T) {
 	assert.Equal(t, domain, ident.Domain)
 	assert.Equal(t, publisherID, ident.PublisherID)
 
-	err := identities.VerifyFullIdentity(ident, domain, publisherID, &privKey.PublicKey)
+	err := identities.VerifyFullIdentity(ident, domain, publisherID, messaging.GetPublicKeyOf(privKey))
 	assert.NoError(t, err, "Self signed signature should verify against the identity")
 
 	// error case - missing public key in identity
@@ -188,29 +314,29 @@ func TestVerifyIdentity(t *testing.T) {
 	assert.Errorf(t, err, "Identity is expired")
 
 	// error case - identity public key must match its private key
-	pubKeyPem := messaging.PublicKeyToPem(&privKey.PublicKey)
+	pubKeyPem := messaging.PublicKeyToPem(messaging.GetPublicKeyOf(privKey))
 	assert.Equal(t, pubKeyPem, ident.PublicKey)
 
 	// error case - identity signature must verify against its signer
 	ident4 := *ident
 	ident4.IdentitySignature = ""
 	payload, _ := json.Marshal(&ident4.PublisherIdentityMessage)
-	sig := messaging.CreateEcdsaSignature(payload, privKey)
-	err = messaging.VerifyEcdsaSignature(payload, sig, &privKey.PublicKey)
+	sig := messaging.CreateSignature(payload, privKey)
+	err = messaging.VerifySignature(payload, sig, messaging.GetPublicKeyOf(privKey))
 	assert.NoError(t, err)
 	ident4.IdentitySignature = sig
-	err = identities.VerifyFullIdentity(&ident4, domain, publisherID, &privKey.PublicKey)
+	err = identities.VerifyFullIdentity(&ident4, domain, publisherID, messaging.GetPublicKeyOf(privKey))
 	assert.NoError(t, err, "Signature should verify against the identity")
 	// verification fails when identity is modified
 	ident4.Location = "not a location"
-	err = identities.VerifyFullIdentity(&ident4, domain, publisherID, &privKey.PublicKey)
+	err = identities.VerifyFullIdentity(&ident4, domain, publisherID, messaging.GetPublicKeyOf(privKey))
 	assert.Error(t, err, "Signature should fail against a modified identity")
 
 	// mismatch in public/private key of identity
 	ident4 = *ident
 	newPrivKey := messaging.CreateAsymKeys()
 	ident4.PrivateKey = messaging.PrivateKeyToPem(newPrivKey)
-	err = identities.VerifyFullIdentity(&ident4, domain, publisherID, &privKey.PublicKey)
+	err = identities.VerifyFullIdentity(&ident4, domain, publisherID, messaging.GetPublicKeyOf(privKey))
 	assert.Error(t, err, "Signature should fail against a mismatched public/private key pem in the identity ")
 
 }
@@ -1,14 +1,16 @@
 package identities
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/iotdomain/iotdomain-go/keystore"
 	"github.com/iotdomain/iotdomain-go/lib"
 	"github.com/iotdomain/iotdomain-go/messaging"
 	"github.com/iotdomain/iotdomain-go/types"
@@ -18,6 +20,9 @@ import (
 // valid for 1 year
 const validDuration = time.Hour * 24 * 365
 
+// PreviousKeyGracePeriod is the duration the key of a renewed identity remains accepted
+const PreviousKeyGracePeriod = time.Hour
+
 // IdentityFileSuffix to append to name of the file containing saved identity
 const IdentityFileSuffix = "-identity.json"
 
@@ -27,38 +32,66 @@ type RegisteredIdentity struct {
 	domain       string // domain of the publisher creating this identity
 	publisherID  string
 	fullIdentity *types.PublisherFullIdentity
-	dssPubKey    *ecdsa.PublicKey  // DSS pub key for verification (secure zones only)
-	privateKey   *ecdsa.PrivateKey // private key from the new identity
+	dssPubKey    crypto.PublicKey  // DSS pub key for verification (secure zones only)
+	keyAlgorithm string            // algorithm of the keys of new identities
+	keyStore     keystore.KeyStore // store of the private key. nil to save it in the identity file
+	privateKey   crypto.PrivateKey // private key from the new identity
 	updated      bool              // flag, this identity has been updated and needs to be published/saved
+	updateMutex  *sync.Mutex       // mutex for async updating of the identity
 }
 
 // GetAddress returns the identity's publication address
 func (regIdentity *RegisteredIdentity) GetAddress() string {
+	regIdentity.updateMutex.Lock()
+	defer regIdentity.updateMutex.Unlock()
 	return regIdentity.fullIdentity.Address
 }
 
 // GetPublicKey returns the identity's public key
-// func (regIdentity *RegisteredIdentity) GetPublicKey() *ecdsa.PublicKey {
+// func (regIdentity *RegisteredIdentity) GetPublicKey() crypto.PublicKey {
 // 	return &regIdentity.privateKey.PublicKey
 // }
 
 // GetPrivateKey returns the identity's private key
-func (regIdentity *RegisteredIdentity) GetPrivateKey() *ecdsa.PrivateKey {
+func (regIdentity *RegisteredIdentity) GetPrivateKey() crypto.PrivateKey {
+	regIdentity.updateMutex.Lock()
+	defer regIdentity.updateMutex.Unlock()
 	return regIdentity.privateKey
 }
 
 // GetFullIdentity returns the full identity with private key
-func (regIdentity *RegisteredIdentity) GetFullIdentity() (fullIdentity *types.PublisherFullIdentity, privKey *ecdsa.PrivateKey) {
+func (regIdentity *RegisteredIdentity) GetFullIdentity() (fullIdentity *types.PublisherFullIdentity, privKey crypto.PrivateKey) {
+	regIdentity.updateMutex.Lock()
+	defer regIdentity.updateMutex.Unlock()
+	return regIdentity.fullIdentity, regIdentity.privateKey
+}
+
+// GetUpdatedIdentity returns the identity if it has been updated since the last call, or nil if it hasn't
+// Intended to publish the identity and start using its keys after it was renewed.
+// clearUpdates clears the update flag on return
+func (regIdentity *RegisteredIdentity) GetUpdatedIdentity(clearUpdates bool) (
+	fullIdentity *types.PublisherFullIdentity, privKey crypto.PrivateKey) {
+
+	regIdentity.updateMutex.Lock()
+	defer regIdentity.updateMutex.Unlock()
+	if !regIdentity.updated {
+		return nil, nil
+	}
+	if clearUpdates {
+		regIdentity.updated = false
+	}
 	return regIdentity.fullIdentity, regIdentity.privateKey
 }
 
 // LoadIdentity loads the publisher identity and private key from json file and
 // verifies its content. See also VerifyIdentity for the criteria.
-//  Returns the identity with corresponding ECDSA private key.
+// With a key store, the private key is loaded from the store unless the identity file still
+// contains it.
+//  Returns the identity with corresponding ECDSA or Ed25519 private key.
 //  If the identity doesn't exist, has a different domain/publisherId, or is invalid
 // then an error will be returned and the existing identity remains unchanged.
 func (regIdentity *RegisteredIdentity) LoadIdentity() (
-	fullIdentity *types.PublisherFullIdentity, privKey *ecdsa.PrivateKey, err error) {
+	fullIdentity *types.PublisherFullIdentity, privKey crypto.PrivateKey, err error) {
 
 	if regIdentity.filename == "" {
 		err := lib.MakeErrorf("LoadIdentity: Missing filename")
@@ -67,12 +100,20 @@ func (regIdentity *RegisteredIdentity) LoadIdentity() (
 
 	identityJSON, err := ioutil.ReadFile(regIdentity.filename)
 	if err != nil {
-		return nil, nil, err
+		regIdentity.updateMutex.Lock()
+		defer regIdentity.updateMutex.Unlock()
+		return regIdentity.fullIdentity, regIdentity.privateKey, err
 	}
 	fullIdentity = &types.PublisherFullIdentity{}
 	err = json.Unmarshal(identityJSON, fullIdentity)
-	if err == nil {
-		privKey = messaging.PrivateKeyFromPem(fullIdentity.PrivateKey)
+	if err == nil && fullIdentity.PrivateKey == "" && regIdentity.keyStore != nil {
+		// the identity file doesn't contain the key
+		privKey, err = regIdentity.keyStore.LoadKey()
+		if err == nil {
+			fullIdentity.PrivateKey = messaging.PrivateKeyToPem(privKey)
+		}
+	} else if err == nil {
+		privKey, err = messaging.ParsePrivateKeyPem(fullIdentity.PrivateKey)
 	}
 	if err == nil {
 		// must match domain and publisher
@@ -80,6 +121,8 @@ func (regIdentity *RegisteredIdentity) LoadIdentity() (
 		err = VerifyFullIdentity(fullIdentity, regIdentity.domain, regIdentity.publisherID, nil)
 	}
 	// finaly, replace the identity with the loaded identity
+	regIdentity.updateMutex.Lock()
+	defer regIdentity.updateMutex.Unlock()
 	if err == nil {
 		regIdentity.fullIdentity = fullIdentity
 		regIdentity.privateKey = privKey
@@ -87,7 +130,35 @@ func (regIdentity *RegisteredIdentity) LoadIdentity() (
 	return regIdentity.fullIdentity, regIdentity.privateKey, err
 }
 
+// RenewIdentity replaces the identity with a new self-signed identity with new keys. The organization
+// and location of the current identity are retained. The new keys use the key algorithm of this
+// registered identity. Use SaveIdentity to save it to the identity file.
+// Intended for publishers that are not part of a secured domain and renew their identity before it expires.
+func (regIdentity *RegisteredIdentity) RenewIdentity() (
+	fullIdentity *types.PublisherFullIdentity, privKey crypto.PrivateKey) {
+
+	// the algorithm is verified when the registered identity is created
+	fullIdentity, privKey, _ = CreateIdentityWithAlgorithm(
+		regIdentity.domain, regIdentity.publisherID, regIdentity.keyAlgorithm)
+
+	regIdentity.updateMutex.Lock()
+	defer regIdentity.updateMutex.Unlock()
+	if regIdentity.fullIdentity != nil {
+		fullIdentity.Location = regIdentity.fullIdentity.Location
+		fullIdentity.Organization = regIdentity.fullIdentity.Organization
+		messaging.SignIdentity(&fullIdentity.PublisherIdentityMessage, privKey)
+	}
+	regIdentity.fullIdentity = fullIdentity
+	regIdentity.privateKey = privKey
+	regIdentity.updated = true
+	return fullIdentity, privKey
+}
+
 // SaveIdentity saves the full identity of the publisher
+// With a key store, the private key is saved in the store and not in the identity file. The
+// identity is written to a temporary file that replaces the identity file once the key is saved.
+// If replacing the identity file fails then the previous key is restored, so the saved identity
+// and key always belong together.
 // see also https://stackoverflow.com/questions/21322182/how-to-store-ecdsa-private-key-in-go
 func (regIdentity *RegisteredIdentity) SaveIdentity() error {
 
@@ -95,61 +166,124 @@ func (regIdentity *RegisteredIdentity) SaveIdentity() error {
 		return lib.MakeErrorf("SaveIdentity: Missing filename")
 	}
 
-	// save the identity as JSON. Remove the existing file first as they are read-only
-	identityJSON, _ := json.MarshalIndent(regIdentity.fullIdentity, " ", " ")
-	// move the identity before deleting
-	os.Rename(regIdentity.filename, regIdentity.filename+".old")
-	err := ioutil.WriteFile(regIdentity.filename, identityJSON, 0400)
+	regIdentity.updateMutex.Lock()
+	savedIdentity := *regIdentity.fullIdentity
+	privKey := regIdentity.privateKey
+	keyStore := regIdentity.keyStore
+	regIdentity.updateMutex.Unlock()
+	if keyStore != nil {
+		savedIdentity.PrivateKey = ""
+	}
+	identityJSON, _ := json.MarshalIndent(&savedIdentity, " ", " ")
+	tmpFilename := regIdentity.filename + ".tmp"
+	os.Remove(tmpFilename)
+	err := ioutil.WriteFile(tmpFilename, identityJSON, 0400)
+	if err != nil {
+		return lib.MakeErrorf("SaveIdentity: Unable to save the publisher's identity at %s: %s", regIdentity.filename, err)
+	}
+	var previousKey crypto.PrivateKey
+	if keyStore != nil {
+		previousKey, _ = keyStore.LoadKey()
+		err = keyStore.SaveKey(privKey)
+		if err != nil {
+			os.Remove(tmpFilename)
+			return lib.MakeErrorf("SaveIdentity: Unable to save the publisher's private key: %s", err)
+		}
+	}
+	// the identity file is read-only, which doesn't prevent replacing it
+	err = os.Rename(tmpFilename, regIdentity.filename)
 	if err != nil {
+		os.Remove(tmpFilename)
+		if previousKey != nil {
+			keyStore.SaveKey(previousKey)
+		}
 		return lib.MakeErrorf("SaveIdentity: Unable to save the publisher's identity at %s: %s", regIdentity.filename, err)
 	}
-	os.Remove(regIdentity.filename + ".old")
-	return err
+	return nil
 }
 
 // SetDssKey sets the DSS public key. This is needed to allow the DSS to update the
 // registered identity. Without it, any updates are refused. Intended to be set by
 // the publisher when a verified DSS identity is received.
-func (regIdentity *RegisteredIdentity) SetDssKey(dssSigningKey *ecdsa.PublicKey) {
+func (regIdentity *RegisteredIdentity) SetDssKey(dssSigningKey crypto.PublicKey) {
+	regIdentity.updateMutex.Lock()
+	defer regIdentity.updateMutex.Unlock()
 	regIdentity.dssPubKey = dssSigningKey
 }
 
-// UpdateIdentity verifies and sets a new registered identity and saves it to the
+// SetKeyStore sets the store of the private key. SaveIdentity saves the key in this store instead
+// of the identity file and LoadIdentity loads it from this store. Set it before LoadIdentity.
+// An identity file that still contains the key can be loaded and moves the key to the store when saved.
+//  keyStore to use, or nil to keep the private key in the identity file
+func (regIdentity *RegisteredIdentity) SetKeyStore(keyStore keystore.KeyStore) {
+	regIdentity.updateMutex.Lock()
+	defer regIdentity.updateMutex.Unlock()
+	regIdentity.keyStore = keyStore
+}
+
+// UpdateIdentity verifies and sets a new registered identity. Use SaveIdentity to save it to the
 // identity file.
-func (regIdentity *RegisteredIdentity) UpdateIdentity(fullIdentity *types.PublisherFullIdentity) {
+// Returns an error if the identity fails verification, in which case the identity is not updated.
+func (regIdentity *RegisteredIdentity) UpdateIdentity(fullIdentity *types.PublisherFullIdentity) error {
+	regIdentity.updateMutex.Lock()
+	defer regIdentity.updateMutex.Unlock()
 
 	err := VerifyFullIdentity(fullIdentity, regIdentity.domain, regIdentity.publisherID, regIdentity.dssPubKey)
 	if err != nil {
 		logrus.Errorf("UpdateIdentity: verification failed. Identity not updated.")
-		return
+		return err
 	}
-	privKey := messaging.PrivateKeyFromPem(fullIdentity.PrivateKey)
+	// the private key is verified above
+	privKey, _ := messaging.ParsePrivateKeyPem(fullIdentity.PrivateKey)
 	regIdentity.privateKey = privKey
 	regIdentity.fullIdentity = fullIdentity
 	regIdentity.updated = true
+	return nil
 }
 
-// CreateIdentity creates and self-sign a new identity for the publisher
+// CreateIdentity creates and self-sign a new identity for the publisher with ES256 keys
 // This creates a base64encoded signature of the public identity using the given
 // private key.
 // The validity is 1 year.
 func CreateIdentity(domain string, publisherID string) (
-	fullIdentity *types.PublisherFullIdentity, signingPrivKey *ecdsa.PrivateKey) {
+	fullIdentity *types.PublisherFullIdentity, signingPrivKey crypto.PrivateKey) {
+
+	fullIdentity, signingPrivKey, _ = CreateIdentityWithAlgorithm(domain, publisherID, messaging.KeyAlgorithmES256)
+	return fullIdentity, signingPrivKey
+}
+
+// CreateIdentityWithAlgorithm creates and self-sign a new identity for the publisher
+//  algorithm of the identity keys, eg messaging.KeyAlgorithmES256 (default), KeyAlgorithmES384 or
+//  KeyAlgorithmEdDSA. Publishers with EdDSA keys cannot receive encrypted messages, which includes
+//  all commands and acknowledgements, nor be a reader of encrypted output values.
+// Returns an error if the algorithm is not supported
+func CreateIdentityWithAlgorithm(domain string, publisherID string, algorithm string) (
+	fullIdentity *types.PublisherFullIdentity, signingPrivKey crypto.PrivateKey, err error) {
 	// Create a new one and sign it.
 	timestampStr := time.Now().Format(types.TimeFormat)
 	validUntil := time.Now().Add(validDuration)
 	validUntilStr := validUntil.Format(types.TimeFormat)
 
 	// generate private/public key for signing and store the public key in the publisher identity in PEM format
-	identityPrivKey := messaging.CreateAsymKeys()
+	identityPrivKey, err := messaging.CreateKeys(algorithm)
+	if err != nil {
+		return nil, nil, lib.MakeErrorf("CreateIdentity: %s", err)
+	}
 
-	identityPubPem := messaging.PublicKeyToPem(&identityPrivKey.PublicKey)
+	identityPubPem := messaging.PublicKeyToPem(messaging.GetPublicKeyOf(identityPrivKey))
 	identityPrivPem := messaging.PrivateKeyToPem(identityPrivKey)
 	addr := MakePublisherIdentityAddress(domain, publisherID)
 
+	// ES256 identities don't record the algorithm so existing publishers can verify them
+	keyAlgorithm := messaging.GetKeyAlgorithm(identityPrivKey)
+	if keyAlgorithm == messaging.KeyAlgorithmES256 {
+		keyAlgorithm = ""
+	}
+
 	// self signed identity
 	publicIdentity := types.PublisherIdentityMessage{
 		Address:           addr,
+		Algorithm:         keyAlgorithm,
 		IdentitySignature: "",
 		Domain:            domain,
 		IssuerID:          publisherID, // self issued, will be replaced by DSS
@@ -168,7 +302,16 @@ func CreateIdentity(domain string, publisherID string) (
 		PublisherIdentityMessage: publicIdentity,
 		PrivateKey:               identityPrivPem,
 	}
-	return fullIdentity, identityPrivKey
+	return fullIdentity, identityPrivKey, nil
+}
+
+// GetIdentityAlgorithm returns the algorithm of the public key of the identity
+// Identities without algorithm use ES256.
+func GetIdentityAlgorithm(identity *types.PublisherIdentityMessage) string {
+	if identity.Algorithm == "" {
+		return messaging.KeyAlgorithmES256
+	}
+	return identity.Algorithm
 }
 
 // IsIdentityExpired tests if the given identity is expired
@@ -178,6 +321,16 @@ func IsIdentityExpired(identity *types.PublisherIdentityMessage) bool {
 	return (nowIsGreater > 0)
 }
 
+// IsIdentityExpiring tests if the given identity expires within the given duration
+// An identity without a valid expiry time is considered to be expiring.
+func IsIdentityExpiring(identity *types.PublisherIdentityMessage, renewBefore time.Duration) bool {
+	validUntil, err := time.Parse(types.TimeFormat, identity.ValidUntil)
+	if err != nil {
+		return true
+	}
+	return time.Now().Add(renewBefore).After(validUntil)
+}
+
 // MakePublisherIdentityAddress generates the address of a publisher:
 //   domain/publisherID/$identity
 // Intended for lookup of nodes in the node list.
@@ -201,7 +354,7 @@ func MakePublisherIdentityAddress(domain string, publisherID string) string {
 // If any of these conditions are not met then a new self-signed identity is created. When in a
 // secured domain, the publisher must be re-added to the domain as the issuer is not the DSS.
 func VerifyFullIdentity(ident *types.PublisherFullIdentity, domain string,
-	publisherID string, dssSigningKey *ecdsa.PublicKey) error {
+	publisherID string, dssSigningKey crypto.PublicKey) error {
 
 	// must be of the same publisher
 	if domain != ident.Domain || publisherID != ident.PublisherID {
@@ -215,29 +368,50 @@ func VerifyFullIdentity(ident *types.PublisherFullIdentity, domain string,
 	}
 
 	// public key in identity must be the PEM key that belongs to the private key
-	identPrivateKey := messaging.PrivateKeyFromPem(ident.PrivateKey)
-	publicPem := messaging.PublicKeyToPem(&identPrivateKey.PublicKey)
-	if publicPem != ident.PublicKey {
+	identPrivateKey, err := messaging.ParsePrivateKeyPem(ident.PrivateKey)
+	if err != nil {
+		return lib.MakeErrorf("VerifyFullIdentity: Identity '%s' has an invalid private key: %s", ident.Address, err)
+	}
+	identPublicKey := messaging.GetPublicKeyOf(identPrivateKey)
+	if identPublicKey == nil || messaging.PublicKeyToPem(identPublicKey) != ident.PublicKey {
 		return lib.MakeErrorf("VerifyFullIdentity: Public key in signed identity '%s' doesn't belong to the identity private key", ident.Address)
 	}
 	// identity is valid
 	return nil
 }
 
-// NewRegisteredIdentity creates a new persistent registered identity
+// NewRegisteredIdentity creates a new persistent registered identity with ES256 keys
 // Use LoadIdentity to load the previously saved identity before use.
 // If no filename is provided, the identity will not be loaded or saved
 func NewRegisteredIdentity(domain string, publisherID string, identityFile string) (regIdent *RegisteredIdentity) {
+	regIdent, _ = NewRegisteredIdentityWithAlgorithm(domain, publisherID, identityFile, messaging.KeyAlgorithmES256)
+	return regIdent
+}
+
+// NewRegisteredIdentityWithAlgorithm creates a new persistent registered identity whose new keys
+// use the given algorithm. A loaded identity keeps its keys until it is renewed.
+//  algorithm of the keys, eg messaging.KeyAlgorithmES256 (default), KeyAlgorithmES384 or KeyAlgorithmEdDSA
+// Returns an error if the algorithm is not supported
+func NewRegisteredIdentityWithAlgorithm(domain string, publisherID string, identityFile string, algorithm string) (
+	regIdent *RegisteredIdentity, err error) {
 
-	fullIdentity, privKey := CreateIdentity(domain, publisherID)
+	if algorithm == "" {
+		algorithm = messaging.KeyAlgorithmES256
+	}
+	fullIdentity, privKey, err := CreateIdentityWithAlgorithm(domain, publisherID, algorithm)
+	if err != nil {
+		return nil, err
+	}
 
 	regIdent = &RegisteredIdentity{
 		domain:       domain,
 		filename:     identityFile,
 		fullIdentity: fullIdentity,
+		keyAlgorithm: algorithm,
 		privateKey:   privKey,
 		publisherID:  publisherID,
 		updated:      true,
+		updateMutex:  &sync.Mutex{},
 	}
-	return regIdent
+	return regIdent, nil
 }
@@ -4,6 +4,7 @@ package inputs
 import (
 	"fmt"
 	"reflect"
+	"sync"
 
 	"github.com/iotdomain/iotdomain-go/lib"
 	"github.com/iotdomain/iotdomain-go/messaging"
@@ -17,6 +18,8 @@ type DomainInputs struct {
 	// inputMap      map[string]*types.InputDiscoveryMessage
 	messageSigner *messaging.MessageSigner // subscription to input discovery messages
 	// updateMutex   *sync.Mutex              // mutex for async updating of inputs
+	subscriptions     map[string]messaging.SubscriptionHandle // subscription handles by address
+	subscriptionMutex *sync.Mutex                             // mutex for updating subscriptions
 }
 
 // AddInput adds or replaces the input.
@@ -56,17 +59,34 @@ func (domainInputs *DomainInputs) RemoveInput(inputAddress string) {
 	domainInputs.c.Remove(inputAddress)
 }
 
+// RemovePublisherInputs removes all inputs of a publisher, eg when the publisher is revoked
+// publisherAddress contains the domain/publisherID[/$identity]
+// Returns the number of removed inputs
+func (domainInputs *DomainInputs) RemovePublisherInputs(publisherAddress string) int {
+	return domainInputs.c.RemoveByAddressPrefix(publisherAddress)
+}
+
 // Subscribe to inputs from a domain publisher
 func (domainInputs *DomainInputs) Subscribe(domain string, publisherID string) {
 	// subscription address for all inputs domain/publisher/node/type/instance/$input
 	addr := MakeInputDiscoveryAddress(domain, publisherID, "+", "+", "+")
-	domainInputs.messageSigner.Subscribe(addr, domainInputs.handleDiscoverInput)
+	domainInputs.subscriptionMutex.Lock()
+	defer domainInputs.subscriptionMutex.Unlock()
+	if _, found := domainInputs.subscriptions[addr]; found {
+		return
+	}
+	domainInputs.subscriptions[addr] = domainInputs.messageSigner.Subscribe(addr, domainInputs.handleDiscoverInput)
 }
 
 // Unsubscribe from publisher inputs
 func (domainInputs *DomainInputs) Unsubscribe(domain string, publisherID string) {
 	addr := MakeInputDiscoveryAddress(domain, publisherID, "+", "+", "+")
-	domainInputs.messageSigner.Unsubscribe(addr, domainInputs.handleDiscoverInput)
+	domainInputs.subscriptionMutex.Lock()
+	defer domainInputs.subscriptionMutex.Unlock()
+	if handle, found := domainInputs.subscriptions[addr]; found {
+		domainInputs.messageSigner.Unsubscribe(handle)
+		delete(domainInputs.subscriptions, addr)
+	}
 }
 
 // handleDiscoverInput updates the domain input list with discovered inputs
@@ -89,8 +109,10 @@ func MakeInputDiscoveryAddress(domain string, publisherID string, nodeID string,
 func NewDomainInputs(messageSigner *messaging.MessageSigner) *DomainInputs {
 
 	inputs := DomainInputs{
-		c:             lib.NewDomainCollection(reflect.TypeOf(&types.InputDiscoveryMessage{}), messageSigner.GetPublicKey),
-		messageSigner: messageSigner,
+		c:                 lib.NewDomainCollection(reflect.TypeOf(&types.InputDiscoveryMessage{}), messageSigner.GetPublicKey),
+		messageSigner:     messageSigner,
+		subscriptions:     make(map[string]messaging.SubscriptionHandle),
+		subscriptionMutex: &sync.Mutex{},
 	}
 	return &inputs
 }
@@ -1,7 +1,7 @@
 package inputs_test
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"encoding/json"
 	"testing"
 
@@ -22,7 +22,7 @@ func TestNewDomainInput(t *testing.T) {
 	const node1Addr = domain + "/" + publisherID + "/" + nodeID
 	const inputType = types.InputTypeSwitch
 	privKey := messaging.CreateAsymKeys()
-	getPubKey := func(address string) *ecdsa.PublicKey {
+	getPubKey := func(address string) crypto.PublicKey {
 		return &privKey.PublicKey
 	}
 	messenger := messaging.NewDummyMessenger(dummyConfig)
@@ -65,7 +65,7 @@ func TestDiscoverDomainInputs(t *testing.T) {
 	const node1Addr = domain + "/" + publisherID + "/" + nodeID
 	const inputType = types.InputTypeSwitch
 	privKey := messaging.CreateAsymKeys()
-	getPubKey := func(address string) *ecdsa.PublicKey {
+	getPubKey := func(address string) crypto.PublicKey {
 		return &privKey.PublicKey
 	}
 	messenger := messaging.NewDummyMessenger(dummyConfig)
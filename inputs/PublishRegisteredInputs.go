@@ -24,3 +24,14 @@ func PublishRegisteredInputs(
 	// 	persist.SaveInputs(publisher.cacheFolder, publisher.PublisherID(), allInputs)
 	// }
 }
+
+// RemoveRegisteredInputs removes the discovery publication of deleted inputs from the message bus
+func RemoveRegisteredInputs(
+	deletedInputs []*types.InputDiscoveryMessage,
+	messageSigner *messaging.MessageSigner) {
+
+	for _, input := range deletedInputs {
+		logrus.Infof("RemoveRegisteredInputs: remove input discovery: %s", input.Address)
+		messageSigner.RemovePublication(input.Address)
+	}
+}
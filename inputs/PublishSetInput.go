@@ -1,7 +1,7 @@
 package inputs
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"errors"
 	"fmt"
 	"strings"
@@ -19,7 +19,17 @@ import (
 //  The messageSigner is used to encrypt the message using the encryption key from the destination publisher
 func PublishSetInput(
 	destination string, value string, sender string,
-	messageSigner *messaging.MessageSigner, encryptionKey *ecdsa.PublicKey) error {
+	messageSigner *messaging.MessageSigner, encryptionKey crypto.PublicKey) error {
+
+	return PublishSetInputWithCorrelationID(destination, value, sender, "", messageSigner, encryptionKey)
+}
+
+// PublishSetInputWithCorrelationID sends a message to set the input value of a remote destination
+// like PublishSetInput. The receiver acknowledges the command with the given correlation ID, see
+// the acks package.
+func PublishSetInputWithCorrelationID(
+	destination string, value string, sender string, correlationID string,
+	messageSigner *messaging.MessageSigner, encryptionKey crypto.PublicKey) error {
 
 	// logger.Infof("PublishSetInput: publishing encrypted input %s to %s", value, remoteNodeInputAddress)
 	// encryptionKey := setInputs.getPublisherKey(remoteNodeInputAddress)
@@ -38,10 +48,11 @@ func PublishSetInput(
 	// Encecode the SetMessage
 	timeStampStr := time.Now().Format("2006-01-02T15:04:05.000-0700")
 	var setMessage = types.SetInputMessage{
-		Address:   inputAddr,
-		Sender:    sender,
-		Timestamp: timeStampStr,
-		Value:     value,
+		Address:       inputAddr,
+		CorrelationID: correlationID,
+		Sender:        sender,
+		Timestamp:     timeStampStr,
+		Value:         value,
 	}
 	// setInputs.messageSigner.PublishObject(inputAddr, false, &setMessage, encryptionKey)
 	return messageSigner.PublishObject(inputAddr, false, &setMessage, encryptionKey)
@@ -16,12 +16,14 @@ type ReceiveFromOutputs struct {
 	isRunning        bool                        // flag, subscriptions are active
 	messageSigner    *messaging.MessageSigner    // subscription and publication messenger
 	registeredInputs *RegisteredInputs           // registered inputs of this publisher
-	senderTimestamp  map[string]string           // most recent timestamp of received commands by sender
-	updateMutex      *sync.Mutex                 // mutex for async updating of inputs
+	replayGuard      *messaging.ReplayGuard      // protection against replay of outputs
+	// subscriptions to outputs used as input source
+	subscriptions map[string]messaging.SubscriptionHandle // output subscriptions [outputAddr]handle
+	updateMutex   *sync.Mutex                             // mutex for async updating of inputs
 }
 
 // CreateInput adds a subscription to an output to use as input
-// If the given output address is already subscribed to, its handler will be replaced
+// Multiple inputs can share the same output. The output is subscribed to only once.
 //  The given outputAddress is one of $raw or $latest output address
 //  The handler is provided with the address, the sender and the received output value.
 func (ifout *ReceiveFromOutputs) CreateInput(
@@ -34,39 +36,42 @@ func (ifout *ReceiveFromOutputs) CreateInput(
 	ifout.updateMutex.Lock()
 	defer ifout.updateMutex.Unlock()
 
-	ifout.messageSigner.Subscribe(outputAddress, ifout.onReceiveOutput)
+	_, hasSubscription := ifout.subscriptions[outputAddress]
+	if !hasSubscription {
+		ifout.subscriptions[outputAddress] = ifout.messageSigner.Subscribe(outputAddress, ifout.onReceiveOutput)
+	}
+	// a replaced input might have used another output
+	ifout.unsubscribeUnusedOutputs()
 	return input
 }
 
 // DeleteInput by address
+// The output is unsubscribed from when no other input uses it.
 func (ifout *ReceiveFromOutputs) DeleteInput(inputID string) {
 	ifout.updateMutex.Lock()
 	defer ifout.updateMutex.Unlock()
 
-	input := ifout.registeredInputs.GetInputByID(inputID)
-	if input != nil {
-		ifout.messageSigner.Unsubscribe(input.Source, ifout.onReceiveOutput)
-		ifout.registeredInputs.DeleteInput(inputID)
-	}
+	ifout.registeredInputs.DeleteInput(inputID)
+	ifout.unsubscribeUnusedOutputs()
 }
 
 // onReceiveOutput verifies the message sender (for 'latest' outputs)
+// Values of confidential outputs are decrypted if this publisher is one of their readers.
 func (ifout *ReceiveFromOutputs) onReceiveOutput(address string, message string) error {
 	var value string
 	if strings.HasSuffix(address, types.MessageTypeRaw) {
 		value = message
 	} else if strings.HasSuffix(address, types.MessageTypeLatest) {
 		latestMessage := types.OutputLatestMessage{}
-		isSigned, err := ifout.messageSigner.VerifySignedMessage(message, &latestMessage)
+		_, isSigned, err := ifout.messageSigner.DecodeMessage(message, &latestMessage)
 		if err != nil {
 			return lib.MakeErrorf("onReceiveOutput: Sender of output on address %s failed to verify: %s", address, err)
 		}
 		// Verify this is the most recent message to protect against replay attacks
-		prevTimestamp := ifout.senderTimestamp[address]
-		if prevTimestamp > latestMessage.Timestamp {
-			return lib.MakeErrorf("onReceiveOutput: earlier timestamp of output %s. Message discarded.", address)
+		err = ifout.replayGuard.Check(address, address, latestMessage.Timestamp, message)
+		if err != nil {
+			return lib.MakeErrorf("onReceiveOutput: %s. Message discarded.", err)
 		}
-		ifout.senderTimestamp[address] = latestMessage.Timestamp
 		_ = isSigned
 		value = latestMessage.Value
 	}
@@ -79,6 +84,17 @@ func (ifout *ReceiveFromOutputs) onReceiveOutput(address string, message string)
 	return nil
 }
 
+// unsubscribeUnusedOutputs removes the subscriptions to outputs that are not used by any input
+// The caller must hold the update mutex.
+func (ifout *ReceiveFromOutputs) unsubscribeUnusedOutputs() {
+	for outputAddress, handle := range ifout.subscriptions {
+		if len(ifout.registeredInputs.GetInputsWithSource(outputAddress)) == 0 {
+			delete(ifout.subscriptions, outputAddress)
+			ifout.messageSigner.Unsubscribe(handle)
+		}
+	}
+}
+
 // NewReceiveFromOutputs creates a input list with subscriptions to outputs to use as input
 func NewReceiveFromOutputs(
 	messageSigner *messaging.MessageSigner,
@@ -88,7 +104,8 @@ func NewReceiveFromOutputs(
 	ifo := ReceiveFromOutputs{
 		messageSigner:    messageSigner,
 		registeredInputs: registeredInputs,
-		senderTimestamp:  make(map[string]string),
+		replayGuard:      messaging.NewOrderReplayGuard(), // retained outputs can be old, only verify order
+		subscriptions:    make(map[string]messaging.SubscriptionHandle),
 		updateMutex:      &sync.Mutex{}, // mutex for async updating of inputs
 	}
 	return &ifo
@@ -1,7 +1,7 @@
 package inputs_test
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"testing"
 	"time"
 
@@ -28,7 +28,7 @@ func TestReceiveFromOutputs(t *testing.T) {
 		inputReceived = value
 	}
 	msgr := messaging.NewDummyMessenger(nil)
-	signer := messaging.NewMessageSigner(msgr, privKey, func(addr string) *ecdsa.PublicKey {
+	signer := messaging.NewMessageSigner(msgr, privKey, func(addr string) crypto.PublicKey {
 		return signatureVerificationKey
 	})
 	regInputs := inputs.NewRegisteredInputs(domain, publisher1ID)
@@ -56,6 +56,11 @@ func TestReceiveFromOutputs(t *testing.T) {
 	// time.Sleep(2 * time.Second)
 	assert.Equal(t, "World", inputReceived, "No input received")
 
+	// the retained output delivered again on resubscribe is accepted
+	inputReceived = ""
+	msgr.Publish(outputAddrLatest, true, msgr.FindLastPublication(outputAddrLatest))
+	assert.Equal(t, "World", inputReceived, "Redelivered output not received")
+
 	// older timestamp
 	latest.Timestamp = (time.Now().Add(-time.Hour)).Format(types.TimeFormat)
 	latest.Value = "Older"
@@ -78,4 +83,15 @@ func TestReceiveFromOutputs(t *testing.T) {
 	// delete non existing input should not fail
 	i.DeleteInput(input1.InputID)
 
+	// a shared output remains subscribed until its last input is deleted
+	input2 := i.CreateInput(device1ID, inputType, "2", outputAddrRaw, handler)
+	input3 := i.CreateInput(device1ID, inputType, "3", outputAddrRaw, handler)
+	i.DeleteInput(input2.InputID)
+	inputReceived = ""
+	msgr.Publish(outputAddrRaw, false, "Shared")
+	assert.Equal(t, "Shared", inputReceived, "Shared output no longer received")
+	i.DeleteInput(input3.InputID)
+	inputReceived = ""
+	msgr.Publish(outputAddrRaw, false, "Unsubscribed")
+	assert.Empty(t, inputReceived, "Output received after deleting its inputs")
 }
@@ -7,26 +7,33 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/iotdomain/iotdomain-go/acks"
+	"github.com/iotdomain/iotdomain-go/acl"
 	"github.com/iotdomain/iotdomain-go/lib"
 	"github.com/iotdomain/iotdomain-go/messaging"
 	"github.com/iotdomain/iotdomain-go/types"
 	"github.com/sirupsen/logrus"
 )
 
+// DeniedHandler is notified when a set command is denied because the sender is not authorized
+// Intended to report the error in the lastError status of the node.
+type DeniedHandler func(nodeHWID string, errorMsg string)
+
 // ReceiveFromSetCommands handles set commands aimed at inputs managed by this publisher.
 // This decrypts incoming messages determines the sender and verifies the signature with
 // the sender public key. Last it translates from the publishing address to the input ID
 // before passing the request to the handler associated with the input.
 type ReceiveFromSetCommands struct {
-	domain           string // the domain of this publisher
-	publisherID      string // the registered publisher for the inputs
+	authorizer       acl.Authorizer // optional authorization of senders
+	deniedHandler    DeniedHandler  // optional handler of denied commands
+	domain           string         // the domain of this publisher
+	publisherID      string         // the registered publisher for the inputs
 	isRunning        bool
 	messageSigner    *messaging.MessageSigner // subscription and publication messenger
-	senderTimestamp  map[string]string        // most recent timestamp of received commands by sender
 	registeredInputs *RegisteredInputs        // registered inputs of this publisher
 	// subscriptions of registered inputs
-	subscriptions map[string]string // SetInput subscriptions of inputs [setAddr]setAddr
-	updateMutex   *sync.Mutex       // mutex for async handling of inputs
+	subscriptions map[string]messaging.SubscriptionHandle // SetInput subscriptions of inputs [setAddr]handle
+	updateMutex   *sync.Mutex                             // mutex for async handling of inputs
 }
 
 // CreateInput creates a new input that responds to a set command from the message bus.
@@ -54,8 +61,20 @@ func (ifset *ReceiveFromSetCommands) DeleteInput(inputID string) {
 	ifset.registeredInputs.DeleteInput(inputID)
 }
 
-// decodeSetCommand decrypts and verifies the signature of an incoming set command.
-// If successful this passes the set command to the setInputHandler callback
+// SetAuthorizer sets the authorizer that determines which senders can set which inputs.
+//  authorizer to use, or nil to allow all senders with a valid signature
+//  deniedHandler is optional and invoked when a command is denied
+func (ifset *ReceiveFromSetCommands) SetAuthorizer(authorizer acl.Authorizer, deniedHandler DeniedHandler) {
+	ifset.updateMutex.Lock()
+	defer ifset.updateMutex.Unlock()
+	ifset.authorizer = authorizer
+	ifset.deniedHandler = deniedHandler
+}
+
+// decodeSetCommand decrypts and verifies the signature and timestamp of an incoming set command.
+// If successful and the sender is authorized, this passes the set command to the setInputHandler callback
+// A command with a correlation ID is acknowledged to the sender once its signature is verified. Commands
+// that are not encrypted, not signed, have an invalid signature or are replayed are not acknowledged.
 func (ifset *ReceiveFromSetCommands) decodeSetCommand(address string, message string) error {
 	var setMessage types.SetInputMessage
 
@@ -70,34 +89,61 @@ func (ifset *ReceiveFromSetCommands) decodeSetCommand(address string, message st
 	segments[5] = types.MessageTypeInputDiscovery
 	inputAddr := strings.Join(segments, "/")
 
-	isEncrypted, isSigned, err := ifset.messageSigner.DecodeMessage(message, &setMessage)
+	isEncrypted, isSigned, err := ifset.messageSigner.DecodeCommand(address, message, &setMessage)
 
 	if !isEncrypted {
-		return lib.MakeErrorf("decodeSetCommand: Set command '%s' is not encrypted. Message discarded.", address)
+		err = lib.MakeErrorf("decodeSetCommand: Set command '%s' is not encrypted. Message discarded.", address)
 	} else if !isSigned {
-		return lib.MakeErrorf("decodeSetCommand: Set command '%s' is not signed. Message discarded.", address)
+		err = lib.MakeErrorf("decodeSetCommand: Set command '%s' is not signed. Message discarded.", address)
 	} else if err != nil {
-		return lib.MakeErrorf("decodeSetCommand: Message to %s. Error %s'. Message discarded.", address, err)
+		err = lib.MakeErrorf("decodeSetCommand: Message to %s. Error %s'. Message discarded.", address, err)
 	}
-
-	// Verify this is the most recent message to protect against replay attacks
-	prevTimestamp := ifset.senderTimestamp[setMessage.Sender]
-	if prevTimestamp > setMessage.Timestamp {
-		errText := fmt.Sprintf("decodeSetCommand: earlier timestamp of message to input %s from sender %s."+
-			" Message discarded.", address, setMessage.Sender)
-		logrus.Warning(errText)
-		return errors.New(errText)
+	if err != nil {
+		// the sender isn't verified so don't acknowledge
+		return err
 	}
-	ifset.senderTimestamp[setMessage.Sender] = setMessage.Timestamp
+
 	logrus.Infof("decodeSetCommand successful for input %s. isEncrypted=%t, isSigned=%t",
 		address, isEncrypted, isSigned)
 
-	// the handler is responsible for authorization
 	inputID := ifset.registeredInputs.addressMap[inputAddr]
+	input := ifset.registeredInputs.GetInputByID(inputID)
+	if input == nil {
+		err = lib.MakeErrorf("decodeSetCommand: Unknown input '%s'. Message discarded.", inputAddr)
+		ifset.publishAck(&setMessage, types.AckStatusRejected, err)
+		return err
+	}
+	ifset.updateMutex.Lock()
+	authorizer := ifset.authorizer
+	deniedHandler := ifset.deniedHandler
+	ifset.updateMutex.Unlock()
+	if authorizer != nil && !authorizer.IsAuthorized(setMessage.Sender, inputAddr, acl.ActionSetInput) {
+		err = lib.MakeErrorf("decodeSetCommand: Sender '%s' is not authorized to set input '%s'. Message discarded.",
+			setMessage.Sender, inputAddr)
+		if deniedHandler != nil {
+			deniedHandler(input.NodeHWID, err.Error())
+		}
+		ifset.publishAck(&setMessage, types.AckStatusRejected, err)
+		return err
+	}
 	ifset.registeredInputs.NotifyInputHandler(inputID, setMessage.Sender, setMessage.Value)
+	ifset.publishAck(&setMessage, types.AckStatusAccepted, nil)
 	return nil
 }
 
+// publishAck acknowledges a set command to its sender if the command has a correlation ID
+func (ifset *ReceiveFromSetCommands) publishAck(setMessage *types.SetInputMessage, status types.AckStatus, err error) {
+	if setMessage.CorrelationID == "" {
+		return
+	}
+	errorText := ""
+	if err != nil {
+		errorText = err.Error()
+	}
+	acks.PublishAck(ifset.domain, ifset.publisherID, setMessage.Sender, setMessage.CorrelationID,
+		status, errorText, ifset.messageSigner)
+}
+
 // subscribeToSetCommand to receive set input commands for the given node, type and instance
 func (ifset *ReceiveFromSetCommands) subscribeToSetCommand(input *types.InputDiscoveryMessage) {
 	// change message type $input to $set to make the set address from the input address
@@ -106,10 +152,9 @@ func (ifset *ReceiveFromSetCommands) subscribeToSetCommand(input *types.InputDis
 	setAddr := strings.Join(segments, "/")
 
 	// prevent double subscription
-	_, hasSubscription := ifset.subscriptions[input.Address]
+	_, hasSubscription := ifset.subscriptions[setAddr]
 	if !hasSubscription {
-		ifset.subscriptions[setAddr] = setAddr
-		ifset.messageSigner.Subscribe(setAddr, ifset.decodeSetCommand)
+		ifset.subscriptions[setAddr] = ifset.messageSigner.Subscribe(setAddr, ifset.decodeSetCommand)
 	}
 }
 
@@ -117,14 +162,17 @@ func (ifset *ReceiveFromSetCommands) subscribeToSetCommand(input *types.InputDis
 func (ifset *ReceiveFromSetCommands) unsubscribeFromSetCommand(inputID string) {
 	// change message type $input to $set to make the set address from the input address
 	input := ifset.registeredInputs.GetInputByID(inputID)
+	if input == nil {
+		return
+	}
 	segments := strings.Split(input.Address, "/")
 	segments[5] = types.MessageTypeSetInput
 	setAddr := strings.Join(segments, "/")
 
-	_, hasSubscription := ifset.subscriptions[setAddr]
+	handle, hasSubscription := ifset.subscriptions[setAddr]
 	if hasSubscription {
 		delete(ifset.subscriptions, setAddr)
-		ifset.messageSigner.Unsubscribe(setAddr, ifset.decodeSetCommand)
+		ifset.messageSigner.Unsubscribe(handle)
 	}
 }
 
@@ -151,8 +199,7 @@ func NewReceiveFromSetCommands(
 		messageSigner:    messageSigner,
 		publisherID:      publisherID,
 		registeredInputs: registeredInputs,
-		senderTimestamp:  make(map[string]string),
-		subscriptions:    make(map[string]string),
+		subscriptions:    make(map[string]messaging.SubscriptionHandle),
 		updateMutex:      &sync.Mutex{},
 	}
 	return recvsetin
@@ -1,11 +1,12 @@
 package inputs_test
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"fmt"
 	"testing"
 	"time"
 
+	"github.com/iotdomain/iotdomain-go/acl"
 	"github.com/iotdomain/iotdomain-go/inputs"
 	"github.com/iotdomain/iotdomain-go/messaging"
 	"github.com/iotdomain/iotdomain-go/types"
@@ -16,7 +17,7 @@ import (
 var privKey = messaging.CreateAsymKeys()
 
 // get publisher key for signature verification
-func getPublisherKey(addr string) *ecdsa.PublicKey {
+func getPublisherKey(addr string) crypto.PublicKey {
 	return &privKey.PublicKey
 }
 
@@ -48,7 +49,7 @@ func TestPublishSetInput(t *testing.T) {
 	var signatureVerificationKey = &privKey.PublicKey
 
 	msgr := messaging.NewDummyMessenger(nil)
-	signer := messaging.NewMessageSigner(msgr, privKey, func(addr string) *ecdsa.PublicKey {
+	signer := messaging.NewMessageSigner(msgr, privKey, func(addr string) crypto.PublicKey {
 		return signatureVerificationKey
 	})
 
@@ -113,4 +114,62 @@ func TestPublishSetInput(t *testing.T) {
 	rxMsg = receivedInputs[input1Addr]
 	assert.NotEqual(t, "content old", rxMsg, "Older message should not be accepted")
 
+	// unauthorized senders are rejected and reported
+	deniedNode := ""
+	accessControlList := acl.NewAccessControlList("", "", publisher1ID)
+	accessControlList.AddRule(acl.ACLRule{Sender: "admin", Address: "#"})
+	receiver.SetAuthorizer(accessControlList, func(nodeHWID string, errorMsg string) {
+		deniedNode = nodeHWID
+	})
+	inputs.PublishSetInput(setInput1Addr, "content2", senderAddr, signer, &privKey.PublicKey)
+	assert.Equal(t, "content1", receivedInputs[input1Addr], "Unauthorized set command should not be accepted")
+	assert.Equal(t, node1ID, deniedNode)
+	inputs.PublishSetInput(setInput1Addr, "content2", "admin", signer, &privKey.PublicKey)
+	assert.Equal(t, "content2", receivedInputs[input1Addr], "Authorized set command not accepted")
+}
+
+// TestSetInputFaults receives set commands over a bus that drops, duplicates and reorders messages
+func TestSetInputFaults(t *testing.T) {
+	const input1Type = types.InputTypeTemperature
+	var setInput1Addr = inputs.MakeSetInputAddress(domain, publisher1ID, node1ID, input1Type, types.DefaultInputInstance)
+	var senderAddr = fmt.Sprintf("%s/publisher2/node1/$node", domain)
+	received := make([]string, 0)
+
+	msgr := messaging.NewDummyMessenger(nil)
+	signer := messaging.NewMessageSigner(msgr, privKey, getPublisherKey)
+	registeredInputs := inputs.NewRegisteredInputs(domain, publisher1ID)
+	receiver := inputs.NewReceiveFromSetCommands(domain, publisher1ID, signer, registeredInputs)
+	receiver.CreateInput(node1ID, input1Type, types.DefaultInputInstance,
+		func(input *types.InputDiscoveryMessage, sender string, value string) {
+			received = append(received, value)
+		})
+	publishSetInput := func(value string) {
+		// timestamps have a millisecond resolution
+		time.Sleep(2 * time.Millisecond)
+		inputs.PublishSetInput(setInput1Addr, value, senderAddr, signer, &privKey.PublicKey)
+	}
+
+	// a duplicated command is handled once
+	msgr.InjectFault(messaging.DummyFault{Type: messaging.FaultDuplicate, Count: 1})
+	publishSetInput("1")
+	assert.Equal(t, []string{"1"}, received)
+
+	// a dropped command is lost
+	msgr.InjectFault(messaging.DummyFault{Type: messaging.FaultDrop, Count: 1})
+	publishSetInput("2")
+	assert.Equal(t, []string{"1"}, received)
+
+	// an older command that arrives late doesn't override a newer command
+	msgr.InjectFault(messaging.DummyFault{Type: messaging.FaultReorder, Count: 1})
+	publishSetInput("3")
+	publishSetInput("4")
+	assert.Equal(t, []string{"1", "4"}, received)
+
+	// commands are not received while the connection is lost
+	msgr.InjectFault(messaging.DummyFault{Type: messaging.FaultDisconnect, Count: 1})
+	publishSetInput("5")
+	publishSetInput("6")
+	msgr.SimulateReconnect()
+	publishSetInput("7")
+	assert.Equal(t, []string{"1", "4", "7"}, received)
 }
@@ -25,6 +25,7 @@ type RegisteredInputs struct {
 	addressMap        map[string]string                       // lookup inputID by publication address
 	inputsByHWID      map[string]*types.InputDiscoveryMessage // lookup input by inputHWID
 	updatedInputHWIDs map[string]string                       // inputHWIDs of inputs that have been rediscovered/updated
+	deletedInputs     map[string]*types.InputDiscoveryMessage // deleted inputs by address, pending removal from the bus
 	updateMutex       *sync.Mutex                             // mutex for async handling of inputs
 	// notification handlers by inputID
 	handlers map[string]func(input *types.InputDiscoveryMessage, sender string, value string)
@@ -61,14 +62,16 @@ func (regInputs *RegisteredInputs) DeleteInput(inputHWID string) {
 	regInputs.updateMutex.Lock()
 	defer regInputs.updateMutex.Unlock()
 
-	// inputAddr := MakeInputDiscoveryAddress(regInputs.domain, regInputs.publisherID, nodeID, inputType, instance)
+	input := regInputs.inputsByHWID[inputHWID]
+	if input == nil {
+		return
+	}
 	delete(regInputs.inputsByHWID, inputHWID)
+	delete(regInputs.addressMap, input.Address)
 	delete(regInputs.handlers, inputHWID)
-	if regInputs.updatedInputHWIDs == nil {
-		regInputs.updatedInputHWIDs = make(map[string]string)
-	}
-	// "" updates mean that the input is deleted
-	regInputs.updatedInputHWIDs[inputHWID] = ""
+	delete(regInputs.updatedInputHWIDs, inputHWID)
+	// keep the input until its publication is removed
+	regInputs.deletedInputs[input.Address] = input
 }
 
 // GetAllInputs returns the list of inputs
@@ -137,6 +140,22 @@ func (regInputs *RegisteredInputs) GetInputsWithSource(source string) []*types.I
 	return inputList
 }
 
+// GetDeletedInputs returns the list of registered inputs that have been deleted
+// clear the list of deleted inputs on return
+func (regInputs *RegisteredInputs) GetDeletedInputs(clearUpdates bool) []*types.InputDiscoveryMessage {
+	var deleteList []*types.InputDiscoveryMessage = make([]*types.InputDiscoveryMessage, 0)
+
+	regInputs.updateMutex.Lock()
+	defer regInputs.updateMutex.Unlock()
+	for _, input := range regInputs.deletedInputs {
+		deleteList = append(deleteList, input)
+	}
+	if clearUpdates {
+		regInputs.deletedInputs = make(map[string]*types.InputDiscoveryMessage)
+	}
+	return deleteList
+}
+
 // GetUpdatedInputs returns the list of registered inputs that have been updated
 // clear the update on return
 func (regInputs *RegisteredInputs) GetUpdatedInputs(clearUpdates bool) []*types.InputDiscoveryMessage {
@@ -216,6 +235,7 @@ func (regInputs *RegisteredInputs) updateInput(input *types.InputDiscoveryMessag
 	}
 	input.Timestamp = time.Now().Format(types.TimeFormat)
 	regInputs.updatedInputHWIDs[input.InputID] = input.InputID
+	delete(regInputs.deletedInputs, input.Address)
 }
 
 // MakeInputHWID creates the internal ID to identify the input of the owning node using its HWID
@@ -251,12 +271,13 @@ func NewInput(
 func NewRegisteredInputs(domain string, publisherID string) *RegisteredInputs {
 
 	regInputs := &RegisteredInputs{
-		domain:       domain,
-		publisherID:  publisherID,
-		addressMap:   make(map[string]string),
-		inputsByHWID: make(map[string]*types.InputDiscoveryMessage),
-		handlers:     make(map[string]func(input *types.InputDiscoveryMessage, sender string, newValue string)),
-		updateMutex:  &sync.Mutex{},
+		domain:        domain,
+		publisherID:   publisherID,
+		addressMap:    make(map[string]string),
+		deletedInputs: make(map[string]*types.InputDiscoveryMessage),
+		inputsByHWID:  make(map[string]*types.InputDiscoveryMessage),
+		handlers:      make(map[string]func(input *types.InputDiscoveryMessage, sender string, newValue string)),
+		updateMutex:   &sync.Mutex{},
 	}
 	return regInputs
 }
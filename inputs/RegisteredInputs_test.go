@@ -1,7 +1,7 @@
 package inputs_test
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"fmt"
 	"testing"
 
@@ -108,7 +108,7 @@ func TestPublish(t *testing.T) {
 
 	var privKey = messaging.CreateAsymKeys()
 
-	getPublisherKey := func(addr string) *ecdsa.PublicKey {
+	getPublisherKey := func(addr string) crypto.PublicKey {
 		return &privKey.PublicKey
 	}
 
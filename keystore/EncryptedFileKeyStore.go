@@ -0,0 +1,216 @@
+// Package keystore with a passphrase protected PKCS#8 key file store
+package keystore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// EncryptedKeyPemType is the PEM block type of an encrypted PKCS#8 private key
+const EncryptedKeyPemType = "ENCRYPTED PRIVATE KEY"
+
+// PBKDF2 iterations to derive the encryption key from the passphrase
+const pbkdf2Iterations = 100000
+
+// Object identifiers of PKCS#5 v2.0 (RFC 8018) password based encryption
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// encryptedPrivateKeyInfo is the PKCS#8 encrypted private key (RFC 5958)
+type encryptedPrivateKeyInfo struct {
+	EncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+// pbes2Params are the parameters of the PBES2 encryption algorithm
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params are the parameters of the PBKDF2 key derivation function
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// EncryptedFileKeyStore stores the private key in a PKCS#8 file that is encrypted with a passphrase.
+// The key is encrypted with AES-256-CBC using a PBKDF2-HMAC-SHA256 derived key, compatible with
+// 'openssl pkcs8 -topk8 -v2 aes-256-cbc'.
+type EncryptedFileKeyStore struct {
+	filename   string // file with the encrypted key
+	passphrase string // passphrase to derive the encryption key from
+}
+
+// LoadKey loads and decrypts the private key from the key file
+// Returns an error if the file cannot be read or the passphrase is incorrect
+func (store *EncryptedFileKeyStore) LoadKey() (crypto.PrivateKey, error) {
+	pemEncoded, err := ioutil.ReadFile(store.filename)
+	if err != nil {
+		return nil, lib.MakeErrorf("EncryptedFileKeyStore.LoadKey: Unable to read key file: %s", err)
+	}
+	block, _ := pem.Decode(pemEncoded)
+	if block == nil || block.Type != EncryptedKeyPemType {
+		return nil, lib.MakeErrorf("EncryptedFileKeyStore.LoadKey: Key file %s doesn't contain an encrypted private key",
+			store.filename)
+	}
+	privateKey, err := DecryptPKCS8PrivateKey(block.Bytes, store.passphrase)
+	if err != nil {
+		return nil, lib.MakeErrorf("EncryptedFileKeyStore.LoadKey: Key file %s: %s", store.filename, err)
+	}
+	return privateKey, nil
+}
+
+// SaveKey encrypts the private key and saves it in the key file
+func (store *EncryptedFileKeyStore) SaveKey(privateKey crypto.PrivateKey) error {
+	encryptedKey, err := EncryptPKCS8PrivateKey(privateKey, store.passphrase)
+	if err != nil {
+		return lib.MakeErrorf("EncryptedFileKeyStore.SaveKey: %s", err)
+	}
+	pemEncoded := pem.EncodeToMemory(&pem.Block{Type: EncryptedKeyPemType, Bytes: encryptedKey})
+	return writeKeyFile(store.filename, pemEncoded)
+}
+
+// DecryptPKCS8PrivateKey decrypts a DER encoded PBES2 encrypted PKCS#8 private key
+//  der is the encrypted private key
+//  passphrase the key is encrypted with
+// Returns the ECDSA or Ed25519 private key, or an error if the passphrase is incorrect or the
+// encryption isn't supported
+func DecryptPKCS8PrivateKey(der []byte, passphrase string) (crypto.PrivateKey, error) {
+	var keyInfo encryptedPrivateKeyInfo
+	var encParams pbes2Params
+	var kdfParams pbkdf2Params
+
+	_, err := asn1.Unmarshal(der, &keyInfo)
+	if err != nil {
+		return nil, lib.MakeErrorf("DecryptPKCS8PrivateKey: Invalid encrypted private key: %s", err)
+	} else if !keyInfo.EncryptionAlgorithm.Algorithm.Equal(oidPBES2) {
+		return nil, lib.MakeErrorf("DecryptPKCS8PrivateKey: Unsupported encryption algorithm %s",
+			keyInfo.EncryptionAlgorithm.Algorithm)
+	}
+	_, err = asn1.Unmarshal(keyInfo.EncryptionAlgorithm.Parameters.FullBytes, &encParams)
+	if err == nil && !encParams.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		err = lib.MakeErrorf("unsupported key derivation %s", encParams.KeyDerivationFunc.Algorithm)
+	} else if err == nil && !encParams.EncryptionScheme.Algorithm.Equal(oidAES256CBC) {
+		err = lib.MakeErrorf("unsupported encryption scheme %s", encParams.EncryptionScheme.Algorithm)
+	}
+	if err == nil {
+		_, err = asn1.Unmarshal(encParams.KeyDerivationFunc.Parameters.FullBytes, &kdfParams)
+	}
+	if err == nil && len(kdfParams.PRF.Algorithm) > 0 && !kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA256) {
+		// the default HMAC-SHA1 is not supported
+		err = lib.MakeErrorf("unsupported PBKDF2 function %s", kdfParams.PRF.Algorithm)
+	} else if err == nil && len(kdfParams.PRF.Algorithm) == 0 {
+		err = lib.MakeErrorf("unsupported PBKDF2 function HMAC-SHA1")
+	}
+	var iv []byte
+	if err == nil {
+		_, err = asn1.Unmarshal(encParams.EncryptionScheme.Parameters.FullBytes, &iv)
+	}
+	if err != nil {
+		return nil, lib.MakeErrorf("DecryptPKCS8PrivateKey: Invalid encryption parameters: %s", err)
+	}
+	encrypted := keyInfo.EncryptedData
+	if len(iv) != aes.BlockSize || len(encrypted) == 0 || len(encrypted)%aes.BlockSize != 0 {
+		return nil, lib.MakeErrorf("DecryptPKCS8PrivateKey: Invalid encrypted data size")
+	}
+
+	encryptionKey := pbkdf2.Key([]byte(passphrase), kdfParams.Salt, kdfParams.IterationCount, 32, sha256.New)
+	block, _ := aes.NewCipher(encryptionKey)
+	decrypted := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, encrypted)
+
+	// an incorrect passphrase results in invalid padding or an invalid key
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > aes.BlockSize ||
+		!bytes.Equal(decrypted[len(decrypted)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, lib.MakeErrorf("DecryptPKCS8PrivateKey: Incorrect passphrase")
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(decrypted[:len(decrypted)-padding])
+	if err != nil {
+		return nil, lib.MakeErrorf("DecryptPKCS8PrivateKey: Incorrect passphrase")
+	} else if messaging.GetKeyAlgorithm(privateKey) == "" {
+		return nil, lib.MakeErrorf("DecryptPKCS8PrivateKey: Unsupported private key type %T", privateKey)
+	}
+	return privateKey, nil
+}
+
+// EncryptPKCS8PrivateKey encrypts a private key as a DER encoded PBES2 encrypted PKCS#8 private key
+//  privateKey is the ECDSA or Ed25519 key to encrypt
+//  passphrase to encrypt the key with
+// Returns the encrypted key or an error if the key type is not supported or the passphrase is empty
+func EncryptPKCS8PrivateKey(privateKey crypto.PrivateKey, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, lib.MakeErrorf("EncryptPKCS8PrivateKey: Missing passphrase")
+	} else if messaging.GetKeyAlgorithm(privateKey) == "" {
+		return nil, lib.MakeErrorf("EncryptPKCS8PrivateKey: Unsupported private key type %T", privateKey)
+	}
+	plaintext, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, lib.MakeErrorf("EncryptPKCS8PrivateKey: %s", err)
+	}
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err = rand.Read(salt); err == nil {
+		_, err = rand.Read(iv)
+	}
+	if err != nil {
+		return nil, lib.MakeErrorf("EncryptPKCS8PrivateKey: %s", err)
+	}
+
+	encryptionKey := pbkdf2.Key([]byte(passphrase), salt, pbkdf2Iterations, 32, sha256.New)
+	block, _ := aes.NewCipher(encryptionKey)
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	plaintext = append(plaintext, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	encrypted := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, plaintext)
+
+	kdfParams, _ := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pbkdf2Iterations,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	ivParam, _ := asn1.Marshal(iv)
+	encParams, _ := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		EncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: encParams}},
+		EncryptedData:       encrypted,
+	})
+}
+
+// NewEncryptedFileKeyStore creates a store for a passphrase protected key file
+//  filename of the key file
+//  passphrase to encrypt the key with, see also ReadPassphrase
+// Returns an error if the passphrase is empty
+func NewEncryptedFileKeyStore(filename string, passphrase string) (*EncryptedFileKeyStore, error) {
+	if passphrase == "" {
+		return nil, lib.MakeErrorf("NewEncryptedFileKeyStore: Missing passphrase for key file %s", filename)
+	}
+	store := &EncryptedFileKeyStore{
+		filename:   filename,
+		passphrase: passphrase,
+	}
+	return store, nil
+}
@@ -0,0 +1,46 @@
+// Package keystore with a plaintext key file store
+package keystore
+
+import (
+	"crypto"
+	"io/ioutil"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/messaging"
+)
+
+// FileKeyStore stores the private key as plaintext PEM in a file that is only readable by its owner.
+// Intended for development. Use the EncryptedFileKeyStore in production.
+type FileKeyStore struct {
+	filename string // file with the PEM encoded key
+}
+
+// LoadKey loads the private key from the key file
+func (store *FileKeyStore) LoadKey() (crypto.PrivateKey, error) {
+	pemEncoded, err := ioutil.ReadFile(store.filename)
+	if err != nil {
+		return nil, lib.MakeErrorf("FileKeyStore.LoadKey: Unable to read key file: %s", err)
+	}
+	privateKey, err := messaging.ParsePrivateKeyPem(string(pemEncoded))
+	if err != nil {
+		return nil, lib.MakeErrorf("FileKeyStore.LoadKey: Key file %s: %s", store.filename, err)
+	}
+	return privateKey, nil
+}
+
+// SaveKey saves the private key in the key file
+func (store *FileKeyStore) SaveKey(privateKey crypto.PrivateKey) error {
+	if messaging.GetKeyAlgorithm(privateKey) == "" {
+		return lib.MakeErrorf("FileKeyStore.SaveKey: Unsupported private key type %T", privateKey)
+	}
+	return writeKeyFile(store.filename, []byte(messaging.PrivateKeyToPem(privateKey)))
+}
+
+// NewFileKeyStore creates a store for a plaintext PEM key file
+//  filename of the key file
+func NewFileKeyStore(filename string) *FileKeyStore {
+	store := &FileKeyStore{
+		filename: filename,
+	}
+	return store
+}
@@ -0,0 +1,95 @@
+// Package keystore with storage of the private key of a publisher identity
+package keystore
+
+import (
+	"crypto"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+)
+
+// Key store types for use in the publisher configuration
+const (
+	KeyStoreTypeEncrypted = "encrypted" // passphrase protected PKCS#8 file
+	KeyStoreTypeFile      = "file"      // plaintext PEM file, intended for development
+	KeyStoreTypeMemory    = "memory"    // memory only, intended for testing
+)
+
+// KeyStore stores the private key of a publisher identity
+type KeyStore interface {
+	// LoadKey loads the private key from the store
+	// Returns an error if the store has no key or the key cannot be read
+	LoadKey() (crypto.PrivateKey, error)
+
+	// SaveKey saves the private key in the store, replacing a previously saved key
+	// Returns an error if the key cannot be saved
+	SaveKey(privateKey crypto.PrivateKey) error
+}
+
+// ReadPassphrase reads the passphrase of a key store from the environment or from a file
+//  passphraseEnv is the name of the environment variable with the passphrase. Used if set.
+//  passphraseFile is the file whose first line is the passphrase, used if the environment
+//  variable isn't set
+// Returns an error if no passphrase is available
+func ReadPassphrase(passphraseEnv string, passphraseFile string) (string, error) {
+	if passphraseEnv != "" {
+		passphrase := os.Getenv(passphraseEnv)
+		if passphrase != "" {
+			return passphrase, nil
+		}
+	}
+	if passphraseFile == "" {
+		return "", lib.MakeErrorf("ReadPassphrase: No passphrase in environment variable '%s' and no passphrase file",
+			passphraseEnv)
+	}
+	content, err := ioutil.ReadFile(passphraseFile)
+	if err != nil {
+		return "", lib.MakeErrorf("ReadPassphrase: Unable to read passphrase file: %s", err)
+	}
+	passphrase := strings.SplitN(string(content), "\n", 2)[0]
+	passphrase = strings.TrimRight(passphrase, "\r")
+	if passphrase == "" {
+		return "", lib.MakeErrorf("ReadPassphrase: Passphrase file %s is empty", passphraseFile)
+	}
+	return passphrase, nil
+}
+
+// NewKeyStore creates a key store of the given type
+//  storeType is one of KeyStoreTypeEncrypted, KeyStoreTypeFile or KeyStoreTypeMemory
+//  keyFile is the file the key is stored in. Not used by the memory store.
+//  passphraseEnv and passphraseFile provide the passphrase of the encrypted store, see ReadPassphrase
+// Returns an error if the type is unknown or the encrypted store has no passphrase
+func NewKeyStore(storeType string, keyFile string, passphraseEnv string, passphraseFile string) (KeyStore, error) {
+	switch storeType {
+	case KeyStoreTypeEncrypted:
+		passphrase, err := ReadPassphrase(passphraseEnv, passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		return NewEncryptedFileKeyStore(keyFile, passphrase)
+	case KeyStoreTypeFile:
+		return NewFileKeyStore(keyFile), nil
+	case KeyStoreTypeMemory:
+		return NewMemoryKeyStore(), nil
+	}
+	return nil, lib.MakeErrorf("NewKeyStore: Unknown key store type '%s'", storeType)
+}
+
+// writeKeyFile writes the key file readonly for the owner, replacing an existing key file
+// The key is written to a temporary file that replaces the key file, so an existing key file is
+// unchanged if writing fails.
+func writeKeyFile(filename string, content []byte) error {
+	tmpFilename := filename + ".tmp"
+	os.Remove(tmpFilename)
+	err := ioutil.WriteFile(tmpFilename, content, 0400)
+	if err == nil {
+		err = os.Rename(tmpFilename, filename)
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return lib.MakeErrorf("writeKeyFile: Unable to save the key at %s: %s", filename, err)
+	}
+	return nil
+}
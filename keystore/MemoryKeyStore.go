@@ -0,0 +1,44 @@
+// Package keystore with an in-memory key store
+package keystore
+
+import (
+	"crypto"
+	"sync"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+)
+
+// MemoryKeyStore keeps the private key in memory. Intended for testing.
+type MemoryKeyStore struct {
+	privateKey  crypto.PrivateKey
+	updateMutex *sync.Mutex
+}
+
+// LoadKey returns the saved private key
+func (store *MemoryKeyStore) LoadKey() (crypto.PrivateKey, error) {
+	store.updateMutex.Lock()
+	defer store.updateMutex.Unlock()
+	if store.privateKey == nil {
+		return nil, lib.MakeErrorf("MemoryKeyStore.LoadKey: No key saved")
+	}
+	return store.privateKey, nil
+}
+
+// SaveKey keeps the private key
+func (store *MemoryKeyStore) SaveKey(privateKey crypto.PrivateKey) error {
+	if privateKey == nil {
+		return lib.MakeErrorf("MemoryKeyStore.SaveKey: Missing private key")
+	}
+	store.updateMutex.Lock()
+	defer store.updateMutex.Unlock()
+	store.privateKey = privateKey
+	return nil
+}
+
+// NewMemoryKeyStore creates an empty in-memory key store
+func NewMemoryKeyStore() *MemoryKeyStore {
+	store := &MemoryKeyStore{
+		updateMutex: &sync.Mutex{},
+	}
+	return store
+}
@@ -2,7 +2,7 @@
 package lib
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"reflect"
 	"strings"
 	"sync"
@@ -15,7 +15,7 @@ import (
 type DomainCollection struct {
 	DiscoMap map[string]interface{} // discovered by addres
 	// MessageSigner *messaging.MessageSigner // subscription to discovery messages
-	GetPublicKey func(string) *ecdsa.PublicKey // get the public key for signature verification
+	GetPublicKey func(string) crypto.PublicKey // get the public key for signature verification
 	UpdateMutex  *sync.Mutex                   // mutex for async updating
 	ItemPtr      reflect.Type                  // pointer type of item in map
 	updateCount  int                           // nr of updates to this collection
@@ -100,9 +100,15 @@ func (dc *DomainCollection) GetAll(resultSlicePtr interface{}) {
 //  For convenience this also set the PublisherID, NodeID in the target object. If the
 // discovery is of an input/output then the OutputType/Instance is also set. These
 // are derived from the address as they are not separate parameters in the standard.
+//  An empty message removes the item from the collection.
 func (dc *DomainCollection) HandleDiscovery(
 	address string, rawMessage string, newItem interface{}) error {
 
+	// an empty message means the retained discovery has been removed
+	if rawMessage == "" {
+		dc.Remove(address)
+		return nil
+	}
 	// verify the message signature and get the payload
 	// FIXME: this is a lib func, should not depend on messaging!
 	_, err := messaging.VerifySenderJWSSignature(rawMessage, newItem,
@@ -135,6 +141,27 @@ func (dc *DomainCollection) Remove(address string) {
 	dc.updateCount++
 }
 
+// RemoveByAddressPrefix removes all objects whose address starts with the given address
+// The message type is removed from addressPrefix, so a publisher identity address can be used to
+// remove all items of that publisher.
+// Returns the number of removed objects.
+func (dc *DomainCollection) RemoveByAddressPrefix(addressPrefix string) int {
+	base := MakeBaseAddress(addressPrefix)
+	dc.UpdateMutex.Lock()
+	defer dc.UpdateMutex.Unlock()
+	removeCount := 0
+	for addr := range dc.DiscoMap {
+		if addr == base || strings.HasPrefix(addr, base+"/") {
+			delete(dc.DiscoMap, addr)
+			removeCount++
+		}
+	}
+	if removeCount > 0 {
+		dc.updateCount++
+	}
+	return removeCount
+}
+
 // ResetUpdateCount sets the update count to zero and returns the old update count
 func (dc *DomainCollection) ResetUpdateCount() int {
 	dc.UpdateMutex.Lock()
@@ -185,7 +212,7 @@ func setObjectField(object interface{}, fieldName string, value string) {
 
 // NewDomainCollection creates an instance for generic handling of discovered inputs, outputs and nodes
 // itemPtr is a pointer to a dummy instance of the item
-func NewDomainCollection(itemPtr reflect.Type, getPublicKey func(string) *ecdsa.PublicKey) DomainCollection {
+func NewDomainCollection(itemPtr reflect.Type, getPublicKey func(string) crypto.PublicKey) DomainCollection {
 
 	domainCollection := DomainCollection{
 		DiscoMap:     make(map[string]interface{}),
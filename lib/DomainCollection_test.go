@@ -64,6 +64,13 @@ func TestCreateCollection(t *testing.T) {
 	c.Remove(item1Addr)
 	item1b = c.GetByAddress(item1Addr)
 	require.Nil(t, item1b, "Item still there after remove")
+
+	// remove all items of a publisher, but not of a publisher with the same prefix
+	c.Update("domain/pub2/node", &item1)
+	removeCount := c.RemoveByAddressPrefix("domain/pub/$identity")
+	assert.Equal(t, 1, removeCount)
+	assert.Nil(t, c.GetByAddress(item2InputAddr))
+	assert.NotNil(t, c.GetByAddress("domain/pub2/node"))
 }
 func TestDiscovery(t *testing.T) {
 	const itemAddr = "test/pub1/node1/type/instance"
@@ -97,6 +104,13 @@ func TestDiscovery(t *testing.T) {
 
 	item1c := c.GetByAddress(itemAddr)
 	require.NotNil(t, item1c)
+
+	// removing the retained publication removes the item
+	err = signer.RemovePublication(itemAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, errCount, "Removal should not fail")
+	item1d := c.GetByAddress(itemAddr)
+	assert.Nil(t, item1d, "Item still there after removing its publication")
 }
 
 func TestMakeError(t *testing.T) {
@@ -0,0 +1,93 @@
+// Package messaging with tracking of the connection state of messengers
+package messaging
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// connectionStatus tracks the connection state of a messenger and notifies the connection
+// handler of changes
+type connectionStatus struct {
+	changed      chan struct{}               // closed and replaced when the state changes
+	handler      func(state ConnectionState) // handler to notify of changes
+	state        ConnectionState             // current state
+	wasConnected bool                        // connected since the last connect request
+	mutex        *sync.Mutex
+}
+
+// get returns the current connection state
+func (status *connectionStatus) get() ConnectionState {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+	return status.state
+}
+
+// set the connection state and notify the handler if the state changed
+// Connected is reported as reconnected if the connection was lost since connecting.
+func (status *connectionStatus) set(state ConnectionState) {
+	status.mutex.Lock()
+	switch state {
+	case ConnectionStateConnecting, ConnectionStateDisconnected:
+		status.wasConnected = false
+	case ConnectionStateConnected, ConnectionStateReconnected:
+		if status.wasConnected {
+			state = ConnectionStateReconnected
+		}
+		status.wasConnected = true
+	}
+	if state == status.state {
+		status.mutex.Unlock()
+		return
+	}
+	status.state = state
+	close(status.changed)
+	status.changed = make(chan struct{})
+	handler := status.handler
+	status.mutex.Unlock()
+
+	if handler != nil {
+		handler(state)
+	}
+}
+
+// setHandler sets the handler to notify of state changes
+func (status *connectionStatus) setHandler(handler func(state ConnectionState)) {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+	status.handler = handler
+}
+
+// wait until connected, disconnected or ctx is done
+// Returns nil when connected
+func (status *connectionStatus) wait(ctx context.Context) error {
+	for {
+		status.mutex.Lock()
+		state := status.state
+		changed := status.changed
+		status.mutex.Unlock()
+
+		switch state {
+		case ConnectionStateConnected, ConnectionStateReconnected:
+			return nil
+		case ConnectionStateDisconnected:
+			return errors.New("disconnected while connecting")
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// newConnectionStatus returns the status of a disconnected messenger
+func newConnectionStatus() *connectionStatus {
+	status := &connectionStatus{
+		changed: make(chan struct{}),
+		state:   ConnectionStateDisconnected,
+		mutex:   &sync.Mutex{},
+	}
+	return status
+}
@@ -0,0 +1,209 @@
+// Package messaging with dispatching of received messages to subscription handlers
+package messaging
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Overflow policies of the dispatch queues
+const (
+	OverflowBlock      = "block"      // wait until the queue has room (default)
+	OverflowDropNewest = "dropnewest" // drop the received message
+	OverflowDropOldest = "dropoldest" // drop the oldest queued message to make room
+)
+
+// DefaultDispatchQueueSize is the default maximum number of messages queued per dispatch worker
+const DefaultDispatchQueueSize = 100
+
+// DispatchMetrics with counters of dispatched messages
+type DispatchMetrics struct {
+	Dispatched uint64 // nr of messages passed to the handlers
+	Dropped    uint64 // nr of messages dropped because a queue was full
+	Queued     int    // nr of messages waiting to be passed to the handlers
+	Workers    int    // nr of workers. 0 when handlers run in the receiving goroutine
+}
+
+// Dispatcher passes received messages to their handlers using a pool of workers so that a
+// slow handler doesn't stall the handling of other addresses. Messages of the same address
+// are always handled by the same worker to preserve their order. Each worker has a bounded
+// queue. When it is full the overflow policy determines whether the receiver waits or a
+// message is dropped.
+type Dispatcher struct {
+	dispatched  uint64              // nr of messages passed to the handlers
+	dropped     uint64              // nr of messages dropped because a queue was full
+	isRunning   bool                // workers are running
+	overflow    string              // overflow policy of the queues
+	queues      []chan dispatchItem // queue of each worker
+	queueSize   int                 // max nr of messages in a worker queue
+	runMutex    *sync.RWMutex       // mutex for starting and stopping the workers
+	updateMutex *sync.Mutex         // mutex for updating the counters
+	waitGroup   *sync.WaitGroup     // wait for the workers to end
+	workers     int                 // nr of workers
+}
+
+// dispatchItem is a queued message
+type dispatchItem struct {
+	handle func() // invokes the handlers of the message
+	drop   func() // invoked instead of handle when the message is dropped. Optional.
+}
+
+// Dispatch passes a received message to its handlers
+// Without workers, or if the dispatcher isn't started, the handlers are invoked directly.
+//  address the message was received on. Messages of the same address are handled in order.
+//  handle invokes the handlers of the message
+func (dispatcher *Dispatcher) Dispatch(address string, handle func()) {
+	dispatcher.DispatchOrDrop(address, handle, nil)
+}
+
+// DispatchOrDrop passes a received message to its handlers, or drops it if the overflow policy
+// drops messages when the queue is full. Intended to acknowledge a message once it is handled or
+// dropped.
+//  address the message was received on. Messages of the same address are handled in order.
+//  handle invokes the handlers of the message
+//  drop is invoked instead of handle when the message is dropped. Use nil to ignore.
+func (dispatcher *Dispatcher) DispatchOrDrop(address string, handle func(), drop func()) {
+	dispatcher.runMutex.RLock()
+	defer dispatcher.runMutex.RUnlock()
+	if !dispatcher.isRunning {
+		dispatcher.run(handle)
+		return
+	}
+	item := dispatchItem{handle: handle, drop: drop}
+	queue := dispatcher.queues[dispatcher.workerIndex(address)]
+	switch dispatcher.overflow {
+	case OverflowDropNewest:
+		select {
+		case queue <- item:
+		default:
+			logrus.Warningf("Dispatcher.Dispatch: Queue is full. Dropping message on %s", address)
+			dispatcher.countDropped(item)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case queue <- item:
+				return
+			default:
+			}
+			select {
+			case oldest := <-queue:
+				logrus.Warningf("Dispatcher.Dispatch: Queue is full. Dropping oldest message for %s", address)
+				dispatcher.countDropped(oldest)
+			default:
+			}
+		}
+	default:
+		queue <- item
+	}
+}
+
+// Metrics returns the counters of dispatched and dropped messages
+func (dispatcher *Dispatcher) Metrics() DispatchMetrics {
+	dispatcher.runMutex.RLock()
+	queued := 0
+	for _, queue := range dispatcher.queues {
+		queued += len(queue)
+	}
+	dispatcher.runMutex.RUnlock()
+
+	dispatcher.updateMutex.Lock()
+	defer dispatcher.updateMutex.Unlock()
+	return DispatchMetrics{
+		Dispatched: dispatcher.dispatched,
+		Dropped:    dispatcher.dropped,
+		Queued:     queued,
+		Workers:    dispatcher.workers,
+	}
+}
+
+// Start the workers. This does nothing if there are no workers or they are already running.
+func (dispatcher *Dispatcher) Start() {
+	dispatcher.runMutex.Lock()
+	defer dispatcher.runMutex.Unlock()
+	if dispatcher.isRunning || dispatcher.workers <= 0 {
+		return
+	}
+	dispatcher.isRunning = true
+	dispatcher.queues = make([]chan dispatchItem, dispatcher.workers)
+	for index := range dispatcher.queues {
+		queue := make(chan dispatchItem, dispatcher.queueSize)
+		dispatcher.queues[index] = queue
+		dispatcher.waitGroup.Add(1)
+		go dispatcher.work(queue)
+	}
+}
+
+// Stop the workers after they handled the queued messages
+// This must not be called from a message handler as it waits for the handlers to complete.
+func (dispatcher *Dispatcher) Stop() {
+	dispatcher.runMutex.Lock()
+	if !dispatcher.isRunning {
+		dispatcher.runMutex.Unlock()
+		return
+	}
+	dispatcher.isRunning = false
+	for _, queue := range dispatcher.queues {
+		close(queue)
+	}
+	dispatcher.queues = nil
+	dispatcher.runMutex.Unlock()
+	dispatcher.waitGroup.Wait()
+}
+
+// countDropped increments the number of dropped messages and notifies the drop of the message
+func (dispatcher *Dispatcher) countDropped(item dispatchItem) {
+	dispatcher.updateMutex.Lock()
+	dispatcher.dropped++
+	dispatcher.updateMutex.Unlock()
+	if item.drop != nil {
+		item.drop()
+	}
+}
+
+// run the handlers of a message and count it
+func (dispatcher *Dispatcher) run(handle func()) {
+	handle()
+	dispatcher.updateMutex.Lock()
+	defer dispatcher.updateMutex.Unlock()
+	dispatcher.dispatched++
+}
+
+// work passes the messages in the queue to their handlers until the queue is closed
+func (dispatcher *Dispatcher) work(queue chan dispatchItem) {
+	defer dispatcher.waitGroup.Done()
+	for item := range queue {
+		dispatcher.run(item.handle)
+	}
+}
+
+// workerIndex returns the index of the worker that handles messages of the address
+func (dispatcher *Dispatcher) workerIndex(address string) int {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(address))
+	return int(hash.Sum32() % uint32(len(dispatcher.queues)))
+}
+
+// NewDispatcher creates a dispatcher of received messages. Use Start to start the workers.
+//  workers is the number of workers. Use 0 to invoke the handlers in the receiving goroutine.
+//  queueSize is the maximum number of queued messages per worker. Use 0 for DefaultDispatchQueueSize.
+//  overflow is the policy when a queue is full: OverflowBlock (default), OverflowDropNewest or OverflowDropOldest
+func NewDispatcher(workers int, queueSize int, overflow string) *Dispatcher {
+	if queueSize <= 0 {
+		queueSize = DefaultDispatchQueueSize
+	}
+	if overflow != OverflowDropNewest && overflow != OverflowDropOldest {
+		overflow = OverflowBlock
+	}
+	dispatcher := &Dispatcher{
+		overflow:    overflow,
+		queueSize:   queueSize,
+		runMutex:    &sync.RWMutex{},
+		updateMutex: &sync.Mutex{},
+		waitGroup:   &sync.WaitGroup{},
+		workers:     workers,
+	}
+	return dispatcher
+}
@@ -0,0 +1,116 @@
+package messaging_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDispatchOrder handles messages of the same address in order
+func TestDispatchOrder(t *testing.T) {
+	const nrMessages = 100
+	addresses := []string{"domain1/pub1/node1/$node", "domain1/pub1/node2/$node", "domain1/pub2/node1/$node"}
+	dispatcher := messaging.NewDispatcher(4, 10, messaging.OverflowBlock)
+	dispatcher.Start()
+
+	received := make(map[string][]int)
+	mutex := sync.Mutex{}
+	for i := 0; i < nrMessages; i++ {
+		address := addresses[i%len(addresses)]
+		value := i
+		dispatcher.Dispatch(address, func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			received[address] = append(received[address], value)
+		})
+	}
+	dispatcher.Stop()
+
+	for _, address := range addresses {
+		values := received[address]
+		for i := 1; i < len(values); i++ {
+			assert.Less(t, values[i-1], values[i], "Messages of %s out of order", address)
+		}
+	}
+	metrics := dispatcher.Metrics()
+	assert.Equal(t, uint64(nrMessages), metrics.Dispatched)
+	assert.Equal(t, uint64(0), metrics.Dropped)
+	assert.Equal(t, 4, metrics.Workers)
+
+	// after stop the handlers are invoked directly
+	isHandled := false
+	dispatcher.Dispatch(addresses[0], func() { isHandled = true })
+	assert.True(t, isHandled)
+}
+
+// TestDispatchSlowHandler doesn't stall the messages of other addresses
+func TestDispatchSlowHandler(t *testing.T) {
+	dispatcher := messaging.NewDispatcher(8, 0, "")
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	blocked := make(chan struct{})
+	handled := make(chan string, 1)
+	dispatcher.Dispatch("domain1/pub1/node1/$set", func() { <-blocked })
+	dispatcher.Dispatch("domain1/pub2/node1/$set", func() { handled <- "other" })
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Slow handler stalls other addresses")
+	}
+	close(blocked)
+}
+
+// dispatch 5 messages to a single worker with a queue of 2 while the first is being handled
+func testDispatchOverflow(t *testing.T, overflow string) []string {
+	const address = "domain1/pub1/node1/$set"
+	dispatcher := messaging.NewDispatcher(1, 2, overflow)
+	dispatcher.Start()
+
+	started := make(chan struct{})
+	blocked := make(chan struct{})
+	received := make([]string, 0)
+	dispatcher.Dispatch(address, func() {
+		close(started)
+		<-blocked
+		received = append(received, "0")
+	})
+	<-started
+	for i := 1; i < 5; i++ {
+		value := fmt.Sprint(i)
+		dispatcher.Dispatch(address, func() { received = append(received, value) })
+	}
+	metrics := dispatcher.Metrics()
+	assert.Equal(t, uint64(2), metrics.Dropped)
+	assert.Equal(t, 2, metrics.Queued)
+	close(blocked)
+	dispatcher.Stop()
+	assert.Equal(t, uint64(3), dispatcher.Metrics().Dispatched)
+	return received
+}
+
+func TestDispatchOverflow(t *testing.T) {
+	received := testDispatchOverflow(t, messaging.OverflowDropNewest)
+	assert.Equal(t, []string{"0", "1", "2"}, received)
+
+	received = testDispatchOverflow(t, messaging.OverflowDropOldest)
+	assert.Equal(t, []string{"0", "3", "4"}, received)
+}
+
+// TestDispatchDisabled invokes the handlers without workers
+func TestDispatchDisabled(t *testing.T) {
+	dispatcher := messaging.NewDispatcher(0, 0, "")
+	dispatcher.Start()
+	isHandled := false
+	dispatcher.Dispatch("domain1/#", func() { isHandled = true })
+	assert.True(t, isHandled)
+	metrics := dispatcher.Metrics()
+	require.Equal(t, 0, metrics.Workers)
+	assert.Equal(t, uint64(1), metrics.Dispatched)
+	dispatcher.Stop()
+}
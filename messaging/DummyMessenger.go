@@ -2,18 +2,47 @@
 package messaging
 
 import (
-	"fmt"
-	"strings"
+	"context"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/iotdomain/iotdomain-go/mqttpacket"
 	"github.com/iotdomain/iotdomain-go/types"
 	"github.com/sirupsen/logrus"
 )
 
-// DummyMessenger that implements IMessenger
+// Faults that can be injected in the delivery of messages by the DummyMessenger
+const (
+	FaultDelay      = "delay"      // deliver the message after the fault delay
+	FaultDisconnect = "disconnect" // lose the connection instead of delivering the message
+	FaultDrop       = "drop"       // don't deliver or retain the message
+	FaultDuplicate  = "duplicate"  // deliver the message twice
+	FaultReorder    = "reorder"    // deliver the message after the next message
+)
+
+// DummyFault describes a fault to inject in the delivery of published messages
+type DummyFault struct {
+	Address string        // address filter of the messages to apply the fault to, with wildcards. "" for all messages
+	Count   int           // nr of messages to apply the fault to. 0 for all messages
+	Delay   time.Duration // delay of FaultDelay, or time until reconnecting after FaultDisconnect. 0 to stay disconnected
+	Type    string        // type of fault, eg FaultDrop
+}
+
+// DummyMessenger that implements IMessenger without a message bus. It acts as the broker of
+// the subscribers that share the messenger, with MQTT wildcard matching, retained messages and
+// the last will. Faults can be injected to test under adverse conditions.
 type DummyMessenger struct {
-	publications  map[string]string
-	config        *MessengerConfig // for domain configuration
+	config        *MessengerConfig   // for domain configuration
+	dispatcher    *Dispatcher        // passes received messages to the subscription handlers
+	faults        []*DummyFault      // injected faults
+	held          []dummyMessage     // messages held back by FaultReorder
+	isLost        bool               // the connection is lost by a simulated fault
+	lastHandle    SubscriptionHandle // handle of the last subscription
+	lastWill      *dummyMessage      // last will, delivered when the connection is lost
+	publications  map[string]string  // last publication by address
+	retained      map[string]string  // retained messages by address
+	status        *connectionStatus
 	subscriptions []Subscription
 	publishMutex  *sync.Mutex // mutex for concurrent publishing of messages
 }
@@ -21,16 +50,57 @@ type DummyMessenger struct {
 // Subscription to messages
 type Subscription struct {
 	address string
+	handle  SubscriptionHandle
 	handler func(address string, message string) error
 }
 
+// dummyMessage with the address and content of a message
+type dummyMessage struct {
+	address string
+	message string
+}
+
+// ClearFaults removes the injected faults and delivers the messages held back for reordering
+func (messenger *DummyMessenger) ClearFaults() {
+	messenger.publishMutex.Lock()
+	messenger.faults = nil
+	messenger.publishMutex.Unlock()
+	messenger.releaseHeld()
+}
+
 // Connect the messenger
-func (messenger *DummyMessenger) Connect(lastWillAddress string, lastWillValue string) error {
+// The last will is delivered to the subscribers when a connection loss is simulated.
+func (messenger *DummyMessenger) Connect(ctx context.Context, lastWillAddress string, lastWillValue string) error {
+	messenger.status.set(ConnectionStateConnecting)
+	messenger.publishMutex.Lock()
+	messenger.isLost = false
+	messenger.lastWill = nil
+	if lastWillAddress != "" {
+		messenger.lastWill = &dummyMessage{address: lastWillAddress, message: lastWillValue}
+	}
+	messenger.publishMutex.Unlock()
+	messenger.dispatcher.Start()
+	messenger.status.set(ConnectionStateConnected)
 	return nil
 }
 
-// Disconnect gracefully disconnects the messenger
+// ConnectionState returns the current connection state
+func (messenger *DummyMessenger) ConnectionState() ConnectionState {
+	return messenger.status.get()
+}
+
+// Disconnect gracefully disconnects the messenger. The last will is discarded.
 func (messenger *DummyMessenger) Disconnect() {
+	messenger.publishMutex.Lock()
+	messenger.lastWill = nil
+	messenger.publishMutex.Unlock()
+	messenger.dispatcher.Stop()
+	messenger.status.set(ConnectionStateDisconnected)
+}
+
+// DispatchMetrics returns the counters of received messages passed to the subscription handlers
+func (messenger *DummyMessenger) DispatchMetrics() DispatchMetrics {
+	return messenger.dispatcher.Metrics()
 }
 
 // FindLastPublication with the given address
@@ -51,109 +121,246 @@ func (messenger *DummyMessenger) GetDomain() string {
 	return domain
 }
 
+// InjectFault adds a fault to apply to the delivery of published messages
+// The first fault that matches the address of a message is applied.
+func (messenger *DummyMessenger) InjectFault(fault DummyFault) {
+	messenger.publishMutex.Lock()
+	defer messenger.publishMutex.Unlock()
+	messenger.faults = append(messenger.faults, &fault)
+}
+
 // NrPublications returns the number of received publications
 func (messenger *DummyMessenger) NrPublications() int {
+	messenger.publishMutex.Lock()
+	defer messenger.publishMutex.Unlock()
 	return len(messenger.publications)
 }
 
 // OnReceive function to simulate a received message
+// The message is passed to the handlers of matching subscriptions without faults.
+// Without dispatch workers, or when not connected, the handlers are invoked before returning.
 func (messenger *DummyMessenger) OnReceive(address string, message string) {
 	messenger.publishMutex.Lock()
 	subs := messenger.subscriptions
 	messenger.publishMutex.Unlock()
 
-	for _, subscription := range subs {
-		match := messenger.matchAddress(address, subscription.address)
-
-		if match && subscription.handler != nil {
-			subscription.handler(address, message)
+	messenger.dispatcher.Dispatch(address, func() {
+		for _, subscription := range subs {
+			if subscription.handler != nil && mqttpacket.MatchTopic(address, subscription.address) {
+				subscription.handler(address, message)
+			}
 		}
-	}
+	})
 }
 
 // Publish a message
-// address is the MQTT address to send to
-// retained (ignored)
-// message JSON text or raw message base64 encoded text
+// The message is delivered to the matching subscriptions unless a fault applies.
+// A retained message is delivered to new subscriptions. An empty retained message removes it.
+//  address is the MQTT address to send to
+//  retained to deliver the message to later subscribers
+//  message JSON text or raw message base64 encoded text
+// Returns an error while the connection is lost
 func (messenger *DummyMessenger) Publish(address string, retained bool, message string) error {
 	messenger.publishMutex.Lock()
+	if messenger.isLost {
+		messenger.publishMutex.Unlock()
+		return errNotConnected
+	}
 	messenger.publications[address] = message
+	fault := messenger.takeFault(address)
+	isDropped := fault != nil && (fault.Type == FaultDrop || fault.Type == FaultDisconnect)
+	if retained && !isDropped {
+		if message == "" {
+			delete(messenger.retained, address)
+		} else {
+			messenger.retained[address] = message
+		}
+	}
 	messenger.publishMutex.Unlock()
-	// go messenger.OnReceive(address, payload)
-	messenger.OnReceive(address, message)
+
+	if fault == nil {
+		messenger.deliver(address, message)
+		messenger.releaseHeld()
+		return nil
+	}
+	logrus.Infof("DummyMessenger.Publish: Injecting fault %s on %s", fault.Type, address)
+	switch fault.Type {
+	case FaultDelay:
+		time.AfterFunc(fault.Delay, func() { messenger.deliver(address, message) })
+	case FaultDisconnect:
+		messenger.SimulateConnectionLoss()
+		if fault.Delay > 0 {
+			time.AfterFunc(fault.Delay, messenger.SimulateReconnect)
+		}
+	case FaultDuplicate:
+		messenger.deliver(address, message)
+		messenger.deliver(address, message)
+		messenger.releaseHeld()
+	case FaultReorder:
+		messenger.publishMutex.Lock()
+		messenger.held = append(messenger.held, dummyMessage{address: address, message: message})
+		messenger.publishMutex.Unlock()
+	}
 	return nil
 }
 
+// SetConnectionHandler sets the handler that is invoked when the connection state changes
+func (messenger *DummyMessenger) SetConnectionHandler(handler func(state ConnectionState)) {
+	messenger.status.setHandler(handler)
+}
+
+// SimulateConnectionLoss simulates the loss of the connection
+// The last will is delivered to the subscribers, as the broker delivers it to the other clients.
+// Publish fails and messages are not delivered until SimulateReconnect is called.
+func (messenger *DummyMessenger) SimulateConnectionLoss() {
+	messenger.publishMutex.Lock()
+	if messenger.isLost {
+		messenger.publishMutex.Unlock()
+		return
+	}
+	lastWill := messenger.lastWill
+	messenger.publishMutex.Unlock()
+	logrus.Warningf("DummyMessenger.SimulateConnectionLoss: Connection lost")
+	if lastWill != nil {
+		messenger.OnReceive(lastWill.address, lastWill.message)
+	}
+	messenger.publishMutex.Lock()
+	messenger.isLost = true
+	messenger.publishMutex.Unlock()
+	messenger.status.set(ConnectionStateLost)
+}
+
+// SimulateReconnect restores a lost connection
+// The subscriptions are restored and receive the matching retained messages, like after
+// reconnecting to a broker.
+func (messenger *DummyMessenger) SimulateReconnect() {
+	messenger.publishMutex.Lock()
+	if !messenger.isLost {
+		messenger.publishMutex.Unlock()
+		return
+	}
+	messenger.isLost = false
+	subs := messenger.subscriptions
+	messenger.publishMutex.Unlock()
+	logrus.Warningf("DummyMessenger.SimulateReconnect: Connection restored")
+	messenger.status.set(ConnectionStateConnected)
+	for _, subscription := range subs {
+		messenger.deliverRetained(subscription)
+	}
+}
+
 // Subscribe to a message by address
+// The retained messages that match the address are delivered to the new subscription.
+// Returns the handle to unsubscribe with
 func (messenger *DummyMessenger) Subscribe(
-	address string, onMessage func(address string, message string) error) {
+	address string, onMessage func(address string, message string) error) SubscriptionHandle {
 
 	logrus.Infof("DummyMessenger.Subscribe: address %s", address)
-	subscription := Subscription{address: address, handler: onMessage}
 	messenger.publishMutex.Lock()
+	messenger.lastHandle++
+	subscription := Subscription{address: address, handle: messenger.lastHandle, handler: onMessage}
 	messenger.subscriptions = append(messenger.subscriptions, subscription)
+	isLost := messenger.isLost
 	messenger.publishMutex.Unlock()
+	if !isLost {
+		messenger.deliverRetained(subscription)
+	}
+	return subscription.handle
 }
 
-// Unsubscribe an address and handler
-func (messenger *DummyMessenger) Unsubscribe(
-	address string, onMessage func(address string, message string) error) {
+// Unsubscribe a subscription using the handle returned by Subscribe
+func (messenger *DummyMessenger) Unsubscribe(handle SubscriptionHandle) {
 	messenger.publishMutex.Lock()
-	// https://stackoverflow.com/questions/9643205/how-do-i-compare-two-functions-for-pointer-equality-in-the-latest-go-weekly
-	var onMessageID = onMessage
-	onMessageStr := fmt.Sprintf("%v", &onMessageID)
+	defer messenger.publishMutex.Unlock()
 	for i, sub := range messenger.subscriptions {
-		// can't compare addresses directly so convert to string
-		var handlerID = sub.handler
-		handlerStr := fmt.Sprintf("%v", &handlerID)
-		if sub.address == address && (onMessage == nil || handlerStr == onMessageStr) {
-			// shift remainder left one index
-			copy(messenger.subscriptions[i:], messenger.subscriptions[i+1:])
-			messenger.subscriptions = messenger.subscriptions[:len(messenger.subscriptions)-1]
-			if onMessage != nil {
-				break
-			}
+		if sub.handle == handle {
+			// copy so a concurrent OnReceive keeps its list intact
+			subscriptions := make([]Subscription, 0, len(messenger.subscriptions)-1)
+			subscriptions = append(subscriptions, messenger.subscriptions[:i]...)
+			messenger.subscriptions = append(subscriptions, messenger.subscriptions[i+1:]...)
+			break
 		}
 	}
+}
+
+// deliver a message to the matching subscriptions unless the connection is lost
+func (messenger *DummyMessenger) deliver(address string, message string) {
+	messenger.publishMutex.Lock()
+	isLost := messenger.isLost
 	messenger.publishMutex.Unlock()
+	if !isLost {
+		messenger.OnReceive(address, message)
+	}
 }
 
-// test if a given address matches a subscription address with wildcards
-func (messenger *DummyMessenger) matchAddress(address string, subscription string) (match bool) {
-	subscriptionSegments := strings.Split(subscription, "/")
-	addressSegments := strings.Split(address, "/")
+// deliverRetained delivers the retained messages that match a subscription, sorted by address
+func (messenger *DummyMessenger) deliverRetained(subscription Subscription) {
+	messenger.publishMutex.Lock()
+	addresses := make([]string, 0)
+	for address := range messenger.retained {
+		if mqttpacket.MatchTopic(address, subscription.address) {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+	messages := make([]string, len(addresses))
+	for index, address := range addresses {
+		messages[index] = messenger.retained[address]
+	}
+	messenger.publishMutex.Unlock()
 
-	// no match subscription is longer than address
-	if len(subscriptionSegments) > len(addressSegments) {
-		return false
+	if subscription.handler == nil {
+		return
 	}
+	for index, address := range addresses {
+		retainedAddress, message := address, messages[index]
+		messenger.dispatcher.Dispatch(retainedAddress, func() {
+			subscription.handler(retainedAddress, message)
+		})
+	}
+}
 
-	// Match the segments accepting wildcards. Rather crude but only intended for testing.
-	match = true
-	for index, addrSegment := range addressSegments {
-		// if index >= len(subscriptionSegments) {
-		// 	return false
-		// }
-		subscriptionSegment := subscriptionSegments[index]
+// releaseHeld delivers the messages held back for reordering
+func (messenger *DummyMessenger) releaseHeld() {
+	messenger.publishMutex.Lock()
+	held := messenger.held
+	messenger.held = nil
+	messenger.publishMutex.Unlock()
+	for _, heldMessage := range held {
+		messenger.deliver(heldMessage.address, heldMessage.message)
+	}
+}
 
-		if subscriptionSegment == "#" {
-			return true
-		} else if subscriptionSegment == "+" {
-			// match, continue
-		} else if addrSegment == subscriptionSegment {
-			// match continue
-		} else {
-			return false
+// takeFault returns the first fault that applies to an address and counts it
+// Must be called within a locked section
+func (messenger *DummyMessenger) takeFault(address string) *DummyFault {
+	for index, fault := range messenger.faults {
+		if fault.Address != "" && !mqttpacket.MatchTopic(address, fault.Address) {
+			continue
 		}
+		if fault.Count > 0 {
+			fault.Count--
+			if fault.Count == 0 {
+				messenger.faults = append(messenger.faults[:index:index], messenger.faults[index+1:]...)
+			}
+		}
+		return fault
 	}
-	return match
+	return nil
 }
 
 // NewDummyMessenger provides a messenger for messages that go no.where...
 func NewDummyMessenger(config *MessengerConfig) *DummyMessenger {
+	dispatcher := NewDispatcher(0, 0, "")
+	if config != nil {
+		dispatcher = NewDispatcher(config.DispatchWorkers, config.DispatchQueueSize, config.DispatchOverflow)
+	}
 	var messenger = &DummyMessenger{
 		config:        config,
+		dispatcher:    dispatcher,
 		publications:  make(map[string]string, 0),
+		retained:      make(map[string]string),
+		status:        newConnectionStatus(),
 		subscriptions: make([]Subscription, 0),
 		publishMutex:  &sync.Mutex{},
 	}
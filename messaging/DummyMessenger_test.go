@@ -1,8 +1,10 @@
 package messaging_test
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"sync"
 	"testing"
 	"time"
 
@@ -26,13 +28,15 @@ type DummyMessage struct {
 // TestConnect to dummy
 func TestDummyConnect(t *testing.T) {
 	messenger := messaging.NewDummyMessenger(&dummyConfig)
-	err := messenger.Connect("", "")
+	err := messenger.Connect(context.Background(), "", "")
 
 	domain := messenger.GetDomain()
 	assert.Equal(t, types.LocalDomainID, domain)
 
 	assert.NoError(t, err, "Connection failed")
+	assert.Equal(t, messaging.ConnectionStateConnected, messenger.ConnectionState())
 	messenger.Disconnect()
+	assert.Equal(t, messaging.ConnectionStateDisconnected, messenger.ConnectionState())
 }
 
 // TestPublish a message
@@ -42,7 +46,7 @@ func TestDummyPublish(t *testing.T) {
 	var pub1JSON, _ = json.Marshal(pub1Message)
 
 	messenger := messaging.NewDummyMessenger(&dummyConfig)
-	err := messenger.Connect("", "")
+	err := messenger.Connect(context.Background(), "", "")
 	assert.NoError(t, err, "Connection failed")
 
 	err = messenger.Publish(dummy1Addr, false, string(pub1JSON))
@@ -63,11 +67,11 @@ func TestDummyPublishSubscribe(t *testing.T) {
 	rxLength := 0
 
 	messenger := messaging.NewDummyMessenger(&dummyConfig)
-	err := messenger.Connect("", "")
+	err := messenger.Connect(context.Background(), "", "")
 	assert.NoError(t, err, "Connection failed")
 
 	messenger.Subscribe(dummy1Addr, nil)
-	messenger.Subscribe(dummy2Addr, func(addr string, message string) error {
+	handle := messenger.Subscribe(dummy2Addr, func(addr string, message string) error {
 		err := json.Unmarshal([]byte(message), &receivedMessage)
 		assert.NoError(t, err, "Received message can't be parsed")
 		rxLength = len(message)
@@ -91,10 +95,188 @@ func TestDummyPublishSubscribe(t *testing.T) {
 	nrPublications := messenger.NrPublications()
 	assert.Equal(t, 2, nrPublications, "Expected 1 publication")
 
-	messenger.Unsubscribe(dummy2Addr, nil)
+	messenger.Unsubscribe(handle)
 	messenger.Disconnect()
 
 	assert.Equal(t, txLength, rxLength, "Sent and received message sizes don't match")
 
 	assert.Equal(t, "bob", receivedMessage.Name, "Did not receive published message")
 }
+
+// TestDummyDispatchWorkers passes messages to the handlers using workers
+func TestDummyDispatchWorkers(t *testing.T) {
+	const slowAddr = "domain1/pub1/node1/$set"
+	const fastAddr = "domain1/pub2/node1/$set"
+	config := dummyConfig
+	config.DispatchWorkers = 4
+	messenger := messaging.NewDummyMessenger(&config)
+	err := messenger.Connect(context.Background(), "", "")
+	assert.NoError(t, err, "Connection failed")
+
+	blocked := make(chan struct{})
+	received := make(chan string, 1)
+	messenger.Subscribe(slowAddr, func(address string, message string) error {
+		<-blocked
+		return nil
+	})
+	messenger.Subscribe(fastAddr, func(address string, message string) error {
+		received <- message
+		return nil
+	})
+	_ = messenger.Publish(slowAddr, false, "slow")
+	_ = messenger.Publish(fastAddr, false, "fast")
+	select {
+	case message := <-received:
+		assert.Equal(t, "fast", message)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Slow handler stalls other subscriptions")
+	}
+	close(blocked)
+	messenger.Disconnect()
+	assert.Equal(t, uint64(2), messenger.DispatchMetrics().Dispatched)
+}
+
+// TestDummyWildcards matches subscriptions like an MQTT broker
+func TestDummyWildcards(t *testing.T) {
+	messenger := messaging.NewDummyMessenger(nil)
+	_ = messenger.Connect(context.Background(), "", "")
+	received := make(map[string]int)
+	for _, filter := range []string{"domain1/+/#", "+/pub1", "#", "$SYS/#", "domain1/+"} {
+		filter := filter
+		messenger.Subscribe(filter, func(address string, message string) error {
+			received[filter]++
+			return nil
+		})
+	}
+	_ = messenger.Publish("domain1/pub1", false, "1")
+	_ = messenger.Publish("domain1/pub1/node1/$node", false, "2")
+	_ = messenger.Publish("$SYS/broker", false, "3")
+
+	assert.Equal(t, 2, received["domain1/+/#"])
+	assert.Equal(t, 1, received["+/pub1"])
+	assert.Equal(t, 2, received["#"], "wildcards don't match $ topics")
+	assert.Equal(t, 1, received["$SYS/#"])
+	assert.Equal(t, 1, received["domain1/+"])
+}
+
+// TestDummyRetained delivers retained messages to new subscriptions
+func TestDummyRetained(t *testing.T) {
+	messenger := messaging.NewDummyMessenger(nil)
+	_ = messenger.Connect(context.Background(), "", "")
+	_ = messenger.Publish("domain1/pub1/node2/$node", true, "node2")
+	_ = messenger.Publish("domain1/pub1/node1/$node", true, "node1")
+	_ = messenger.Publish("domain1/pub1/node3/$node", false, "node3")
+	_ = messenger.Publish("domain1/pub1/node4/$node", true, "node4")
+	_ = messenger.Publish("domain1/pub1/node4/$node", true, "")
+
+	received := make([]string, 0)
+	messenger.Subscribe("domain1/pub1/+/$node", func(address string, message string) error {
+		received = append(received, message)
+		return nil
+	})
+	assert.Equal(t, []string{"node1", "node2"}, received)
+}
+
+// TestDummyLastWill delivers the last will when the connection is lost
+func TestDummyLastWill(t *testing.T) {
+	const statusAddr = "domain1/pub1/$status"
+	messenger := messaging.NewDummyMessenger(nil)
+	states := make([]messaging.ConnectionState, 0)
+	messenger.SetConnectionHandler(func(state messaging.ConnectionState) {
+		states = append(states, state)
+	})
+	_ = messenger.Connect(context.Background(), statusAddr, "lost")
+	_ = messenger.Publish("domain1/pub1/$identity", true, "identity1")
+	lastWill := ""
+	messenger.Subscribe(statusAddr, func(address string, message string) error {
+		lastWill = message
+		return nil
+	})
+	identity := ""
+	messenger.Subscribe("domain1/pub1/$identity", func(address string, message string) error {
+		identity = message
+		return nil
+	})
+
+	messenger.SimulateConnectionLoss()
+	assert.Equal(t, "lost", lastWill)
+	assert.Equal(t, messaging.ConnectionStateLost, messenger.ConnectionState())
+	err := messenger.Publish("domain1/pub1/$identity", true, "identity2")
+	assert.Error(t, err)
+
+	// retained messages are delivered again after reconnecting
+	identity = ""
+	messenger.SimulateReconnect()
+	assert.Equal(t, "identity1", identity)
+	assert.Equal(t, messaging.ConnectionStateReconnected, states[len(states)-1])
+
+	// no last will after a graceful disconnect
+	lastWill = ""
+	messenger.Disconnect()
+	messenger.SimulateConnectionLoss()
+	assert.Equal(t, "", lastWill)
+}
+
+// TestDummyFaults injects faults in the delivery of messages
+func TestDummyFaults(t *testing.T) {
+	const node1Addr = "domain1/pub1/node1/$node"
+	const node2Addr = "domain1/pub1/node2/$node"
+	messenger := messaging.NewDummyMessenger(nil)
+	_ = messenger.Connect(context.Background(), "", "")
+	mutex := sync.Mutex{}
+	received := make([]string, 0)
+	messenger.Subscribe("domain1/#", func(address string, message string) error {
+		mutex.Lock()
+		received = append(received, message)
+		mutex.Unlock()
+		return nil
+	})
+	getReceived := func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		result := received
+		received = make([]string, 0)
+		return result
+	}
+
+	// a dropped message is not delivered or retained. The fault applies to the matching address only.
+	messenger.InjectFault(messaging.DummyFault{Type: messaging.FaultDrop, Address: node1Addr, Count: 1})
+	_ = messenger.Publish(node2Addr, true, "a")
+	_ = messenger.Publish(node1Addr, true, "b")
+	_ = messenger.Publish(node1Addr, false, "c")
+	assert.Equal(t, []string{"a", "c"}, getReceived())
+
+	// duplicate
+	messenger.InjectFault(messaging.DummyFault{Type: messaging.FaultDuplicate, Count: 1})
+	_ = messenger.Publish(node1Addr, false, "d")
+	_ = messenger.Publish(node1Addr, false, "e")
+	assert.Equal(t, []string{"d", "d", "e"}, getReceived())
+
+	// reorder
+	messenger.InjectFault(messaging.DummyFault{Type: messaging.FaultReorder, Count: 1})
+	_ = messenger.Publish(node1Addr, false, "f")
+	_ = messenger.Publish(node1Addr, false, "g")
+	assert.Equal(t, []string{"g", "f"}, getReceived())
+	messenger.InjectFault(messaging.DummyFault{Type: messaging.FaultReorder})
+	_ = messenger.Publish(node1Addr, false, "h")
+	assert.Empty(t, getReceived())
+	messenger.ClearFaults()
+	assert.Equal(t, []string{"h"}, getReceived())
+
+	// delay
+	messenger.InjectFault(messaging.DummyFault{Type: messaging.FaultDelay, Count: 1, Delay: 50 * time.Millisecond})
+	_ = messenger.Publish(node1Addr, false, "i")
+	assert.Empty(t, getReceived())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []string{"i"}, getReceived())
+
+	// disconnect and reconnect after the delay, with redelivery of retained messages
+	messenger.InjectFault(messaging.DummyFault{Type: messaging.FaultDisconnect, Count: 1, Delay: 50 * time.Millisecond})
+	_ = messenger.Publish(node1Addr, false, "j")
+	assert.Equal(t, messaging.ConnectionStateLost, messenger.ConnectionState())
+	err := messenger.Publish(node1Addr, false, "k")
+	assert.Error(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, messaging.ConnectionStateReconnected, messenger.ConnectionState())
+	assert.Equal(t, []string{"a"}, getReceived())
+}
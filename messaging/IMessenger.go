@@ -1,18 +1,50 @@
 // Package messaging - Interface of messengers for publishers and subscribers
 package messaging
 
+import "context"
+
+// ConnectionState of a messenger as reported to its connection handler
+type ConnectionState string
+
+// Connection states of a messenger
+const (
+	ConnectionStateConnecting   ConnectionState = "connecting"   // connecting for the first time
+	ConnectionStateConnected    ConnectionState = "connected"    // connected for the first time
+	ConnectionStateLost         ConnectionState = "lost"         // connection lost, reconnecting in the background
+	ConnectionStateReconnected  ConnectionState = "reconnected"  // connection restored after it was lost
+	ConnectionStateDisconnected ConnectionState = "disconnected" // not connected or intentionally disconnected
+)
+
+// SubscriptionHandle identifies a subscription made with Subscribe
+type SubscriptionHandle uint64
+
 // MessengerConfig with configuration of a messenger
 type MessengerConfig struct {
-	ClientID  string `yaml:"clientid,omitempty"`  // optional connect ID, must be unique. Default is generated.
-	Domain    string `yaml:"domain,omitempty"`    // Domain to be used by all publishers
-	Login     string `yaml:"login"`               // messenger login name
-	Port      uint16 `yaml:"port,omitempty"`      // optional port, default is 8883 for TLS
-	Password  string `yaml:"credentials"`         // messenger login credentials
-	PubQos    byte   `yaml:"pubqos,omitempty"`    // publishing QOS 0-2. Default=0
-	Server    string `yaml:"server"`              // Message bus server/broker hostname or ip address, required
-	Signing   bool   `yaml:"signing,omitempty"`   // Message signing to be used by all publishers.
-	SubQos    byte   `yaml:"subqos,omitempty"`    // Subscription QOS 0-2. Default=0
-	Messenger string `yaml:"messenger,omitempty"` // Messenger client type: "DummyMessenger" (default) or "MQTTMessenger"
+	CAFile            string `yaml:"cafile,omitempty"`            // optional CA certificate to verify the server with. Default is DefaultCAFile if it exists, otherwise the system CAs
+	ClientCert        string `yaml:"clientcert,omitempty"`        // optional client certificate file for mutual TLS authentication
+	ClientID          string `yaml:"clientid,omitempty"`          // optional connect ID, must be unique. Default is generated.
+	ClientKey         string `yaml:"clientkey,omitempty"`         // optional client private key file for mutual TLS authentication
+	Domain            string `yaml:"domain,omitempty"`            // Domain to be used by all publishers
+	DispatchOverflow  string `yaml:"dispatchoverflow,omitempty"`  // policy when a dispatch queue is full: block (default), dropnewest or dropoldest
+	DispatchQueueSize int    `yaml:"dispatchqueuesize,omitempty"` // max received messages queued per dispatch worker. Default is 100
+	DispatchWorkers   int    `yaml:"dispatchworkers,omitempty"`   // nr of workers that pass received messages to handlers. Default 0 uses the receiving goroutine
+	Heartbeat         int    `yaml:"heartbeat,omitempty"`         // seconds between last will heartbeats. Default is 10 (NATSMessenger)
+	Insecure          bool   `yaml:"insecure,omitempty"`          // skip verification of the server certificate. Intended for testing
+	Login             string `yaml:"login"`                       // messenger login name
+	Path              string `yaml:"path,omitempty"`              // optional websocket path on the server, eg /mqtt
+	Port              uint16 `yaml:"port,omitempty"`              // optional port, default is 1883 for tcp, 8883 for tls, 80 for ws and 443 for wss. NATS uses 4222
+	Password          string `yaml:"credentials"`                 // messenger login credentials
+	PubQos            byte   `yaml:"pubqos,omitempty"`            // publishing QOS 0-2. Default=0
+	QueueFile         string `yaml:"queuefile,omitempty"`         // optional file to persist publications queued while disconnected (MQTTMessenger)
+	QueueSize         int    `yaml:"queuesize,omitempty"`         // max publications queued while disconnected. Default is 1000 (MQTTMessenger)
+	RecordFile        string `yaml:"recordfile,omitempty"`        // optional file to record published and received messages for replay
+	Server            string `yaml:"server"`                      // Message bus server/broker hostname or ip address, required
+	ServerName        string `yaml:"servername,omitempty"`        // optional name on the server certificate. Default is the server hostname
+	Signing           bool   `yaml:"signing,omitempty"`           // Message signing to be used by all publishers.
+	SubQos            byte   `yaml:"subqos,omitempty"`            // Subscription QOS 0-2. Default=0
+	Messenger         string `yaml:"messenger,omitempty"`         // Messenger client type: "DummyMessenger" (default), "MQTTMessenger", "MQTT5Messenger" or "NATSMessenger"
+	Transport         string `yaml:"transport,omitempty"`         // transport to connect with: tcp, tls (default), ws or wss
+	ValueExpiry       uint32 `yaml:"valueexpiry,omitempty"`       // seconds the server keeps retained $latest and $raw values. 0 to keep them (MQTT5Messenger)
 }
 
 // IMessenger interface for messenger implementations
@@ -22,11 +54,19 @@ type IMessenger interface {
 	// This contains the last-will & testament information which is useful to inform subscribers
 	//  when a publisher is unintentionally disconnected. Non MQTT busses can replace this with
 	// their equivalent if available. Subscribers-only leave this empty.
+	// Connect waits until the connection is established or ctx is done. Connection attempts
+	// continue in the background until Disconnect is called. Use SetConnectionHandler to be
+	// notified when the connection is established, lost or restored.
 	//
+	// ctx to limit the time to wait for the connection
 	// lastWillAddress optional last will & testament address for publishing device state
 	//                 on accidental disconnect. Subscribers use "" to ignore.
 	// lastWillValue payload to use with the last will publication
-	Connect(lastWillAddress string, lastWillValue string) error
+	// Returns an error if the configuration is invalid, or if not connected when ctx is done
+	Connect(ctx context.Context, lastWillAddress string, lastWillValue string) error
+
+	// ConnectionState returns the current state of the connection
+	ConnectionState() ConnectionState
 
 	// Gracefully disconnect the messenger and unsubscribe to all subscribed messages.
 	// This will prevent the LWT publication so publishers must publish a graceful disconnect
@@ -40,13 +80,19 @@ type IMessenger interface {
 	//  message is a serialized message to send
 	Publish(address string, retained bool, message string) error
 
+	// SetConnectionHandler sets the handler that is invoked when the connection state changes.
+	// The handler can be invoked from a background goroutine.
+	SetConnectionHandler(handler func(state ConnectionState))
+
 	// Subscribe to a message. The subscriber must handle message decryption and signing verification.
 	//  address to subscribe to with support for wildcards '+' and '#'. Non MQTT busses must convert to equivalent
 	//  onMessage callback is invoked when a message on this address is received
 	// Multiple subscriptions for the same address is supported.
-	Subscribe(address string, onMessage func(address string, message string) error)
+	// Returns the handle to unsubscribe with
+	Subscribe(address string, onMessage func(address string, message string) error) SubscriptionHandle
 
-	// Unsubscribe from a previously subscribed address.
-	// If onMessage is nil then all subscriptions with the address will be removed
-	Unsubscribe(address string, onMessage func(address string, message string) error)
+	// Unsubscribe a subscription using the handle returned by Subscribe.
+	// The address is unsubscribed from the message bus when it has no remaining subscriptions.
+	// Unknown handles are ignored.
+	Unsubscribe(handle SubscriptionHandle)
 }
@@ -2,15 +2,22 @@
 package messaging
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/asn1"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/iotdomain/iotdomain-go/types"
 	"github.com/sirupsen/logrus"
@@ -20,22 +27,67 @@ import (
 // MessageSigner for signing and verifying of signed and encrypted messages
 type MessageSigner struct {
 	// GetPublicKey when available is used in mess to verify signature
-	GetPublicKey func(address string) *ecdsa.PublicKey // must be a variable
-	messenger    IMessenger
-	signMessages bool              // flag, sign outgoing messages. Default is true. Disable for testing
-	privateKey   *ecdsa.PrivateKey // private key for signing and decryption
+	GetPublicKey func(address string) crypto.PublicKey // must be a variable
+	// GetPreviousPublicKey when available provides the key a sender used before it renewed its identity
+	GetPreviousPublicKey func(address string) crypto.PublicKey
+	messenger            IMessenger
+	signMessages         bool              // flag, sign outgoing messages. Default is true. Disable for testing
+	privateKey           crypto.PrivateKey // private key for signing and decryption
+	previousKey          crypto.PrivateKey // private key before rotation, for decryption during the grace period
+	previousKeyExpiry    time.Time         // time the previous key is no longer accepted
+	replayGuard          *ReplayGuard      // protection against replay of commands
+	updateMutex          *sync.Mutex       // mutex for async rotation of keys
+}
+
+// DecodeCommand decrypts and verifies a command like DecodeMessage and rejects the command if it is
+// a replay of an earlier command. The object must have a 'Timestamp' field and a 'Sender' or
+// 'Address' field.
+//  address the command is received on
+func (signer *MessageSigner) DecodeCommand(address string, rawMessage string, object interface{}) (
+	isEncrypted bool, isSigned bool, err error) {
+
+	dmessage, isEncrypted, isSigned, err := signer.decodeMessage(rawMessage, object)
+	if err != nil || !isSigned {
+		return isEncrypted, isSigned, err
+	}
+	reflObject := reflect.ValueOf(object).Elem()
+	reflSender := reflObject.FieldByName("Sender")
+	if !reflSender.IsValid() {
+		reflSender = reflObject.FieldByName("Address")
+	}
+	reflTimestamp := reflObject.FieldByName("Timestamp")
+	if !reflSender.IsValid() || !reflTimestamp.IsValid() {
+		err = errors.New("DecodeCommand: object doesn't have a Sender and Timestamp field")
+		return isEncrypted, isSigned, err
+	}
+	signer.updateMutex.Lock()
+	replayGuard := signer.replayGuard
+	signer.updateMutex.Unlock()
+	if replayGuard == nil {
+		return isEncrypted, isSigned, nil
+	}
+	err = replayGuard.Check(reflSender.String(), address, reflTimestamp.String(), dmessage)
+	return isEncrypted, isSigned, err
 }
 
 // DecodeMessage decrypts the message and verifies the sender signature .
 // The sender and signer of the message is contained the message 'sender' field. If the
 // Sender field is missing then the 'address' field is used as sender.
 // object must hold the expected message type to decode the json message containging the sender info
+// Messages encrypted with, or signed by, a key that was recently rotated are accepted during the
+// grace period of that key.
 func (signer *MessageSigner) DecodeMessage(rawMessage string, object interface{}) (isEncrypted bool, isSigned bool, err error) {
-	dmessage, isEncrypted, err := DecryptMessage(rawMessage, signer.privateKey)
-	isSigned, err = VerifySenderJWSSignature(dmessage, object, signer.GetPublicKey)
+	_, isEncrypted, isSigned, err = signer.decodeMessage(rawMessage, object)
 	return isEncrypted, isSigned, err
 }
 
+// SetReplayGuard replaces the protection against replay of commands used by DecodeCommand
+func (signer *MessageSigner) SetReplayGuard(replayGuard *ReplayGuard) {
+	signer.updateMutex.Lock()
+	defer signer.updateMutex.Unlock()
+	signer.replayGuard = replayGuard
+}
+
 // SignMessages returns whether messages MUST be signed on sending or receiving
 func (signer *MessageSigner) SignMessages() bool {
 	return signer.signMessages
@@ -47,13 +99,21 @@ func (signer *MessageSigner) SignMessages() bool {
 //  or 'address' field
 func (signer *MessageSigner) VerifySignedMessage(rawMessage string, object interface{}) (isSigned bool, err error) {
 	isSigned, err = VerifySenderJWSSignature(rawMessage, object, signer.GetPublicKey)
+	if isSigned && err != nil && signer.GetPreviousPublicKey != nil {
+		// the sender might have renewed its identity after signing the message
+		_, prevErr := VerifySenderJWSSignature(rawMessage, object, signer.GetPreviousPublicKey)
+		if prevErr == nil {
+			err = nil
+		}
+	}
 	return isSigned, err
 }
 
 // PublishObject encapsulates the message object in a payload, signs the message, and sends it.
-//  If an encryption key is provided then the signed message will be encrypted.
+//  If an encryption key is provided then the signed message will be encrypted. Only ECDSA keys
+//  can be used for encryption.
 //  The object to publish will be marshalled to JSON and signed by this publisher
-func (signer *MessageSigner) PublishObject(address string, retained bool, object interface{}, encryptionKey *ecdsa.PublicKey) error {
+func (signer *MessageSigner) PublishObject(address string, retained bool, object interface{}, encryptionKey crypto.PublicKey) error {
 	// payload, err := json.Marshal(object)
 	payload, err := json.MarshalIndent(object, " ", " ")
 	if err != nil || object == nil {
@@ -68,40 +128,115 @@ func (signer *MessageSigner) PublishObject(address string, retained bool, object
 	return err
 }
 
+// PublishObjectForRecipients encapsulates the message object in a payload, signs the message, encrypts
+// it for each of the recipients and sends it. Each recipient decrypts the message with its own key.
+//  recipients are the identity addresses of the publishers that can decrypt the message, eg
+//  domain/publisherID/$identity. Their public keys are obtained with GetPublicKey.
+// Returns an error if the public key of a recipient is unknown or cannot be used for encryption
+func (signer *MessageSigner) PublishObjectForRecipients(
+	address string, retained bool, object interface{}, recipients []string) error {
+
+	if len(recipients) == 0 || signer.GetPublicKey == nil {
+		return fmt.Errorf("PublishObjectForRecipients: No recipients or recipient keys to encrypt message for %s", address)
+	}
+	payload, err := json.MarshalIndent(object, " ", " ")
+	if err != nil || object == nil {
+		return fmt.Errorf("PublishObjectForRecipients: Error marshalling message for address %s: %s", address, err)
+	}
+	publicKeys := make(map[string]crypto.PublicKey)
+	for _, recipient := range recipients {
+		publicKey := signer.GetPublicKey(recipient)
+		if publicKey == nil {
+			return fmt.Errorf("PublishObjectForRecipients: No public key for recipient '%s' of %s", recipient, address)
+		}
+		publicKeys[recipient] = publicKey
+	}
+	return signer.PublishEncryptedForRecipients(address, retained, string(payload), publicKeys)
+}
+
+// RotatePrivateKey replaces the private key used for signing and decryption while the current key
+// remains valid for decryption during the grace period. Intended for use when the publisher identity
+// is renewed as messages can still be encrypted with the previous key until the new identity is received.
+func (signer *MessageSigner) RotatePrivateKey(privateKey crypto.PrivateKey, gracePeriod time.Duration) {
+	signer.updateMutex.Lock()
+	defer signer.updateMutex.Unlock()
+	if signer.privateKey != nil && !isSameKey(signer.privateKey, privateKey) {
+		signer.previousKey = signer.privateKey
+		signer.previousKeyExpiry = time.Now().Add(gracePeriod)
+	}
+	signer.privateKey = privateKey
+}
+
+// SetPrivateKey replaces the private key used for signing and decryption.
+// Intended for use when the publisher identity is renewed.
+func (signer *MessageSigner) SetPrivateKey(privateKey crypto.PrivateKey) {
+	signer.updateMutex.Lock()
+	defer signer.updateMutex.Unlock()
+	signer.privateKey = privateKey
+	signer.previousKey = nil
+}
+
 // SetSignMessages enables or disables message signing. Intended for testing.
 func (signer *MessageSigner) SetSignMessages(sign bool) {
 	signer.signMessages = sign
 }
 
 // Subscribe to messages on the given address
+// Returns the handle to unsubscribe with
 func (signer *MessageSigner) Subscribe(
 	address string,
-	handler func(address string, message string) error) {
-	signer.messenger.Subscribe(address, handler)
+	handler func(address string, message string) error) SubscriptionHandle {
+	return signer.messenger.Subscribe(address, handler)
 }
 
-// Unsubscribe to messages on the given address
-func (signer *MessageSigner) Unsubscribe(
-	address string,
-	handler func(address string, message string) error) {
-	signer.messenger.Unsubscribe(address, handler)
+// Unsubscribe a subscription using the handle returned by Subscribe
+func (signer *MessageSigner) Unsubscribe(handle SubscriptionHandle) {
+	signer.messenger.Unsubscribe(handle)
 }
 
 // PublishEncrypted sign and encrypts the payload and publish the resulting message on the given address
 // Signing only happens if the publisher's signingMethod is set to SigningMethodJWS
 func (signer *MessageSigner) PublishEncrypted(
-	address string, retained bool, payload string, publicKey *ecdsa.PublicKey) error {
+	address string, retained bool, payload string, publicKey crypto.PublicKey) error {
 	var err error
 	message := payload
 	// first sign, then encrypt as per RFC
 	if signer.signMessages {
-		message, _ = CreateJWSSignature(string(payload), signer.privateKey)
+		privateKey, _ := signer.getPrivateKeys()
+		message, _ = CreateJWSSignature(string(payload), privateKey)
 	}
 	emessage, err := EncryptMessage(message, publicKey)
+	if err != nil {
+		return err
+	}
 	err = signer.messenger.Publish(address, retained, emessage)
 	return err
 }
 
+// PublishEncryptedForRecipients signs and encrypts the payload for multiple recipients and publishes
+// the resulting message on the given address. See also EncryptMessageForRecipients.
+//  publicKeys of the recipients by their identity address
+func (signer *MessageSigner) PublishEncryptedForRecipients(
+	address string, retained bool, payload string, publicKeys map[string]crypto.PublicKey) error {
+	message := payload
+	// first sign, then encrypt as per RFC
+	if signer.signMessages {
+		privateKey, _ := signer.getPrivateKeys()
+		message, _ = CreateJWSSignature(string(payload), privateKey)
+	}
+	emessage, err := EncryptMessageForRecipients(message, publicKeys)
+	if err != nil {
+		return err
+	}
+	return signer.messenger.Publish(address, retained, emessage)
+}
+
+// RemovePublication removes a retained publication from the message bus.
+// This publishes an empty retained message on the given address which clears the retained message.
+func (signer *MessageSigner) RemovePublication(address string) error {
+	return signer.messenger.Publish(address, true, "")
+}
+
 // PublishSigned sign the payload and publish the resulting message on the given address
 // Signing only happens if the publisher's signingMethod is set to SigningMethodJWS
 func (signer *MessageSigner) PublishSigned(
@@ -112,7 +247,8 @@ func (signer *MessageSigner) PublishSigned(
 	message := payload
 
 	if signer.signMessages {
-		message, err = CreateJWSSignature(string(payload), signer.privateKey)
+		privateKey, _ := signer.getPrivateKeys()
+		message, err = CreateJWSSignature(string(payload), privateKey)
 		if err != nil {
 			logrus.Errorf("Publisher.publishMessage: Error signing message for address %s: %s", address, err)
 		}
@@ -121,10 +257,35 @@ func (signer *MessageSigner) PublishSigned(
 	return err
 }
 
+// decodeMessage decrypts the message and verifies the sender signature
+// This returns the decrypted message
+func (signer *MessageSigner) decodeMessage(rawMessage string, object interface{}) (
+	dmessage string, isEncrypted bool, isSigned bool, err error) {
+
+	privateKey, previousKey := signer.getPrivateKeys()
+	dmessage, isEncrypted, err = DecryptMessage(rawMessage, privateKey)
+	if isEncrypted && err != nil && previousKey != nil {
+		dmessage, isEncrypted, err = DecryptMessage(rawMessage, previousKey)
+	}
+	isSigned, err = signer.VerifySignedMessage(dmessage, object)
+	return dmessage, isEncrypted, isSigned, err
+}
+
+// getPrivateKeys returns the current private key and the previous key if still in its grace period
+func (signer *MessageSigner) getPrivateKeys() (privateKey crypto.PrivateKey, previousKey crypto.PrivateKey) {
+	signer.updateMutex.Lock()
+	defer signer.updateMutex.Unlock()
+	if signer.previousKey != nil && time.Now().Before(signer.previousKeyExpiry) {
+		previousKey = signer.previousKey
+	}
+	return signer.privateKey, previousKey
+}
+
 // NewMessageSigner creates a new instance for signing and verifying published messages
 // If getPublicKey is not provided, verification of signature is skipped
-func NewMessageSigner(messenger IMessenger, signingKey *ecdsa.PrivateKey,
-	getPublicKey func(address string) *ecdsa.PublicKey,
+//  signingKey is an ECDSA P-256, ECDSA P-384 or Ed25519 private key. Ed25519 keys cannot decrypt messages.
+func NewMessageSigner(messenger IMessenger, signingKey crypto.PrivateKey,
+	getPublicKey func(address string) crypto.PublicKey,
 ) *MessageSigner {
 
 	signer := &MessageSigner{
@@ -132,6 +293,8 @@ func NewMessageSigner(messenger IMessenger, signingKey *ecdsa.PrivateKey,
 		messenger:    messenger,
 		signMessages: true,
 		privateKey:   signingKey, // private key for signing
+		replayGuard:  NewReplayGuard("", DefaultReplayWindow),
+		updateMutex:  &sync.Mutex{},
 	}
 	return signer
 }
@@ -140,14 +303,15 @@ func NewMessageSigner(messenger IMessenger, signingKey *ecdsa.PrivateKey,
  *  Helper Functions for signing and verification
  */
 
-// CreateEcdsaSignature creates a ECDSA256 signature from the payload using the provided private key
+// CreateEcdsaSignature creates a ECDSA signature from the payload using the provided private key
+// The payload is hashed with SHA-256 for P-256 keys and with SHA-384 for P-384 keys.
 // This returns a base64url encoded signature
 func CreateEcdsaSignature(payload []byte, privateKey *ecdsa.PrivateKey) string {
 	if privateKey == nil {
 		return ""
 	}
-	hashed := sha256.Sum256(payload)
-	r, s, err := ecdsa.Sign(rand.Reader, privateKey, hashed[:])
+	hashed := hashEcdsaPayload(payload, privateKey.Curve)
+	r, s, err := ecdsa.Sign(rand.Reader, privateKey, hashed)
 	if err != nil {
 		return ""
 	}
@@ -155,18 +319,38 @@ func CreateEcdsaSignature(payload []byte, privateKey *ecdsa.PrivateKey) string {
 	return base64.URLEncoding.EncodeToString(sig)
 }
 
-// SignIdentity updates the base64URL encoded ECDSA256 signature of the public identity
-func SignIdentity(publicIdent *types.PublisherIdentityMessage, privKey *ecdsa.PrivateKey) {
+// CreateSignature creates a signature from the payload using the provided ECDSA or Ed25519 private key
+// This returns a base64url encoded signature, or "" if the key is not supported
+func CreateSignature(payload []byte, privateKey crypto.PrivateKey) string {
+	switch key := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		return CreateEcdsaSignature(payload, key)
+	case ed25519.PrivateKey:
+		if len(key) != ed25519.PrivateKeySize {
+			return ""
+		}
+		return base64.URLEncoding.EncodeToString(ed25519.Sign(key, payload))
+	}
+	return ""
+}
+
+// SignIdentity updates the base64URL encoded signature of the public identity
+func SignIdentity(publicIdent *types.PublisherIdentityMessage, privKey crypto.PrivateKey) {
 	identCopy := *publicIdent
 	identCopy.IdentitySignature = ""
 	payload, _ := json.Marshal(identCopy)
-	sigStr := CreateEcdsaSignature(payload, privKey)
+	sigStr := CreateSignature(payload, privKey)
 	publicIdent.IdentitySignature = sigStr
 }
 
-// CreateJWSSignature signs the payload using JSE ES256 and return the JSE compact serialized message
-func CreateJWSSignature(payload string, privateKey *ecdsa.PrivateKey) (string, error) {
-	joseSigner, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: privateKey}, nil)
+// CreateJWSSignature signs the payload using JWS and return the JWS compact serialized message
+// The JWS algorithm, ES256, ES384 or EdDSA, is determined by the private key.
+func CreateJWSSignature(payload string, privateKey crypto.PrivateKey) (string, error) {
+	algorithm := GetKeyAlgorithm(privateKey)
+	if algorithm == "" {
+		return "", errors.New("CreateJWSSignature: Unsupported or missing private key")
+	}
+	joseSigner, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.SignatureAlgorithm(algorithm), Key: privateKey}, nil)
 	if err != nil {
 		return "", err
 	}
@@ -180,12 +364,13 @@ func CreateJWSSignature(payload string, privateKey *ecdsa.PrivateKey) (string, e
 }
 
 // DecryptMessage deserializes and decrypts the message using JWE
+// Messages encrypted for multiple recipients are decrypted using the recipient entry of the private key.
 // This returns the decrypted message, or the input message if the message was not encrypted
-func DecryptMessage(serialized string, privateKey *ecdsa.PrivateKey) (message string, isEncrypted bool, err error) {
+func DecryptMessage(serialized string, privateKey crypto.PrivateKey) (message string, isEncrypted bool, err error) {
 	message = serialized
 	decrypter, err := jose.ParseEncrypted(serialized)
 	if err == nil {
-		dmessage, err := decrypter.Decrypt(privateKey)
+		_, _, dmessage, err := decrypter.DecryptMulti(privateKey)
 		message = string(dmessage)
 		return message, true, err
 	}
@@ -193,10 +378,16 @@ func DecryptMessage(serialized string, privateKey *ecdsa.PrivateKey) (message st
 }
 
 // EncryptMessage encrypts and serializes the message using JWE
-func EncryptMessage(message string, publicKey *ecdsa.PublicKey) (serialized string, err error) {
+// Only ECDSA public keys can be used for encryption.
+func EncryptMessage(message string, publicKey crypto.PublicKey) (serialized string, err error) {
 	var jwe *jose.JSONWebEncryption
 
-	recpnt := jose.Recipient{Algorithm: jose.ECDH_ES, Key: publicKey}
+	ecdsaKey, isEcdsa := publicKey.(*ecdsa.PublicKey)
+	if !isEcdsa || ecdsaKey == nil {
+		err = fmt.Errorf("EncryptMessage: Key algorithm '%s' cannot be used for encryption", GetKeyAlgorithm(publicKey))
+		return message, err
+	}
+	recpnt := jose.Recipient{Algorithm: jose.ECDH_ES, Key: ecdsaKey}
 
 	encrypter, err := jose.NewEncrypter(jose.A128CBC_HS256, recpnt, nil)
 
@@ -210,15 +401,48 @@ func EncryptMessage(message string, publicKey *ecdsa.PublicKey) (serialized stri
 	return serialized, err
 }
 
-// VerifyIdentitySignature verifies a base64URL encoded ECDSA256 signature in the identity
+// EncryptMessageForRecipients encrypts the message for multiple recipients using JWE with ECDH-ES+A128KW
+// and serializes it in the JWE JSON serialization. The identity address of each recipient is included
+// as its key ID. Only ECDSA public keys can be used for encryption.
+//  publicKeys of the recipients by their identity address
+func EncryptMessageForRecipients(message string, publicKeys map[string]crypto.PublicKey) (serialized string, err error) {
+	if len(publicKeys) == 0 {
+		return message, errors.New("EncryptMessageForRecipients: No recipients")
+	}
+	addresses := make([]string, 0, len(publicKeys))
+	for address := range publicKeys {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	recipients := make([]jose.Recipient, 0, len(addresses))
+	for _, address := range addresses {
+		ecdsaKey, isEcdsa := publicKeys[address].(*ecdsa.PublicKey)
+		if !isEcdsa || ecdsaKey == nil {
+			err = fmt.Errorf("EncryptMessageForRecipients: Key of recipient '%s' cannot be used for encryption", address)
+			return message, err
+		}
+		recipients = append(recipients, jose.Recipient{Algorithm: jose.ECDH_ES_A128KW, Key: ecdsaKey, KeyID: address})
+	}
+	encrypter, err := jose.NewMultiEncrypter(jose.A128CBC_HS256, recipients, nil)
+	if err != nil {
+		return message, err
+	}
+	jwe, err := encrypter.Encrypt([]byte(message))
+	if err != nil {
+		return message, err
+	}
+	return jwe.FullSerialize(), nil
+}
+
+// VerifyIdentitySignature verifies a base64URL encoded signature in the identity
 // against the identity itself using the sender's public key.
-func VerifyIdentitySignature(ident *types.PublisherIdentityMessage, pubKey *ecdsa.PublicKey) error {
+func VerifyIdentitySignature(ident *types.PublisherIdentityMessage, pubKey crypto.PublicKey) error {
 	// the signing took place with the signature field empty
 	identCopy := *ident
 	identCopy.IdentitySignature = ""
 	payload, _ := json.Marshal(identCopy)
 
-	err := VerifyEcdsaSignature(payload, ident.IdentitySignature, pubKey)
+	err := VerifySignature(payload, ident.IdentitySignature, pubKey)
 
 	// signingKey := jose.SigningKey{Algorithm: jose.ES256, Key: privKey}
 	// joseSigner, _ := jose.NewSigner(signingKey, nil)
@@ -232,7 +456,7 @@ func VerifyIdentitySignature(ident *types.PublisherIdentityMessage, pubKey *ecds
 
 // VerifyEcdsaSignature the payload using the base64url encoded signature and public key
 // payload is any raw data
-// signatureB64urlEncoded is the ecdsa 256 URL encoded signature
+// signatureB64urlEncoded is the ecdsa URL encoded signature
 // Intended for signing an object like the publisher identity. Use VerifyJWSMessage for
 // verifying JWS signed messages.
 func VerifyEcdsaSignature(payload []byte, signatureB64urlEncoded string, publicKey *ecdsa.PublicKey) error {
@@ -249,19 +473,40 @@ func VerifyEcdsaSignature(payload []byte, signatureB64urlEncoded string, publicK
 		return errors.New("VerifyEcdsaSignature: Payload is not ASN")
 	}
 
-	hashed := sha256.Sum256(payload)
-	verified := ecdsa.Verify(publicKey, hashed[:], rs.R, rs.S)
+	hashed := hashEcdsaPayload(payload, publicKey.Curve)
+	verified := ecdsa.Verify(publicKey, hashed, rs.R, rs.S)
 	if !verified {
 		return errors.New("VerifyEcdsaSignature: Signature does not match payload")
 	}
 	return nil
 }
 
+// VerifySignature verifies the payload using the base64url encoded signature and an ECDSA or
+// Ed25519 public key. See also CreateSignature.
+func VerifySignature(payload []byte, signatureB64urlEncoded string, publicKey crypto.PublicKey) error {
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		return VerifyEcdsaSignature(payload, signatureB64urlEncoded, key)
+	case ed25519.PublicKey:
+		signature, err := base64.URLEncoding.DecodeString(signatureB64urlEncoded)
+		if err != nil {
+			return errors.New("VerifySignature: Invalid signature")
+		}
+		if len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, payload, signature) {
+			return errors.New("VerifySignature: Signature does not match payload")
+		}
+		return nil
+	case nil:
+		return errors.New("VerifySignature: publicKey is nil")
+	}
+	return errors.New("VerifySignature: Unsupported public key")
+}
+
 // VerifyJWSMessage verifies a signed message and returns its payload
 // The message is a JWS encoded string. The public key of the sender is
 // needed to verify the message.
 //  Intended for testing, as the application uses VerifySenderJWSSignature instead.
-func VerifyJWSMessage(message string, publicKey *ecdsa.PublicKey) (payload string, err error) {
+func VerifyJWSMessage(message string, publicKey crypto.PublicKey) (payload string, err error) {
 	if publicKey == nil {
 		err := errors.New("VerifyJWSMessage: public key is nil")
 		return "", err
@@ -287,7 +532,7 @@ func VerifyJWSMessage(message string, publicKey *ecdsa.PublicKey) (payload strin
 // The rawMessage is json unmarshalled into the given object.
 //
 // This returns a flag if the message was signed and if so, an error if the verification failed
-func VerifySenderJWSSignature(rawMessage string, object interface{}, getPublicKey func(address string) *ecdsa.PublicKey) (isSigned bool, err error) {
+func VerifySenderJWSSignature(rawMessage string, object interface{}, getPublicKey func(address string) crypto.PublicKey) (isSigned bool, err error) {
 
 	jwsSignature, err := jose.ParseSigned(rawMessage)
 	if err != nil {
@@ -335,3 +580,13 @@ func VerifySenderJWSSignature(rawMessage string, object interface{}, getPublicKe
 	}
 	return true, err
 }
+
+// hashEcdsaPayload hashes the payload with the hash that matches the curve size
+func hashEcdsaPayload(payload []byte, curve elliptic.Curve) []byte {
+	if curve == elliptic.P384() {
+		hashed := sha512.Sum384(payload)
+		return hashed[:]
+	}
+	hashed := sha256.Sum256(payload)
+	return hashed[:]
+}
@@ -1,7 +1,7 @@
 package messaging_test
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"encoding/base64"
 	"encoding/json"
 	"log"
@@ -11,6 +11,7 @@ import (
 	"github.com/iotdomain/iotdomain-go/messaging"
 	"github.com/iotdomain/iotdomain-go/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gopkg.in/square/go-jose.v2"
 )
 
@@ -92,6 +93,63 @@ func TestJWSSigning(t *testing.T) {
 	assert.NotEqual(t, sig1, sig2, "JWS Signature doesn't match with Ecdsa")
 }
 
+func TestKeyAlgorithms(t *testing.T) {
+	payload1, _ := json.Marshal(testObject)
+	ident := &types.PublisherIdentityMessage{Address: "test/pub1/$identity", Domain: "test", PublisherID: "pub1"}
+
+	for _, algorithm := range []string{messaging.KeyAlgorithmES256, messaging.KeyAlgorithmES384, messaging.KeyAlgorithmEdDSA} {
+		privKey, err := messaging.CreateKeys(algorithm)
+		require.NoError(t, err)
+		pubKey := messaging.GetPublicKeyOf(privKey)
+		assert.Equal(t, algorithm, messaging.GetKeyAlgorithm(privKey))
+		assert.Equal(t, algorithm, messaging.GetKeyAlgorithm(pubKey))
+
+		// JWS signature uses the algorithm of the key
+		sig1, err := messaging.CreateJWSSignature(string(payload1), privKey)
+		require.NoError(t, err)
+		jwsSignature, _ := jose.ParseSigned(sig1)
+		assert.Equal(t, algorithm, jwsSignature.Signatures[0].Header.Algorithm)
+		payload, err := messaging.VerifyJWSMessage(sig1, pubKey)
+		assert.NoError(t, err, "Verification of %s signature failed", algorithm)
+		assert.Equal(t, string(payload1), payload)
+
+		// keys survive the PEM encoding
+		assert.Equal(t, privKey, messaging.PrivateKeyFromPem(messaging.PrivateKeyToPem(privKey)))
+		assert.Equal(t, pubKey, messaging.PublicKeyFromPem(messaging.PublicKeyToPem(pubKey)))
+
+		messaging.SignIdentity(ident, privKey)
+		err = messaging.VerifyIdentitySignature(ident, pubKey)
+		assert.NoError(t, err, "Verification of %s identity signature failed", algorithm)
+	}
+	// signatures don't verify with a key of another algorithm
+	edKey, _ := messaging.CreateKeys(messaging.KeyAlgorithmEdDSA)
+	ecKey, _ := messaging.CreateKeys(messaging.KeyAlgorithmES384)
+	sig1, _ := messaging.CreateJWSSignature(string(payload1), edKey)
+	_, err := messaging.VerifyJWSMessage(sig1, messaging.GetPublicKeyOf(ecKey))
+	assert.Error(t, err)
+	messaging.SignIdentity(ident, edKey)
+	err = messaging.VerifyIdentitySignature(ident, messaging.GetPublicKeyOf(ecKey))
+	assert.Error(t, err)
+
+	// Ed25519 keys can't be used for encryption
+	_, err = messaging.EncryptMessage("hello", messaging.GetPublicKeyOf(edKey))
+	assert.Error(t, err)
+	emessage, err := messaging.EncryptMessage("hello", messaging.GetPublicKeyOf(ecKey))
+	require.NoError(t, err)
+	dmessage, isEncrypted, err := messaging.DecryptMessage(emessage, ecKey)
+	assert.NoError(t, err)
+	assert.True(t, isEncrypted)
+	assert.Equal(t, "hello", dmessage)
+
+	// error cases
+	_, err = messaging.CreateKeys("RS256")
+	assert.Error(t, err)
+	_, err = messaging.CreateJWSSignature(string(payload1), nil)
+	assert.Error(t, err)
+	assert.Nil(t, messaging.PublicKeyFromPem("not a pem"))
+	assert.Nil(t, messaging.PrivateKeyFromPem("not a pem"))
+}
+
 func TestSigningPerformance(t *testing.T) {
 	privKey := messaging.CreateAsymKeys()
 
@@ -160,7 +218,7 @@ func TestVerifySender(t *testing.T) {
 	sig1, err := messaging.CreateJWSSignature(string(payload1), privKey)
 
 	var received TestObjectWithSender
-	isSigned, err := messaging.VerifySenderJWSSignature(sig1, &received, func(address string) *ecdsa.PublicKey {
+	isSigned, err := messaging.VerifySenderJWSSignature(sig1, &received, func(address string) crypto.PublicKey {
 		// return the public key of this publisher
 		return &privKey.PublicKey
 	})
@@ -171,7 +229,7 @@ func TestVerifySender(t *testing.T) {
 	payload2, err := json.Marshal(testObject2)
 	sig2, err := messaging.CreateJWSSignature(string(payload2), privKey)
 	var received2 TestObjectNoSender
-	isSigned, err = messaging.VerifySenderJWSSignature(sig2, &received2, func(address string) *ecdsa.PublicKey {
+	isSigned, err = messaging.VerifySenderJWSSignature(sig2, &received2, func(address string) crypto.PublicKey {
 		// return the public key of this publisher
 		return &privKey.PublicKey
 	})
@@ -187,7 +245,7 @@ func TestVerifySender(t *testing.T) {
 
 	// no public key for sender
 	sig2, err = messaging.CreateJWSSignature(string(payload2), privKey)
-	isSigned, err = messaging.VerifySenderJWSSignature(sig2, &received2, func(address string) *ecdsa.PublicKey {
+	isSigned, err = messaging.VerifySenderJWSSignature(sig2, &received2, func(address string) crypto.PublicKey {
 		return nil
 	})
 	assert.Errorf(t, err, "Verification without public key succeeded")
@@ -220,7 +278,7 @@ func TestVerifySender(t *testing.T) {
 
 	// different public key
 	newKeys := messaging.CreateAsymKeys()
-	isSigned, err = messaging.VerifySenderJWSSignature(sig2, &received, func(address string) *ecdsa.PublicKey {
+	isSigned, err = messaging.VerifySenderJWSSignature(sig2, &received, func(address string) crypto.PublicKey {
 		// return the public key of this publisher
 		return &newKeys.PublicKey
 	})
@@ -245,7 +303,7 @@ func TestSigner(t *testing.T) {
 	config := messaging.MessengerConfig{}
 	messenger := messaging.NewDummyMessenger(&config)
 	privKey := messaging.CreateAsymKeys()
-	getPubKey := func(address string) *ecdsa.PublicKey {
+	getPubKey := func(address string) crypto.PublicKey {
 		return &privKey.PublicKey
 	}
 	signer := messaging.NewMessageSigner(messenger, privKey, getPubKey)
@@ -266,7 +324,7 @@ func TestSigner(t *testing.T) {
 		return nil
 	}
 	signer.SetSignMessages(true)
-	signer.Subscribe("test/+/#", handler)
+	handle := signer.Subscribe("test/+/#", handler)
 
 	obj := TestObjectWithSender{}
 	obj.Field1 = payload1
@@ -293,7 +351,153 @@ func TestSigner(t *testing.T) {
 	// err = signer.PublishEncrypted("test/bob/james", false, "aaa", &privKey.PublicKey)
 	// assert.Error(t, err, "No error publishing empty string as object")
 
-	signer.Unsubscribe("test/+/#", nil)
+	signer.Unsubscribe(handle)
+}
+
+func TestMultipleRecipients(t *testing.T) {
+	const addr1 = "test/pub1/$identity"
+	const addr2 = "test/pub2/$identity"
+	const addr3 = "test/pub3/$identity"
+	keys := map[string]crypto.PrivateKey{
+		addr1: messaging.CreateAsymKeys(),
+		addr2: messaging.CreateAsymKeys(),
+		addr3: messaging.CreateAsymKeys(),
+	}
+	getPubKey := func(address string) crypto.PublicKey {
+		return messaging.GetPublicKeyOf(keys[address])
+	}
+
+	// each recipient decrypts the message with its own key
+	emessage, err := messaging.EncryptMessageForRecipients("hello", map[string]crypto.PublicKey{
+		addr1: getPubKey(addr1), addr2: getPubKey(addr2)})
+	require.NoError(t, err)
+	for _, addr := range []string{addr1, addr2} {
+		dmessage, isEncrypted, err := messaging.DecryptMessage(emessage, keys[addr])
+		assert.NoError(t, err)
+		assert.True(t, isEncrypted)
+		assert.Equal(t, "hello", dmessage)
+	}
+	_, isEncrypted, err := messaging.DecryptMessage(emessage, keys[addr3])
+	assert.True(t, isEncrypted)
+	assert.Error(t, err, "Message decrypted by a key that is not a recipient")
+
+	// publish a signed object to multiple recipients
+	messenger := messaging.NewDummyMessenger(nil)
+	signer1 := messaging.NewMessageSigner(messenger, keys[addr1], getPubKey)
+	signer2 := messaging.NewMessageSigner(messenger, keys[addr2], getPubKey)
+	signer3 := messaging.NewMessageSigner(messenger, keys[addr3], getPubKey)
+	received := make(map[string]string)
+	for addr, signer := range map[string]*messaging.MessageSigner{addr2: signer2, addr3: signer3} {
+		recipient, recipientSigner := addr, signer
+		recipientSigner.Subscribe("test/pub1/#", func(address string, rawMessage string) error {
+			obj := TestObjectWithSender{}
+			isEncrypted, isSigned, err := recipientSigner.DecodeMessage(rawMessage, &obj)
+			if isEncrypted && isSigned && err == nil {
+				received[recipient] = obj.Field1
+			}
+			return nil
+		})
+	}
+	obj := TestObjectWithSender{Field1: "confidential", Sender: addr1}
+	err = signer1.PublishObjectForRecipients("test/pub1/node1/$output", false, obj, []string{addr1, addr2})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{addr2: "confidential"}, received)
+
+	// error cases
+	err = signer1.PublishObjectForRecipients("test/pub1/node1/$output", false, obj, []string{addr2, "test/unknown/$identity"})
+	assert.Error(t, err)
+	err = signer1.PublishObjectForRecipients("test/pub1/node1/$output", false, obj, nil)
+	assert.Error(t, err)
+	edKey, _ := messaging.CreateKeys(messaging.KeyAlgorithmEdDSA)
+	_, err = messaging.EncryptMessageForRecipients("hello", map[string]crypto.PublicKey{
+		addr1: messaging.GetPublicKeyOf(edKey)})
+	assert.Error(t, err)
+}
+
+func TestDecodeCommand(t *testing.T) {
+	type TestCommand struct {
+		Field1    string `json:"field1"`
+		Sender    string `json:"sender"`
+		Timestamp string `json:"timestamp"`
+	}
+	const address = "test/bob/james/$configure"
+	messenger := messaging.NewDummyMessenger(&messaging.MessengerConfig{})
+	privKey := messaging.CreateAsymKeys()
+	signer := messaging.NewMessageSigner(messenger, privKey, func(address string) crypto.PublicKey {
+		return &privKey.PublicKey
+	})
+	command := TestCommand{Field1: "payload1", Sender: Pub1Address, Timestamp: time.Now().Format(types.TimeFormat)}
+	payload, _ := json.Marshal(command)
+	signed, _ := messaging.CreateJWSSignature(string(payload), privKey)
+	encrypted, _ := messaging.EncryptMessage(signed, &privKey.PublicKey)
+
+	received := TestCommand{}
+	isEncrypted, isSigned, err := signer.DecodeCommand(address, encrypted, &received)
+	assert.True(t, isEncrypted)
+	assert.True(t, isSigned)
+	assert.NoError(t, err)
+	assert.Equal(t, "payload1", received.Field1)
+
+	// a replay is rejected, even when encrypted again
+	_, _, err = signer.DecodeCommand(address, encrypted, &received)
+	assert.Error(t, err)
+	encrypted2, _ := messaging.EncryptMessage(signed, &privKey.PublicKey)
+	_, _, err = signer.DecodeCommand(address, encrypted2, &received)
+	assert.Error(t, err)
+
+	// an expired command is rejected
+	command.Timestamp = time.Now().Add(-time.Hour).Format(types.TimeFormat)
+	payload, _ = json.Marshal(command)
+	signed, _ = messaging.CreateJWSSignature(string(payload), privKey)
+	_, _, err = signer.DecodeCommand(address, signed, &received)
+	assert.Error(t, err)
+
+	// unless the window is disabled
+	signer.SetReplayGuard(messaging.NewReplayGuard("", 0))
+	_, _, err = signer.DecodeCommand(address, signed, &received)
+	assert.NoError(t, err)
+
+	// commands must have a timestamp
+	signed, _ = messaging.CreateJWSSignature(`{"field1":"payload1","sender":"me"}`, privKey)
+	_, _, err = signer.DecodeCommand(address, signed, &TestObjectWithSender{})
+	assert.Error(t, err)
+}
+
+func TestRotatePrivateKey(t *testing.T) {
+	config := messaging.MessengerConfig{}
+	messenger := messaging.NewDummyMessenger(&config)
+	oldKey := messaging.CreateAsymKeys()
+	newKey := messaging.CreateAsymKeys()
+	getPubKey := func(address string) crypto.PublicKey {
+		return &newKey.PublicKey
+	}
+	getPrevKey := func(address string) crypto.PublicKey {
+		return &oldKey.PublicKey
+	}
+	signer := messaging.NewMessageSigner(messenger, oldKey, getPubKey)
+	obj := TestObjectWithSender{Field1: "payload1", Sender: "c'est moi"}
+	payload, _ := json.Marshal(obj)
+	signed, _ := messaging.CreateJWSSignature(string(payload), oldKey)
+	encrypted, _ := messaging.EncryptMessage(signed, &oldKey.PublicKey)
+
+	// messages encrypted with the previous key are accepted during the grace period
+	signer.RotatePrivateKey(newKey, time.Minute)
+	received := TestObjectWithSender{}
+	isEncrypted, isSigned, err := signer.DecodeMessage(encrypted, &received)
+	assert.True(t, isEncrypted)
+	assert.True(t, isSigned)
+	// but not signed with it
+	assert.Error(t, err)
+	signer.GetPreviousPublicKey = getPrevKey
+	_, _, err = signer.DecodeMessage(encrypted, &received)
+	assert.NoError(t, err)
+	assert.Equal(t, "payload1", received.Field1)
+
+	// after the grace period the previous key is no longer used
+	signer.RotatePrivateKey(oldKey, 0)
+	signer.RotatePrivateKey(newKey, 0)
+	_, _, err = signer.DecodeMessage(encrypted, &received)
+	assert.Error(t, err)
 }
 
 func TestSignIdentity(t *testing.T) {
@@ -0,0 +1,881 @@
+// Package messaging - Publish and Subscribe to messages using the MQTT 5 protocol
+package messaging
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/mqttpacket"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+// User properties added to MQTT 5 publications to describe the message without decoding it
+const (
+	UserPropertyEncryption = "encryption" // content encryption algorithm of a JWE message
+	UserPropertySender     = "sender"     // sender of a message that is not encrypted
+	UserPropertySignature  = "signature"  // signature algorithm of a JWS message
+)
+
+// incomingQueueSize is the number of received messages that can wait for their handlers
+// The MQTT 5 messenger drops received messages when this queue is full.
+const incomingQueueSize = 100
+
+// errNotConnected is returned when a request is made without connection to the server
+var errNotConnected = errors.New("no connection with server")
+
+// PublicationProperties with the MQTT 5 properties of a publication
+type PublicationProperties struct {
+	CorrelationData []byte            // identifies the request a response belongs to
+	MessageExpiry   uint32            // seconds the broker keeps the message. 0 for no expiry
+	ResponseAddress string            // address to publish the response to a request on
+	UserProperties  map[string]string // metadata such as the sender and signature algorithm
+}
+
+// ReasonCodeError is returned when the server rejects a request with a MQTT 5 reason code
+type ReasonCodeError struct {
+	Operation    string // connect, publish, subscribe, unsubscribe or disconnect
+	Address      string // address of the request, if any
+	ReasonCode   byte   // reason code >= 0x80
+	ReasonString string // optional explanation provided by the server
+}
+
+// Error returns a description of the rejected request
+func (err *ReasonCodeError) Error() string {
+	text := fmt.Sprintf("%s %s rejected: %s", err.Operation, err.Address, mqttpacket.ReasonText(err.ReasonCode))
+	if err.ReasonString != "" {
+		text += " (" + err.ReasonString + ")"
+	}
+	return text
+}
+
+// Mqtt5Messenger that implements IMessenger using MQTT 5. In addition to IMessenger it supports
+// publication properties for request-response and reports rejections by the server as errors.
+// Only QoS 0 and 1 are supported. QoS 2 is downgraded to QoS 1.
+type Mqtt5Messenger struct {
+	config         *MessengerConfig                  // connect information
+	conn           net.Conn                          // current connection, nil when not connected
+	connectDone    chan struct{}                     // closed to end the connection attempts
+	connectPacket  *mqttpacket.Connect               // connect request, used to reconnect
+	dispatcher     *Dispatcher                       // passes received messages to the subscription handlers
+	isRunning      bool                              // reconnect when the connection is lost
+	lastHandle     SubscriptionHandle                // handle of the last subscription
+	lastPacketID   uint16                            // packet ID of the last request
+	lastSubID      uint32                            // identifier of the last subscription
+	pending        map[uint16]chan mqttpacket.Packet // requests waiting for acknowledgement
+	refusedErr     error                             // error of a refused connection
+	status         *connectionStatus                 // connection state reported to the connection handler
+	subIDAvailable bool                              // server supports subscription identifiers
+	subscriptions  map[string]*mqtt5Subscription     // subscriptions by address
+	updateMutex    *sync.Mutex                       // mutex for async updating of connection state
+	writeMutex     *sync.Mutex                       // mutex for writing packets
+}
+
+// mqtt5Subscription with the handlers of a subscribed address
+type mqtt5Subscription struct {
+	address  string
+	id       uint32 // subscription identifier to route messages to the handlers
+	handlers []mqtt5Handler
+}
+
+// mqtt5Handler with a message handler and the handle to unsubscribe it with
+type mqtt5Handler struct {
+	handle  SubscriptionHandle
+	handler func(address string, message string, props *PublicationProperties) error
+}
+
+// Connect to the MQTT 5 server and set the LWT
+// If a previous connection exists then it is disconnected first.
+// This waits until connected or ctx is done. Connection failures are retried in the background
+// until the connection succeeds or Disconnect is called. Once connected, a lost connection is
+// re-established in the background and subscriptions are restored.
+//  ctx to limit the time to wait for the connection
+//  lastWillAddress optional last will and testament address for publishing device state on
+//                  accidental disconnect. Use "" to ignore LWT feature.
+//  lastWillValue to use as the last will
+// Returns an error if the configuration is invalid, the server refuses the connection or if not
+// connected when ctx is done
+func (messenger *Mqtt5Messenger) Connect(ctx context.Context, lastWillAddress string, lastWillValue string) error {
+	config := messenger.config
+
+	brokerURL, err := MakeBrokerURL(config)
+	if err != nil {
+		return err
+	}
+	_, err = MakeTLSConfig(config)
+	if err != nil {
+		return err
+	}
+	messenger.closeConnection()
+
+	// ClientID defaults to hostname-nanosecondsSinceEpoc, unique for clients started in the same second
+	hostName, _ := os.Hostname()
+	if config.ClientID == "" {
+		config.ClientID = fmt.Sprintf("%s-%d", hostName, time.Now().UnixNano())
+	}
+	connectPacket := &mqttpacket.Connect{
+		ProtocolVersion: mqttpacket.ProtocolVersion5,
+		ClientID:        config.ClientID,
+		CleanStart:      true,
+		KeepAlive:       ConnectionTimeoutSec,
+	}
+	if config.Login != "" {
+		connectPacket.Username = config.Login
+		connectPacket.Password = config.Password
+	}
+	if lastWillAddress != "" {
+		connectPacket.Will = &mqttpacket.Will{Topic: lastWillAddress, Payload: []byte(lastWillValue), QoS: 1}
+	}
+	connectDone := make(chan struct{})
+	messenger.status.set(ConnectionStateConnecting)
+	messenger.updateMutex.Lock()
+	if messenger.connectDone != nil {
+		close(messenger.connectDone)
+	}
+	messenger.connectDone = connectDone
+	messenger.connectPacket = connectPacket
+	messenger.isRunning = true
+	messenger.refusedErr = nil
+	messenger.updateMutex.Unlock()
+	messenger.dispatcher.Start()
+
+	logrus.Infof("Mqtt5Messenger.Connect: Connecting to MQTT server: %s with clientID %s", brokerURL, config.ClientID)
+	go messenger.connectLoop(brokerURL, connectDone)
+	err = messenger.status.wait(ctx)
+	if err != nil {
+		messenger.updateMutex.Lock()
+		refusedErr := messenger.refusedErr
+		messenger.updateMutex.Unlock()
+		if refusedErr != nil {
+			return refusedErr
+		}
+		logrus.Warningf("Mqtt5Messenger.Connect: Not connected to %s: %s", brokerURL, err)
+		return fmt.Errorf("Mqtt5Messenger.Connect: Not connected to %s: %s", brokerURL, err)
+	}
+	return nil
+}
+
+// ConnectionState returns the current state of the connection with the server
+func (messenger *Mqtt5Messenger) ConnectionState() ConnectionState {
+	return messenger.status.get()
+}
+
+// Disconnect from the MQTT 5 server and remove all subscriptions. This sends a normal disconnect
+// so that the server discards the LWT.
+func (messenger *Mqtt5Messenger) Disconnect() {
+	messenger.updateMutex.Lock()
+	messenger.isRunning = false
+	messenger.subscriptions = make(map[string]*mqtt5Subscription)
+	if messenger.connectDone != nil {
+		close(messenger.connectDone)
+		messenger.connectDone = nil
+	}
+	messenger.updateMutex.Unlock()
+	messenger.closeConnection()
+	messenger.dispatcher.Stop()
+	messenger.status.set(ConnectionStateDisconnected)
+}
+
+// DispatchMetrics returns the counters of received messages passed to the subscription handlers
+func (messenger *Mqtt5Messenger) DispatchMetrics() DispatchMetrics {
+	return messenger.dispatcher.Metrics()
+}
+
+// Publish a message
+// If PubQos is 1 then this waits for the server to acknowledge the message.
+//  address to publish on
+//  retained to have the server retain the address value
+//  message to publish
+// Returns a ReasonCodeError if the server rejects the message
+func (messenger *Mqtt5Messenger) Publish(address string, retained bool, message string) error {
+	return messenger.PublishWithProperties(address, retained, message, nil)
+}
+
+// PublishWithProperties publishes a message with MQTT 5 publication properties.
+// Retained $latest and $raw values expire after the configured ValueExpiry. User properties
+// that describe the message sender and signature are added automatically.
+//  address to publish on
+//  retained to have the server retain the address value
+//  message to publish
+//  props with optional properties to include. nil to use the defaults.
+// Returns a ReasonCodeError if the server rejects the message
+func (messenger *Mqtt5Messenger) PublishWithProperties(
+	address string, retained bool, message string, props *PublicationProperties) error {
+
+	publish := &mqttpacket.Publish{
+		Topic:   address,
+		Payload: []byte(message),
+		QoS:     messenger.config.PubQos,
+		Retain:  retained,
+	}
+	if publish.QoS > 1 {
+		publish.QoS = 1
+	}
+	userProperties := messageMetadata(message)
+	if retained && (strings.HasSuffix(address, "/"+types.MessageTypeLatest) ||
+		strings.HasSuffix(address, "/"+types.MessageTypeRaw)) {
+		publish.Properties.MessageExpiry = messenger.config.ValueExpiry
+	}
+	if props != nil {
+		if props.MessageExpiry != 0 {
+			publish.Properties.MessageExpiry = props.MessageExpiry
+		}
+		publish.Properties.ResponseTopic = props.ResponseAddress
+		publish.Properties.CorrelationData = props.CorrelationData
+		for name, value := range props.UserProperties {
+			userProperties[name] = value
+		}
+	}
+	publish.Properties.User = makeUserProperties(userProperties)
+	logrus.Debugf("Mqtt5Messenger.Publish: address=%s, qos=%d, retained=%v", address, publish.QoS, retained)
+
+	if publish.QoS == 0 {
+		messenger.updateMutex.Lock()
+		conn := messenger.conn
+		messenger.updateMutex.Unlock()
+		if conn == nil {
+			logrus.Warnf("Mqtt5Messenger.Publish: Unable to publish on %s. No connection with server.", address)
+			return errNotConnected
+		}
+		return messenger.write(conn, publish)
+	}
+	ack, err := messenger.request(func(packetID uint16) mqttpacket.Packet {
+		publish.PacketID = packetID
+		return publish
+	})
+	if err != nil {
+		logrus.Warnf("Mqtt5Messenger.Publish: Error during publish on address %s: %s", address, err)
+		return err
+	}
+	puback, isPuback := ack.(*mqttpacket.Puback)
+	if !isPuback {
+		return fmt.Errorf("Mqtt5Messenger.Publish: Unexpected response of type %d", ack.Type())
+	} else if puback.ReasonCode >= mqttpacket.ReasonUnspecifiedError {
+		err = &ReasonCodeError{Operation: "publish", Address: address,
+			ReasonCode: puback.ReasonCode, ReasonString: puback.Properties.ReasonString}
+		logrus.Warnf("Mqtt5Messenger.Publish: %s", err)
+		return err
+	}
+	return nil
+}
+
+// Respond to a request that was received with a response address
+//  request are the properties of the received request
+//  message with the response
+// Returns an error if the request has no response address or the response is rejected
+func (messenger *Mqtt5Messenger) Respond(request *PublicationProperties, message string) error {
+	if request == nil || request.ResponseAddress == "" {
+		return errors.New("Mqtt5Messenger.Respond: Request has no response address")
+	}
+	props := &PublicationProperties{CorrelationData: request.CorrelationData}
+	return messenger.PublishWithProperties(request.ResponseAddress, false, message, props)
+}
+
+// SetConnectionHandler sets the handler that is invoked when the connection state changes
+func (messenger *Mqtt5Messenger) SetConnectionHandler(handler func(state ConnectionState)) {
+	messenger.status.setHandler(handler)
+}
+
+// Subscribe to an address
+// Subscriptions are restored after the connection is re-established. If no connection exists
+// then the subscription is made when connected. A subscription rejected by the server is logged
+// and removed.
+//  address to subscribe to. This can contain wildcards.
+//  onMessage callback handler
+// Returns the handle to unsubscribe with
+func (messenger *Mqtt5Messenger) Subscribe(
+	address string, onMessage func(address string, message string) error) SubscriptionHandle {
+	handle, err := messenger.subscribe(address,
+		func(address string, message string, props *PublicationProperties) error {
+			return onMessage(address, message)
+		})
+	if err != nil {
+		logrus.Errorf("Mqtt5Messenger.Subscribe: %s", err)
+	}
+	return handle
+}
+
+// SubscribeWithProperties subscribes to an address with a handler that receives the
+// publication properties, for example to respond to a request.
+//  address to subscribe to. This can contain wildcards.
+//  onMessage callback handler
+// Returns the handle to unsubscribe with, or a ReasonCodeError if the server rejects the subscription
+func (messenger *Mqtt5Messenger) SubscribeWithProperties(address string,
+	onMessage func(address string, message string, props *PublicationProperties) error) (SubscriptionHandle, error) {
+	return messenger.subscribe(address, onMessage)
+}
+
+// Unsubscribe a subscription using the handle returned by Subscribe or SubscribeWithProperties.
+// The server subscription is removed when the address has no more handlers.
+func (messenger *Mqtt5Messenger) Unsubscribe(handle SubscriptionHandle) {
+	messenger.updateMutex.Lock()
+	var subscription *mqtt5Subscription
+	handlers := make([]mqtt5Handler, 0)
+	for _, sub := range messenger.subscriptions {
+		for index, handler := range sub.handlers {
+			if handler.handle == handle {
+				subscription = sub
+				handlers = append(handlers, sub.handlers[:index]...)
+				handlers = append(handlers, sub.handlers[index+1:]...)
+				break
+			}
+		}
+		if subscription != nil {
+			break
+		}
+	}
+	if subscription == nil {
+		messenger.updateMutex.Unlock()
+		return
+	}
+	subscription.handlers = handlers
+	if len(handlers) > 0 {
+		messenger.updateMutex.Unlock()
+		return
+	}
+	address := subscription.address
+	delete(messenger.subscriptions, address)
+	messenger.updateMutex.Unlock()
+
+	ack, err := messenger.request(func(packetID uint16) mqttpacket.Packet {
+		return &mqttpacket.Unsubscribe{PacketID: packetID, Topics: []string{address}}
+	})
+	if err == errNotConnected {
+		return
+	} else if err != nil {
+		logrus.Warnf("Mqtt5Messenger.Unsubscribe: Error unsubscribing from %s: %s", address, err)
+	} else if unsuback, isUnsuback := ack.(*mqttpacket.Unsuback); isUnsuback &&
+		len(unsuback.ReasonCodes) == 1 && unsuback.ReasonCodes[0] >= mqttpacket.ReasonUnspecifiedError {
+		logrus.Warnf("Mqtt5Messenger.Unsubscribe: Server rejected unsubscribe from %s: %s",
+			address, mqttpacket.ReasonText(unsuback.ReasonCodes[0]))
+	}
+}
+
+// closeConnection sends a normal disconnect and closes the current connection
+func (messenger *Mqtt5Messenger) closeConnection() {
+	messenger.updateMutex.Lock()
+	conn := messenger.conn
+	messenger.conn = nil
+	pending := messenger.pending
+	messenger.pending = make(map[uint16]chan mqttpacket.Packet)
+	messenger.updateMutex.Unlock()
+
+	for _, ackChan := range pending {
+		close(ackChan)
+	}
+	if conn != nil {
+		logrus.Warningf("Mqtt5Messenger.Disconnect: Closing connection")
+		_ = messenger.write(conn, &mqttpacket.Disconnect{ReasonCode: mqttpacket.ReasonSuccess})
+		conn.Close()
+	}
+}
+
+// connect to the server, start the connection loops and restore the subscriptions
+// Returns a ReasonCodeError if the server refuses the connection
+func (messenger *Mqtt5Messenger) connect() error {
+	conn, err := messenger.dial()
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(ConnectionTimeoutSec * time.Second))
+	err = mqttpacket.WritePacket(conn, messenger.connectPacket, mqttpacket.ProtocolVersion5)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	packet, err := mqttpacket.ReadPacket(reader, mqttpacket.ProtocolVersion5)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	connack, isConnack := packet.(*mqttpacket.Connack)
+	if !isConnack {
+		conn.Close()
+		return fmt.Errorf("Mqtt5Messenger.connect: Expected connack, got packet type %d", packet.Type())
+	} else if connack.ReasonCode >= mqttpacket.ReasonUnspecifiedError {
+		conn.Close()
+		return &ReasonCodeError{Operation: "connect", Address: messenger.config.Server,
+			ReasonCode: connack.ReasonCode, ReasonString: connack.Properties.ReasonString}
+	}
+	conn.SetDeadline(time.Time{})
+	keepAlive := time.Duration(messenger.connectPacket.KeepAlive) * time.Second
+	if connack.Properties.ServerKeepAlive != 0 {
+		keepAlive = time.Duration(connack.Properties.ServerKeepAlive) * time.Second
+	}
+
+	messenger.updateMutex.Lock()
+	if !messenger.isRunning {
+		messenger.updateMutex.Unlock()
+		conn.Close()
+		return errors.New("Mqtt5Messenger.connect: Disconnected while connecting")
+	}
+	messenger.conn = conn
+	messenger.subIDAvailable = connack.Properties.SubIDAvail == nil || *connack.Properties.SubIDAvail != 0
+	messenger.updateMutex.Unlock()
+	logrus.Warningf("Mqtt5Messenger.connect: Connected to server %s. ClientId=%s",
+		messenger.config.Server, messenger.config.ClientID)
+
+	incoming := make(chan *mqttpacket.Publish, incomingQueueSize)
+	go messenger.readLoop(conn, reader, incoming, keepAlive)
+	go messenger.dispatchLoop(conn, incoming)
+	if keepAlive > 0 {
+		go messenger.pingLoop(conn, keepAlive)
+	}
+	messenger.resubscribe()
+	messenger.status.set(ConnectionStateConnected)
+	return nil
+}
+
+// connectLoop attempts to connect until it succeeds, the server refuses the connection or done
+// is closed
+func (messenger *Mqtt5Messenger) connectLoop(brokerURL string, done chan struct{}) {
+	retryDelaySec := 1
+	for {
+		err := messenger.connect()
+		if err == nil {
+			return
+		} else if _, isRefused := err.(*ReasonCodeError); isRefused {
+			logrus.Errorf("Mqtt5Messenger.connectLoop: Server %s refused the connection: %s", brokerURL, err)
+			messenger.updateMutex.Lock()
+			messenger.isRunning = false
+			messenger.refusedErr = err
+			messenger.updateMutex.Unlock()
+			messenger.status.set(ConnectionStateDisconnected)
+			return
+		}
+		logrus.Errorf("Mqtt5Messenger.connectLoop: Connecting to server on %s failed: %s. retrying in %d seconds.",
+			brokerURL, err, retryDelaySec)
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Duration(retryDelaySec) * time.Second):
+		}
+		// slowly increment wait time
+		if retryDelaySec < 120 {
+			retryDelaySec++
+		}
+	}
+}
+
+// connectionLost closes the lost connection and reconnects while running
+func (messenger *Mqtt5Messenger) connectionLost(conn net.Conn, err error) {
+	messenger.updateMutex.Lock()
+	if messenger.conn != conn {
+		// the connection was closed intentionally
+		messenger.updateMutex.Unlock()
+		return
+	}
+	messenger.conn = nil
+	pending := messenger.pending
+	messenger.pending = make(map[uint16]chan mqttpacket.Packet)
+	done := messenger.connectDone
+	messenger.updateMutex.Unlock()
+
+	conn.Close()
+	for _, ackChan := range pending {
+		close(ackChan)
+	}
+	logrus.Warningf("Mqtt5Messenger.connectionLost: Disconnected from server %s: %s",
+		messenger.config.Server, err)
+	messenger.status.set(ConnectionStateLost)
+
+	retryDelaySec := 1
+	for messenger.running() {
+		err = messenger.connect()
+		if err == nil {
+			return
+		}
+		logrus.Errorf("Mqtt5Messenger.connectionLost: Reconnecting to server %s failed: %s. retrying in %d seconds.",
+			messenger.config.Server, err, retryDelaySec)
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Duration(retryDelaySec) * time.Second):
+		}
+		if retryDelaySec < 60 {
+			retryDelaySec++
+		}
+	}
+}
+
+// dial opens the network connection for the configured transport
+func (messenger *Mqtt5Messenger) dial() (net.Conn, error) {
+	config := messenger.config
+	brokerURL, err := MakeBrokerURL(config)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := MakeTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	parsedURL, _ := url.Parse(brokerURL)
+	dialer := &net.Dialer{Timeout: ConnectionTimeoutSec * time.Second}
+
+	switch parsedURL.Scheme {
+	case TransportTCP:
+		return dialer.Dial("tcp", parsedURL.Host)
+	case TransportTLS:
+		return tls.DialWithDialer(dialer, "tcp", parsedURL.Host, tlsConfig)
+	default:
+		origin := "http://" + parsedURL.Host
+		wsConfig, err := websocket.NewConfig(brokerURL, origin)
+		if err != nil {
+			return nil, err
+		}
+		wsConfig.Protocol = []string{"mqtt"}
+		wsConfig.TlsConfig = tlsConfig
+		wsConfig.Dialer = dialer
+		wsConn, err := websocket.DialConfig(wsConfig)
+		if err != nil {
+			return nil, err
+		}
+		wsConn.PayloadType = websocket.BinaryFrame
+		return wsConn, nil
+	}
+}
+
+// dispatchLoop passes received messages to the subscription handlers
+// This runs separate from the readLoop so that handlers can publish and wait for acknowledgement.
+// A QoS 1 message is acknowledged after its handlers complete, or with a quota exceeded reason
+// code when the dispatcher drops it.
+func (messenger *Mqtt5Messenger) dispatchLoop(conn net.Conn, incoming chan *mqttpacket.Publish) {
+	for publish := range incoming {
+		props := &PublicationProperties{
+			CorrelationData: publish.Properties.CorrelationData,
+			MessageExpiry:   publish.Properties.MessageExpiry,
+			ResponseAddress: publish.Properties.ResponseTopic,
+			UserProperties:  make(map[string]string),
+		}
+		for _, userProp := range publish.Properties.User {
+			props.UserProperties[userProp.Name] = userProp.Value
+		}
+		logrus.Infof("Mqtt5Messenger.onMessage. address=%s, retained=%v", publish.Topic, publish.Retain)
+		handlers := messenger.getHandlers(publish)
+		address := publish.Topic
+		message := string(publish.Payload)
+		received := publish
+		messenger.dispatcher.DispatchOrDrop(address, func() {
+			for _, handler := range handlers {
+				handler.handler(address, message, props)
+			}
+			messenger.acknowledgeReceived(conn, received, mqttpacket.ReasonSuccess)
+		}, func() {
+			messenger.acknowledgeReceived(conn, received, mqttpacket.ReasonQuotaExceeded)
+		})
+	}
+}
+
+// acknowledgeReceived sends the acknowledgement of a received QoS 1 message
+//  reasonCode is ReasonSuccess when the message is handled, or a failure code when it is dropped
+func (messenger *Mqtt5Messenger) acknowledgeReceived(conn net.Conn, publish *mqttpacket.Publish, reasonCode byte) {
+	if publish.QoS > 0 {
+		_ = messenger.write(conn, &mqttpacket.Puback{PacketID: publish.PacketID, ReasonCode: reasonCode})
+	}
+}
+
+// getHandlers returns the handlers of the subscriptions a message is received for
+// The server includes the identifiers of the matching subscriptions, if supported.
+func (messenger *Mqtt5Messenger) getHandlers(publish *mqttpacket.Publish) []mqtt5Handler {
+	messenger.updateMutex.Lock()
+	defer messenger.updateMutex.Unlock()
+	handlers := make([]mqtt5Handler, 0)
+	for _, subscription := range messenger.subscriptions {
+		match := false
+		if len(publish.Properties.SubscriptionIDs) > 0 {
+			for _, subID := range publish.Properties.SubscriptionIDs {
+				match = match || subID == subscription.id
+			}
+		} else {
+			match = mqttpacket.MatchTopic(publish.Topic, subscription.address)
+		}
+		if match {
+			handlers = append(handlers, subscription.handlers...)
+		}
+	}
+	return handlers
+}
+
+// pingLoop sends a ping at half the keep alive interval until the connection is replaced
+func (messenger *Mqtt5Messenger) pingLoop(conn net.Conn, keepAlive time.Duration) {
+	for {
+		time.Sleep(keepAlive / 2)
+		messenger.updateMutex.Lock()
+		isCurrent := messenger.conn == conn
+		messenger.updateMutex.Unlock()
+		if !isCurrent || messenger.write(conn, &mqttpacket.Pingreq{}) != nil {
+			return
+		}
+	}
+}
+
+// readLoop reads packets until the connection closes
+// The server must send a packet, at least a ping response, within 1.5 times the keep alive.
+// Received messages are dropped when the incoming queue is full, so the acknowledgements that
+// handlers wait for and the ping responses are read while the handlers are busy.
+func (messenger *Mqtt5Messenger) readLoop(
+	conn net.Conn, reader *bufio.Reader, incoming chan *mqttpacket.Publish, keepAlive time.Duration) {
+	defer close(incoming)
+	for {
+		if keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		}
+		packet, err := mqttpacket.ReadPacket(reader, mqttpacket.ProtocolVersion5)
+		if err != nil {
+			messenger.connectionLost(conn, err)
+			return
+		}
+		switch p := packet.(type) {
+		case *mqttpacket.Publish:
+			select {
+			case incoming <- p:
+			default:
+				logrus.Warningf("Mqtt5Messenger.readLoop: Incoming queue is full. Dropping message on %s", p.Topic)
+				messenger.dispatcher.countDropped(dispatchItem{})
+				messenger.acknowledgeReceived(conn, p, mqttpacket.ReasonQuotaExceeded)
+			}
+		case *mqttpacket.Puback:
+			messenger.acknowledge(p.PacketID, p)
+		case *mqttpacket.Suback:
+			messenger.acknowledge(p.PacketID, p)
+		case *mqttpacket.Unsuback:
+			messenger.acknowledge(p.PacketID, p)
+		case *mqttpacket.Pingresp:
+			// connection is alive
+		case *mqttpacket.Disconnect:
+			messenger.connectionLost(conn, &ReasonCodeError{Operation: "disconnect",
+				ReasonCode: p.ReasonCode, ReasonString: p.Properties.ReasonString})
+			return
+		default:
+			messenger.connectionLost(conn, fmt.Errorf("unexpected packet type %d", packet.Type()))
+			return
+		}
+	}
+}
+
+// acknowledge passes an acknowledgement to the request waiting for it
+func (messenger *Mqtt5Messenger) acknowledge(packetID uint16, ack mqttpacket.Packet) {
+	messenger.updateMutex.Lock()
+	ackChan := messenger.pending[packetID]
+	delete(messenger.pending, packetID)
+	messenger.updateMutex.Unlock()
+	if ackChan != nil {
+		ackChan <- ack
+	}
+}
+
+// request sends a packet that has a packet ID and waits for its acknowledgement
+//  makePacket returns the packet to send with the given packet ID
+// Returns errNotConnected without connection, or an error if the connection is lost or the
+// acknowledgement isn't received in time
+func (messenger *Mqtt5Messenger) request(makePacket func(packetID uint16) mqttpacket.Packet) (
+	ack mqttpacket.Packet, err error) {
+
+	messenger.updateMutex.Lock()
+	conn := messenger.conn
+	if conn == nil {
+		messenger.updateMutex.Unlock()
+		return nil, errNotConnected
+	}
+	packetID := messenger.lastPacketID
+	for {
+		packetID++
+		if _, inUse := messenger.pending[packetID]; packetID != 0 && !inUse {
+			break
+		}
+	}
+	messenger.lastPacketID = packetID
+	ackChan := make(chan mqttpacket.Packet, 1)
+	messenger.pending[packetID] = ackChan
+	messenger.updateMutex.Unlock()
+
+	err = messenger.write(conn, makePacket(packetID))
+	if err == nil {
+		select {
+		case received, isOpen := <-ackChan:
+			if isOpen {
+				return received, nil
+			}
+			err = errors.New("connection lost")
+		case <-time.After(ConnectionTimeoutSec * time.Second):
+			err = errors.New("timeout waiting for acknowledgement")
+		}
+	}
+	messenger.updateMutex.Lock()
+	if messenger.pending[packetID] == ackChan {
+		delete(messenger.pending, packetID)
+	}
+	messenger.updateMutex.Unlock()
+	return nil, err
+}
+
+// resubscribe to the addresses after establishing a connection
+func (messenger *Mqtt5Messenger) resubscribe() {
+	messenger.updateMutex.Lock()
+	subscriptions := make([]*mqtt5Subscription, 0, len(messenger.subscriptions))
+	for _, subscription := range messenger.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+	messenger.updateMutex.Unlock()
+
+	logrus.Infof("Mqtt5Messenger.resubscribe to %d addresses", len(subscriptions))
+	for _, subscription := range subscriptions {
+		err := messenger.sendSubscribe(subscription)
+		if err != nil {
+			logrus.Errorf("Mqtt5Messenger.resubscribe: %s", err)
+		}
+	}
+}
+
+// running returns true until Disconnect is called
+func (messenger *Mqtt5Messenger) running() bool {
+	messenger.updateMutex.Lock()
+	defer messenger.updateMutex.Unlock()
+	return messenger.isRunning
+}
+
+// sendSubscribe sends the subscription to the server and waits for the result
+// Returns nil without connection as the subscription is sent when connected
+func (messenger *Mqtt5Messenger) sendSubscribe(subscription *mqtt5Subscription) error {
+	qos := messenger.config.SubQos
+	if qos > 1 {
+		qos = 1
+	}
+	ack, err := messenger.request(func(packetID uint16) mqttpacket.Packet {
+		subscribe := &mqttpacket.Subscribe{
+			PacketID:      packetID,
+			Subscriptions: []mqttpacket.Subscription{{Topic: subscription.address, QoS: qos}},
+		}
+		messenger.updateMutex.Lock()
+		if messenger.subIDAvailable {
+			subscribe.Properties.SubscriptionIDs = []uint32{subscription.id}
+		}
+		messenger.updateMutex.Unlock()
+		return subscribe
+	})
+	if err == errNotConnected {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Error subscribing to %s: %s", subscription.address, err)
+	}
+	suback, isSuback := ack.(*mqttpacket.Suback)
+	if !isSuback || len(suback.ReasonCodes) != 1 {
+		return fmt.Errorf("Invalid response subscribing to %s", subscription.address)
+	} else if suback.ReasonCodes[0] >= mqttpacket.ReasonUnspecifiedError {
+		return &ReasonCodeError{Operation: "subscribe", Address: subscription.address,
+			ReasonCode: suback.ReasonCodes[0], ReasonString: suback.Properties.ReasonString}
+	}
+	return nil
+}
+
+// subscribe adds a handler and subscribes to the address on the server if it is a new address
+func (messenger *Mqtt5Messenger) subscribe(address string,
+	onMessage func(address string, message string, props *PublicationProperties) error) (SubscriptionHandle, error) {
+
+	logrus.Infof("Mqtt5Messenger.Subscribe: address %s, qos %d", address, messenger.config.SubQos)
+	messenger.updateMutex.Lock()
+	subscription := messenger.subscriptions[address]
+	isNew := subscription == nil
+	if isNew {
+		messenger.lastSubID++
+		subscription = &mqtt5Subscription{address: address, id: messenger.lastSubID}
+		messenger.subscriptions[address] = subscription
+	}
+	messenger.lastHandle++
+	handle := messenger.lastHandle
+	subscription.handlers = append(subscription.handlers, mqtt5Handler{handle: handle, handler: onMessage})
+	messenger.updateMutex.Unlock()
+	if !isNew {
+		return handle, nil
+	}
+	err := messenger.sendSubscribe(subscription)
+	if _, isRejected := err.(*ReasonCodeError); isRejected {
+		messenger.updateMutex.Lock()
+		if messenger.subscriptions[address] == subscription {
+			delete(messenger.subscriptions, address)
+		}
+		messenger.updateMutex.Unlock()
+	}
+	return handle, err
+}
+
+// write a packet to the connection
+func (messenger *Mqtt5Messenger) write(conn net.Conn, packet mqttpacket.Packet) error {
+	messenger.writeMutex.Lock()
+	defer messenger.writeMutex.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(ConnectionTimeoutSec * time.Second))
+	return mqttpacket.WritePacket(conn, packet, mqttpacket.ProtocolVersion5)
+}
+
+// makeUserProperties converts a map of user properties to a list sorted by name
+func makeUserProperties(properties map[string]string) []mqttpacket.UserProperty {
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	userProperties := make([]mqttpacket.UserProperty, 0, len(names))
+	for _, name := range names {
+		userProperties = append(userProperties, mqttpacket.UserProperty{Name: name, Value: properties[name]})
+	}
+	return userProperties
+}
+
+// messageMetadata returns the user properties that describe a message: the signature algorithm
+// of JWS messages, the content encryption of JWE messages and the sender if it is readable.
+func messageMetadata(message string) map[string]string {
+	metadata := make(map[string]string)
+	payload := []byte(message)
+	segments := strings.Split(message, ".")
+	header := struct {
+		Alg string `json:"alg"`
+		Enc string `json:"enc"`
+	}{}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(segments[0])
+	if err == nil && len(segments) > 1 && json.Unmarshal(headerJSON, &header) == nil {
+		if len(segments) == 5 && header.Enc != "" {
+			// JWE compact serialization: header.key.iv.ciphertext.tag
+			metadata[UserPropertyEncryption] = header.Enc
+			return metadata
+		} else if len(segments) == 3 && header.Alg != "" {
+			// JWS compact serialization: header.payload.signature
+			metadata[UserPropertySignature] = header.Alg
+			payload, _ = base64.RawURLEncoding.DecodeString(segments[1])
+		}
+	}
+	content := struct {
+		Sender string `json:"sender"`
+	}{}
+	if json.Unmarshal(payload, &content) == nil && content.Sender != "" {
+		metadata[UserPropertySender] = content.Sender
+	}
+	return metadata
+}
+
+// NewMqtt5Messenger creates a new MQTT 5 messenger instance
+func NewMqtt5Messenger(config *MessengerConfig) *Mqtt5Messenger {
+	messenger := &Mqtt5Messenger{
+		config:        config,
+		dispatcher:    NewDispatcher(config.DispatchWorkers, config.DispatchQueueSize, config.DispatchOverflow),
+		pending:       make(map[uint16]chan mqttpacket.Packet),
+		status:        newConnectionStatus(),
+		subscriptions: make(map[string]*mqtt5Subscription),
+		updateMutex:   &sync.Mutex{},
+		writeMutex:    &sync.Mutex{},
+	}
+	return messenger
+}
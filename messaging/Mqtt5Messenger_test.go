@@ -0,0 +1,336 @@
+package messaging_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/mqttpacket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testServer is a minimal MQTT 5 server that forwards publications to the subscribers of the
+// same connection and rejects addresses starting with 'denied'. Publications to addresses starting
+// with 'qos1' are forwarded with QoS 1.
+type testServer struct {
+	listener net.Listener
+	conns    []net.Conn
+	connects []*mqttpacket.Connect
+	pubacks  []*mqttpacket.Puback // acknowledgements received from the client
+	retained map[string]*mqttpacket.Publish
+	mutex    sync.Mutex
+}
+
+// countPubacks returns the nr of received acknowledgements with the given reason code
+func (server *testServer) countPubacks(reasonCode byte) int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	count := 0
+	for _, puback := range server.pubacks {
+		if puback.ReasonCode == reasonCode {
+			count++
+		}
+	}
+	return count
+}
+
+func startTestServer(t *testing.T) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &testServer{listener: listener, retained: make(map[string]*mqttpacket.Publish)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *testServer) port() uint16 {
+	return uint16(server.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// dropConnections closes all connections without disconnect
+func (server *testServer) dropConnections() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, conn := range server.conns {
+		conn.Close()
+	}
+}
+
+func (server *testServer) serve(conn net.Conn) {
+	version := mqttpacket.ProtocolVersion5
+	reader := bufio.NewReader(conn)
+	subscriptions := make(map[string]uint32)
+	packetID := uint16(0)
+	defer conn.Close()
+
+	packet, err := mqttpacket.ReadPacket(reader, version)
+	if err != nil {
+		return
+	}
+	connect := packet.(*mqttpacket.Connect)
+	server.mutex.Lock()
+	server.conns = append(server.conns, conn)
+	server.connects = append(server.connects, connect)
+	server.mutex.Unlock()
+	if connect.Username == "baduser" {
+		mqttpacket.WritePacket(conn, &mqttpacket.Connack{ReasonCode: mqttpacket.ReasonBadUsernameOrPassword}, version)
+		return
+	}
+	mqttpacket.WritePacket(conn, &mqttpacket.Connack{}, version)
+
+	for {
+		packet, err = mqttpacket.ReadPacket(reader, version)
+		if err != nil {
+			return
+		}
+		switch p := packet.(type) {
+		case *mqttpacket.Subscribe:
+			suback := &mqttpacket.Suback{PacketID: p.PacketID}
+			for _, subscription := range p.Subscriptions {
+				if strings.HasPrefix(subscription.Topic, "denied") {
+					suback.ReasonCodes = append(suback.ReasonCodes, mqttpacket.ReasonNotAuthorized)
+					continue
+				}
+				subscriptions[subscription.Topic] = p.Properties.SubscriptionIDs[0]
+				suback.ReasonCodes = append(suback.ReasonCodes, subscription.QoS)
+			}
+			mqttpacket.WritePacket(conn, suback, version)
+			for topic, publish := range server.retained {
+				if mqttpacket.MatchTopic(topic, p.Subscriptions[0].Topic) {
+					forward := *publish
+					forward.Properties.SubscriptionIDs = p.Properties.SubscriptionIDs
+					mqttpacket.WritePacket(conn, &forward, version)
+				}
+			}
+		case *mqttpacket.Unsubscribe:
+			for _, topic := range p.Topics {
+				delete(subscriptions, topic)
+			}
+			mqttpacket.WritePacket(conn, &mqttpacket.Unsuback{PacketID: p.PacketID, ReasonCodes: []byte{0}}, version)
+		case *mqttpacket.Publish:
+			if strings.HasPrefix(p.Topic, "denied") {
+				mqttpacket.WritePacket(conn, &mqttpacket.Puback{PacketID: p.PacketID,
+					ReasonCode: mqttpacket.ReasonNotAuthorized, Properties: mqttpacket.Properties{ReasonString: "test"}}, version)
+				continue
+			}
+			if p.QoS > 0 {
+				mqttpacket.WritePacket(conn, &mqttpacket.Puback{PacketID: p.PacketID}, version)
+			}
+			forward := *p
+			forward.QoS = 0
+			forward.Retain = false
+			if strings.HasPrefix(p.Topic, "qos1") {
+				packetID++
+				forward.QoS = 1
+				forward.PacketID = packetID
+			}
+			for topic, subID := range subscriptions {
+				if mqttpacket.MatchTopic(p.Topic, topic) {
+					forward.Properties.SubscriptionIDs = append(forward.Properties.SubscriptionIDs, subID)
+				}
+			}
+			if p.Retain {
+				server.retained[p.Topic] = &forward
+			}
+			if len(forward.Properties.SubscriptionIDs) > 0 {
+				mqttpacket.WritePacket(conn, &forward, version)
+			}
+		case *mqttpacket.Puback:
+			server.mutex.Lock()
+			server.pubacks = append(server.pubacks, p)
+			server.mutex.Unlock()
+		case *mqttpacket.Pingreq:
+			mqttpacket.WritePacket(conn, &mqttpacket.Pingresp{}, version)
+		case *mqttpacket.Disconnect:
+			return
+		}
+	}
+}
+
+func TestMqtt5PublishSubscribe(t *testing.T) {
+	const node1Addr = "domain1/publisher1/node1/$node"
+	const valueAddr = "domain1/publisher1/node1/temperature/0/$latest"
+	server := startTestServer(t)
+	defer server.listener.Close()
+
+	config := &messaging.MessengerConfig{Messenger: "MQTT5Messenger", Server: "127.0.0.1", Port: server.port(),
+		Transport: messaging.TransportTCP, PubQos: 1, SubQos: 1, ValueExpiry: 600, Login: "user1"}
+	messenger := messaging.NewMessenger(config).(*messaging.Mqtt5Messenger)
+	err := messenger.Connect(context.Background(), "domain1/publisher1/$state", "lost")
+	require.NoError(t, err)
+	defer messenger.Disconnect()
+	require.Equal(t, 1, len(server.connects))
+	assert.Equal(t, mqttpacket.ProtocolVersion5, server.connects[0].ProtocolVersion)
+	assert.Equal(t, "user1", server.connects[0].Username)
+	assert.Equal(t, "lost", string(server.connects[0].Will.Payload))
+
+	received := make(chan *messaging.PublicationProperties, 10)
+	var rxMessage string
+	handler := func(address string, message string, props *messaging.PublicationProperties) error {
+		rxMessage = message
+		received <- props
+		return nil
+	}
+	nodeHandle, err := messenger.SubscribeWithProperties("domain1/+/+/$node", handler)
+	require.NoError(t, err)
+
+	// a signed message carries its signature algorithm and sender
+	privKey := messaging.CreateAsymKeys()
+	signedMessage, err := messaging.CreateJWSSignature(`{"address":"`+node1Addr+`","sender":"domain1/publisher1/$identity"}`, privKey)
+	require.NoError(t, err)
+	err = messenger.Publish(node1Addr, false, signedMessage)
+	require.NoError(t, err)
+	props := <-received
+	assert.Equal(t, signedMessage, rxMessage)
+	assert.Equal(t, "ES256", props.UserProperties[messaging.UserPropertySignature])
+	assert.Equal(t, "domain1/publisher1/$identity", props.UserProperties[messaging.UserPropertySender])
+	assert.Equal(t, uint32(0), props.MessageExpiry)
+
+	// retained values expire
+	received2 := make(chan *messaging.PublicationProperties, 10)
+	err = messenger.Publish(valueAddr, true, "21.5")
+	require.NoError(t, err)
+	_, err = messenger.SubscribeWithProperties(valueAddr, func(address string, message string, props *messaging.PublicationProperties) error {
+		received2 <- props
+		return nil
+	})
+	require.NoError(t, err)
+	props = <-received2
+	assert.Equal(t, uint32(600), props.MessageExpiry)
+	assert.Equal(t, 0, len(received), "Message for the other subscription")
+
+	// respond to a request using the response address and correlation data
+	request := &messaging.PublicationProperties{ResponseAddress: node1Addr, CorrelationData: []byte("request1")}
+	err = messenger.Respond(request, `{"status":"ok"}`)
+	require.NoError(t, err)
+	props = <-received
+	assert.Equal(t, []byte("request1"), props.CorrelationData)
+	err = messenger.Respond(&messaging.PublicationProperties{}, "nowhere")
+	assert.Error(t, err)
+
+	// rejections are reported with their reason code
+	err = messenger.Publish("denied/publisher1/node1/$node", false, "hello")
+	require.Error(t, err)
+	reasonErr, isReasonErr := err.(*messaging.ReasonCodeError)
+	require.True(t, isReasonErr)
+	assert.Equal(t, mqttpacket.ReasonNotAuthorized, reasonErr.ReasonCode)
+	assert.Contains(t, err.Error(), "not authorized (test)")
+	_, err = messenger.SubscribeWithProperties("denied/#", handler)
+	require.Error(t, err)
+	assert.IsType(t, &messaging.ReasonCodeError{}, err)
+
+	// subscriptions are restored after the connection is lost
+	server.dropConnections()
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 30 && messenger.Publish(node1Addr, false, "reconnected") != nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	select {
+	case <-received:
+		assert.Equal(t, "reconnected", rxMessage)
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "No message after reconnect")
+	}
+
+	// unsubscribed messages are no longer received
+	messenger.Unsubscribe(nodeHandle)
+	err = messenger.Publish(node1Addr, false, "unsubscribed")
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, len(received))
+
+	// publish after disconnect fails
+	messenger.Disconnect()
+	err = messenger.Publish(node1Addr, false, "disconnected")
+	assert.Error(t, err)
+}
+
+func TestMqtt5ConnectRefused(t *testing.T) {
+	server := startTestServer(t)
+	defer server.listener.Close()
+
+	config := &messaging.MessengerConfig{Server: "127.0.0.1", Port: server.port(),
+		Transport: messaging.TransportTCP, Login: "baduser"}
+	messenger := messaging.NewMqtt5Messenger(config)
+	err := messenger.Connect(context.Background(), "", "")
+	require.Error(t, err)
+	reasonErr, isReasonErr := err.(*messaging.ReasonCodeError)
+	require.True(t, isReasonErr)
+	assert.Equal(t, mqttpacket.ReasonBadUsernameOrPassword, reasonErr.ReasonCode)
+
+	config.Transport = "invalid"
+	err = messenger.Connect(context.Background(), "", "")
+	assert.Error(t, err)
+}
+
+// TestMqtt5AckAfterHandler acknowledges messages after they are handled and drops messages
+// instead of blocking the acknowledgements that handlers wait for
+func TestMqtt5AckAfterHandler(t *testing.T) {
+	const slowAddr = "qos1/publisher1/node1/$event"
+	const msgCount = 200
+	server := startTestServer(t)
+	defer server.listener.Close()
+
+	config := &messaging.MessengerConfig{Server: "127.0.0.1", Port: server.port(),
+		Transport: messaging.TransportTCP, PubQos: 1, SubQos: 1, DispatchWorkers: 1, DispatchQueueSize: 1}
+	messenger := messaging.NewMqtt5Messenger(config)
+	err := messenger.Connect(context.Background(), "", "")
+	require.NoError(t, err)
+	defer messenger.Disconnect()
+
+	release := make(chan bool)
+	replyErr := make(chan error, 1)
+	handled := 0
+	handledMutex := sync.Mutex{}
+	_, err = messenger.SubscribeWithProperties(slowAddr, func(address string, message string, props *messaging.PublicationProperties) error {
+		if message == "0" {
+			<-release
+			replyErr <- messenger.Publish("reply/publisher1/node1/$event", false, "reply")
+		}
+		handledMutex.Lock()
+		handled++
+		handledMutex.Unlock()
+		return nil
+	})
+	require.NoError(t, err)
+
+	// publications are acknowledged by the server while the handler is busy
+	for i := 0; i < msgCount; i++ {
+		err = messenger.Publish(slowAddr, false, strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, server.countPubacks(mqttpacket.ReasonSuccess), "Acknowledged before handled")
+	assert.Greater(t, server.countPubacks(mqttpacket.ReasonQuotaExceeded), 0)
+
+	// the handler can publish and receive the acknowledgement
+	close(release)
+	select {
+	case err = <-replyErr:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Handler publication is blocked")
+	}
+	time.Sleep(100 * time.Millisecond)
+	handledMutex.Lock()
+	handledCount := handled
+	handledMutex.Unlock()
+	assert.Equal(t, handledCount, server.countPubacks(mqttpacket.ReasonSuccess))
+	assert.Equal(t, msgCount, server.countPubacks(mqttpacket.ReasonSuccess)+
+		server.countPubacks(mqttpacket.ReasonQuotaExceeded))
+	assert.Equal(t, uint64(msgCount-handledCount), messenger.DispatchMetrics().Dropped)
+}
@@ -2,12 +2,14 @@
 package messaging
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,60 +21,95 @@ import (
 // ConnectionTimeoutSec constant with connection and reconnection timeouts
 const ConnectionTimeoutSec = 20
 
-// TLSPort is the default secure port to connect to mqtt
-const TLSPort = 8883
+// Transports to connect to the MQTT broker with
+const (
+	TransportTCP = "tcp" // plain TCP, intended for local development brokers
+	TransportTLS = "tls" // TLS over TCP, the default
+	TransportWS  = "ws"  // websocket
+	TransportWSS = "wss" // websocket over TLS
+)
+
+// Default ports of the transports
+const (
+	TCPPort = 1883 // default port of plain TCP connections
+	TLSPort = 8883 // default secure port to connect to mqtt
+	WSPort  = 80   // default port of websocket connections
+	WSSPort = 443  // default port of secure websocket connections
+)
+
+// DefaultCAFile is the CA certificate to verify the server with when no CA file is configured.
+// This is the CA that ZCAS installs for mosquitto. If it doesn't exist the system CAs are used.
+var DefaultCAFile = "/etc/mosquitto/certs/zcas_ca.crt"
 
 // MqttMessenger that implements IMessenger
 type MqttMessenger struct {
-	config              *MessengerConfig    // connect information
-	isRunning           bool                // listen for messages while running
-	pahoClient          pahomqtt.Client     // Paho MQTT Client
-	subscriptions       []TopicSubscription // list of TopicSubscription for re-subscribing after reconnect
-	tlsVerifyServerCert bool                // verify the server certificate, this requires a Root CA signed cert
-	tlsCACertFile       string              // path to CA certificate
-	updateMutex         *sync.Mutex         // mutex for async updating of subscriptions
+	config        *MessengerConfig    // connect information
+	connectDone   chan struct{}       // closed to end the initial connection attempts
+	dispatcher    *Dispatcher         // passes received messages to the subscription handlers
+	flushMutex    *sync.Mutex         // mutex to flush the publish queue one at a time
+	isRunning     bool                // listen for messages while running
+	lastHandle    SubscriptionHandle  // handle of the last subscription
+	pahoClient    pahomqtt.Client     // Paho MQTT Client
+	publishQueue  *PublishQueue       // publications waiting for the connection to be restored
+	status        *connectionStatus   // connection state reported to the connection handler
+	subscriptions []TopicSubscription // list of TopicSubscription for re-subscribing after reconnect
+	updateMutex   *sync.Mutex         // mutex for async updating of subscriptions
 }
 
 // TopicSubscription holds subscriptions to restore after disconnect
 type TopicSubscription struct {
 	address string
+	handle  SubscriptionHandle // handle to unsubscribe with
 	handler func(address string, message string) error
-	token   pahomqtt.Token // for debugging
-	client  *MqttMessenger //
 }
 
 // Connect to the MQTT broker and set the LWT
 // If a previous connection exists then it is disconnected first.
 // This publishes the LWT on the address baseTopic/nodeHWID/$state.
+// This waits until connected or ctx is done. Connection attempts continue in the background until
+// Disconnect is called. Once connected, paho restores a lost connection.
+// @param ctx to limit the time to wait for the connection
 // @param lastWillTopic optional last will and testament address for publishing device state on accidental disconnect.
 //                       Use "" to ignore LWT feature.
 // @param lastWillValue to use as the last will
-func (messenger *MqttMessenger) Connect(lastWillAddress string, lastWillValue string) error {
+func (messenger *MqttMessenger) Connect(ctx context.Context, lastWillAddress string, lastWillValue string) error {
 	config := messenger.config
 
+	brokerURL, err := MakeBrokerURL(config)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := MakeTLSConfig(config)
+	if err != nil {
+		return err
+	}
+
 	// close existing connection
-	if messenger.pahoClient != nil && messenger.pahoClient.IsConnected() {
-		messenger.pahoClient.Disconnect(10 * ConnectionTimeoutSec)
+	messenger.updateMutex.Lock()
+	existingClient := messenger.pahoClient
+	if messenger.connectDone != nil {
+		close(messenger.connectDone)
+		messenger.connectDone = nil
+	}
+	messenger.updateMutex.Unlock()
+	if existingClient != nil && existingClient.IsConnected() {
+		existingClient.Disconnect(10 * ConnectionTimeoutSec)
 	}
 
 	// set config defaults
-	// ClientID defaults to hostname-secondsSinceEpoc
+	// ClientID defaults to hostname-nanosecondsSinceEpoc, unique for clients started in the same second
 	hostName, _ := os.Hostname()
 	if config.ClientID == "" {
-		config.ClientID = fmt.Sprintf("%s-%d", hostName, time.Now().Unix())
-	}
-
-	// Connect using TLS
-	port := config.Port
-	if port == 0 {
-		port = TLSPort
+		config.ClientID = fmt.Sprintf("%s-%d", hostName, time.Now().UnixNano())
 	}
 
-	brokerURL := fmt.Sprintf("tls://%s:%d/", config.Server, port) // tcp://host:1883 ws://host:1883 tls://host:8883, tcps://awshost:8883/mqtt
-	// brokerURL := fmt.Sprintf("tls://mqtt.eclipse.org:8883/")
 	opts := pahomqtt.NewClientOptions()
 	opts.AddBroker(brokerURL)
 	opts.SetClientID(config.ClientID)
+	if config.Login != "" {
+		opts.SetUsername(config.Login)
+		opts.SetPassword(config.Password)
+	}
 	opts.SetAutoReconnect(true)
 	opts.SetConnectTimeout(10 * time.Second)
 	opts.SetMaxReconnectInterval(60 * time.Second) // max wait 1 minute for a reconnect
@@ -87,98 +124,114 @@ func (messenger *MqttMessenger) Connect(lastWillAddress string, lastWillValue st
 			brokerURL, client.IsConnected(), config.ClientID)
 		// Subscribe to addresss already registered by the app on connect or reconnect
 		messenger.resubscribe()
+		// Send the publications queued while disconnected
+		go messenger.flushQueue()
+		messenger.status.set(ConnectionStateConnected)
 	})
 	opts.SetConnectionLostHandler(func(client pahomqtt.Client, err error) {
 		log.Warningf("MqttMessenger.onConnectionLost: Disconnected from server %s. Error %s, ClientId=%s",
 			brokerURL, err, config.ClientID)
+		messenger.status.set(ConnectionStateLost)
 	})
 	if lastWillAddress != "" {
 		opts.SetWill(lastWillAddress, lastWillValue, 1, false)
 	}
-	// Use TLS if a CA certificate is given
-	var rootCA *x509.CertPool
-	if messenger.tlsCACertFile != "" {
-		rootCA = x509.NewCertPool()
-		caFile, err := ioutil.ReadFile(messenger.tlsCACertFile)
-		if err != nil {
-			logrus.Errorf("MqttMessenger.Connect: Unable to read CA certificate chain: %s", err)
-		}
-		rootCA.AppendCertsFromPEM([]byte(caFile))
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
 	}
-	opts.SetTLSConfig(&tls.Config{
-		InsecureSkipVerify: !messenger.tlsVerifyServerCert,
-		RootCAs:            rootCA, // include the zcas cert in the host root ca set
-		// https://opium.io/blog/mqtt-in-go/
-		ServerName: "", // hostname on the server certificate. How to get this?
-	})
 
 	logrus.Infof("MqttMessenger.Connect: Connecting to MQTT server: %s with clientID %s"+
 		" AutoReconnect and CleanSession are set.",
 		brokerURL, config.ClientID)
 
 	// FIXME: PahoMqtt disconnects when sending a lot of messages, like on startup of some adapters.
-	messenger.pahoClient = pahomqtt.NewClient(opts)
-
+	pahoClient := pahomqtt.NewClient(opts)
+	connectDone := make(chan struct{})
+	messenger.status.set(ConnectionStateConnecting)
+	messenger.updateMutex.Lock()
+	messenger.pahoClient = pahoClient
+	messenger.connectDone = connectDone
 	// start listening for messages
 	messenger.isRunning = true
+	messenger.updateMutex.Unlock()
+	messenger.dispatcher.Start()
 	//go messenger.messageChanLoop()
 
-	// Auto reconnect doesn't work for initial attempt: https://github.com/eclipse/paho.mqtt.golang/issues/77
-	retryDelaySec := 1
-	for {
-		token := messenger.pahoClient.Connect()
-		token.Wait()
-		// Wait to give connection time to settle. Sending a lot of messages causes the connection to fail. Bug?
-		time.Sleep(1000 * time.Millisecond)
-		err := token.Error()
-		if err == nil {
-			break
-		}
-
-		logrus.Errorf("MqttMessenger.Connect: Connecting to broker on %s failed: %s. retrying in %d seconds.",
-			brokerURL, token.Error(), retryDelaySec)
-		time.Sleep(time.Duration(retryDelaySec) * time.Second)
-		// slowly increment wait time
-		if retryDelaySec < 120 {
-			retryDelaySec++
-		}
+	go messenger.connectLoop(pahoClient, brokerURL, connectDone)
+	err = messenger.status.wait(ctx)
+	if err != nil {
+		logrus.Warningf("MqttMessenger.Connect: Not connected to %s: %s", brokerURL, err)
+		return fmt.Errorf("MqttMessenger.Connect: Not connected to %s: %s", brokerURL, err)
 	}
 	return nil
 }
 
+// ConnectionState returns the current state of the connection with the broker
+func (messenger *MqttMessenger) ConnectionState() ConnectionState {
+	return messenger.status.get()
+}
+
 // Disconnect from the MQTT broker and unsubscribe from all addresss and set
 // device state to disconnected
 func (messenger *MqttMessenger) Disconnect() {
 	messenger.updateMutex.Lock()
 	messenger.isRunning = false
+	pahoClient := messenger.pahoClient
+	if messenger.connectDone != nil {
+		close(messenger.connectDone)
+		messenger.connectDone = nil
+	}
 	messenger.updateMutex.Unlock()
 
-	if messenger.pahoClient != nil {
+	if pahoClient != nil {
 		logrus.Warningf("MqttMessenger.Disconnect: Set state to disconnected and close connection")
 		//messenger.publish("$state", "disconnected")
 		time.Sleep(time.Second / 10) // Disconnect doesn't seem to wait for all messages. A small delay ahead helps
-		messenger.pahoClient.Disconnect(10 * ConnectionTimeoutSec * 1000)
+		pahoClient.Disconnect(10 * ConnectionTimeoutSec * 1000)
+		messenger.updateMutex.Lock()
 		messenger.pahoClient = nil
+		messenger.updateMutex.Unlock()
 
 		messenger.subscriptions = nil
 		//close(messenger.messageChannel)     // end the message handler loop
 	}
+	messenger.dispatcher.Stop()
+	if err := messenger.publishQueue.Save(); err != nil {
+		logrus.Errorf("MqttMessenger.Disconnect: %s", err)
+	}
+	messenger.status.set(ConnectionStateDisconnected)
 }
 
 // Publish value using the device address as base
 // address to publish on.
 // retained to have the broker retain the address value
 // payload is converted to string if it isn't a byte array, as Paho doesn't handle int and bool
+// While the connection is lost the publication is queued and sent after the connection is restored.
+// Returns an error if the messenger isn't connected or the queue cannot be persisted
 func (messenger *MqttMessenger) Publish(address string, retained bool, message string) error {
 	var err error
 
-	if messenger.pahoClient == nil || !messenger.pahoClient.IsConnected() {
+	messenger.updateMutex.Lock()
+	pahoClient := messenger.pahoClient
+	isRunning := messenger.isRunning
+	messenger.updateMutex.Unlock()
+	if pahoClient == nil || !isRunning {
 		logrus.Warnf("MqttMessenger.Publish: Unable to publish. No connection with server.")
 		return errors.New("no connection with server")
 	}
+	// Paho reports connected while reconnecting and drops qos 0 messages so check the connection itself.
+	// Publications are also queued while the queue isn't empty to keep them in order.
+	if !pahoClient.IsConnectionOpen() || messenger.publishQueue.Len() > 0 {
+		logrus.Infof("MqttMessenger.Publish: Not connected. Queuing publication on address %s", address)
+		messenger.publishQueue.Add(address, retained, message)
+		if pahoClient.IsConnectionOpen() {
+			go messenger.flushQueue()
+		}
+		return nil
+	}
 	logrus.Debugf("MqttMessenger.Publish []byte: address=%s, qos=%d, retained=%v",
 		address, messenger.config.PubQos, retained)
-	token := messenger.pahoClient.Publish(address, messenger.config.PubQos, retained, message)
+	token := pahoClient.Publish(address, messenger.config.PubQos, retained, message)
 
 	err = token.Error()
 	if err != nil {
@@ -208,19 +261,110 @@ func (messenger *MqttMessenger) PublishRaw(address string, retained bool, messag
 	return err
 }
 
-// Wrapper for message handling.
-// Use a channel to handle the message in a gorouting.
-// This fixes a problem with losing context in callbacks. Not sure what is going on though.
-func (subscription *TopicSubscription) onMessage(c pahomqtt.Client, msg pahomqtt.Message) {
-	// NOTE: Scope in this callback is not always retained. Pipe notifications through a channel and handle in goroutine
-	address := msg.Topic()
-	rawPayload := string(msg.Payload())
-
-	logrus.Infof("MqttMessenger.onMessage. address=%s, subscription=%s, retained=%v",
-		address, subscription.address, msg.Retained())
-	subscription.handler(address, rawPayload)
-	//message := &IncomingMessage{msgTopic, payload, subscription}
-	//subscription.client.messageChannel <- message
+// SetConnectionHandler sets the handler that is invoked when the connection state changes
+func (messenger *MqttMessenger) SetConnectionHandler(handler func(state ConnectionState)) {
+	messenger.status.setHandler(handler)
+}
+
+// DispatchMetrics returns the counters of received messages passed to the subscription handlers
+func (messenger *MqttMessenger) DispatchMetrics() DispatchMetrics {
+	return messenger.dispatcher.Metrics()
+}
+
+// QueueDepth returns the number of publications waiting for the connection to be restored
+func (messenger *MqttMessenger) QueueDepth() int {
+	return messenger.publishQueue.Len()
+}
+
+// connectLoop attempts the initial connection until it succeeds or done is closed
+// Auto reconnect doesn't work for initial attempt: https://github.com/eclipse/paho.mqtt.golang/issues/77
+func (messenger *MqttMessenger) connectLoop(pahoClient pahomqtt.Client, brokerURL string, done chan struct{}) {
+	retryDelaySec := 1
+	for {
+		token := pahoClient.Connect()
+		token.Wait()
+		err := token.Error()
+		if err == nil {
+			break
+		}
+
+		logrus.Errorf("MqttMessenger.connectLoop: Connecting to broker on %s failed: %s. retrying in %d seconds.",
+			brokerURL, err, retryDelaySec)
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Duration(retryDelaySec) * time.Second):
+		}
+		// slowly increment wait time
+		if retryDelaySec < 120 {
+			retryDelaySec++
+		}
+	}
+	select {
+	case <-done:
+		// disconnected while connecting
+		pahoClient.Disconnect(0)
+	default:
+	}
+}
+
+// flushQueue publishes the queued publications in order while the connection is open.
+// Publications that are not acknowledged in time remain queued for the next attempt.
+func (messenger *MqttMessenger) flushQueue() {
+	messenger.flushMutex.Lock()
+	defer messenger.flushMutex.Unlock()
+
+	err := messenger.publishQueue.Flush(func(address string, retained bool, message string) error {
+		messenger.updateMutex.Lock()
+		pahoClient := messenger.pahoClient
+		messenger.updateMutex.Unlock()
+		if pahoClient == nil || !pahoClient.IsConnectionOpen() {
+			return errors.New("no connection with server")
+		}
+		token := pahoClient.Publish(address, messenger.config.PubQos, retained, message)
+		if !token.WaitTimeout(ConnectionTimeoutSec * time.Second) {
+			return errors.New("publication not acknowledged in time")
+		}
+		return token.Error()
+	})
+	if err != nil {
+		logrus.Warnf("MqttMessenger.flushQueue: %d publications remain queued: %s", messenger.publishQueue.Len(), err)
+	}
+}
+
+// hasSubscription returns true if the address has a subscription. The caller must hold the mutex.
+func (messenger *MqttMessenger) hasSubscription(address string) bool {
+	for _, subscription := range messenger.subscriptions {
+		if subscription.address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// onMessage returns the paho message handler of a subscribed address. Paho supports a single
+// handler per address so this passes the message to all handlers of the address.
+func (messenger *MqttMessenger) onMessage(subscriptionAddress string) pahomqtt.MessageHandler {
+	return func(c pahomqtt.Client, msg pahomqtt.Message) {
+		address := msg.Topic()
+		rawPayload := string(msg.Payload())
+
+		logrus.Infof("MqttMessenger.onMessage. address=%s, subscription=%s, retained=%v",
+			address, subscriptionAddress, msg.Retained())
+		messenger.updateMutex.Lock()
+		handlers := make([]func(address string, message string) error, 0)
+		for _, subscription := range messenger.subscriptions {
+			if subscription.address == subscriptionAddress {
+				handlers = append(handlers, subscription.handler)
+			}
+		}
+		messenger.updateMutex.Unlock()
+		messenger.dispatcher.Dispatch(address, func() {
+			for _, handler := range handlers {
+				handler(address, rawPayload)
+			}
+		})
+	}
 }
 
 // subscribe to addresss after establishing connection
@@ -230,22 +374,26 @@ func (subscription *TopicSubscription) onMessage(c pahomqtt.Client, msg pahomqtt
 func (messenger *MqttMessenger) resubscribe() {
 	// prevent simultaneous access to subscriptions
 	messenger.updateMutex.Lock()
-	defer messenger.updateMutex.Unlock()
-
-	logrus.Infof("MqttMessenger.resubscribe to %d addresess", len(messenger.subscriptions))
+	pahoClient := messenger.pahoClient
+	// paho subscribes once per address
+	addresses := make([]string, 0)
+	isAdded := make(map[string]bool)
 	for _, subscription := range messenger.subscriptions {
-		// clear existing subscription
-		messenger.pahoClient.Unsubscribe(subscription.address)
-
-		logrus.Infof("MqttMessenger.resubscribe: address %s", subscription.address)
-		// create a new variable to hold the subscription in the closure
-		newSubscr := subscription
-		token := messenger.pahoClient.Subscribe(newSubscr.address, messenger.config.PubQos, newSubscr.onMessage)
-		//token := messenger.pahoClient.Subscribe(newSubscr.address, newSubscr.qos, func (c pahomqtt.Client, msg pahomqtt.Message) {
-		//logrus.Infof("mqtt.resubscribe.onMessage: address %s, subscription %s", msg.Topic(), newSubscr.address)
-		//newSubscr.onMessage(c, msg)
-		//})
-		newSubscr.token = token
+		if !isAdded[subscription.address] {
+			isAdded[subscription.address] = true
+			addresses = append(addresses, subscription.address)
+		}
+	}
+	messenger.updateMutex.Unlock()
+
+	logrus.Infof("MqttMessenger.resubscribe to %d addresess", len(addresses))
+	for _, address := range addresses {
+		// clear existing subscription. Paho doesn't keep the order of unsubscribe and subscribe requests
+		// so wait for it to complete.
+		pahoClient.Unsubscribe(address).WaitTimeout(ConnectionTimeoutSec * time.Second)
+
+		logrus.Infof("MqttMessenger.resubscribe: address %s", address)
+		pahoClient.Subscribe(address, messenger.config.SubQos, messenger.onMessage(address))
 	}
 	logrus.Infof("MqttMessenger.resubscribe complete")
 }
@@ -254,63 +402,140 @@ func (messenger *MqttMessenger) resubscribe() {
 // Subscribers are automatically resubscribed after the connection is restored
 // If no connection exists, then subscriptions are stored until a connection is established.
 // address: address to subscribe to. This can contain wildcards.
-// qos: Quality of service for subscription: 0, 1, 2
 // handler: callback handler.
+// Returns the handle to unsubscribe with
 func (messenger *MqttMessenger) Subscribe(
-	address string, onMessage func(address string, message string) error) {
+	address string, onMessage func(address string, message string) error) SubscriptionHandle {
+
+	messenger.updateMutex.Lock()
+	isNewAddress := !messenger.hasSubscription(address)
+	messenger.lastHandle++
 	subscription := TopicSubscription{
 		address: address,
+		handle:  messenger.lastHandle,
 		handler: onMessage,
-		token:   nil,
-		client:  messenger,
 	}
-	messenger.updateMutex.Lock()
-	defer messenger.updateMutex.Unlock()
 	messenger.subscriptions = append(messenger.subscriptions, subscription)
+	pahoClient := messenger.pahoClient
+	messenger.updateMutex.Unlock()
 
 	logrus.Infof("MqttMessenger.Subscribe: address %s, qos %d", address, messenger.config.SubQos)
-	//messenger.pahoClient.Subscribe(address, qos, addressSubscription.onMessage) //func(c pahomqtt.Client, msg pahomqtt.Message) {
-	if messenger.pahoClient != nil {
-		messenger.pahoClient.Subscribe(address, messenger.config.SubQos, subscription.onMessage) //func(c pahomqtt.Client, msg pahomqtt.Message) {
+	if isNewAddress && pahoClient != nil {
+		// wait for the subscription as paho can send a following publication first
+		pahoClient.Subscribe(address, messenger.config.SubQos, messenger.onMessage(address)).
+			WaitTimeout(ConnectionTimeoutSec * time.Second)
 	}
-	// return nil
+	return subscription.handle
 }
 
-// Unsubscribe an address and handler
-// if handler is nil then only the address needs to match
-func (messenger *MqttMessenger) Unsubscribe(
-	address string, onMessage func(address string, message string) error) {
-	// messenger.publishMutex.Lock()
-	var onMessageID = onMessage
-	// onMessageStr := fmt.Sprintf("%v", &onMessage)
+// Unsubscribe a subscription using the handle returned by Subscribe
+// The address is unsubscribed from the broker when it has no remaining handlers.
+func (messenger *MqttMessenger) Unsubscribe(handle SubscriptionHandle) {
+	messenger.updateMutex.Lock()
+	address := ""
 	for i, sub := range messenger.subscriptions {
-		// can't compare addresses directly so convert to string
-		// handlerStr := fmt.Sprintf("%v", &sub.handler)
-		var handlerID = sub.handler
-		// if sub.address == address && handlerStr == onMessageStr {
-		if sub.address == address && (onMessage == nil || &onMessageID == &handlerID) {
-			// shift remainder left one index
-			if i < len(messenger.subscriptions) {
-				copy(messenger.subscriptions[i:], messenger.subscriptions[i+1:])
-			}
-			messenger.subscriptions = messenger.subscriptions[:len(messenger.subscriptions)-1]
-			if onMessage != nil {
-				break
-			}
+		if sub.handle == handle {
+			address = sub.address
+			// copy so a concurrent resubscribe keeps its list intact
+			subscriptions := make([]TopicSubscription, 0, len(messenger.subscriptions)-1)
+			subscriptions = append(subscriptions, messenger.subscriptions[:i]...)
+			messenger.subscriptions = append(subscriptions, messenger.subscriptions[i+1:]...)
+			break
+		}
+	}
+	isLastHandler := address != "" && !messenger.hasSubscription(address)
+	pahoClient := messenger.pahoClient
+	messenger.updateMutex.Unlock()
+
+	if isLastHandler && pahoClient != nil {
+		logrus.Infof("MqttMessenger.Unsubscribe: address %s", address)
+		pahoClient.Unsubscribe(address).WaitTimeout(ConnectionTimeoutSec * time.Second)
+	}
+}
+
+// MakeBrokerURL returns the URL of the broker for the configured transport, server, port and path
+//  eg: tcp://host:1883/, tls://host:8883/, ws://host:80/mqtt, wss://host:443/mqtt
+// Returns an error if the transport is not supported
+func MakeBrokerURL(config *MessengerConfig) (string, error) {
+	transport := config.Transport
+	if transport == "" {
+		transport = TransportTLS
+	}
+	var port uint16
+	switch transport {
+	case TransportTCP:
+		port = TCPPort
+	case TransportTLS:
+		port = TLSPort
+	case TransportWS:
+		port = WSPort
+	case TransportWSS:
+		port = WSSPort
+	default:
+		return "", fmt.Errorf("MakeBrokerURL: Unsupported transport '%s'", transport)
+	}
+	if config.Port != 0 {
+		port = config.Port
+	}
+	urlPath := "/" + strings.TrimPrefix(config.Path, "/")
+	brokerURL := fmt.Sprintf("%s://%s:%d%s", transport, config.Server, port, urlPath)
+	return brokerURL, nil
+}
+
+// MakeTLSConfig returns the TLS configuration for the tls and wss transports. This loads the
+// CA certificate to verify the server with and the optional client certificate and key for
+// mutual TLS authentication. Without a configured CA file the DefaultCAFile is used if it exists.
+// Returns nil for transports without TLS, or an error if a certificate cannot be loaded.
+func MakeTLSConfig(config *MessengerConfig) (*tls.Config, error) {
+	if config.Transport == TransportTCP || config.Transport == TransportWS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.Insecure,
+		ServerName:         config.ServerName, // "" uses the server hostname
+	}
+	caFile := config.CAFile
+	if caFile == "" {
+		if _, err := os.Stat(DefaultCAFile); err == nil {
+			caFile = DefaultCAFile
 		}
 	}
-	// messenger.publishMutex.Unlock()
+	if caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("MakeTLSConfig: Unable to read CA certificate %s: %s", caFile, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("MakeTLSConfig: No certificates found in CA certificate %s", caFile)
+		}
+	}
+	if config.ClientCert != "" || config.ClientKey != "" {
+		clientCert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("MakeTLSConfig: Unable to load client certificate %s and key %s: %s",
+				config.ClientCert, config.ClientKey, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+	return tlsConfig, nil
 }
 
 // NewMqttMessenger creates a new MQTT messenger instance
 func NewMqttMessenger(config *MessengerConfig) *MqttMessenger {
 	messenger := &MqttMessenger{
-		config:     config,
-		pahoClient: nil,
+		config:       config,
+		dispatcher:   NewDispatcher(config.DispatchWorkers, config.DispatchQueueSize, config.DispatchOverflow),
+		flushMutex:   &sync.Mutex{},
+		pahoClient:   nil,
+		publishQueue: NewPublishQueue(config.QueueFile, config.QueueSize),
+		status:       newConnectionStatus(),
 		//messageChannel: make(chan *IncomingMessage),
-		tlsCACertFile:       "/etc/mosquitto/certs/zcas_ca.crt",
-		tlsVerifyServerCert: true,
-		updateMutex:         &sync.Mutex{},
+		updateMutex: &sync.Mutex{},
+	}
+	// publications that were queued before a restart
+	if err := messenger.publishQueue.Load(); err != nil {
+		logrus.Errorf("NewMqttMessenger: %s", err)
 	}
 	return messenger
 }
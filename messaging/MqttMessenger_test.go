@@ -1,18 +1,31 @@
 package messaging_test
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
 	"testing"
 	"time"
 
+	"github.com/iotdomain/iotdomain-go/broker"
 	"github.com/iotdomain/iotdomain-go/messaging"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var messengerConfig = messaging.MessengerConfig{
-	Server: "localhost", // set this to your broker
-	Port:   8883,
+	Server:    "localhost",
+	Transport: messaging.TransportTCP,
 	// ClientID: "test1",
 }
 
@@ -35,15 +48,136 @@ func TestNewMessenger(t *testing.T) {
 	assert.NotNil(t, m, "Failed creating dummy messenger")
 }
 
+// start an embedded broker on a free port and return the messenger config to connect to it
+func startBroker(t *testing.T) (*broker.Broker, *messaging.MessengerConfig) {
+	testBroker := broker.NewBroker(&broker.BrokerConfig{Address: "localhost:0"})
+	err := testBroker.Start()
+	require.NoError(t, err)
+	config := messengerConfig
+	config.Port = testBroker.Port()
+	return testBroker, &config
+}
+
+// create a self signed certificate and key in PEM format
+func createTestCert(t *testing.T) (certPEM []byte, keyPEM []byte) {
+	privKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	derCert, err := x509.CreateCertificate(rand.Reader, template, template, &privKey.PublicKey, privKey)
+	require.NoError(t, err)
+	derKey, _ := x509.MarshalECPrivateKey(privKey)
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derCert})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: derKey})
+	return certPEM, keyPEM
+}
+
+func TestBrokerURL(t *testing.T) {
+	config := messaging.MessengerConfig{Server: "localhost"}
+	brokerURL, err := messaging.MakeBrokerURL(&config)
+	assert.NoError(t, err)
+	assert.Equal(t, "tls://localhost:8883/", brokerURL)
+
+	config.Transport = messaging.TransportTCP
+	brokerURL, _ = messaging.MakeBrokerURL(&config)
+	assert.Equal(t, "tcp://localhost:1883/", brokerURL)
+
+	config.Transport = messaging.TransportWS
+	config.Path = "mqtt"
+	brokerURL, _ = messaging.MakeBrokerURL(&config)
+	assert.Equal(t, "ws://localhost:80/mqtt", brokerURL)
+
+	config.Transport = messaging.TransportWSS
+	config.Port = 8443
+	config.Path = "/mqtt"
+	brokerURL, _ = messaging.MakeBrokerURL(&config)
+	assert.Equal(t, "wss://localhost:8443/mqtt", brokerURL)
+
+	// unsupported transports fail to connect
+	config.Transport = "udp"
+	_, err = messaging.MakeBrokerURL(&config)
+	assert.Error(t, err)
+	err = messaging.NewMqttMessenger(&config).Connect(context.Background(), "", "")
+	assert.Error(t, err)
+}
+
+func TestTLSConfig(t *testing.T) {
+	tempFolder, _ := ioutil.TempDir("", "messaging")
+	defer os.RemoveAll(tempFolder)
+	caFile := path.Join(tempFolder, "ca.crt")
+	certFile := path.Join(tempFolder, "client.crt")
+	keyFile := path.Join(tempFolder, "client.key")
+	certPEM, keyPEM := createTestCert(t)
+	ioutil.WriteFile(caFile, certPEM, 0600)
+	ioutil.WriteFile(certFile, certPEM, 0600)
+	ioutil.WriteFile(keyFile, keyPEM, 0600)
+
+	// transports without TLS
+	config := messaging.MessengerConfig{Server: "localhost", Transport: messaging.TransportTCP}
+	tlsConfig, err := messaging.MakeTLSConfig(&config)
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	// TLS with the system CAs
+	defaultCAFile := messaging.DefaultCAFile
+	defer func() { messaging.DefaultCAFile = defaultCAFile }()
+	messaging.DefaultCAFile = path.Join(tempFolder, "missing.crt")
+	config.Transport = ""
+	tlsConfig, err = messaging.MakeTLSConfig(&config)
+	assert.NoError(t, err)
+	require.NotNil(t, tlsConfig)
+	assert.Nil(t, tlsConfig.RootCAs)
+
+	// TLS with the default CA
+	messaging.DefaultCAFile = caFile
+	tlsConfig, err = messaging.MakeTLSConfig(&config)
+	assert.NoError(t, err)
+	require.NotNil(t, tlsConfig)
+	assert.NotNil(t, tlsConfig.RootCAs)
+
+	// mutual TLS with a CA
+	config.Transport = messaging.TransportWSS
+	config.CAFile = caFile
+	config.ClientCert = certFile
+	config.ClientKey = keyFile
+	config.ServerName = "mqtt.example.com"
+	tlsConfig, err = messaging.MakeTLSConfig(&config)
+	assert.NoError(t, err)
+	require.NotNil(t, tlsConfig)
+	assert.NotNil(t, tlsConfig.RootCAs)
+	assert.Equal(t, 1, len(tlsConfig.Certificates))
+	assert.Equal(t, "mqtt.example.com", tlsConfig.ServerName)
+
+	// error cases
+	config.ClientKey = caFile
+	_, err = messaging.MakeTLSConfig(&config)
+	assert.Error(t, err, "Expected error loading a client certificate without key")
+	config.CAFile = keyFile
+	_, err = messaging.MakeTLSConfig(&config)
+	assert.Error(t, err, "Expected error loading a CA without certificate")
+	config.CAFile = path.Join(tempFolder, "missing.crt")
+	_, err = messaging.MakeTLSConfig(&config)
+	assert.Error(t, err, "Expected error loading a missing CA")
+	err = messaging.NewMqttMessenger(&config).Connect(context.Background(), "", "")
+	assert.Error(t, err)
+}
+
 // TestConnect to mqtt broker
 func TestConnect(t *testing.T) {
-	messenger := messaging.NewMqttMessenger(&messengerConfig)
-	err := messenger.Connect("", "")
+	testBroker, config := startBroker(t)
+	defer testBroker.Stop()
+	messenger := messaging.NewMqttMessenger(config)
+	err := messenger.Connect(context.Background(), "", "")
 	assert.NoError(t, err, "Connection failed")
 	// messenger.Disconnect()
 
 	// using LWT
-	err = messenger.Connect("test/pub1/$lwt", "last will and testament")
+	err = messenger.Connect(context.Background(), "test/pub1/$lwt", "last will and testament")
 	assert.NoError(t, err, "Connection failed")
 	messenger.Disconnect()
 
@@ -52,10 +186,12 @@ func TestConnect(t *testing.T) {
 // TestPublish onto mqtt broker
 func TestPublish(t *testing.T) {
 	logrus.SetReportCaller(true) // publisher logging includes caller and file:line#
+	testBroker, config := startBroker(t)
+	defer testBroker.Stop()
 
-	messenger := messaging.NewMqttMessenger(&messengerConfig)
+	messenger := messaging.NewMqttMessenger(config)
 
-	err := messenger.Connect("", "")
+	err := messenger.Connect(context.Background(), "", "")
 	assert.NoError(t, err, "Connection failed")
 
 	err = messenger.Publish(pub1Addr, false, string(pub1JSON))
@@ -80,16 +216,18 @@ func TestPublishSubscribe(t *testing.T) {
 	txLength := len(pub1JSON)
 	rxLength := 0
 	logrus.SetReportCaller(true) // publisher logging includes caller and file:line#
+	testBroker, config := startBroker(t)
+	defer testBroker.Stop()
 
-	messenger := messaging.NewMqttMessenger(&messengerConfig)
-	messenger.Subscribe(pub1Addr, func(addr string, message string) error {
+	messenger := messaging.NewMqttMessenger(config)
+	handle1 := messenger.Subscribe(pub1Addr, func(addr string, message string) error {
 		return nil
 	})
 
-	err := messenger.Connect("", "")
+	err := messenger.Connect(context.Background(), "", "")
 	assert.NoError(t, err, "Connection failed")
 
-	messenger.Subscribe(pub1Addr, func(addr string, message string) error {
+	handle2 := messenger.Subscribe(pub1Addr, func(addr string, message string) error {
 		err := json.Unmarshal([]byte(message), &receivedMessage)
 		assert.NoError(t, err, "Received message can't be parsed")
 		rxLength = len(message)
@@ -101,10 +239,170 @@ func TestPublishSubscribe(t *testing.T) {
 	err = messenger.Publish(pub1Addr, false, string(pub1JSON))
 	assert.NoError(t, err, "Publish failed")
 	time.Sleep(time.Second * 2)
-	messenger.Unsubscribe(pub1Addr, nil)
+	messenger.Unsubscribe(handle1)
+	messenger.Unsubscribe(handle2)
 	messenger.Disconnect()
 
 	assert.Equal(t, txLength, rxLength, "Sent and received message sizes don't match")
 
 	assert.Equal(t, "bob", receivedMessage.Name, "Did not receive published message")
 }
+
+// TestPublishQueued publishes while the broker is down
+func TestPublishQueued(t *testing.T) {
+	const valueAddr = "domain1/pub1/node1/temperature/0/$latest"
+	testBroker, config := startBroker(t)
+	address := testBroker.Address()
+	messenger := messaging.NewMqttMessenger(config)
+	err := messenger.Connect(context.Background(), "", "")
+	require.NoError(t, err)
+	defer messenger.Disconnect()
+
+	testBroker.Stop()
+	time.Sleep(100 * time.Millisecond)
+	err = messenger.Publish(valueAddr, true, "20")
+	assert.NoError(t, err)
+	err = messenger.Publish(pub1Addr, false, "hello")
+	assert.NoError(t, err)
+	err = messenger.Publish(valueAddr, true, "21")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, messenger.QueueDepth())
+
+	// the queue is flushed in order after reconnect
+	testBroker = broker.NewBroker(&broker.BrokerConfig{Address: address})
+	err = testBroker.Start()
+	require.NoError(t, err)
+	defer testBroker.Stop()
+	subscriberConfig := *config
+	subscriberConfig.ClientID = ""
+	subscriber := messaging.NewMqtt5Messenger(&subscriberConfig)
+	err = subscriber.Connect(context.Background(), "", "")
+	require.NoError(t, err)
+	defer subscriber.Disconnect()
+	received := make(chan string, 10)
+	_, err = subscriber.SubscribeWithProperties("domain1/pub1/#",
+		func(address string, message string, props *messaging.PublicationProperties) error {
+			received <- message
+			return nil
+		})
+	require.NoError(t, err)
+
+	for _, expected := range []string{"hello", "21"} {
+		select {
+		case message := <-received:
+			assert.Equal(t, expected, message)
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "Queued publication not received")
+		}
+	}
+	assert.Equal(t, 0, messenger.QueueDepth())
+}
+
+// connect to a broker that isn't running yet and track the connection state while it
+// is started, restarted and the messenger disconnects
+func testConnectionState(t *testing.T, newMessenger func(config *messaging.MessengerConfig) messaging.IMessenger) {
+	testBroker, config := startBroker(t)
+	address := testBroker.Address()
+	testBroker.Stop()
+
+	messenger := newMessenger(config)
+	states := make(chan messaging.ConnectionState, 10)
+	messenger.SetConnectionHandler(func(state messaging.ConnectionState) {
+		states <- state
+	})
+	waitState := func(expected messaging.ConnectionState) {
+		select {
+		case state := <-states:
+			assert.Equal(t, expected, state)
+		case <-time.After(10 * time.Second):
+			assert.Fail(t, "No connection state "+string(expected))
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := messenger.Connect(ctx, "", "")
+	assert.Error(t, err, "Connect without broker succeeded")
+	waitState(messaging.ConnectionStateConnecting)
+	assert.Equal(t, messaging.ConnectionStateConnecting, messenger.ConnectionState())
+
+	// connecting continues in the background
+	testBroker = broker.NewBroker(&broker.BrokerConfig{Address: address})
+	err = testBroker.Start()
+	require.NoError(t, err)
+	waitState(messaging.ConnectionStateConnected)
+
+	testBroker.Stop()
+	waitState(messaging.ConnectionStateLost)
+	err = testBroker.Start()
+	require.NoError(t, err)
+	defer testBroker.Stop()
+	waitState(messaging.ConnectionStateReconnected)
+
+	messenger.Disconnect()
+	waitState(messaging.ConnectionStateDisconnected)
+}
+
+func TestConnectionState(t *testing.T) {
+	testConnectionState(t, func(config *messaging.MessengerConfig) messaging.IMessenger {
+		return messaging.NewMqttMessenger(config)
+	})
+	testConnectionState(t, func(config *messaging.MessengerConfig) messaging.IMessenger {
+		return messaging.NewMqtt5Messenger(config)
+	})
+}
+
+// subscribe twice to the same address and unsubscribe each handle
+func testUnsubscribeHandle(t *testing.T, messenger messaging.IMessenger) {
+	err := messenger.Connect(context.Background(), "", "")
+	require.NoError(t, err)
+	defer messenger.Disconnect()
+
+	received1 := make(chan string, 10)
+	received2 := make(chan string, 10)
+	handle1 := messenger.Subscribe(pub1Addr, func(address string, message string) error {
+		received1 <- message
+		return nil
+	})
+	handle2 := messenger.Subscribe(pub1Addr, func(address string, message string) error {
+		received2 <- message
+		return nil
+	})
+	assert.NotEqual(t, handle1, handle2)
+	receive := func(received chan string) string {
+		select {
+		case message := <-received:
+			return message
+		case <-time.After(3 * time.Second):
+			return ""
+		}
+	}
+
+	err = messenger.Publish(pub1Addr, false, "both")
+	require.NoError(t, err)
+	assert.Equal(t, "both", receive(received1))
+	assert.Equal(t, "both", receive(received2))
+
+	// the other handler keeps receiving
+	messenger.Unsubscribe(handle1)
+	messenger.Unsubscribe(handle1)
+	err = messenger.Publish(pub1Addr, false, "second")
+	require.NoError(t, err)
+	assert.Equal(t, "second", receive(received2))
+
+	// without handlers the address is unsubscribed
+	messenger.Unsubscribe(handle2)
+	err = messenger.Publish(pub1Addr, false, "none")
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, len(received1))
+	assert.Equal(t, 0, len(received2))
+}
+
+func TestUnsubscribeHandle(t *testing.T) {
+	testBroker, config := startBroker(t)
+	defer testBroker.Stop()
+
+	testUnsubscribeHandle(t, messaging.NewDummyMessenger(config))
+	testUnsubscribeHandle(t, messaging.NewMqttMessenger(config))
+	testUnsubscribeHandle(t, messaging.NewMqtt5Messenger(config))
+}
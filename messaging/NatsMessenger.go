@@ -0,0 +1,1036 @@
+// Package messaging - Publish and Subscribe to messages using a NATS server
+package messaging
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/mqttpacket"
+	"github.com/iotdomain/iotdomain-go/natsprotocol"
+	"github.com/sirupsen/logrus"
+)
+
+// NatsPort is the default port of NATS servers, used for plain TCP and TLS connections
+const NatsPort = 4222
+
+// DefaultHeartbeatSec is the default interval of the last will heartbeat of the NatsMessenger
+const DefaultHeartbeatSec = 10
+
+// Subjects and stream used by the NatsMessenger to emulate MQTT retained messages and last will
+const (
+	NatsHeartbeatSubject = "_iotd.heartbeat" // subject of the last will heartbeats
+	NatsRetainedPrefix   = "_iotd.retained." // prefix of the subjects of retained messages in the stream
+	NatsRetainedStream   = "IOTD_RETAINED"   // JetStream stream with the last retained message per subject
+)
+
+// natsWillExpiry is the number of heartbeat intervals without heartbeat after which the last
+// will is published
+const natsWillExpiry = 2.5
+
+// subscription IDs of the inbox for request responses and of the heartbeats
+const (
+	natsHeartbeatSid = "heartbeat"
+	natsInboxSid     = "inbox"
+)
+
+// JetStream error code of a stream that already exists
+const natsErrStreamNameInUse = 10058
+
+// NatsServerError is returned when the NATS server refuses the connection, for example when the
+// authorization fails
+type NatsServerError struct {
+	Message string // error message of the server
+}
+
+// Error returns the error message of the server
+func (err *NatsServerError) Error() string {
+	return "NATS server error: " + err.Message
+}
+
+// NatsHeartbeat is published periodically by a NatsMessenger that is connected with a last will.
+// Messengers that subscribe to the last will address publish the last will to their subscribers
+// when the heartbeats stop without a graceful disconnect.
+type NatsHeartbeat struct {
+	Address   string `json:"address"`   // last will address
+	ClientID  string `json:"clientID"`  // ID of the messenger that sends the heartbeat
+	Connected bool   `json:"connected"` // false when the messenger disconnects gracefully
+	Interval  int    `json:"interval"`  // seconds until the next heartbeat
+	Value     string `json:"value"`     // last will value
+}
+
+// NatsMessenger that implements IMessenger using a NATS server. MQTT addresses are translated to
+// NATS subjects. Retained messages are kept in a JetStream stream with the last message of each
+// subject. If JetStream is not available then retained messages are not delivered on subscribe.
+// The last will is emulated with a heartbeat that is monitored by the subscribers of the last
+// will address.
+type NatsMessenger struct {
+	config          *MessengerConfig                 // connect information
+	conn            net.Conn                         // current connection, nil when not connected
+	connectDone     chan struct{}                    // closed to end the connection attempts
+	dispatcher      *Dispatcher                      // passes received messages to the subscription handlers
+	fetches         map[string]string                // retained messages being fetched by sid, with the subscribed address
+	inboxPrefix     string                           // prefix of the reply subjects of this messenger
+	isRunning       bool                             // reconnect when the connection is lost
+	lastHandle      SubscriptionHandle               // handle of the last subscription
+	lastRequestID   int                              // ID of the last request
+	lastSid         int                              // ID of the last subscription on the server
+	lastWill        *NatsHeartbeat                   // heartbeat with the last will, nil without last will
+	pending         map[string]chan *natsprotocol.Op // requests waiting for a response by reply subject
+	refusedErr      error                            // error of a refused connection
+	retainAvailable bool                             // the retained stream is available
+	status          *connectionStatus                // connection state reported to the connection handler
+	subscriptions   map[string]*natsSubscription     // subscriptions by address
+	updateMutex     *sync.Mutex                      // mutex for async updating of connection state
+	wills           map[string]*natsWill             // last wills of other messengers by client ID
+	writeMutex      *sync.Mutex                      // mutex for writing operations
+}
+
+// natsSubscription with the handlers of a subscribed address
+type natsSubscription struct {
+	address  string
+	subject  string // NATS subject of the address
+	sid      string // subscription ID to route messages to the handlers
+	handlers []natsHandler
+}
+
+// natsHandler with a message handler and the handle to unsubscribe it with
+type natsHandler struct {
+	handle  SubscriptionHandle
+	handler func(address string, message string) error
+}
+
+// natsWill with the last heartbeat of a messenger and the time its last will is published
+type natsWill struct {
+	heartbeat NatsHeartbeat
+	deadline  time.Time
+}
+
+// natsAPIResponse with the fields used of JetStream API responses
+type natsAPIResponse struct {
+	Error *struct {
+		Code        int    `json:"code"`
+		ErrCode     int    `json:"err_code"`
+		Description string `json:"description"`
+	} `json:"error"`
+	Name       string `json:"name"`
+	NumPending uint64 `json:"num_pending"`
+}
+
+// Connect to the NATS server and start the last will heartbeat
+// If a previous connection exists then it is disconnected first.
+// This waits until connected or ctx is done. Connection failures are retried in the background
+// until the connection succeeds or Disconnect is called. Once connected, a lost connection is
+// re-established in the background and subscriptions are restored.
+//  ctx to limit the time to wait for the connection
+//  lastWillAddress optional last will and testament address for publishing device state on
+//                  accidental disconnect. Use "" to ignore LWT feature.
+//  lastWillValue to use as the last will
+// Returns an error if the configuration is invalid, the server refuses the connection or if not
+// connected when ctx is done
+func (messenger *NatsMessenger) Connect(ctx context.Context, lastWillAddress string, lastWillValue string) error {
+	config := messenger.config
+
+	serverURL, err := MakeNatsURL(config)
+	if err != nil {
+		return err
+	}
+	_, err = MakeTLSConfig(config)
+	if err != nil {
+		return err
+	}
+	messenger.closeConnection()
+
+	// ClientID defaults to hostname-nanosecondsSinceEpoc, unique for clients started in the same second
+	hostName, _ := os.Hostname()
+	if config.ClientID == "" {
+		config.ClientID = fmt.Sprintf("%s-%d", hostName, time.Now().UnixNano())
+	}
+	var lastWill *NatsHeartbeat
+	if lastWillAddress != "" {
+		interval := config.Heartbeat
+		if interval <= 0 {
+			interval = DefaultHeartbeatSec
+		}
+		lastWill = &NatsHeartbeat{Address: lastWillAddress, ClientID: config.ClientID,
+			Connected: true, Interval: interval, Value: lastWillValue}
+	}
+	inboxID := make([]byte, 8)
+	_, _ = rand.Read(inboxID)
+
+	connectDone := make(chan struct{})
+	messenger.status.set(ConnectionStateConnecting)
+	messenger.updateMutex.Lock()
+	if messenger.connectDone != nil {
+		close(messenger.connectDone)
+	}
+	messenger.connectDone = connectDone
+	messenger.inboxPrefix = "_INBOX." + hex.EncodeToString(inboxID) + "."
+	messenger.isRunning = true
+	messenger.lastWill = lastWill
+	messenger.refusedErr = nil
+	messenger.updateMutex.Unlock()
+	messenger.dispatcher.Start()
+
+	logrus.Infof("NatsMessenger.Connect: Connecting to NATS server: %s with clientID %s", serverURL, config.ClientID)
+	go messenger.connectLoop(serverURL, connectDone)
+	err = messenger.status.wait(ctx)
+	if err != nil {
+		messenger.updateMutex.Lock()
+		refusedErr := messenger.refusedErr
+		messenger.updateMutex.Unlock()
+		if refusedErr != nil {
+			return refusedErr
+		}
+		logrus.Warningf("NatsMessenger.Connect: Not connected to %s: %s", serverURL, err)
+		return fmt.Errorf("NatsMessenger.Connect: Not connected to %s: %s", serverURL, err)
+	}
+	return nil
+}
+
+// ConnectionState returns the current state of the connection with the server
+func (messenger *NatsMessenger) ConnectionState() ConnectionState {
+	return messenger.status.get()
+}
+
+// Disconnect from the NATS server and remove all subscriptions. A messenger with a last will
+// announces the graceful disconnect so that its last will is not published.
+func (messenger *NatsMessenger) Disconnect() {
+	messenger.updateMutex.Lock()
+	messenger.isRunning = false
+	conn := messenger.conn
+	lastWill := messenger.lastWill
+	messenger.lastWill = nil
+	messenger.fetches = make(map[string]string)
+	messenger.subscriptions = make(map[string]*natsSubscription)
+	messenger.wills = make(map[string]*natsWill)
+	if messenger.connectDone != nil {
+		close(messenger.connectDone)
+		messenger.connectDone = nil
+	}
+	messenger.updateMutex.Unlock()
+
+	if conn != nil && lastWill != nil {
+		goodbye := *lastWill
+		goodbye.Connected = false
+		messenger.publishHeartbeat(conn, &goodbye)
+	}
+	messenger.closeConnection()
+	messenger.dispatcher.Stop()
+	messenger.status.set(ConnectionStateDisconnected)
+}
+
+// DispatchMetrics returns the counters of received messages passed to the subscription handlers
+func (messenger *NatsMessenger) DispatchMetrics() DispatchMetrics {
+	return messenger.dispatcher.Metrics()
+}
+
+// Publish a message
+// A retained message is also stored in the retained stream as the last value of the address.
+// Publishing an empty retained message removes the retained value.
+//  address to publish on
+//  retained to have the server retain the address value
+//  message to publish
+// Returns an error if not connected or the message cannot be sent
+func (messenger *NatsMessenger) Publish(address string, retained bool, message string) error {
+	subject := NatsSubject(address)
+	logrus.Debugf("NatsMessenger.Publish: address=%s, subject=%s, retained=%v", address, subject, retained)
+
+	messenger.updateMutex.Lock()
+	conn := messenger.conn
+	retainAvailable := messenger.retainAvailable
+	messenger.updateMutex.Unlock()
+	if conn == nil {
+		logrus.Warnf("NatsMessenger.Publish: Unable to publish on %s. No connection with server.", address)
+		return errNotConnected
+	}
+	err := messenger.write(conn, &natsprotocol.Op{Name: natsprotocol.OpPub,
+		Args: []string{subject}, Payload: []byte(message)})
+	if err == nil && retained {
+		if retainAvailable {
+			err = messenger.write(conn, &natsprotocol.Op{Name: natsprotocol.OpPub,
+				Args: []string{NatsRetainedPrefix + subject}, Payload: []byte(message)})
+		} else {
+			logrus.Infof("NatsMessenger.Publish: Retained messages are not available. Address %s is not retained", address)
+		}
+	}
+	if err != nil {
+		logrus.Warnf("NatsMessenger.Publish: Error during publish on address %s: %s", address, err)
+	}
+	return err
+}
+
+// SetConnectionHandler sets the handler that is invoked when the connection state changes
+func (messenger *NatsMessenger) SetConnectionHandler(handler func(state ConnectionState)) {
+	messenger.status.setHandler(handler)
+}
+
+// Subscribe to an address
+// Subscriptions are restored after the connection is re-established. If no connection exists
+// then the subscription is made when connected. The retained messages of the address are
+// delivered to the new subscription.
+//  address to subscribe to. This can contain the MQTT wildcards '+' and '#'.
+//  onMessage callback handler
+// Returns the handle to unsubscribe with
+func (messenger *NatsMessenger) Subscribe(
+	address string, onMessage func(address string, message string) error) SubscriptionHandle {
+
+	logrus.Infof("NatsMessenger.Subscribe: address %s", address)
+	messenger.updateMutex.Lock()
+	subscription := messenger.subscriptions[address]
+	isNew := subscription == nil
+	if isNew {
+		messenger.lastSid++
+		subscription = &natsSubscription{address: address, subject: NatsSubject(address),
+			sid: strconv.Itoa(messenger.lastSid)}
+		messenger.subscriptions[address] = subscription
+	}
+	messenger.lastHandle++
+	handle := messenger.lastHandle
+	subscription.handlers = append(subscription.handlers, natsHandler{handle: handle, handler: onMessage})
+	conn := messenger.conn
+	messenger.updateMutex.Unlock()
+
+	if isNew && conn != nil {
+		messenger.sendSubscribe(conn, subscription)
+	}
+	return handle
+}
+
+// Unsubscribe a subscription using the handle returned by Subscribe.
+// The server subscription is removed when the address has no more handlers.
+func (messenger *NatsMessenger) Unsubscribe(handle SubscriptionHandle) {
+	messenger.updateMutex.Lock()
+	var subscription *natsSubscription
+	handlers := make([]natsHandler, 0)
+	for _, sub := range messenger.subscriptions {
+		for index, handler := range sub.handlers {
+			if handler.handle == handle {
+				subscription = sub
+				handlers = append(handlers, sub.handlers[:index]...)
+				handlers = append(handlers, sub.handlers[index+1:]...)
+				break
+			}
+		}
+		if subscription != nil {
+			break
+		}
+	}
+	if subscription == nil {
+		messenger.updateMutex.Unlock()
+		return
+	}
+	subscription.handlers = handlers
+	if len(handlers) > 0 {
+		messenger.updateMutex.Unlock()
+		return
+	}
+	delete(messenger.subscriptions, subscription.address)
+	conn := messenger.conn
+	messenger.updateMutex.Unlock()
+
+	if conn != nil {
+		err := messenger.write(conn, &natsprotocol.Op{Name: natsprotocol.OpUnsub, Args: []string{subscription.sid}})
+		if err != nil {
+			logrus.Warnf("NatsMessenger.Unsubscribe: Error unsubscribing from %s: %s", subscription.address, err)
+		}
+	}
+}
+
+// closeConnection closes the current connection
+func (messenger *NatsMessenger) closeConnection() {
+	messenger.updateMutex.Lock()
+	conn := messenger.conn
+	messenger.conn = nil
+	pending := messenger.pending
+	messenger.pending = make(map[string]chan *natsprotocol.Op)
+	messenger.updateMutex.Unlock()
+
+	for _, responseChan := range pending {
+		close(responseChan)
+	}
+	if conn != nil {
+		logrus.Warningf("NatsMessenger.Disconnect: Closing connection")
+		conn.Close()
+	}
+}
+
+// connect to the server, start the connection loops and restore the subscriptions
+// Returns a NatsServerError if the server refuses the connection
+func (messenger *NatsMessenger) connect() error {
+	conn, reader, err := messenger.dial()
+	if err != nil {
+		return err
+	}
+	keepAlive := ConnectionTimeoutSec * time.Second
+
+	messenger.updateMutex.Lock()
+	if !messenger.isRunning {
+		messenger.updateMutex.Unlock()
+		conn.Close()
+		return fmt.Errorf("NatsMessenger.connect: Disconnected while connecting")
+	}
+	messenger.conn = conn
+	messenger.fetches = make(map[string]string)
+	inboxPrefix := messenger.inboxPrefix
+	// the last wills of other messengers get a new deadline as their heartbeats were missed
+	for _, will := range messenger.wills {
+		will.deadline = time.Now().Add(natsWillInterval(will.heartbeat.Interval))
+	}
+	messenger.updateMutex.Unlock()
+	logrus.Warningf("NatsMessenger.connect: Connected to server %s. ClientId=%s",
+		messenger.config.Server, messenger.config.ClientID)
+
+	incoming := make(chan *natsprotocol.Op, incomingQueueSize)
+	go messenger.readLoop(conn, reader, incoming, keepAlive)
+	go messenger.dispatchLoop(incoming)
+	go messenger.pingLoop(conn, keepAlive)
+	go messenger.heartbeatLoop(conn)
+
+	// request responses have a single token after the inbox prefix
+	err = messenger.write(conn, &natsprotocol.Op{Name: natsprotocol.OpSub,
+		Args: []string{inboxPrefix + "*", natsInboxSid}})
+	if err == nil {
+		err = messenger.write(conn, &natsprotocol.Op{Name: natsprotocol.OpSub,
+			Args: []string{NatsHeartbeatSubject, natsHeartbeatSid}})
+	}
+	if err != nil {
+		messenger.connectionLost(conn, err)
+		return nil
+	}
+	messenger.createRetainedStream()
+	messenger.resubscribe(conn)
+	messenger.status.set(ConnectionStateConnected)
+	return nil
+}
+
+// connectLoop attempts to connect until it succeeds, the server refuses the connection or done
+// is closed
+func (messenger *NatsMessenger) connectLoop(serverURL string, done chan struct{}) {
+	retryDelaySec := 1
+	for {
+		err := messenger.connect()
+		if err == nil {
+			return
+		} else if _, isRefused := err.(*NatsServerError); isRefused {
+			logrus.Errorf("NatsMessenger.connectLoop: Server %s refused the connection: %s", serverURL, err)
+			messenger.updateMutex.Lock()
+			messenger.isRunning = false
+			messenger.refusedErr = err
+			messenger.updateMutex.Unlock()
+			messenger.status.set(ConnectionStateDisconnected)
+			return
+		}
+		logrus.Errorf("NatsMessenger.connectLoop: Connecting to server on %s failed: %s. retrying in %d seconds.",
+			serverURL, err, retryDelaySec)
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Duration(retryDelaySec) * time.Second):
+		}
+		// slowly increment wait time
+		if retryDelaySec < 120 {
+			retryDelaySec++
+		}
+	}
+}
+
+// connectionLost closes the lost connection and reconnects while running
+func (messenger *NatsMessenger) connectionLost(conn net.Conn, err error) {
+	messenger.updateMutex.Lock()
+	if messenger.conn != conn {
+		// the connection was closed intentionally
+		messenger.updateMutex.Unlock()
+		return
+	}
+	messenger.conn = nil
+	pending := messenger.pending
+	messenger.pending = make(map[string]chan *natsprotocol.Op)
+	done := messenger.connectDone
+	messenger.updateMutex.Unlock()
+
+	conn.Close()
+	for _, responseChan := range pending {
+		close(responseChan)
+	}
+	logrus.Warningf("NatsMessenger.connectionLost: Disconnected from server %s: %s",
+		messenger.config.Server, err)
+	messenger.status.set(ConnectionStateLost)
+
+	retryDelaySec := 1
+	for messenger.running() {
+		err = messenger.connect()
+		if err == nil {
+			return
+		}
+		logrus.Errorf("NatsMessenger.connectionLost: Reconnecting to server %s failed: %s. retrying in %d seconds.",
+			messenger.config.Server, err, retryDelaySec)
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Duration(retryDelaySec) * time.Second):
+		}
+		if retryDelaySec < 60 {
+			retryDelaySec++
+		}
+	}
+}
+
+// createRetainedStream creates the stream that holds the last retained message of each subject
+// Retained messages are not available if the server doesn't support JetStream.
+func (messenger *NatsMessenger) createRetainedStream() {
+	streamConfig, _ := json.Marshal(map[string]interface{}{
+		"name":                 NatsRetainedStream,
+		"subjects":             []string{NatsRetainedPrefix + ">"},
+		"max_msgs_per_subject": 1,
+		"retention":            "limits",
+		"storage":              "file",
+	})
+	response, err := messenger.requestAPI("$JS.API.STREAM.CREATE."+NatsRetainedStream, streamConfig)
+	if err == nil && response.Error != nil && response.Error.ErrCode != natsErrStreamNameInUse {
+		err = fmt.Errorf("%s", response.Error.Description)
+	}
+	if err != nil {
+		logrus.Warningf("NatsMessenger.createRetainedStream: Retained messages are not available: %s", err)
+	}
+	messenger.updateMutex.Lock()
+	messenger.retainAvailable = err == nil
+	messenger.updateMutex.Unlock()
+}
+
+// dial opens the connection, upgrades it to TLS if needed and sends the connect options
+// Returns the connection with its reader, or a NatsServerError if the server refuses the connection
+func (messenger *NatsMessenger) dial() (net.Conn, *bufio.Reader, error) {
+	config := messenger.config
+	serverURL, err := MakeNatsURL(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig, err := MakeTLSConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	parsedURL, _ := url.Parse(serverURL)
+	dialer := &net.Dialer{Timeout: ConnectionTimeoutSec * time.Second}
+	conn, err := dialer.Dial("tcp", parsedURL.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(ConnectionTimeoutSec * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// the server starts with its information, including whether it requires TLS
+	op, err := natsprotocol.ReadOp(reader)
+	info := natsprotocol.Info{}
+	if err == nil && op.Name != natsprotocol.OpInfo {
+		err = fmt.Errorf("NatsMessenger.dial: Expected INFO, got %s", op.Name)
+	} else if err == nil {
+		err = json.Unmarshal([]byte(op.Args[0]), &info)
+	}
+	if err == nil && tlsConfig == nil && info.TLSRequired {
+		err = fmt.Errorf("NatsMessenger.dial: Server %s requires TLS", config.Server)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if tlsConfig != nil {
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = parsedURL.Hostname()
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		err = tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tlsConn
+		reader = bufio.NewReader(conn)
+	}
+
+	options := natsprotocol.ConnectOptions{
+		TLSRequired:  tlsConfig != nil,
+		User:         config.Login,
+		Pass:         config.Password,
+		Name:         config.ClientID,
+		Lang:         "go",
+		Version:      "1.0",
+		Protocol:     1,
+		Headers:      info.Headers,
+		NoResponders: info.Headers,
+	}
+	optionsJSON, _ := json.Marshal(options)
+	err = natsprotocol.WriteOp(conn, &natsprotocol.Op{Name: natsprotocol.OpConnect, Args: []string{string(optionsJSON)}})
+	if err == nil {
+		err = natsprotocol.WriteOp(conn, &natsprotocol.Op{Name: natsprotocol.OpPing})
+	}
+	if err == nil {
+		// the server responds with PONG once the connection is accepted
+		op, err = natsprotocol.ReadOp(reader)
+		if err == nil && op.Name == natsprotocol.OpErr {
+			err = &NatsServerError{Message: strings.Trim(op.Args[0], "' ")}
+		} else if err == nil && op.Name != natsprotocol.OpPong {
+			err = fmt.Errorf("NatsMessenger.dial: Expected PONG, got %s", op.Name)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, reader, nil
+}
+
+// dispatchLoop passes received messages to the subscription handlers
+// This runs separate from the readLoop so that handlers can make requests.
+func (messenger *NatsMessenger) dispatchLoop(incoming chan *natsprotocol.Op) {
+	for op := range incoming {
+		subject, sid := op.Args[0], op.Args[1]
+		if sid == natsHeartbeatSid {
+			messenger.receiveHeartbeat(op.Payload)
+			continue
+		}
+		messenger.updateMutex.Lock()
+		fetchAddress, isFetch := messenger.fetches[sid]
+		messenger.updateMutex.Unlock()
+		if isFetch {
+			messenger.receiveRetained(sid, fetchAddress, op)
+			continue
+		}
+		// like MQTT '$' topics, internal subjects are not matched by a wildcard at the start
+		isInternal := strings.HasPrefix(subject, "_") || strings.HasPrefix(subject, "$")
+		var handlers []natsHandler
+		messenger.updateMutex.Lock()
+		for _, subscription := range messenger.subscriptions {
+			isWildcard := strings.HasPrefix(subscription.subject, "*") || strings.HasPrefix(subscription.subject, ">")
+			if subscription.sid == sid && !(isInternal && isWildcard) {
+				handlers = subscription.handlers
+			}
+		}
+		messenger.updateMutex.Unlock()
+		messenger.dispatch(NatsAddress(subject), string(op.Payload), handlers)
+	}
+}
+
+// dispatch a message to handlers
+func (messenger *NatsMessenger) dispatch(address string, message string, handlers []natsHandler) {
+	if len(handlers) == 0 {
+		return
+	}
+	logrus.Infof("NatsMessenger.onMessage. address=%s", address)
+	messenger.dispatcher.Dispatch(address, func() {
+		for _, handler := range handlers {
+			handler.handler(address, message)
+		}
+	})
+}
+
+// endFetch removes the delivery subscription and consumer of a retained message fetch
+//  sid of the delivery subscription
+//  consumer to delete, "" if the consumer wasn't created
+func (messenger *NatsMessenger) endFetch(sid string, consumer string) {
+	messenger.updateMutex.Lock()
+	_, isFetch := messenger.fetches[sid]
+	delete(messenger.fetches, sid)
+	conn := messenger.conn
+	messenger.updateMutex.Unlock()
+	if !isFetch || conn == nil {
+		return
+	}
+	_ = messenger.write(conn, &natsprotocol.Op{Name: natsprotocol.OpUnsub, Args: []string{sid}})
+	if consumer != "" {
+		_ = messenger.write(conn, &natsprotocol.Op{Name: natsprotocol.OpPub,
+			Args: []string{"$JS.API.CONSUMER.DELETE." + NatsRetainedStream + "." + consumer}})
+	}
+}
+
+// expireWills publishes the last wills of messengers whose heartbeat has stopped to the
+// handlers of the subscriptions that match the last will address
+func (messenger *NatsMessenger) expireWills() {
+	expired := make([]NatsHeartbeat, 0)
+	messenger.updateMutex.Lock()
+	for clientID, will := range messenger.wills {
+		if time.Now().After(will.deadline) {
+			expired = append(expired, will.heartbeat)
+			delete(messenger.wills, clientID)
+		}
+	}
+	messenger.updateMutex.Unlock()
+
+	for _, heartbeat := range expired {
+		logrus.Warningf("NatsMessenger.expireWills: No heartbeat from %s. Publishing its last will on %s",
+			heartbeat.ClientID, heartbeat.Address)
+		messenger.dispatch(heartbeat.Address, heartbeat.Value, messenger.getHandlers(heartbeat.Address))
+	}
+}
+
+// fetchRetained requests the retained messages of a subscription from the retained stream
+// A consumer delivers the last message of each matching subject to a delivery subject that is
+// subscribed to until all messages are received.
+func (messenger *NatsMessenger) fetchRetained(conn net.Conn, subscription *natsSubscription) {
+	messenger.updateMutex.Lock()
+	if !messenger.retainAvailable {
+		messenger.updateMutex.Unlock()
+		return
+	}
+	messenger.lastSid++
+	sid := "fetch" + strconv.Itoa(messenger.lastSid)
+	deliverSubject := messenger.inboxPrefix + "retained." + strconv.Itoa(messenger.lastSid)
+	messenger.fetches[sid] = subscription.address
+	messenger.updateMutex.Unlock()
+
+	err := messenger.write(conn, &natsprotocol.Op{Name: natsprotocol.OpSub, Args: []string{deliverSubject, sid}})
+	if err != nil {
+		messenger.endFetch(sid, "")
+		return
+	}
+	request, _ := json.Marshal(map[string]interface{}{
+		"stream_name": NatsRetainedStream,
+		"config": map[string]interface{}{
+			"ack_policy":      "none",
+			"deliver_policy":  "last_per_subject",
+			"deliver_subject": deliverSubject,
+			"filter_subject":  NatsRetainedPrefix + subscription.subject,
+		},
+	})
+	response, err := messenger.requestAPI("$JS.API.CONSUMER.CREATE."+NatsRetainedStream, request)
+	if err == nil && response.Error != nil {
+		err = fmt.Errorf("%s", response.Error.Description)
+	}
+	if err != nil {
+		logrus.Warningf("NatsMessenger.fetchRetained: Unable to fetch retained messages of %s: %s",
+			subscription.address, err)
+		messenger.endFetch(sid, "")
+	} else if response.NumPending == 0 {
+		messenger.endFetch(sid, response.Name)
+	}
+}
+
+// getHandlers returns the handlers of the subscriptions that match an address
+func (messenger *NatsMessenger) getHandlers(address string) []natsHandler {
+	messenger.updateMutex.Lock()
+	defer messenger.updateMutex.Unlock()
+	handlers := make([]natsHandler, 0)
+	for _, subscription := range messenger.subscriptions {
+		if mqttpacket.MatchTopic(address, subscription.address) {
+			handlers = append(handlers, subscription.handlers...)
+		}
+	}
+	return handlers
+}
+
+// heartbeatLoop publishes the last will heartbeat until the connection is replaced and checks
+// for the last wills of other messengers to publish
+func (messenger *NatsMessenger) heartbeatLoop(conn net.Conn) {
+	nextHeartbeat := time.Now()
+	for {
+		messenger.updateMutex.Lock()
+		isCurrent := messenger.conn == conn
+		lastWill := messenger.lastWill
+		messenger.updateMutex.Unlock()
+		if !isCurrent {
+			return
+		}
+		if lastWill != nil && !time.Now().Before(nextHeartbeat) {
+			messenger.publishHeartbeat(conn, lastWill)
+			nextHeartbeat = time.Now().Add(time.Duration(lastWill.Interval) * time.Second)
+		}
+		messenger.expireWills()
+		time.Sleep(time.Second / 4)
+	}
+}
+
+// pingLoop sends a ping at half the keep alive interval until the connection is replaced
+func (messenger *NatsMessenger) pingLoop(conn net.Conn, keepAlive time.Duration) {
+	for {
+		time.Sleep(keepAlive / 2)
+		messenger.updateMutex.Lock()
+		isCurrent := messenger.conn == conn
+		messenger.updateMutex.Unlock()
+		if !isCurrent || messenger.write(conn, &natsprotocol.Op{Name: natsprotocol.OpPing}) != nil {
+			return
+		}
+	}
+}
+
+// publishHeartbeat publishes the last will heartbeat
+func (messenger *NatsMessenger) publishHeartbeat(conn net.Conn, heartbeat *NatsHeartbeat) {
+	payload, _ := json.Marshal(heartbeat)
+	err := messenger.write(conn, &natsprotocol.Op{Name: natsprotocol.OpPub,
+		Args: []string{NatsHeartbeatSubject}, Payload: payload})
+	if err != nil {
+		logrus.Warningf("NatsMessenger.publishHeartbeat: %s", err)
+	}
+}
+
+// readLoop reads operations until the connection closes
+// The server must send an operation, at least a ping response, within 1.5 times the keep alive.
+func (messenger *NatsMessenger) readLoop(
+	conn net.Conn, reader *bufio.Reader, incoming chan *natsprotocol.Op, keepAlive time.Duration) {
+	defer close(incoming)
+	for {
+		conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		op, err := natsprotocol.ReadOp(reader)
+		if err != nil {
+			messenger.connectionLost(conn, err)
+			return
+		}
+		switch op.Name {
+		case natsprotocol.OpMsg, natsprotocol.OpHMsg:
+			if op.Args[1] == natsInboxSid {
+				messenger.respond(op)
+			} else if natsprotocol.HeaderStatus(op.Headers) == "" {
+				incoming <- op
+			}
+		case natsprotocol.OpPing:
+			_ = messenger.write(conn, &natsprotocol.Op{Name: natsprotocol.OpPong})
+		case natsprotocol.OpErr:
+			// the server closes the connection after a fatal error
+			logrus.Warningf("NatsMessenger.readLoop: Server error: %s", op.Args[0])
+		}
+	}
+}
+
+// receiveHeartbeat tracks the last will of a messenger if it is published on a subscribed address
+func (messenger *NatsMessenger) receiveHeartbeat(payload []byte) {
+	heartbeat := NatsHeartbeat{}
+	err := json.Unmarshal(payload, &heartbeat)
+	if err != nil || heartbeat.ClientID == messenger.config.ClientID {
+		return
+	}
+	isSubscribed := len(messenger.getHandlers(heartbeat.Address)) > 0
+	messenger.updateMutex.Lock()
+	defer messenger.updateMutex.Unlock()
+	if !heartbeat.Connected || !isSubscribed {
+		delete(messenger.wills, heartbeat.ClientID)
+		return
+	}
+	messenger.wills[heartbeat.ClientID] = &natsWill{heartbeat: heartbeat,
+		deadline: time.Now().Add(natsWillInterval(heartbeat.Interval))}
+}
+
+// receiveRetained passes a retained message to the handlers of the subscription that fetched it
+// and ends the fetch when no more messages are pending.
+//  sid of the delivery subscription
+//  address of the subscription
+//  op with the message delivered by the consumer
+func (messenger *NatsMessenger) receiveRetained(sid string, address string, op *natsprotocol.Op) {
+	if len(op.Payload) > 0 {
+		messenger.updateMutex.Lock()
+		var handlers []natsHandler
+		if subscription := messenger.subscriptions[address]; subscription != nil {
+			handlers = subscription.handlers
+		}
+		messenger.updateMutex.Unlock()
+		retainedAddress := NatsAddress(strings.TrimPrefix(op.Args[0], NatsRetainedPrefix))
+		messenger.dispatch(retainedAddress, string(op.Payload), handlers)
+	}
+	// the reply subject holds the consumer and the nr of pending messages:
+	//  $JS.ACK.<stream>.<consumer>.<delivered>.<sseq>.<cseq>.<time>.<pending>
+	//  $JS.ACK.<domain>.<account hash>.<stream>.<consumer>.<delivered>.<sseq>.<cseq>.<time>.<pending>.<token>
+	if len(op.Args) < 3 {
+		return
+	}
+	tokens := strings.Split(op.Args[2], ".")
+	consumer, pending := "", ""
+	if len(tokens) == 9 {
+		consumer, pending = tokens[3], tokens[8]
+	} else if len(tokens) >= 12 {
+		consumer, pending = tokens[5], tokens[10]
+	}
+	if pending == "0" {
+		messenger.endFetch(sid, consumer)
+	}
+}
+
+// requestAPI sends a request to the JetStream API and waits for the response
+// Returns an error without connection, if JetStream is not available or the response is invalid
+func (messenger *NatsMessenger) requestAPI(subject string, payload []byte) (*natsAPIResponse, error) {
+	messenger.updateMutex.Lock()
+	conn := messenger.conn
+	if conn == nil {
+		messenger.updateMutex.Unlock()
+		return nil, errNotConnected
+	}
+	messenger.lastRequestID++
+	reply := messenger.inboxPrefix + strconv.Itoa(messenger.lastRequestID)
+	responseChan := make(chan *natsprotocol.Op, 1)
+	messenger.pending[reply] = responseChan
+	messenger.updateMutex.Unlock()
+
+	var response *natsprotocol.Op
+	err := messenger.write(conn, &natsprotocol.Op{Name: natsprotocol.OpPub,
+		Args: []string{subject, reply}, Payload: payload})
+	if err == nil {
+		select {
+		case received, isOpen := <-responseChan:
+			if isOpen {
+				response = received
+			} else {
+				err = fmt.Errorf("connection lost")
+			}
+		case <-time.After(ConnectionTimeoutSec * time.Second):
+			err = fmt.Errorf("timeout waiting for response")
+		}
+	}
+	messenger.updateMutex.Lock()
+	if messenger.pending[reply] == responseChan {
+		delete(messenger.pending, reply)
+	}
+	messenger.updateMutex.Unlock()
+	if err != nil {
+		return nil, err
+	} else if natsprotocol.HeaderStatus(response.Headers) == "503" {
+		return nil, fmt.Errorf("JetStream is not enabled")
+	}
+	apiResponse := &natsAPIResponse{}
+	err = json.Unmarshal(response.Payload, apiResponse)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response: %s", err)
+	}
+	return apiResponse, nil
+}
+
+// respond passes a response to the request waiting for it
+func (messenger *NatsMessenger) respond(op *natsprotocol.Op) {
+	messenger.updateMutex.Lock()
+	responseChan := messenger.pending[op.Args[0]]
+	delete(messenger.pending, op.Args[0])
+	messenger.updateMutex.Unlock()
+	if responseChan != nil {
+		responseChan <- op
+	}
+}
+
+// resubscribe to the addresses after establishing a connection
+func (messenger *NatsMessenger) resubscribe(conn net.Conn) {
+	messenger.updateMutex.Lock()
+	subscriptions := make([]*natsSubscription, 0, len(messenger.subscriptions))
+	for _, subscription := range messenger.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+	messenger.updateMutex.Unlock()
+
+	logrus.Infof("NatsMessenger.resubscribe to %d addresses", len(subscriptions))
+	for _, subscription := range subscriptions {
+		messenger.sendSubscribe(conn, subscription)
+	}
+}
+
+// running returns true until Disconnect is called
+func (messenger *NatsMessenger) running() bool {
+	messenger.updateMutex.Lock()
+	defer messenger.updateMutex.Unlock()
+	return messenger.isRunning
+}
+
+// sendSubscribe sends the subscription to the server and fetches its retained messages
+func (messenger *NatsMessenger) sendSubscribe(conn net.Conn, subscription *natsSubscription) {
+	err := messenger.write(conn, &natsprotocol.Op{Name: natsprotocol.OpSub,
+		Args: []string{subscription.subject, subscription.sid}})
+	if err != nil {
+		logrus.Errorf("NatsMessenger.sendSubscribe: Error subscribing to %s: %s", subscription.address, err)
+		return
+	}
+	messenger.fetchRetained(conn, subscription)
+}
+
+// write an operation to the connection
+func (messenger *NatsMessenger) write(conn net.Conn, op *natsprotocol.Op) error {
+	messenger.writeMutex.Lock()
+	defer messenger.writeMutex.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(ConnectionTimeoutSec * time.Second))
+	return natsprotocol.WriteOp(conn, op)
+}
+
+// MakeNatsURL returns the URL of the NATS server for the configured transport
+// Returns an error if the transport is not tcp or tls
+func MakeNatsURL(config *MessengerConfig) (string, error) {
+	transport := config.Transport
+	if transport == "" {
+		transport = TransportTLS
+	}
+	if transport != TransportTCP && transport != TransportTLS {
+		return "", fmt.Errorf("MakeNatsURL: Unsupported transport '%s'", transport)
+	}
+	port := uint16(NatsPort)
+	if config.Port != 0 {
+		port = config.Port
+	}
+	return fmt.Sprintf("%s://%s:%d", transport, config.Server, port), nil
+}
+
+// NatsAddress converts a NATS subject to an address. This is the reverse of NatsSubject.
+func NatsAddress(subject string) string {
+	tokens := strings.Split(subject, ".")
+	for index, token := range tokens {
+		switch token {
+		case "*":
+			tokens[index] = "+"
+		case ">":
+			tokens[index] = "#"
+		default:
+			if unescaped, err := url.PathUnescape(token); err == nil {
+				tokens[index] = unescaped
+			}
+		}
+	}
+	return strings.Join(tokens, "/")
+}
+
+// NatsSubject converts an address to a NATS subject. Address levels become subject tokens and
+// the wildcards '+' and '#' become '*' and '>'. Characters that are not allowed in a token are
+// percent escaped.
+func NatsSubject(address string) string {
+	levels := strings.Split(address, "/")
+	for index, level := range levels {
+		switch level {
+		case "+":
+			levels[index] = "*"
+		case "#":
+			levels[index] = ">"
+		default:
+			levels[index] = natsTokenEscaper.Replace(level)
+		}
+	}
+	return strings.Join(levels, ".")
+}
+
+// natsTokenEscaper escapes the characters in an address level that are not allowed in a NATS token
+var natsTokenEscaper = strings.NewReplacer(
+	"%", "%25", ".", "%2E", "*", "%2A", ">", "%3E", " ", "%20", "\t", "%09")
+
+// natsWillInterval returns the time without heartbeat after which a last will is published
+func natsWillInterval(heartbeatSec int) time.Duration {
+	if heartbeatSec <= 0 {
+		heartbeatSec = DefaultHeartbeatSec
+	}
+	return time.Duration(natsWillExpiry * float64(heartbeatSec) * float64(time.Second))
+}
+
+// NewNatsMessenger creates a new NATS messenger instance
+func NewNatsMessenger(config *MessengerConfig) *NatsMessenger {
+	messenger := &NatsMessenger{
+		config:        config,
+		dispatcher:    NewDispatcher(config.DispatchWorkers, config.DispatchQueueSize, config.DispatchOverflow),
+		fetches:       make(map[string]string),
+		pending:       make(map[string]chan *natsprotocol.Op),
+		status:        newConnectionStatus(),
+		subscriptions: make(map[string]*natsSubscription),
+		updateMutex:   &sync.Mutex{},
+		wills:         make(map[string]*natsWill),
+		writeMutex:    &sync.Mutex{},
+	}
+	return messenger
+}
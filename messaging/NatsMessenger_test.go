@@ -0,0 +1,465 @@
+package messaging_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/natsprotocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// natsTestServer is a minimal NATS server that routes messages between its clients. With
+// JetStream it supports a last-value stream and consumers that deliver the last message per subject.
+// Clients with login 'baduser' or a blocked name are refused.
+type natsTestServer struct {
+	listener      net.Listener
+	jetStream     bool
+	blocked       map[string]bool // refused client names
+	clients       []*natsTestClient
+	deleted       []string // deleted consumers
+	lastConsumer  int
+	streamCreated bool
+	stream        map[string][]byte // last message by subject
+	mutex         sync.Mutex
+}
+
+// natsTestClient is a connection of a client with its subscriptions
+type natsTestClient struct {
+	conn          net.Conn
+	name          string
+	subscriptions map[string]string // subject filter by sid
+	writeMutex    sync.Mutex
+}
+
+func startNatsTestServer(t *testing.T, jetStream bool) *natsTestServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &natsTestServer{listener: listener, jetStream: jetStream,
+		blocked: make(map[string]bool), stream: make(map[string][]byte)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *natsTestServer) config() *messaging.MessengerConfig {
+	return &messaging.MessengerConfig{Messenger: "NATSMessenger", Server: "127.0.0.1",
+		Port: uint16(server.listener.Addr().(*net.TCPAddr).Port), Transport: messaging.TransportTCP}
+}
+
+// dropClient closes the connections of a client and refuses it to reconnect if block is set
+func (server *natsTestServer) dropClient(name string, block bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.blocked[name] = block
+	for _, client := range server.clients {
+		if client.name == name {
+			client.conn.Close()
+		}
+	}
+}
+
+// deliver a message to the subscriptions of all clients that match the route. The route is the
+// subject, except for consumers that deliver stream messages to their deliver subject.
+func (server *natsTestServer) deliver(route string, subject string, reply string, headers []byte, payload []byte) {
+	server.mutex.Lock()
+	clients := append([]*natsTestClient{}, server.clients...)
+	server.mutex.Unlock()
+	for _, client := range clients {
+		client.writeMutex.Lock()
+		for sid, filter := range client.subscriptions {
+			if natsprotocol.MatchSubject(route, filter) {
+				op := &natsprotocol.Op{Name: natsprotocol.OpMsg, Args: []string{subject, sid}, Payload: payload}
+				if reply != "" {
+					op.Args = append(op.Args, reply)
+				}
+				if headers != nil {
+					op.Name = natsprotocol.OpHMsg
+					op.Headers = headers
+				}
+				natsprotocol.WriteOp(client.conn, op)
+			}
+		}
+		client.writeMutex.Unlock()
+	}
+}
+
+// handleAPI handles a request to the JetStream API
+func (server *natsTestServer) handleAPI(subject string, reply string, payload []byte) {
+	if !server.jetStream {
+		server.deliver(reply, reply, "", natsprotocol.MakeHeaders("503"), nil)
+		return
+	}
+	server.mutex.Lock()
+	response := `{}`
+	var deliveries []string
+	var deliverSubject, consumer string
+	switch {
+	case strings.HasPrefix(subject, "$JS.API.STREAM.CREATE."):
+		if server.streamCreated {
+			response = `{"error":{"code":400,"err_code":10058,"description":"stream name already in use"}}`
+		}
+		server.streamCreated = true
+	case strings.HasPrefix(subject, "$JS.API.CONSUMER.CREATE."):
+		request := struct {
+			Config struct {
+				DeliverSubject string `json:"deliver_subject"`
+				FilterSubject  string `json:"filter_subject"`
+			} `json:"config"`
+		}{}
+		json.Unmarshal(payload, &request)
+		server.lastConsumer++
+		consumer = fmt.Sprintf("consumer%d", server.lastConsumer)
+		deliverSubject = request.Config.DeliverSubject
+		for streamSubject := range server.stream {
+			if natsprotocol.MatchSubject(streamSubject, request.Config.FilterSubject) {
+				deliveries = append(deliveries, streamSubject)
+			}
+		}
+		sort.Strings(deliveries)
+		response = fmt.Sprintf(`{"name":"%s","num_pending":%d}`, consumer, len(deliveries))
+	case strings.HasPrefix(subject, "$JS.API.CONSUMER.DELETE."):
+		server.deleted = append(server.deleted, subject[strings.LastIndex(subject, ".")+1:])
+	}
+	messages := make([][]byte, len(deliveries))
+	for index, streamSubject := range deliveries {
+		messages[index] = server.stream[streamSubject]
+	}
+	server.mutex.Unlock()
+
+	if reply != "" {
+		server.deliver(reply, reply, "", nil, []byte(response))
+	}
+	for index, streamSubject := range deliveries {
+		ack := fmt.Sprintf("$JS.ACK.%s.%s.1.%d.%d.0.%d", messaging.NatsRetainedStream, consumer,
+			index+1, index+1, len(deliveries)-index-1)
+		server.deliver(deliverSubject, streamSubject, ack, nil, messages[index])
+	}
+}
+
+func (server *natsTestServer) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	defer conn.Close()
+	info := fmt.Sprintf(`{"server_id":"test","headers":true,"jetstream":%v}`, server.jetStream)
+	natsprotocol.WriteOp(conn, &natsprotocol.Op{Name: natsprotocol.OpInfo, Args: []string{info}})
+
+	op, err := natsprotocol.ReadOp(reader)
+	if err != nil || op.Name != natsprotocol.OpConnect {
+		return
+	}
+	options := natsprotocol.ConnectOptions{}
+	json.Unmarshal([]byte(op.Args[0]), &options)
+	client := &natsTestClient{conn: conn, name: options.Name, subscriptions: make(map[string]string)}
+	server.mutex.Lock()
+	isBlocked := server.blocked[options.Name]
+	server.mutex.Unlock()
+	if options.User == "baduser" || isBlocked {
+		natsprotocol.WriteOp(conn, &natsprotocol.Op{Name: natsprotocol.OpErr, Args: []string{"'Authorization Violation'"}})
+		return
+	}
+	server.mutex.Lock()
+	server.clients = append(server.clients, client)
+	server.mutex.Unlock()
+	defer func() {
+		server.mutex.Lock()
+		for index, c := range server.clients {
+			if c == client {
+				server.clients = append(server.clients[:index], server.clients[index+1:]...)
+				break
+			}
+		}
+		server.mutex.Unlock()
+	}()
+
+	for {
+		op, err = natsprotocol.ReadOp(reader)
+		if err != nil {
+			return
+		}
+		switch op.Name {
+		case natsprotocol.OpPing:
+			client.writeMutex.Lock()
+			natsprotocol.WriteOp(conn, &natsprotocol.Op{Name: natsprotocol.OpPong})
+			client.writeMutex.Unlock()
+		case natsprotocol.OpSub:
+			client.writeMutex.Lock()
+			client.subscriptions[op.Args[len(op.Args)-1]] = op.Args[0]
+			client.writeMutex.Unlock()
+		case natsprotocol.OpUnsub:
+			client.writeMutex.Lock()
+			delete(client.subscriptions, op.Args[0])
+			client.writeMutex.Unlock()
+		case natsprotocol.OpPub:
+			subject, reply := op.Args[0], ""
+			if len(op.Args) > 1 {
+				reply = op.Args[1]
+			}
+			if strings.HasPrefix(subject, "$JS.API.") {
+				server.handleAPI(subject, reply, op.Payload)
+				continue
+			}
+			server.mutex.Lock()
+			if server.streamCreated && strings.HasPrefix(subject, messaging.NatsRetainedPrefix) {
+				server.stream[subject] = op.Payload
+			}
+			server.mutex.Unlock()
+			server.deliver(subject, subject, reply, nil, op.Payload)
+		}
+	}
+}
+
+// receive a message or return "" after a timeout
+func receiveNats(received chan string, timeout time.Duration) string {
+	select {
+	case message := <-received:
+		return message
+	case <-time.After(timeout):
+		return ""
+	}
+}
+
+func TestNatsSubject(t *testing.T) {
+	assert.Equal(t, "domain1.pub1.*.$node", messaging.NatsSubject("domain1/pub1/+/$node"))
+	assert.Equal(t, "domain1.>", messaging.NatsSubject("domain1/#"))
+	assert.Equal(t, "domain1.pub%2E1.node%201.100%25", messaging.NatsSubject("domain1/pub.1/node 1/100%"))
+
+	for _, address := range []string{"domain1/pub1/+/$node", "domain1/#", "domain1/pub.1/node 1/a*b>c/100%"} {
+		assert.Equal(t, address, messaging.NatsAddress(messaging.NatsSubject(address)))
+	}
+}
+
+func TestNatsPublishSubscribe(t *testing.T) {
+	const node1Addr = "domain1/publisher1/node1/$node"
+	const valueAddr = "domain1/publisher1/node1/temperature/0/$latest"
+	server := startNatsTestServer(t, true)
+	defer server.listener.Close()
+
+	config := server.config()
+	config.ClientID = "client1"
+	messenger := messaging.NewMessenger(config).(*messaging.NatsMessenger)
+	err := messenger.Connect(context.Background(), "", "")
+	require.NoError(t, err)
+	defer messenger.Disconnect()
+
+	// retained values are delivered to new subscriptions
+	err = messenger.Publish(valueAddr, true, "21.5")
+	require.NoError(t, err)
+	err = messenger.Publish(node1Addr, false, "not retained")
+	require.NoError(t, err)
+	received := make(chan string, 10)
+	var rxAddress string
+	handle := messenger.Subscribe("domain1/+/node1/#", func(address string, message string) error {
+		rxAddress = address
+		received <- message
+		return nil
+	})
+	assert.Equal(t, "21.5", receiveNats(received, time.Second))
+	assert.Equal(t, valueAddr, rxAddress)
+	assert.Equal(t, "", receiveNats(received, 100*time.Millisecond))
+	server.mutex.Lock()
+	assert.Equal(t, []string{"consumer1"}, server.deleted, "Consumer not deleted after delivery")
+	server.mutex.Unlock()
+
+	// an empty retained message removes the retained value
+	err = messenger.Publish(valueAddr, true, "")
+	require.NoError(t, err)
+	assert.Equal(t, "", receiveNats(received, time.Second))
+	received2 := make(chan string, 10)
+	messenger.Subscribe(valueAddr, func(address string, message string) error {
+		received2 <- message
+		return nil
+	})
+	assert.Equal(t, "", receiveNats(received2, 100*time.Millisecond))
+
+	// wildcards at the start don't receive the internal subjects
+	receivedAll := make(chan string, 10)
+	messenger.Subscribe("#", func(address string, message string) error {
+		receivedAll <- address
+		return nil
+	})
+	err = messenger.Publish(node1Addr, false, "live")
+	require.NoError(t, err)
+	assert.Equal(t, "live", receiveNats(received, time.Second))
+	assert.Equal(t, node1Addr, receiveNats(receivedAll, time.Second))
+
+	// subscriptions are restored after the connection is lost
+	server.dropClient("client1", false)
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 30 && messenger.Publish(node1Addr, false, "reconnected") != nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, "reconnected", receiveNats(received, 3*time.Second))
+
+	// unsubscribed messages are no longer received
+	messenger.Unsubscribe(handle)
+	err = messenger.Publish(node1Addr, false, "unsubscribed")
+	require.NoError(t, err)
+	assert.Equal(t, node1Addr, receiveNats(receivedAll, time.Second))
+	assert.Equal(t, "", receiveNats(received, 100*time.Millisecond))
+
+	// publish after disconnect fails
+	messenger.Disconnect()
+	err = messenger.Publish(node1Addr, false, "disconnected")
+	assert.Error(t, err)
+}
+
+func TestNatsWithoutJetStream(t *testing.T) {
+	server := startNatsTestServer(t, false)
+	defer server.listener.Close()
+
+	testUnsubscribeHandle(t, messaging.NewNatsMessenger(server.config()))
+
+	// retained messages are not available but messages are delivered
+	messenger := messaging.NewNatsMessenger(server.config())
+	err := messenger.Connect(context.Background(), "", "")
+	require.NoError(t, err)
+	defer messenger.Disconnect()
+	err = messenger.Publish(pub1Addr, true, "retained")
+	require.NoError(t, err)
+	received := make(chan string, 10)
+	messenger.Subscribe(pub1Addr, func(address string, message string) error {
+		received <- message
+		return nil
+	})
+	assert.Equal(t, "", receiveNats(received, 100*time.Millisecond))
+	err = messenger.Publish(pub1Addr, true, "live")
+	require.NoError(t, err)
+	assert.Equal(t, "live", receiveNats(received, time.Second))
+}
+
+func TestNatsLastWill(t *testing.T) {
+	const stateAddr = "domain1/publisher1/$state"
+	server := startNatsTestServer(t, true)
+	defer server.listener.Close()
+
+	subscriber := messaging.NewNatsMessenger(server.config())
+	err := subscriber.Connect(context.Background(), "", "")
+	require.NoError(t, err)
+	defer subscriber.Disconnect()
+	received := make(chan string, 10)
+	subscriber.Subscribe(stateAddr, func(address string, message string) error {
+		received <- message
+		return nil
+	})
+
+	// the last will is published when the heartbeat stops
+	config := server.config()
+	config.ClientID = "publisher1"
+	config.Heartbeat = 1
+	publisher := messaging.NewNatsMessenger(config)
+	err = publisher.Connect(context.Background(), stateAddr, "lost")
+	require.NoError(t, err)
+	defer publisher.Disconnect()
+	assert.Equal(t, "", receiveNats(received, 1500*time.Millisecond))
+	server.dropClient("publisher1", true)
+	assert.Equal(t, "lost", receiveNats(received, 4*time.Second))
+	publisher.Disconnect()
+
+	// a graceful disconnect doesn't publish the last will
+	config2 := server.config()
+	config2.ClientID = "publisher2"
+	config2.Heartbeat = 1
+	publisher2 := messaging.NewNatsMessenger(config2)
+	err = publisher2.Connect(context.Background(), stateAddr, "lost")
+	require.NoError(t, err)
+	time.Sleep(500 * time.Millisecond)
+	publisher2.Disconnect()
+	assert.Equal(t, "", receiveNats(received, 3*time.Second))
+}
+
+func TestNatsConnectRefused(t *testing.T) {
+	server := startNatsTestServer(t, true)
+	defer server.listener.Close()
+
+	config := server.config()
+	config.Login = "baduser"
+	messenger := messaging.NewNatsMessenger(config)
+	err := messenger.Connect(context.Background(), "", "")
+	require.Error(t, err)
+	serverErr, isServerErr := err.(*messaging.NatsServerError)
+	require.True(t, isServerErr)
+	assert.Equal(t, "Authorization Violation", serverErr.Message)
+
+	config.Transport = messaging.TransportWS
+	err = messenger.Connect(context.Background(), "", "")
+	assert.Error(t, err)
+}
+
+// TestNatsServer runs against a nats-server with JetStream. Skipped if nats-server isn't installed.
+func TestNatsServer(t *testing.T) {
+	const valueAddr = "domain1/publisher1/node1/temperature/0/$latest"
+	const eventAddr = "domain1/publisher1/node1/$event"
+	serverPath, err := exec.LookPath("nats-server")
+	if err != nil {
+		t.Skip("nats-server not found in PATH")
+	}
+	storeFolder, _ := ioutil.TempDir("", "nats")
+	defer os.RemoveAll(storeFolder)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	server := exec.Command(serverPath, "-js", "-a", "127.0.0.1", "-p", fmt.Sprint(port), "-sd", storeFolder)
+	err = server.Start()
+	require.NoError(t, err)
+	defer func() {
+		server.Process.Kill()
+		server.Wait()
+	}()
+	config := &messaging.MessengerConfig{Messenger: "NATSMessenger", Server: "127.0.0.1",
+		Port: uint16(port), Transport: messaging.TransportTCP}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	publisher := messaging.NewNatsMessenger(config)
+	err = publisher.Connect(ctx, "", "")
+	require.NoError(t, err)
+	defer publisher.Disconnect()
+	err = publisher.Publish(valueAddr, true, "21.5")
+	require.NoError(t, err)
+
+	// the retained value is delivered to a new subscriber, followed by live messages
+	subscriber := messaging.NewNatsMessenger(config)
+	err = subscriber.Connect(ctx, "", "")
+	require.NoError(t, err)
+	defer subscriber.Disconnect()
+	received := make(chan string, 10)
+	subscriber.Subscribe("domain1/publisher1/node1/#", func(address string, message string) error {
+		received <- message
+		return nil
+	})
+	assert.Equal(t, "21.5", receiveNats(received, 3*time.Second))
+	err = publisher.Publish(eventAddr, false, "event1")
+	require.NoError(t, err)
+	assert.Equal(t, "event1", receiveNats(received, 3*time.Second))
+
+	// an empty retained message removes the retained value
+	err = publisher.Publish(valueAddr, true, "")
+	require.NoError(t, err)
+	assert.Equal(t, "", receiveNats(received, time.Second))
+	received2 := make(chan string, 10)
+	subscriber.Subscribe(valueAddr, func(address string, message string) error {
+		received2 <- message
+		return nil
+	})
+	assert.Equal(t, "", receiveNats(received2, 500*time.Millisecond))
+}
@@ -1,9 +1,16 @@
 package messaging
 
+import "github.com/sirupsen/logrus"
+
 // NewMessenger creates a new messenger instance
 // Create a messenger instance using configuration setting:
 //    "DummyMessenger" (default)
 //    MQTTMessenger, requires server, login and credentials properties set
+//    MQTT5Messenger, same as MQTTMessenger using the MQTT 5 protocol
+//    NATSMessenger, same as MQTTMessenger using a NATS server
+//
+// The messages are recorded when a record file is configured, see RecordingMessenger. The record
+// file is closed on Disconnect.
 //
 // config holds the messenger configuration. If no server is given, 'localhost' will be used.
 func NewMessenger(messengerConfig *MessengerConfig) IMessenger {
@@ -14,8 +21,20 @@ func NewMessenger(messengerConfig *MessengerConfig) IMessenger {
 	}
 	if messengerConfig.Messenger == "MQTTMessenger" {
 		m = NewMqttMessenger(messengerConfig)
+	} else if messengerConfig.Messenger == "MQTT5Messenger" {
+		m = NewMqtt5Messenger(messengerConfig)
+	} else if messengerConfig.Messenger == "NATSMessenger" {
+		m = NewNatsMessenger(messengerConfig)
 	} else {
 		m = NewDummyMessenger(messengerConfig)
 	}
+	if messengerConfig.RecordFile != "" {
+		recorder, err := NewRecordingMessenger(m, messengerConfig.RecordFile)
+		if err != nil {
+			logrus.Errorf("NewMessenger: Messages are not recorded: %s", err)
+		} else {
+			m = recorder
+		}
+	}
 	return m
 }
@@ -0,0 +1,207 @@
+// Package messaging with a queue of publications that wait for a connection
+package messaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultQueueSize is the default maximum number of queued publications
+const DefaultQueueSize = 1000
+
+// QueueSaveInterval is the delay after adding a publication before the modified queue is saved.
+// Publications added during the delay are saved together.
+const QueueSaveInterval = time.Second
+
+// QueuedPublication is a publication waiting to be sent
+type QueuedPublication struct {
+	Address  string `json:"address"`
+	Retained bool   `json:"retained"`
+	Message  string `json:"message"`
+}
+
+// PublishQueue buffers publications while the messenger is disconnected. The queue is bounded:
+// when full the oldest publication is dropped. A retained publication replaces the queued
+// retained publication of the same address as only the last value is kept by the server anyway.
+// The queue can be persisted to survive a restart. Added publications are saved after the
+// QueueSaveInterval, when the queue is flushed or when Save is invoked.
+type PublishQueue struct {
+	dropped      int                  // nr of publications dropped because the queue was full
+	filename     string               // file to persist the queue. "" to not persist
+	maxSize      int                  // max nr of queued publications
+	modified     bool                 // the queue was modified since it was last saved
+	publications []*QueuedPublication // publications in order of publishing
+	saveTimer    *time.Timer          // pending save of the modified queue
+	updateMutex  *sync.Mutex
+}
+
+// Add a publication to the end of the queue. If the queue is persisted then it is saved after
+// the QueueSaveInterval.
+func (queue *PublishQueue) Add(address string, retained bool, message string) {
+	queue.updateMutex.Lock()
+	defer queue.updateMutex.Unlock()
+	if retained {
+		// collapse superseded retained publications
+		publications := make([]*QueuedPublication, 0, len(queue.publications))
+		for _, publication := range queue.publications {
+			if !publication.Retained || publication.Address != address {
+				publications = append(publications, publication)
+			}
+		}
+		queue.publications = publications
+	}
+	if len(queue.publications) >= queue.maxSize {
+		logrus.Warningf("PublishQueue.Add: Queue is full. Dropping publication on %s", queue.publications[0].Address)
+		queue.publications = queue.publications[1:]
+		queue.dropped++
+	}
+	queue.publications = append(queue.publications,
+		&QueuedPublication{Address: address, Retained: retained, Message: message})
+	queue.modified = true
+	if queue.filename != "" && queue.saveTimer == nil {
+		queue.saveTimer = time.AfterFunc(QueueSaveInterval, func() {
+			if err := queue.Save(); err != nil {
+				logrus.Errorf("%s", err)
+			}
+		})
+	}
+}
+
+// Dropped returns the number of publications that were dropped because the queue was full
+func (queue *PublishQueue) Dropped() int {
+	queue.updateMutex.Lock()
+	defer queue.updateMutex.Unlock()
+	return queue.dropped
+}
+
+// Flush sends the queued publications in order. A publication is removed from the queue when
+// it is sent successfully. Flushing stops at the first error. The queue is saved once when
+// flushing ends, so publications can be sent again if the process stops while flushing.
+//  publish sends a publication
+// Returns the error of the publication that could not be sent, or nil if the queue is empty
+func (queue *PublishQueue) Flush(publish func(address string, retained bool, message string) error) error {
+	var err error
+	for {
+		queue.updateMutex.Lock()
+		if len(queue.publications) == 0 {
+			queue.updateMutex.Unlock()
+			break
+		}
+		next := queue.publications[0]
+		queue.updateMutex.Unlock()
+
+		err = publish(next.Address, next.Retained, next.Message)
+		if err != nil {
+			break
+		}
+		queue.remove(next)
+	}
+	if saveErr := queue.Save(); saveErr != nil {
+		logrus.Errorf("%s", saveErr)
+	}
+	return err
+}
+
+// Len returns the number of queued publications
+func (queue *PublishQueue) Len() int {
+	queue.updateMutex.Lock()
+	defer queue.updateMutex.Unlock()
+	return len(queue.publications)
+}
+
+// Load the queue from file, replacing the queued publications. A missing file is not an error.
+// If the file holds more than the max size of the queue then the oldest publications are dropped.
+func (queue *PublishQueue) Load() error {
+	if queue.filename == "" {
+		return nil
+	}
+	jsonText, err := ioutil.ReadFile(queue.filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("PublishQueue.Load: Unable to open file %s: %s", queue.filename, err)
+	}
+	publications := make([]*QueuedPublication, 0)
+	err = json.Unmarshal(jsonText, &publications)
+	if err != nil {
+		return fmt.Errorf("PublishQueue.Load: Error parsing JSON file %s: %v", queue.filename, err)
+	}
+	queue.updateMutex.Lock()
+	defer queue.updateMutex.Unlock()
+	if len(publications) > queue.maxSize {
+		dropCount := len(publications) - queue.maxSize
+		logrus.Warningf("PublishQueue.Load: File %s holds more than %d publications. Dropping the oldest %d",
+			queue.filename, queue.maxSize, dropCount)
+		publications = publications[dropCount:]
+		queue.dropped += dropCount
+	}
+	queue.publications = publications
+	queue.modified = false
+	logrus.Infof("PublishQueue.Load: Loaded %d queued publications from %s", len(publications), queue.filename)
+	return nil
+}
+
+// remove a publication that is sent. It might already be removed if it was superseded.
+func (queue *PublishQueue) remove(sent *QueuedPublication) {
+	queue.updateMutex.Lock()
+	defer queue.updateMutex.Unlock()
+	for index, publication := range queue.publications {
+		if publication == sent {
+			queue.publications = append(queue.publications[:index], queue.publications[index+1:]...)
+			queue.modified = true
+			break
+		}
+	}
+}
+
+// Save the queue to file if a file is configured and the queue was modified since it was last
+// saved. The queue is written to a temporary file that replaces the queue file so an interrupted
+// save doesn't corrupt it. Invoke Save before stopping to persist the most recent publications.
+func (queue *PublishQueue) Save() error {
+	queue.updateMutex.Lock()
+	defer queue.updateMutex.Unlock()
+	if queue.saveTimer != nil {
+		queue.saveTimer.Stop()
+		queue.saveTimer = nil
+	}
+	if queue.filename == "" || !queue.modified {
+		return nil
+	}
+	jsonText, err := json.Marshal(queue.publications)
+	if err != nil {
+		return fmt.Errorf("PublishQueue.Save: Error marshalling queue: %v", err)
+	}
+	tmpFilename := queue.filename + ".tmp"
+	err = ioutil.WriteFile(tmpFilename, jsonText, 0600)
+	if err == nil {
+		err = os.Rename(tmpFilename, queue.filename)
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return fmt.Errorf("PublishQueue.Save: Error saving queue to %s: %v", queue.filename, err)
+	}
+	queue.modified = false
+	return nil
+}
+
+// NewPublishQueue creates a new queue for publications
+//  filename to persist the queue. Use "" to not persist.
+//  maxSize is the maximum number of queued publications. Use 0 for the DefaultQueueSize.
+func NewPublishQueue(filename string, maxSize int) *PublishQueue {
+	if maxSize <= 0 {
+		maxSize = DefaultQueueSize
+	}
+	queue := &PublishQueue{
+		filename:     filename,
+		maxSize:      maxSize,
+		publications: make([]*QueuedPublication, 0),
+		updateMutex:  &sync.Mutex{},
+	}
+	return queue
+}
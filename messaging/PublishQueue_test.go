@@ -0,0 +1,115 @@
+package messaging_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishQueue(t *testing.T) {
+	queue := messaging.NewPublishQueue("", 3)
+	queue.Add("domain1/pub1/node1/temperature/0/$latest", true, "20")
+	queue.Add("domain1/pub1/node1/$node", false, "node1")
+	queue.Add("domain1/pub1/node1/temperature/0/$latest", true, "21")
+	assert.Equal(t, 2, queue.Len(), "Superseded retained publication not collapsed")
+
+	// the oldest publication is dropped when full
+	queue.Add("domain1/pub1/node1/$event", false, "event1")
+	queue.Add("domain1/pub1/node1/$event", false, "event2")
+	assert.Equal(t, 3, queue.Len())
+	assert.Equal(t, 1, queue.Dropped())
+
+	// flush in order and stop at the first error
+	sent := make([]string, 0)
+	err := queue.Flush(func(address string, retained bool, message string) error {
+		if len(sent) == 2 {
+			return errors.New("connection lost")
+		}
+		sent = append(sent, message)
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"21", "event1"}, sent)
+	assert.Equal(t, 1, queue.Len())
+
+	err = queue.Flush(func(address string, retained bool, message string) error {
+		sent = append(sent, message)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"21", "event1", "event2"}, sent)
+	assert.Equal(t, 0, queue.Len())
+}
+
+func TestPublishQueuePersistence(t *testing.T) {
+	tempFolder, _ := ioutil.TempDir("", "messaging")
+	defer os.RemoveAll(tempFolder)
+	queueFile := path.Join(tempFolder, "queue.json")
+
+	queue := messaging.NewPublishQueue(queueFile, 0)
+	err := queue.Load()
+	assert.NoError(t, err, "Missing queue file is not an error")
+	queue.Add("domain1/pub1/node1/$node", true, "node1")
+	queue.Add("domain1/pub1/node1/$event", false, "event1")
+	_, err = os.Stat(queueFile)
+	assert.True(t, os.IsNotExist(err), "Queue saved on each publication")
+	err = queue.Save()
+	require.NoError(t, err)
+
+	queue2 := messaging.NewPublishQueue(queueFile, 0)
+	err = queue2.Load()
+	require.NoError(t, err)
+	assert.Equal(t, 2, queue2.Len())
+	queue2.Flush(func(address string, retained bool, message string) error {
+		return nil
+	})
+	queue3 := messaging.NewPublishQueue(queueFile, 0)
+	queue3.Load()
+	assert.Equal(t, 0, queue3.Len())
+	_, err = os.Stat(queueFile + ".tmp")
+	assert.True(t, os.IsNotExist(err), "Temporary queue file not replaced")
+
+	// loading a queue file larger than the max size keeps the newest publications
+	queue.Add("domain1/pub1/node1/$event", false, "event2")
+	queue.Add("domain1/pub1/node1/$event", false, "event3")
+	queue.Save()
+	queue5 := messaging.NewPublishQueue(queueFile, 1)
+	err = queue5.Load()
+	require.NoError(t, err)
+	assert.Equal(t, 1, queue5.Len())
+	assert.Equal(t, 3, queue5.Dropped())
+
+	// invalid queue file
+	ioutil.WriteFile(queueFile, []byte("not json"), 0600)
+	err = queue3.Load()
+	assert.Error(t, err)
+	queue4 := messaging.NewPublishQueue(path.Join(tempFolder, "missing", "queue.json"), 0)
+	queue4.Add("domain1/pub1/node1/$node", true, "node1")
+	err = queue4.Save()
+	assert.Error(t, err)
+}
+
+// TestPublishQueueSaveInterval saves added publications once after the save interval
+func TestPublishQueueSaveInterval(t *testing.T) {
+	tempFolder, _ := ioutil.TempDir("", "messaging")
+	defer os.RemoveAll(tempFolder)
+	queueFile := path.Join(tempFolder, "queue.json")
+
+	queue := messaging.NewPublishQueue(queueFile, 0)
+	for i := 0; i < 100; i++ {
+		queue.Add("domain1/pub1/node1/$event", false, "event")
+	}
+	time.Sleep(2 * messaging.QueueSaveInterval)
+
+	queue2 := messaging.NewPublishQueue(queueFile, 0)
+	err := queue2.Load()
+	require.NoError(t, err)
+	assert.Equal(t, 100, queue2.Len())
+}
@@ -0,0 +1,142 @@
+// Package messaging with a messenger that records the messages of another messenger
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Directions of recorded messages
+const (
+	RecordPublish = "publish" // message published by the application
+	RecordReceive = "receive" // message received by a subscription of the application
+)
+
+// RecordedMessage is a message in a recording. A recording is a JSON-lines file with one message
+// per line in the order they are published or received.
+type RecordedMessage struct {
+	Address      string    `json:"address"`
+	Direction    string    `json:"direction"`              // RecordPublish or RecordReceive
+	Message      string    `json:"message"`                // message as published, eg signed and encrypted
+	Retained     bool      `json:"retained,omitempty"`     // published as retained message
+	Subscription string    `json:"subscription,omitempty"` // address of the subscription that received the message
+	Timestamp    time.Time `json:"timestamp"`              // time the message was published or received
+}
+
+// RecordingMessenger records the messages that are published and received through another messenger
+// to a file, so that the traffic can be replayed with the ReplayMessenger. A message that is
+// received by multiple subscriptions is recorded for each subscription.
+// Note that the recording contains the messages as they are sent, which can include confidential
+// information that is not encrypted.
+type RecordingMessenger struct {
+	encoder     *json.Encoder // writes recorded messages to file
+	file        *os.File      // recording file
+	messenger   IMessenger    // messenger whose messages are recorded
+	updateMutex *sync.Mutex
+}
+
+// Close the recording file. Messages are no longer recorded.
+func (recorder *RecordingMessenger) Close() error {
+	recorder.updateMutex.Lock()
+	defer recorder.updateMutex.Unlock()
+	if recorder.file == nil {
+		return nil
+	}
+	err := recorder.file.Sync()
+	if closeErr := recorder.file.Close(); err == nil {
+		err = closeErr
+	}
+	recorder.file = nil
+	recorder.encoder = nil
+	return err
+}
+
+// Connect the messenger
+func (recorder *RecordingMessenger) Connect(ctx context.Context, lastWillAddress string, lastWillValue string) error {
+	return recorder.messenger.Connect(ctx, lastWillAddress, lastWillValue)
+}
+
+// ConnectionState returns the current connection state of the messenger
+func (recorder *RecordingMessenger) ConnectionState() ConnectionState {
+	return recorder.messenger.ConnectionState()
+}
+
+// Disconnect the messenger and close the recording file. Messages are no longer recorded.
+func (recorder *RecordingMessenger) Disconnect() {
+	recorder.messenger.Disconnect()
+	err := recorder.Close()
+	if err != nil {
+		logrus.Errorf("RecordingMessenger.Disconnect: Unable to close the recording: %s", err)
+	}
+}
+
+// Publish and record a message
+func (recorder *RecordingMessenger) Publish(address string, retained bool, message string) error {
+	recorder.record(&RecordedMessage{
+		Address: address, Direction: RecordPublish, Message: message, Retained: retained, Timestamp: time.Now(),
+	})
+	return recorder.messenger.Publish(address, retained, message)
+}
+
+// SetConnectionHandler sets the handler that is invoked when the connection state changes
+func (recorder *RecordingMessenger) SetConnectionHandler(handler func(state ConnectionState)) {
+	recorder.messenger.SetConnectionHandler(handler)
+}
+
+// Subscribe to a message by address. Received messages are recorded before they are passed to
+// the handler.
+func (recorder *RecordingMessenger) Subscribe(
+	address string, onMessage func(address string, message string) error) SubscriptionHandle {
+
+	return recorder.messenger.Subscribe(address, func(rxAddress string, message string) error {
+		recorder.record(&RecordedMessage{
+			Address: rxAddress, Direction: RecordReceive, Message: message, Subscription: address, Timestamp: time.Now(),
+		})
+		if onMessage == nil {
+			return nil
+		}
+		return onMessage(rxAddress, message)
+	})
+}
+
+// Unsubscribe a subscription using the handle returned by Subscribe
+func (recorder *RecordingMessenger) Unsubscribe(handle SubscriptionHandle) {
+	recorder.messenger.Unsubscribe(handle)
+}
+
+// record a message. Errors are logged as they must not affect the messaging.
+func (recorder *RecordingMessenger) record(recordedMessage *RecordedMessage) {
+	recorder.updateMutex.Lock()
+	defer recorder.updateMutex.Unlock()
+	if recorder.encoder == nil {
+		return
+	}
+	err := recorder.encoder.Encode(recordedMessage)
+	if err != nil {
+		logrus.Errorf("RecordingMessenger.record: Unable to record message on %s: %s", recordedMessage.Address, err)
+	}
+}
+
+// NewRecordingMessenger creates a messenger that records the messages of another messenger
+//  messenger whose messages to record
+//  filename of the recording. Messages are appended if the file exists.
+// Returns an error if the recording file cannot be opened
+func NewRecordingMessenger(messenger IMessenger, filename string) (*RecordingMessenger, error) {
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("NewRecordingMessenger: Unable to open recording %s: %s", filename, err)
+	}
+	recorder := &RecordingMessenger{
+		encoder:     json.NewEncoder(file),
+		file:        file,
+		messenger:   messenger,
+		updateMutex: &sync.Mutex{},
+	}
+	return recorder, nil
+}
@@ -0,0 +1,81 @@
+package messaging_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordReplay(t *testing.T) {
+	const node1Addr = "domain1/pub1/node1/$node"
+	const set1Addr = "domain1/pub1/node1/switch/0/$set"
+	folder, _ := ioutil.TempDir("", "recording")
+	defer os.RemoveAll(folder)
+	filename := path.Join(folder, "recording.jsonl")
+
+	// record the publications and the messages received by each subscription
+	recorder, err := messaging.NewRecordingMessenger(messaging.NewDummyMessenger(nil), filename)
+	require.NoError(t, err)
+	err = recorder.Connect(context.Background(), "", "")
+	require.NoError(t, err)
+	recorder.Subscribe("domain1/+/+/switch/0/$set", nil)
+	recorder.Subscribe("domain1/#", nil)
+	recorder.Publish(node1Addr, true, "node1")
+	time.Sleep(100 * time.Millisecond)
+	recorder.Publish(set1Addr, false, "on")
+	// disconnect closes the recording
+	recorder.Disconnect()
+	recorder.Publish(set1Addr, false, "off")
+	err = recorder.Close()
+	assert.NoError(t, err)
+
+	recording, err := messaging.LoadRecording(filename)
+	require.NoError(t, err)
+	require.Len(t, recording, 5)
+	assert.Equal(t, messaging.RecordPublish, recording[0].Direction)
+	assert.True(t, recording[0].Retained)
+	assert.Equal(t, messaging.RecordReceive, recording[1].Direction)
+	assert.Equal(t, "domain1/#", recording[1].Subscription)
+
+	// replay the received messages to the subscriptions that received them
+	replayer := messaging.NewReplayMessenger(recording)
+	err = replayer.Connect(context.Background(), "", "")
+	require.NoError(t, err)
+	received := make([]string, 0)
+	replayer.Subscribe("domain1/#", func(address string, message string) error {
+		received = append(received, message)
+		return replayer.Publish(address+"/ack", false, message)
+	})
+	start := time.Now()
+	err = replayer.Replay(context.Background(), 2)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(40*time.Millisecond), "Timing not replayed")
+	assert.Equal(t, []string{"node1", "on"}, received)
+	assert.Len(t, replayer.Publications(), 2)
+
+	// without timing, and stopped by the context
+	received = make([]string, 0)
+	err = replayer.Replay(context.Background(), 0)
+	assert.NoError(t, err)
+	assert.Len(t, received, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = replayer.Replay(ctx, 1)
+	assert.Error(t, err)
+
+	// invalid recordings
+	_, err = messaging.LoadRecording(path.Join(folder, "missing.jsonl"))
+	assert.Error(t, err)
+	ioutil.WriteFile(filename, []byte("{not json"), 0600)
+	_, err = messaging.LoadRecording(filename)
+	assert.Error(t, err)
+	_, err = messaging.NewRecordingMessenger(nil, path.Join(folder, "missing", "recording.jsonl"))
+	assert.Error(t, err)
+}
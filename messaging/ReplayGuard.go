@@ -0,0 +1,218 @@
+// Package messaging with protection against replay of commands
+package messaging
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultReplayWindow is the default maximum difference between the timestamp of a command and the
+// clock of the receiver
+const DefaultReplayWindow = 5 * time.Minute
+
+// DefaultReplayMaxEntries is the default maximum number of sender and address combinations that
+// are tracked
+const DefaultReplayMaxEntries = 10000
+
+// replayEntry with the most recent message of a sender to an address
+type replayEntry struct {
+	Timestamp time.Time `json:"timestamp"` // timestamp of the most recent message
+	Digests   []string  `json:"digests"`   // digests of the messages received with this timestamp
+}
+
+// ReplayGuard protects against replay of messages. A message is rejected when its timestamp is outside
+// the window around the current time, when it is older than the last message of the same sender to
+// the same address, or when the same message was already received.
+// The state can be persisted so that protection continues across restarts.
+// The number of tracked sender and address combinations is limited. Entries outside the window are
+// removed first. If that isn't sufficient, for example when the window is disabled, the entries
+// with the oldest messages are removed.
+type ReplayGuard struct {
+	filename    string                  // file to persist the state. "" to not persist
+	maxEntries  int                     // max nr of entries in lastSeen
+	orderOnly   bool                    // accept duplicate messages, only reject older messages
+	permissive  bool                    // accept all messages, for replaying recordings
+	window      time.Duration           // max difference between message timestamp and now. 0 to disable
+	lastSeen    map[string]*replayEntry // most recent messages by sender and address
+	updated     bool                    // state has changed since it was saved
+	updateMutex *sync.Mutex
+}
+
+// Check verifies that a message is not a replay and records it as received
+//  sender is the address of the sender of the message
+//  address the message is published on
+//  timestamp of the message in types.TimeFormat
+//  message is the signed message, used to detect duplicates with the same timestamp
+// Returns an error if the message must be discarded
+func (guard *ReplayGuard) Check(sender string, address string, timestamp string, message string) error {
+	if guard.permissive {
+		return nil
+	}
+	msgTime, err := time.Parse(types.TimeFormat, timestamp)
+	if err != nil {
+		return fmt.Errorf("ReplayGuard.Check: Invalid timestamp '%s' in message from %s to %s", timestamp, sender, address)
+	}
+	if guard.window > 0 {
+		age := time.Since(msgTime)
+		if age > guard.window || age < -guard.window {
+			return fmt.Errorf("ReplayGuard.Check: Timestamp %s of message from %s to %s is outside the window of %s",
+				timestamp, sender, address, guard.window)
+		}
+	}
+	hash := sha256.Sum256([]byte(message))
+	digest := base64.StdEncoding.EncodeToString(hash[:])
+	key := sender + " " + address
+
+	guard.updateMutex.Lock()
+	defer guard.updateMutex.Unlock()
+	entry := guard.lastSeen[key]
+	if entry != nil {
+		if msgTime.Before(entry.Timestamp) {
+			return fmt.Errorf("ReplayGuard.Check: Message from %s to %s is older than the last message",
+				sender, address)
+		} else if msgTime.Equal(entry.Timestamp) {
+			if guard.orderOnly {
+				return nil
+			}
+			for _, seenDigest := range entry.Digests {
+				if seenDigest == digest {
+					return fmt.Errorf("ReplayGuard.Check: Duplicate message from %s to %s", sender, address)
+				}
+			}
+			entry.Digests = append(entry.Digests, digest)
+			guard.updated = true
+			return nil
+		}
+	}
+	if entry == nil && len(guard.lastSeen) >= guard.maxEntries {
+		guard.prune(guard.maxEntries - guard.maxEntries/10 - 1)
+	}
+	guard.lastSeen[key] = &replayEntry{Timestamp: msgTime, Digests: []string{digest}}
+	guard.updated = true
+	return nil
+}
+
+// SetMaxEntries sets the maximum number of sender and address combinations that are tracked.
+// The default is DefaultReplayMaxEntries.
+func (guard *ReplayGuard) SetMaxEntries(maxEntries int) {
+	guard.updateMutex.Lock()
+	defer guard.updateMutex.Unlock()
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	guard.maxEntries = maxEntries
+	guard.prune(maxEntries)
+}
+
+// Load the state from file. Existing state is replaced.
+func (guard *ReplayGuard) Load() error {
+	if guard.filename == "" {
+		return nil
+	}
+	jsonText, err := ioutil.ReadFile(guard.filename)
+	if err != nil {
+		return fmt.Errorf("ReplayGuard.Load: Unable to open file %s: %s", guard.filename, err)
+	}
+	lastSeen := make(map[string]*replayEntry)
+	err = json.Unmarshal(jsonText, &lastSeen)
+	if err != nil {
+		return fmt.Errorf("ReplayGuard.Load: Error parsing JSON file %s: %v", guard.filename, err)
+	}
+	guard.updateMutex.Lock()
+	defer guard.updateMutex.Unlock()
+	guard.lastSeen = lastSeen
+	guard.updated = false
+	guard.prune(guard.maxEntries)
+	return nil
+}
+
+// Save the state to file if it has changed. Entries that are outside the window are removed as
+// their messages are rejected anyway.
+func (guard *ReplayGuard) Save() error {
+	guard.updateMutex.Lock()
+	defer guard.updateMutex.Unlock()
+	if guard.filename == "" || !guard.updated {
+		return nil
+	}
+	guard.prune(guard.maxEntries)
+	jsonText, err := json.MarshalIndent(guard.lastSeen, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ReplayGuard.Save: Error marshalling state: %v", err)
+	}
+	err = ioutil.WriteFile(guard.filename, jsonText, 0600)
+	if err != nil {
+		return fmt.Errorf("ReplayGuard.Save: Error saving state to %s: %v", guard.filename, err)
+	}
+	logrus.Infof("ReplayGuard.Save: Saved %d entries to %s", len(guard.lastSeen), guard.filename)
+	guard.updated = false
+	return nil
+}
+
+// prune removes the entries that are outside the window and, if more than maxEntries remain, the
+// entries with the oldest messages. The caller must hold the lock.
+func (guard *ReplayGuard) prune(maxEntries int) {
+	if guard.window > 0 {
+		for key, entry := range guard.lastSeen {
+			if time.Since(entry.Timestamp) > guard.window {
+				delete(guard.lastSeen, key)
+				guard.updated = true
+			}
+		}
+	}
+	if len(guard.lastSeen) <= maxEntries {
+		return
+	}
+	keys := make([]string, 0, len(guard.lastSeen))
+	for key := range guard.lastSeen {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return guard.lastSeen[keys[i]].Timestamp.Before(guard.lastSeen[keys[j]].Timestamp)
+	})
+	for _, key := range keys[:len(keys)-maxEntries] {
+		delete(guard.lastSeen, key)
+	}
+	guard.updated = true
+}
+
+// NewPermissiveReplayGuard creates a replay guard that accepts all messages. This disables the
+// protection against replay of commands and is only intended for replaying a recording with the
+// ReplayMessenger, whose commands have old timestamps and were already received.
+func NewPermissiveReplayGuard() *ReplayGuard {
+	guard := NewReplayGuard("", 0)
+	guard.permissive = true
+	return guard
+}
+
+// NewOrderReplayGuard creates a replay guard that only rejects messages that are older than the
+// last message of the same sender to the same address. Duplicate messages are accepted. Intended
+// for retained outputs that are delivered again when resubscribing.
+func NewOrderReplayGuard() *ReplayGuard {
+	guard := NewReplayGuard("", 0)
+	guard.orderOnly = true
+	return guard
+}
+
+// NewReplayGuard creates a new instance of protection against replay of messages
+//  filename to persist the state. Use "" to not persist.
+//  window is the max difference between a message timestamp and the current time. Use 0 to only
+//  check the order of messages.
+func NewReplayGuard(filename string, window time.Duration) *ReplayGuard {
+	guard := &ReplayGuard{
+		filename:    filename,
+		maxEntries:  DefaultReplayMaxEntries,
+		window:      window,
+		lastSeen:    make(map[string]*replayEntry),
+		updateMutex: &sync.Mutex{},
+	}
+	return guard
+}
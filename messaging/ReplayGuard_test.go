@@ -0,0 +1,101 @@
+package messaging_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayGuard(t *testing.T) {
+	const sender = "test/publisher2/$identity"
+	const address = "test/publisher1/node1/$configure"
+	tempFolder, _ := ioutil.TempDir("", "messaging")
+	defer os.RemoveAll(tempFolder)
+	replayFile := path.Join(tempFolder, "replay.json")
+
+	guard := messaging.NewReplayGuard(replayFile, time.Minute)
+	now := time.Now()
+	timestamp := now.Format(types.TimeFormat)
+	err := guard.Check(sender, address, timestamp, "message1")
+	assert.NoError(t, err)
+	// duplicate message is rejected, different message with the same timestamp is accepted
+	err = guard.Check(sender, address, timestamp, "message1")
+	assert.Error(t, err)
+	err = guard.Check(sender, address, timestamp, "message2")
+	assert.NoError(t, err)
+	// older message is rejected, unless it is for another address or from another sender
+	older := now.Add(-time.Second).Format(types.TimeFormat)
+	err = guard.Check(sender, address, older, "message3")
+	assert.Error(t, err)
+	err = guard.Check(sender, "test/publisher1/node2/$configure", older, "message3")
+	assert.NoError(t, err)
+	err = guard.Check("test/publisher3/$identity", address, older, "message3")
+	assert.NoError(t, err)
+	// messages outside the window are rejected
+	err = guard.Check(sender, address, now.Add(-2*time.Minute).Format(types.TimeFormat), "message4")
+	assert.Error(t, err)
+	err = guard.Check(sender, address, now.Add(2*time.Minute).Format(types.TimeFormat), "message4")
+	assert.Error(t, err)
+	err = guard.Check(sender, address, "notatimestamp", "message4")
+	assert.Error(t, err)
+
+	// the state survives a restart
+	err = guard.Save()
+	require.NoError(t, err)
+	guard2 := messaging.NewReplayGuard(replayFile, time.Minute)
+	err = guard2.Load()
+	require.NoError(t, err)
+	err = guard2.Check(sender, address, timestamp, "message1")
+	assert.Error(t, err)
+	err = guard2.Check(sender, address, older, "message3")
+	assert.Error(t, err)
+
+	// without a window only the order is verified
+	guard3 := messaging.NewReplayGuard("", 0)
+	err = guard3.Check(sender, address, now.Add(-time.Hour).Format(types.TimeFormat), "message1")
+	assert.NoError(t, err)
+	err = guard3.Load()
+	assert.NoError(t, err)
+	err = guard3.Save()
+	assert.NoError(t, err)
+
+	// the number of entries is limited, the entries with the oldest messages are removed first
+	guard3.SetMaxEntries(2)
+	for i, addr := range []string{"node1", "node2", "node3"} {
+		msgTime := now.Add(time.Duration(i) * time.Second).Format(types.TimeFormat)
+		err = guard3.Check(sender, addr, msgTime, "message1")
+		assert.NoError(t, err)
+	}
+	err = guard3.Check(sender, "node1", now.Format(types.TimeFormat), "message1")
+	assert.NoError(t, err)
+	err = guard3.Check(sender, "node3", now.Add(2*time.Second).Format(types.TimeFormat), "message1")
+	assert.Error(t, err)
+
+	// a permissive guard accepts replayed messages
+	guard5 := messaging.NewPermissiveReplayGuard()
+	err = guard5.Check(sender, address, timestamp, "message1")
+	assert.NoError(t, err)
+	err = guard5.Check(sender, address, now.Add(-time.Hour).Format(types.TimeFormat), "message1")
+	assert.NoError(t, err)
+
+	// an order only guard accepts duplicates but rejects older messages
+	guard6 := messaging.NewOrderReplayGuard()
+	err = guard6.Check(sender, address, timestamp, "message1")
+	assert.NoError(t, err)
+	err = guard6.Check(sender, address, timestamp, "message1")
+	assert.NoError(t, err)
+	err = guard6.Check(sender, address, now.Add(-time.Hour).Format(types.TimeFormat), "message1")
+	assert.Error(t, err)
+
+	// missing file
+	guard4 := messaging.NewReplayGuard(path.Join(tempFolder, "missing.json"), time.Minute)
+	err = guard4.Load()
+	assert.Error(t, err)
+}
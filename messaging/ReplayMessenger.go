@@ -0,0 +1,198 @@
+// Package messaging with a messenger that replays a recording
+package messaging
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/mqttpacket"
+	"github.com/sirupsen/logrus"
+)
+
+// maxRecordedMessageSize is the max size of a line in a recording
+const maxRecordedMessageSize = 16 * 1024 * 1024
+
+// ReplayMessenger feeds the received messages of a recording made with the RecordingMessenger to
+// its subscribers, to reproduce the traffic seen by a publisher or consumer. Messages published
+// during the replay are kept for comparison with the recorded publications.
+type ReplayMessenger struct {
+	lastHandle    SubscriptionHandle // handle of the last subscription
+	publications  []RecordedMessage  // messages published during the replay
+	recording     []RecordedMessage  // messages to replay
+	status        *connectionStatus
+	subscriptions []Subscription
+	updateMutex   *sync.Mutex
+}
+
+// Connect the messenger. The last will is ignored.
+func (replayer *ReplayMessenger) Connect(ctx context.Context, lastWillAddress string, lastWillValue string) error {
+	replayer.status.set(ConnectionStateConnected)
+	return nil
+}
+
+// ConnectionState returns the current connection state
+func (replayer *ReplayMessenger) ConnectionState() ConnectionState {
+	return replayer.status.get()
+}
+
+// Disconnect the messenger
+func (replayer *ReplayMessenger) Disconnect() {
+	replayer.status.set(ConnectionStateDisconnected)
+}
+
+// Publications returns the messages that are published since the messenger was created
+func (replayer *ReplayMessenger) Publications() []RecordedMessage {
+	replayer.updateMutex.Lock()
+	defer replayer.updateMutex.Unlock()
+	publications := make([]RecordedMessage, len(replayer.publications))
+	copy(publications, replayer.publications)
+	return publications
+}
+
+// Publish a message. The message is kept and not delivered to the subscribers.
+func (replayer *ReplayMessenger) Publish(address string, retained bool, message string) error {
+	replayer.updateMutex.Lock()
+	defer replayer.updateMutex.Unlock()
+	replayer.publications = append(replayer.publications, RecordedMessage{
+		Address: address, Direction: RecordPublish, Message: message, Retained: retained, Timestamp: time.Now(),
+	})
+	return nil
+}
+
+// Replay the received messages of the recording to the subscribers, in the order they were received.
+// A message that was recorded with the address of its subscription is passed to the subscriptions
+// with the same address, otherwise to all subscriptions that match the message address.
+//  ctx to stop the replay
+//  speed of the replay relative to the original timing, eg 1 for the original timing and 10 to
+//  replay 10 times faster. Use 0 to replay without waiting.
+// Recorded commands are rejected by the replay protection of the receiver as their timestamps are
+// old and they might already have been received. To replay commands, install a permissive replay
+// guard on the receiver before replaying, eg: signer.SetReplayGuard(NewPermissiveReplayGuard()) or
+// publisher.SetReplayGuard(messaging.NewPermissiveReplayGuard()).
+// Returns an error if ctx is done before all messages are replayed
+func (replayer *ReplayMessenger) Replay(ctx context.Context, speed float64) error {
+	var lastTimestamp time.Time
+	for _, recordedMessage := range replayer.recording {
+		if recordedMessage.Direction != RecordReceive {
+			continue
+		}
+		delay := time.Duration(0)
+		if speed > 0 && !lastTimestamp.IsZero() {
+			delay = time.Duration(float64(recordedMessage.Timestamp.Sub(lastTimestamp)) / speed)
+		}
+		lastTimestamp = recordedMessage.Timestamp
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return fmt.Errorf("ReplayMessenger.Replay: Replay stopped: %s", ctx.Err())
+			}
+		} else if ctx.Err() != nil {
+			return fmt.Errorf("ReplayMessenger.Replay: Replay stopped: %s", ctx.Err())
+		}
+		replayer.deliver(&recordedMessage)
+	}
+	return nil
+}
+
+// SetConnectionHandler sets the handler that is invoked when the connection state changes
+func (replayer *ReplayMessenger) SetConnectionHandler(handler func(state ConnectionState)) {
+	replayer.status.setHandler(handler)
+}
+
+// Subscribe to a message by address
+// Returns the handle to unsubscribe with
+func (replayer *ReplayMessenger) Subscribe(
+	address string, onMessage func(address string, message string) error) SubscriptionHandle {
+
+	replayer.updateMutex.Lock()
+	defer replayer.updateMutex.Unlock()
+	replayer.lastHandle++
+	replayer.subscriptions = append(replayer.subscriptions,
+		Subscription{address: address, handle: replayer.lastHandle, handler: onMessage})
+	return replayer.lastHandle
+}
+
+// Unsubscribe a subscription using the handle returned by Subscribe
+func (replayer *ReplayMessenger) Unsubscribe(handle SubscriptionHandle) {
+	replayer.updateMutex.Lock()
+	defer replayer.updateMutex.Unlock()
+	for i, sub := range replayer.subscriptions {
+		if sub.handle == handle {
+			subscriptions := make([]Subscription, 0, len(replayer.subscriptions)-1)
+			subscriptions = append(subscriptions, replayer.subscriptions[:i]...)
+			replayer.subscriptions = append(subscriptions, replayer.subscriptions[i+1:]...)
+			break
+		}
+	}
+}
+
+// deliver a recorded message to the subscriptions
+func (replayer *ReplayMessenger) deliver(recordedMessage *RecordedMessage) {
+	replayer.updateMutex.Lock()
+	subs := replayer.subscriptions
+	replayer.updateMutex.Unlock()
+
+	for _, subscription := range subs {
+		if subscription.handler == nil {
+			continue
+		} else if recordedMessage.Subscription != "" && recordedMessage.Subscription != subscription.address {
+			continue
+		} else if !mqttpacket.MatchTopic(recordedMessage.Address, subscription.address) {
+			continue
+		}
+		err := subscription.handler(recordedMessage.Address, recordedMessage.Message)
+		if err != nil {
+			logrus.Infof("ReplayMessenger.deliver: Handler of %s: %s", recordedMessage.Address, err)
+		}
+	}
+}
+
+// LoadRecording loads the messages of a recording made with the RecordingMessenger
+// Returns the messages in the order they were recorded, or an error if the file cannot be read
+func LoadRecording(filename string) ([]RecordedMessage, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("LoadRecording: Unable to open recording %s: %s", filename, err)
+	}
+	defer file.Close()
+
+	recording := make([]RecordedMessage, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordedMessageSize)
+	lineNr := 0
+	for scanner.Scan() {
+		lineNr++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		recordedMessage := RecordedMessage{}
+		err = json.Unmarshal(scanner.Bytes(), &recordedMessage)
+		if err != nil {
+			return nil, fmt.Errorf("LoadRecording: Error parsing line %d of %s: %s", lineNr, filename, err)
+		}
+		recording = append(recording, recordedMessage)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("LoadRecording: Error reading recording %s: %s", filename, err)
+	}
+	return recording, nil
+}
+
+// NewReplayMessenger creates a messenger that replays a recording to its subscribers
+//  recording with the messages to replay, see LoadRecording
+func NewReplayMessenger(recording []RecordedMessage) *ReplayMessenger {
+	replayer := &ReplayMessenger{
+		publications:  make([]RecordedMessage, 0),
+		recording:     recording,
+		status:        newConnectionStatus(),
+		subscriptions: make([]Subscription, 0),
+		updateMutex:   &sync.Mutex{},
+	}
+	return replayer
+}
@@ -2,14 +2,26 @@
 package messaging
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"math/big"
 )
 
+// Key algorithms supported for signing. The algorithm names are the JWS algorithm names used in
+// signed messages.
+const (
+	KeyAlgorithmES256 = "ES256" // ECDSA using P-256 and SHA-256. Default.
+	KeyAlgorithmES384 = "ES384" // ECDSA using P-384 and SHA-384
+	KeyAlgorithmEdDSA = "EdDSA" // Ed25519. These keys can sign but not decrypt messages, including commands and acks.
+)
+
 // ECDSASignature ...
 type ECDSASignature struct {
 	R, S *big.Int
@@ -24,45 +36,145 @@ func CreateAsymKeys() *ecdsa.PrivateKey {
 	return privKey
 }
 
-// PrivateKeyFromPem converts PEM encoded private keys into a ECDSA object for use in the application
-// See also PrivateKeyToPem for the opposite.
-// Returns nil if the encoded pem source isn't a pem format
-func PrivateKeyFromPem(pemEncodedPriv string) *ecdsa.PrivateKey {
-	if pemEncodedPriv == "" {
-		return nil
+// CreateKeys creates a private key for the given key algorithm
+//  algorithm is one of KeyAlgorithmES256, KeyAlgorithmES384 or KeyAlgorithmEdDSA. Default is ES256.
+// Returns the private key or an error if the algorithm is not supported
+func CreateKeys(algorithm string) (crypto.PrivateKey, error) {
+	switch algorithm {
+	case "", KeyAlgorithmES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyAlgorithmES384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyAlgorithmEdDSA:
+		_, privKey, err := ed25519.GenerateKey(rand.Reader)
+		return privKey, err
+	}
+	return nil, fmt.Errorf("CreateKeys: Unsupported key algorithm '%s'", algorithm)
+}
+
+// GetKeyAlgorithm returns the algorithm of a private or public key
+// Returns "" if the key type is not supported
+func GetKeyAlgorithm(key interface{}) string {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		if k != nil {
+			return GetKeyAlgorithm(&k.PublicKey)
+		}
+	case *ecdsa.PublicKey:
+		if k == nil || k.Curve == nil {
+			return ""
+		} else if k.Curve == elliptic.P256() {
+			return KeyAlgorithmES256
+		} else if k.Curve == elliptic.P384() {
+			return KeyAlgorithmES384
+		}
+	case ed25519.PrivateKey:
+		if len(k) == ed25519.PrivateKeySize {
+			return KeyAlgorithmEdDSA
+		}
+	case ed25519.PublicKey:
+		if len(k) == ed25519.PublicKeySize {
+			return KeyAlgorithmEdDSA
+		}
 	}
+	return ""
+}
+
+// GetPublicKeyOf returns the public key that belongs to the private key
+// Returns nil if the key type is not supported
+func GetPublicKeyOf(privateKey crypto.PrivateKey) crypto.PublicKey {
+	switch k := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		if k != nil {
+			return &k.PublicKey
+		}
+	case ed25519.PrivateKey:
+		if len(k) == ed25519.PrivateKeySize {
+			return k.Public()
+		}
+	}
+	return nil
+}
+
+// ParsePrivateKeyPem converts a PEM encoded private key into a key object
+// ECDSA keys are in the EC format, Ed25519 keys in the PKCS#8 format.
+// Returns an error if the pem source isn't a PEM encoded ECDSA or Ed25519 private key
+func ParsePrivateKeyPem(pemEncodedPriv string) (crypto.PrivateKey, error) {
 	block, _ := pem.Decode([]byte(pemEncodedPriv))
-	x509Encoded := block.Bytes
-	privateKey, _ := x509.ParseECPrivateKey(x509Encoded)
+	if block == nil {
+		return nil, errors.New("ParsePrivateKeyPem: Private key is not PEM encoded")
+	}
+	ecdsaKey, err := x509.ParseECPrivateKey(block.Bytes)
+	if err == nil {
+		return ecdsaKey, nil
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("ParsePrivateKeyPem: Invalid private key: %s", err)
+	} else if GetKeyAlgorithm(privateKey) == "" {
+		return nil, fmt.Errorf("ParsePrivateKeyPem: Unsupported private key type %T", privateKey)
+	}
+	return privateKey, nil
+}
 
+// PrivateKeyFromPem converts PEM encoded private keys into a key object for use in the application
+// See also PrivateKeyToPem for the opposite and ParsePrivateKeyPem for the reason of failure.
+// Returns nil if the encoded pem source isn't a pem format
+func PrivateKeyFromPem(pemEncodedPriv string) crypto.PrivateKey {
+	privateKey, _ := ParsePrivateKeyPem(pemEncodedPriv)
 	return privateKey
 }
 
 // PrivateKeyToPem converts a private key into their PEM encoded ascii format
 // see also https://stackoverflow.com/questions/21322182/how-to-store-ecdsa-private-key-in-go
-func PrivateKeyToPem(privateKey *ecdsa.PrivateKey) string {
-	x509Encoded, _ := x509.MarshalECPrivateKey(privateKey)
+func PrivateKeyToPem(privateKey crypto.PrivateKey) string {
+	var x509Encoded []byte
+	if ecdsaKey, isEcdsa := privateKey.(*ecdsa.PrivateKey); isEcdsa {
+		x509Encoded, _ = x509.MarshalECPrivateKey(ecdsaKey)
+	} else {
+		x509Encoded, _ = x509.MarshalPKCS8PrivateKey(privateKey)
+	}
 	pemEncoded := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: x509Encoded})
 
 	return string(pemEncoded)
 }
 
-// PublicKeyFromPem converts a ascii encoded public key into a ECDSA public key
-func PublicKeyFromPem(pemEncodedPub string) *ecdsa.PublicKey {
-	if pemEncodedPub == "" {
-		return nil
+// isSameKey returns true if both private keys are the same key. Ed25519 keys are slices which
+// cannot be compared directly.
+func isSameKey(key1 crypto.PrivateKey, key2 crypto.PrivateKey) bool {
+	if key1 == nil || key2 == nil {
+		return key1 == nil && key2 == nil
 	}
+	return PrivateKeyToPem(key1) == PrivateKeyToPem(key2)
+}
+
+// ParsePublicKeyPem converts a PEM encoded public key into a ECDSA or Ed25519 public key
+// Returns an error if the pem source isn't a PEM encoded ECDSA or Ed25519 public key
+func ParsePublicKeyPem(pemEncodedPub string) (crypto.PublicKey, error) {
 	blockPub, _ := pem.Decode([]byte(pemEncodedPub))
-	x509EncodedPub := blockPub.Bytes
-	genericPublicKey, _ := x509.ParsePKIXPublicKey(x509EncodedPub)
-	publicKey := genericPublicKey.(*ecdsa.PublicKey)
+	if blockPub == nil {
+		return nil, errors.New("ParsePublicKeyPem: Public key is not PEM encoded")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(blockPub.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("ParsePublicKeyPem: Invalid public key: %s", err)
+	} else if GetKeyAlgorithm(publicKey) == "" {
+		return nil, fmt.Errorf("ParsePublicKeyPem: Unsupported public key type %T", publicKey)
+	}
+	return publicKey, nil
+}
 
+// PublicKeyFromPem converts a ascii encoded public key into a ECDSA or Ed25519 public key
+// See also ParsePublicKeyPem for the reason of failure.
+// Returns nil if the encoded pem source isn't a supported public key
+func PublicKeyFromPem(pemEncodedPub string) crypto.PublicKey {
+	publicKey, _ := ParsePublicKeyPem(pemEncodedPub)
 	return publicKey
 }
 
 // PublicKeyToPem converts a public key into PEM encoded ascii format
 // See also PublicKeyFromPem for its counterpart
-func PublicKeyToPem(publicKey *ecdsa.PublicKey) string {
+func PublicKeyToPem(publicKey crypto.PublicKey) string {
 	x509EncodedPub, _ := x509.MarshalPKIXPublicKey(publicKey)
 	pemEncodedPub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: x509EncodedPub})
 	return string(pemEncodedPub)
@@ -0,0 +1,223 @@
+// Package mqttpacket with encoding and decoding of MQTT 3.1.1 and MQTT 5 control packets.
+// Only the packets needed for QoS 0 and 1 are supported.
+package mqttpacket
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Protocol versions as used in the CONNECT packet
+const (
+	ProtocolVersion311 byte = 4 // MQTT 3.1.1
+	ProtocolVersion5   byte = 5 // MQTT 5
+)
+
+// Control packet types
+const (
+	TypeConnect     byte = 1
+	TypeConnack     byte = 2
+	TypePublish     byte = 3
+	TypePuback      byte = 4
+	TypeSubscribe   byte = 8
+	TypeSuback      byte = 9
+	TypeUnsubscribe byte = 10
+	TypeUnsuback    byte = 11
+	TypePingreq     byte = 12
+	TypePingresp    byte = 13
+	TypeDisconnect  byte = 14
+)
+
+// MaxRemainingLength is the largest packet size that can be encoded, excluding the fixed header
+const MaxRemainingLength = 268435455
+
+// ErrMalformed is returned when a packet cannot be decoded
+var ErrMalformed = errors.New("malformed packet")
+
+// Packet is a MQTT control packet
+type Packet interface {
+	// Type returns the control packet type, eg TypePublish
+	Type() byte
+}
+
+// Connect packet, sent by the client to open a session
+type Connect struct {
+	ProtocolVersion byte   // ProtocolVersion311 or ProtocolVersion5
+	ClientID        string // unique client ID. "" to have the server assign one
+	CleanStart      bool   // discard any existing session
+	KeepAlive       uint16 // max seconds between packets from the client. 0 to disable
+	Username        string // optional login name
+	Password        string // optional login credentials
+	Will            *Will  // optional last will and testament
+	Properties      Properties
+}
+
+// Will is the message the server publishes when the client disconnects unexpectedly
+type Will struct {
+	Topic      string
+	Payload    []byte
+	QoS        byte
+	Retain     bool
+	Properties Properties
+}
+
+// Connack packet, sent by the server in response to Connect
+type Connack struct {
+	SessionPresent bool
+	ReasonCode     byte // ReasonSuccess or a connect reason code >= 0x80
+	Properties     Properties
+}
+
+// Publish packet with an application message
+type Publish struct {
+	Topic      string
+	Payload    []byte
+	QoS        byte
+	Retain     bool
+	Dup        bool
+	PacketID   uint16 // only used with QoS > 0
+	Properties Properties
+}
+
+// Puback packet, acknowledges a Publish with QoS 1
+type Puback struct {
+	PacketID   uint16
+	ReasonCode byte
+	Properties Properties
+}
+
+// Subscribe packet with one or more topic filters
+type Subscribe struct {
+	PacketID      uint16
+	Subscriptions []Subscription
+	Properties    Properties
+}
+
+// Subscription with a topic filter and its options
+type Subscription struct {
+	Topic             string // topic filter with optional '+' and '#' wildcards
+	QoS               byte   // maximum QoS of the messages sent to the client
+	NoLocal           bool   // do not send messages published by this client (v5)
+	RetainAsPublished bool   // keep the retain flag of forwarded messages (v5)
+	RetainHandling    byte   // 0 send retained messages, 1 only on new subscriptions, 2 never (v5)
+}
+
+// Suback packet, acknowledges a Subscribe with a reason code for each subscription
+type Suback struct {
+	PacketID    uint16
+	ReasonCodes []byte // granted QoS or an error reason code >= 0x80
+	Properties  Properties
+}
+
+// Unsubscribe packet with one or more topic filters
+type Unsubscribe struct {
+	PacketID   uint16
+	Topics     []string
+	Properties Properties
+}
+
+// Unsuback packet, acknowledges an Unsubscribe. MQTT 3.1.1 has no reason codes.
+type Unsuback struct {
+	PacketID    uint16
+	ReasonCodes []byte
+	Properties  Properties
+}
+
+// Pingreq packet, sent by the client to keep the connection alive
+type Pingreq struct{}
+
+// Pingresp packet, response to Pingreq
+type Pingresp struct{}
+
+// Disconnect packet. MQTT 5 allows both client and server to send it with a reason code.
+type Disconnect struct {
+	ReasonCode byte
+	Properties Properties
+}
+
+// Type of the packet
+func (packet *Connect) Type() byte { return TypeConnect }
+
+// Type of the packet
+func (packet *Connack) Type() byte { return TypeConnack }
+
+// Type of the packet
+func (packet *Publish) Type() byte { return TypePublish }
+
+// Type of the packet
+func (packet *Puback) Type() byte { return TypePuback }
+
+// Type of the packet
+func (packet *Subscribe) Type() byte { return TypeSubscribe }
+
+// Type of the packet
+func (packet *Suback) Type() byte { return TypeSuback }
+
+// Type of the packet
+func (packet *Unsubscribe) Type() byte { return TypeUnsubscribe }
+
+// Type of the packet
+func (packet *Unsuback) Type() byte { return TypeUnsuback }
+
+// Type of the packet
+func (packet *Pingreq) Type() byte { return TypePingreq }
+
+// Type of the packet
+func (packet *Pingresp) Type() byte { return TypePingresp }
+
+// Type of the packet
+func (packet *Disconnect) Type() byte { return TypeDisconnect }
+
+// ReadPacket reads and decodes the next packet
+//  reader to read the packet from, eg a buffered network connection
+//  version is the protocol version of the session. Connect packets carry their own version.
+// Returns io.EOF when the reader is closed, ErrMalformed if the packet is invalid, or an error
+// if the packet type is not supported
+func ReadPacket(reader io.Reader, version byte) (Packet, error) {
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, err
+	}
+	packetType := buf[0] >> 4
+	flags := buf[0] & 0x0F
+	length := 0
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			return nil, ErrMalformed
+		}
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		length |= int(buf[0]&0x7F) << shift
+		if buf[0]&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	return decodePacket(packetType, flags, body, version)
+}
+
+// WritePacket encodes and writes a packet in a single write
+//  writer to write the packet to, eg a network connection
+//  packet to write
+//  version is the protocol version of the session. Connect packets use their own version.
+func WritePacket(writer io.Writer, packet Packet, version byte) error {
+	body, flags, err := encodePacket(packet, version)
+	if err != nil {
+		return err
+	}
+	if len(body) > MaxRemainingLength {
+		return fmt.Errorf("packet of %d bytes exceeds the maximum size", len(body))
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteByte(packet.Type()<<4 | flags)
+	writeVarInt(buf, uint32(len(body)))
+	buf.Write(body)
+	_, err = writer.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,177 @@
+package mqttpacket_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/iotdomain/iotdomain-go/mqttpacket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// write and read back a packet
+func roundTrip(t *testing.T, packet mqttpacket.Packet, version byte) mqttpacket.Packet {
+	buf := &bytes.Buffer{}
+	err := mqttpacket.WritePacket(buf, packet, version)
+	require.NoError(t, err)
+	decoded, err := mqttpacket.ReadPacket(buf, version)
+	require.NoError(t, err)
+	assert.Equal(t, 0, buf.Len(), "Not all bytes are read")
+	return decoded
+}
+
+func TestRoundTrip5(t *testing.T) {
+	version := mqttpacket.ProtocolVersion5
+	maxQoS := byte(1)
+	packets := []mqttpacket.Packet{
+		&mqttpacket.Connect{
+			ProtocolVersion: version,
+			ClientID:        "client1",
+			CleanStart:      true,
+			KeepAlive:       20,
+			Username:        "user1",
+			Password:        "secret",
+			Will: &mqttpacket.Will{
+				Topic: "domain1/publisher1/$state", Payload: []byte("lost"), QoS: 1,
+				Properties: mqttpacket.Properties{WillDelay: 5},
+			},
+			Properties: mqttpacket.Properties{SessionExpiry: 60, ReceiveMaximum: 10},
+		},
+		&mqttpacket.Connack{
+			SessionPresent: true,
+			Properties:     mqttpacket.Properties{AssignedClientID: "auto-1", MaximumQoS: &maxQoS, ServerKeepAlive: 30},
+		},
+		&mqttpacket.Publish{
+			Topic:    "domain1/publisher1/node1/switch/0/$latest",
+			Payload:  bytes.Repeat([]byte("x"), 20000),
+			QoS:      1,
+			Retain:   true,
+			PacketID: 1234,
+			Properties: mqttpacket.Properties{
+				PayloadFormat:   1,
+				MessageExpiry:   3600,
+				ContentType:     "application/json",
+				ResponseTopic:   "domain1/publisher2/$ack",
+				CorrelationData: []byte{1, 2, 3},
+				SubscriptionIDs: []uint32{1, 300},
+				User:            []mqttpacket.UserProperty{{Name: "sender", Value: "domain1/publisher1/$identity"}},
+			},
+		},
+		&mqttpacket.Publish{Topic: "a/b", Payload: []byte{}},
+		&mqttpacket.Puback{PacketID: 1234, ReasonCode: mqttpacket.ReasonNotAuthorized,
+			Properties: mqttpacket.Properties{ReasonString: "denied"}},
+		&mqttpacket.Subscribe{
+			PacketID: 2,
+			Subscriptions: []mqttpacket.Subscription{
+				{Topic: "domain1/+/$identity", QoS: 1, NoLocal: true, RetainAsPublished: true, RetainHandling: 2},
+				{Topic: "#"},
+			},
+			Properties: mqttpacket.Properties{SubscriptionIDs: []uint32{5}},
+		},
+		&mqttpacket.Suback{PacketID: 2, ReasonCodes: []byte{1, mqttpacket.ReasonNotAuthorized}},
+		&mqttpacket.Unsubscribe{PacketID: 3, Topics: []string{"a/b", "c/#"}},
+		&mqttpacket.Unsuback{PacketID: 3, ReasonCodes: []byte{0, mqttpacket.ReasonNoSubscriptionExisted}},
+		&mqttpacket.Pingreq{},
+		&mqttpacket.Pingresp{},
+		&mqttpacket.Disconnect{ReasonCode: mqttpacket.ReasonDisconnectWithWill},
+	}
+	for _, packet := range packets {
+		decoded := roundTrip(t, packet, version)
+		assert.Equal(t, packet, decoded)
+	}
+}
+
+func TestRoundTrip311(t *testing.T) {
+	version := mqttpacket.ProtocolVersion311
+	connect := &mqttpacket.Connect{
+		ProtocolVersion: version,
+		ClientID:        "client1",
+		KeepAlive:       20,
+		Will:            &mqttpacket.Will{Topic: "a/$state", Payload: []byte("lost"), QoS: 1, Retain: true},
+	}
+	decoded := roundTrip(t, connect, mqttpacket.ProtocolVersion5)
+	assert.Equal(t, connect, decoded, "Connect uses its own version")
+
+	// properties are not encoded in 3.1.1
+	publish := &mqttpacket.Publish{Topic: "a/b", Payload: []byte("hello"), QoS: 1, PacketID: 7,
+		Properties: mqttpacket.Properties{MessageExpiry: 10}}
+	decoded = roundTrip(t, publish, version)
+	assert.Equal(t, "hello", string(decoded.(*mqttpacket.Publish).Payload))
+	assert.Equal(t, uint32(0), decoded.(*mqttpacket.Publish).Properties.MessageExpiry)
+
+	// return codes are converted to reason codes
+	decoded = roundTrip(t, &mqttpacket.Connack{ReasonCode: mqttpacket.ReasonNotAuthorized}, version)
+	assert.Equal(t, mqttpacket.ReasonNotAuthorized, decoded.(*mqttpacket.Connack).ReasonCode)
+	decoded = roundTrip(t, &mqttpacket.Suback{PacketID: 1, ReasonCodes: []byte{1, mqttpacket.ReasonNotAuthorized}}, version)
+	assert.Equal(t, []byte{1, mqttpacket.ReasonUnspecifiedError}, decoded.(*mqttpacket.Suback).ReasonCodes)
+	decoded = roundTrip(t, &mqttpacket.Disconnect{ReasonCode: mqttpacket.ReasonDisconnectWithWill}, version)
+	assert.Equal(t, mqttpacket.ReasonSuccess, decoded.(*mqttpacket.Disconnect).ReasonCode)
+
+	assert.Equal(t, "not authorized", mqttpacket.ReasonText(mqttpacket.ReasonNotAuthorized))
+	assert.Equal(t, "reason code 0xFF", mqttpacket.ReasonText(0xFF))
+}
+
+func TestMalformed(t *testing.T) {
+	version := mqttpacket.ProtocolVersion5
+	invalid := [][]byte{
+		{0x30, 0x03, 0x00, 0x05, 'a'},        // topic longer than packet
+		{0x36, 0x02, 0x00, 0x00},             // QoS 3
+		{0x80, 0x02, 0x00, 0x01},             // subscribe with invalid flags
+		{0x82, 0x03, 0x00, 0x01, 0x00},       // subscribe without topics
+		{0x30, 0x04, 0x00, 0x01, 'a', 0x05},  // property length exceeds packet
+		{0xC0, 0x01, 0x00},                   // ping with body
+		{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}, // length of more than 4 bytes
+	}
+	for _, data := range invalid {
+		_, err := mqttpacket.ReadPacket(bytes.NewReader(data), version)
+		assert.Error(t, err, "Expected error for %v", data)
+	}
+	// unknown property
+	_, err := mqttpacket.ReadPacket(bytes.NewReader([]byte{0x30, 0x06, 0x00, 0x01, 'a', 0x02, 0x7F, 0x00}), version)
+	assert.Equal(t, mqttpacket.ErrMalformed, err)
+
+	// truncated packet
+	_, err = mqttpacket.ReadPacket(bytes.NewReader([]byte{0x30, 0x10, 0x00}), version)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, err = mqttpacket.ReadPacket(bytes.NewReader([]byte{}), version)
+	assert.Equal(t, io.EOF, err)
+
+	// unsupported protocol version returns the connect packet
+	connect := []byte{0x10, 0x0A, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x03, 0x00, 0x00, 0x00, 0x00, 0x00}
+	packet, err := mqttpacket.ReadPacket(bytes.NewReader(connect), 0)
+	assert.Equal(t, mqttpacket.ErrUnsupportedVersion, err)
+	require.NotNil(t, packet)
+	assert.Equal(t, byte(3), packet.(*mqttpacket.Connect).ProtocolVersion)
+	err = mqttpacket.WritePacket(&bytes.Buffer{}, packet, 0)
+	assert.Error(t, err)
+}
+
+func TestMatchTopic(t *testing.T) {
+	const topic = "domain1/publisher1/node1/$node"
+	assert.True(t, mqttpacket.MatchTopic(topic, topic))
+	assert.True(t, mqttpacket.MatchTopic(topic, "domain1/+/+/$node"))
+	assert.True(t, mqttpacket.MatchTopic(topic, "domain1/#"))
+	assert.True(t, mqttpacket.MatchTopic(topic, "#"))
+	assert.True(t, mqttpacket.MatchTopic("domain1", "domain1/#"), "'#' includes the parent level")
+	assert.False(t, mqttpacket.MatchTopic(topic, "domain1/+/$node"))
+	assert.False(t, mqttpacket.MatchTopic(topic, "domain1/publisher1/node1"))
+	assert.False(t, mqttpacket.MatchTopic("domain1/publisher1", topic))
+	assert.False(t, mqttpacket.MatchTopic("$SYS/broker", "#"))
+	assert.True(t, mqttpacket.MatchTopic("$SYS/broker", "$SYS/#"))
+}
+
+func TestValidTopic(t *testing.T) {
+	assert.True(t, mqttpacket.ValidTopicName("domain1/publisher1/$identity"))
+	assert.False(t, mqttpacket.ValidTopicName(""))
+	assert.False(t, mqttpacket.ValidTopicName("domain1/+/$identity"))
+	assert.False(t, mqttpacket.ValidTopicName("domain1/#"))
+
+	assert.True(t, mqttpacket.ValidTopicFilter("domain1/+/$identity"))
+	assert.True(t, mqttpacket.ValidTopicFilter("domain1/#"))
+	assert.True(t, mqttpacket.ValidTopicFilter("#"))
+	assert.False(t, mqttpacket.ValidTopicFilter(""))
+	assert.False(t, mqttpacket.ValidTopicFilter("domain1/#/$identity"))
+	assert.False(t, mqttpacket.ValidTopicFilter("domain1/pub+/$identity"))
+	assert.False(t, mqttpacket.ValidTopicFilter("domain1/pub#"))
+}
@@ -0,0 +1,297 @@
+// Package mqttpacket with the MQTT 5 packet properties
+package mqttpacket
+
+import "bytes"
+
+// Property identifiers
+const (
+	PropPayloadFormat        byte = 0x01
+	PropMessageExpiry        byte = 0x02
+	PropContentType          byte = 0x03
+	PropResponseTopic        byte = 0x08
+	PropCorrelationData      byte = 0x09
+	PropSubscriptionID       byte = 0x0B
+	PropSessionExpiry        byte = 0x11
+	PropAssignedClientID     byte = 0x12
+	PropServerKeepAlive      byte = 0x13
+	PropAuthMethod           byte = 0x15
+	PropAuthData             byte = 0x16
+	PropRequestProblemInfo   byte = 0x17
+	PropWillDelay            byte = 0x18
+	PropRequestResponseInfo  byte = 0x19
+	PropResponseInfo         byte = 0x1A
+	PropServerReference      byte = 0x1C
+	PropReasonString         byte = 0x1F
+	PropReceiveMaximum       byte = 0x21
+	PropTopicAliasMaximum    byte = 0x22
+	PropTopicAlias           byte = 0x23
+	PropMaximumQoS           byte = 0x24
+	PropRetainAvailable      byte = 0x25
+	PropUserProperty         byte = 0x26
+	PropMaximumPacketSize    byte = 0x27
+	PropWildcardSubAvailable byte = 0x28
+	PropSubIDAvailable       byte = 0x29
+	PropSharedSubAvailable   byte = 0x2A
+)
+
+// encoding of property values
+const (
+	propByte = iota
+	propUint16
+	propUint32
+	propVarInt
+	propString
+	propBinary
+	propPair
+)
+
+// propTypes with the value encoding of each property identifier
+var propTypes = map[byte]int{
+	PropPayloadFormat:        propByte,
+	PropMessageExpiry:        propUint32,
+	PropContentType:          propString,
+	PropResponseTopic:        propString,
+	PropCorrelationData:      propBinary,
+	PropSubscriptionID:       propVarInt,
+	PropSessionExpiry:        propUint32,
+	PropAssignedClientID:     propString,
+	PropServerKeepAlive:      propUint16,
+	PropAuthMethod:           propString,
+	PropAuthData:             propBinary,
+	PropRequestProblemInfo:   propByte,
+	PropWillDelay:            propUint32,
+	PropRequestResponseInfo:  propByte,
+	PropResponseInfo:         propString,
+	PropServerReference:      propString,
+	PropReasonString:         propString,
+	PropReceiveMaximum:       propUint16,
+	PropTopicAliasMaximum:    propUint16,
+	PropTopicAlias:           propUint16,
+	PropMaximumQoS:           propByte,
+	PropRetainAvailable:      propByte,
+	PropUserProperty:         propPair,
+	PropMaximumPacketSize:    propUint32,
+	PropWildcardSubAvailable: propByte,
+	PropSubIDAvailable:       propByte,
+	PropSharedSubAvailable:   propByte,
+}
+
+// UserProperty is an application defined name-value pair
+type UserProperty struct {
+	Name  string
+	Value string
+}
+
+// Properties of MQTT 5 packets. Zero values are not encoded. Properties that are not listed here
+// are skipped when decoding. MQTT 3.1.1 packets have no properties.
+type Properties struct {
+	PayloadFormat     byte           // 1 if the payload is UTF-8 text
+	MessageExpiry     uint32         // seconds until the message expires. 0 for no expiry
+	ContentType       string         // MIME type of the payload
+	ResponseTopic     string         // topic to publish the response to a request on
+	CorrelationData   []byte         // identifies the request a response belongs to
+	SubscriptionIDs   []uint32       // identifier of a subscription, or of the matching subscriptions
+	SessionExpiry     uint32         // seconds the session is kept after disconnect
+	AssignedClientID  string         // client ID assigned by the server
+	ServerKeepAlive   uint16         // keep alive interval required by the server
+	WillDelay         uint32         // seconds to delay the will publication
+	ReasonString      string         // human readable explanation of the reason code
+	ReceiveMaximum    uint16         // max number of unacknowledged QoS 1 messages
+	TopicAliasMaximum uint16         // max number of topic aliases accepted
+	TopicAlias        uint16         // alias used instead of the topic name
+	MaximumQoS        *byte          // max QoS supported by the server. nil for QoS 2
+	RetainAvailable   *byte          // 0 if the server doesn't support retained messages. nil if supported
+	MaximumPacketSize uint32         // max packet size accepted
+	WildcardSubAvail  *byte          // 0 if the server doesn't support wildcard subscriptions
+	SubIDAvail        *byte          // 0 if the server doesn't support subscription identifiers
+	SharedSubAvail    *byte          // 0 if the server doesn't support shared subscriptions
+	User              []UserProperty // application defined properties
+}
+
+// GetUserProperty returns the value of the first user property with the given name, or ""
+func (props *Properties) GetUserProperty(name string) string {
+	for _, prop := range props.User {
+		if prop.Name == name {
+			return prop.Value
+		}
+	}
+	return ""
+}
+
+// encode the properties, prefixed with their length
+func (props *Properties) encode(buf *bytes.Buffer) {
+	propBuf := &bytes.Buffer{}
+	if props.PayloadFormat != 0 {
+		propBuf.WriteByte(PropPayloadFormat)
+		propBuf.WriteByte(props.PayloadFormat)
+	}
+	if props.MessageExpiry != 0 {
+		propBuf.WriteByte(PropMessageExpiry)
+		writeUint32(propBuf, props.MessageExpiry)
+	}
+	if props.ContentType != "" {
+		propBuf.WriteByte(PropContentType)
+		writeString(propBuf, props.ContentType)
+	}
+	if props.ResponseTopic != "" {
+		propBuf.WriteByte(PropResponseTopic)
+		writeString(propBuf, props.ResponseTopic)
+	}
+	if props.CorrelationData != nil {
+		propBuf.WriteByte(PropCorrelationData)
+		writeBinary(propBuf, props.CorrelationData)
+	}
+	for _, subID := range props.SubscriptionIDs {
+		propBuf.WriteByte(PropSubscriptionID)
+		writeVarInt(propBuf, subID)
+	}
+	if props.SessionExpiry != 0 {
+		propBuf.WriteByte(PropSessionExpiry)
+		writeUint32(propBuf, props.SessionExpiry)
+	}
+	if props.AssignedClientID != "" {
+		propBuf.WriteByte(PropAssignedClientID)
+		writeString(propBuf, props.AssignedClientID)
+	}
+	if props.ServerKeepAlive != 0 {
+		propBuf.WriteByte(PropServerKeepAlive)
+		writeUint16(propBuf, props.ServerKeepAlive)
+	}
+	if props.WillDelay != 0 {
+		propBuf.WriteByte(PropWillDelay)
+		writeUint32(propBuf, props.WillDelay)
+	}
+	if props.ReasonString != "" {
+		propBuf.WriteByte(PropReasonString)
+		writeString(propBuf, props.ReasonString)
+	}
+	if props.ReceiveMaximum != 0 {
+		propBuf.WriteByte(PropReceiveMaximum)
+		writeUint16(propBuf, props.ReceiveMaximum)
+	}
+	if props.TopicAliasMaximum != 0 {
+		propBuf.WriteByte(PropTopicAliasMaximum)
+		writeUint16(propBuf, props.TopicAliasMaximum)
+	}
+	if props.TopicAlias != 0 {
+		propBuf.WriteByte(PropTopicAlias)
+		writeUint16(propBuf, props.TopicAlias)
+	}
+	if props.MaximumQoS != nil {
+		propBuf.WriteByte(PropMaximumQoS)
+		propBuf.WriteByte(*props.MaximumQoS)
+	}
+	if props.RetainAvailable != nil {
+		propBuf.WriteByte(PropRetainAvailable)
+		propBuf.WriteByte(*props.RetainAvailable)
+	}
+	for _, userProp := range props.User {
+		propBuf.WriteByte(PropUserProperty)
+		writeString(propBuf, userProp.Name)
+		writeString(propBuf, userProp.Value)
+	}
+	if props.MaximumPacketSize != 0 {
+		propBuf.WriteByte(PropMaximumPacketSize)
+		writeUint32(propBuf, props.MaximumPacketSize)
+	}
+	if props.WildcardSubAvail != nil {
+		propBuf.WriteByte(PropWildcardSubAvailable)
+		propBuf.WriteByte(*props.WildcardSubAvail)
+	}
+	if props.SubIDAvail != nil {
+		propBuf.WriteByte(PropSubIDAvailable)
+		propBuf.WriteByte(*props.SubIDAvail)
+	}
+	if props.SharedSubAvail != nil {
+		propBuf.WriteByte(PropSharedSubAvailable)
+		propBuf.WriteByte(*props.SharedSubAvail)
+	}
+	writeVarInt(buf, uint32(propBuf.Len()))
+	buf.Write(propBuf.Bytes())
+}
+
+// decode the length prefixed properties
+func (props *Properties) decode(dec *decoder) {
+	length := int(dec.readVarInt())
+	if dec.err != nil || length > dec.remaining() {
+		dec.err = ErrMalformed
+		return
+	}
+	end := dec.pos + length
+	for dec.err == nil && dec.pos < end {
+		propID := dec.readByte()
+		propType, known := propTypes[propID]
+		if !known {
+			dec.err = ErrMalformed
+			return
+		}
+		switch propType {
+		case propByte:
+			value := dec.readByte()
+			switch propID {
+			case PropPayloadFormat:
+				props.PayloadFormat = value
+			case PropMaximumQoS:
+				props.MaximumQoS = &value
+			case PropRetainAvailable:
+				props.RetainAvailable = &value
+			case PropWildcardSubAvailable:
+				props.WildcardSubAvail = &value
+			case PropSubIDAvailable:
+				props.SubIDAvail = &value
+			case PropSharedSubAvailable:
+				props.SharedSubAvail = &value
+			}
+		case propUint16:
+			value := dec.readUint16()
+			switch propID {
+			case PropServerKeepAlive:
+				props.ServerKeepAlive = value
+			case PropReceiveMaximum:
+				props.ReceiveMaximum = value
+			case PropTopicAliasMaximum:
+				props.TopicAliasMaximum = value
+			case PropTopicAlias:
+				props.TopicAlias = value
+			}
+		case propUint32:
+			value := dec.readUint32()
+			switch propID {
+			case PropMessageExpiry:
+				props.MessageExpiry = value
+			case PropSessionExpiry:
+				props.SessionExpiry = value
+			case PropWillDelay:
+				props.WillDelay = value
+			case PropMaximumPacketSize:
+				props.MaximumPacketSize = value
+			}
+		case propVarInt:
+			props.SubscriptionIDs = append(props.SubscriptionIDs, dec.readVarInt())
+		case propString:
+			value := dec.readString()
+			switch propID {
+			case PropContentType:
+				props.ContentType = value
+			case PropResponseTopic:
+				props.ResponseTopic = value
+			case PropAssignedClientID:
+				props.AssignedClientID = value
+			case PropReasonString:
+				props.ReasonString = value
+			}
+		case propBinary:
+			value := dec.readBinary()
+			if propID == PropCorrelationData {
+				props.CorrelationData = value
+			}
+		case propPair:
+			name := dec.readString()
+			value := dec.readString()
+			props.User = append(props.User, UserProperty{Name: name, Value: value})
+		}
+	}
+	if dec.pos != end {
+		dec.err = ErrMalformed
+	}
+}
@@ -0,0 +1,109 @@
+// Package mqttpacket with the MQTT 5 reason codes
+package mqttpacket
+
+import "fmt"
+
+// Reason codes used in acknowledgements and disconnect. Codes >= 0x80 indicate failure.
+// MQTT 3.1.1 return codes are converted to their MQTT 5 equivalent when decoding.
+const (
+	ReasonSuccess                     byte = 0x00 // also normal disconnect and granted QoS 0
+	ReasonGrantedQoS1                 byte = 0x01
+	ReasonGrantedQoS2                 byte = 0x02
+	ReasonDisconnectWithWill          byte = 0x04
+	ReasonNoMatchingSubscribers       byte = 0x10
+	ReasonNoSubscriptionExisted       byte = 0x11
+	ReasonUnspecifiedError            byte = 0x80
+	ReasonMalformedPacket             byte = 0x81
+	ReasonProtocolError               byte = 0x82
+	ReasonImplementationSpecificError byte = 0x83
+	ReasonUnsupportedProtocolVersion  byte = 0x84
+	ReasonClientIDNotValid            byte = 0x85
+	ReasonBadUsernameOrPassword       byte = 0x86
+	ReasonNotAuthorized               byte = 0x87
+	ReasonServerUnavailable           byte = 0x88
+	ReasonServerBusy                  byte = 0x89
+	ReasonBanned                      byte = 0x8A
+	ReasonServerShuttingDown          byte = 0x8B
+	ReasonKeepAliveTimeout            byte = 0x8D
+	ReasonSessionTakenOver            byte = 0x8E
+	ReasonTopicFilterInvalid          byte = 0x8F
+	ReasonTopicNameInvalid            byte = 0x90
+	ReasonPacketIDInUse               byte = 0x91
+	ReasonPacketIDNotFound            byte = 0x92
+	ReasonReceiveMaximumExceeded      byte = 0x93
+	ReasonPacketTooLarge              byte = 0x95
+	ReasonQuotaExceeded               byte = 0x97
+	ReasonPayloadFormatInvalid        byte = 0x99
+	ReasonRetainNotSupported          byte = 0x9A
+	ReasonQoSNotSupported             byte = 0x9B
+	ReasonSharedSubNotSupported       byte = 0x9E
+	ReasonSubIDNotSupported           byte = 0xA1
+	ReasonWildcardSubNotSupported     byte = 0xA2
+)
+
+// reasonTexts with a description of the reason codes
+var reasonTexts = map[byte]string{
+	ReasonSuccess:                     "success",
+	ReasonGrantedQoS1:                 "granted QoS 1",
+	ReasonGrantedQoS2:                 "granted QoS 2",
+	ReasonDisconnectWithWill:          "disconnect with will message",
+	ReasonNoMatchingSubscribers:       "no matching subscribers",
+	ReasonNoSubscriptionExisted:       "no subscription existed",
+	ReasonUnspecifiedError:            "unspecified error",
+	ReasonMalformedPacket:             "malformed packet",
+	ReasonProtocolError:               "protocol error",
+	ReasonImplementationSpecificError: "implementation specific error",
+	ReasonUnsupportedProtocolVersion:  "unsupported protocol version",
+	ReasonClientIDNotValid:            "client identifier not valid",
+	ReasonBadUsernameOrPassword:       "bad user name or password",
+	ReasonNotAuthorized:               "not authorized",
+	ReasonServerUnavailable:           "server unavailable",
+	ReasonServerBusy:                  "server busy",
+	ReasonBanned:                      "banned",
+	ReasonServerShuttingDown:          "server shutting down",
+	ReasonKeepAliveTimeout:            "keep alive timeout",
+	ReasonSessionTakenOver:            "session taken over",
+	ReasonTopicFilterInvalid:          "topic filter invalid",
+	ReasonTopicNameInvalid:            "topic name invalid",
+	ReasonPacketIDInUse:               "packet identifier in use",
+	ReasonPacketIDNotFound:            "packet identifier not found",
+	ReasonReceiveMaximumExceeded:      "receive maximum exceeded",
+	ReasonPacketTooLarge:              "packet too large",
+	ReasonQuotaExceeded:               "quota exceeded",
+	ReasonPayloadFormatInvalid:        "payload format invalid",
+	ReasonRetainNotSupported:          "retain not supported",
+	ReasonQoSNotSupported:             "QoS not supported",
+	ReasonSharedSubNotSupported:       "shared subscriptions not supported",
+	ReasonSubIDNotSupported:           "subscription identifiers not supported",
+	ReasonWildcardSubNotSupported:     "wildcard subscriptions not supported",
+}
+
+// connackReasons converts MQTT 3.1.1 connect return codes to MQTT 5 reason codes
+var connackReasons = []byte{
+	ReasonSuccess,
+	ReasonUnsupportedProtocolVersion,
+	ReasonClientIDNotValid,
+	ReasonServerUnavailable,
+	ReasonBadUsernameOrPassword,
+	ReasonNotAuthorized,
+}
+
+// ReasonText returns a description of a reason code
+func ReasonText(reasonCode byte) string {
+	text, found := reasonTexts[reasonCode]
+	if !found {
+		text = fmt.Sprintf("reason code 0x%02X", reasonCode)
+	}
+	return text
+}
+
+// connackReturnCode converts a MQTT 5 connect reason code to a MQTT 3.1.1 return code
+func connackReturnCode(reasonCode byte) byte {
+	for returnCode, reason := range connackReasons {
+		if reason == reasonCode {
+			return byte(returnCode)
+		}
+	}
+	// refused, server unavailable
+	return 3
+}
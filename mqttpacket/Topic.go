@@ -0,0 +1,49 @@
+// Package mqttpacket with matching of topics and topic filters
+package mqttpacket
+
+import "strings"
+
+// MatchTopic returns true if a topic matches a topic filter with the wildcards '+' for a single
+// level and '#' for the remaining levels. Topics that start with '$' are not matched by a filter
+// that starts with a wildcard.
+func MatchTopic(topic string, filter string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for index, filterLevel := range filterLevels {
+		if filterLevel == "#" {
+			return true
+		} else if index >= len(topicLevels) {
+			return false
+		} else if filterLevel != "+" && filterLevel != topicLevels[index] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// ValidTopicName returns true if a topic can be published on. It must not be empty or contain
+// wildcards.
+func ValidTopicName(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#\x00")
+}
+
+// ValidTopicFilter returns true if a topic filter can be subscribed to. Wildcards must occupy a
+// whole level and '#' must be the last level.
+func ValidTopicFilter(filter string) bool {
+	if filter == "" || strings.Contains(filter, "\x00") {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for index, level := range levels {
+		if level == "#" && index != len(levels)-1 {
+			return false
+		} else if len(level) > 1 && strings.ContainsAny(level, "+#") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,470 @@
+// Package mqttpacket with the encoding of packet fields
+package mqttpacket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// ErrUnsupportedVersion is returned with the decoded Connect packet when the client uses a
+// protocol version other than MQTT 3.1.1 or MQTT 5
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// protocolName in the connect packet
+const protocolName = "MQTT"
+
+// connect flags
+const (
+	connectFlagCleanStart = 0x02
+	connectFlagWill       = 0x04
+	connectFlagWillRetain = 0x20
+	connectFlagPassword   = 0x40
+	connectFlagUsername   = 0x80
+)
+
+func writeUint16(buf *bytes.Buffer, value uint16) {
+	buf.WriteByte(byte(value >> 8))
+	buf.WriteByte(byte(value))
+}
+
+func writeUint32(buf *bytes.Buffer, value uint32) {
+	writeUint16(buf, uint16(value>>16))
+	writeUint16(buf, uint16(value))
+}
+
+// writeVarInt writes a variable byte integer of up to 4 bytes
+func writeVarInt(buf *bytes.Buffer, value uint32) {
+	for {
+		digit := byte(value % 128)
+		value /= 128
+		if value > 0 {
+			digit |= 0x80
+		}
+		buf.WriteByte(digit)
+		if value == 0 {
+			return
+		}
+	}
+}
+
+func writeBinary(buf *bytes.Buffer, value []byte) {
+	writeUint16(buf, uint16(len(value)))
+	buf.Write(value)
+}
+
+func writeString(buf *bytes.Buffer, value string) {
+	writeUint16(buf, uint16(len(value)))
+	buf.WriteString(value)
+}
+
+// decoder reads fields from a packet body. The first error is kept and further reads return
+// zero values.
+type decoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+// remaining returns the number of bytes not yet read
+func (dec *decoder) remaining() int {
+	return len(dec.data) - dec.pos
+}
+
+// next returns the next n bytes
+func (dec *decoder) next(n int) []byte {
+	if dec.err != nil || n > dec.remaining() {
+		dec.err = ErrMalformed
+		return nil
+	}
+	value := dec.data[dec.pos : dec.pos+n]
+	dec.pos += n
+	return value
+}
+
+func (dec *decoder) readByte() byte {
+	value := dec.next(1)
+	if value == nil {
+		return 0
+	}
+	return value[0]
+}
+
+func (dec *decoder) readUint16() uint16 {
+	value := dec.next(2)
+	if value == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(value)
+}
+
+func (dec *decoder) readUint32() uint32 {
+	value := dec.next(4)
+	if value == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(value)
+}
+
+func (dec *decoder) readVarInt() uint32 {
+	value := uint32(0)
+	for shift := uint(0); shift <= 21; shift += 7 {
+		digit := dec.readByte()
+		value |= uint32(digit&0x7F) << shift
+		if digit&0x80 == 0 {
+			return value
+		}
+	}
+	dec.err = ErrMalformed
+	return 0
+}
+
+func (dec *decoder) readBinary() []byte {
+	length := int(dec.readUint16())
+	value := dec.next(length)
+	if value == nil {
+		return nil
+	}
+	return append([]byte{}, value...)
+}
+
+// readString reads a UTF-8 encoded string
+func (dec *decoder) readString() string {
+	length := int(dec.readUint16())
+	value := dec.next(length)
+	if !utf8.Valid(value) {
+		dec.err = ErrMalformed
+		return ""
+	}
+	return string(value)
+}
+
+// readRest returns the remaining bytes
+func (dec *decoder) readRest() []byte {
+	return dec.next(dec.remaining())
+}
+
+// encodePacket returns the body and fixed header flags of a packet
+func encodePacket(packet Packet, version byte) (body []byte, flags byte, err error) {
+	buf := &bytes.Buffer{}
+	isV5 := version == ProtocolVersion5
+
+	switch p := packet.(type) {
+	case *Connect:
+		if p.ProtocolVersion != ProtocolVersion311 && p.ProtocolVersion != ProtocolVersion5 {
+			return nil, 0, ErrUnsupportedVersion
+		}
+		isV5 = p.ProtocolVersion == ProtocolVersion5
+		writeString(buf, protocolName)
+		buf.WriteByte(p.ProtocolVersion)
+		connectFlags := byte(0)
+		if p.CleanStart {
+			connectFlags |= connectFlagCleanStart
+		}
+		if p.Will != nil {
+			connectFlags |= connectFlagWill | (p.Will.QoS&0x03)<<3
+			if p.Will.Retain {
+				connectFlags |= connectFlagWillRetain
+			}
+		}
+		if p.Username != "" {
+			connectFlags |= connectFlagUsername
+		}
+		if p.Password != "" {
+			connectFlags |= connectFlagPassword
+		}
+		buf.WriteByte(connectFlags)
+		writeUint16(buf, p.KeepAlive)
+		if isV5 {
+			p.Properties.encode(buf)
+		}
+		writeString(buf, p.ClientID)
+		if p.Will != nil {
+			if isV5 {
+				p.Will.Properties.encode(buf)
+			}
+			writeString(buf, p.Will.Topic)
+			writeBinary(buf, p.Will.Payload)
+		}
+		if p.Username != "" {
+			writeString(buf, p.Username)
+		}
+		if p.Password != "" {
+			writeBinary(buf, []byte(p.Password))
+		}
+	case *Connack:
+		if p.SessionPresent {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		if isV5 {
+			buf.WriteByte(p.ReasonCode)
+			p.Properties.encode(buf)
+		} else {
+			buf.WriteByte(connackReturnCode(p.ReasonCode))
+		}
+	case *Publish:
+		if p.QoS > 2 {
+			return nil, 0, fmt.Errorf("invalid QoS %d", p.QoS)
+		}
+		flags = p.QoS << 1
+		if p.Dup {
+			flags |= 0x08
+		}
+		if p.Retain {
+			flags |= 0x01
+		}
+		writeString(buf, p.Topic)
+		if p.QoS > 0 {
+			writeUint16(buf, p.PacketID)
+		}
+		if isV5 {
+			p.Properties.encode(buf)
+		}
+		buf.Write(p.Payload)
+	case *Puback:
+		writeUint16(buf, p.PacketID)
+		if isV5 {
+			buf.WriteByte(p.ReasonCode)
+			p.Properties.encode(buf)
+		}
+	case *Subscribe:
+		flags = 0x02
+		writeUint16(buf, p.PacketID)
+		if isV5 {
+			p.Properties.encode(buf)
+		}
+		for _, subscription := range p.Subscriptions {
+			writeString(buf, subscription.Topic)
+			options := subscription.QoS & 0x03
+			if isV5 {
+				if subscription.NoLocal {
+					options |= 0x04
+				}
+				if subscription.RetainAsPublished {
+					options |= 0x08
+				}
+				options |= (subscription.RetainHandling & 0x03) << 4
+			}
+			buf.WriteByte(options)
+		}
+	case *Suback:
+		writeUint16(buf, p.PacketID)
+		if isV5 {
+			p.Properties.encode(buf)
+		}
+		for _, reasonCode := range p.ReasonCodes {
+			if !isV5 && reasonCode >= ReasonUnspecifiedError {
+				reasonCode = ReasonUnspecifiedError
+			}
+			buf.WriteByte(reasonCode)
+		}
+	case *Unsubscribe:
+		flags = 0x02
+		writeUint16(buf, p.PacketID)
+		if isV5 {
+			p.Properties.encode(buf)
+		}
+		for _, topic := range p.Topics {
+			writeString(buf, topic)
+		}
+	case *Unsuback:
+		writeUint16(buf, p.PacketID)
+		if isV5 {
+			p.Properties.encode(buf)
+			buf.Write(p.ReasonCodes)
+		}
+	case *Pingreq, *Pingresp:
+		// no body
+	case *Disconnect:
+		if isV5 {
+			buf.WriteByte(p.ReasonCode)
+			p.Properties.encode(buf)
+		}
+	default:
+		return nil, 0, fmt.Errorf("unsupported packet type %d", packet.Type())
+	}
+	return buf.Bytes(), flags, nil
+}
+
+// decodePacket decodes the body of a packet
+func decodePacket(packetType byte, flags byte, body []byte, version byte) (Packet, error) {
+	dec := &decoder{data: body}
+	isV5 := version == ProtocolVersion5
+	var packet Packet
+	var err error
+
+	// only publish, subscribe and unsubscribe use flags
+	if (packetType == TypeSubscribe || packetType == TypeUnsubscribe) && flags != 0x02 {
+		return nil, ErrMalformed
+	} else if packetType != TypePublish && packetType != TypeSubscribe && packetType != TypeUnsubscribe &&
+		flags != 0 {
+		return nil, ErrMalformed
+	}
+
+	switch packetType {
+	case TypeConnect:
+		p := &Connect{}
+		if dec.readString() != protocolName {
+			return nil, ErrMalformed
+		}
+		p.ProtocolVersion = dec.readByte()
+		if dec.err == nil && p.ProtocolVersion != ProtocolVersion311 && p.ProtocolVersion != ProtocolVersion5 {
+			return p, ErrUnsupportedVersion
+		}
+		isV5 = p.ProtocolVersion == ProtocolVersion5
+		connectFlags := dec.readByte()
+		if connectFlags&0x01 != 0 {
+			return nil, ErrMalformed
+		}
+		p.CleanStart = connectFlags&connectFlagCleanStart != 0
+		p.KeepAlive = dec.readUint16()
+		if isV5 {
+			p.Properties.decode(dec)
+		}
+		p.ClientID = dec.readString()
+		if connectFlags&connectFlagWill != 0 {
+			p.Will = &Will{
+				QoS:    (connectFlags >> 3) & 0x03,
+				Retain: connectFlags&connectFlagWillRetain != 0,
+			}
+			if isV5 {
+				p.Will.Properties.decode(dec)
+			}
+			p.Will.Topic = dec.readString()
+			p.Will.Payload = dec.readBinary()
+			if p.Will.QoS > 2 {
+				return nil, ErrMalformed
+			}
+		}
+		if connectFlags&connectFlagUsername != 0 {
+			p.Username = dec.readString()
+		}
+		if connectFlags&connectFlagPassword != 0 {
+			p.Password = string(dec.readBinary())
+		}
+		packet = p
+	case TypeConnack:
+		p := &Connack{}
+		p.SessionPresent = dec.readByte()&0x01 != 0
+		p.ReasonCode = dec.readByte()
+		if isV5 {
+			if dec.remaining() > 0 {
+				p.Properties.decode(dec)
+			}
+		} else if int(p.ReasonCode) < len(connackReasons) {
+			p.ReasonCode = connackReasons[p.ReasonCode]
+		} else {
+			p.ReasonCode = ReasonUnspecifiedError
+		}
+		packet = p
+	case TypePublish:
+		p := &Publish{
+			QoS:    (flags >> 1) & 0x03,
+			Retain: flags&0x01 != 0,
+			Dup:    flags&0x08 != 0,
+		}
+		if p.QoS > 2 {
+			return nil, ErrMalformed
+		}
+		p.Topic = dec.readString()
+		if p.QoS > 0 {
+			p.PacketID = dec.readUint16()
+		}
+		if isV5 {
+			p.Properties.decode(dec)
+		}
+		p.Payload = dec.readRest()
+		packet = p
+	case TypePuback:
+		p := &Puback{}
+		p.PacketID = dec.readUint16()
+		if isV5 && dec.remaining() > 0 {
+			p.ReasonCode = dec.readByte()
+			if dec.remaining() > 0 {
+				p.Properties.decode(dec)
+			}
+		}
+		packet = p
+	case TypeSubscribe:
+		p := &Subscribe{}
+		p.PacketID = dec.readUint16()
+		if isV5 {
+			p.Properties.decode(dec)
+		}
+		for dec.err == nil && dec.remaining() > 0 {
+			subscription := Subscription{Topic: dec.readString()}
+			options := dec.readByte()
+			subscription.QoS = options & 0x03
+			if isV5 {
+				subscription.NoLocal = options&0x04 != 0
+				subscription.RetainAsPublished = options&0x08 != 0
+				subscription.RetainHandling = (options >> 4) & 0x03
+			}
+			if subscription.QoS > 2 || (!isV5 && options&0xFC != 0) || (isV5 && options&0xC0 != 0) {
+				return nil, ErrMalformed
+			}
+			p.Subscriptions = append(p.Subscriptions, subscription)
+		}
+		if len(p.Subscriptions) == 0 {
+			return nil, ErrMalformed
+		}
+		packet = p
+	case TypeSuback:
+		p := &Suback{}
+		p.PacketID = dec.readUint16()
+		if isV5 {
+			p.Properties.decode(dec)
+		}
+		p.ReasonCodes = dec.readRest()
+		packet = p
+	case TypeUnsubscribe:
+		p := &Unsubscribe{}
+		p.PacketID = dec.readUint16()
+		if isV5 {
+			p.Properties.decode(dec)
+		}
+		for dec.err == nil && dec.remaining() > 0 {
+			p.Topics = append(p.Topics, dec.readString())
+		}
+		if len(p.Topics) == 0 {
+			return nil, ErrMalformed
+		}
+		packet = p
+	case TypeUnsuback:
+		p := &Unsuback{}
+		p.PacketID = dec.readUint16()
+		if isV5 {
+			p.Properties.decode(dec)
+			p.ReasonCodes = dec.readRest()
+		}
+		packet = p
+	case TypePingreq:
+		packet = &Pingreq{}
+	case TypePingresp:
+		packet = &Pingresp{}
+	case TypeDisconnect:
+		p := &Disconnect{}
+		if isV5 && dec.remaining() > 0 {
+			p.ReasonCode = dec.readByte()
+			if dec.remaining() > 0 {
+				p.Properties.decode(dec)
+			}
+		}
+		packet = p
+	default:
+		return nil, fmt.Errorf("unsupported packet type %d", packetType)
+	}
+	if dec.err != nil {
+		err = dec.err
+	} else if dec.remaining() > 0 {
+		err = ErrMalformed
+	}
+	if err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
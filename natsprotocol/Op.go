@@ -0,0 +1,200 @@
+// Package natsprotocol with reading and writing of NATS client protocol operations.
+// See https://docs.nats.io/reference/reference-protocols/nats-protocol
+package natsprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Operations of the NATS client protocol
+const (
+	OpConnect = "CONNECT" // client connect options
+	OpErr     = "-ERR"    // protocol error
+	OpHMsg    = "HMSG"    // message with headers delivered to a subscriber
+	OpHPub    = "HPUB"    // publish a message with headers
+	OpInfo    = "INFO"    // server information
+	OpMsg     = "MSG"     // message delivered to a subscriber
+	OpOK      = "+OK"     // acknowledgement in verbose mode
+	OpPing    = "PING"    // keep alive request
+	OpPong    = "PONG"    // keep alive response
+	OpPub     = "PUB"     // publish a message
+	OpSub     = "SUB"     // subscribe to a subject
+	OpUnsub   = "UNSUB"   // unsubscribe a subscription
+)
+
+// HeaderVersion starts the header block of HPUB and HMSG operations
+const HeaderVersion = "NATS/1.0"
+
+// MaxPayload is the largest payload that is read. Larger payloads are rejected as malformed.
+const MaxPayload = 64 * 1024 * 1024
+
+// ErrMalformed is returned when an operation cannot be decoded
+var ErrMalformed = errors.New("malformed operation")
+
+// Op is a NATS protocol operation
+type Op struct {
+	Name    string   // operation name, eg PUB
+	Args    []string // arguments of the operation without the sizes. INFO, CONNECT and -ERR have one argument.
+	Headers []byte   // header block of HPUB and HMSG
+	Payload []byte   // payload of PUB, HPUB, MSG and HMSG
+}
+
+// Info with the server information sent after a client connects
+type Info struct {
+	ServerID    string `json:"server_id"`
+	Version     string `json:"version"`
+	Headers     bool   `json:"headers"`
+	MaxPayload  int64  `json:"max_payload"`
+	TLSRequired bool   `json:"tls_required,omitempty"`
+	JetStream   bool   `json:"jetstream,omitempty"`
+}
+
+// ConnectOptions sent by the client with CONNECT
+type ConnectOptions struct {
+	Verbose      bool   `json:"verbose"`
+	Pedantic     bool   `json:"pedantic"`
+	TLSRequired  bool   `json:"tls_required"`
+	User         string `json:"user,omitempty"`
+	Pass         string `json:"pass,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Lang         string `json:"lang"`
+	Version      string `json:"version"`
+	Protocol     int    `json:"protocol"`
+	Headers      bool   `json:"headers"`
+	NoResponders bool   `json:"no_responders"`
+}
+
+// HeaderStatus returns the status code of a header block, eg "503" when a request has no
+// responders, or "" if the header has no status
+func HeaderStatus(headers []byte) string {
+	line := string(headers)
+	if index := strings.Index(line, "\r\n"); index >= 0 {
+		line = line[:index]
+	}
+	fields := strings.Fields(strings.TrimPrefix(line, HeaderVersion))
+	if !strings.HasPrefix(line, HeaderVersion) || len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// MakeHeaders returns a header block with the given status, eg "503". Use "" for no status.
+func MakeHeaders(status string) []byte {
+	if status == "" {
+		return []byte(HeaderVersion + "\r\n\r\n")
+	}
+	return []byte(HeaderVersion + " " + status + "\r\n\r\n")
+}
+
+// ReadOp reads the next operation
+// Returns ErrMalformed if the operation cannot be decoded, or the error of the reader
+func ReadOp(reader *bufio.Reader) (*Op, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	name := line
+	rest := ""
+	if index := strings.IndexAny(line, " \t"); index >= 0 {
+		name = line[:index]
+		rest = strings.TrimLeft(line[index:], " \t")
+	}
+	op := &Op{Name: strings.ToUpper(name)}
+
+	switch op.Name {
+	case OpInfo, OpConnect, OpErr:
+		op.Args = []string{rest}
+	case OpPing, OpPong, OpOK:
+	case OpSub, OpUnsub:
+		op.Args = strings.Fields(rest)
+		if len(op.Args) < 1 || len(op.Args) > 3 {
+			return nil, ErrMalformed
+		}
+	case OpPub, OpMsg:
+		// PUB <subject> [reply] <size>, MSG <subject> <sid> [reply] <size>
+		fields := strings.Fields(rest)
+		minArgs := 1
+		if op.Name == OpMsg {
+			minArgs = 2
+		}
+		if len(fields) < minArgs+1 || len(fields) > minArgs+2 {
+			return nil, ErrMalformed
+		}
+		op.Args = fields[:len(fields)-1]
+		op.Payload, err = readPayload(reader, fields[len(fields)-1])
+		if err != nil {
+			return nil, err
+		}
+	case OpHPub, OpHMsg:
+		// HPUB <subject> [reply] <header size> <total size>, HMSG <subject> <sid> [reply] <header size> <total size>
+		fields := strings.Fields(rest)
+		minArgs := 1
+		if op.Name == OpHMsg {
+			minArgs = 2
+		}
+		if len(fields) < minArgs+2 || len(fields) > minArgs+3 {
+			return nil, ErrMalformed
+		}
+		op.Args = fields[:len(fields)-2]
+		headerSize, err := strconv.Atoi(fields[len(fields)-2])
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		data, err := readPayload(reader, fields[len(fields)-1])
+		if err != nil {
+			return nil, err
+		} else if headerSize < 0 || headerSize > len(data) {
+			return nil, ErrMalformed
+		}
+		op.Headers = data[:headerSize]
+		op.Payload = data[headerSize:]
+	default:
+		return nil, fmt.Errorf("%w: unknown operation '%s'", ErrMalformed, name)
+	}
+	return op, nil
+}
+
+// WriteOp writes an operation. The sizes of PUB, HPUB, MSG and HMSG are added to the arguments.
+func WriteOp(writer io.Writer, op *Op) error {
+	buf := &bytes.Buffer{}
+	buf.WriteString(op.Name)
+	for _, arg := range op.Args {
+		buf.WriteString(" ")
+		buf.WriteString(arg)
+	}
+	switch op.Name {
+	case OpPub, OpMsg:
+		buf.WriteString(" " + strconv.Itoa(len(op.Payload)) + "\r\n")
+		buf.Write(op.Payload)
+	case OpHPub, OpHMsg:
+		buf.WriteString(" " + strconv.Itoa(len(op.Headers)) + " " + strconv.Itoa(len(op.Headers)+len(op.Payload)) + "\r\n")
+		buf.Write(op.Headers)
+		buf.Write(op.Payload)
+	}
+	buf.WriteString("\r\n")
+	_, err := writer.Write(buf.Bytes())
+	return err
+}
+
+// readPayload reads a payload of the given size followed by CRLF
+func readPayload(reader *bufio.Reader, sizeArg string) ([]byte, error) {
+	size, err := strconv.Atoi(sizeArg)
+	if err != nil || size < 0 || size > MaxPayload {
+		return nil, ErrMalformed
+	}
+	data := make([]byte, size+2)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return nil, err
+	} else if data[size] != '\r' || data[size+1] != '\n' {
+		return nil, ErrMalformed
+	}
+	return data[:size], nil
+}
@@ -0,0 +1,65 @@
+package natsprotocol_test
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/iotdomain/iotdomain-go/natsprotocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// write and read back an operation
+func roundTrip(t *testing.T, op *natsprotocol.Op) *natsprotocol.Op {
+	buf := &bytes.Buffer{}
+	err := natsprotocol.WriteOp(buf, op)
+	require.NoError(t, err)
+	decoded, err := natsprotocol.ReadOp(bufio.NewReader(buf))
+	require.NoError(t, err)
+	assert.Equal(t, 0, buf.Len(), "Not all bytes are read")
+	return decoded
+}
+
+func TestOps(t *testing.T) {
+	pub := &natsprotocol.Op{Name: natsprotocol.OpPub, Args: []string{"domain1.pub1.$node", "_INBOX.1"},
+		Payload: []byte("hello\r\nworld")}
+	assert.Equal(t, pub, roundTrip(t, pub))
+
+	msg := &natsprotocol.Op{Name: natsprotocol.OpMsg, Args: []string{"domain1.pub1.$node", "7"}, Payload: []byte{}}
+	assert.Equal(t, msg, roundTrip(t, msg))
+
+	hmsg := &natsprotocol.Op{Name: natsprotocol.OpHMsg, Args: []string{"_INBOX.1", "1"},
+		Headers: natsprotocol.MakeHeaders("503"), Payload: []byte{}}
+	decoded := roundTrip(t, hmsg)
+	assert.Equal(t, hmsg, decoded)
+	assert.Equal(t, "503", natsprotocol.HeaderStatus(decoded.Headers))
+	assert.Equal(t, "", natsprotocol.HeaderStatus(natsprotocol.MakeHeaders("")))
+
+	info := &natsprotocol.Op{Name: natsprotocol.OpInfo, Args: []string{`{"server_id":"test", "headers":true}`}}
+	assert.Equal(t, info, roundTrip(t, info))
+	sub := &natsprotocol.Op{Name: natsprotocol.OpSub, Args: []string{"domain1.>", "3"}}
+	assert.Equal(t, sub, roundTrip(t, sub))
+	ping := &natsprotocol.Op{Name: natsprotocol.OpPing}
+	assert.Equal(t, ping, roundTrip(t, ping))
+
+	// lower case operations and invalid sizes
+	op, err := natsprotocol.ReadOp(bufio.NewReader(bytes.NewBufferString("pong\r\n")))
+	require.NoError(t, err)
+	assert.Equal(t, natsprotocol.OpPong, op.Name)
+	_, err = natsprotocol.ReadOp(bufio.NewReader(bytes.NewBufferString("PUB a 10\r\nshort\r\n")))
+	assert.Error(t, err)
+	_, err = natsprotocol.ReadOp(bufio.NewReader(bytes.NewBufferString("PUB a x\r\n\r\n")))
+	assert.Error(t, err)
+	_, err = natsprotocol.ReadOp(bufio.NewReader(bytes.NewBufferString("BOGUS\r\n")))
+	assert.Error(t, err)
+}
+
+func TestMatchSubject(t *testing.T) {
+	assert.True(t, natsprotocol.MatchSubject("domain1.pub1.node1", "domain1.*.node1"))
+	assert.True(t, natsprotocol.MatchSubject("domain1.pub1.node1", "domain1.>"))
+	assert.True(t, natsprotocol.MatchSubject("domain1.pub1.node1", "domain1.pub1.node1"))
+	assert.False(t, natsprotocol.MatchSubject("domain1", "domain1.>"))
+	assert.False(t, natsprotocol.MatchSubject("domain1.pub1", "domain1.*.node1"))
+	assert.False(t, natsprotocol.MatchSubject("domain1.pub1.node1", "domain1.*"))
+}
@@ -0,0 +1,22 @@
+// Package natsprotocol with matching of subjects and subject filters
+package natsprotocol
+
+import "strings"
+
+// MatchSubject returns true if a subject matches a subject filter with the wildcards '*' for a
+// single token and '>' for one or more remaining tokens
+func MatchSubject(subject string, filter string) bool {
+	filterTokens := strings.Split(filter, ".")
+	subjectTokens := strings.Split(subject, ".")
+
+	for index, filterToken := range filterTokens {
+		if filterToken == ">" {
+			return index < len(subjectTokens)
+		} else if index >= len(subjectTokens) {
+			return false
+		} else if filterToken != "*" && filterToken != subjectTokens[index] {
+			return false
+		}
+	}
+	return len(filterTokens) == len(subjectTokens)
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"reflect"
+	"sync"
 
 	"github.com/iotdomain/iotdomain-go/lib"
 	"github.com/iotdomain/iotdomain-go/messaging"
@@ -16,8 +17,10 @@ import (
 
 // DomainNodes manages nodes discovered on the domain
 type DomainNodes struct {
-	c             lib.DomainCollection     //
-	messageSigner *messaging.MessageSigner // subscription to input discovery messages
+	c                 lib.DomainCollection                    //
+	messageSigner     *messaging.MessageSigner                // subscription to input discovery messages
+	subscriptions     map[string]messaging.SubscriptionHandle // subscription handles by address
+	subscriptionMutex *sync.Mutex                             // mutex for updating subscriptions
 }
 
 // AddNode adds or replaces a discovered node
@@ -132,17 +135,34 @@ func (domainNodes *DomainNodes) SaveNodes(filename string) error {
 	return nil
 }
 
+// RemovePublisherNodes removes all nodes of a publisher, eg when the publisher is revoked
+// publisherAddress contains the domain/publisherID[/$identity]
+// Returns the number of removed nodes
+func (domainNodes *DomainNodes) RemovePublisherNodes(publisherAddress string) int {
+	return domainNodes.c.RemoveByAddressPrefix(publisherAddress)
+}
+
 // Subscribe to nodes discovery of the given domain publisher.
 func (domainNodes *DomainNodes) Subscribe(domain string, publisherID string) {
 	// subscription address  domain/publisher/+/$node
 	address := MakeNodeDiscoveryAddress(domain, publisherID, "+")
-	domainNodes.messageSigner.Subscribe(address, domainNodes.handleDiscoverNode)
+	domainNodes.subscriptionMutex.Lock()
+	defer domainNodes.subscriptionMutex.Unlock()
+	if _, found := domainNodes.subscriptions[address]; found {
+		return
+	}
+	domainNodes.subscriptions[address] = domainNodes.messageSigner.Subscribe(address, domainNodes.handleDiscoverNode)
 }
 
 // Unsubscribe from publisher
 func (domainNodes *DomainNodes) Unsubscribe(domain string, publisherID string) {
 	address := MakeNodeDiscoveryAddress(domain, publisherID, "+")
-	domainNodes.messageSigner.Unsubscribe(address, domainNodes.handleDiscoverNode)
+	domainNodes.subscriptionMutex.Lock()
+	defer domainNodes.subscriptionMutex.Unlock()
+	if handle, found := domainNodes.subscriptions[address]; found {
+		domainNodes.messageSigner.Unsubscribe(handle)
+		delete(domainNodes.subscriptions, address)
+	}
 }
 
 // handleDiscoverNode adds discovered domain nodes to the collection
@@ -160,8 +180,10 @@ func NewDomainNodes(messageSigner *messaging.MessageSigner) *DomainNodes {
 		reflect.TypeOf(&types.NodeDiscoveryMessage{}), messageSigner.GetPublicKey)
 
 	domainNodes := DomainNodes{
-		c:             domainCollection,
-		messageSigner: messageSigner,
+		c:                 domainCollection,
+		messageSigner:     messageSigner,
+		subscriptions:     make(map[string]messaging.SubscriptionHandle),
+		subscriptionMutex: &sync.Mutex{},
 	}
 	return &domainNodes
 }
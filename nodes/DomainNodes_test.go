@@ -1,7 +1,7 @@
 package nodes_test
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"encoding/json"
 	"testing"
 
@@ -23,7 +23,7 @@ func TestNewDomainNodes(t *testing.T) {
 	const TestConfigDefault = "testDefault"
 	const node1Addr = domain + "/" + publisherID + "/" + nodeID
 	privKey := messaging.CreateAsymKeys()
-	getPubKey := func(address string) *ecdsa.PublicKey {
+	getPubKey := func(address string) crypto.PublicKey {
 		return &privKey.PublicKey
 	}
 	messenger := messaging.NewDummyMessenger(dummyConfig)
@@ -83,7 +83,7 @@ func TestDiscoverDomainNodes(t *testing.T) {
 	const node1Addr = domain + "/" + publisherID + "/" + nodeID
 	privKey := messaging.CreateAsymKeys()
 
-	getPubKey := func(address string) *ecdsa.PublicKey {
+	getPubKey := func(address string) crypto.PublicKey {
 		return &privKey.PublicKey
 	}
 	messenger := messaging.NewDummyMessenger(dummyConfig)
@@ -0,0 +1,39 @@
+// Package nodes with command to create a node on a remote publisher
+package nodes
+
+import (
+	"crypto"
+	"strings"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// PublishCreateNode publishes the command to create a node on a remote publisher.
+// nodeAddress is the address of the new node: domain/publisherID/nodeHWID.
+// attr contains the initial configuration of the node.
+// This signs and encrypts the message for the destination
+func PublishCreateNode(
+	nodeAddress string, nodeType types.NodeType, attr types.NodeAttrMap, sender string,
+	messageSigner *messaging.MessageSigner, encryptionKey crypto.PublicKey) error {
+
+	logrus.Infof("PublishCreateNode: publishing encrypted message to %s", nodeAddress)
+	segments := strings.Split(nodeAddress, "/")
+	if len(segments) < 3 {
+		return lib.MakeErrorf("PublishCreateNode: Node address %s is invalid", nodeAddress)
+	}
+	createAddr := MakeNodeCreateAddress(segments[0], segments[1], segments[2])
+	timeStampStr := time.Now().Format(types.TimeFormat)
+	var message = types.NodeCreateMessage{
+		Address:   createAddr,
+		Attr:      attr,
+		NodeType:  nodeType,
+		Sender:    sender,
+		Timestamp: timeStampStr,
+	}
+	err := messageSigner.PublishObject(createAddr, false, &message, encryptionKey)
+	return err
+}
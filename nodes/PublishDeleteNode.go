@@ -0,0 +1,35 @@
+// Package nodes with command to delete a remote node
+package nodes
+
+import (
+	"crypto"
+	"strings"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// PublishDeleteNode publishes the command to delete a remote node using the existing
+// node address. This signs and encrypts the message for the destination
+func PublishDeleteNode(
+	nodeAddress string, sender string,
+	messageSigner *messaging.MessageSigner, encryptionKey crypto.PublicKey) error {
+
+	logrus.Infof("PublishDeleteNode: publishing encrypted message to %s", nodeAddress)
+	segments := strings.Split(nodeAddress, "/")
+	if len(segments) < 3 {
+		return lib.MakeErrorf("PublishDeleteNode: Node address %s is invalid", nodeAddress)
+	}
+	deleteAddr := MakeNodeDeleteAddress(segments[0], segments[1], segments[2])
+	timeStampStr := time.Now().Format(types.TimeFormat)
+	var message = types.NodeDeleteMessage{
+		Address:   deleteAddr,
+		Sender:    sender,
+		Timestamp: timeStampStr,
+	}
+	err := messageSigner.PublishObject(deleteAddr, false, &message, encryptionKey)
+	return err
+}
@@ -2,10 +2,11 @@
 package nodes
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"strings"
 	"time"
 
+	"github.com/iotdomain/iotdomain-go/lib"
 	"github.com/iotdomain/iotdomain-go/messaging"
 	"github.com/iotdomain/iotdomain-go/types"
 	"github.com/sirupsen/logrus"
@@ -15,14 +16,25 @@ import (
 // If an encryption key is given then the signed message will be encrypted, otherwise just signed.
 func PublishNodeConfigure(
 	destinationAddress string, attr types.NodeAttrMap, sender string,
-	messageSigner *messaging.MessageSigner, encryptionKey *ecdsa.PublicKey) {
+	messageSigner *messaging.MessageSigner, encryptionKey crypto.PublicKey) {
+
+	PublishNodeConfigureWithCorrelationID(destinationAddress, attr, sender, "", messageSigner, encryptionKey)
+}
+
+// PublishNodeConfigureWithCorrelationID sends a command to update the configuration of a remote node
+// like PublishNodeConfigure. The receiver acknowledges the command with the given correlation ID,
+// see the acks package.
+// Returns an error if the destination address is incomplete or publishing fails
+func PublishNodeConfigureWithCorrelationID(
+	destinationAddress string, attr types.NodeAttrMap, sender string, correlationID string,
+	messageSigner *messaging.MessageSigner, encryptionKey crypto.PublicKey) error {
 
 	logrus.Infof("PublishNodeConfigure: publishing encrypted configuration to %s", destinationAddress)
 	// Check that address is one of our inputs
 	segments := strings.Split(destinationAddress, "/")
 	// a full address is required
 	if len(segments) < 4 {
-		return
+		return lib.MakeErrorf("PublishNodeConfigure: Destination address '%s' is incomplete", destinationAddress)
 	}
 	// domain/publisherID/nodeID/$configure
 	segments[3] = types.MessageTypeConfigure
@@ -31,10 +43,11 @@ func PublishNodeConfigure(
 	// Encecode the SetMessage
 	timeStampStr := time.Now().Format("2006-01-02T15:04:05.000-0700")
 	var configureMessage = types.NodeConfigureMessage{
-		Address:   configAddr,
-		Sender:    sender,
-		Timestamp: timeStampStr,
-		Attr:      attr,
+		Address:       configAddr,
+		CorrelationID: correlationID,
+		Sender:        sender,
+		Timestamp:     timeStampStr,
+		Attr:          attr,
 	}
-	messageSigner.PublishObject(configAddr, false, &configureMessage, encryptionKey)
+	return messageSigner.PublishObject(configAddr, false, &configureMessage, encryptionKey)
 }
@@ -25,3 +25,14 @@ func PublishRegisteredNodes(
 		}
 	}
 }
+
+// RemoveRegisteredNodes removes the discovery publication of deleted nodes from the message bus
+func RemoveRegisteredNodes(
+	deletedNodes []*types.NodeDiscoveryMessage,
+	messageSigner *messaging.MessageSigner) {
+
+	for _, node := range deletedNodes {
+		logrus.Infof("RemoveRegisteredNodes: remove node discovery: %s", node.Address)
+		messageSigner.RemovePublication(node.Address)
+	}
+}
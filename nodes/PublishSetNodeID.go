@@ -2,7 +2,7 @@
 package nodes
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"strings"
 	"time"
 
@@ -16,7 +16,7 @@ import (
 // node address. This signs and encrypts the message for the destination
 func PublishSetNodeID(
 	nodeAddress string, newNodeID string, sender string,
-	messageSigner *messaging.MessageSigner, encryptionKey *ecdsa.PublicKey) error {
+	messageSigner *messaging.MessageSigner, encryptionKey crypto.PublicKey) error {
 
 	logrus.Infof("PublishSetNodeID: publishing encrypted message to %s", nodeAddress)
 	segments := strings.Split(nodeAddress, "/")
@@ -0,0 +1,75 @@
+// Package nodes with command to upgrade the firmware of a remote node
+package nodes
+
+import (
+	"crypto"
+	"crypto/md5"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// PublishUpgrade publishes the command to upgrade the firmware of a remote node in a single message.
+// This signs and encrypts the message for the destination
+func PublishUpgrade(
+	nodeAddress string, fwVersion string, firmware []byte, sender string,
+	messageSigner *messaging.MessageSigner, encryptionKey crypto.PublicKey) error {
+
+	return PublishUpgradeChunks(nodeAddress, fwVersion, firmware, 0, 0, sender, messageSigner, encryptionKey)
+}
+
+// PublishUpgradeChunks publishes the command to upgrade the firmware of a remote node in chunks of
+// the given size. Intended for firmware that exceeds the maximum payload size of the message bus.
+//  chunkSize is the maximum size of the firmware in each message, 0 to send the firmware in a single message
+//  startChunk is the index of the first chunk to send. Use 0 to send all chunks or a higher index to
+// resume an interrupted transfer.
+// This signs and encrypts the messages for the destination
+func PublishUpgradeChunks(
+	nodeAddress string, fwVersion string, firmware []byte, chunkSize int, startChunk int, sender string,
+	messageSigner *messaging.MessageSigner, encryptionKey crypto.PublicKey) error {
+
+	logrus.Infof("PublishUpgradeChunks: publishing encrypted firmware %s to %s", fwVersion, nodeAddress)
+	segments := strings.Split(nodeAddress, "/")
+	if len(segments) < 3 {
+		return lib.MakeErrorf("PublishUpgradeChunks: Node address %s is invalid", nodeAddress)
+	}
+	upgradeAddr := MakeNodeUpgradeAddress(segments[0], segments[1], segments[2])
+	checksum := md5.Sum(firmware)
+	md5Hex := hex.EncodeToString(checksum[:])
+
+	chunkCount := 1
+	if chunkSize > 0 && len(firmware) > chunkSize {
+		chunkCount = (len(firmware) + chunkSize - 1) / chunkSize
+	} else {
+		chunkSize = len(firmware)
+	}
+	for index := startChunk; index < chunkCount; index++ {
+		start := index * chunkSize
+		end := start + chunkSize
+		if end > len(firmware) {
+			end = len(firmware)
+		}
+		var message = types.UpgradeFirmwareMessage{
+			Address:   upgradeAddr,
+			MD5:       md5Hex,
+			Firmware:  firmware[start:end],
+			FWVersion: fwVersion,
+			Sender:    sender,
+			Timestamp: time.Now().Format(types.TimeFormat),
+		}
+		if chunkCount > 1 {
+			message.ChunkCount = chunkCount
+			message.ChunkIndex = index
+		}
+		err := messageSigner.PublishObject(upgradeAddr, false, &message, encryptionKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Package nodes with handling of node create commands
+package nodes
+
+import (
+	"crypto"
+	"strings"
+	"sync"
+
+	"github.com/iotdomain/iotdomain-go/acl"
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// CreateNodeHandler application handler when command to create a node is received
+// The handler is only invoked if the node does not yet exist.
+type CreateNodeHandler func(nodeHWID string, nodeType types.NodeType, params types.NodeAttrMap)
+
+// ReceiveCreateNode with handling of commands to create nodes managed by this publisher.
+// This decrypts incoming messages determines the sender and verifies the signature with
+// the sender public key.
+type ReceiveCreateNode struct {
+	authorizer        acl.Authorizer               // optional authorization of senders
+	domain            string                       // the domain of this publisher
+	publisherID       string                       // the registered publisher for the nodes
+	createNodeHandler CreateNodeHandler            // handler to pass the command to
+	messageSigner     *messaging.MessageSigner     // subscription and publication messenger
+	subscription      messaging.SubscriptionHandle // handle of the subscription
+	privateKey        crypto.PrivateKey            // private key for decrypting create command messages
+	registeredNodes   *RegisteredNodes             // registered nodes of this publisher
+	updateMutex       *sync.Mutex                  // mutex for async handling of commands
+}
+
+// SetAuthorizer sets the authorizer that determines which senders can create which nodes.
+// Use nil to allow all senders with a valid signature.
+func (createNode *ReceiveCreateNode) SetAuthorizer(authorizer acl.Authorizer) {
+	createNode.updateMutex.Lock()
+	defer createNode.updateMutex.Unlock()
+	createNode.authorizer = authorizer
+}
+
+// SetCreateNodeHandler set the handler for creating nodes
+func (createNode *ReceiveCreateNode) SetCreateNodeHandler(
+	handler func(nodeHWID string, nodeType types.NodeType, params types.NodeAttrMap)) {
+	createNode.createNodeHandler = handler
+}
+
+// Start listening for create commands
+func (createNode *ReceiveCreateNode) Start() {
+	createNode.updateMutex.Lock()
+	defer createNode.updateMutex.Unlock()
+	// subscribe to all create commands for this publisher
+	addr := MakeNodeCreateAddress(createNode.domain, createNode.publisherID, "+")
+	createNode.subscription = createNode.messageSigner.Subscribe(addr, createNode.receiveCreateCommand)
+}
+
+// Stop listening for commands
+func (createNode *ReceiveCreateNode) Stop() {
+	createNode.updateMutex.Lock()
+	defer createNode.updateMutex.Unlock()
+	createNode.messageSigner.Unsubscribe(createNode.subscription)
+}
+
+// handle an incoming command to create a node. This:
+// - check if the message is encrypted
+// - check if the signature is valid
+// - check that the message is not a replay of an earlier command
+// - check that the sender is authorized to create the node
+// - check that the node doesn't already exist
+// - if a create handler is set, let it create the node
+// - without handler, create the node and apply the given configuration
+// The node hardware ID is taken from the address: domain/publisherID/nodeHWID/$create
+func (createNode *ReceiveCreateNode) receiveCreateCommand(address string, message string) error {
+	var createMessage types.NodeCreateMessage
+
+	isEncrypted, isSigned, err := createNode.messageSigner.DecodeCommand(address, message, &createMessage)
+
+	if !isEncrypted {
+		return lib.MakeErrorf("receiveCreateCommand: Create node command on '%s' is not encrypted. Message discarded.", address)
+	} else if !isSigned {
+		return lib.MakeErrorf("receiveCreateCommand: Create node command on '%s' is not signed. Message discarded.", address)
+	} else if err != nil {
+		return lib.MakeErrorf("receiveCreateCommand: Message to %s. Error %s'. Message discarded.", address, err)
+	}
+
+	segments := strings.Split(address, "/")
+	if len(segments) < 4 || segments[2] == "" {
+		return lib.MakeErrorf("receiveCreateCommand: Address '%s' is incomplete. Message discarded.", address)
+	}
+	nodeHWID := segments[2]
+	nodeAddr := MakeNodeDiscoveryAddress(segments[0], segments[1], nodeHWID)
+	createNode.updateMutex.Lock()
+	authorizer := createNode.authorizer
+	createNode.updateMutex.Unlock()
+	if authorizer != nil && !authorizer.IsAuthorized(createMessage.Sender, nodeAddr, acl.ActionCreateNode) {
+		// the node doesn't exist so there is no status to report the error in
+		return lib.MakeErrorf("receiveCreateCommand: Sender '%s' is not authorized to create node '%s'. Message discarded.",
+			createMessage.Sender, nodeAddr)
+	}
+	existingNode := createNode.registeredNodes.GetNodeByHWID(nodeHWID)
+	if existingNode != nil {
+		return lib.MakeErrorf("receiveCreateCommand: Node '%s' already exists. Message discarded.", nodeHWID)
+	}
+	logrus.Infof("receiveCreateCommand create command on address %s. isEncrypted=%t, isSigned=%t", address, isEncrypted, isSigned)
+
+	if createNode.createNodeHandler != nil {
+		// A handler can determine if and how the node is created
+		createNode.createNodeHandler(nodeHWID, createMessage.NodeType, createMessage.Attr)
+	} else {
+		// Without a handler create the node and apply its initial configuration
+		createNode.registeredNodes.CreateNode(nodeHWID, createMessage.NodeType)
+		if len(createMessage.Attr) > 0 {
+			createNode.registeredNodes.UpdateNodeConfigValues(nodeHWID, createMessage.Attr)
+		}
+	}
+	return nil
+}
+
+// NewReceiveCreateNode returns a new instance of handling of node create commands.
+func NewReceiveCreateNode(
+	domain string,
+	publisherID string,
+	createHandler CreateNodeHandler,
+	messageSigner *messaging.MessageSigner,
+	registeredNodes *RegisteredNodes,
+	privateKey crypto.PrivateKey) *ReceiveCreateNode {
+	rcn := &ReceiveCreateNode{
+		domain:            domain,
+		messageSigner:     messageSigner,
+		createNodeHandler: createHandler,
+		publisherID:       publisherID,
+		registeredNodes:   registeredNodes,
+		privateKey:        privateKey,
+		updateMutex:       &sync.Mutex{},
+	}
+	return rcn
+}
@@ -0,0 +1,126 @@
+// Package nodes with handling of node delete commands
+package nodes
+
+import (
+	"crypto"
+	"sync"
+
+	"github.com/iotdomain/iotdomain-go/acl"
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// DeleteNodeHandler application handler when command to delete a node is received
+// The handler is only invoked if the node is confirmed to exist.
+type DeleteNodeHandler func(nodeHWID string)
+
+// ReceiveDeleteNode with handling of commands to delete nodes managed by this publisher.
+// This decrypts incoming messages determines the sender and verifies the signature with
+// the sender public key.
+type ReceiveDeleteNode struct {
+	authorizer        acl.Authorizer               // optional authorization of senders
+	domain            string                       // the domain of this publisher
+	publisherID       string                       // the registered publisher for the nodes
+	deleteNodeHandler DeleteNodeHandler            // handler to pass the command to
+	messageSigner     *messaging.MessageSigner     // subscription and publication messenger
+	subscription      messaging.SubscriptionHandle // handle of the subscription
+	privateKey        crypto.PrivateKey            // private key for decrypting delete command messages
+	registeredNodes   *RegisteredNodes             // registered nodes of this publisher
+	updateMutex       *sync.Mutex                  // mutex for async handling of commands
+}
+
+// SetAuthorizer sets the authorizer that determines which senders can delete which nodes.
+// Use nil to allow all senders with a valid signature.
+func (deleteNode *ReceiveDeleteNode) SetAuthorizer(authorizer acl.Authorizer) {
+	deleteNode.updateMutex.Lock()
+	defer deleteNode.updateMutex.Unlock()
+	deleteNode.authorizer = authorizer
+}
+
+// SetDeleteNodeHandler set the handler for deleting nodes
+func (deleteNode *ReceiveDeleteNode) SetDeleteNodeHandler(handler func(nodeHWID string)) {
+	deleteNode.deleteNodeHandler = handler
+}
+
+// Start listening for delete commands
+func (deleteNode *ReceiveDeleteNode) Start() {
+	deleteNode.updateMutex.Lock()
+	defer deleteNode.updateMutex.Unlock()
+	// subscribe to all delete commands for this publisher's nodes
+	addr := MakeNodeDeleteAddress(deleteNode.domain, deleteNode.publisherID, "+")
+	deleteNode.subscription = deleteNode.messageSigner.Subscribe(addr, deleteNode.receiveDeleteCommand)
+}
+
+// Stop listening for commands
+func (deleteNode *ReceiveDeleteNode) Stop() {
+	deleteNode.updateMutex.Lock()
+	defer deleteNode.updateMutex.Unlock()
+	deleteNode.messageSigner.Unsubscribe(deleteNode.subscription)
+}
+
+// handle an incoming command to delete one of our nodes. This:
+// - check if the message is encrypted
+// - check if the signature is valid
+// - check that the message is not a replay of an earlier command
+// - check if the node is valid
+// - check that the sender is authorized to delete the node
+// - if a delete handler is set, let it delete the node
+// - without handler, remove the node from the registered nodes
+func (deleteNode *ReceiveDeleteNode) receiveDeleteCommand(nodeAddress string, message string) error {
+	var deleteMessage types.NodeDeleteMessage
+
+	isEncrypted, isSigned, err := deleteNode.messageSigner.DecodeCommand(nodeAddress, message, &deleteMessage)
+
+	if !isEncrypted {
+		return lib.MakeErrorf("receiveDeleteCommand: Delete node command on '%s' is not encrypted. Message discarded.", nodeAddress)
+	} else if !isSigned {
+		return lib.MakeErrorf("receiveDeleteCommand: Delete node command on '%s' is not signed. Message discarded.", nodeAddress)
+	} else if err != nil {
+		return lib.MakeErrorf("receiveDeleteCommand: Message to %s. Error %s'. Message discarded.", nodeAddress, err)
+	}
+
+	node := deleteNode.registeredNodes.GetNodeByAddress(nodeAddress)
+	if node == nil {
+		return lib.MakeErrorf("receiveDeleteCommand unknown node for address %s", nodeAddress)
+	}
+	deleteNode.updateMutex.Lock()
+	authorizer := deleteNode.authorizer
+	deleteNode.updateMutex.Unlock()
+	if authorizer != nil && !authorizer.IsAuthorized(deleteMessage.Sender, node.Address, acl.ActionDeleteNode) {
+		err = lib.MakeErrorf("receiveDeleteCommand: Sender '%s' is not authorized to delete node '%s'. Message discarded.",
+			deleteMessage.Sender, node.Address)
+		deleteNode.registeredNodes.UpdateNodeStatus(node.HWID,
+			map[types.NodeStatus]string{types.NodeStatusLastError: err.Error()})
+		return err
+	}
+	logrus.Infof("receiveDeleteCommand delete command on address %s. isEncrypted=%t, isSigned=%t", nodeAddress, isEncrypted, isSigned)
+
+	if deleteNode.deleteNodeHandler != nil {
+		deleteNode.deleteNodeHandler(node.HWID)
+	} else {
+		deleteNode.registeredNodes.DeleteNode(node.HWID)
+	}
+	return nil
+}
+
+// NewReceiveDeleteNode returns a new instance of handling of node delete commands.
+func NewReceiveDeleteNode(
+	domain string,
+	publisherID string,
+	deleteHandler DeleteNodeHandler,
+	messageSigner *messaging.MessageSigner,
+	registeredNodes *RegisteredNodes,
+	privateKey crypto.PrivateKey) *ReceiveDeleteNode {
+	rdn := &ReceiveDeleteNode{
+		domain:            domain,
+		messageSigner:     messageSigner,
+		deleteNodeHandler: deleteHandler,
+		publisherID:       publisherID,
+		registeredNodes:   registeredNodes,
+		privateKey:        privateKey,
+		updateMutex:       &sync.Mutex{},
+	}
+	return rdn
+}
@@ -2,9 +2,11 @@
 package nodes
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"sync"
 
+	"github.com/iotdomain/iotdomain-go/acks"
+	"github.com/iotdomain/iotdomain-go/acl"
 	"github.com/iotdomain/iotdomain-go/lib"
 	"github.com/iotdomain/iotdomain-go/messaging"
 	"github.com/iotdomain/iotdomain-go/types"
@@ -19,13 +21,23 @@ type NodeConfigureHandler func(nodeHWID string, params types.NodeAttrMap)
 // This decrypts incoming messages determines the sender and verifies the signature with
 // the sender public key.
 type ReceiveNodeConfigure struct {
-	domain               string                   // the domain of this publisher
-	publisherID          string                   // the registered publisher for the inputs
-	nodeConfigureHandler NodeConfigureHandler     // handler to pass the command to
-	messageSigner        *messaging.MessageSigner // subscription and publication messenger
-	privateKey           *ecdsa.PrivateKey        // private key for decrypting set command messages
-	registeredNodes      *RegisteredNodes         // registered nodes of this publisher
-	updateMutex          *sync.Mutex              // mutex for async handling of inputs
+	authorizer           acl.Authorizer               // optional authorization of senders
+	domain               string                       // the domain of this publisher
+	publisherID          string                       // the registered publisher for the inputs
+	nodeConfigureHandler NodeConfigureHandler         // handler to pass the command to
+	messageSigner        *messaging.MessageSigner     // subscription and publication messenger
+	subscription         messaging.SubscriptionHandle // handle of the subscription
+	privateKey           crypto.PrivateKey            // private key for decrypting set command messages
+	registeredNodes      *RegisteredNodes             // registered nodes of this publisher
+	updateMutex          *sync.Mutex                  // mutex for async handling of inputs
+}
+
+// SetAuthorizer sets the authorizer that determines which senders can configure which nodes.
+// Use nil to allow all senders with a valid signature.
+func (nodeConfigure *ReceiveNodeConfigure) SetAuthorizer(authorizer acl.Authorizer) {
+	nodeConfigure.updateMutex.Lock()
+	defer nodeConfigure.updateMutex.Unlock()
+	nodeConfigure.authorizer = authorizer
 }
 
 // SetConfigureNodeHandler set the handler for updating node inputs
@@ -40,41 +52,58 @@ func (nodeConfigure *ReceiveNodeConfigure) Start() {
 	defer nodeConfigure.updateMutex.Unlock()
 	// subscribe to all configure commands for this publisher's nodes
 	addr := MakeNodeConfigureAddress(nodeConfigure.domain, nodeConfigure.publisherID, "+")
-	nodeConfigure.messageSigner.Subscribe(addr, nodeConfigure.receiveConfigureCommand)
+	nodeConfigure.subscription = nodeConfigure.messageSigner.Subscribe(addr, nodeConfigure.receiveConfigureCommand)
 }
 
 // Stop listening for commands
 func (nodeConfigure *ReceiveNodeConfigure) Stop() {
 	nodeConfigure.updateMutex.Lock()
 	defer nodeConfigure.updateMutex.Unlock()
-	addr := MakeNodeConfigureAddress(nodeConfigure.domain, nodeConfigure.publisherID, "+")
-	nodeConfigure.messageSigner.Unsubscribe(addr, nodeConfigure.receiveConfigureCommand)
+	nodeConfigure.messageSigner.Unsubscribe(nodeConfigure.subscription)
 }
 
 // handle an incoming a configuration command for one of our nodes. This:
 // - check if the message is encrypted
 // - check if the signature is valid
+// - check that the message is not a replay of an earlier command
 // - check if the node is valid
+// - check if the sender is authorized to configure the node
 // - if a configuration handler is set, let it apply the configuration
 // - save node configuration if persistence is set
-// TODO: support for authorization per node
+// - acknowledge the command if it has a correlation ID and the signature is verified
 func (nodeConfigure *ReceiveNodeConfigure) receiveConfigureCommand(nodeAddress string, message string) error {
 	var configureMessage types.NodeConfigureMessage
 
-	isEncrypted, isSigned, err := nodeConfigure.messageSigner.DecodeMessage(message, &configureMessage)
+	isEncrypted, isSigned, err := nodeConfigure.messageSigner.DecodeCommand(nodeAddress, message, &configureMessage)
 
 	if !isEncrypted {
-		return lib.MakeErrorf("receiveConfigureCommand: Configuration update of '%s' is not encrypted. Message discarded.", nodeAddress)
+		err = lib.MakeErrorf("receiveConfigureCommand: Configuration update of '%s' is not encrypted. Message discarded.", nodeAddress)
 	} else if !isSigned {
-		return lib.MakeErrorf("receiveConfigureCommand: Configuration update of '%s' is not signed. Message discarded.", nodeAddress)
+		err = lib.MakeErrorf("receiveConfigureCommand: Configuration update of '%s' is not signed. Message discarded.", nodeAddress)
 	} else if err != nil {
-		return lib.MakeErrorf("receiveConfigureCommand: Message to %s. Error %s'. Message discarded.", nodeAddress, err)
+		err = lib.MakeErrorf("receiveConfigureCommand: Message to %s. Error %s'. Message discarded.", nodeAddress, err)
+	}
+	if err != nil {
+		// the sender isn't verified so don't acknowledge
+		return err
 	}
 
-	// TODO: authorization check
 	node := nodeConfigure.registeredNodes.GetNodeByAddress(nodeAddress)
 	if node == nil || message == "" {
-		return lib.MakeErrorf("receiveConfigureCommand unknown node for address %s or missing message", nodeAddress)
+		err = lib.MakeErrorf("receiveConfigureCommand unknown node for address %s or missing message", nodeAddress)
+		nodeConfigure.publishAck(&configureMessage, types.AckStatusRejected, err)
+		return err
+	}
+	nodeConfigure.updateMutex.Lock()
+	authorizer := nodeConfigure.authorizer
+	nodeConfigure.updateMutex.Unlock()
+	if authorizer != nil && !authorizer.IsAuthorized(configureMessage.Sender, node.Address, acl.ActionConfigure) {
+		err = lib.MakeErrorf("receiveConfigureCommand: Sender '%s' is not authorized to configure node '%s'. Message discarded.",
+			configureMessage.Sender, node.Address)
+		nodeConfigure.registeredNodes.UpdateNodeStatus(node.HWID,
+			map[types.NodeStatus]string{types.NodeStatusLastError: err.Error()})
+		nodeConfigure.publishAck(&configureMessage, types.AckStatusRejected, err)
+		return err
 	}
 	logrus.Infof("receiveConfigureCommand configure command on address %s. isEncrypted=%t, isSigned=%t", nodeAddress, isEncrypted, isSigned)
 
@@ -82,13 +111,30 @@ func (nodeConfigure *ReceiveNodeConfigure) receiveConfigureCommand(nodeAddress s
 	if nodeConfigure.nodeConfigureHandler != nil {
 		// A handler can determine which configuration updates are applied
 		nodeConfigure.nodeConfigureHandler(node.HWID, params)
+		nodeConfigure.publishAck(&configureMessage, types.AckStatusAccepted, nil)
 	} else {
 		// Without a handler apply the configuration update
 		nodeConfigure.registeredNodes.UpdateNodeConfigValues(node.HWID, params)
+		nodeConfigure.publishAck(&configureMessage, types.AckStatusApplied, nil)
 	}
 	return nil
 }
 
+// publishAck acknowledges a configure command to its sender if the command has a correlation ID
+func (nodeConfigure *ReceiveNodeConfigure) publishAck(
+	configureMessage *types.NodeConfigureMessage, status types.AckStatus, err error) {
+
+	if configureMessage.CorrelationID == "" {
+		return
+	}
+	errorText := ""
+	if err != nil {
+		errorText = err.Error()
+	}
+	acks.PublishAck(nodeConfigure.domain, nodeConfigure.publisherID, configureMessage.Sender,
+		configureMessage.CorrelationID, status, errorText, nodeConfigure.messageSigner)
+}
+
 // NewReceiveNodeConfigure returns a new instance of handling of node configuration commands.
 func NewReceiveNodeConfigure(
 	domain string,
@@ -96,7 +142,7 @@ func NewReceiveNodeConfigure(
 	configHandler NodeConfigureHandler,
 	messageSigner *messaging.MessageSigner,
 	registeredNodes *RegisteredNodes,
-	privateKey *ecdsa.PrivateKey) *ReceiveNodeConfigure {
+	privateKey crypto.PrivateKey) *ReceiveNodeConfigure {
 	sin := &ReceiveNodeConfigure{
 		domain:               domain,
 		messageSigner:        messageSigner,
@@ -2,11 +2,12 @@
 package nodes
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"fmt"
 	"strings"
 	"sync"
 
+	"github.com/iotdomain/iotdomain-go/acl"
 	"github.com/iotdomain/iotdomain-go/lib"
 	"github.com/iotdomain/iotdomain-go/messaging"
 	"github.com/iotdomain/iotdomain-go/types"
@@ -20,12 +21,23 @@ type SetNodeIDHandler func(nodeAddress string, message *types.SetNodeIDMessage)
 // This decrypts incoming messages, determines the sender and verifies the signature with
 // the sender public key.
 type ReceiveSetNodeID struct {
-	domain        string                   // the domain of this publisher
-	publisherID   string                   // the registered publisher for the inputs
-	messageSigner *messaging.MessageSigner // subscription and publication messenger
-	privateKey    *ecdsa.PrivateKey        // private key for decrypting set command messages
-	handler       SetNodeIDHandler         // handler to pass the command to
-	updateMutex   *sync.Mutex              // mutex for async handling of inputs
+	authorizer      acl.Authorizer               // optional authorization of senders
+	domain          string                       // the domain of this publisher
+	publisherID     string                       // the registered publisher for the inputs
+	messageSigner   *messaging.MessageSigner     // subscription and publication messenger
+	subscription    messaging.SubscriptionHandle // handle of the subscription
+	privateKey      crypto.PrivateKey            // private key for decrypting set command messages
+	handler         SetNodeIDHandler             // handler to pass the command to
+	registeredNodes *RegisteredNodes             // registered nodes of this publisher
+	updateMutex     *sync.Mutex                  // mutex for async handling of inputs
+}
+
+// SetAuthorizer sets the authorizer that determines which senders can change the ID of which nodes.
+// Use nil to allow all senders with a valid signature.
+func (setNodeID *ReceiveSetNodeID) SetAuthorizer(authorizer acl.Authorizer) {
+	setNodeID.updateMutex.Lock()
+	defer setNodeID.updateMutex.Unlock()
+	setNodeID.authorizer = authorizer
 }
 
 // SetNodeIDHandler set the handler for updating node IDs
@@ -40,19 +52,18 @@ func (setNodeID *ReceiveSetNodeID) Start() {
 	setNodeID.updateMutex.Lock()
 	defer setNodeID.updateMutex.Unlock()
 	addr := MakeSetNodeIDAddress(setNodeID.domain, setNodeID.publisherID, "+")
-	setNodeID.messageSigner.Subscribe(addr, setNodeID.decodeSetNodeIDCommand)
+	setNodeID.subscription = setNodeID.messageSigner.Subscribe(addr, setNodeID.decodeSetNodeIDCommand)
 }
 
 // Stop listening for set node ID commands
 func (setNodeID *ReceiveSetNodeID) Stop() {
 	setNodeID.updateMutex.Lock()
 	defer setNodeID.updateMutex.Unlock()
-	addr := MakeSetNodeIDAddress(setNodeID.domain, setNodeID.publisherID, "+")
-	setNodeID.messageSigner.Unsubscribe(addr, setNodeID.decodeSetNodeIDCommand)
+	setNodeID.messageSigner.Unsubscribe(setNodeID.subscription)
 }
 
-// decodeSetNodeIDCommand decrypts and verifies the signature of an incoming set command.
-// If successful this passes the set command to the setInputHandler callback
+// decodeSetNodeIDCommand decrypts and verifies the signature and timestamp of an incoming set command.
+// If successful and the sender is authorized, this passes the command to the handler callback
 func (setNodeID *ReceiveSetNodeID) decodeSetNodeIDCommand(setAddress string, message string) error {
 	var setNodeIDMessage types.SetNodeIDMessage
 
@@ -66,7 +77,7 @@ func (setNodeID *ReceiveSetNodeID) decodeSetNodeIDCommand(setAddress string, mes
 	segments[3] = types.MessageTypeNodeDiscovery
 	nodeAddr := strings.Join(segments, "/")
 
-	isEncrypted, isSigned, err := setNodeID.messageSigner.DecodeMessage(message, &setNodeIDMessage)
+	isEncrypted, isSigned, err := setNodeID.messageSigner.DecodeCommand(setAddress, message, &setNodeIDMessage)
 
 	if !isEncrypted {
 		return lib.MakeErrorf("decodeSetNodeIDCommand: Update of '%s' is not encrypted. Message discarded.", setAddress)
@@ -76,6 +87,20 @@ func (setNodeID *ReceiveSetNodeID) decodeSetNodeIDCommand(setAddress string, mes
 		return lib.MakeErrorf("decodeSetNodeIDCommand: Message to %s. Error %s'. Message discarded.", setAddress, err)
 	}
 
+	setNodeID.updateMutex.Lock()
+	authorizer := setNodeID.authorizer
+	setNodeID.updateMutex.Unlock()
+	if authorizer != nil && !authorizer.IsAuthorized(setNodeIDMessage.Sender, nodeAddr, acl.ActionSetNodeID) {
+		err = lib.MakeErrorf("decodeSetNodeIDCommand: Sender '%s' is not authorized to change the ID of node '%s'. Message discarded.",
+			setNodeIDMessage.Sender, nodeAddr)
+		node := setNodeID.registeredNodes.GetNodeByAddress(nodeAddr)
+		if node != nil {
+			setNodeID.registeredNodes.UpdateNodeStatus(node.HWID,
+				map[types.NodeStatus]string{types.NodeStatusLastError: err.Error()})
+		}
+		return err
+	}
+
 	logrus.Infof("decodeSetNodeIDCommand on address %s. isEncrypted=%t, isSigned=%t", setAddress, isEncrypted, isSigned)
 
 	if setNodeID.handler != nil {
@@ -99,14 +124,16 @@ func NewReceiveSetNodeID(
 	publisherID string,
 	setNodeIDHandler func(address string, message *types.SetNodeIDMessage),
 	messageSigner *messaging.MessageSigner,
-	privateKey *ecdsa.PrivateKey) *ReceiveSetNodeID {
+	registeredNodes *RegisteredNodes,
+	privateKey crypto.PrivateKey) *ReceiveSetNodeID {
 	receiver := &ReceiveSetNodeID{
-		domain:        domain,
-		messageSigner: messageSigner,
-		handler:       setNodeIDHandler,
-		publisherID:   publisherID,
-		privateKey:    privateKey,
-		updateMutex:   &sync.Mutex{},
+		domain:          domain,
+		messageSigner:   messageSigner,
+		handler:         setNodeIDHandler,
+		publisherID:     publisherID,
+		privateKey:      privateKey,
+		registeredNodes: registeredNodes,
+		updateMutex:     &sync.Mutex{},
 	}
 	return receiver
 }
@@ -0,0 +1,332 @@
+// Package nodes with receiving of the firmware upgrade command
+package nodes
+
+import (
+	"crypto"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/acl"
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// Default limits of firmware upgrades, see also SetTransferLimits
+const (
+	DefaultMaxChunkCount   = 4096             // max nr of chunks of a chunked firmware upgrade
+	DefaultMaxFirmwareSize = 16 * 1024 * 1024 // max size of the firmware in bytes
+	DefaultTransferTimeout = 30 * time.Minute // time without chunks after which a partial transfer is discarded
+)
+
+// UpgradeHandler application handler that installs the received firmware on a node.
+// The firmware MD5 has been verified before the handler is invoked. Return an error if the
+// upgrade failed.
+type UpgradeHandler func(nodeHWID string, fwVersion string, firmware []byte) error
+
+// firmwareTransfer tracks the chunks received of a chunked firmware upgrade
+type firmwareTransfer struct {
+	md5      string    // MD5 of the complete firmware
+	chunks   [][]byte  // received chunks by index, nil if not yet received
+	received int       // nr of chunks received
+	size     int       // total size of the received chunks
+	updated  time.Time // time the last chunk was received
+}
+
+// ReceiveUpgrade listener for firmware upgrade commands aimed at nodes managed by this publisher.
+// This decrypts incoming messages, determines the sender and verifies the signature with
+// the sender public key. Chunked firmware is reassembled before it is passed to the handler.
+// A transfer that was interrupted can be resumed by sending the missing chunks of the same firmware.
+// Chunks of a firmware that was just installed are ignored.
+type ReceiveUpgrade struct {
+	authorizer      acl.Authorizer               // optional authorization of senders
+	domain          string                       // the domain of this publisher
+	publisherID     string                       // the registered publisher for the nodes
+	messageSigner   *messaging.MessageSigner     // subscription and publication messenger
+	subscription    messaging.SubscriptionHandle // handle of the subscription
+	privateKey      crypto.PrivateKey            // private key for decrypting upgrade messages
+	handler         UpgradeHandler               // handler to pass the firmware to
+	installedMD5    map[string]string            // MD5 of the most recent installed firmware by node HWID
+	maxChunkCount   int                          // max nr of chunks of a transfer
+	maxFirmwareSize int                          // max size of the firmware
+	now             func() time.Time             // clock for tracking the age of transfers
+	registeredNodes *RegisteredNodes             // registered nodes of this publisher
+	transferTimeout time.Duration                // partial transfers without chunks for this duration are discarded
+	transfers       map[string]*firmwareTransfer // chunked transfers in progress by node HWID
+	updateMutex     *sync.Mutex                  // mutex for async handling of upgrades
+}
+
+// GetMissingChunks returns the indices of the chunks that have not yet been received for a
+// chunked upgrade of the given node. Intended to resume an interrupted transfer.
+// Returns nil if no chunked transfer is in progress for the node.
+func (upgrade *ReceiveUpgrade) GetMissingChunks(nodeHWID string) []int {
+	upgrade.updateMutex.Lock()
+	defer upgrade.updateMutex.Unlock()
+	transfer := upgrade.transfers[nodeHWID]
+	if transfer == nil {
+		return nil
+	}
+	missing := make([]int, 0)
+	for index, chunk := range transfer.chunks {
+		if chunk == nil {
+			missing = append(missing, index)
+		}
+	}
+	return missing
+}
+
+// SetAuthorizer sets the authorizer that determines which senders can upgrade which nodes.
+// Use nil to allow all senders with a valid signature.
+func (upgrade *ReceiveUpgrade) SetAuthorizer(authorizer acl.Authorizer) {
+	upgrade.updateMutex.Lock()
+	defer upgrade.updateMutex.Unlock()
+	upgrade.authorizer = authorizer
+}
+
+// SetClock replaces the clock used to determine the age of partial transfers. Default is time.Now.
+// Intended for testing the transfer timeout.
+func (upgrade *ReceiveUpgrade) SetClock(now func() time.Time) {
+	upgrade.updateMutex.Lock()
+	defer upgrade.updateMutex.Unlock()
+	upgrade.now = now
+}
+
+// SetTransferLimits sets the limits of received firmware. Upgrades that exceed the limits are rejected.
+//  maxChunkCount is the max nr of chunks of a chunked upgrade
+//  maxFirmwareSize is the max size of the firmware in bytes
+//  transferTimeout is the time without new chunks after which a partial transfer is discarded
+func (upgrade *ReceiveUpgrade) SetTransferLimits(maxChunkCount int, maxFirmwareSize int, transferTimeout time.Duration) {
+	upgrade.updateMutex.Lock()
+	defer upgrade.updateMutex.Unlock()
+	upgrade.maxChunkCount = maxChunkCount
+	upgrade.maxFirmwareSize = maxFirmwareSize
+	upgrade.transferTimeout = transferTimeout
+}
+
+// SetUpgradeHandler set the handler for installing firmware
+func (upgrade *ReceiveUpgrade) SetUpgradeHandler(
+	handler func(nodeHWID string, fwVersion string, firmware []byte) error) {
+
+	upgrade.updateMutex.Lock()
+	defer upgrade.updateMutex.Unlock()
+	upgrade.handler = handler
+}
+
+// Start listening for upgrade commands
+func (upgrade *ReceiveUpgrade) Start() {
+	upgrade.updateMutex.Lock()
+	defer upgrade.updateMutex.Unlock()
+	addr := MakeNodeUpgradeAddress(upgrade.domain, upgrade.publisherID, "+")
+	upgrade.subscription = upgrade.messageSigner.Subscribe(addr, upgrade.decodeUpgradeCommand)
+}
+
+// Stop listening for upgrade commands
+func (upgrade *ReceiveUpgrade) Stop() {
+	upgrade.updateMutex.Lock()
+	defer upgrade.updateMutex.Unlock()
+	upgrade.messageSigner.Unsubscribe(upgrade.subscription)
+}
+
+// addChunk adds a received chunk to the transfer of the node. A chunk of a different firmware
+// replaces the existing transfer. Transfers that exceed the limits are discarded and transfers that
+// haven't received chunks within the transfer timeout expire.
+// Returns the firmware when all chunks are received.
+func (upgrade *ReceiveUpgrade) addChunk(
+	nodeHWID string, message *types.UpgradeFirmwareMessage) (progress int, firmware []byte, err error) {
+
+	upgrade.updateMutex.Lock()
+	defer upgrade.updateMutex.Unlock()
+
+	upgrade.expireTransfers()
+	if message.ChunkCount > upgrade.maxChunkCount {
+		return 0, nil, fmt.Errorf("chunk count %d exceeds the max of %d chunks", message.ChunkCount, upgrade.maxChunkCount)
+	} else if message.ChunkIndex < 0 || message.ChunkIndex >= message.ChunkCount {
+		return 0, nil, fmt.Errorf("chunk index %d is out of range of %d chunks", message.ChunkIndex, message.ChunkCount)
+	}
+	// ignore remaining chunks of a resumed transfer that has completed
+	if upgrade.installedMD5[nodeHWID] == message.MD5 {
+		return 100, nil, nil
+	}
+	transfer := upgrade.transfers[nodeHWID]
+	if transfer == nil || transfer.md5 != message.MD5 || len(transfer.chunks) != message.ChunkCount {
+		transfer = &firmwareTransfer{
+			md5:    message.MD5,
+			chunks: make([][]byte, message.ChunkCount),
+		}
+		upgrade.transfers[nodeHWID] = transfer
+	}
+	// ignore chunks that were already received
+	if transfer.chunks[message.ChunkIndex] == nil {
+		if transfer.size+len(message.Firmware) > upgrade.maxFirmwareSize {
+			delete(upgrade.transfers, nodeHWID)
+			return 0, nil, fmt.Errorf("firmware exceeds the max size of %d bytes", upgrade.maxFirmwareSize)
+		}
+		transfer.chunks[message.ChunkIndex] = message.Firmware
+		transfer.received++
+		transfer.size += len(message.Firmware)
+	}
+	transfer.updated = upgrade.now()
+	progress = transfer.received * 100 / len(transfer.chunks)
+	if transfer.received < len(transfer.chunks) {
+		return progress, nil, nil
+	}
+	// all chunks are received, reassemble the firmware
+	delete(upgrade.transfers, nodeHWID)
+	firmware = make([]byte, 0, transfer.size)
+	for _, chunk := range transfer.chunks {
+		firmware = append(firmware, chunk...)
+	}
+	return progress, firmware, nil
+}
+
+// expireTransfers discards partial transfers that haven't received a chunk within the transfer timeout
+// This must be called with the update mutex locked.
+func (upgrade *ReceiveUpgrade) expireTransfers() {
+	for nodeHWID, transfer := range upgrade.transfers {
+		if upgrade.now().Sub(transfer.updated) > upgrade.transferTimeout {
+			logrus.Warningf("expireTransfers: Discarding incomplete firmware transfer of node %s", nodeHWID)
+			delete(upgrade.transfers, nodeHWID)
+		}
+	}
+}
+
+// decodeUpgradeCommand decrypts and verifies the signature and timestamp of an incoming upgrade command.
+// If successful, the sender is authorized and the firmware is complete, this verifies the MD5 and passes the firmware to
+// the upgrade handler. Progress and outcome are reported in the node status.
+func (upgrade *ReceiveUpgrade) decodeUpgradeCommand(address string, message string) error {
+	var upgradeMessage types.UpgradeFirmwareMessage
+
+	// a full address is required: domain/pub/node/$upgrade
+	segments := strings.Split(address, "/")
+	if len(segments) < 4 {
+		return lib.MakeErrorf("decodeUpgradeCommand: address '%s' is incomplete", address)
+	}
+
+	isEncrypted, isSigned, err := upgrade.messageSigner.DecodeCommand(address, message, &upgradeMessage)
+
+	if !isEncrypted {
+		return lib.MakeErrorf("decodeUpgradeCommand: Upgrade of '%s' is not encrypted. Message discarded.", address)
+	} else if !isSigned {
+		return lib.MakeErrorf("decodeUpgradeCommand: Upgrade of '%s' is not signed. Message discarded.", address)
+	} else if err != nil {
+		return lib.MakeErrorf("decodeUpgradeCommand: Message to %s. Error %s'. Message discarded.", address, err)
+	}
+
+	node := upgrade.registeredNodes.GetNodeByAddress(address)
+	if node == nil {
+		return lib.MakeErrorf("decodeUpgradeCommand: unknown node for address %s", address)
+	}
+	upgrade.updateMutex.Lock()
+	authorizer := upgrade.authorizer
+	upgrade.updateMutex.Unlock()
+	if authorizer != nil && !authorizer.IsAuthorized(upgradeMessage.Sender, node.Address, acl.ActionUpgrade) {
+		err = lib.MakeErrorf("decodeUpgradeCommand: Sender '%s' is not authorized to upgrade node '%s'. Message discarded.",
+			upgradeMessage.Sender, node.Address)
+		upgrade.registeredNodes.UpdateNodeStatus(node.HWID,
+			map[types.NodeStatus]string{types.NodeStatusLastError: err.Error()})
+		return err
+	}
+	logrus.Infof("decodeUpgradeCommand on address %s. isEncrypted=%t, isSigned=%t", address, isEncrypted, isSigned)
+
+	firmware := upgradeMessage.Firmware
+	upgrade.updateMutex.Lock()
+	maxFirmwareSize := upgrade.maxFirmwareSize
+	upgrade.updateMutex.Unlock()
+	if len(firmware) > maxFirmwareSize {
+		err = fmt.Errorf("firmware exceeds the max size of %d bytes", maxFirmwareSize)
+		upgrade.registeredNodes.UpdateErrorStatus(node.HWID, types.NodeRunStateError, err.Error())
+		return lib.MakeErrorf("decodeUpgradeCommand: Upgrade of '%s' failed: %s", address, err)
+	}
+	if upgradeMessage.ChunkCount > 1 {
+		var progress int
+		progress, firmware, err = upgrade.addChunk(node.HWID, &upgradeMessage)
+		if err != nil {
+			upgrade.registeredNodes.UpdateErrorStatus(node.HWID, types.NodeRunStateError, err.Error())
+			return lib.MakeErrorf("decodeUpgradeCommand: Upgrade of '%s' failed: %s", address, err)
+		}
+		upgrade.registeredNodes.UpdateNodeStatus(node.HWID, map[types.NodeStatus]string{
+			types.NodeStatusRunState:        types.NodeRunStateUpgrading,
+			types.NodeStatusUpgradeProgress: strconv.Itoa(progress),
+		})
+		if firmware == nil {
+			// wait for more chunks
+			return nil
+		}
+	}
+	err = upgrade.installFirmware(node.HWID, upgradeMessage.FWVersion, upgradeMessage.MD5, firmware)
+	if err != nil {
+		upgrade.registeredNodes.UpdateErrorStatus(node.HWID, types.NodeRunStateError, err.Error())
+		return lib.MakeErrorf("decodeUpgradeCommand: Upgrade of '%s' failed: %s", address, err)
+	}
+	return nil
+}
+
+// installFirmware verifies the firmware MD5 and passes it to the handler
+// On success the node software version is updated.
+func (upgrade *ReceiveUpgrade) installFirmware(nodeHWID string, fwVersion string, md5Hex string, firmware []byte) error {
+	checksum := md5.Sum(firmware)
+	if !strings.EqualFold(hex.EncodeToString(checksum[:]), md5Hex) {
+		return fmt.Errorf("firmware MD5 mismatch")
+	}
+	upgrade.updateMutex.Lock()
+	handler := upgrade.handler
+	delete(upgrade.installedMD5, nodeHWID)
+	upgrade.updateMutex.Unlock()
+	if handler == nil {
+		return fmt.Errorf("no upgrade handler is configured")
+	}
+	upgrade.registeredNodes.UpdateNodeStatus(nodeHWID, map[types.NodeStatus]string{
+		types.NodeStatusRunState:        types.NodeRunStateUpgrading,
+		types.NodeStatusUpgradeProgress: "100",
+	})
+	err := handler(nodeHWID, fwVersion, firmware)
+	if err != nil {
+		return err
+	}
+	upgrade.updateMutex.Lock()
+	upgrade.installedMD5[nodeHWID] = md5Hex
+	upgrade.updateMutex.Unlock()
+	upgrade.registeredNodes.UpdateNodeAttr(nodeHWID, map[types.NodeAttr]string{
+		types.NodeAttrSoftwareVersion: fwVersion,
+	})
+	upgrade.registeredNodes.UpdateErrorStatus(nodeHWID, types.NodeRunStateReady, "")
+	return nil
+}
+
+// MakeNodeUpgradeAddress creates the address used to upgrade a node's firmware
+// domain, publisherID, nodeID of the existing node
+func MakeNodeUpgradeAddress(domain string, publisherID string, nodeID string) string {
+	return MakeNodeAddress(domain, publisherID, nodeID, types.MessageTypeUpgrade)
+}
+
+// NewReceiveUpgrade returns a new instance of handling of the upgrade command.
+func NewReceiveUpgrade(
+	domain string,
+	publisherID string,
+	upgradeHandler UpgradeHandler,
+	messageSigner *messaging.MessageSigner,
+	registeredNodes *RegisteredNodes,
+	privateKey crypto.PrivateKey) *ReceiveUpgrade {
+	receiver := &ReceiveUpgrade{
+		domain:          domain,
+		messageSigner:   messageSigner,
+		handler:         upgradeHandler,
+		installedMD5:    make(map[string]string),
+		maxChunkCount:   DefaultMaxChunkCount,
+		maxFirmwareSize: DefaultMaxFirmwareSize,
+		now:             time.Now,
+		publisherID:     publisherID,
+		privateKey:      privateKey,
+		registeredNodes: registeredNodes,
+		transferTimeout: DefaultTransferTimeout,
+		transfers:       make(map[string]*firmwareTransfer),
+		updateMutex:     &sync.Mutex{},
+	}
+	return receiver
+}
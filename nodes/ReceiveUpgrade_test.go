@@ -0,0 +1,128 @@
+package nodes_test
+
+import (
+	"crypto"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/nodes"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiveUpgrade(t *testing.T) {
+	const fwVersion = "1.2.3"
+	var privKey = messaging.CreateAsymKeys()
+	var firmware = []byte("This is the firmware of node 1")
+	var firmware2 = []byte("This is firmware version 2 of node 1")
+	var installed []byte
+
+	collection := nodes.NewRegisteredNodes(domain, publisher1ID)
+	node1 := collection.CreateNode(node1ID, types.NodeTypeUnknown)
+
+	getPublisherKey := func(addr string) crypto.PublicKey {
+		return &privKey.PublicKey
+	}
+	handler := func(hwID string, version string, fw []byte) error {
+		installed = fw
+		return nil
+	}
+	msgr := messaging.NewDummyMessenger(nil)
+	signer := messaging.NewMessageSigner(msgr, privKey, getPublisherKey)
+	receiver := nodes.NewReceiveUpgrade(domain, publisher1ID, nil, signer, collection, privKey)
+	receiver.Start()
+
+	// without handler the upgrade fails
+	err := nodes.PublishUpgrade(node1.Address, fwVersion, firmware, "sender", signer, &privKey.PublicKey)
+	assert.NoError(t, err)
+	status, _ := collection.GetNodeByHWID(node1ID).Status[types.NodeStatusRunState]
+	assert.Equal(t, types.NodeRunStateError, status)
+
+	// single message upgrade
+	receiver.SetUpgradeHandler(handler)
+	err = nodes.PublishUpgrade(node1.Address, fwVersion, firmware, "sender", signer, &privKey.PublicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, firmware, installed)
+	assert.Equal(t, fwVersion, collection.GetNodeAttr(node1ID, types.NodeAttrSoftwareVersion))
+	status, _ = collection.GetNodeByHWID(node1ID).Status[types.NodeStatusRunState]
+	assert.Equal(t, types.NodeRunStateReady, status)
+
+	// chunked upgrade, interrupted and resumed
+	installed = nil
+	err = nodes.PublishUpgradeChunks(node1.Address, "2.0", firmware2, 4, 0, "sender", signer, nil)
+	assert.NoError(t, err, "unencrypted chunks are discarded by the receiver")
+	assert.Nil(t, receiver.GetMissingChunks(node1ID))
+	nodes.PublishUpgradeChunks(node1.Address, "2.0", firmware2, 4, 5, "sender", signer, &privKey.PublicKey)
+	missing := receiver.GetMissingChunks(node1ID)
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, missing)
+	status, _ = collection.GetNodeByHWID(node1ID).Status[types.NodeStatusRunState]
+	assert.Equal(t, types.NodeRunStateUpgrading, status)
+	assert.Nil(t, installed)
+	// resending all chunks ignores the chunks already received
+	nodes.PublishUpgradeChunks(node1.Address, "2.0", firmware2, 4, 0, "sender", signer, &privKey.PublicKey)
+	assert.Equal(t, firmware2, installed)
+	assert.Nil(t, receiver.GetMissingChunks(node1ID))
+	assert.Equal(t, "2.0", collection.GetNodeAttr(node1ID, types.NodeAttrSoftwareVersion))
+
+	// a chunk of a different firmware replaces the transfer
+	nodes.PublishUpgradeChunks(node1.Address, "2.1", firmware, 10, 2, "sender", signer, &privKey.PublicKey)
+	nodes.PublishUpgradeChunks(node1.Address, "2.1", firmware, 4, 7, "sender", signer, &privKey.PublicKey)
+	missing = receiver.GetMissingChunks(node1ID)
+	assert.Equal(t, 7, len(missing))
+	// chunks of the installed firmware are ignored
+	nodes.PublishUpgradeChunks(node1.Address, "2.0", firmware2, 4, 0, "sender", signer, &privKey.PublicKey)
+	assert.Equal(t, 7, len(receiver.GetMissingChunks(node1ID)))
+
+	// handler failure is reported in the node status
+	receiver.SetUpgradeHandler(func(hwID string, version string, fw []byte) error {
+		return errors.New("upgrade failed")
+	})
+	nodes.PublishUpgrade(node1.Address, "3.0", firmware, "sender", signer, &privKey.PublicKey)
+	assert.Equal(t, "2.0", collection.GetNodeAttr(node1ID, types.NodeAttrSoftwareVersion))
+	lastError, _ := collection.GetNodeByHWID(node1ID).Status[types.NodeStatusLastError]
+	assert.Equal(t, "upgrade failed", lastError)
+
+	// chunks received within the transfer timeout are kept, stale transfers expire
+	now := time.Now()
+	receiver.SetClock(func() time.Time { return now })
+	receiver.SetUpgradeHandler(handler)
+	receiver.SetTransferLimits(8, 100, time.Minute)
+	nodes.PublishUpgradeChunks(node1.Address, "4.0", firmware, 10, 2, "sender", signer, &privKey.PublicKey)
+	assert.Equal(t, []int{0, 1}, receiver.GetMissingChunks(node1ID))
+	now = now.Add(59 * time.Second)
+	nodes.PublishUpgradeChunks(node1.Address, "4.0", firmware, 10, 1, "sender", signer, &privKey.PublicKey)
+	assert.Equal(t, []int{0}, receiver.GetMissingChunks(node1ID), "chunks within the timeout not kept")
+	now = now.Add(61 * time.Second)
+	nodes.PublishUpgradeChunks(node1.Address, "4.0", firmware, 10, 2, "sender", signer, &privKey.PublicKey)
+	assert.Equal(t, []int{0, 1}, receiver.GetMissingChunks(node1ID), "stale transfer not expired")
+	receiver.SetClock(time.Now)
+
+	// upgrades that exceed the limits are rejected
+	receiver.SetTransferLimits(8, 20, time.Hour)
+	hugeChunkCount := types.UpgradeFirmwareMessage{
+		Address: nodes.MakeNodeUpgradeAddress(domain, publisher1ID, node1ID), ChunkCount: 1 << 30, ChunkIndex: 1,
+		Firmware: firmware[:5], FWVersion: "4.1", MD5: "0", Sender: "sender", Timestamp: time.Now().Format(types.TimeFormat)}
+	signer.PublishObject(hugeChunkCount.Address, false, &hugeChunkCount, &privKey.PublicKey)
+	lastError, _ = collection.GetNodeByHWID(node1ID).Status[types.NodeStatusLastError]
+	assert.Contains(t, lastError, "chunk count")
+	nodes.PublishUpgrade(node1.Address, "4.1", firmware, "sender", signer, &privKey.PublicKey)
+	lastError, _ = collection.GetNodeByHWID(node1ID).Status[types.NodeStatusLastError]
+	assert.Contains(t, lastError, "max size")
+	collection.UpdateErrorStatus(node1ID, types.NodeRunStateReady, "")
+	nodes.PublishUpgradeChunks(node1.Address, "4.1", firmware2, 5, 0, "sender", signer, &privKey.PublicKey)
+	lastError, _ = collection.GetNodeByHWID(node1ID).Status[types.NodeStatusLastError]
+	assert.Contains(t, lastError, "max size")
+	assert.Equal(t, "2.0", collection.GetNodeAttr(node1ID, types.NodeAttrSoftwareVersion))
+	receiver.SetTransferLimits(nodes.DefaultMaxChunkCount, nodes.DefaultMaxFirmwareSize, nodes.DefaultTransferTimeout)
+
+	// error conditions
+	err = nodes.PublishUpgrade("invalidaddr", fwVersion, firmware, "sender", signer, &privKey.PublicKey)
+	assert.Error(t, err)
+	nodes.PublishUpgrade(domain+"/"+publisher1ID+"/nonode", fwVersion, firmware, "sender", signer, &privKey.PublicKey)
+	signer.SetSignMessages(false)
+	nodes.PublishUpgrade(node1.Address, fwVersion, firmware, "sender", signer, &privKey.PublicKey)
+
+	receiver.Stop()
+}
@@ -29,6 +29,7 @@ type RegisteredNodes struct {
 	// onSetNodeID  func(node *types.NodeDiscoveryMessage, newID string) // notify of a change in node ID. Use this to update input and output addresses
 	nodeMap      map[string]*types.NodeDiscoveryMessage // registered nodes by node ID
 	updatedNodes map[string]*types.NodeDiscoveryMessage // updated nodes by device ID
+	deletedNodes map[string]*types.NodeDiscoveryMessage // deleted nodes by address, pending removal from the bus
 	updateMutex  *sync.Mutex                            // mutex for async updating of nodes
 }
 
@@ -106,8 +107,19 @@ func (regNodes *RegisteredNodes) CreateNodeConfig(
 }
 
 // DeleteNode deletes a node from the collection of registered nodes
+// The node is kept in the list of deleted nodes until its publication is removed, see GetDeletedNodes.
 func (regNodes *RegisteredNodes) DeleteNode(hwAddress string) {
-	// TODO
+	regNodes.updateMutex.Lock()
+	defer regNodes.updateMutex.Unlock()
+
+	node := regNodes.deviceMap[hwAddress]
+	if node == nil {
+		return
+	}
+	delete(regNodes.deviceMap, node.HWID)
+	delete(regNodes.nodeMap, node.NodeID)
+	delete(regNodes.updatedNodes, node.Address)
+	regNodes.deletedNodes[node.Address] = node
 }
 
 // GetAllNodes returns a list of nodes
@@ -271,6 +283,23 @@ func (regNodes *RegisteredNodes) GetNodeConfigString(
 	return attrValue, nil
 }
 
+// GetDeletedNodes returns the list of nodes that have been deleted
+// clearUpdates clears the list of deleted nodes. Intended for removing their publications.
+func (regNodes *RegisteredNodes) GetDeletedNodes(clearUpdates bool) []*types.NodeDiscoveryMessage {
+	var deleteList []*types.NodeDiscoveryMessage = make([]*types.NodeDiscoveryMessage, 0)
+
+	regNodes.updateMutex.Lock()
+	defer regNodes.updateMutex.Unlock()
+
+	for _, node := range regNodes.deletedNodes {
+		deleteList = append(deleteList, node)
+	}
+	if clearUpdates {
+		regNodes.deletedNodes = make(map[string]*types.NodeDiscoveryMessage)
+	}
+	return deleteList
+}
+
 // GetUpdatedNodes returns the list of nodes that have been updated
 // clearUpdates clears the list of updates. Intended for publishing only updated nodes.
 func (regNodes *RegisteredNodes) GetUpdatedNodes(clearUpdates bool) []*types.NodeDiscoveryMessage {
@@ -568,6 +597,7 @@ func (regNodes *RegisteredNodes) updateNode(node *types.NodeDiscoveryMessage) {
 	}
 	node.Timestamp = time.Now().Format(types.TimeFormat)
 	regNodes.updatedNodes[node.Address] = node
+	delete(regNodes.deletedNodes, node.Address)
 }
 
 // MakeNodeAddress generates the publication address of a node: domain/publisherID/nodeID[/messageType].
@@ -588,6 +618,16 @@ func MakeNodeConfigureAddress(domain string, publisherID string, nodeID string)
 	return MakeNodeAddress(domain, publisherID, nodeID, types.MessageTypeConfigure)
 }
 
+// MakeNodeCreateAddress generates the address to create a node: domain/publisherID/nodeHWID/$create.
+func MakeNodeCreateAddress(domain string, publisherID string, nodeHWID string) string {
+	return MakeNodeAddress(domain, publisherID, nodeHWID, types.MessageTypeCreate)
+}
+
+// MakeNodeDeleteAddress generates the address to delete a node: domain/publisherID/nodeID/$delete.
+func MakeNodeDeleteAddress(domain string, publisherID string, nodeID string) string {
+	return MakeNodeAddress(domain, publisherID, nodeID, types.MessageTypeDelete)
+}
+
 // MakeNodeDiscoveryAddress generates the address of a node: domain/publisherID/nodeID/$node.
 func MakeNodeDiscoveryAddress(domain string, publisherID string, nodeID string) string {
 	return MakeNodeAddress(domain, publisherID, nodeID, types.MessageTypeNodeDiscovery)
@@ -631,7 +671,10 @@ func NewNode(domain string, publisherID string, nodeHWID string, nodeType types.
 	}
 	newNode.Attr[types.NodeAttrType] = string(nodeType)
 	newNode.Config[types.NodeAttrName] = *NewNodeConfig(types.DataTypeString, "Human friendly node name", "")
+	newNode.Config[types.NodeAttrPublishBatch] = *NewNodeConfig(types.DataTypeInt, "Nr of output events per batch, 0 to disable batching. Batching replaces the other output publications", "0")
+	newNode.Config[types.NodeAttrPublishBatchAge] = *NewNodeConfig(types.DataTypeInt, "Max age in seconds of a batch before it is published", "60")
 	newNode.Config[types.NodeAttrPublishEvent] = *NewNodeConfig(types.DataTypeString, "Enable publishing outputs as event", "false")
+	newNode.Config[types.NodeAttrPublishForecast] = *NewNodeConfig(types.DataTypeBool, "Enable publishing output forecasts", "true")
 	newNode.Config[types.NodeAttrPublishHistory] = *NewNodeConfig(types.DataTypeBool, "Enable publishing output history", "true")
 	newNode.Config[types.NodeAttrPublishLatest] = *NewNodeConfig(types.DataTypeBool, "Enable publishing latest output", "true")
 	newNode.Config[types.NodeAttrPublishRaw] = *NewNodeConfig(types.DataTypeBool, "Enable publishing raw outputs", "true")
@@ -647,6 +690,7 @@ func NewRegisteredNodes(domain string, publisherID string) *RegisteredNodes {
 		deviceMap:    make(map[string]*types.NodeDiscoveryMessage),
 		nodeMap:      make(map[string]*types.NodeDiscoveryMessage),
 		updatedNodes: make(map[string]*types.NodeDiscoveryMessage),
+		deletedNodes: make(map[string]*types.NodeDiscoveryMessage),
 		updateMutex:  &sync.Mutex{},
 	}
 	return &nodes
@@ -1,10 +1,11 @@
 package nodes_test
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"fmt"
 	"testing"
 
+	"github.com/iotdomain/iotdomain-go/acl"
 	"github.com/iotdomain/iotdomain-go/messaging"
 	"github.com/iotdomain/iotdomain-go/nodes"
 	"github.com/iotdomain/iotdomain-go/types"
@@ -209,7 +210,7 @@ func TestReceiveConfig(t *testing.T) {
 	collection := nodes.NewRegisteredNodes(domain, publisher1ID)
 	node1 := collection.CreateNode(node1ID, types.NodeTypeUnknown)
 
-	getPublisherKey := func(addr string) *ecdsa.PublicKey {
+	getPublisherKey := func(addr string) crypto.PublicKey {
 		return &privKey.PublicKey
 	}
 	handler := func(hwID string, params types.NodeAttrMap) {
@@ -240,9 +241,127 @@ func TestReceiveConfig(t *testing.T) {
 	signer.SetSignMessages(false)
 	nodes.PublishNodeConfigure(node1.Address, types.NodeAttrMap{}, "sender", signer, &privKey.PublicKey)
 
+	signer.SetSignMessages(true)
+
+	// - not authorized
+	accessControlList := acl.NewAccessControlList("", "", publisher1ID)
+	accessControlList.AddRule(acl.ACLRule{Sender: "admin", Address: "#", Actions: []string{acl.ActionConfigure}})
+	receiver.SetAuthorizer(accessControlList)
+	nodes.PublishNodeConfigure(node1.Address, types.NodeAttrMap{
+		types.NodeAttrName: "alice",
+	}, "senderaddress", signer, &privKey.PublicKey)
+	name := collection.GetNodeAttr(node1ID, types.NodeAttrName)
+	assert.Equal(t, "bob", name)
+	lastError := collection.GetNodeByHWID(node1ID).Status[types.NodeStatusLastError]
+	assert.Contains(t, lastError, "not authorized")
+	// - authorized
+	nodes.PublishNodeConfigure(node1.Address, types.NodeAttrMap{
+		types.NodeAttrName: "alice",
+	}, "admin", signer, &privKey.PublicKey)
+
 	receiver.Stop()
+	name = collection.GetNodeAttr(node1ID, types.NodeAttrName)
+	assert.Equal(t, "alice", name)
+}
+
+func TestDeleteNode(t *testing.T) {
+	collection := nodes.NewRegisteredNodes(domain, publisher1ID)
+	node1 := collection.CreateNode(node1ID, types.NodeTypeUnknown)
+	collection.GetUpdatedNodes(true)
+
+	collection.DeleteNode(node1ID)
+	node := collection.GetNodeByHWID(node1ID)
+	assert.Nil(t, node, "Node not deleted")
+	deleted := collection.GetDeletedNodes(true)
+	require.Equal(t, 1, len(deleted))
+	assert.Equal(t, node1.Address, deleted[0].Address)
+	deleted = collection.GetDeletedNodes(true)
+	assert.Equal(t, 0, len(deleted))
+
+	// deleting a non existing node is ignored
+	collection.DeleteNode(node1ID)
+	deleted = collection.GetDeletedNodes(false)
+	assert.Equal(t, 0, len(deleted))
+
+	// recreating a deleted node should not remove it
+	collection.CreateNode(node1ID, types.NodeTypeUnknown)
+	collection.DeleteNode(node1ID)
+	collection.CreateNode(node1ID, types.NodeTypeUnknown)
+	deleted = collection.GetDeletedNodes(true)
+	assert.Equal(t, 0, len(deleted))
+}
+
+func TestReceiveCreateDelete(t *testing.T) {
+	const node2ID = "node2"
+	var privKey = messaging.CreateAsymKeys()
+	var deleteCount = 0
+
+	collection := nodes.NewRegisteredNodes(domain, publisher1ID)
+	node1Address := nodes.MakeNodeDiscoveryAddress(domain, publisher1ID, node1ID)
+	node2Address := nodes.MakeNodeDiscoveryAddress(domain, publisher1ID, node2ID)
+
+	getPublisherKey := func(addr string) crypto.PublicKey {
+		return &privKey.PublicKey
+	}
+	msgr := messaging.NewDummyMessenger(nil)
+	signer := messaging.NewMessageSigner(msgr, privKey, getPublisherKey)
+	createReceiver := nodes.NewReceiveCreateNode(domain, publisher1ID, nil, signer, collection, privKey)
+	deleteReceiver := nodes.NewReceiveDeleteNode(domain, publisher1ID, nil, signer, collection, privKey)
+	createReceiver.Start()
+	deleteReceiver.Start()
+
+	// create without handler creates and configures the node
+	err := nodes.PublishCreateNode(node1Address, types.NodeTypeAVReceiver, types.NodeAttrMap{
+		types.NodeAttrName: "bob",
+	}, "senderaddress", signer, &privKey.PublicKey)
+	assert.NoError(t, err)
+	node1 := collection.GetNodeByHWID(node1ID)
+	require.NotNil(t, node1, "Node not created")
+	assert.Equal(t, string(types.NodeTypeAVReceiver), node1.Attr[types.NodeAttrType])
 	name := collection.GetNodeAttr(node1ID, types.NodeAttrName)
 	assert.Equal(t, "bob", name)
+
+	// create with handler lets the handler create the node
+	createReceiver.SetCreateNodeHandler(func(hwID string, nodeType types.NodeType, params types.NodeAttrMap) {
+		collection.CreateNode(hwID, nodeType)
+	})
+	err = nodes.PublishCreateNode(node2Address, types.NodeTypeUnknown, nil, "senderaddress", signer, &privKey.PublicKey)
+	assert.NoError(t, err)
+	assert.NotNil(t, collection.GetNodeByHWID(node2ID), "Node 2 not created")
+
+	// delete without handler removes the node
+	err = nodes.PublishDeleteNode(node1.Address, "senderaddress", signer, &privKey.PublicKey)
+	assert.NoError(t, err)
+	assert.Nil(t, collection.GetNodeByHWID(node1ID), "Node not deleted")
+
+	// delete with handler
+	deleteReceiver.SetDeleteNodeHandler(func(hwID string) {
+		deleteCount++
+		collection.DeleteNode(hwID)
+	})
+	nodes.PublishDeleteNode(node2Address, "senderaddress", signer, &privKey.PublicKey)
+	assert.Equal(t, 1, deleteCount)
+	assert.Nil(t, collection.GetNodeByHWID(node2ID), "Node 2 not deleted")
+
+	// error conditions
+	// - invalid address
+	err = nodes.PublishCreateNode("invalidaddr", types.NodeTypeUnknown, nil, "sender", signer, &privKey.PublicKey)
+	assert.Error(t, err)
+	err = nodes.PublishDeleteNode("invalidaddr", "sender", signer, &privKey.PublicKey)
+	assert.Error(t, err)
+	// - delete unknown node
+	nodes.PublishDeleteNode(node1Address, "sender", signer, &privKey.PublicKey)
+	assert.Equal(t, 1, deleteCount)
+	// - not encrypted
+	nodes.PublishCreateNode(node1Address, types.NodeTypeUnknown, nil, "sender", signer, nil)
+	assert.Nil(t, collection.GetNodeByHWID(node1ID), "Unencrypted create command was accepted")
+	// - not signed
+	signer.SetSignMessages(false)
+	nodes.PublishCreateNode(node1Address, types.NodeTypeUnknown, nil, "sender", signer, &privKey.PublicKey)
+	assert.Nil(t, collection.GetNodeByHWID(node1ID), "Unsigned create command was accepted")
+
+	createReceiver.Stop()
+	deleteReceiver.Stop()
 }
 
 func TestLoadSave(t *testing.T) {
@@ -283,7 +402,7 @@ func TestChangeNodeID(t *testing.T) {
 
 	var privKey = messaging.CreateAsymKeys()
 
-	getPublisherKey := func(addr string) *ecdsa.PublicKey {
+	getPublisherKey := func(addr string) crypto.PublicKey {
 		return &privKey.PublicKey
 	}
 
@@ -294,7 +413,7 @@ func TestChangeNodeID(t *testing.T) {
 		hwAddress := collection.GetNodeByAddress(address)
 		collection.SetNodeID(hwAddress, message.NodeID)
 	}
-	receiver := nodes.NewReceiveSetNodeID(domain, publisher1ID, nil, signer, privKey)
+	receiver := nodes.NewReceiveSetNodeID(domain, publisher1ID, nil, signer, collection, privKey)
 	receiver.SetNodeIDHandler(setNodeIDHandler)
 	receiver.Start()
 
@@ -319,7 +438,7 @@ func TestPublishReceive(t *testing.T) {
 
 	var privKey = messaging.CreateAsymKeys()
 
-	getPublisherKey := func(addr string) *ecdsa.PublicKey {
+	getPublisherKey := func(addr string) crypto.PublicKey {
 		return &privKey.PublicKey
 	}
 
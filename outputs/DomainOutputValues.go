@@ -2,8 +2,12 @@
 package outputs
 
 import (
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 
+	"github.com/iotdomain/iotdomain-go/lib"
 	"github.com/iotdomain/iotdomain-go/messaging"
 	"github.com/iotdomain/iotdomain-go/types"
 )
@@ -11,12 +15,23 @@ import (
 // DomainOutputValues for managing values of discovered outputs
 type DomainOutputValues struct {
 	// c             lib.DomainCollection //
-	raw           map[string]string
-	latest        map[string]*types.OutputLatestMessage
-	history       map[string]*types.OutputHistoryMessage
-	event         map[string]*types.OutputEventMessage
-	messageSigner *messaging.MessageSigner // subscription to output discovery messages
-	updateMutex   *sync.Mutex              // mutex for async updating of outputs
+	raw               map[string]string
+	latest            map[string]*types.OutputLatestMessage
+	history           map[string]*types.OutputHistoryMessage
+	event             map[string]*types.OutputEventMessage
+	forecast          map[string]*types.OutputForecastMessage
+	messageSigner     *messaging.MessageSigner                // subscription to output discovery messages
+	subscriptions     map[string]messaging.SubscriptionHandle // subscription handles by address
+	subscriptionMutex *sync.Mutex                             // mutex for updating subscriptions
+	updateMutex       *sync.Mutex                             // mutex for async updating of outputs
+}
+
+// GetForecast returns the forecast message of an output
+func (dov *DomainOutputValues) GetForecast(forecastAddress string) (value *types.OutputForecastMessage, found bool) {
+	dov.updateMutex.Lock()
+	defer dov.updateMutex.Unlock()
+	value, found = dov.forecast[forecastAddress]
+	return value, found
 }
 
 // GetRaw returns the latest raw value of an output
@@ -27,6 +42,22 @@ func (dov *DomainOutputValues) GetRaw(rawAddress string) (value string, found bo
 	return value, found
 }
 
+// GetEvent returns the event message of a node
+func (dov *DomainOutputValues) GetEvent(eventAddress string) (value *types.OutputEventMessage, found bool) {
+	dov.updateMutex.Lock()
+	defer dov.updateMutex.Unlock()
+	value, found = dov.event[eventAddress]
+	return value, found
+}
+
+// GetHistory returns the history message of an output
+func (dov *DomainOutputValues) GetHistory(historyAddress string) (value *types.OutputHistoryMessage, found bool) {
+	dov.updateMutex.Lock()
+	defer dov.updateMutex.Unlock()
+	value, found = dov.history[historyAddress]
+	return value, found
+}
+
 // GetLatest returns the 'latest' value message of an output
 func (dov *DomainOutputValues) GetLatest(latestAddress string) (value *types.OutputLatestMessage, found bool) {
 	dov.updateMutex.Lock()
@@ -35,6 +66,202 @@ func (dov *DomainOutputValues) GetLatest(latestAddress string) (value *types.Out
 	return value, found
 }
 
+// RemovePublisherValues removes all output values of a publisher, eg when the publisher is revoked
+// publisherAddress contains the domain/publisherID[/$identity]
+func (dov *DomainOutputValues) RemovePublisherValues(publisherAddress string) {
+	base := lib.MakeBaseAddress(publisherAddress) + "/"
+	dov.updateMutex.Lock()
+	defer dov.updateMutex.Unlock()
+	for addr := range dov.raw {
+		if strings.HasPrefix(addr, base) {
+			delete(dov.raw, addr)
+		}
+	}
+	for addr := range dov.latest {
+		if strings.HasPrefix(addr, base) {
+			delete(dov.latest, addr)
+		}
+	}
+	for addr := range dov.history {
+		if strings.HasPrefix(addr, base) {
+			delete(dov.history, addr)
+		}
+	}
+	for addr := range dov.event {
+		if strings.HasPrefix(addr, base) {
+			delete(dov.event, addr)
+		}
+	}
+	for addr := range dov.forecast {
+		if strings.HasPrefix(addr, base) {
+			delete(dov.forecast, addr)
+		}
+	}
+}
+
+// Subscribe to output values from a domain publisher
+// Use "+" as domain or publisherID to subscribe to all domains or publishers.
+// Batches of node events are fanned out into the latest values of the node outputs.
+// Values of confidential outputs are decrypted if this publisher is one of their readers.
+func (dov *DomainOutputValues) Subscribe(domain string, publisherID string) {
+	dov.subscriptionMutex.Lock()
+	defer dov.subscriptionMutex.Unlock()
+	for addr, handler := range dov.makeSubscriptions(domain, publisherID) {
+		if _, found := dov.subscriptions[addr]; !found {
+			dov.subscriptions[addr] = dov.messageSigner.Subscribe(addr, handler)
+		}
+	}
+}
+
+// Unsubscribe from output values of a domain publisher
+func (dov *DomainOutputValues) Unsubscribe(domain string, publisherID string) {
+	dov.subscriptionMutex.Lock()
+	defer dov.subscriptionMutex.Unlock()
+	for address := range dov.makeSubscriptions(domain, publisherID) {
+		if handle, found := dov.subscriptions[address]; found {
+			dov.messageSigner.Unsubscribe(handle)
+			delete(dov.subscriptions, address)
+		}
+	}
+}
+
+// handleBatch updates the latest values of the node outputs contained in a batch
+// This verifies that the batch message is properly signed by its publisher
+func (dov *DomainOutputValues) handleBatch(address string, message string) error {
+	var batchMessage types.OutputBatchMessage
+
+	if message == "" {
+		// retained batch was removed
+		return nil
+	}
+	_, _, err := dov.messageSigner.DecodeMessage(message, &batchMessage)
+	if err != nil {
+		return lib.MakeErrorf("handleBatch: Failed verifying batch on address %s: %s", address, err)
+	}
+	if batchMessage.Address != address {
+		return lib.MakeErrorf("handleBatch: Batch address %s doesn't match publication address %s",
+			batchMessage.Address, address)
+	}
+	for _, latest := range DecodeBatch(&batchMessage) {
+		dov.UpdateLatest(latest)
+	}
+	return nil
+}
+
+// handleForecast updates the forecast of a domain output
+// This verifies that the forecast message is properly signed by its publisher
+func (dov *DomainOutputValues) handleForecast(address string, message string) error {
+	var forecastMessage types.OutputForecastMessage
+
+	if message == "" {
+		// retained forecast was removed
+		dov.updateMutex.Lock()
+		delete(dov.forecast, address)
+		dov.updateMutex.Unlock()
+		return nil
+	}
+	_, _, err := dov.messageSigner.DecodeMessage(message, &forecastMessage)
+	if err != nil {
+		return lib.MakeErrorf("handleForecast: Failed verifying forecast on address %s: %s", address, err)
+	}
+	if forecastMessage.Address != address {
+		return lib.MakeErrorf("handleForecast: Forecast address %s doesn't match publication address %s",
+			forecastMessage.Address, address)
+	}
+	dov.UpdateForecast(&forecastMessage)
+	return nil
+}
+
+// handleEvent updates the event of a domain node
+// This decrypts the event if needed and verifies that it is properly signed by its publisher
+func (dov *DomainOutputValues) handleEvent(address string, message string) error {
+	var eventMessage types.OutputEventMessage
+
+	if message == "" {
+		// retained event was removed
+		dov.updateMutex.Lock()
+		delete(dov.event, address)
+		dov.updateMutex.Unlock()
+		return nil
+	}
+	_, _, err := dov.messageSigner.DecodeMessage(message, &eventMessage)
+	if err != nil {
+		return lib.MakeErrorf("handleEvent: Failed decoding event on address %s: %s", address, err)
+	}
+	if eventMessage.Address != address {
+		return lib.MakeErrorf("handleEvent: Event address %s doesn't match publication address %s",
+			eventMessage.Address, address)
+	}
+	dov.UpdateEvent(&eventMessage)
+	return nil
+}
+
+// handleHistory updates the history of a domain output
+// This decrypts the history if needed and verifies that it is properly signed by its publisher
+func (dov *DomainOutputValues) handleHistory(address string, message string) error {
+	var historyMessage types.OutputHistoryMessage
+
+	if message == "" {
+		// retained history was removed
+		dov.updateMutex.Lock()
+		delete(dov.history, address)
+		dov.updateMutex.Unlock()
+		return nil
+	}
+	_, _, err := dov.messageSigner.DecodeMessage(message, &historyMessage)
+	if err != nil {
+		return lib.MakeErrorf("handleHistory: Failed decoding history on address %s: %s", address, err)
+	}
+	if historyMessage.Address != address {
+		return lib.MakeErrorf("handleHistory: History address %s doesn't match publication address %s",
+			historyMessage.Address, address)
+	}
+	dov.UpdateHistory(&historyMessage)
+	return nil
+}
+
+// handleLatest updates the latest value of a domain output
+// This decrypts the value if needed and verifies that it is properly signed by its publisher
+func (dov *DomainOutputValues) handleLatest(address string, message string) error {
+	var latestMessage types.OutputLatestMessage
+
+	if message == "" {
+		// retained value was removed
+		dov.updateMutex.Lock()
+		delete(dov.latest, address)
+		dov.updateMutex.Unlock()
+		return nil
+	}
+	_, _, err := dov.messageSigner.DecodeMessage(message, &latestMessage)
+	if err != nil {
+		return lib.MakeErrorf("handleLatest: Failed decoding value on address %s: %s", address, err)
+	}
+	if latestMessage.Address != address {
+		return lib.MakeErrorf("handleLatest: Value address %s doesn't match publication address %s",
+			latestMessage.Address, address)
+	}
+	dov.UpdateLatest(&latestMessage)
+	return nil
+}
+
+// makeSubscriptions returns the handlers of the output value subscriptions of a domain publisher
+func (dov *DomainOutputValues) makeSubscriptions(
+	domain string, publisherID string) map[string]func(address string, message string) error {
+
+	batchAddr := MakeOutputBatchAddress(domain, publisherID, "+")
+	eventAddr := MakeOutputEventAddress(domain, publisherID, "+")
+	forecastAddr := MakeOutputValueAddress(domain, publisherID, "+", "+", "+", types.MessageTypeForecast)
+	historyAddr := MakeOutputValueAddress(domain, publisherID, "+", "+", "+", types.MessageTypeHistory)
+	latestAddr := MakeOutputValueAddress(domain, publisherID, "+", "+", "+", types.MessageTypeLatest)
+	return map[string]func(address string, message string) error{
+		batchAddr:    dov.handleBatch,
+		eventAddr:    dov.handleEvent,
+		forecastAddr: dov.handleForecast,
+		historyAddr:  dov.handleHistory,
+		latestAddr:   dov.handleLatest,
+	}
+}
+
 // UpdateEvent replaces the node event value
 func (dov *DomainOutputValues) UpdateEvent(value *types.OutputEventMessage) {
 	dov.updateMutex.Lock()
@@ -42,6 +269,13 @@ func (dov *DomainOutputValues) UpdateEvent(value *types.OutputEventMessage) {
 	dov.event[value.Address] = value
 }
 
+// UpdateForecast replaces the output forecast value
+func (dov *DomainOutputValues) UpdateForecast(value *types.OutputForecastMessage) {
+	dov.updateMutex.Lock()
+	defer dov.updateMutex.Unlock()
+	dov.forecast[value.Address] = value
+}
+
 // UpdateHistory replaces the output history value
 func (dov *DomainOutputValues) UpdateHistory(value *types.OutputHistoryMessage) {
 	dov.updateMutex.Lock()
@@ -63,15 +297,59 @@ func (dov *DomainOutputValues) UpdateRaw(address string, value string) {
 	dov.raw[address] = value
 }
 
+// DecodeBatch fans out a batch of node events into the latest values of the node outputs
+// The values are returned in the order of the events, so later values of an output supersede
+// earlier ones. The output unit is not included in a batch and left empty.
+func DecodeBatch(batchMessage *types.OutputBatchMessage) []*types.OutputLatestMessage {
+	latestList := make([]*types.OutputLatestMessage, 0)
+	// domain/publisher/node/$batch -> domain/publisher/node
+	segments := strings.Split(batchMessage.Address, "/")
+	nodeBase := strings.Join(segments[:len(segments)-1], "/")
+
+	for _, batchEvent := range batchMessage.Batch {
+		// event values are keyed by output type/instance
+		attrIDs := make([]string, 0, len(batchEvent.Event))
+		for attrID := range batchEvent.Event {
+			attrIDs = append(attrIDs, attrID)
+		}
+		sort.Strings(attrIDs)
+		for _, attrID := range attrIDs {
+			latestList = append(latestList, &types.OutputLatestMessage{
+				Address:   nodeBase + "/" + attrID + "/" + types.MessageTypeLatest,
+				Timestamp: batchEvent.Timestamp,
+				Value:     batchEvent.Event[attrID],
+			})
+		}
+	}
+	return latestList
+}
+
+// MakeOutputEventAddress creates the address of a node's $event publication
+func MakeOutputEventAddress(domain string, publisherID string, nodeID string) string {
+	address := fmt.Sprintf("%s/%s/%s/"+types.MessageTypeEvent, domain, publisherID, nodeID)
+	return address
+}
+
+// MakeOutputValueAddress creates the address of an output value publication, eg $latest, $history or $forecast
+func MakeOutputValueAddress(domain string, publisherID string, nodeID string,
+	outputType types.OutputType, instance string, messageType types.MessageType) string {
+
+	address := MakeOutputDiscoveryAddress(domain, publisherID, nodeID, outputType, instance)
+	return ReplaceMessageType(address, messageType)
+}
+
 // NewDomainOutputValues creates a new instance for handling of discovered output values
 func NewDomainOutputValues(messageSigner *messaging.MessageSigner) *DomainOutputValues {
 	return &DomainOutputValues{
 		// c:             lib.NewDomainCollection(messageSigner, reflect.TypeOf(&types.OutputLatestMessage{})),
-		messageSigner: messageSigner,
-		updateMutex:   &sync.Mutex{},
-		raw:           make(map[string]string, 0),
-		latest:        make(map[string]*types.OutputLatestMessage, 0),
-		history:       make(map[string]*types.OutputHistoryMessage, 0),
-		event:         make(map[string]*types.OutputEventMessage, 0),
+		messageSigner:     messageSigner,
+		subscriptions:     make(map[string]messaging.SubscriptionHandle),
+		subscriptionMutex: &sync.Mutex{},
+		updateMutex:       &sync.Mutex{},
+		raw:               make(map[string]string, 0),
+		latest:            make(map[string]*types.OutputLatestMessage, 0),
+		history:           make(map[string]*types.OutputHistoryMessage, 0),
+		event:             make(map[string]*types.OutputEventMessage, 0),
+		forecast:          make(map[string]*types.OutputForecastMessage, 0),
 	}
 }
@@ -1,14 +1,16 @@
 package outputs_test
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/iotdomain/iotdomain-go/messaging"
 	"github.com/iotdomain/iotdomain-go/outputs"
 	"github.com/iotdomain/iotdomain-go/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCreateDomainOutputValues(t *testing.T) {
@@ -24,7 +26,7 @@ func TestCreateDomainOutputValues(t *testing.T) {
 	config := messaging.MessengerConfig{}
 	messenger := messaging.NewDummyMessenger(&config)
 	privKey := messaging.CreateAsymKeys()
-	getPubKey := func(address string) *ecdsa.PublicKey {
+	getPubKey := func(address string) crypto.PublicKey {
 		return &privKey.PublicKey
 	}
 	signer := messaging.NewMessageSigner(messenger, privKey, getPubKey)
@@ -39,3 +41,187 @@ func TestCreateDomainOutputValues(t *testing.T) {
 	collection.UpdateLatest(&types.OutputLatestMessage{})
 	collection.UpdateRaw(out1Addr, "raw")
 }
+
+func TestReceiveForecast(t *testing.T) {
+	const domain = "test"
+	const publisherID = "pub1"
+	const node1ID = "node1"
+	const out1Type = types.OutputTypeTemperature
+	config := messaging.MessengerConfig{}
+	messenger := messaging.NewDummyMessenger(&config)
+	privKey := messaging.CreateAsymKeys()
+	getPubKey := func(address string) crypto.PublicKey {
+		return &privKey.PublicKey
+	}
+	signer := messaging.NewMessageSigner(messenger, privKey, getPubKey)
+	regOutputs := outputs.NewRegisteredOutputs(domain, publisherID)
+	output1 := regOutputs.CreateOutput(node1ID, out1Type, types.DefaultOutputInstance)
+	fcAddr := outputs.MakeOutputValueAddress(domain, publisherID, node1ID, out1Type,
+		types.DefaultOutputInstance, types.MessageTypeForecast)
+
+	collection := outputs.NewDomainOutputValues(signer)
+	collection.Subscribe("+", "+")
+
+	forecast := outputs.OutputForecast{{Timestamp: "2050-01-01T00:00:00.000+0000", Value: "42"}}
+	outputs.PublishForecast(output1, forecast, signer)
+	fc, found := collection.GetForecast(fcAddr)
+	require.True(t, found, "Forecast not received")
+	assert.Equal(t, "42", fc.Forecast[0].Value)
+
+	// removing the publication removes the forecast
+	signer.RemovePublication(fcAddr)
+	_, found = collection.GetForecast(fcAddr)
+	assert.False(t, found)
+
+	// unsigned forecasts are rejected
+	signer.PublishObject(fcAddr, true, "not a forecast", nil)
+	_, found = collection.GetForecast(fcAddr)
+	assert.False(t, found)
+
+	collection.Unsubscribe("+", "+")
+}
+
+func TestReceiveBatch(t *testing.T) {
+	const domain = "test"
+	const publisherID = "pub1"
+	const node1ID = "node1"
+	config := messaging.MessengerConfig{}
+	messenger := messaging.NewDummyMessenger(&config)
+	privKey := messaging.CreateAsymKeys()
+	getPubKey := func(address string) crypto.PublicKey {
+		return &privKey.PublicKey
+	}
+	signer := messaging.NewMessageSigner(messenger, privKey, getPubKey)
+	nodeAddr := domain + "/" + publisherID + "/" + node1ID + "/" + types.MessageTypeNodeDiscovery
+	latestAddr := outputs.MakeOutputValueAddress(domain, publisherID, node1ID, types.OutputTypeSwitch,
+		types.DefaultOutputInstance, types.MessageTypeLatest)
+	latest2Addr := outputs.MakeOutputValueAddress(domain, publisherID, node1ID, types.OutputTypeTemperature,
+		types.DefaultOutputInstance, types.MessageTypeLatest)
+
+	collection := outputs.NewDomainOutputValues(signer)
+	collection.Subscribe("+", "+")
+
+	batches := outputs.NewRegisteredOutputBatches(domain, publisherID)
+	batches.AddEvent(node1ID, map[string]string{"switch/0": "on", "temperature/0": "20"})
+	batches.AddEvent(node1ID, map[string]string{"switch/0": "off"})
+	err := outputs.PublishOutputBatch(nodeAddr, batches.TakeBatch(node1ID), signer)
+	assert.NoError(t, err)
+
+	// the last event value of an output is its latest value
+	latest, found := collection.GetLatest(latestAddr)
+	require.True(t, found, "Batch not received")
+	assert.Equal(t, "off", latest.Value)
+	latest, found = collection.GetLatest(latest2Addr)
+	require.True(t, found)
+	assert.Equal(t, "20", latest.Value)
+
+	// unsigned batches are rejected
+	batchAddr := outputs.MakeOutputBatchAddress(domain, publisherID, "node2")
+	signer.PublishObject(batchAddr, true, "not a batch", nil)
+	signer.RemovePublication(batchAddr)
+	collection.Unsubscribe("+", "+")
+}
+
+func TestReceiveConfidentialOutputs(t *testing.T) {
+	const domain = "test"
+	const node1ID = "node1"
+	const pub1Addr = domain + "/pub1/$identity"
+	const pub2Addr = domain + "/pub2/$identity"
+	const pub3Addr = domain + "/pub3/$identity"
+	keys := map[string]crypto.PrivateKey{
+		pub1Addr: messaging.CreateAsymKeys(),
+		pub2Addr: messaging.CreateAsymKeys(),
+		pub3Addr: messaging.CreateAsymKeys(),
+	}
+	getPubKey := func(address string) crypto.PublicKey {
+		segments := strings.Split(address, "/")
+		if len(segments) < 2 {
+			return nil
+		}
+		return messaging.GetPublicKeyOf(keys[segments[0]+"/"+segments[1]+"/$identity"])
+	}
+	messenger := messaging.NewDummyMessenger(nil)
+	signer1 := messaging.NewMessageSigner(messenger, keys[pub1Addr], getPubKey)
+	reader := outputs.NewDomainOutputValues(messaging.NewMessageSigner(messenger, keys[pub2Addr], getPubKey))
+	reader.Subscribe("+", "+")
+	defer reader.Unsubscribe("+", "+")
+	other := outputs.NewDomainOutputValues(messaging.NewMessageSigner(messenger, keys[pub3Addr], getPubKey))
+	other.Subscribe("+", "+")
+	defer other.Unsubscribe("+", "+")
+
+	// pub1 publishes a confidential and a public output
+	regOutputs := outputs.NewRegisteredOutputs(domain, "pub1")
+	output1 := regOutputs.CreateOutput(node1ID, types.OutputTypeTemperature, types.DefaultOutputInstance)
+	output2 := regOutputs.CreateOutput(node1ID, types.OutputTypeSwitch, types.DefaultOutputInstance)
+	err := regOutputs.SetOutputReaders(output1.OutputID, []string{pub2Addr})
+	require.NoError(t, err)
+	latestAddr1 := outputs.ReplaceMessageType(output1.Address, types.MessageTypeLatest)
+	latestAddr2 := outputs.ReplaceMessageType(output2.Address, types.MessageTypeLatest)
+	historyAddr1 := outputs.ReplaceMessageType(output1.Address, types.MessageTypeHistory)
+	forecastAddr1 := outputs.ReplaceMessageType(output1.Address, types.MessageTypeForecast)
+	values := outputs.NewRegisteredOutputValues(domain, "pub1")
+	values.UpdateOutputValue(output1.OutputID, "20")
+	values.UpdateOutputValue(output2.OutputID, "on")
+	outputs.PublishOutputLatest(output1, values.GetOutputValueByID(output1.OutputID), signer1)
+	outputs.PublishOutputLatest(output2, values.GetOutputValueByID(output2.OutputID), signer1)
+	outputs.PublishOutputHistory(output1, values.GetHistory(output1.OutputID), signer1)
+	outputs.PublishForecast(output1, outputs.OutputForecast{{Value: "21"}}, signer1)
+
+	// only the reader decrypts the confidential output
+	latest, found := reader.GetLatest(latestAddr1)
+	require.True(t, found, "Confidential output not received by its reader")
+	assert.Equal(t, "20", latest.Value)
+	history, found := reader.GetHistory(historyAddr1)
+	require.True(t, found)
+	assert.Len(t, history.History, 1)
+	_, found = other.GetLatest(latestAddr1)
+	assert.False(t, found, "Confidential output received by a publisher that isn't a reader")
+	_, found = other.GetHistory(historyAddr1)
+	assert.False(t, found)
+	forecast, found := reader.GetForecast(forecastAddr1)
+	require.True(t, found)
+	assert.Equal(t, "21", forecast.Forecast[0].Value)
+	_, found = other.GetForecast(forecastAddr1)
+	assert.False(t, found)
+
+	// public outputs are received by everyone
+	latest, found = other.GetLatest(latestAddr2)
+	require.True(t, found)
+	assert.Equal(t, "on", latest.Value)
+
+	// events and batches are readable by the readers of all its confidential outputs
+	nodeOutputs := regOutputs.GetOutputsByNodeHWID(node1ID)
+	readers, isConfidential := outputs.GetOutputReaders(nodeOutputs)
+	assert.True(t, isConfidential)
+	assert.Equal(t, []string{pub2Addr}, readers)
+	regOutputs.SetOutputReaders(output2.OutputID, []string{pub3Addr})
+	readers, isConfidential = outputs.GetOutputReaders(nodeOutputs)
+	assert.True(t, isConfidential)
+	assert.Empty(t, readers)
+	regOutputs.SetOutputReaders(output1.OutputID, nil)
+	regOutputs.SetOutputReaders(output2.OutputID, nil)
+	_, isConfidential = outputs.GetOutputReaders(nodeOutputs)
+	assert.False(t, isConfidential)
+
+	// error case - unknown output
+	err = regOutputs.SetOutputReaders("notanoutput", []string{pub2Addr})
+	assert.Error(t, err)
+}
+
+func TestDecodeBatch(t *testing.T) {
+	batchMessage := &types.OutputBatchMessage{
+		Address: outputs.MakeOutputBatchAddress("test", "pub1", "node1"),
+		Batch: []types.OutputBatchEvent{
+			{Timestamp: "2020-10-01T10:00:00.000+0000", Event: map[string]string{"switch/0": "on", "switch/1": "off"}},
+			{Timestamp: "2020-10-01T10:01:00.000+0000", Event: map[string]string{"switch/0": "off"}},
+		},
+	}
+	latestList := outputs.DecodeBatch(batchMessage)
+	require.Equal(t, 3, len(latestList))
+	assert.Equal(t, "test/pub1/node1/switch/0/$latest", latestList[0].Address)
+	assert.Equal(t, "on", latestList[0].Value)
+	assert.Equal(t, "test/pub1/node1/switch/1/$latest", latestList[1].Address)
+	assert.Equal(t, "test/pub1/node1/switch/0/$latest", latestList[2].Address)
+	assert.Equal(t, "off", latestList[2].Value)
+	assert.Equal(t, "2020-10-01T10:01:00.000+0000", latestList[2].Timestamp)
+}
@@ -4,6 +4,7 @@ package outputs
 import (
 	"fmt"
 	"reflect"
+	"sync"
 
 	"github.com/iotdomain/iotdomain-go/lib"
 	"github.com/iotdomain/iotdomain-go/messaging"
@@ -12,8 +13,10 @@ import (
 
 // DomainOutputs for managing discovered outputs
 type DomainOutputs struct {
-	c             lib.DomainCollection //
-	messageSigner *messaging.MessageSigner
+	c                 lib.DomainCollection //
+	messageSigner     *messaging.MessageSigner
+	subscriptions     map[string]messaging.SubscriptionHandle // subscription handles by address
+	subscriptionMutex *sync.Mutex                             // mutex for updating subscriptions
 }
 
 // AddOutput adds or replaces the output
@@ -66,17 +69,34 @@ func (domainOutputs *DomainOutputs) RemoveOutput(address string) {
 	domainOutputs.c.Remove(address)
 }
 
+// RemovePublisherOutputs removes all outputs of a publisher, eg when the publisher is revoked
+// publisherAddress contains the domain/publisherID[/$identity]
+// Returns the number of removed outputs
+func (domainOutputs *DomainOutputs) RemovePublisherOutputs(publisherAddress string) int {
+	return domainOutputs.c.RemoveByAddressPrefix(publisherAddress)
+}
+
 // Subscribe to outputs from a domain publisher
 func (domainOutputs *DomainOutputs) Subscribe(domain string, publisherID string) {
 	// subscription address for all outputs domain/publisher/node/type/instance/$output
 	addr := MakeOutputDiscoveryAddress(domain, publisherID, "+", "+", "+")
-	domainOutputs.messageSigner.Subscribe(addr, domainOutputs.handleDiscoverOutput)
+	domainOutputs.subscriptionMutex.Lock()
+	defer domainOutputs.subscriptionMutex.Unlock()
+	if _, found := domainOutputs.subscriptions[addr]; found {
+		return
+	}
+	domainOutputs.subscriptions[addr] = domainOutputs.messageSigner.Subscribe(addr, domainOutputs.handleDiscoverOutput)
 }
 
 // Unsubscribe from publisher outputs
 func (domainOutputs *DomainOutputs) Unsubscribe(domain string, publisherID string) {
 	addr := MakeOutputDiscoveryAddress(domain, publisherID, "+", "+", "+")
-	domainOutputs.messageSigner.Unsubscribe(addr, domainOutputs.handleDiscoverOutput)
+	domainOutputs.subscriptionMutex.Lock()
+	defer domainOutputs.subscriptionMutex.Unlock()
+	if handle, found := domainOutputs.subscriptions[addr]; found {
+		domainOutputs.messageSigner.Unsubscribe(handle)
+		delete(domainOutputs.subscriptions, addr)
+	}
 }
 
 // handleDiscoverOutput updates the domain output list with discovered outputs
@@ -98,7 +118,9 @@ func MakeOutputDiscoveryAddress(domain string, publisherID string, nodeID string
 // NewDomainOutputs creates a new instance for handling of discovered domain outputs
 func NewDomainOutputs(messageSigner *messaging.MessageSigner) *DomainOutputs {
 	return &DomainOutputs{
-		c:             lib.NewDomainCollection(reflect.TypeOf(&types.OutputDiscoveryMessage{}), messageSigner.GetPublicKey),
-		messageSigner: messageSigner,
+		c:                 lib.NewDomainCollection(reflect.TypeOf(&types.OutputDiscoveryMessage{}), messageSigner.GetPublicKey),
+		messageSigner:     messageSigner,
+		subscriptions:     make(map[string]messaging.SubscriptionHandle),
+		subscriptionMutex: &sync.Mutex{},
 	}
 }
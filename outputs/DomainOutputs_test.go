@@ -1,7 +1,7 @@
 package outputs_test
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"encoding/json"
 	"fmt"
 	"testing"
@@ -25,7 +25,7 @@ func TestCreateDomainOutputs(t *testing.T) {
 	config := messaging.MessengerConfig{}
 	messenger := messaging.NewDummyMessenger(&config)
 	privKey := messaging.CreateAsymKeys()
-	getPubKey := func(address string) *ecdsa.PublicKey {
+	getPubKey := func(address string) crypto.PublicKey {
 		return &privKey.PublicKey
 	}
 	signer := messaging.NewMessageSigner(messenger, privKey, getPubKey)
@@ -73,7 +73,7 @@ func TestDiscoverDomainOutputs(t *testing.T) {
 	const node1Addr = domain + "/" + publisherID + "/" + nodeID
 	const outputType = types.OutputTypeSwitch
 	privKey := messaging.CreateAsymKeys()
-	getPubKey := func(address string) *ecdsa.PublicKey {
+	getPubKey := func(address string) crypto.PublicKey {
 		return &privKey.PublicKey
 	}
 	messenger := messaging.NewDummyMessenger(dummyConfig)
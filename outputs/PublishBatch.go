@@ -0,0 +1,50 @@
+// Package outputs with publication of batched node output events
+package outputs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// PublishOutputBatch publishes a batch of node output events in a single $batch message
+// nodeAddress is the node discovery address: domain/publisher/node/$node
+func PublishOutputBatch(
+	nodeAddress string,
+	batch OutputBatch,
+	messageSigner *messaging.MessageSigner,
+) error {
+	return PublishOutputBatchForReaders(nodeAddress, batch, nil, messageSigner)
+}
+
+// PublishOutputBatchForReaders publishes a batch of node output events in a single $batch message
+// that is encrypted for the given readers. Without readers the batch is only signed.
+// nodeAddress is the node discovery address: domain/publisher/node/$node
+// readers are the identity addresses of the publishers that are authorized to read the batch
+func PublishOutputBatchForReaders(
+	nodeAddress string,
+	batch OutputBatch,
+	readers []string,
+	messageSigner *messaging.MessageSigner,
+) error {
+	// zone/publisher/node/$batch
+	addr := ReplaceMessageType(nodeAddress, types.MessageTypeBatch)
+	logrus.Infof("PublishOutputBatch: %d events to: %s", len(batch), addr)
+
+	batchMessage := &types.OutputBatchMessage{
+		Address:   addr,
+		Batch:     batch,
+		Timestamp: time.Now().Format(types.TimeFormat),
+	}
+	err := PublishOutputObject(addr, batchMessage, readers, messageSigner)
+	return err
+}
+
+// MakeOutputBatchAddress creates the address of a node's $batch publication
+func MakeOutputBatchAddress(domain string, publisherID string, nodeID string) string {
+	address := fmt.Sprintf("%s/%s/%s/"+types.MessageTypeBatch, domain, publisherID, nodeID)
+	return address
+}
@@ -9,6 +9,7 @@ import (
 )
 
 // PublishForecast publishes the $forecast output values retained=true
+// The forecast of an output with readers is encrypted for these readers.
 // not thread-safe, using within a locked section
 func PublishForecast(
 	output *types.OutputDiscoveryMessage,
@@ -27,7 +28,10 @@ func PublishForecast(
 		Forecast:  forecast,
 	}
 	logrus.Debugf("Publisher.publishForecast: %d entries on %s", len(forecastMessage.Forecast), aliasAddress)
-	messageSigner.PublishObject(aliasAddress, true, forecastMessage, nil)
+	err := PublishOutputObject(aliasAddress, forecastMessage, output.Readers, messageSigner)
+	if err != nil {
+		logrus.Errorf("PublishForecast: %s", err)
+	}
 }
 
 // PublishUpdatedForecasts publishes the output forecasts
@@ -42,6 +46,10 @@ func PublishUpdatedForecasts(
 		output := regOutputs.GetOutputByID(outputID)
 		forecast := regFCValues.GetForecast(outputID)
 
-		PublishForecast(output, forecast, messageSigner)
+		if output == nil {
+			logrus.Warningf("PublishUpdatedForecasts: no output with ID %s. Forecast not published", outputID)
+		} else {
+			PublishForecast(output, forecast, messageSigner)
+		}
 	}
 }
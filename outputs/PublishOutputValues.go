@@ -30,7 +30,10 @@ func PublishOutputHistory(
 		History:   history,
 	}
 	logrus.Debugf("PublishOutputHistory: %d entries to: %s", len(historyMessage.History), addr)
-	messageSigner.PublishObject(addr, true, historyMessage, nil)
+	err := PublishOutputObject(addr, historyMessage, output.Readers, messageSigner)
+	if err != nil {
+		logrus.Errorf("PublishOutputHistory: %s", err)
+	}
 }
 
 // PublishOutputLatest publishes the $latest output value
@@ -52,7 +55,22 @@ func PublishOutputLatest(
 		Unit:      output.Unit,
 		Value:     latest.Value,
 	}
-	messageSigner.PublishObject(addr, true, latestMessage, nil)
+	err := PublishOutputObject(addr, latestMessage, output.Readers, messageSigner)
+	if err != nil {
+		logrus.Errorf("PublishOutputLatest: %s", err)
+	}
+}
+
+// PublishOutputObject publishes a retained output value message, eg $latest, $history or $event.
+// When readers are provided the message is encrypted for these readers, otherwise it is only signed.
+//  readers are the identity addresses of the publishers that are authorized to read the message
+func PublishOutputObject(address string, object interface{}, readers []string,
+	messageSigner *messaging.MessageSigner) error {
+
+	if len(readers) > 0 {
+		return messageSigner.PublishObjectForRecipients(address, true, object, readers)
+	}
+	return messageSigner.PublishObject(address, true, object, nil)
 }
 
 // PublishOutputRaw publishes the raw output $raw (retained)
@@ -75,6 +93,33 @@ func PublishOutputRaw(output *types.OutputDiscoveryMessage, value string, messag
 	return err
 }
 
+// GetOutputReaders returns the readers that are authorized to read all of the given outputs, eg to
+// publish the node $event or $batch that contains their values.
+// Returns isConfidential true if at least one of the outputs has readers, in which case readers holds
+// the publishers that are readers of every output that has readers.
+func GetOutputReaders(outputList []*types.OutputDiscoveryMessage) (readers []string, isConfidential bool) {
+	for _, output := range outputList {
+		if len(output.Readers) == 0 {
+			continue
+		} else if !isConfidential {
+			isConfidential = true
+			readers = append([]string{}, output.Readers...)
+			continue
+		}
+		commonReaders := make([]string, 0, len(readers))
+		for _, reader := range readers {
+			for _, outputReader := range output.Readers {
+				if reader == outputReader {
+					commonReaders = append(commonReaders, reader)
+					break
+				}
+			}
+		}
+		readers = commonReaders
+	}
+	return readers, isConfidential
+}
+
 // ReplaceMessageType replace the last segment  with a new message type
 func ReplaceMessageType(addr string, newMessageType types.MessageType) string {
 	segments := strings.Split(addr, "/")
@@ -23,3 +23,14 @@ func PublishRegisteredOutputs(
 	// 	persist.SaveOutputs(publisher.cacheFolder, publisher.PublisherID(), allOutputs)
 	// }
 }
+
+// RemoveRegisteredOutputs removes the discovery publication of deleted outputs from the message bus
+func RemoveRegisteredOutputs(
+	deletedOutputs []*types.OutputDiscoveryMessage,
+	messageSigner *messaging.MessageSigner) {
+
+	for _, output := range deletedOutputs {
+		logrus.Infof("RemoveRegisteredOutputs: remove output discovery for: %s", output.Address)
+		messageSigner.RemovePublication(output.Address)
+	}
+}
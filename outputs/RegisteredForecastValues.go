@@ -3,6 +3,7 @@ package outputs
 
 import (
 	"sync"
+	"time"
 
 	"github.com/iotdomain/iotdomain-go/types"
 )
@@ -49,14 +50,61 @@ func (regForecasts *RegisteredForecastValues) GetUpdatedForecasts(clearUpdates b
 	return idList
 }
 
+// MarkUpdated marks the forecast of an output as updated so it is published again, eg after its
+// readers have changed. Outputs without forecast are ignored.
+func (regForecasts *RegisteredForecastValues) MarkUpdated(outputID string) {
+	regForecasts.updateMutex.Lock()
+	defer regForecasts.updateMutex.Unlock()
+	if regForecasts.forecastMap[outputID] == nil {
+		return
+	}
+	if regForecasts.updatedForecasts == nil {
+		regForecasts.updatedForecasts = make(map[string]string)
+	}
+	regForecasts.updatedForecasts[outputID] = outputID
+}
+
+// TrimForecasts removes forecast entries whose time has passed.
+// Forecasts that are trimmed are marked as updated so they are published again.
+// Intended to be invoked periodically, eg from the publisher heartbeat.
+// Returns the number of forecasts that have been trimmed.
+func (regForecasts *RegisteredForecastValues) TrimForecasts() int {
+	return regForecasts.TrimForecastsBefore(time.Now())
+}
+
+// TrimForecastsBefore removes forecast entries whose time is before the given time.
+// Forecasts that are trimmed are marked as updated so they are published again.
+//  now is the time before which entries are removed, eg the current time
+// Returns the number of forecasts that have been trimmed.
+func (regForecasts *RegisteredForecastValues) TrimForecastsBefore(now time.Time) int {
+	trimCount := 0
+
+	regForecasts.updateMutex.Lock()
+	defer regForecasts.updateMutex.Unlock()
+
+	for outputID, forecast := range regForecasts.forecastMap {
+		trimmed := trimForecast(forecast, now)
+		if len(trimmed) != len(forecast) {
+			regForecasts.forecastMap[outputID] = trimmed
+			if regForecasts.updatedForecasts == nil {
+				regForecasts.updatedForecasts = make(map[string]string)
+			}
+			regForecasts.updatedForecasts[outputID] = outputID
+			trimCount++
+		}
+	}
+	return trimCount
+}
+
 // UpdateForecast updates the output forecast list of values
+// Entries whose time has already passed are removed.
 func (regForecasts *RegisteredForecastValues) UpdateForecast(
 	outputID string, forecast OutputForecast) {
 
 	regForecasts.updateMutex.Lock()
 	defer regForecasts.updateMutex.Unlock()
 
-	regForecasts.forecastMap[outputID] = forecast
+	regForecasts.forecastMap[outputID] = trimForecast(forecast, time.Now())
 
 	if regForecasts.updatedForecasts == nil {
 		regForecasts.updatedForecasts = make(map[string]string)
@@ -66,6 +114,36 @@ func (regForecasts *RegisteredForecastValues) UpdateForecast(
 	// publisher.publishForecast(aliasAddress, output)
 }
 
+// trimForecast returns the forecast without the entries before the given time.
+// The time of an entry is its epoch time, or its timestamp if no epoch time is set. Entries
+// without a valid time are retained.
+// This returns the original forecast if no entries are removed.
+func trimForecast(forecast OutputForecast, now time.Time) OutputForecast {
+	var trimmed OutputForecast
+	for index, entry := range forecast {
+		entryTime := time.Unix(entry.EpochTime, 0)
+		if entry.EpochTime == 0 {
+			var err error
+			entryTime, err = time.Parse(types.TimeFormat, entry.Timestamp)
+			if err != nil {
+				entryTime = now
+			}
+		}
+		if entryTime.Before(now) {
+			if trimmed == nil {
+				trimmed = make(OutputForecast, 0, len(forecast))
+				trimmed = append(trimmed, forecast[:index]...)
+			}
+		} else if trimmed != nil {
+			trimmed = append(trimmed, entry)
+		}
+	}
+	if trimmed == nil {
+		return forecast
+	}
+	return trimmed
+}
+
 // NewRegisteredForecastValues creates a new instance for storing output forecasts
 func NewRegisteredForecastValues(domain string, publisherID string) *RegisteredForecastValues {
 	rfv := RegisteredForecastValues{
@@ -1,8 +1,9 @@
 package outputs_test
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"testing"
+	"time"
 
 	"github.com/iotdomain/iotdomain-go/messaging"
 	"github.com/iotdomain/iotdomain-go/outputs"
@@ -44,7 +45,7 @@ func TestPublishForecast(t *testing.T) {
 	var privKey = messaging.CreateAsymKeys()
 
 	// get publisher key for signature verification
-	var getPublisherKey = func(addr string) *ecdsa.PublicKey {
+	var getPublisherKey = func(addr string) crypto.PublicKey {
 		return &privKey.PublicKey
 	}
 
@@ -66,6 +67,45 @@ func TestPublishForecast(t *testing.T) {
 	collection.UpdateForecast(output1.OutputID, forecast)
 
 	outputs.PublishUpdatedForecasts(collection, regOutputs, signer)
+	fcAddr := outputs.ReplaceMessageType(output1.Address, types.MessageTypeForecast)
+	assert.NotEmpty(t, msgr.FindLastPublication(fcAddr), "Forecast not published")
 
-	// TODO: verify the forecast was published
+	// forecast of unknown output is not published
+	collection.UpdateForecast("fakeid", forecast)
+	outputs.PublishUpdatedForecasts(collection, regOutputs, signer)
+}
+
+func TestTrimForecast(t *testing.T) {
+	const domain = "test"
+	const publisher1ID = "publisher1"
+	const output1ID = "node1.temperature.0"
+	now := time.Now()
+
+	collection := outputs.NewRegisteredForecastValues(domain, publisher1ID)
+	forecast := outputs.OutputForecast{
+		{EpochTime: now.Add(-time.Hour).Unix(), Value: "past"},
+		{Timestamp: now.Add(-time.Minute).Format(types.TimeFormat), Value: "past timestamp"},
+		{EpochTime: now.Unix() + 1, Value: "soon"},
+		{EpochTime: now.Add(time.Hour).Unix(), Value: "future"},
+		{Timestamp: now.Add(time.Hour).Format(types.TimeFormat), Value: "future timestamp"},
+	}
+	// past entries are removed on update
+	collection.UpdateForecast(output1ID, forecast)
+	fc := collection.GetForecast(output1ID)
+	assert.Equal(t, 3, len(fc))
+	assert.Equal(t, "soon", fc[0].Value)
+	collection.GetUpdatedForecasts(true)
+
+	// nothing to trim
+	trimCount := collection.TrimForecasts()
+	assert.Equal(t, 0, trimCount)
+	assert.Equal(t, 0, len(collection.GetUpdatedForecasts(true)))
+
+	// after some time passes the entry is trimmed and the forecast is updated
+	trimCount = collection.TrimForecastsBefore(now.Add(time.Second * 2))
+	assert.Equal(t, 1, trimCount)
+	fc = collection.GetForecast(output1ID)
+	assert.Equal(t, 2, len(fc))
+	assert.Equal(t, "future", fc[0].Value)
+	assert.Equal(t, 1, len(collection.GetUpdatedForecasts(true)))
 }
@@ -0,0 +1,120 @@
+// Package outputs with accumulating of node output events for batch publication
+package outputs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/types"
+)
+
+// OutputBatch with a time ordered list of node output events
+type OutputBatch []types.OutputBatchEvent
+
+// outputBatch with the events accumulated for a node
+type outputBatch struct {
+	created time.Time   // time the first event was added
+	events  OutputBatch // accumulated events
+}
+
+// RegisteredOutputBatches accumulates node output events until they are published as a batch.
+// Intended for nodes where each publication is expensive, like battery powered or LoRa devices.
+type RegisteredOutputBatches struct {
+	domain      string                  // domain the batches belong to
+	publisherID string                  // publisher of the batches
+	batchMap    map[string]*outputBatch // pending batches by node HWID
+	updateMutex *sync.Mutex
+}
+
+// AddEvent adds an event with output values to the batch of a node
+// event contains the output values by output type/instance
+// Returns the number of events in the node's batch
+func (regBatches *RegisteredOutputBatches) AddEvent(nodeHWID string, event map[string]string) int {
+	regBatches.updateMutex.Lock()
+	defer regBatches.updateMutex.Unlock()
+
+	now := time.Now()
+	batch := regBatches.batchMap[nodeHWID]
+	if batch == nil {
+		batch = &outputBatch{created: now, events: make(OutputBatch, 0)}
+		regBatches.batchMap[nodeHWID] = batch
+	}
+	batch.events = append(batch.events, types.OutputBatchEvent{
+		Timestamp: now.Format(types.TimeFormat),
+		Event:     event,
+	})
+	return len(batch.events)
+}
+
+// GetBatch returns a copy of the pending events of a node
+// Returns nil if the node has no pending events
+func (regBatches *RegisteredOutputBatches) GetBatch(nodeHWID string) OutputBatch {
+	regBatches.updateMutex.Lock()
+	defer regBatches.updateMutex.Unlock()
+
+	batch := regBatches.batchMap[nodeHWID]
+	if batch == nil {
+		return nil
+	}
+	return append(OutputBatch{}, batch.events...)
+}
+
+// GetBatchNodes returns the HWIDs of the nodes that have pending events
+func (regBatches *RegisteredOutputBatches) GetBatchNodes() []string {
+	regBatches.updateMutex.Lock()
+	defer regBatches.updateMutex.Unlock()
+
+	nodeList := make([]string, 0, len(regBatches.batchMap))
+	for nodeHWID := range regBatches.batchMap {
+		nodeList = append(nodeList, nodeHWID)
+	}
+	return nodeList
+}
+
+// TakeBatch removes and returns the pending events of a node regardless of their count or age
+// Returns nil if the node has no pending events
+func (regBatches *RegisteredOutputBatches) TakeBatch(nodeHWID string) OutputBatch {
+	regBatches.updateMutex.Lock()
+	defer regBatches.updateMutex.Unlock()
+
+	batch := regBatches.batchMap[nodeHWID]
+	if batch == nil {
+		return nil
+	}
+	delete(regBatches.batchMap, nodeHWID)
+	return batch.events
+}
+
+// TakeReadyBatch removes and returns the pending events of a node if the batch is ready for
+// publication. A batch is ready when it holds at least maxCount events or when its first event is
+// at least maxAge old. Use 0 to disable the count or age limit.
+// Returns nil if the batch is not ready.
+func (regBatches *RegisteredOutputBatches) TakeReadyBatch(
+	nodeHWID string, maxCount int, maxAge time.Duration) OutputBatch {
+
+	regBatches.updateMutex.Lock()
+	defer regBatches.updateMutex.Unlock()
+
+	batch := regBatches.batchMap[nodeHWID]
+	if batch == nil {
+		return nil
+	}
+	countReached := maxCount > 0 && len(batch.events) >= maxCount
+	ageReached := maxAge > 0 && time.Since(batch.created) >= maxAge
+	if !countReached && !ageReached {
+		return nil
+	}
+	delete(regBatches.batchMap, nodeHWID)
+	return batch.events
+}
+
+// NewRegisteredOutputBatches creates a new instance for accumulating node output events
+func NewRegisteredOutputBatches(domain string, publisherID string) *RegisteredOutputBatches {
+	rob := RegisteredOutputBatches{
+		domain:      domain,
+		publisherID: publisherID,
+		batchMap:    make(map[string]*outputBatch),
+		updateMutex: &sync.Mutex{},
+	}
+	return &rob
+}
@@ -0,0 +1,51 @@
+package outputs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/outputs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutputBatches(t *testing.T) {
+	const domain = "test"
+	const publisher1ID = "publisher1"
+	const node1ID = "node1"
+	const node2ID = "node2"
+	collection := outputs.NewRegisteredOutputBatches(domain, publisher1ID)
+
+	count := collection.AddEvent(node1ID, map[string]string{"switch/0": "on"})
+	assert.Equal(t, 1, count)
+	collection.AddEvent(node2ID, map[string]string{"switch/0": "off"})
+	assert.Equal(t, 2, len(collection.GetBatchNodes()))
+
+	// batch isn't ready until the count is reached
+	batch := collection.TakeReadyBatch(node1ID, 2, 0)
+	assert.Nil(t, batch)
+	count = collection.AddEvent(node1ID, map[string]string{"switch/0": "off"})
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 2, len(collection.GetBatch(node1ID)))
+	batch = collection.TakeReadyBatch(node1ID, 2, 0)
+	require.Equal(t, 2, len(batch))
+	assert.Equal(t, "on", batch[0].Event["switch/0"])
+	assert.Equal(t, "off", batch[1].Event["switch/0"])
+	assert.NotEmpty(t, batch[0].Timestamp)
+	assert.Nil(t, collection.GetBatch(node1ID))
+	assert.Nil(t, collection.TakeReadyBatch(node1ID, 1, 0))
+
+	// batch is ready when its max age is reached
+	batch = collection.TakeReadyBatch(node2ID, 10, time.Second)
+	assert.Nil(t, batch)
+	time.Sleep(time.Second)
+	batch = collection.TakeReadyBatch(node2ID, 10, time.Second)
+	assert.Equal(t, 1, len(batch))
+
+	// take the batch regardless of count or age
+	collection.AddEvent(node2ID, map[string]string{"switch/0": "on"})
+	batch = collection.TakeBatch(node2ID)
+	assert.Equal(t, 1, len(batch))
+	assert.Nil(t, collection.TakeBatch(node2ID))
+	assert.Equal(t, 0, len(collection.GetBatchNodes()))
+}
@@ -73,6 +73,20 @@ func (outputValues *RegisteredOutputValues) GetUpdatedOutputValues(clearUpdates
 	return idList
 }
 
+// MarkUpdated marks the value of an output as updated so it is published again, eg after its
+// readers have changed. Outputs without value are ignored.
+func (outputValues *RegisteredOutputValues) MarkUpdated(outputID string) {
+	outputValues.updateMutex.Lock()
+	defer outputValues.updateMutex.Unlock()
+	if len(outputValues.historyMap[outputID]) == 0 {
+		return
+	}
+	if outputValues.updatedOutputs == nil {
+		outputValues.updatedOutputs = make(map[string]string)
+	}
+	outputValues.updatedOutputs[outputID] = outputID
+}
+
 // UpdateOutputFloatList adds a list of floats as the output value in the format: "[value1, value2, ...]"
 func (outputValues *RegisteredOutputValues) UpdateOutputFloatList(outputID string, values []float32) bool {
 	valuesAsString, _ := json.Marshal(values)
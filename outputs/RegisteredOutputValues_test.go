@@ -1,7 +1,7 @@
 package outputs_test
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"testing"
 
 	"github.com/iotdomain/iotdomain-go/messaging"
@@ -69,7 +69,7 @@ func TestPublishOutputValues(t *testing.T) {
 	config := messaging.MessengerConfig{}
 	messenger := messaging.NewDummyMessenger(&config)
 	privKey := messaging.CreateAsymKeys()
-	getPubKey := func(address string) *ecdsa.PublicKey {
+	getPubKey := func(address string) crypto.PublicKey {
 		return &privKey.PublicKey
 	}
 	signer := messaging.NewMessageSigner(messenger, privKey, getPubKey)
@@ -5,12 +5,14 @@ import (
 	"sync"
 	"time"
 
+	"github.com/iotdomain/iotdomain-go/lib"
 	"github.com/iotdomain/iotdomain-go/types"
 )
 
 // RegisteredOutputs manages registration of publisher outputs
 type RegisteredOutputs struct {
 	addressMap       map[string]string                        // lookup outputID by output publication address
+	deletedOutputs   map[string]*types.OutputDiscoveryMessage // deleted outputs by address, pending removal from the bus
 	domain           string                                   // the domain of this publisher
 	publisherID      string                                   // the registered publisher for the inputs
 	outputsByID      map[string]*types.OutputDiscoveryMessage // lookup output by output ID
@@ -30,6 +32,22 @@ func (regOutputs *RegisteredOutputs) CreateOutput(
 	return output
 }
 
+// DeleteOutput unregisters the output
+// The output is kept in the list of deleted outputs until its publication is removed, see GetDeletedOutputs.
+func (regOutputs *RegisteredOutputs) DeleteOutput(outputID string) {
+	regOutputs.updateMutex.Lock()
+	defer regOutputs.updateMutex.Unlock()
+
+	output := regOutputs.outputsByID[outputID]
+	if output == nil {
+		return
+	}
+	delete(regOutputs.outputsByID, outputID)
+	delete(regOutputs.addressMap, output.Address)
+	delete(regOutputs.updatedOutputIDs, outputID)
+	regOutputs.deletedOutputs[output.Address] = output
+}
+
 // GetAllOutputs returns the list of outputs
 func (regOutputs *RegisteredOutputs) GetAllOutputs() []*types.OutputDiscoveryMessage {
 	regOutputs.updateMutex.Lock()
@@ -85,6 +103,22 @@ func (regOutputs *RegisteredOutputs) GetOutputByID(outputID string) *types.Outpu
 	return output
 }
 
+// GetDeletedOutputs returns the list of outputs that have been deleted
+// clear the list of deleted outputs on return
+func (regOutputs *RegisteredOutputs) GetDeletedOutputs(clearUpdates bool) []*types.OutputDiscoveryMessage {
+	var deleteList []*types.OutputDiscoveryMessage = make([]*types.OutputDiscoveryMessage, 0)
+
+	regOutputs.updateMutex.Lock()
+	defer regOutputs.updateMutex.Unlock()
+	for _, output := range regOutputs.deletedOutputs {
+		deleteList = append(deleteList, output)
+	}
+	if clearUpdates {
+		regOutputs.deletedOutputs = make(map[string]*types.OutputDiscoveryMessage)
+	}
+	return deleteList
+}
+
 // GetUpdatedOutputs returns the list of discovered outputs that have been updated
 // clear the update on return
 func (regOutputs *RegisteredOutputs) GetUpdatedOutputs(clearUpdates bool) []*types.OutputDiscoveryMessage {
@@ -120,6 +154,27 @@ func (regOutputs *RegisteredOutputs) SetNodeID(nodeHWID string, alias string) {
 	}
 }
 
+// SetOutputReaders sets the publishers that are authorized to read the output values. When set, the
+// $latest and $history values of the output, and the $event and $batch of its node, are encrypted
+// for these readers and the $raw value is not published.
+//  readers are the identity addresses of the authorized publishers, eg domain/publisherID/$identity.
+//  Use nil to publish the output values unencrypted.
+// Returns an error if the output doesn't exist
+func (regOutputs *RegisteredOutputs) SetOutputReaders(outputID string, readers []string) error {
+	regOutputs.updateMutex.Lock()
+	defer regOutputs.updateMutex.Unlock()
+	output := regOutputs.outputsByID[outputID]
+	if output == nil {
+		return lib.MakeErrorf("SetOutputReaders: Output '%s' not found", outputID)
+	}
+	if len(readers) == 0 {
+		output.Readers = nil
+	} else {
+		output.Readers = append([]string{}, readers...)
+	}
+	return nil
+}
+
 // UpdateOutput replaces the output and updates its timestamp.
 func (regOutputs *RegisteredOutputs) UpdateOutput(output *types.OutputDiscoveryMessage) {
 	regOutputs.updateMutex.Lock()
@@ -141,6 +196,7 @@ func (regOutputs *RegisteredOutputs) updateOutput(output *types.OutputDiscoveryM
 	}
 	output.Timestamp = time.Now().Format(types.TimeFormat)
 	regOutputs.updatedOutputIDs[output.OutputID] = output.OutputID
+	delete(regOutputs.deletedOutputs, output.Address)
 }
 
 // MakeOutputID creates the internal ID to identify the output of the owning node
@@ -173,11 +229,12 @@ func NewOutput(domain string, publisherID string, nodeHWID string, outputType ty
 // NewRegisteredOutputs creates a new instance for registered output management
 func NewRegisteredOutputs(domain string, publisherID string) *RegisteredOutputs {
 	regOutputs := RegisteredOutputs{
-		domain:      domain,
-		publisherID: publisherID,
-		addressMap:  make(map[string]string),
-		outputsByID: make(map[string]*types.OutputDiscoveryMessage),
-		updateMutex: &sync.Mutex{},
+		domain:         domain,
+		publisherID:    publisherID,
+		addressMap:     make(map[string]string),
+		deletedOutputs: make(map[string]*types.OutputDiscoveryMessage),
+		outputsByID:    make(map[string]*types.OutputDiscoveryMessage),
+		updateMutex:    &sync.Mutex{},
 	}
 	return &regOutputs
 }
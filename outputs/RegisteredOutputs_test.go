@@ -1,7 +1,7 @@
 package outputs_test
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"fmt"
 	"testing"
 
@@ -92,7 +92,7 @@ func TestPublishOutputs(t *testing.T) {
 	var privKey = messaging.CreateAsymKeys()
 
 	// get publisher key for signature verification
-	var getPublisherKey = func(addr string) *ecdsa.PublicKey {
+	var getPublisherKey = func(addr string) crypto.PublicKey {
 		return &privKey.PublicKey
 	}
 
@@ -20,7 +20,8 @@ import (
 //  - appConfig optional application object to load <appID>.yaml configuration into
 //  - cacheDiscovery loads and saves discovered publisher identities and nodes from cache
 //
-// This returns publisher instance or error if messenger fails to load
+// This returns publisher instance or error if messenger fails to load. If the publisher cannot be
+// created, eg because its key store cannot be loaded, then this returns nil and the reason.
 func NewAppPublisher(appID string, configFolder string, appConfig interface{},
 	cacheFolder string, cacheDiscovery bool) (*Publisher, error) {
 
@@ -46,7 +47,9 @@ func NewAppPublisher(appID string, configFolder string, appConfig interface{},
 		lib.LoadAppConfig(configFolder, appID, appConfig)
 	}
 	// 4: create the publisher. Reload its identity if available.
-	pub := NewPublisher(pubConfig, messenger)
-
+	pub, pubErr := newPublisher(pubConfig, messenger)
+	if pubErr != nil {
+		return nil, lib.MakeErrorf("NewAppPublisher: Unable to create publisher %s: %s", pubConfig.PublisherID, pubErr)
+	}
 	return pub, err
 }
@@ -4,6 +4,7 @@ package publisher
 import (
 	"time"
 
+	"github.com/iotdomain/iotdomain-go/identities"
 	"github.com/iotdomain/iotdomain-go/inputs"
 	"github.com/iotdomain/iotdomain-go/lib"
 	"github.com/iotdomain/iotdomain-go/messaging"
@@ -16,28 +17,83 @@ import (
 // PublishUpdates publishes changes to registered nodes, inputs, outputs, values and this publisher identity
 func (publisher *Publisher) PublishUpdates() {
 
+	// a renewed identity replaces the keys used for signing and decryption
+	updatedIdentity, privKey := publisher.registeredIdentity.GetUpdatedIdentity(true)
+	if updatedIdentity != nil {
+		publishedIdentity := publisher.domainIdentities.GetPublisherByAddress(updatedIdentity.Address)
+		publisher.messageSigner.RotatePrivateKey(privKey, identities.PreviousKeyGracePeriod)
+		publisher.domainIdentities.AddIdentity(&updatedIdentity.PublisherIdentityMessage)
+		identities.PublishIdentity(&updatedIdentity.PublisherIdentityMessage, publisher.messageSigner)
+
+		// retained discovery signed with the previous key fails verification after the grace period
+		if publishedIdentity != nil && publishedIdentity.PublicKey != updatedIdentity.PublicKey {
+			nodes.PublishRegisteredNodes(publisher.registeredNodes.GetAllNodes(), publisher.messageSigner)
+			inputs.PublishRegisteredInputs(publisher.registeredInputs.GetAllInputs(), publisher.messageSigner)
+			outputs.PublishRegisteredOutputs(publisher.registeredOutputs.GetAllOutputs(), publisher.messageSigner)
+		}
+	}
+
 	updatedNodes := publisher.registeredNodes.GetUpdatedNodes(true)
 	nodes.PublishRegisteredNodes(updatedNodes, publisher.messageSigner)
-	if len(updatedNodes) > 0 && publisher.config.ConfigFolder != "" {
+	deletedNodes := publisher.registeredNodes.GetDeletedNodes(true)
+	nodes.RemoveRegisteredNodes(deletedNodes, publisher.messageSigner)
+	if (len(updatedNodes) > 0 || len(deletedNodes) > 0) && publisher.config.ConfigFolder != "" {
 		publisher.SaveRegisteredNodes()
 	}
+	publisher.replayGuard.Save()
 
 	updatedInputs := publisher.registeredInputs.GetUpdatedInputs(true)
 	inputs.PublishRegisteredInputs(updatedInputs, publisher.messageSigner)
+	deletedInputs := publisher.registeredInputs.GetDeletedInputs(true)
+	inputs.RemoveRegisteredInputs(deletedInputs, publisher.messageSigner)
 
 	updatedOutputs := publisher.registeredOutputs.GetUpdatedOutputs(true)
 	outputs.PublishRegisteredOutputs(updatedOutputs, publisher.messageSigner)
+	deletedOutputs := publisher.registeredOutputs.GetDeletedOutputs(true)
+	outputs.RemoveRegisteredOutputs(deletedOutputs, publisher.messageSigner)
 
 	updatedOutputIDs := publisher.registeredOutputValues.GetUpdatedOutputValues(true)
 	publisher.PublishUpdatedOutputValues(updatedOutputIDs, publisher.messageSigner)
+
+	// forecasts change as time passes
+	publisher.registeredForecastValues.TrimForecasts()
+	updatedForecastIDs := publisher.registeredForecastValues.GetUpdatedForecasts(true)
+	publisher.PublishUpdatedForecasts(updatedForecastIDs, publisher.messageSigner)
+
+	// batches are also published when they reach their max age
+	publisher.PublishReadyBatches(publisher.messageSigner)
+}
+
+// PublishUpdatedForecasts publishes updated forecasts of registered outputs
+// This uses the node publishForecast config to determine if the forecast is published
+func (publisher *Publisher) PublishUpdatedForecasts(
+	updatedOutputIDs []string,
+	messageSigner *messaging.MessageSigner) {
+
+	for _, outputID := range updatedOutputIDs {
+		output := publisher.registeredOutputs.GetOutputByID(outputID)
+		if output == nil {
+			logrus.Warningf("PublishUpdatedForecasts: no output with ID %s. This is unexpected", outputID)
+			continue
+		}
+		pubForecast, _ := publisher.registeredNodes.GetNodeConfigBool(
+			output.NodeHWID, types.NodeAttrPublishForecast, true)
+		if pubForecast {
+			forecast := publisher.registeredForecastValues.GetForecast(outputID)
+			outputs.PublishForecast(output, forecast, messageSigner)
+		}
+	}
 }
 
 // PublishUpdatedOutputValues publishes updated outputs discovery and values of registered outputs
 // This uses the node config to determine which output publications to use: eg raw, latest, history
+// Nodes with batching enabled only publish their values in the batch, to reduce the nr of publications.
 func (publisher *Publisher) PublishUpdatedOutputValues(
 	updatedOutputIDs []string,
 	messageSigner *messaging.MessageSigner) {
 	regOutputValues := publisher.registeredOutputValues
+	// nodes with batching add a single event per update, regardless the nr of updated outputs
+	batchNodes := make(map[string]*types.NodeDiscoveryMessage)
 
 	for _, outputID := range updatedOutputIDs {
 		var node *types.NodeDiscoveryMessage
@@ -53,30 +109,72 @@ func (publisher *Publisher) PublishUpdatedOutputValues(
 			logrus.Warningf("PublishOutputValues: no node for output %s. This is unexpected", outputID)
 		} else if latestValue == nil {
 			logrus.Warningf("PublishOutputValues: no latest value for %s. This is unexpected", outputID)
+		} else if batchSize, _ := publisher.registeredNodes.GetNodeConfigInt(
+			node.HWID, types.NodeAttrPublishBatch, 0); batchSize > 0 {
+			batchNodes[node.HWID] = node
 		} else {
-			pubRaw, _ := publisher.registeredNodes.GetNodeConfigBool(node.Address, types.NodeAttrPublishRaw, true)
-			if pubRaw {
+			pubRaw, _ := publisher.registeredNodes.GetNodeConfigBool(node.HWID, types.NodeAttrPublishRaw, true)
+			// the raw value of confidential outputs can't be encrypted for its readers
+			if pubRaw && len(output.Readers) == 0 {
 				outputs.PublishOutputRaw(output, latestValue.Value, messageSigner)
 			}
-			pubLatest, _ := publisher.registeredNodes.GetNodeConfigBool(node.Address, types.NodeAttrPublishLatest, true)
+			pubLatest, _ := publisher.registeredNodes.GetNodeConfigBool(node.HWID, types.NodeAttrPublishLatest, true)
 			if pubLatest {
 				outputs.PublishOutputLatest(output, latestValue, messageSigner)
 			}
-			pubHistory, _ := publisher.registeredNodes.GetNodeConfigBool(node.Address, types.NodeAttrPublishHistory, true)
+			pubHistory, _ := publisher.registeredNodes.GetNodeConfigBool(node.HWID, types.NodeAttrPublishHistory, true)
 			if pubHistory {
 				history := regOutputValues.GetHistory(outputID)
 				outputs.PublishOutputHistory(output, history, messageSigner)
 			}
-			pubEvent, _ := publisher.registeredNodes.GetNodeConfigBool(node.Address, types.NodeAttrPublishEvent, false)
+			pubEvent, _ := publisher.registeredNodes.GetNodeConfigBool(node.HWID, types.NodeAttrPublishEvent, false)
 			if pubEvent {
 				PublishOutputEvent(node, publisher.registeredOutputs, publisher.registeredOutputValues, messageSigner)
 			}
 		}
 	}
+	for _, node := range batchNodes {
+		event := makeOutputEvent(node, publisher.registeredOutputs, regOutputValues)
+		publisher.registeredOutputBatches.AddEvent(node.HWID, event)
+	}
+}
+
+// PublishReadyBatches publishes the accumulated output events of nodes whose batch has reached
+// the node's configured publishBatch size or publishBatchAge.
+// Pending events of nodes that have batching disabled are published immediately.
+func (publisher *Publisher) PublishReadyBatches(messageSigner *messaging.MessageSigner) {
+	for _, nodeHWID := range publisher.registeredOutputBatches.GetBatchNodes() {
+		var batch outputs.OutputBatch
+		node := publisher.registeredNodes.GetNodeByHWID(nodeHWID)
+		if node == nil {
+			logrus.Warningf("PublishReadyBatches: node %s no longer exists. Batch discarded", nodeHWID)
+			publisher.registeredOutputBatches.TakeBatch(nodeHWID)
+			continue
+		}
+		batchSize, _ := publisher.registeredNodes.GetNodeConfigInt(nodeHWID, types.NodeAttrPublishBatch, 0)
+		batchAge, _ := publisher.registeredNodes.GetNodeConfigInt(
+			nodeHWID, types.NodeAttrPublishBatchAge, DefaultBatchAge)
+		if batchSize <= 0 {
+			batch = publisher.registeredOutputBatches.TakeBatch(nodeHWID)
+		} else {
+			batch = publisher.registeredOutputBatches.TakeReadyBatch(
+				nodeHWID, batchSize, time.Duration(batchAge)*time.Second)
+		}
+		if batch == nil {
+			continue
+		}
+		readers, isConfidential := outputs.GetOutputReaders(publisher.registeredOutputs.GetOutputsByNodeHWID(nodeHWID))
+		if isConfidential && len(readers) == 0 {
+			logrus.Warningf("PublishReadyBatches: node %s outputs don't have common readers. Batch discarded", nodeHWID)
+			continue
+		}
+		outputs.PublishOutputBatchForReaders(node.Address, batch, readers, messageSigner)
+	}
 }
 
 // PublishOutputEvent publishes all node output values in the $event command
 // zone/publisher/nodealias/$event
+// If outputs of the node have readers then the event is encrypted for the readers of all these outputs.
 // TODO: decide when to invoke this
 func PublishOutputEvent(
 	node *types.NodeDiscoveryMessage,
@@ -89,11 +187,32 @@ func PublishOutputEvent(
 	logrus.Infof("Publisher.publishEvent: %s", aliasAddress)
 
 	nodeOutputs := registeredOutputs.GetOutputsByNodeHWID(node.HWID)
-	event := make(map[string]string)
 	timeStampStr := time.Now().Format("2006-01-02T15:04:05.000-0700")
 	if len(nodeOutputs) == 0 {
 		return lib.MakeErrorf("PublishOutputEvent: Node %s doesn't have any outputs", node.Address)
 	}
+	readers, isConfidential := outputs.GetOutputReaders(nodeOutputs)
+	if isConfidential && len(readers) == 0 {
+		return lib.MakeErrorf("PublishOutputEvent: Outputs of node %s don't have common readers", node.Address)
+	}
+	event := makeOutputEvent(node, registeredOutputs, outputValues)
+	eventMessage := &types.OutputEventMessage{
+		Address:   aliasAddress,
+		Event:     event,
+		Timestamp: timeStampStr,
+	}
+	err := outputs.PublishOutputObject(aliasAddress, eventMessage, readers, messageSigner)
+	return err
+}
+
+// makeOutputEvent returns the latest values of all node outputs, keyed by output type/instance
+func makeOutputEvent(
+	node *types.NodeDiscoveryMessage,
+	registeredOutputs *outputs.RegisteredOutputs,
+	outputValues *outputs.RegisteredOutputValues,
+) map[string]string {
+	event := make(map[string]string)
+	nodeOutputs := registeredOutputs.GetOutputsByNodeHWID(node.HWID)
 	for _, output := range nodeOutputs {
 		var value = ""
 		latest := outputValues.GetOutputValueByID(output.OutputID)
@@ -103,11 +222,5 @@ func PublishOutputEvent(
 		}
 		event[attrID] = value
 	}
-	eventMessage := &types.OutputEventMessage{
-		Address:   aliasAddress,
-		Event:     event,
-		Timestamp: timeStampStr,
-	}
-	err := messageSigner.PublishObject(aliasAddress, true, eventMessage, nil)
-	return err
+	return event
 }
@@ -7,6 +7,7 @@
 package publisher
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
@@ -16,8 +17,11 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/iotdomain/iotdomain-go/acks"
+	"github.com/iotdomain/iotdomain-go/acl"
 	"github.com/iotdomain/iotdomain-go/identities"
 	"github.com/iotdomain/iotdomain-go/inputs"
+	"github.com/iotdomain/iotdomain-go/keystore"
 	"github.com/iotdomain/iotdomain-go/lib"
 	"github.com/iotdomain/iotdomain-go/messaging"
 	"github.com/iotdomain/iotdomain-go/nodes"
@@ -32,29 +36,54 @@ const (
 	// polling based sources
 	DefaultPollInterval = 600
 
+	// DefaultBatchAge is the max age in seconds of a batch of output events before it is published
+	DefaultBatchAge = 60
+
+	// DefaultRenewIdentityDays is the nr of days before expiry that the publisher identity is renewed
+	DefaultRenewIdentityDays = 7
+
 	// RegisteredNodesFileSuffix to append to name of the file containing registered nodes
 	RegisteredNodesFileSuffix = "-nodes.json"
 	// RegisteredIdentityFileSuffix to append to the name of the file containing publisher saved identity
 	RegisteredIdentityFileSuffix = "-identity.json"
+	// RegisteredKeyFileSuffix to append to the name of the file containing the identity private key
+	// when a key store is configured
+	RegisteredKeyFileSuffix = "-key.pem"
 	// DomainPublishersFileSuffix to append to the name of the file containing domain publisher identities
 	DomainPublishersFileSuffix = "-domainpublishers.json"
+	// ReplayGuardFileSuffix to append to the name of the file containing the replay protection state
+	ReplayGuardFileSuffix = "-replay.json"
 	// note, domain nodes are not saved
 )
 
+// time to wait for a requested identity renewal before trying again
+const renewRetryInterval = 10 * time.Minute
+
+// time Start waits for the messenger to connect before connecting continues in the background
+const connectTimeout = 10 * time.Second
+
 // PublisherConfig defined configuration fields read from the application configuration
 type PublisherConfig struct {
-	SaveDiscoveredPublishers bool   `yaml:"cachePublishers"`   // load/save discovered publisher identities to cache
-	SaveDiscoveredNodes      bool   `yaml:"cacheNodes"`        // load/save discovered nodes to cache
-	CacheFolder              string `yaml:"cacheFolder"`       // location of discovered domain nodes and publishers
-	ConfigFolder             string `yaml:"configFolder"`      // location of yaml configuration files and registered nodes and identity
-	Domain                   string `yaml:"domain"`            // optional override per publisher. Default is local
-	PublisherID              string `yaml:"publisherId"`       // this publisher's ID
-	Loglevel                 string `yaml:"loglevel"`          // error, warning, info, debug
-	Logfile                  string `yaml:"logfile"`           //
-	DisableConfig            bool   `yaml:"disableConfig"`     // disable configuration over the bus, default is enabled
-	DisableInput             bool   `yaml:"disableInput"`      // disable inputs over the bus, default is enabled
-	DisablePublishers        bool   `yaml:"disablePublishers"` // disable listening for available publishers (enable for signature verification)
-	SecuredDomain            bool   `yaml:"securedDomain"`     // require secured domain and signed messages
+	SaveDiscoveredPublishers bool     `yaml:"cachePublishers"`   // load/save discovered publisher identities to cache
+	SaveDiscoveredNodes      bool     `yaml:"cacheNodes"`        // load/save discovered nodes to cache
+	CacheFolder              string   `yaml:"cacheFolder"`       // location of discovered domain nodes and publishers
+	ConfigFolder             string   `yaml:"configFolder"`      // location of yaml configuration files and registered nodes and identity
+	ACLFile                  string   `yaml:"aclFile"`           // file in the config folder with the acl of node commands. Default allows all
+	Domain                   string   `yaml:"domain"`            // optional override per publisher. Default is local
+	KeyAlgorithm             string   `yaml:"keyAlgorithm"`      // algorithm of new identity keys: ES256 (default), ES384 or EdDSA. EdDSA keys can't decrypt commands
+	KeyPassphraseEnv         string   `yaml:"keyPassphraseEnv"`  // environment variable with the passphrase of the encrypted key store
+	KeyPassphraseFile        string   `yaml:"keyPassphraseFile"` // file in the config folder with the passphrase, used if the env var isn't set
+	KeyStore                 string   `yaml:"keyStore"`          // store of the identity private key: encrypted, file or memory. Default is the identity file
+	PublisherID              string   `yaml:"publisherId"`       // this publisher's ID
+	RenewIdentityDays        int      `yaml:"renewIdentityDays"` // nr of days before expiry the identity is renewed. Default is 7
+	ReplayWindow             int      `yaml:"replayWindow"`      // max seconds between a command timestamp and the local clock. Default is 300
+	RevocationAdmins         []string `yaml:"revocationAdmins"`  // publisherIDs besides the DSS that can revoke publishers
+	Loglevel                 string   `yaml:"loglevel"`          // error, warning, info, debug
+	Logfile                  string   `yaml:"logfile"`           //
+	DisableConfig            bool     `yaml:"disableConfig"`     // disable configuration over the bus, default is enabled
+	DisableInput             bool     `yaml:"disableInput"`      // disable inputs over the bus, default is enabled
+	DisablePublishers        bool     `yaml:"disablePublishers"` // disable listening for available publishers (enable for signature verification)
+	SecuredDomain            bool     `yaml:"securedDomain"`     // require secured domain and signed messages
 }
 
 // Publisher carries the operating state of 'this' publisher
@@ -72,15 +101,22 @@ type Publisher struct {
 	inputFromOutputs     *inputs.ReceiveFromOutputs     // subscribe input to an output (latest) value
 	inputFromSetCommands *inputs.ReceiveFromSetCommands // trigger inputs with set commands for registered inputs
 
+	receiveAcks             *acks.ReceiveAcks // listener for acknowledgements of commands sent by this publisher
 	receiveMyIdentityUpdate *identities.ReceiveRegisteredIdentityUpdate
+	receiveCreateNode       *nodes.ReceiveCreateNode                     // listener for creating registered nodes
+	receiveDeleteNode       *nodes.ReceiveDeleteNode                     // listener for deleting registered nodes
 	receiveDomainIdentities *identities.ReceiveDomainPublisherIdentities // listener for identity updates
 	receiveNodeConfigure    *nodes.ReceiveNodeConfigure                  // listener for node configure for registered nodes
+	receiveRenewIdentity    *identities.ReceiveRenewIdentity             // listener for identity renewal requests (DSS only)
+	receiveRevocations      *identities.ReceiveRevocationList            // listener for revoked publishers
 	receiveSetNodeID        *nodes.ReceiveSetNodeID                      // listener for set node alias
+	receiveUpgrade          *nodes.ReceiveUpgrade                        // listener for node firmware upgrades
 
 	registeredForecastValues *outputs.RegisteredForecastValues // output forecasts values published by this publisher
 	registeredIdentity       *identities.RegisteredIdentity    // registered/published identity of this publisher
 	registeredInputs         *inputs.RegisteredInputs          // registered/published inputs from this publisher
 	registeredNodes          *nodes.RegisteredNodes            // registered/published nodes from this publisher
+	registeredOutputBatches  *outputs.RegisteredOutputBatches  // accumulated output events for batch publication
 	registeredOutputs        *outputs.RegisteredOutputs        // registered/published outputs from this publisher
 	registeredOutputValues   *outputs.RegisteredOutputValues   // registered/published output values from this publisher
 
@@ -96,12 +132,32 @@ type Publisher struct {
 	pollHandler         func(pub *Publisher)                                 // function that performs value polling
 	pollCountdown       int                                                  // countdown each heartbeat
 	pollInterval        int                                                  // value polling interval in seconds
+	renewRequested      time.Time                                            // time of the last identity renewal
+	replayGuard         *messaging.ReplayGuard                               // protection against replay of commands
 
 	// background publications require a mutex to prevent concurrent access
 	heartbeatChannel chan bool
 	updateMutex      *sync.Mutex // mutex for async updating and publishing
 }
 
+// HandleDeleteNodeCommand handles the command to delete a node. This removes the node, its inputs
+// and its outputs, and removes their discovery publications from the message bus.
+func (pub *Publisher) HandleDeleteNodeCommand(nodeHWID string) {
+	pub.DeleteNode(nodeHWID)
+}
+
+// HandleRevokedPublishers removes the discovered nodes, inputs, outputs and output values of
+// publishers that have been revoked
+func (pub *Publisher) HandleRevokedPublishers(revokedAddresses []string) {
+	for _, addr := range revokedAddresses {
+		nodeCount := pub.domainNodes.RemovePublisherNodes(addr)
+		pub.domainInputs.RemovePublisherInputs(addr)
+		pub.domainOutputs.RemovePublisherOutputs(addr)
+		pub.domainOutputValues.RemovePublisherValues(addr)
+		logrus.Warningf("HandleRevokedPublishers: Removed %d nodes of revoked publisher %s", nodeCount, addr)
+	}
+}
+
 // HandleSetNodeIDCommand handles the command to change the ID of a node. This updates the address
 // of a node, its inputs and its outputs.
 func (pub *Publisher) HandleSetNodeIDCommand(address string, message *types.SetNodeIDMessage) {
@@ -114,6 +170,18 @@ func (pub *Publisher) HandleSetNodeIDCommand(address string, message *types.SetN
 	pub.registeredOutputs.SetNodeID(node.HWID, message.NodeID)
 }
 
+// checkCanDecrypt returns an error if the identity keys of the publisher cannot decrypt messages.
+// Commands and their acknowledgements are always encrypted, so a publisher with EdDSA keys cannot
+// register nodes or inputs, or wait for acknowledgements.
+func (pub *Publisher) checkCanDecrypt(operation string) error {
+	algorithm := messaging.GetKeyAlgorithm(pub.GetIdentityKeys())
+	if algorithm == messaging.KeyAlgorithmEdDSA {
+		return lib.MakeErrorf("%s: Publisher %s has %s keys that cannot decrypt commands",
+			operation, pub.PublisherID(), algorithm)
+	}
+	return nil
+}
+
 // LoadDomainPublishers loads discovered publisher identities from the cache folder.
 // Intended to cache the public signing keys to verify messages from these publishers
 func (pub *Publisher) LoadDomainPublishers() error {
@@ -124,7 +192,11 @@ func (pub *Publisher) LoadDomainPublishers() error {
 
 // LoadRegisteredNodes loads saved registered nodes from the config folder.
 // Intended to restore node configuration.
+// Returns an error if the publisher keys cannot decrypt commands, see CreateNode.
 func (pub *Publisher) LoadRegisteredNodes() error {
+	if err := pub.checkCanDecrypt("LoadRegisteredNodes"); err != nil {
+		return err
+	}
 	filename := path.Join(pub.config.ConfigFolder, pub.PublisherID()+RegisteredNodesFileSuffix)
 	err := pub.registeredNodes.LoadNodes(filename)
 	return err
@@ -144,6 +216,23 @@ func (pub *Publisher) SaveRegisteredNodes() error {
 	return err
 }
 
+// SetNodeCreateHandler set the handler for creating nodes.
+// The handler is invoked if a create command for a node is received and the node doesn't exist.
+// Without handler the node is created and configured with the attributes from the command.
+func (pub *Publisher) SetNodeCreateHandler(
+	handler func(nodeHWID string, nodeType types.NodeType, config types.NodeAttrMap)) {
+
+	pub.receiveCreateNode.SetCreateNodeHandler(handler)
+}
+
+// SetNodeDeleteHandler set the handler for deleting nodes.
+// The handler is invoked if a delete command for a node is received and the node exists. This
+// replaces the default handler which removes the node, its inputs and outputs. Use DeleteNode to do so.
+func (pub *Publisher) SetNodeDeleteHandler(handler func(nodeHWID string)) {
+
+	pub.receiveDeleteNode.SetDeleteNodeHandler(handler)
+}
+
 // SetNodeConfigHandler set the handler for updating node configuration.
 // The handler is invoked if a configuration update for a node is received and the node exists.
 func (pub *Publisher) SetNodeConfigHandler(
@@ -152,6 +241,15 @@ func (pub *Publisher) SetNodeConfigHandler(
 	pub.receiveNodeConfigure.SetConfigureNodeHandler(handler)
 }
 
+// SetNodeUpgradeHandler set the handler for installing node firmware.
+// The handler is invoked when the firmware of a node is received and its MD5 is verified. Without
+// handler upgrade commands fail.
+func (pub *Publisher) SetNodeUpgradeHandler(
+	handler func(nodeHWID string, fwVersion string, firmware []byte) error) {
+
+	pub.receiveUpgrade.SetUpgradeHandler(handler)
+}
+
 // SetPollInterval is a convenience function for periodic polling of updates to registered
 // nodes, inputs, outputs and output values.
 // seconds interval to perform another poll. Default (0) is DefaultPollInterval
@@ -203,9 +301,15 @@ func (pub *Publisher) Start() {
 			pub.domainNodes.LoadNodes(pub.config.CacheFolder)
 		}
 
+		// reload the state of replay protection of commands
+		pub.replayGuard.Load()
+
+		// receive acknowledgements of commands sent by this publisher
+		pub.receiveAcks.Start()
 		// discover domain entities, eg identities, nodes, inputs and outputs
 		if !pub.config.DisablePublishers {
 			pub.receiveDomainIdentities.Start()
+			pub.receiveRevocations.Start()
 		}
 		// receive registered input set commands
 		if !pub.config.DisableInput {
@@ -214,17 +318,27 @@ func (pub *Publisher) Start() {
 		// Receive registered node configuration commands
 		if !pub.config.DisableConfig {
 			pub.receiveNodeConfigure.Start()
+			pub.receiveCreateNode.Start()
+			pub.receiveDeleteNode.Start()
+			pub.receiveUpgrade.Start()
 		}
 		// in secured domains the DSS can update the identity
 		if pub.config.SecuredDomain {
 			pub.receiveMyIdentityUpdate.Start()
 		}
-		//  listening
+		// the DSS renews identities on request
+		if pub.PublisherID() == types.DSSPublisherID {
+			pub.receiveRenewIdentity.Start()
+		}
+		//  listening. The status and identity are published when connected.
+		pub.messenger.SetConnectionHandler(pub.handleConnectionState)
 		lwtStatusAddress := identities.MakePublisherStatusAddress(pub.Domain(), pub.PublisherID())
-		pub.messenger.Connect(lwtStatusAddress, string(types.PublisherRunStateLost))
-
-		pub.SetPublisherStatus(types.PublisherRunStateConnected)
-		identities.PublishIdentity(&myIdent.PublisherIdentityMessage, pub.messageSigner)
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+		err := pub.messenger.Connect(ctx, lwtStatusAddress, string(types.PublisherRunStateLost))
+		cancel()
+		if err != nil {
+			logrus.Warningf("Publisher.Start: %s. Connecting continues in the background", err)
+		}
 	}
 }
 
@@ -236,14 +350,21 @@ func (pub *Publisher) Stop() {
 	if pub.isRunning {
 		pub.isRunning = false
 
+		pub.receiveAcks.Stop()
 		pub.receiveMyIdentityUpdate.Stop()
 		pub.receiveDomainIdentities.Stop()
+		pub.receiveRevocations.Stop()
 		pub.receiveNodeConfigure.Stop()
+		pub.receiveRenewIdentity.Stop()
+		pub.receiveCreateNode.Stop()
+		pub.receiveDeleteNode.Stop()
 		pub.receiveSetNodeID.Stop()
+		pub.receiveUpgrade.Stop()
 
 		pub.updateMutex.Unlock()
 		// wait for heartbeat to end
 		<-pub.heartbeatChannel
+		pub.replayGuard.Save()
 	} else {
 		pub.updateMutex.Unlock()
 	}
@@ -267,6 +388,25 @@ func (pub *Publisher) WaitForSignal() {
 	fmt.Println(sig)
 }
 
+// handleConnectionState publishes the publisher status and identity when the messenger is connected.
+// After a reconnect the last will has replaced the status, and the discovery is published again as
+// the server might have lost its retained messages.
+func (pub *Publisher) handleConnectionState(state messaging.ConnectionState) {
+	logrus.Infof("Publisher.handleConnectionState: Publisher %s connection is %s", pub.PublisherID(), state)
+	if state != messaging.ConnectionStateConnected && state != messaging.ConnectionStateReconnected {
+		return
+	}
+	pub.SetPublisherStatus(types.PublisherRunStateConnected)
+	myIdent, _ := pub.registeredIdentity.GetFullIdentity()
+	identities.PublishIdentity(&myIdent.PublisherIdentityMessage, pub.messageSigner)
+
+	if state == messaging.ConnectionStateReconnected {
+		nodes.PublishRegisteredNodes(pub.registeredNodes.GetAllNodes(), pub.messageSigner)
+		inputs.PublishRegisteredInputs(pub.registeredInputs.GetAllInputs(), pub.messageSigner)
+		outputs.PublishRegisteredOutputs(pub.registeredOutputs.GetAllOutputs(), pub.messageSigner)
+	}
+}
+
 // Main heartbeat loop to publish, discove and poll value updates
 func (pub *Publisher) heartbeatLoop() {
 	logrus.Infof("Publisher.heartbeatLoop: starting heartbeat loop")
@@ -275,6 +415,8 @@ func (pub *Publisher) heartbeatLoop() {
 	for {
 		time.Sleep(time.Second)
 
+		pub.renewExpiringIdentity()
+
 		// FIXME: The duration of publishing these updates adds to the heartbeat which delays the heartbeat
 		pub.PublishUpdates()
 
@@ -300,6 +442,39 @@ func (pub *Publisher) heartbeatLoop() {
 	logrus.Infof("Publisher.heartbeatLoop: Ending loop of publisher %s", pub.PublisherID())
 }
 
+// renewExpiringIdentity renews the publisher identity when it is about to expire.
+// In a secured domain the renewal is requested from the DSS, which responds with the $setIdentity
+// command. Otherwise a new self-signed identity with new keys is created and saved.
+// The new identity is published on the next PublishUpdates.
+func (pub *Publisher) renewExpiringIdentity() {
+	myIdent, _ := pub.registeredIdentity.GetFullIdentity()
+	renewBefore := time.Duration(pub.config.RenewIdentityDays) * 24 * time.Hour
+	if !identities.IsIdentityExpiring(&myIdent.PublisherIdentityMessage, renewBefore) {
+		return
+	}
+	pub.updateMutex.Lock()
+	if time.Since(pub.renewRequested) < renewRetryInterval {
+		pub.updateMutex.Unlock()
+		return
+	}
+	pub.renewRequested = time.Now()
+	pub.updateMutex.Unlock()
+
+	if pub.config.SecuredDomain && pub.PublisherID() != types.DSSPublisherID {
+		logrus.Warningf("Publisher.renewExpiringIdentity: Identity of %s expires at %s. Requesting renewal from the DSS",
+			pub.PublisherID(), myIdent.ValidUntil)
+		err := identities.PublishRenewIdentity(&myIdent.PublisherIdentityMessage, pub.messageSigner)
+		if err != nil {
+			logrus.Errorf("Publisher.renewExpiringIdentity: %s", err)
+		}
+		return
+	}
+	logrus.Warningf("Publisher.renewExpiringIdentity: Identity of %s expires at %s. Renewing the identity",
+		pub.PublisherID(), myIdent.ValidUntil)
+	pub.registeredIdentity.RenewIdentity()
+	pub.registeredIdentity.SaveIdentity()
+}
+
 // SetLogging sets the logging level and output file for this publisher
 // Intended for setting logging from configuration
 //  levelName is the requested logging level: error, warning, info, debug
@@ -362,11 +537,24 @@ func SetLogging(levelName string, filename string) error {
 // signingMethod indicates if and how publications must be signed. The default is jws. For testing 'none' can be used.
 //
 // messenger for publishing onto the message bus is required
+// Returns nil if the publisher cannot be created. The reason is logged.
 func NewPublisher(config *PublisherConfig, messenger messaging.IMessenger,
 ) *Publisher {
 
+	pub, err := newPublisher(config, messenger)
+	if err != nil {
+		logrus.Errorf("NewPublisher: %s", err)
+	}
+	return pub
+}
+
+// newPublisher creates a new publisher instance, see NewPublisher
+// Returns an error if the messenger is missing, the key algorithm is not supported or the key
+// store cannot be opened or loaded.
+func newPublisher(config *PublisherConfig, messenger messaging.IMessenger) (*Publisher, error) {
+
 	if messenger == nil {
-		return nil
+		return nil, lib.MakeErrorf("NewPublisher: Missing messenger")
 	}
 	if config == nil {
 		config = &PublisherConfig{}
@@ -377,20 +565,62 @@ func NewPublisher(config *PublisherConfig, messenger messaging.IMessenger,
 	if config.ConfigFolder == "" {
 		config.ConfigFolder = lib.DefaultConfigFolder
 	}
+	if config.RenewIdentityDays <= 0 {
+		config.RenewIdentityDays = DefaultRenewIdentityDays
+	}
+	if config.ReplayWindow <= 0 {
+		config.ReplayWindow = int(messaging.DefaultReplayWindow / time.Second)
+	}
+	if config.KeyAlgorithm == "" {
+		config.KeyAlgorithm = messaging.KeyAlgorithmES256
+	}
 	SetLogging(config.Loglevel, config.Logfile)
-
 	identityFile := path.Join(config.ConfigFolder, config.PublisherID+RegisteredIdentityFileSuffix)
-	registeredIdentity := identities.NewRegisteredIdentity(
-		config.Domain, config.PublisherID, identityFile)
+	registeredIdentity, err := identities.NewRegisteredIdentityWithAlgorithm(
+		config.Domain, config.PublisherID, identityFile, config.KeyAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	var keyStore keystore.KeyStore
+	keyFile := path.Join(config.ConfigFolder, config.PublisherID+RegisteredKeyFileSuffix)
+	if config.KeyStore != "" {
+		passphraseFile := config.KeyPassphraseFile
+		if passphraseFile != "" && !path.IsAbs(passphraseFile) {
+			passphraseFile = path.Join(config.ConfigFolder, passphraseFile)
+		}
+		keyStore, err = keystore.NewKeyStore(config.KeyStore, keyFile, config.KeyPassphraseEnv, passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		registeredIdentity.SetKeyStore(keyStore)
+	}
 	_, privKey, err := registeredIdentity.LoadIdentity()
+	if err != nil && keyStore != nil {
+		// don't replace a key that can't be loaded, eg due to an incorrect passphrase
+		if _, statErr := os.Stat(keyFile); statErr == nil {
+			if _, keyErr := keyStore.LoadKey(); keyErr != nil {
+				return nil, lib.MakeErrorf("NewPublisher: Unable to load the key of publisher %s. "+
+					"Identity not replaced: %s", config.PublisherID, keyErr)
+			}
+		}
+	}
 	if err != nil {
 		// save the identity as the loaded one isnt' valid
 		registeredIdentity.SaveIdentity()
 	}
+	if messaging.GetKeyAlgorithm(privKey) == messaging.KeyAlgorithmEdDSA {
+		logrus.Warningf("NewPublisher: Publisher %s uses %s keys that cannot decrypt messages. It cannot "+
+			"register nodes or inputs, receive acknowledgements, read encrypted output values or receive "+
+			"an identity from the DSS.", config.PublisherID, messaging.KeyAlgorithmEdDSA)
+	}
 	domainIdentities := identities.NewDomainPublisherIdentities()
 
 	// These are the basis for signing and identifying publishers
 	messageSigner := messaging.NewMessageSigner(messenger, privKey, domainIdentities.GetPublisherKey)
+	messageSigner.GetPreviousPublicKey = domainIdentities.GetPreviousPublisherKey
+	replayFile := path.Join(config.ConfigFolder, config.PublisherID+ReplayGuardFileSuffix)
+	replayGuard := messaging.NewReplayGuard(replayFile, time.Duration(config.ReplayWindow)*time.Second)
+	messageSigner.SetReplayGuard(replayGuard)
 
 	// application services
 	domainInputs := inputs.NewDomainInputs(messageSigner)
@@ -402,15 +632,26 @@ func NewPublisher(config *PublisherConfig, messenger messaging.IMessenger,
 	registeredOutputs := outputs.NewRegisteredOutputs(config.Domain, config.PublisherID)
 	registeredOutputValues := outputs.NewRegisteredOutputValues(config.Domain, config.PublisherID)
 	registeredForecastValues := outputs.NewRegisteredForecastValues(config.Domain, config.PublisherID)
+	registeredOutputBatches := outputs.NewRegisteredOutputBatches(config.Domain, config.PublisherID)
 
+	receiveAcks := acks.NewReceiveAcks(config.Domain, config.PublisherID, messageSigner)
 	receiveMyIdentityUpdate := identities.NewReceiveRegisteredIdentityUpdate(
 		registeredIdentity, messageSigner)
 	receiveDomainIdentities := identities.NewReceivePublisherIdentities(config.Domain,
 		domainIdentities, messageSigner)
+	receiveRenewIdentity := identities.NewReceiveRenewIdentity(config.Domain, nil, messageSigner)
+	receiveRevocations := identities.NewReceiveRevocationList(config.Domain, config.RevocationAdmins,
+		domainIdentities, messageSigner)
 	receiveNodeConfigure := nodes.NewReceiveNodeConfigure(
 		config.Domain, config.PublisherID, nil, messageSigner, registeredNodes, privKey)
 	receiveSetNodeID := nodes.NewReceiveSetNodeID(
-		config.Domain, config.PublisherID, nil, messageSigner, privKey)
+		config.Domain, config.PublisherID, nil, messageSigner, registeredNodes, privKey)
+	receiveCreateNode := nodes.NewReceiveCreateNode(
+		config.Domain, config.PublisherID, nil, messageSigner, registeredNodes, privKey)
+	receiveDeleteNode := nodes.NewReceiveDeleteNode(
+		config.Domain, config.PublisherID, nil, messageSigner, registeredNodes, privKey)
+	receiveUpgrade := nodes.NewReceiveUpgrade(
+		config.Domain, config.PublisherID, nil, messageSigner, registeredNodes, privKey)
 
 	var pub = &Publisher{
 		config:             *config,
@@ -435,24 +676,43 @@ func NewPublisher(config *PublisherConfig, messenger messaging.IMessenger,
 		messageSigner:           messageSigner,
 		pollCountdown:           0,
 		pollInterval:            DefaultPollInterval,
+		replayGuard:             replayGuard,
+		receiveAcks:             receiveAcks,
+		receiveCreateNode:       receiveCreateNode,
+		receiveDeleteNode:       receiveDeleteNode,
 		receiveDomainIdentities: receiveDomainIdentities,
 		receiveMyIdentityUpdate: receiveMyIdentityUpdate,
 		receiveNodeConfigure:    receiveNodeConfigure,
+		receiveRenewIdentity:    receiveRenewIdentity,
+		receiveRevocations:      receiveRevocations,
 		receiveSetNodeID:        receiveSetNodeID,
+		receiveUpgrade:          receiveUpgrade,
 
 		registeredForecastValues: registeredForecastValues,
 		registeredIdentity:       registeredIdentity,
 		registeredInputs:         registeredInputs,
 		registeredNodes:          registeredNodes,
+		registeredOutputBatches:  registeredOutputBatches,
 		registeredOutputs:        registeredOutputs,
 		registeredOutputValues:   registeredOutputValues,
 
 		updateMutex: &sync.Mutex{},
 	}
 	receiveSetNodeID.SetNodeIDHandler(pub.HandleSetNodeIDCommand)
+	if config.ACLFile != "" {
+		// an acl that fails to load denies all commands
+		accessControlList := acl.NewAccessControlList(config.ConfigFolder, config.ACLFile, config.PublisherID)
+		err = accessControlList.Load()
+		if err != nil {
+			logrus.Errorf("NewPublisher: %s", err)
+		}
+		pub.SetAuthorizer(accessControlList)
+	}
+	receiveDeleteNode.SetDeleteNodeHandler(pub.HandleDeleteNodeCommand)
+	receiveRevocations.SetRevokedPublishersHandler(pub.HandleRevokedPublishers)
 
 	// Load configuration of previously registered nodes from config
 	pub.LoadRegisteredNodes()
 
-	return pub
+	return pub, nil
 }
@@ -1,12 +1,21 @@
 package publisher_test
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 	"time"
 
+	"github.com/iotdomain/iotdomain-go/acks"
+	"github.com/iotdomain/iotdomain-go/identities"
 	"github.com/iotdomain/iotdomain-go/inputs"
+	"github.com/iotdomain/iotdomain-go/keystore"
 	"github.com/iotdomain/iotdomain-go/messaging"
+	"github.com/iotdomain/iotdomain-go/outputs"
 	"github.com/iotdomain/iotdomain-go/publisher"
 	"github.com/iotdomain/iotdomain-go/types"
 	"github.com/sirupsen/logrus"
@@ -52,6 +61,48 @@ func TestNewPublisher(t *testing.T) {
 	// defaults
 	pub2 := publisher.NewPublisher(nil, nil)
 	require.Nil(t, pub2)
+
+	// key algorithm of a new identity
+	folder, _ := ioutil.TempDir("", "keyalgorithm")
+	defer os.RemoveAll(folder)
+	pub3 := publisher.NewPublisher(&publisher.PublisherConfig{
+		ConfigFolder: folder, PublisherID: "publisher3", KeyAlgorithm: messaging.KeyAlgorithmEdDSA}, testMessenger)
+	require.NotNil(t, pub3)
+	assert.Equal(t, messaging.KeyAlgorithmEdDSA, pub3.GetIdentity().Algorithm)
+	assert.Equal(t, messaging.KeyAlgorithmEdDSA, messaging.GetKeyAlgorithm(pub3.GetIdentityKeys()))
+	// EdDSA keys cannot decrypt commands or acks so the publisher cannot have nodes or inputs
+	assert.Nil(t, pub3.CreateNode("node1", types.NodeTypeUnknown))
+	assert.Nil(t, pub3.CreateInput("node1", types.InputTypeSwitch, types.DefaultInputInstance, nil))
+	_, err := pub3.PublishSetInputWithAck(context.Background(), "test/publisher1/node1/switch/0/$input", "on")
+	assert.Error(t, err)
+	pub4 := publisher.NewPublisher(&publisher.PublisherConfig{
+		ConfigFolder: folder, PublisherID: "publisher4", KeyAlgorithm: "RS256"}, testMessenger)
+	assert.Nil(t, pub4)
+
+	// the private key is kept in the encrypted key store instead of the identity file
+	ioutil.WriteFile(path.Join(folder, "passphrase"), []byte("secret\n"), 0600)
+	keyStoreConfig := &publisher.PublisherConfig{
+		ConfigFolder: folder, PublisherID: "publisher5", KeyStore: keystore.KeyStoreTypeEncrypted,
+		KeyPassphraseFile: "passphrase"}
+	pub5 := publisher.NewPublisher(keyStoreConfig, testMessenger)
+	require.NotNil(t, pub5)
+	identityJSON, _ := ioutil.ReadFile(path.Join(folder, "publisher5"+publisher.RegisteredIdentityFileSuffix))
+	assert.NotContains(t, string(identityJSON), "PRIVATE KEY")
+	pub5b := publisher.NewPublisher(keyStoreConfig, testMessenger)
+	require.NotNil(t, pub5b)
+	assert.Equal(t, pub5.GetIdentity().PublicKey, pub5b.GetIdentity().PublicKey)
+	// an incorrect passphrase doesn't replace the identity or key
+	keyPem, _ := ioutil.ReadFile(path.Join(folder, "publisher5"+publisher.RegisteredKeyFileSuffix))
+	ioutil.WriteFile(path.Join(folder, "passphrase"), []byte("wrong secret\n"), 0600)
+	pub5c := publisher.NewPublisher(keyStoreConfig, testMessenger)
+	assert.Nil(t, pub5c)
+	keyPem2, _ := ioutil.ReadFile(path.Join(folder, "publisher5"+publisher.RegisteredKeyFileSuffix))
+	identityJSON2, _ := ioutil.ReadFile(path.Join(folder, "publisher5"+publisher.RegisteredIdentityFileSuffix))
+	assert.Equal(t, keyPem, keyPem2)
+	assert.Equal(t, identityJSON, identityJSON2)
+	pub6 := publisher.NewPublisher(&publisher.PublisherConfig{
+		ConfigFolder: folder, PublisherID: "publisher6", KeyStore: keystore.KeyStoreTypeEncrypted}, testMessenger)
+	assert.Nil(t, pub6)
 }
 
 type s struct{ Item1 string }
@@ -62,6 +113,14 @@ func TestNewAppPublisher(t *testing.T) {
 	appPub, err := publisher.NewAppPublisher(appID, test1Config.ConfigFolder, &appConfig, "", false)
 	assert.NotNil(t, appPub)
 	assert.Error(t, err) // no messenger config
+
+	// a publisher that can't be created returns an error instead of a nil publisher
+	folder, _ := ioutil.TempDir("", "apppublisher")
+	defer os.RemoveAll(folder)
+	ioutil.WriteFile(path.Join(folder, appID+".yaml"), []byte("keyStore: encrypted\n"), 0600)
+	appPub, err = publisher.NewAppPublisher(appID, folder, &appConfig, "", false)
+	assert.Nil(t, appPub)
+	assert.Error(t, err)
 }
 
 func TestStartStop(t *testing.T) {
@@ -93,6 +152,31 @@ func TestStartStop(t *testing.T) {
 
 }
 
+// TestConnectionLoss publishes the lost status as last will and restores the status on reconnect
+func TestConnectionLoss(t *testing.T) {
+	configFolder, _ := ioutil.TempDir("", "publisher")
+	defer os.RemoveAll(configFolder)
+	var testMessenger = messaging.NewDummyMessenger(msgConfig)
+	pub1 := publisher.NewPublisher(&publisher.PublisherConfig{
+		ConfigFolder: configFolder, Domain: "test", PublisherID: "publisher1",
+	}, testMessenger)
+	pub1.Start()
+	defer pub1.Stop()
+
+	statusAddr := identities.MakePublisherStatusAddress("test", "publisher1")
+	lastStatus := ""
+	testMessenger.Subscribe(statusAddr, func(address string, message string) error {
+		lastStatus = message
+		return nil
+	})
+	testMessenger.SimulateConnectionLoss()
+	assert.Equal(t, string(types.PublisherRunStateLost), lastStatus)
+
+	testMessenger.SimulateReconnect()
+	assert.NotEqual(t, string(types.PublisherRunStateLost), lastStatus)
+	assert.Equal(t, testMessenger.FindLastPublication(statusAddr), lastStatus)
+}
+
 func TestSetLogging(t *testing.T) {
 	var logFile = "/tmp/iotdomain-go.log"
 	// var testMessenger = messaging.NewDummyMessenger(msgConfig)
@@ -147,6 +231,51 @@ func TestDiscoveryWithNewNodeID(t *testing.T) {
 	pub1.Stop()
 }
 
+// TestCreateDeleteNode tests the create and delete node commands
+func TestCreateDeleteNode(t *testing.T) {
+	const newNodeID = "newnode"
+	var newNodeAddr = fmt.Sprintf("test/publisher1/%s/$node", newNodeID)
+	var newInputAddr = fmt.Sprintf("test/publisher1/%s/switch/0/$input", newNodeID)
+	var newOutputAddr = fmt.Sprintf("test/publisher1/%s/switch/0/$output", newNodeID)
+	var testMessenger = messaging.NewDummyMessenger(msgConfig)
+	pub1 := publisher.NewPublisher(test1Config, testMessenger)
+	pub1.Start()
+
+	err := pub1.PublishCreateNode(newNodeAddr, types.NodeTypeUnknown, types.NodeAttrMap{
+		types.NodeAttrName: "new node",
+	})
+	assert.NoError(t, err)
+	node := pub1.GetNodeByHWID(newNodeID)
+	require.NotNil(t, node, "Node not created")
+	assert.Equal(t, "new node", pub1.GetNodeAttr(newNodeID, types.NodeAttrName))
+
+	pub1.CreateInput(newNodeID, types.InputTypeSwitch, types.DefaultInputInstance, nil)
+	pub1.CreateOutput(newNodeID, types.OutputTypeSwitch, types.DefaultOutputInstance)
+	pub1.PublishUpdates()
+	assert.NotEmpty(t, testMessenger.FindLastPublication(newNodeAddr), "Node not published")
+	assert.NotEmpty(t, testMessenger.FindLastPublication(newInputAddr), "Input not published")
+	assert.NotEmpty(t, testMessenger.FindLastPublication(newOutputAddr), "Output not published")
+
+	// delete must remove the node, its inputs and outputs, and their publications
+	err = pub1.PublishDeleteNode(newNodeAddr)
+	assert.NoError(t, err)
+	assert.Nil(t, pub1.GetNodeByHWID(newNodeID), "Node not deleted")
+	assert.Nil(t, pub1.GetInputByNodeHWID(newNodeID, types.InputTypeSwitch, types.DefaultInputInstance))
+	assert.Nil(t, pub1.GetOutputByNodeHWID(newNodeID, types.OutputTypeSwitch, types.DefaultOutputInstance))
+	pub1.PublishUpdates()
+	assert.Empty(t, testMessenger.FindLastPublication(newNodeAddr), "Node publication not removed")
+	assert.Empty(t, testMessenger.FindLastPublication(newInputAddr), "Input publication not removed")
+	assert.Empty(t, testMessenger.FindLastPublication(newOutputAddr), "Output publication not removed")
+
+	// error case - unknown publisher
+	err = pub1.PublishCreateNode("test/publisher2/node2", types.NodeTypeUnknown, nil)
+	assert.Error(t, err)
+	err = pub1.PublishDeleteNode(node2Base)
+	assert.Error(t, err)
+
+	pub1.Stop()
+}
+
 // TestReceiveInput tests receiving input control commands
 func TestReceiveInput(t *testing.T) {
 	var testMessenger = messaging.NewDummyMessenger(msgConfig)
@@ -197,19 +326,319 @@ func TestReceiveInput(t *testing.T) {
 	pub1.Stop()
 }
 
+func TestCommandAcks(t *testing.T) {
+	var testMessenger = messaging.NewDummyMessenger(msgConfig)
+	var node1InputSetAddr = fmt.Sprintf("%s/%s/0/%s", node1Base, node1InputType, types.MessageTypeSetInput)
+	pub1 := publisher.NewPublisher(test1Config, testMessenger)
+	pub1.Start()
+	defer pub1.Stop()
+	pub1.CreateNode(node1ID, types.NodeTypeUnknown)
+	pub1.CreateInput(node1ID, types.InputTypeSwitch, types.DefaultInputInstance,
+		func(input *types.InputDiscoveryMessage, sender string, value string) {})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	ack, err := pub1.PublishSetInputWithAck(ctx, node1InputSetAddr, "true")
+	require.NoError(t, err)
+	assert.Equal(t, types.AckStatusAccepted, ack.Status)
+
+	node1 := pub1.GetNodeByHWID(node1ID)
+	require.NotNil(t, node1)
+	ack, err = pub1.PublishNodeConfigureWithAck(ctx, node1.Address, types.NodeAttrMap{types.NodeAttrName: "bob"})
+	require.NoError(t, err)
+	assert.Equal(t, types.AckStatusApplied, ack.Status)
+
+	// rejected commands report the error
+	ack, err = pub1.PublishNodeConfigureWithAck(ctx, node1Base+"2/$node", types.NodeAttrMap{types.NodeAttrName: "bob"})
+	require.NoError(t, err)
+	assert.Equal(t, types.AckStatusRejected, ack.Status)
+	assert.NotEmpty(t, ack.Error)
+
+	// replayed commands are not acknowledged
+	ackAddr := acks.MakeAckAddress(pub1.Address())
+	lastAck := testMessenger.FindLastPublication(ackAddr)
+	testMessenger.OnReceive(node1InputSetAddr, testMessenger.FindLastPublication(node1InputSetAddr))
+	assert.Equal(t, lastAck, testMessenger.FindLastPublication(ackAddr))
+
+	// unknown publishers can't be sent commands
+	_, err = pub1.PublishSetInputWithAck(ctx, "test/publisher2/node1/switch/0/$setInput", "true")
+	assert.Error(t, err)
+	_, err = pub1.PublishNodeConfigureWithAck(ctx, "test/publisher2/node1", types.NodeAttrMap{})
+	assert.Error(t, err)
+}
+
 func TestPublishEvent(t *testing.T) {
 	// setup
 	var testMessenger = messaging.NewDummyMessenger(msgConfig)
 	pub1 := publisher.NewPublisher(test1Config, testMessenger)
 	node1 := pub1.CreateNode(node1ID, types.NodeTypeUnknown)
 	// pub1.CreateInput(node1ID, node1InputType, types.DefaultInputInstance, nil)
-	pub1.CreateOutput(node1ID, node1Output1Type, types.DefaultOutputInstance)
+	output1 := pub1.CreateOutput(node1ID, node1Output1Type, types.DefaultOutputInstance)
 	err := pub1.PublishOutputEvent(node1)
 	assert.NoError(t, err)
 	// TODO: check result
+
+	// the event of confidential outputs is only published if the readers' keys are known
+	err = pub1.SetOutputReaders(output1.OutputID, []string{"test/unknown/$identity"})
+	require.NoError(t, err)
+	err = pub1.PublishOutputEvent(node1)
+	assert.Error(t, err)
+	pub1.SetOutputReaders(output1.OutputID, nil)
+	err = pub1.PublishOutputEvent(node1)
+	assert.NoError(t, err)
+}
+
+func TestPublishForecast(t *testing.T) {
+	const node3ID = "node3"
+	var node1ForecastAddr = node1Base + "/switch/0/$forecast"
+	var node3ForecastAddr = fmt.Sprintf("test/publisher1/%s/switch/0/$forecast", node3ID)
+	var testMessenger = messaging.NewDummyMessenger(msgConfig)
+	pub1 := publisher.NewPublisher(test1Config, testMessenger)
+	pub1.CreateNode(node1ID, types.NodeTypeUnknown)
+	pub1.CreateNode(node3ID, types.NodeTypeUnknown)
+	pub1.Start()
+	pub1.UpdateNodeConfigValues(node3ID, types.NodeAttrMap{types.NodeAttrPublishForecast: "false"})
+	output1 := pub1.CreateOutput(node1ID, node1Output1Type, types.DefaultOutputInstance)
+	output3 := pub1.CreateOutput(node3ID, node1Output1Type, types.DefaultOutputInstance)
+	pub1.Subscribe("", "")
+
+	forecast := outputs.OutputForecast{
+		{EpochTime: time.Now().Add(-time.Hour).Unix(), Value: "off"},
+		{EpochTime: time.Now().Add(time.Hour).Unix(), Value: "on"},
+	}
+	pub1.UpdateOutputForecast(output1.OutputID, forecast)
+	pub1.UpdateOutputForecast(output3.OutputID, forecast)
+	pub1.PublishUpdates()
+
+	// past entries are not published
+	forecastMsg := pub1.GetDomainForecast(node1ForecastAddr)
+	require.NotNil(t, forecastMsg, "Forecast not published")
+	assert.Equal(t, 1, len(forecastMsg.Forecast))
+	assert.Equal(t, "on", forecastMsg.Forecast[0].Value)
+
+	// node3 has forecast publication disabled
+	assert.Empty(t, testMessenger.FindLastPublication(node3ForecastAddr), "Forecast published while disabled")
+	assert.Nil(t, pub1.GetDomainForecast(node3ForecastAddr))
+
+	// setting readers removes the raw value and republishes the latest value and forecast encrypted
+	rawAddr := outputs.ReplaceMessageType(output1.Address, types.MessageTypeRaw)
+	latestAddr := outputs.ReplaceMessageType(output1.Address, types.MessageTypeLatest)
+	pub1.UpdateOutputValue(node1ID, node1Output1Type, types.DefaultOutputInstance, "on")
+	pub1.PublishUpdates()
+	assert.NotEmpty(t, testMessenger.FindLastPublication(rawAddr))
+	err := pub1.SetOutputReaders(output1.OutputID, []string{pub1.Address()})
+	require.NoError(t, err)
+	assert.Empty(t, testMessenger.FindLastPublication(rawAddr))
+	pub1.PublishUpdates()
+	assert.Empty(t, testMessenger.FindLastPublication(rawAddr))
+	assert.Contains(t, testMessenger.FindLastPublication(latestAddr), "ciphertext")
+	assert.Contains(t, testMessenger.FindLastPublication(node1ForecastAddr), "ciphertext")
+	forecastMsg = pub1.GetDomainForecast(node1ForecastAddr)
+	require.NotNil(t, forecastMsg, "Encrypted forecast not received by its reader")
+	assert.Equal(t, "on", forecastMsg.Forecast[0].Value)
+	pub1.Unsubscribe("", "")
+	pub1.Stop()
+}
+
+// TestPublishNodeConfig uses the node configuration to determine which output values are published
+func TestPublishNodeConfig(t *testing.T) {
+	const node5ID = "node5"
+	var node5EventAddr = fmt.Sprintf("test/publisher1/%s/$event", node5ID)
+	var testMessenger = messaging.NewDummyMessenger(msgConfig)
+	pub1 := publisher.NewPublisher(test1Config, testMessenger)
+	pub1.Start()
+	pub1.CreateNode(node5ID, types.NodeTypeUnknown)
+	pub1.UpdateNodeConfigValues(node5ID, types.NodeAttrMap{
+		types.NodeAttrPublishEvent:   "true",
+		types.NodeAttrPublishHistory: "false",
+		types.NodeAttrPublishLatest:  "false",
+		types.NodeAttrPublishRaw:     "false",
+	})
+	output5 := pub1.CreateOutput(node5ID, node1Output1Type, types.DefaultOutputInstance)
+
+	pub1.UpdateOutputValue(node5ID, node1Output1Type, types.DefaultOutputInstance, "on")
+	pub1.PublishUpdates()
+	assert.NotEmpty(t, testMessenger.FindLastPublication(node5EventAddr), "Event not published")
+	for _, messageType := range []types.MessageType{types.MessageTypeRaw, types.MessageTypeLatest, types.MessageTypeHistory} {
+		valueAddr := outputs.ReplaceMessageType(output5.Address, messageType)
+		assert.Empty(t, testMessenger.FindLastPublication(valueAddr), "%s published while disabled", messageType)
+	}
+	pub1.Stop()
+}
+
+func TestPublishBatch(t *testing.T) {
+	const node4ID = "node4"
+	var node4BatchAddr = fmt.Sprintf("test/publisher1/%s/$batch", node4ID)
+	var node4EventAddr = fmt.Sprintf("test/publisher1/%s/$event", node4ID)
+	var node4LatestAddr = outputs.MakeOutputValueAddress("test", "publisher1", node4ID,
+		node1Output1Type, types.DefaultOutputInstance, types.MessageTypeLatest)
+	var testMessenger = messaging.NewDummyMessenger(msgConfig)
+	pub1 := publisher.NewPublisher(test1Config, testMessenger)
+	pub1.Start()
+	pub1.CreateNode(node4ID, types.NodeTypeUnknown)
+	pub1.UpdateNodeConfigValues(node4ID, types.NodeAttrMap{
+		types.NodeAttrPublishBatch: "2",
+		types.NodeAttrPublishEvent: "true",
+	})
+	pub1.CreateOutput(node4ID, node1Output1Type, types.DefaultOutputInstance)
+
+	// first event is held back
+	pub1.UpdateOutputValue(node4ID, node1Output1Type, types.DefaultOutputInstance, "on")
+	pub1.PublishUpdates()
+	assert.Empty(t, testMessenger.FindLastPublication(node4BatchAddr), "Batch published too early")
+	assert.Empty(t, testMessenger.FindLastPublication(node4EventAddr), "Event published while batching")
+	assert.Empty(t, testMessenger.FindLastPublication(node4LatestAddr), "Latest value published while batching")
+
+	// second event completes the batch
+	pub1.UpdateOutputValue(node4ID, node1Output1Type, types.DefaultOutputInstance, "off")
+	pub1.PublishUpdates()
+	assert.NotEmpty(t, testMessenger.FindLastPublication(node4BatchAddr), "Batch not published")
+
+	// disabling batching publishes the pending events
+	testMessenger.Publish(node4BatchAddr, true, "")
+	pub1.UpdateOutputValue(node4ID, node1Output1Type, types.DefaultOutputInstance, "on")
+	pub1.PublishUpdates()
+	assert.Empty(t, testMessenger.FindLastPublication(node4BatchAddr))
+	pub1.UpdateNodeConfigValues(node4ID, types.NodeAttrMap{types.NodeAttrPublishBatch: "0"})
+	pub1.PublishUpdates()
+	assert.NotEmpty(t, testMessenger.FindLastPublication(node4BatchAddr), "Pending batch not published")
+	pub1.UpdateOutputValue(node4ID, node1Output1Type, types.DefaultOutputInstance, "off")
+	pub1.PublishUpdates()
+	assert.NotEmpty(t, testMessenger.FindLastPublication(node4LatestAddr), "Latest value not published")
+	pub1.Stop()
 }
 
 // run a bunch of facade commands with invalid arguments
+func TestRenewIdentity(t *testing.T) {
+	configFolder, _ := ioutil.TempDir("", "publisher")
+	defer os.RemoveAll(configFolder)
+	var testMessenger = messaging.NewDummyMessenger(msgConfig)
+	// the 1 year self-signed identity is renewed immediately
+	pub1 := publisher.NewPublisher(&publisher.PublisherConfig{
+		ConfigFolder: configFolder, Domain: "test", PublisherID: "publisher1", RenewIdentityDays: 400,
+	}, testMessenger)
+	pub1.CreateNode(node1ID, types.NodeTypeUnknown)
+	pub1.Start()
+	ident1 := pub1.GetIdentity()
+	time.Sleep(time.Millisecond * 1500)
+	ident2 := pub1.GetIdentity()
+	assert.NotEqual(t, ident1.PublicKey, ident2.PublicKey, "Identity not renewed")
+	assert.Equal(t, ident1.Location, ident2.Location)
+
+	// the new identity is published and the node discovery is republished with the new key
+	newKey := pub1.GetPublisherKey(pub1.Address())
+	require.NotNil(t, newKey)
+	assert.Equal(t, messaging.PublicKeyToPem(newKey), ident2.PublicKey)
+	_, err := messaging.VerifyJWSMessage(testMessenger.FindLastPublication(node1Addr), newKey)
+	assert.NoError(t, err, "Node discovery not signed with the renewed key")
+
+	// the renewed identity is saved
+	identityJSON, err := ioutil.ReadFile(path.Join(configFolder, "publisher1"+publisher.RegisteredIdentityFileSuffix))
+	require.NoError(t, err)
+	savedIdentity := types.PublisherFullIdentity{}
+	json.Unmarshal(identityJSON, &savedIdentity)
+	assert.Equal(t, ident2.PublicKey, savedIdentity.PublicKey, "Renewed identity not saved")
+
+	// don't renew again until the retry interval has passed
+	time.Sleep(time.Millisecond * 1100)
+	assert.Equal(t, ident2.PublicKey, pub1.GetIdentity().PublicKey)
+	pub1.Stop()
+}
+
+func TestRevokePublisher(t *testing.T) {
+	configFolder, _ := ioutil.TempDir("", "publisher")
+	defer os.RemoveAll(configFolder)
+	var testMessenger = messaging.NewDummyMessenger(msgConfig)
+	pub1 := publisher.NewPublisher(&publisher.PublisherConfig{
+		ConfigFolder: configFolder, Domain: "test", PublisherID: "publisher1",
+		RevocationAdmins: []string{"admin"},
+	}, testMessenger)
+	pub2 := publisher.NewPublisher(&publisher.PublisherConfig{
+		ConfigFolder: configFolder, Domain: "test", PublisherID: "publisher2",
+	}, testMessenger)
+	admin := publisher.NewPublisher(&publisher.PublisherConfig{
+		ConfigFolder: configFolder, Domain: "test", PublisherID: "admin",
+	}, testMessenger)
+	pub1.Start()
+	pub2.Start()
+	admin.Start()
+	pub1.Subscribe("test", "publisher2")
+
+	pub2.CreateNode(node1ID, types.NodeTypeUnknown)
+	pub2.CreateOutput(node1ID, node1Output1Type, types.DefaultOutputInstance)
+	pub2.PublishUpdates()
+	require.NotNil(t, pub1.GetDomainNode(node2Base+"/$node"), "Node of publisher2 not discovered")
+	require.Equal(t, 1, len(pub1.GetDomainOutputs()))
+
+	// a revoked publisher and its nodes are removed
+	err := admin.PublishRevocationList([]types.RevokedPublisher{{Address: pub2.Address()}})
+	assert.NoError(t, err)
+	assert.Nil(t, pub1.GetDomainPublisher(pub2.Address()))
+	assert.Nil(t, pub1.GetPublisherKey(pub2.Address()))
+	assert.Nil(t, pub1.GetDomainNode(node2Base+"/$node"), "Node of revoked publisher2 not removed")
+	assert.Equal(t, 0, len(pub1.GetDomainOutputs()))
+
+	// new publications of the revoked publisher are rejected
+	pub2.UpdateNodeAttr(node1ID, types.NodeAttrMap{types.NodeAttrDescription: "revoked"})
+	pub2.PublishUpdates()
+	assert.Nil(t, pub1.GetDomainNode(node2Base+"/$node"))
+
+	// publisher2 isn't allowed to revoke
+	err = pub2.PublishRevocationList([]types.RevokedPublisher{{Address: admin.Address()}})
+	assert.NoError(t, err)
+	assert.NotNil(t, pub1.GetPublisherKey(admin.Address()))
+
+	pub1.Stop()
+	pub2.Stop()
+	admin.Stop()
+}
+
+func TestAccessControl(t *testing.T) {
+	const aclText = "rules:\n  - sender: test/admin/$identity\n    address: test/{publisher}/#\n"
+	configFolder, _ := ioutil.TempDir("", "publisher")
+	defer os.RemoveAll(configFolder)
+	err := ioutil.WriteFile(path.Join(configFolder, "acl.yaml"), []byte(aclText), 0600)
+	require.NoError(t, err)
+	var testMessenger = messaging.NewDummyMessenger(msgConfig)
+	admin := publisher.NewPublisher(&publisher.PublisherConfig{
+		ConfigFolder: configFolder, Domain: "test", PublisherID: "admin",
+	}, testMessenger)
+	pub1 := publisher.NewPublisher(&publisher.PublisherConfig{
+		ConfigFolder: configFolder, Domain: "test", PublisherID: "publisher1", ACLFile: "acl.yaml",
+	}, testMessenger)
+	admin.Start()
+	pub1.Start()
+	testMessenger.OnReceive(admin.Address(), testMessenger.FindLastPublication(admin.Address()))
+	pub1.CreateNode(node1ID, types.NodeTypeUnknown)
+	pub1.PublishUpdates()
+
+	// only the admin is allowed to configure nodes of publisher1
+	pub1.PublishNodeConfigure(node1Addr, types.NodeAttrMap{types.NodeAttrName: "denied"})
+	assert.Empty(t, pub1.GetNodeAttr(node1ID, types.NodeAttrName))
+	node := pub1.GetNodeByHWID(node1ID)
+	assert.Contains(t, node.Status[types.NodeStatusLastError], "not authorized")
+
+	admin.PublishNodeConfigure(node1Addr, types.NodeAttrMap{types.NodeAttrName: "allowed"})
+	assert.Equal(t, "allowed", pub1.GetNodeAttr(node1ID, types.NodeAttrName))
+
+	// the same applies to creating and deleting nodes
+	node2Addr := "test/publisher1/node2"
+	pub1.PublishCreateNode(node2Addr, types.NodeTypeUnknown, nil)
+	assert.Nil(t, pub1.GetNodeByHWID("node2"))
+	admin.PublishCreateNode(node2Addr, types.NodeTypeUnknown, nil)
+	assert.NotNil(t, pub1.GetNodeByHWID("node2"))
+
+	pub1.PublishDeleteNode(node1Addr)
+	node = pub1.GetNodeByHWID(node1ID)
+	require.NotNil(t, node)
+	assert.Contains(t, node.Status[types.NodeStatusLastError], "not authorized to delete")
+	admin.PublishDeleteNode(node1Addr)
+	assert.Nil(t, pub1.GetNodeByHWID(node1ID))
+
+	pub1.Stop()
+	admin.Stop()
+}
+
 func TestErrors(t *testing.T) {
 	var testMessenger = messaging.NewDummyMessenger(msgConfig)
 	pub1 := publisher.NewPublisher(test1Config, testMessenger)
@@ -228,6 +657,7 @@ func TestErrors(t *testing.T) {
 	pub1.GetDomainInput("fakeaddr")
 	pub1.GetDomainNode("fakeaddr")
 	pub1.GetDomainOutput("fakeaddr")
+	pub1.GetDomainForecast("fakeaddr")
 	pub1.GetIdentity()
 	pub1.GetIdentityKeys()
 	pub1.GetInputByNodeHWID("fakenode", "", "")
@@ -250,8 +680,14 @@ func TestErrors(t *testing.T) {
 	pub1.GetOutputValueByID("fakeid")
 	pub1.MakeNodeDiscoveryAddress("fakeid")
 	pub1.PublishNodeConfigure("fakeaddr", types.NodeAttrMap{})
+	pub1.PublishCreateNode("fakeaddr", types.NodeTypeAlarm, types.NodeAttrMap{})
+	pub1.PublishDeleteNode("fakeaddr")
 	pub1.PublishRaw(out1, true, "value")
+	pub1.PublishUpgrade("fakeaddr", "1.0", []byte("firmware"))
 	pub1.SetNodeConfigHandler(nil)
+	pub1.SetNodeCreateHandler(nil)
+	pub1.SetNodeDeleteHandler(nil)
+	pub1.SetNodeUpgradeHandler(nil)
 	pub1.SetSigningOnOff(true)
 	pub1.Subscribe("", "")
 	pub1.Unsubscribe("", "")
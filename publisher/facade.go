@@ -4,10 +4,15 @@
 package publisher
 
 import (
-	"crypto/ecdsa"
+	"context"
+	"crypto"
+	"strings"
 
+	"github.com/iotdomain/iotdomain-go/acl"
+	"github.com/iotdomain/iotdomain-go/identities"
 	"github.com/iotdomain/iotdomain-go/inputs"
 	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/messaging"
 	"github.com/iotdomain/iotdomain-go/nodes"
 	"github.com/iotdomain/iotdomain-go/outputs"
 	"github.com/iotdomain/iotdomain-go/types"
@@ -23,8 +28,13 @@ func (pub *Publisher) Address() string {
 
 // CreateInput creates a new node input that handle set commands and add it to the registered inputs
 //  If an input of the given nodeHWID, type and instance already exist it will be replaced. This returns the new input
+// or nil if the publisher keys cannot decrypt set commands, see CreateNode.
 func (pub *Publisher) CreateInput(nodeHWID string, inputType types.InputType, instance string,
 	setCommandHandler func(input *types.InputDiscoveryMessage, sender string, value string)) *types.InputDiscoveryMessage {
+	if err := pub.checkCanDecrypt("CreateInput"); err != nil {
+		logrus.Error(err)
+		return nil
+	}
 	input := pub.inputFromSetCommands.CreateInput(nodeHWID, inputType, instance, setCommandHandler)
 	return input
 }
@@ -35,6 +45,10 @@ func (pub *Publisher) CreateInputFromFile(
 	nodeHWID string, inputType types.InputType, instance string, path string,
 	handler func(input *types.InputDiscoveryMessage, sender string, value string)) *types.InputDiscoveryMessage {
 
+	if err := pub.checkCanDecrypt("CreateInputFromFile"); err != nil {
+		logrus.Error(err)
+		return nil
+	}
 	input := pub.inputFromFiles.CreateInput(nodeHWID, inputType, instance, path, handler)
 	return input
 }
@@ -44,6 +58,10 @@ func (pub *Publisher) CreateInputFromHTTP(
 	nodeHWID string, inputType types.InputType, instance string, url string, login string, password string, intervalSec int,
 	handler func(input *types.InputDiscoveryMessage, sender string, value string)) {
 
+	if err := pub.checkCanDecrypt("CreateInputFromHTTP"); err != nil {
+		logrus.Error(err)
+		return
+	}
 	input := pub.inputFromHTTP.CreateHTTPInput(
 		nodeHWID, inputType, instance, url, login, password, intervalSec, handler)
 	_ = input
@@ -54,14 +72,24 @@ func (pub *Publisher) CreateInputFromOutput(
 	nodeHWID string, inputType types.InputType, instance string, outputAddress string,
 	handler func(input *types.InputDiscoveryMessage, sender string, value string)) {
 
+	if err := pub.checkCanDecrypt("CreateInputFromOutput"); err != nil {
+		logrus.Error(err)
+		return
+	}
 	input := pub.inputFromOutputs.CreateInput(nodeHWID, inputType, instance, outputAddress, handler)
 
 	_ = input
 }
 
 // CreateNode creates a new node and add it to this publisher's registered nodes
-// returns the new node instance
+// Commands to nodes are encrypted for the publisher. Publishers with EdDSA keys cannot decrypt them
+// and cannot register nodes.
+// returns the new node instance, or nil if the publisher keys cannot decrypt commands
 func (pub *Publisher) CreateNode(nodeHWID string, nodeType types.NodeType) *types.NodeDiscoveryMessage {
+	if err := pub.checkCanDecrypt("CreateNode"); err != nil {
+		logrus.Error(err)
+		return nil
+	}
 	node := pub.registeredNodes.CreateNode(nodeHWID, nodeType)
 	return node
 }
@@ -74,8 +102,33 @@ func (pub *Publisher) CreateOutput(nodeHWID string, outputType types.OutputType,
 	return output
 }
 
-// DeleteNode deletes a node from the collection of registered nodes
+// DeleteInput deletes an input and stops listening to its source
+func (pub *Publisher) DeleteInput(inputID string) {
+	input := pub.registeredInputs.GetInputByID(inputID)
+	if input == nil {
+		return
+	}
+	source := input.Source
+	if source == "" {
+		pub.inputFromSetCommands.DeleteInput(inputID)
+	} else if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		pub.inputFromHTTP.DeleteInput(inputID)
+	} else if strings.HasSuffix(source, types.MessageTypeLatest) || strings.HasSuffix(source, types.MessageTypeRaw) {
+		pub.inputFromOutputs.DeleteInput(inputID)
+	} else {
+		pub.inputFromFiles.DeleteInput(input.NodeHWID, input.InputType, input.Instance)
+	}
+}
+
+// DeleteNode deletes a node and its inputs and outputs from this publisher.
+// Their discovery publications are removed from the message bus with the next heartbeat.
 func (pub *Publisher) DeleteNode(hwAddress string) {
+	for _, input := range pub.registeredInputs.GetInputsByNodeHWID(hwAddress) {
+		pub.DeleteInput(input.InputID)
+	}
+	for _, output := range pub.registeredOutputs.GetOutputsByNodeHWID(hwAddress) {
+		pub.registeredOutputs.DeleteOutput(output.OutputID)
+	}
 	pub.registeredNodes.DeleteNode(hwAddress)
 }
 
@@ -91,6 +144,14 @@ func (pub *Publisher) Domain() string {
 // 	return *ident
 // }
 
+// GetDomainForecast returns the most recent forecast of a discovered domain output
+//  forecastAddress is the output's $forecast address: domain/publisher/node/type/instance/$forecast
+// Returns nil if no forecast is received for the output
+func (pub *Publisher) GetDomainForecast(forecastAddress string) *types.OutputForecastMessage {
+	forecast, _ := pub.domainOutputValues.GetForecast(forecastAddress)
+	return forecast
+}
+
 // GetDomainInput returns a discovered domain input
 func (pub *Publisher) GetDomainInput(address string) *types.InputDiscoveryMessage {
 	return pub.domainInputs.GetInputByAddress(address)
@@ -101,6 +162,14 @@ func (pub *Publisher) GetDomainInputs() []*types.InputDiscoveryMessage {
 	return pub.domainInputs.GetAllInputs()
 }
 
+// GetDomainLatest returns the latest value of a discovered domain output
+//  latestAddress is the output's $latest address: domain/publisher/node/type/instance/$latest
+// Returns nil if no value is received for the output
+func (pub *Publisher) GetDomainLatest(latestAddress string) *types.OutputLatestMessage {
+	latest, _ := pub.domainOutputValues.GetLatest(latestAddress)
+	return latest
+}
+
 // GetDomainNode returns a discovered domain node by its address
 func (pub *Publisher) GetDomainNode(address string) *types.NodeDiscoveryMessage {
 	return pub.domainNodes.GetNodeByAddress(address)
@@ -121,6 +190,12 @@ func (pub *Publisher) GetDomainOutputs() []*types.OutputDiscoveryMessage {
 	return pub.domainOutputs.GetAllOutputs()
 }
 
+// GetDomainPublisher returns a discovered publisher identity by its identity address
+// Returns nil if the publisher is not known
+func (pub *Publisher) GetDomainPublisher(address string) *types.PublisherIdentityMessage {
+	return pub.domainIdentities.GetPublisherByAddress(address)
+}
+
 // GetDomainPublishers returns all discovered domain publishers
 func (pub *Publisher) GetDomainPublishers() []*types.PublisherIdentityMessage {
 	return pub.domainIdentities.GetAllPublishers()
@@ -153,7 +228,7 @@ func (pub *Publisher) GetIdentity() *types.PublisherIdentityMessage {
 }
 
 // GetIdentityKeys returns the private/public key pair of this publisher
-func (pub *Publisher) GetIdentityKeys() *ecdsa.PrivateKey {
+func (pub *Publisher) GetIdentityKeys() crypto.PrivateKey {
 	_, privKey := pub.registeredIdentity.GetFullIdentity()
 	return privKey
 }
@@ -250,7 +325,7 @@ func (pub *Publisher) GetOutputValueByID(outputID string) *types.OutputValue {
 
 // GetPublisherKey returns the public key of the publisher contained in the given address
 // The address must at least contain a domain and publisherId
-func (pub *Publisher) GetPublisherKey(address string) *ecdsa.PublicKey {
+func (pub *Publisher) GetPublisherKey(address string) crypto.PublicKey {
 	return pub.domainIdentities.GetPublisherKey(address)
 }
 
@@ -279,6 +354,56 @@ func (pub *Publisher) PublishNodeConfigure(domainNodeAddr string, attr types.Nod
 	return true
 }
 
+// PublishNodeConfigureWithAck publishes a $configure command to a domain node and waits for its
+// acknowledgement.
+//  ctx to limit the time to wait for the acknowledgement
+// Returns the acknowledgement with the result of the command, or an error if the destination
+// publisher has no public key, this publisher's keys cannot decrypt the acknowledgement, or no
+// acknowledgement is received in time
+func (pub *Publisher) PublishNodeConfigureWithAck(
+	ctx context.Context, domainNodeAddr string, attr types.NodeAttrMap) (*types.CommandAckMessage, error) {
+
+	if err := pub.checkCanDecrypt("PublishNodeConfigureWithAck"); err != nil {
+		return nil, err
+	}
+	destPubKey := pub.GetPublisherKey(domainNodeAddr)
+	if destPubKey == nil {
+		return nil, lib.MakeErrorf("PublishNodeConfigureWithAck: no public key found to encrypt command for node %s. Message not sent.", domainNodeAddr)
+	}
+	return pub.receiveAcks.WaitForAck(ctx, domainNodeAddr, func(correlationID string) error {
+		return nodes.PublishNodeConfigureWithCorrelationID(
+			domainNodeAddr, attr, pub.Address(), correlationID, pub.messageSigner, destPubKey)
+	})
+}
+
+// PublishCreateNode publishes a $create command to create a node on a remote publisher.
+//  nodeAddr is the address of the new node: domain/publisherID/nodeHWID
+//  This requires that the publisher identity of the remote publisher is known so the
+// command can be encrypted.
+// Returns error if the destination publisher is unknown and the message cannot be sent.
+func (pub *Publisher) PublishCreateNode(nodeAddr string, nodeType types.NodeType, attr types.NodeAttrMap) error {
+	destPubKey := pub.GetPublisherKey(nodeAddr)
+	if destPubKey == nil {
+		return lib.MakeErrorf("PublishCreateNode: no public key found to encrypt command for node %s"+
+			". Message not sent.", nodeAddr)
+	}
+	err := nodes.PublishCreateNode(nodeAddr, nodeType, attr, pub.Address(), pub.messageSigner, destPubKey)
+	return err
+}
+
+// PublishDeleteNode publishes a $delete command to delete a domain node
+//  This requires that the publisher identity of the node is known so the command can be encrypted.
+// Returns error if the destination publisher is unknown and the message cannot be sent.
+func (pub *Publisher) PublishDeleteNode(nodeAddr string) error {
+	destPubKey := pub.GetPublisherKey(nodeAddr)
+	if destPubKey == nil {
+		return lib.MakeErrorf("PublishDeleteNode: no public key found to encrypt command for node %s"+
+			". Message not sent.", nodeAddr)
+	}
+	err := nodes.PublishDeleteNode(nodeAddr, pub.Address(), pub.messageSigner, destPubKey)
+	return err
+}
+
 // // PublishNodeAlias publishes a command to set a node's alias
 // // The node's publisher must have been discovered
 // func (pub *Publisher) PublishNodeAlias(nodeAddr string, alias string) {
@@ -298,6 +423,27 @@ func (pub *Publisher) PublishOutputEvent(node *types.NodeDiscoveryMessage) error
 	return PublishOutputEvent(node, pub.registeredOutputs, pub.registeredOutputValues, pub.messageSigner)
 }
 
+// PublishSetIdentity publishes a new identity to the publisher it is issued to
+//  Intended for the DSS to issue and renew identities. This requires that the current identity of the
+// receiving publisher is known so the identity can be encrypted.
+// Returns error if the destination publisher is unknown and the message cannot be sent.
+func (pub *Publisher) PublishSetIdentity(fullIdentity *types.PublisherFullIdentity) error {
+	destPubKey := pub.GetPublisherKey(fullIdentity.Address)
+	if destPubKey == nil {
+		return lib.MakeErrorf("PublishSetIdentity: no public key found to encrypt identity for %s"+
+			". Message not sent.", fullIdentity.Address)
+	}
+	err := identities.PublishSetIdentity(fullIdentity, pub.messageSigner, destPubKey)
+	return err
+}
+
+// PublishRevocationList publishes the list of revoked publishers and keys of the domain
+// The list is signed by this publisher, which must be the DSS or one of the revocation admins.
+// It replaces the previously published list so it must contain all revocations.
+func (pub *Publisher) PublishRevocationList(revoked []types.RevokedPublisher) error {
+	return identities.PublishRevocationList(pub.Domain(), revoked, pub.Address(), pub.messageSigner)
+}
+
 // PublishSetInput publishes a $setInput input command to the given input address
 //  This requires that the publisher identity of the receiving input is known so the
 // command can be encrypted.
@@ -311,6 +457,28 @@ func (pub *Publisher) PublishSetInput(inputAddr string, value string) error {
 	return err
 }
 
+// PublishSetInputWithAck publishes a $setInput command to the given input address and waits for
+// its acknowledgement.
+//  ctx to limit the time to wait for the acknowledgement
+// Returns the acknowledgement with the result of the command, or an error if the destination
+// publisher has no public key, this publisher's keys cannot decrypt the acknowledgement, or no
+// acknowledgement is received in time
+func (pub *Publisher) PublishSetInputWithAck(
+	ctx context.Context, inputAddr string, value string) (*types.CommandAckMessage, error) {
+
+	if err := pub.checkCanDecrypt("PublishSetInputWithAck"); err != nil {
+		return nil, err
+	}
+	destPubKey := pub.GetPublisherKey(inputAddr)
+	if destPubKey == nil {
+		return nil, lib.MakeErrorf("PublishSetInputWithAck: no public key found to encrypt command for set input to %s. Message not sent.", inputAddr)
+	}
+	return pub.receiveAcks.WaitForAck(ctx, inputAddr, func(correlationID string) error {
+		return inputs.PublishSetInputWithCorrelationID(
+			inputAddr, value, pub.Address(), correlationID, pub.messageSigner, destPubKey)
+	})
+}
+
 // PublishSetNodeID publishes a set node ID command to the given node address
 //  This requires that the publisher identity of the receiving input is known so the
 // command can be encrypted.
@@ -325,13 +493,94 @@ func (pub *Publisher) PublishSetNodeID(nodeAddr string, newNodeID string) error
 	return err
 }
 
+// PublishUpgrade publishes a firmware upgrade command to the given node address
+//  This requires that the publisher identity of the node is known so the command can be encrypted.
+// Returns error if the destination publisher is unknown and the message cannot be sent.
+func (pub *Publisher) PublishUpgrade(nodeAddr string, fwVersion string, firmware []byte) error {
+	return pub.PublishUpgradeChunks(nodeAddr, fwVersion, firmware, 0, 0)
+}
+
+// PublishUpgradeChunks publishes a firmware upgrade command to the given node address in chunks
+// of chunkSize bytes, starting with chunk startChunk. Use a startChunk > 0 to resume an interrupted upgrade.
+// Returns error if the destination publisher is unknown and the message cannot be sent.
+func (pub *Publisher) PublishUpgradeChunks(
+	nodeAddr string, fwVersion string, firmware []byte, chunkSize int, startChunk int) error {
+
+	destPubKey := pub.GetPublisherKey(nodeAddr)
+	if destPubKey == nil {
+		return lib.MakeErrorf("PublishUpgradeChunks: no public key found to encrypt command for node %s"+
+			". Message not sent.", nodeAddr)
+	}
+	err := nodes.PublishUpgradeChunks(nodeAddr, fwVersion, firmware, chunkSize, startChunk,
+		pub.Address(), pub.messageSigner, destPubKey)
+	return err
+}
+
+// SetAuthorizer sets the authorizer of configure, create, delete, upgrade, set input and set node ID
+// commands. Denied commands are reported in the lastError status of the node, if it exists. Use nil
+// to allow all senders.
+func (pub *Publisher) SetAuthorizer(authorizer acl.Authorizer) {
+	pub.receiveCreateNode.SetAuthorizer(authorizer)
+	pub.receiveDeleteNode.SetAuthorizer(authorizer)
+	pub.receiveNodeConfigure.SetAuthorizer(authorizer)
+	pub.receiveSetNodeID.SetAuthorizer(authorizer)
+	pub.receiveUpgrade.SetAuthorizer(authorizer)
+	pub.inputFromSetCommands.SetAuthorizer(authorizer, func(nodeHWID string, errorMsg string) {
+		pub.registeredNodes.UpdateNodeStatus(nodeHWID,
+			map[types.NodeStatus]string{types.NodeStatusLastError: errorMsg})
+	})
+}
+
+// SetOutputReaders sets the publishers that are authorized to read the values of an output. The
+// output values are encrypted for these readers. Readers must use ECDSA identity keys as EdDSA keys
+// cannot decrypt.
+// When readers are set, the retained $raw value is removed and the $latest, $history and $forecast
+// values are republished encrypted on the next update.
+//  readers are the identity addresses of the authorized publishers, eg domain/publisherID/$identity.
+//  Use nil to publish the output values unencrypted.
+// Returns an error if the output doesn't exist or a known reader has EdDSA keys
+func (pub *Publisher) SetOutputReaders(outputID string, readers []string) error {
+	for _, reader := range readers {
+		readerKey := pub.GetPublisherKey(reader)
+		if messaging.GetKeyAlgorithm(readerKey) == messaging.KeyAlgorithmEdDSA {
+			return lib.MakeErrorf("SetOutputReaders: Reader %s has %s keys that cannot decrypt output values",
+				reader, messaging.KeyAlgorithmEdDSA)
+		}
+	}
+	err := pub.registeredOutputs.SetOutputReaders(outputID, readers)
+	if err != nil || len(readers) == 0 {
+		return err
+	}
+	output := pub.registeredOutputs.GetOutputByID(outputID)
+	if output != nil {
+		rawAddr := outputs.ReplaceMessageType(output.Address, types.MessageTypeRaw)
+		err = pub.messageSigner.RemovePublication(rawAddr)
+	}
+	pub.registeredOutputValues.MarkUpdated(outputID)
+	pub.registeredForecastValues.MarkUpdated(outputID)
+	return err
+}
+
+// SetRenewIdentityHandler sets the handler of requests to renew a publisher identity
+// Intended for the DSS, which receives requests to renew identities before they expire.
+func (pub *Publisher) SetRenewIdentityHandler(handler identities.RenewIdentityHandler) {
+	pub.receiveRenewIdentity.SetRenewIdentityHandler(handler)
+}
+
+// SetReplayGuard replaces the protection against replay of commands. Intended for replaying a
+// recording with messaging.NewPermissiveReplayGuard, see messaging.ReplayMessenger. Use before Start.
+func (pub *Publisher) SetReplayGuard(replayGuard *messaging.ReplayGuard) {
+	pub.replayGuard = replayGuard
+	pub.messageSigner.SetReplayGuard(replayGuard)
+}
+
 // SetSigningOnOff turns signing of publications on or off.
 //  The default is on (true)
 func (pub *Publisher) SetSigningOnOff(onOff bool) {
 	pub.messageSigner.SetSignMessages(onOff)
 }
 
-// Subscribe to receive nodes, inputs and outputs from the selected domain and/or publisher
+// Subscribe to receive nodes, inputs, outputs and output forecasts from the selected domain and/or publisher
 // To subscribe to all domains or all publishers use "" as the domain or publisherID
 func (pub *Publisher) Subscribe(domain string, publisherID string) {
 	// subscription address for all outputs domain/publisher/node/type/instance/$output
@@ -344,9 +593,10 @@ func (pub *Publisher) Subscribe(domain string, publisherID string) {
 	pub.domainNodes.Subscribe(domain, publisherID)
 	pub.domainInputs.Subscribe(domain, publisherID)
 	pub.domainOutputs.Subscribe(domain, publisherID)
+	pub.domainOutputValues.Subscribe(domain, publisherID)
 }
 
-// Unsubscribe from receiving nodes, inputs and outputs from the selected domain and/or publisher
+// Unsubscribe from receiving nodes, inputs, outputs and output forecasts from the selected domain and/or publisher
 // Use the same domain and publisherID as used in Subscribe
 func (pub *Publisher) Unsubscribe(domain string, publisherID string) {
 	// subscription address for all outputs domain/publisher/node/type/instance/$output
@@ -359,6 +609,7 @@ func (pub *Publisher) Unsubscribe(domain string, publisherID string) {
 	pub.domainNodes.Unsubscribe(domain, publisherID)
 	pub.domainInputs.Unsubscribe(domain, publisherID)
 	pub.domainOutputs.Unsubscribe(domain, publisherID)
+	pub.domainOutputValues.Unsubscribe(domain, publisherID)
 }
 
 // UpdateNodeErrorStatus sets a registered node RunState to the given status with a lasterror message
@@ -67,18 +67,23 @@ type InputDiscoveryMessage struct {
 
 // SetInputMessage to control an input
 type SetInputMessage struct {
-	Address   string `json:"address"` // zone/publisher/node/$set/type/instance
-	Timestamp string `json:"timestamp"`
-	Sender    string `json:"sender"` // sending node: zone/publisher/nodeId
-	Value     string `json:"value"`  // this can also be a string containing a list, eg "[ a, b, c ]""
+	Address       string `json:"address"`                 // zone/publisher/node/$set/type/instance
+	CorrelationID string `json:"correlationId,omitempty"` // optional ID to acknowledge the command with
+	Timestamp     string `json:"timestamp"`
+	Sender        string `json:"sender"` // sending node: zone/publisher/nodeId
+	Value         string `json:"value"`  // this can also be a string containing a list, eg "[ a, b, c ]""
 }
 
 // UpgradeFirmwareMessage with node firmware
+// Large firmware images can be sent in chunks. Each chunk carries its index, the total number of
+// chunks and the MD5 of the complete firmware.
 type UpgradeFirmwareMessage struct {
-	Address   string `json:"address"`   // message address
-	MD5       string `json:"md5"`       // firmware MD5
-	Firmware  []byte `json:"firmware"`  // firmware code
-	FWVersion string `json:"fwVersion"` // firmware version
-	Sender    string `json:"sender"`    // sending node: zone/publisher/nodeId
-	Timestamp string `json:"timestamp"`
+	Address    string `json:"address"`              // message address
+	ChunkCount int    `json:"chunkCount,omitempty"` // nr of chunks of the firmware, 0 or 1 when not chunked
+	ChunkIndex int    `json:"chunkIndex,omitempty"` // index of the chunk in Firmware, starting at 0
+	MD5        string `json:"md5"`                  // MD5 of the complete firmware, hex encoded
+	Firmware   []byte `json:"firmware"`             // firmware code or chunk thereof
+	FWVersion  string `json:"fwVersion"`            // firmware version
+	Sender     string `json:"sender"`               // sending node: zone/publisher/nodeId
+	Timestamp  string `json:"timestamp"`
 }
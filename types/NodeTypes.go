@@ -36,7 +36,8 @@ const (
 	NodeAttrName            NodeAttr = "name"            // Name of device or service
 	NodeAttrNetmask         NodeAttr = "netmask"         // IP network mask
 	NodeAttrPassword        NodeAttr = "password"        // password to connect. Value is not published.
-	NodeAttrPublishBatch    NodeAttr = "publishBatch"    // int with nr of events per batch, 0 to disable
+	NodeAttrPublishBatch    NodeAttr = "publishBatch"    // int with nr of events per batch, 0 to disable. Batching replaces raw, latest, history and event
+	NodeAttrPublishBatchAge NodeAttr = "publishBatchAge" // int, max age in seconds of a batch before it is published
 	NodeAttrPublishEvent    NodeAttr = "publishEvent"    // enable publishing as event
 	NodeAttrPublishForecast NodeAttr = "publishForecast" // bool, publish output with $forecast message
 	NodeAttrPublishHistory  NodeAttr = "publishHistory"  // bool, publish output with $history message
@@ -61,25 +62,27 @@ type NodeStatusMap map[NodeStatus]string
 // Various NodeStatus attributes that describe the recent status of the node
 // These indicate how the node is performing and are updated with each publication, typically once a day
 const (
-	NodeStatusErrorCount    NodeStatus = "errorCount"    // nr of errors reported on this device
-	NodeStatusHealth        NodeStatus = "health"        // health status of the device 0-100%
-	NodeStatusLastError     NodeStatus = "lastError"     // most recent error message, or "" if no error
-	NodeStatusLastSeen      NodeStatus = "lastSeen"      // ISO time the device was last seen
-	NodeStatusLatencyMSec   NodeStatus = "latencymsec"   // duration connect to sensor in milliseconds
-	NodeStatusNeighborCount NodeStatus = "neighborCount" // mesh network nr of neighbors
-	NodeStatusNeighborIDs   NodeStatus = "neighborIDs"   // mesh network device neighbors ID list [id,id,...]
-	NodeStatusRxCount       NodeStatus = "rxCount"       // Nr of messages received from device
-	NodeStatusTxCount       NodeStatus = "txCount"       // Nr of messages send to device
-	NodeStatusRunState      NodeStatus = "runState"      // Node run-state as per below
+	NodeStatusErrorCount      NodeStatus = "errorCount"      // nr of errors reported on this device
+	NodeStatusHealth          NodeStatus = "health"          // health status of the device 0-100%
+	NodeStatusLastError       NodeStatus = "lastError"       // most recent error message, or "" if no error
+	NodeStatusLastSeen        NodeStatus = "lastSeen"        // ISO time the device was last seen
+	NodeStatusLatencyMSec     NodeStatus = "latencymsec"     // duration connect to sensor in milliseconds
+	NodeStatusNeighborCount   NodeStatus = "neighborCount"   // mesh network nr of neighbors
+	NodeStatusNeighborIDs     NodeStatus = "neighborIDs"     // mesh network device neighbors ID list [id,id,...]
+	NodeStatusRxCount         NodeStatus = "rxCount"         // Nr of messages received from device
+	NodeStatusTxCount         NodeStatus = "txCount"         // Nr of messages send to device
+	NodeStatusRunState        NodeStatus = "runState"        // Node run-state as per below
+	NodeStatusUpgradeProgress NodeStatus = "upgradeProgress" // firmware upgrade progress 0-100%
 )
 
 // Values for Node State
 // These reflect whether a node is ready, sleeping or in error
 const (
-	NodeRunStateError    string = "error"    // Node reports an error
-	NodeRunStateReady    string = "ready"    // Node is ready for use
-	NodeRunStateSleeping string = "sleeping" // Node has gone into sleep mode, often a battery powered devie
-	NodeRunStateLost     string = "lost"     // Node is is no longer reachable
+	NodeRunStateError     string = "error"     // Node reports an error
+	NodeRunStateReady     string = "ready"     // Node is ready for use
+	NodeRunStateSleeping  string = "sleeping"  // Node has gone into sleep mode, often a battery powered devie
+	NodeRunStateLost      string = "lost"      // Node is is no longer reachable
+	NodeRunStateUpgrading string = "upgrading" // Node is receiving or installing a firmware upgrade
 )
 
 // NodeType identifying  the purpose of the node
@@ -137,12 +140,29 @@ type ConfigAttr struct {
 
 // NodeConfigureMessage with values to update a node configuration
 type NodeConfigureMessage struct {
-	Address   string      `json:"address"` // zone/publisher/node/$configure
-	Attr      NodeAttrMap `json:"attr"`    // attributes to configure
-	Sender    string      `json:"sender"`  // sending node: zone/publisher/node
+	Address       string      `json:"address"`                 // zone/publisher/node/$configure
+	Attr          NodeAttrMap `json:"attr"`                    // attributes to configure
+	CorrelationID string      `json:"correlationId,omitempty"` // optional ID to acknowledge the command with
+	Sender        string      `json:"sender"`                  // sending node: zone/publisher/node
+	Timestamp     string      `json:"timestamp"`
+}
+
+// NodeCreateMessage with command to create a new node
+type NodeCreateMessage struct {
+	Address   string      `json:"address"`        // zone/publisher/node/$create - address of the new node
+	Attr      NodeAttrMap `json:"attr,omitempty"` // initial configuration of the new node
+	NodeType  NodeType    `json:"nodeType"`       // type of node to create
+	Sender    string      `json:"sender"`         // sending node: zone/publisher/node
 	Timestamp string      `json:"timestamp"`
 }
 
+// NodeDeleteMessage with command to delete an existing node
+type NodeDeleteMessage struct {
+	Address   string `json:"address"` // zone/publisher/node/$delete - address of the node to delete
+	Sender    string `json:"sender"`  // sending node: zone/publisher/node
+	Timestamp string `json:"timestamp"`
+}
+
 // NodeDiscoveryMessage definition published in node discovery
 type NodeDiscoveryMessage struct {
 	Address   string        `json:"address"`          // Node discovery address using NodeID
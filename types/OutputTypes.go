@@ -143,14 +143,17 @@ const (
 // 	OutputTypeWindSpeed:              {DataType: DataTypeNumber, DefaultUnit: UnitSpeed, UnitValues: UnitValuesSpeed},
 // }
 
+// OutputBatchEvent with the node output values of a single event in a batch
+type OutputBatchEvent struct {
+	Timestamp string            `json:"timestamp"` // Timestamp of the event
+	Event     map[string]string `json:"event"`     // event values by output type/instance
+}
+
 // OutputBatchMessage message with multiple output events
 type OutputBatchMessage struct {
-	Address string `json:"address"` // Address of the publication: zone/publisher/node/$output/type/instance
-	Batch   []struct {
-		Timestasmp string            // Tunestamp if event
-		Event      map[string]string // event values
-	} `json:"batch"` // time ordered list of events
-	Timestamp string `json:"timestamp"` // timestamp the batch is created
+	Address   string             `json:"address"`   // Address of the publication: zone/publisher/node/$batch
+	Batch     []OutputBatchEvent `json:"batch"`     // time ordered list of events
+	Timestamp string             `json:"timestamp"` // timestamp the batch is created
 }
 
 // OutputDiscoveryMessage with node output description
@@ -170,6 +173,7 @@ type OutputDiscoveryMessage struct {
 	PublisherID string     `json:"-"`
 	OutputType  OutputType `json:"-"`
 	Instance    string     `json:"-"`
+	Readers     []string   `json:"-"` // identity addresses of publishers authorized to read the output values
 }
 
 // OutputEventMessage message with multiple output values
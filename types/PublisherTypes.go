@@ -17,9 +17,31 @@ const (
 	PublisherRunStateLost         PublisherRunState = "lost"         // Publisher unexpectedly disconnected
 )
 
+// AckStatus is the result of a command reported in its acknowledgement
+type AckStatus string
+
+// AckStatus values
+const (
+	AckStatusAccepted AckStatus = "accepted" // Command is passed to the application handler
+	AckStatusApplied  AckStatus = "applied"  // Command is applied by the receiving publisher
+	AckStatusRejected AckStatus = "rejected" // Command is rejected, the error describes the reason
+)
+
+// CommandAckMessage acknowledges the receipt of a command that has a correlation ID
+// This message is signed by the publisher that received the command and encrypted for the sender of the command
+type CommandAckMessage struct {
+	Address       string    `json:"address"`         // publication address of this message, eg domain/publisherId/$ack of the command sender
+	CorrelationID string    `json:"correlationId"`   // correlation ID of the command
+	Error         string    `json:"error,omitempty"` // reason the command is rejected
+	Sender        string    `json:"sender"`          // identity address of the publisher that received the command
+	Status        AckStatus `json:"status"`          // result of the command
+	Timestamp     string    `json:"timestamp"`       // timestamp this message was created
+}
+
 // PublisherIdentityMessage contains the public identity of a publisher
 type PublisherIdentityMessage struct {
 	Address           string `json:"address"`               // publication address of this identity, eg domain/publisherId/\$identity
+	Algorithm         string `json:"algorithm,omitempty"`   // algorithm of the public key: ES256 (default), ES384 or EdDSA
 	Certificate       string `json:"certificate,omitempty"` // optional x509 cert base64 encoded
 	Domain            string `json:"domain"`                // IoT domain name for this publisher
 	IssuerID          string `json:"issuerId"`              // Issuer of the identity, the DSS, publisherId or CA
@@ -41,6 +63,32 @@ type PublisherFullIdentity struct {
 	Sender     string `json:"sender"`     // sender of this update, usually the DSS
 }
 
+// RenewIdentityMessage with a request to the DSS to renew the sender's identity before it expires
+// This message MUST be signed by the publisher whose identity is to be renewed.
+type RenewIdentityMessage struct {
+	Address    string `json:"address"`    // publication address of this message, eg domain/$dss/$renewIdentity
+	Sender     string `json:"sender"`     // identity address of the publisher requesting renewal
+	Timestamp  string `json:"timestamp"`  // timestamp this message was created
+	ValidUntil string `json:"validUntil"` // expiry of the publisher's current identity
+}
+
+// RevokedPublisher describes a publisher or a publisher key that is revoked
+// If a public key is provided then only that key is revoked, otherwise the publisher itself is revoked.
+type RevokedPublisher struct {
+	Address   string `json:"address"`             // identity address of the revoked publisher, eg domain/publisherId/$identity
+	PublicKey string `json:"publicKey,omitempty"` // revoked public key in PEM format, eg when the key is compromised
+	Revoked   string `json:"revoked"`             // timestamp of the revocation
+}
+
+// RevocationListMessage with the revoked publishers and keys of a domain
+// This message MUST be signed by the DSS or a revocation admin
+type RevocationListMessage struct {
+	Address   string             `json:"address"`   // publication address of this message, eg domain/$dss/$revocations
+	Revoked   []RevokedPublisher `json:"revoked"`   // the full list of revoked publishers and keys
+	Sender    string             `json:"sender"`    // identity address of the DSS or admin publishing the list
+	Timestamp string             `json:"timestamp"` // timestamp this message was created
+}
+
 // PublisherStatusMessage containing 'alive' status, used in LWT
 type PublisherStatusMessage struct {
 	Address string            `json:"address"` // publication address of this message